@@ -0,0 +1,261 @@
+package carsclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Car is a car in the inventory, as the API serves it.
+type Car struct {
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model"`
+	VIN          string     `json:"vin"`
+	RegNo        string     `json:"regno"`
+	Dealer       string     `json:"dealer,omitempty"`
+	Branch       string     `json:"branch,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	Order        string     `json:"order,omitempty"`
+	Hold         *Hold      `json:"hold,omitempty"`
+	SoldAt       *time.Time `json:"sold_at,omitempty"`
+	ListedAt     *time.Time `json:"listed_at,omitempty"`
+	Price        *Price     `json:"price,omitempty"`
+	Mileage      int        `json:"mileage,omitempty"`
+	Year         int        `json:"year,omitempty"`
+	FuelType     string     `json:"fuel_type,omitempty"`
+	Transmission string     `json:"transmission,omitempty"`
+	Colour       string     `json:"colour,omitempty"`
+	Condition    string     `json:"condition,omitempty"`
+	Images       []Image    `json:"images,omitempty"`
+	// DisplayPrice is the price in ListOptions.Currency; it is never sent.
+	DisplayPrice *DisplayPrice `json:"display_price,omitempty"`
+	DeletedAt    *time.Time    `json:"deleted_at,omitempty"`
+	// Revision counts the writes made to the car. UpdateCar and DeleteCar
+	// only write the car at the revision read, when it is set.
+	Revision int64 `json:"revision"`
+}
+
+// Price is an asking price in the minor unit of its currency, e.g. pence.
+type Price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// DisplayPrice is a price converted to another currency at Rate.
+type DisplayPrice struct {
+	Amount   int64   `json:"amount"`
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+}
+
+// Hold reserves a car until a time.
+type Hold struct {
+	Until      time.Time `json:"until"`
+	By         string    `json:"by,omitempty"`
+	CustomerID string    `json:"customer_id,omitempty"`
+	Note       string    `json:"note,omitempty"`
+}
+
+// Image is a photo of a car.
+type Image struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// CarPage is one page of a listing.
+type CarPage struct {
+	Cars   []Car `json:"cars"`
+	Total  int64 `json:"total"`
+	Limit  int   `json:"limit"`
+	Page   *int  `json:"page,omitempty"`
+	Offset *int  `json:"offset,omitempty"`
+	// NextCursor, passed as ListOptions.Cursor, lists the next page; it is
+	// empty on the last page, and when listing by offset.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListOptions narrows and pages a listing. The zero value of a field leaves
+// it out.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Page   int
+	// Cursor is the NextCursor of the previous page. Paging by cursor is
+	// asked for with UseCursor, to list the first page.
+	Cursor    string
+	UseCursor bool
+	// Sort is comma separated fields, each prefixed with - for descending.
+	Sort   string
+	Fields []string
+	// Query searches the cars' text.
+	Query string
+
+	Manufacturer string
+	Model        string
+	RegNo        string
+	Dealer       string
+	Branch       string
+	PriceMin     int64
+	PriceMax     int64
+	MileageMax   int
+	YearMin      int
+	YearMax      int
+	FuelType     string
+	Transmission string
+	Colour       string
+	Condition    string
+	Status       string
+	Currency     string
+
+	IncludeDeleted  bool
+	IncludeArchived bool
+}
+
+// values returns the listing parameters of o.
+func (o *ListOptions) values() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	str := func(name, v string) {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	num := func(name string, n int64) {
+		if n != 0 {
+			q.Set(name, strconv.FormatInt(n, 10))
+		}
+	}
+	flag := func(name string, b bool) {
+		if b {
+			q.Set(name, "true")
+		}
+	}
+
+	num("limit", int64(o.Limit))
+	num("offset", int64(o.Offset))
+	num("page", int64(o.Page))
+	if o.UseCursor || o.Cursor != "" {
+		q.Set("cursor", o.Cursor)
+	}
+	str("sort", o.Sort)
+	str("fields", strings.Join(o.Fields, ","))
+	str("q", o.Query)
+	str("manufacturer", o.Manufacturer)
+	str("model", o.Model)
+	str("regno", o.RegNo)
+	str("dealer", o.Dealer)
+	str("branch", o.Branch)
+	num("price_min", o.PriceMin)
+	num("price_max", o.PriceMax)
+	num("mileage_max", int64(o.MileageMax))
+	num("year_min", int64(o.YearMin))
+	num("year_max", int64(o.YearMax))
+	str("fuel_type", o.FuelType)
+	str("transmission", o.Transmission)
+	str("colour", o.Colour)
+	str("condition", o.Condition)
+	str("status", o.Status)
+	str("currency", o.Currency)
+	flag("include_deleted", o.IncludeDeleted)
+	flag("include_archived", o.IncludeArchived)
+	return q
+}
+
+// ListCars returns the page of the cars matching opts; nil lists the first
+// page of all of them.
+func (c *Client) ListCars(ctx context.Context, opts *ListOptions) (*CarPage, error) {
+	var page CarPage
+	_, err := c.call(ctx, request{method: http.MethodGet, path: "/cars", query: opts.values(), retry: true}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetCar returns the car with the VIN.
+func (c *Client) GetCar(ctx context.Context, vin string) (*Car, error) {
+	var car Car
+	_, err := c.call(ctx, request{method: http.MethodGet, path: carPath(vin), retry: true}, &car)
+	if err != nil {
+		return nil, err
+	}
+	return &car, nil
+}
+
+// CreateCar adds car and sets its Revision to that it was stored at. The
+// request is sent with a new Idempotency-Key, so retrying it cannot add the
+// car twice.
+func (c *Client) CreateCar(ctx context.Context, car *Car) error {
+	return c.CreateCarWithKey(ctx, car, newIdempotencyKey())
+}
+
+// CreateCarWithKey is CreateCar with the Idempotency-Key given, for a caller
+// that retries the creation itself, e.g. after restarting, to pass the key
+// of its first attempt.
+func (c *Client) CreateCarWithKey(ctx context.Context, car *Car, key string) error {
+	resp, err := c.call(ctx, request{
+		method: http.MethodPost,
+		path:   "/cars",
+		header: http.Header{"Idempotency-Key": {key}},
+		body:   car,
+		retry:  true,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if rev, ok := revision(resp); ok {
+		car.Revision = rev
+	}
+	return nil
+}
+
+// UpdateCar replaces the car with car, identified by its VIN, and returns it
+// as it was stored. When car.Revision is set, the car is only replaced at
+// that revision; otherwise whatever was written since is overwritten, and
+// the request is not retried.
+func (c *Client) UpdateCar(ctx context.Context, car *Car) (*Car, error) {
+	req := request{method: http.MethodPut, path: carPath(car.VIN), body: car}
+	if car.Revision > 0 {
+		req.header = ifMatch(car.Revision)
+		req.retry = true
+	}
+	var updated Car
+	if _, err := c.call(ctx, req, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteCar deletes the car with the VIN, only at revision rev when it is
+// not zero. Deleted cars can be restored by an admin.
+func (c *Client) DeleteCar(ctx context.Context, vin string, rev int64) error {
+	req := request{method: http.MethodDelete, path: carPath(vin), retry: true}
+	if rev > 0 {
+		req.header = ifMatch(rev)
+	}
+	_, err := c.call(ctx, req, nil)
+	return err
+}
+
+func carPath(vin string) string {
+	return "/cars/" + url.PathEscape(vin)
+}
+
+// ifMatch is the precondition of a write to a car at revision rev, whose
+// ETag is the revision quoted.
+func ifMatch(rev int64) http.Header {
+	return http.Header{"If-Match": {`"` + strconv.FormatInt(rev, 10) + `"`}}
+}
+
+// revision returns the revision in the ETag of resp.
+func revision(resp *http.Response) (int64, bool) {
+	rev, err := strconv.ParseInt(strings.Trim(resp.Header.Get("ETag"), `"`), 10, 64)
+	return rev, err == nil
+}
@@ -0,0 +1,267 @@
+// Package carsclient calls the Car Supermarket API, so that services need
+// not build its requests by hand. The methods follow the API's OpenAPI
+// document, served at /openapi.json.
+//
+// A Client retries the requests that can safely be sent again when the API
+// is unavailable, rate limits them or cannot be reached: reads, writes made
+// to a revision, and creations, which carry an Idempotency-Key that stays
+// the same across attempts.
+//
+//	c := &carsclient.Client{URL: "https://cars.example.com", APIKey: key}
+//	page, err := c.ListCars(ctx, &carsclient.ListOptions{Manufacturer: "Ford", Limit: 50})
+//	for _, car := range page.Cars {
+//		...
+//	}
+package carsclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"problem"
+)
+
+// apiVersion is the version of the API the client speaks.
+const apiVersion = "v1"
+
+// DefaultMaxRetries is how many times a request is retried when a Client's
+// MaxRetries is zero.
+const DefaultMaxRetries = 3
+
+const (
+	retryBackoff    = 250 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+// Client calls the API at URL with the credentials set. Its zero value,
+// with URL set, is ready to use; it may be used by several goroutines.
+type Client struct {
+	// URL is the root of the API, including any base path it is mounted
+	// under, e.g. https://cars.example.com.
+	URL string
+	// APIKey, or else Token, a bearer token, authenticates the requests.
+	APIKey string
+	Token  string
+	// Sign signs each request with APIKey rather than sending it, so that
+	// the request cannot be replayed; keys minted as signed must be.
+	Sign bool
+	// Tenant is the tenant to act for, when the credentials are not bound
+	// to one.
+	Tenant string
+	// HTTP makes the requests; nil uses http.DefaultClient.
+	HTTP *http.Client
+	// MaxRetries is how many times a request that can be retried is; zero
+	// uses DefaultMaxRetries and a negative value none.
+	MaxRetries int
+}
+
+// Error is an error response of the API, with the problem it reported.
+// Switch on Code rather than Detail, which is for people.
+type Error struct {
+	Method string
+	Path   string
+	problem.Details
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Detail)
+}
+
+// IsNotFound reports whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 from the API, such as a write to a
+// revision of a car that is no longer its current one, or a 412, which a
+// delete at such a revision fails with.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && (e.Status == http.StatusConflict || e.Status == http.StatusPreconditionFailed)
+}
+
+// request is a call to the API, relative to its versioned root.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	// body is sent as JSON when it is not nil.
+	body interface{}
+	// retry says the request may be sent again, having no further effect.
+	retry bool
+}
+
+// do sends req, retrying it as its retry allows, and returns the response
+// when its status is 2xx. Otherwise it returns an *Error.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+	u := strings.TrimSuffix(c.URL, "/") + "/" + apiVersion + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	retries := c.MaxRetries
+	switch {
+	case !req.retry || retries < 0:
+		retries = 0
+	case retries == 0:
+		retries = DefaultMaxRetries
+	}
+	delay := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req, u, body)
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		if err == nil {
+			err = responseError(req, resp)
+		}
+		wait, retry := retryAfter(err, resp, delay)
+		if !retry || attempt == retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		delay = time.Duration(math.Min(float64(2*delay), float64(maxRetryBackoff)))
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, u string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		hr.Header[name] = values
+	}
+	hr.Header.Set("Accept", "application/json")
+	if body != nil {
+		hr.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.APIKey != "" && c.Sign:
+		sig, err := signature(c.APIKey, time.Now(), req.method, hr.URL.RequestURI(), body)
+		if err != nil {
+			return nil, err
+		}
+		hr.Header.Set("X-API-Signature", sig)
+	case c.APIKey != "":
+		hr.Header.Set("X-API-Key", c.APIKey)
+	case c.Token != "":
+		hr.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Tenant != "" {
+		hr.Header.Set("X-Tenant-ID", c.Tenant)
+	}
+
+	h := c.HTTP
+	if h == nil {
+		h = http.DefaultClient
+	}
+	return h.Do(hr)
+}
+
+// responseError reads the problem of an error response and closes it.
+func responseError(req request, resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{Method: req.method, Path: req.path}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&e.Details)
+	e.Status = resp.StatusCode
+	return e
+}
+
+// retryAfter says whether a request that failed with err may succeed when
+// sent again, and after how long: not before the response's Retry-After,
+// if it has one, else after delay.
+func retryAfter(err error, resp *http.Response, delay time.Duration) (time.Duration, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		// The API could not be reached, or the connection broke.
+		return delay, true
+	}
+	switch {
+	case e.Status == http.StatusTooManyRequests && e.Code == problem.CodeRateLimited:
+	case e.Status == http.StatusConflict && e.Code == problem.CodeInProgress:
+	case e.Status == http.StatusBadGateway, e.Status == http.StatusServiceUnavailable, e.Status == http.StatusGatewayTimeout:
+	default:
+		return 0, false
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	return delay, true
+}
+
+// call sends req and decodes the JSON body of its response into out, if it
+// is not nil.
+func (c *Client) call(ctx context.Context, req request, out interface{}) (*http.Response, error) {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return resp, nil
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signature returns the X-API-Signature header of a request signed with
+// key at t. Each attempt is signed afresh, with a nonce of its own.
+func signature(key string, t time.Time, method, uri string, body []byte) (string, error) {
+	id, secret, ok := strings.Cut(key, ".")
+	if !ok {
+		return "", errors.New("carsclient: API key is not <id>.<secret>")
+	}
+	nonce := newIdempotencyKey()
+	secretHash := sha256.Sum256([]byte(secret))
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(hex.EncodeToString(secretHash[:])))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", t.Unix(), nonce, method, uri, hex.EncodeToString(bodyHash[:]))
+	return fmt.Sprintf("key=%s,t=%d,nonce=%s,v1=%s", id, t.Unix(), nonce, hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// newIdempotencyKey returns a random key, for a creation to be retried
+// without adding the car twice.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
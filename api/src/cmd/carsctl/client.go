@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"problem"
+)
+
+// apiVersion is the version of the API carsctl speaks.
+const apiVersion = "v1"
+
+// client calls the API with an operator's credentials.
+type client struct {
+	url    string
+	apiKey string
+	token  string
+	tenant string
+	// http has no timeout, as an export of a large inventory takes a while.
+	http http.Client
+}
+
+// do makes a request to path, relative to the versioned API root, and
+// returns the response when its status is 2xx. Otherwise it returns the
+// problem the API reported.
+func (c *client) do(method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := c.url + "/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.authorize(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var p problem.Details
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || p.Detail == "" {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, path, p.Detail)
+}
+
+// authorize sets the credentials and tenant of req.
+func (c *client) authorize(req *http.Request) {
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("X-API-Key", c.apiKey)
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+}
+
+// call makes a request with a JSON body, if in is not nil, and decodes the
+// JSON response into out, if it is not nil.
+func (c *client) call(method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+
+	resp, err := c.do(method, path, query, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseFilter turns name=value arguments into listing parameters.
+func parseFilter(args []string) (url.Values, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("filter %q is not name=value", arg)
+		}
+		query.Add(name, value)
+	}
+	return query, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// seedBatchSize is how many cars are added per request; the API takes at
+// most 5000.
+const seedBatchSize = 1000
+
+// seed adds the cars in a file holding a JSON array of them, in batches.
+func seed(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: carsctl seed FILE")
+	}
+	b, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var cars []json.RawMessage
+	if err := json.Unmarshal(b, &cars); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	created, failed := 0, 0
+	for start := 0; start < len(cars); start += seedBatchSize {
+		end := min(start+seedBatchSize, len(cars))
+		var report struct {
+			Created int
+			Failed  int
+			Results []struct {
+				Index   int
+				VIN     string
+				Status  string
+				Message string
+			}
+		}
+		if err := c.call(http.MethodPost, "/cars/batch", nil, cars[start:end], &report); err != nil {
+			return err
+		}
+		created += report.Created
+		failed += report.Failed
+		for _, res := range report.Results {
+			if res.Status != "created" {
+				fmt.Fprintf(os.Stderr, "car %d (%s): %s %s\n", start+res.Index, res.VIN, res.Status, res.Message)
+			}
+		}
+	}
+	fmt.Printf("%d cars added, %d failed\n", created, failed)
+	return nil
+}
+
+// importCSV uploads a CSV file to the import endpoint, streaming it so that
+// large files are not held in memory.
+func importCSV(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: carsctl import FILE")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file", filepath.Base(args[0]))
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := c.do(http.MethodPost, "/cars/import", nil, form.FormDataContentType(), pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report struct {
+		Imported int
+		Rejected []struct {
+			Line    int
+			VIN     string
+			Message string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+	for _, row := range report.Rejected {
+		fmt.Fprintf(os.Stderr, "line %d (%s): %s\n", row.Line, row.VIN, row.Message)
+	}
+	fmt.Printf("%d cars imported, %d rejected\n", report.Imported, len(report.Rejected))
+	return nil
+}
+
+// export writes the cars matching a filter to standard output, as NDJSON by
+// default or as a CSV or Excel file.
+func export(c *client, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "ndjson", "ndjson, csv or xlsx")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	query, err := parseFilter(flags.Args())
+	if err != nil {
+		return err
+	}
+	query.Set("format", *format)
+
+	path := "/cars/export"
+	if *format == "ndjson" {
+		path = "/cars"
+	}
+	resp, err := c.do(http.MethodGet, path, query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func reindex(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: carsctl reindex")
+	}
+	if err := c.call(http.MethodPost, "/admin/reindex", nil, nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("Indexes built")
+	return nil
+}
+
+// listMigrations lists the migrations applied and pending. The API applies
+// pending migrations as it starts.
+func listMigrations(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: carsctl migrations")
+	}
+	var status struct {
+		Applied []struct {
+			Version   int
+			Name      string
+			AppliedAt string `json:"applied_at"`
+		}
+		Pending []struct {
+			Version int
+			Name    string
+		}
+	}
+	if err := c.call(http.MethodGet, "/admin/migrations", nil, nil, &status); err != nil {
+		return err
+	}
+	for _, m := range status.Applied {
+		fmt.Printf("%4d  applied %s  %s\n", m.Version, m.AppliedAt, m.Name)
+	}
+	for _, m := range status.Pending {
+		fmt.Printf("%4d  pending  %s\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+// deleteByFilter deletes the cars matching a filter one by one, as the API
+// deletes them: they can be restored until they are archived. With -dry-run
+// it only lists them.
+func deleteByFilter(c *client, args []string) error {
+	flags := flag.NewFlagSet("delete-by-filter", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the cars that would be deleted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Deleting the whole inventory by leaving the filter out is too easy a
+	// mistake to allow.
+	if flags.NArg() == 0 {
+		return errors.New("usage: carsctl delete-by-filter [-dry-run] name=value ...")
+	}
+	query, err := parseFilter(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	// The VINs are all listed before any car is deleted, so that deletions
+	// do not move the cars yet to be listed between pages.
+	query.Set("fields", "vin")
+	query.Set("limit", "100")
+	query.Set("cursor", "")
+	var vins []string
+	for {
+		var page struct {
+			Cars       []struct{ VIN string }
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := c.call(http.MethodGet, "/cars", query, nil, &page); err != nil {
+			return err
+		}
+		for _, car := range page.Cars {
+			vins = append(vins, car.VIN)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+
+	for _, vin := range vins {
+		if *dryRun {
+			fmt.Println(vin)
+			continue
+		}
+		if err := c.call(http.MethodDelete, "/cars/"+url.PathEscape(vin), nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	if *dryRun {
+		fmt.Printf("%d cars would be deleted\n", len(vins))
+	} else {
+		fmt.Printf("%d cars deleted\n", len(vins))
+	}
+	return nil
+}
+
+func stats(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: carsctl stats")
+	}
+	var s json.RawMessage
+	if err := c.call(http.MethodGet, "/stats", nil, nil, &s); err != nil {
+		return err
+	}
+	return printJSON(s)
+}
+
+// backupSummary is what the commands print of a backup manifest.
+type backupSummary struct {
+	Name        string
+	CreatedAt   string `json:"created_at"`
+	Collections []struct {
+		Collection string
+		Documents  int64
+		Bytes      int64
+	}
+}
+
+func (b backupSummary) print() {
+	fmt.Printf("%s  %s\n", b.Name, b.CreatedAt)
+	for _, c := range b.Collections {
+		fmt.Printf("    %-8s %8d documents %10d bytes\n", c.Collection, c.Documents, c.Bytes)
+	}
+}
+
+func backup(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: carsctl backup")
+	}
+	var m backupSummary
+	if err := c.call(http.MethodPost, "/admin/backups", nil, nil, &m); err != nil {
+		return err
+	}
+	m.print()
+	return nil
+}
+
+func listBackups(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: carsctl backups")
+	}
+	var manifests []backupSummary
+	if err := c.call(http.MethodGet, "/admin/backups", nil, nil, &manifests); err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		m.print()
+	}
+	return nil
+}
+
+// restore replaces the tenant's data with a backup. The API refuses unless it
+// is in maintenance mode, which is left for the operator to turn on and off.
+func restore(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: carsctl restore NAME")
+	}
+	var m backupSummary
+	if err := c.call(http.MethodPost, "/admin/backups/"+url.PathEscape(args[0])+"/restore", nil, nil, &m); err != nil {
+		return err
+	}
+	fmt.Println("Restored")
+	m.print()
+	return nil
+}
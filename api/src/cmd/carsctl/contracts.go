@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"contract"
+)
+
+// contracts replays the exchanges recorded by a server with
+// RECORD_CONTRACTS_DIR against the API, and reports those it no longer
+// answers as it did: with another status or content type, or a body of
+// another shape. Only reads are replayed unless -writes is given, as writes
+// change the data replayed against.
+func contracts(c *client, args []string) error {
+	flags := flag.NewFlagSet("contracts", flag.ContinueOnError)
+	writes := flags.Bool("writes", false, "replay writes too, in the order recorded per route")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: carsctl contracts [-writes] DIR")
+	}
+
+	var files []string
+	err := filepath.WalkDir(flags.Arg(0), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".json" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	replayed, broken := 0, 0
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var ex contract.Exchange
+		if err := json.Unmarshal(b, &ex); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if !*writes && ex.Method != http.MethodGet && ex.Method != http.MethodHead {
+			continue
+		}
+
+		diffs, err := c.replay(ex)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		replayed++
+		if len(diffs) > 0 {
+			broken++
+			fmt.Printf("BROKEN %s %s (%s)\n", ex.Method, ex.Route, file)
+			for _, d := range diffs {
+				fmt.Printf("    %s\n", d)
+			}
+		}
+	}
+	fmt.Printf("%d exchanges replayed, %d broken\n", replayed, broken)
+	if broken > 0 {
+		return fmt.Errorf("%d of %d contracts broken", broken, replayed)
+	}
+	return nil
+}
+
+// replay makes the request of ex and returns how the response differs from
+// the one recorded.
+func (c *client) replay(ex contract.Exchange) ([]string, error) {
+	u := c.url + ex.Path
+	if ex.Query != "" {
+		u += "?" + ex.Query
+	}
+	var body io.Reader
+	if len(ex.Body) > 0 {
+		body = bytes.NewReader(ex.Body)
+	}
+	req, err := http.NewRequest(ex.Method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range ex.Header {
+		req.Header.Set(name, v)
+	}
+	c.authorize(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if resp.StatusCode != ex.Response.Status {
+		diffs = append(diffs, fmt.Sprintf("status: was %d, now %d", ex.Response.Status, resp.StatusCode))
+	}
+	if want, now := ex.Response.Header["Content-Type"], resp.Header.Get("Content-Type"); want != now {
+		diffs = append(diffs, fmt.Sprintf("Content-Type: was %q, now %q", want, now))
+	}
+	return append(diffs, contract.Compare(ex.Response.Body, got)...), nil
+}
@@ -0,0 +1,95 @@
+// Command carsctl manages the inventory through the API, so that operators
+// need not run commands against the database by hand. Writes go through the
+// same validation, audit log and events as any other client's.
+//
+// Usage:
+//
+//	carsctl [flags] <command> [arguments]
+//
+// The commands are:
+//
+//	seed FILE                     add the cars in a JSON array
+//	import FILE                   import the cars in a CSV file
+//	export [-format F] [FILTER]   write the matching cars to standard output
+//	reindex                       build the API's indexes again
+//	migrations                    list the migrations applied and pending
+//	delete-by-filter [-dry-run] FILTER
+//	                              delete the matching cars
+//	stats                         sum up the inventory
+//	backup                        back up the tenant's data
+//	backups                       list the tenant's backups
+//	restore NAME                  replace the tenant's data with a backup; the
+//	                              API must be in maintenance mode
+//	contracts [-writes] DIR       replay the exchanges a server recorded and
+//	                              report those no longer answered alike
+//
+// A FILTER is one or more name=value listing parameters, such as
+// manufacturer=Ford year_max=2010. Every flag has an environment variable
+// named after it, e.g. -api-key and CARSCTL_API_KEY.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	flags := flag.NewFlagSet("carsctl", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: carsctl [flags] seed|import|export|reindex|migrations|delete-by-filter|stats|backup|backups|restore|contracts [arguments]")
+		flags.PrintDefaults()
+	}
+	c := &client{}
+	flags.StringVar(&c.url, "url", env("CARSCTL_URL", "http://localhost:8080"), "URL of the API, including any base path")
+	flags.StringVar(&c.apiKey, "api-key", env("CARSCTL_API_KEY", ""), "API key to authenticate with")
+	flags.StringVar(&c.token, "token", env("CARSCTL_TOKEN", ""), "bearer token to authenticate with, instead of an API key")
+	flags.StringVar(&c.tenant, "tenant", env("CARSCTL_TENANT", ""), "tenant to act for, when the credentials are not bound to one")
+	flags.Parse(os.Args[1:])
+	c.url = strings.TrimSuffix(c.url, "/")
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func(*client, []string) error{
+		"seed":             seed,
+		"import":           importCSV,
+		"export":           export,
+		"reindex":          reindex,
+		"migrations":       listMigrations,
+		"delete-by-filter": deleteByFilter,
+		"stats":            stats,
+		"backup":           backup,
+		"backups":          listBackups,
+		"restore":          restore,
+		"contracts":        contracts,
+	}
+	command, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "carsctl: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := command(c, flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "carsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func env(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// printJSON writes v to standard output as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,1503 @@
+// Package config loads the API's settings from command line flags and
+// environment variables.
+//
+// Every flag has an environment variable named after it in upper snake case,
+// e.g. -mongo-uri and MONGO_URI. Flags take precedence over the environment,
+// which takes precedence over the defaults. The variables may also be set in
+// the file at CONFIG_FILE, which is read again when the configuration is
+// reloaded, and takes precedence over the environment.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cron"
+	"qr"
+	"regno"
+)
+
+// Config holds the settings of the API server.
+type Config struct {
+	// ConfigFile holds NAME=value lines, as the environment would, to take
+	// precedence over it. Of its settings, those the server reloads take
+	// effect when it is read again.
+	ConfigFile string
+
+	MongoURI               string
+	DBName                 string
+	CarsCollection         string
+	ArchiveCollection      string
+	APIKeysCollection      string
+	RolesCollection        string
+	AuditCollection        string
+	PriceHistoryCollection string
+	DealershipsCollection  string
+	CustomersCollection    string
+	TestDrivesCollection   string
+	OrdersCollection       string
+	// ReservationsCollection holds the holds on cars, each removed by a TTL
+	// index once it expires.
+	ReservationsCollection   string
+	ServiceHistoryCollection string
+	TradeInsCollection       string
+	// SavedSearchesCollection holds the listing searches people save to be
+	// alerted to new cars matching.
+	SavedSearchesCollection string
+	// FavoritesCollection holds the cars on people's watchlists.
+	FavoritesCollection string
+	// StockLevelsCollection holds the count of each model's cars by status,
+	// and StockAlertsCollection the thresholds purchasing is told of them
+	// falling below.
+	StockLevelsCollection string
+	StockAlertsCollection string
+	// WebhooksCollection holds the webhooks partners register, and
+	// WebhookDeliveriesCollection what was sent to them, for
+	// WebhookDeliveryRetention. A delivery is given up after
+	// WebhookMaxAttempts attempts of at most WebhookTimeout each.
+	WebhooksCollection          string
+	WebhookDeliveriesCollection string
+	WebhookDeliveryRetention    time.Duration
+	WebhookMaxAttempts          int
+	WebhookTimeout              time.Duration
+	// NotificationsCollection holds the emails and text messages sent to
+	// customers and watchers, for NotificationRetention. A notification is
+	// given up after NotificationMaxAttempts attempts. Templates of their
+	// text are read from NotificationTemplatesFile, in place of the
+	// built-in ones, and the times in them given in NotificationTimeZone.
+	// Customers are reminded of test drives TestDriveReminderLead before
+	// they start; 0 sends no reminders.
+	NotificationsCollection   string
+	NotificationRetention     time.Duration
+	NotificationMaxAttempts   int
+	NotificationTemplatesFile string
+	NotificationTimeZone      string
+	TestDriveReminderLead     time.Duration
+	// Email is sent through the SMTP server at SMTPAddr, from SMTPFrom, and
+	// text messages through the Twilio account TwilioAccountSID, from
+	// TwilioFrom. Neither is sent when its provider is not configured.
+	SMTPAddr         string
+	SMTPUsername     string
+	SMTPPassword     string
+	SMTPFrom         string
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFrom       string
+	// OutboxCollection keeps inventory events until they are sent to the
+	// webhooks and event bus, and for OutboxRetention after.
+	OutboxCollection string
+	OutboxRetention  time.Duration
+	// AnalyticsCollection holds the views and clicks of listings the
+	// storefront sends, for AnalyticsRetention.
+	AnalyticsCollection string
+	AnalyticsRetention  time.Duration
+	// Storage is where the cars the car endpoints serve are kept: "mongo",
+	// in CarsCollection, or "memory", in the process, for demos and CI,
+	// losing them on exit. With memory no database is connected to: only
+	// GET and POST /cars and GET, PUT, PATCH and DELETE /cars/{vin} are
+	// served, without credentials, and every other operation answers 501.
+	// PostgreSQL, at PostgresURL, is only a ShadowStorage for now, as the
+	// car batch, import, image, export and order endpoints, among others,
+	// still query CarsCollection themselves.
+	Storage     string
+	PostgresURL string
+	// SlowQueryThreshold is how long an operation of the car storage takes
+	// to be logged as slow, and listed by /admin/slow-queries; zero logs
+	// none.
+	SlowQueryThreshold time.Duration
+	// ShadowStorage, when set, is another storage of the cars, by the same
+	// names, tried out against Storage on the routes its feature flags are
+	// on for; ShadowLogSample is the fraction of divergences logged.
+	ShadowStorage   string
+	ShadowLogSample float64
+	// MigrationsCollection records the migrations applied. With MigrateOnly
+	// the server applies them, makes the indexes and exits, for running
+	// migrations as a job ahead of a deploy.
+	MigrationsCollection string
+	MigrateOnly          bool
+	// SchemaValidation is what MongoDB does with a car written to the cars
+	// or archive collection that does not match the shape the API expects:
+	// "error" refuses it, "warn" logs it and "off" does not check.
+	SchemaValidation string
+	// TestDriveNoShowGrace is how late a customer may be checked in for a
+	// test drive before its slot is released.
+	TestDriveNoShowGrace time.Duration
+	// MongoTimeout bounds each attempt to reach MongoDB, which is retried
+	// with backoff for MongoStartupWait at startup. MongoQueryTimeout bounds
+	// every database operation; zero leaves them to the request's deadline.
+	MongoTimeout         time.Duration
+	MongoStartupWait     time.Duration
+	MongoQueryTimeout    time.Duration
+	MongoRetryReads      bool
+	MongoRetryWrites     bool
+	MaxPoolSize          uint64
+	MinPoolSize          uint64
+	MongoMaxConnIdleTime time.Duration
+	// BreakerThreshold is how many failed heartbeats in a row open the
+	// database circuit breaker, which fails requests fast with 503 until
+	// it has probed the database again after BreakerCooldown. Zero turns
+	// it off.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// IdempotencyCollection holds the results of requests made with an
+	// Idempotency-Key for IdempotencyTTL.
+	IdempotencyCollection string
+	IdempotencyTTL        time.Duration
+
+	ListenAddr   string
+	BasePath     string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// Compression is that of responses of CompressionMinSize bytes or more:
+	// "gzip", "zstd", for zstd to clients that accept it and gzip to the
+	// others, or "off".
+	Compression        string
+	CompressionMinSize int
+	// RequestTimeout is the deadline of each request, except the streams
+	// and bulk transfers; zero sets none.
+	RequestTimeout time.Duration
+
+	ShutdownTimeout time.Duration
+
+	// ConsulAddr is the URL of the Consul agent the API registers with once
+	// it is ready to serve, and deregisters from on shutdown; empty turns
+	// registration off. ConsulServiceAddress is the address registered,
+	// the host name when empty.
+	ConsulAddr           string
+	ConsulToken          string
+	ConsulServiceName    string
+	ConsulServiceAddress string
+	ConsulServiceTags    []string
+	ConsulCheckInterval  time.Duration
+
+	// MaintenanceMode starts the API read-only; it is switched at runtime
+	// through /admin/maintenance.
+	MaintenanceMode bool
+	// FaultInjection lets admins inject latency, dropped connections and
+	// errors into requests through /admin/faults, to try clients out
+	// against; never for production.
+	FaultInjection bool
+	// RecordContractsDir, when set, has up to RecordContractsPerRoute
+	// exchanges of each route recorded there, sanitized, as golden files
+	// for carsctl contracts to replay; for staging only.
+	RecordContractsDir      string
+	RecordContractsPerRoute int
+
+	// FeatureFlags turn feature flags on or off by name in this
+	// environment. Admins override them, for the environment or a tenant,
+	// through /admin/feature-flags, kept in FeatureFlagsCollection.
+	FeatureFlags           map[string]bool
+	FeatureFlagsCollection string
+
+	// RegNoFormats are the formats, or groups of them such as gb, the
+	// registrations of cars written must be in; none allow any.
+	// TenantRegNoFormats replace them for the tenants named.
+	RegNoFormats       regno.Set
+	TenantRegNoFormats map[string]regno.Set
+
+	// RequireTenant rejects requests that name no tenant; otherwise they act
+	// for DefaultTenant, which also owns data stored before tenancy.
+	RequireTenant bool
+	DefaultTenant string
+
+	// GRPCListenAddr is where the gRPC service listens; empty turns it off.
+	GRPCListenAddr string
+	// DebugListenAddr is where the profiling and runtime diagnostics of
+	// admins are served, apart from the API; empty turns them off.
+	DebugListenAddr string
+
+	// HTTPS is served with the certificate in TLSCertFile and TLSKeyFile, or
+	// with certificates obtained from Let's Encrypt for TLSAutocertHosts.
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSAutocertHosts    []string
+	TLSAutocertCacheDir string
+	// TLSClientCAFile verifies client certificates; RequireClientCert makes
+	// one mandatory for writes.
+	TLSClientCAFile   string
+	RequireClientCert bool
+	// HSTSMaxAge is how long browsers are told to use only HTTPS, on the
+	// responses sent over it; zero sends no Strict-Transport-Security.
+	HSTSMaxAge time.Duration
+	// AdminCSP is the Content-Security-Policy of the admin UI.
+	AdminCSP string
+	// MaxBodySize is the largest request body read, in bytes, and
+	// BatchMaxBodySize that of a batch of cars. Uploads have their own.
+	MaxBodySize      int64
+	BatchMaxBodySize int64
+
+	// CORSAllowedOrigins lists the browser origins allowed to call the API;
+	// "*" allows any, and none turns CORS off.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	CORSExposedHeaders []string
+	CORSMaxAge         time.Duration
+
+	// RateLimit is the sustained requests per second allowed per client;
+	// zero turns rate limiting off. RateLimitStore is where clients' buckets
+	// are kept: "local", in each instance, or "redis", shared by every
+	// instance through RedisURL.
+	RateLimit      float64
+	RateBurst      int
+	RateLimitStore string
+	// PublicAPI serves the read-only listing API under /public to anyone,
+	// for the storefront, rate limited per client IP by PublicRateLimit and
+	// PublicRateBurst apart from the rest of the API. Its responses may be
+	// cached for PublicMaxAge, and are signed with PublicSigningSecret when
+	// set.
+	PublicAPI           bool
+	PublicRateLimit     float64
+	PublicRateBurst     int
+	PublicMaxAge        time.Duration
+	PublicSigningSecret string
+	// MaxInFlight is how many requests an instance serves at once, and
+	// RouteMaxInFlight how many of them may be to each route pattern, under
+	// the API version; zero, or a route left out, is unlimited. Requests
+	// beyond them are refused with 503.
+	MaxInFlight      int
+	RouteMaxInFlight map[string]int
+	// APIKeyDailyQuota and APIKeyMonthlyQuota are the requests an API key
+	// minted without its own quota may make each UTC day and month; zero is
+	// unlimited. Usage is counted in UsageCollection.
+	APIKeyDailyQuota   int64
+	APIKeyMonthlyQuota int64
+	UsageCollection    string
+
+	// CacheTTL is how long car reads are cached for; zero turns the cache
+	// off. The cache is shared through Redis when RedisURL is set, which
+	// RateLimitStore may share too.
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+	RedisURL        string
+
+	// ValuationProvider names what values cars; only "depreciation", a model
+	// run in process, for now. Valuations are cached for ValuationCacheTTL.
+	ValuationProvider string
+	ValuationCacheTTL time.Duration
+
+	// ExchangeRatesURL is the JSON API prices are converted with, in which
+	// {base} is replaced by the currency converted from; with none, only the
+	// rates set by hand in ExchangeRatesCollection are used. Fetched rates
+	// are cached for ExchangeRatesTTL.
+	ExchangeRatesURL        string
+	ExchangeRatesTTL        time.Duration
+	ExchangeRatesCollection string
+
+	// FuzzySearch is what ?fuzzy=true searches with: "ngram", matching the
+	// words of manufacturers and models by trigrams in process, or "atlas",
+	// the Atlas Search index AtlasSearchIndex on the cars collection.
+	FuzzySearch      string
+	AtlasSearchIndex string
+
+	// RegLookupURL is the DVLA Vehicle Enquiry Service endpoint registrations
+	// are looked up at; lookups are off when it is empty. RegLookupEnrich
+	// fills in the details of cars as they are added.
+	RegLookupURL      string
+	RegLookupAPIKey   string
+	RegLookupEnrich   bool
+	RegLookupCacheTTL time.Duration
+
+	// MOTHistoryURL is the DVSA MOT history API endpoint, to which the
+	// registration is appended; MOT history is off when it is empty.
+	MOTHistoryURL      string
+	MOTHistoryAPIKey   string
+	MOTHistoryCacheTTL time.Duration
+
+	// LenderProfilesFile is a JSON file of the lender profiles finance is
+	// quoted on; a single standard profile is used when it is empty.
+	LenderProfilesFile string
+
+	// FeedsFile is a JSON file of listing feeds, added to the built-in
+	// AutoTrader and Facebook ones or replacing those of their names.
+	// FeedListingURL is the storefront page of a car in feeds, with {vin}
+	// standing for its VIN, and FeedImageBaseURL the public URL of the API
+	// image links are made absolute with.
+	FeedsFile        string
+	FeedListingURL   string
+	FeedImageBaseURL string
+
+	// QRListingURL is the listing page QR codes of cars link to, with {vin}
+	// standing for the VIN, or FeedListingURL when empty. They are drawn
+	// QRSize pixels wide at error correction level QRErrorCorrection, L, M,
+	// Q or H, unless a request asks otherwise.
+	QRListingURL      string
+	QRSize            int
+	QRErrorCorrection string
+
+	// BrochureBrand heads car brochures, on a band of BrochureColour, an
+	// #rrggbb colour. BrochureTemplateFile is a text/template of their
+	// text, in place of the built-in one. Brochures are cached for
+	// BrochureCacheTTL.
+	BrochureBrand        string
+	BrochureColour       string
+	BrochureTemplateFile string
+	BrochureCacheTTL     time.Duration
+
+	// LogLevel is the lowest level logged, until an admin changes it. Of
+	// each debug message, the first records each second are logged, then
+	// one in LogDebugSampling, or none when it is 0.
+	LogLevel         slog.Level
+	LogOutput        string
+	LogDebugSampling int
+
+	OTLPEndpoint string
+
+	// EventBus is where inventory events are published: "kafka", to
+	// KafkaTopic through the Kafka REST Proxy at KafkaRESTURL, or "nats",
+	// to the server at NATSURL under the NATSSubject prefix. Empty turns
+	// publishing off.
+	EventBus     string
+	KafkaRESTURL string
+	KafkaTopic   string
+	NATSURL      string
+	NATSSubject  string
+
+	JWKSURL     string
+	JWTIssuer   string
+	JWTAudience string
+	RequireAuth bool
+	// RequestSignatureSkew is how far the time of a request signed with an
+	// API key may be from the server's; zero refuses signed requests. The
+	// nonces of signed requests are kept in NoncesCollection for twice as
+	// long, to reject replays.
+	RequestSignatureSkew time.Duration
+	NoncesCollection     string
+	// AdminSubjects always have the admin role.
+	AdminSubjects []string
+
+	// UsersCollection holds the users who sign in with a password, and
+	// RefreshTokensCollection the refresh tokens they are issued.
+	UsersCollection         string
+	RefreshTokensCollection string
+	// SessionSigningKey signs the access tokens issued at login. Without one
+	// a key is made at startup, and the tokens are only accepted by the
+	// instance that issued them, until it restarts.
+	SessionSigningKey string
+	SessionTTL        time.Duration
+	RefreshTokenTTL   time.Duration
+	// BootstrapAdmin is made an admin user of the default tenant, with
+	// BootstrapAdminPassword, when there is no user of that name, so that
+	// the first users can be made.
+	BootstrapAdmin         string
+	BootstrapAdminPassword string
+
+	// OIDCIssuer is the identity provider users may sign in with instead,
+	// found by OIDC discovery. Its tokens are accepted for API calls, in
+	// place of those verified with JWKSURL, and people signing in to the
+	// admin UI are sent to it with the code flow and back to
+	// OIDCRedirectURL. OIDCGroupRoles gives the role of each IdP group, as
+	// named in the OIDCGroupsClaim claim of tokens.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCGroupRoles   map[string]string
+	// OIDCPostLoginURL is where people are sent once signed in.
+	OIDCPostLoginURL string
+
+	ArchiveRetention time.Duration
+
+	// AgingThresholds are the days in stock GET /reports/aging buckets cars
+	// by, ascending. PriceReviewDays, when set, has cars in stock that long
+	// without a change of price flagged for review each day.
+	AgingThresholds []int
+	PriceReviewDays int
+
+	// SimilarWeights weigh what GET /cars/:vin/similar scores cars by:
+	// "manufacturer", "model", "price" and "mileage".
+	SimilarWeights map[string]float64
+
+	// JobSchedules override the schedules of background jobs by name, with
+	// a cron expression, a shorthand such as "@every 5m", or "off".
+	JobSchedules map[string]string
+	// LeaderLeaseTTL is how long the lease in LeasesCollection electing the
+	// instance that runs the background jobs lasts unrenewed; zero has
+	// every instance run every job.
+	LeaderLeaseTTL   time.Duration
+	LeasesCollection string
+
+	// ImageRenditions are the smaller copies made of each car photo on
+	// upload, by name, with the longest edge in pixels each may have.
+	ImageRenditions map[string]int
+
+	// PhotoStore is where the bytes of photos are kept: "gridfs", "dir",
+	// under PhotoDir, or "s3", in PhotoS3Bucket. PhotoS3LinkTTL, when set,
+	// has S3 photos downloaded straight from the bucket with pre-signed URLs
+	// valid that long.
+	PhotoStore       string
+	PhotoDir         string
+	PhotoS3Bucket    string
+	PhotoS3Region    string
+	PhotoS3Endpoint  string
+	PhotoS3AccessKey string
+	PhotoS3SecretKey string
+	PhotoS3LinkTTL   time.Duration
+	// The documents of cars are kept where photos are. DocumentRoles gives
+	// the role that may see and upload each kind in place of its default,
+	// and DocumentScanURL, when set, is the service each document is posted
+	// to, to be scanned for viruses before it is kept.
+	DocumentRoles   map[string]string
+	DocumentScanURL string
+
+	// Backups are written to BackupDir, or to BackupS3Bucket in
+	// BackupS3Region through BackupS3Endpoint when it is set, for an
+	// S3-compatible store; with neither, backups are off.
+	BackupDir         string
+	BackupS3Bucket    string
+	BackupS3Region    string
+	BackupS3Endpoint  string
+	BackupS3AccessKey string
+	BackupS3SecretKey string
+
+	// Accounting exports of the orders completed each month are pushed to
+	// AccountingExportDir, to AccountingExportS3Bucket as backups are or to
+	// the SFTP server at AccountingExportSFTPAddr, in each of
+	// AccountingLayouts; with none of them they can only be downloaded.
+	AccountingExportDir         string
+	AccountingExportS3Bucket    string
+	AccountingExportS3Region    string
+	AccountingExportS3Endpoint  string
+	AccountingExportS3AccessKey string
+	AccountingExportS3SecretKey string
+	// The SFTP server must present AccountingExportSFTPHostKey, a public
+	// key in authorized_keys format, and is signed in to as
+	// AccountingExportSFTPUser with the private key in
+	// AccountingExportSFTPKeyFile or else AccountingExportSFTPPassword.
+	AccountingExportSFTPAddr     string
+	AccountingExportSFTPUser     string
+	AccountingExportSFTPPassword string
+	AccountingExportSFTPKeyFile  string
+	AccountingExportSFTPHostKey  string
+	AccountingExportSFTPDir      string
+	// AccountingLayouts are the columns of each layout of the exports, by
+	// name: a field, or field:Header for a column headed other than by its
+	// field. Without any, exports have every field.
+	AccountingLayouts map[string][]string
+	// AccountingDateLayout is the Go time layout dates are written in.
+	AccountingDateLayout string
+
+	// SeedCars cars generated from SeedValue are added to the default
+	// tenant's inventory at startup if it is empty, for demo environments.
+	SeedCars  int
+	SeedValue int64
+
+	// Mock serves the API from MockCars generated cars kept in memory, and
+	// data made up for every other endpoint, without a database, for
+	// frontends to be developed against. Each request takes MockLatency,
+	// give or take a quarter, and MockErrorRate of them fail.
+	Mock          bool
+	MockCars      int
+	MockLatency   time.Duration
+	MockErrorRate float64
+}
+
+// Load parses args (without the program name) and the environment.
+func Load(args []string) (*Config, error) {
+	c := &Config{}
+
+	fs := flag.NewFlagSet("carsupermarket", flag.ContinueOnError)
+	fs.StringVar(&c.ConfigFile, "config-file", "", "file of NAME=value settings, which take precedence over the environment and are reloaded on SIGHUP")
+	fs.StringVar(&c.MongoURI, "mongo-uri", "mongodb://mongo:27017", "MongoDB connection string")
+	fs.StringVar(&c.DBName, "db-name", "carsupermarket", "database holding the inventory")
+	fs.StringVar(&c.Storage, "storage", "mongo", "where the cars are kept: mongo, or memory, which is lost on exit and serves the car endpoints alone")
+	fs.DurationVar(&c.SlowQueryThreshold, "slow-query-threshold", 500*time.Millisecond, "how long a car storage operation takes to be logged as slow; 0 logs none")
+	fs.StringVar(&c.ShadowStorage, "shadow-storage", "", "storage, mongo, postgres or memory, the car routes with shadow feature flags on also read from and write to, to compare; empty for none")
+	fs.Float64Var(&c.ShadowLogSample, "shadow-log-sample", 0.1, "fraction, from 0 to 1, of shadow storage divergences logged")
+	fs.StringVar(&c.PostgresURL, "postgres-url", "", "Postgres connection string, e.g. postgres://cars@db/cars, when STORAGE is postgres")
+	fs.StringVar(&c.CarsCollection, "cars-collection", "cars", "collection holding the cars in stock")
+	fs.StringVar(&c.ArchiveCollection, "archive-collection", "archive", "collection holding archived sold cars")
+	fs.StringVar(&c.APIKeysCollection, "api-keys-collection", "api_keys", "collection holding API keys")
+	fs.StringVar(&c.RolesCollection, "roles-collection", "roles", "collection holding role assignments")
+	fs.StringVar(&c.AuditCollection, "audit-collection", "audit", "collection holding the audit trail of inventory changes")
+	fs.StringVar(&c.PriceHistoryCollection, "price-history-collection", "price_history", "collection holding every change of the cars' prices")
+	fs.StringVar(&c.CustomersCollection, "customers-collection", "customers", "collection holding customers and their enquiries and purchases")
+	fs.StringVar(&c.TestDrivesCollection, "test-drives-collection", "test_drives", "collection holding test drive bookings")
+	fs.DurationVar(&c.TestDriveNoShowGrace, "test-drive-no-show-grace", 15*time.Minute, "how late a test drive may be started before its slot is released")
+	fs.StringVar(&c.OrdersCollection, "orders-collection", "orders", "collection holding the orders cars are sold through")
+	fs.StringVar(&c.ReservationsCollection, "reservations-collection", "reservations", "collection holding the holds on cars until they expire")
+	fs.StringVar(&c.TradeInsCollection, "trade-ins-collection", "trade_ins", "collection holding the cars customers offer in part-exchange")
+	fs.StringVar(&c.SavedSearchesCollection, "saved-searches-collection", "saved_searches", "collection holding the searches people save")
+	fs.StringVar(&c.FavoritesCollection, "favorites-collection", "favorites", "collection holding the cars on people's watchlists")
+	fs.StringVar(&c.StockLevelsCollection, "stock-levels-collection", "stock_levels", "collection holding the count of each model's cars by status")
+	fs.StringVar(&c.StockAlertsCollection, "stock-alerts-collection", "stock_alerts", "collection holding the low stock alerts on models")
+	fs.StringVar(&c.WebhooksCollection, "webhooks-collection", "webhooks", "collection holding the webhooks partners register")
+	fs.StringVar(&c.WebhookDeliveriesCollection, "webhook-deliveries-collection", "webhook_deliveries", "collection holding the deliveries made to webhooks")
+	fs.DurationVar(&c.WebhookDeliveryRetention, "webhook-delivery-retention", 7*24*time.Hour, "how long webhook deliveries are kept for debugging")
+	fs.IntVar(&c.WebhookMaxAttempts, "webhook-max-attempts", 10, "attempts made at a webhook delivery before it is given up")
+	fs.DurationVar(&c.WebhookTimeout, "webhook-timeout", 10*time.Second, "how long a webhook endpoint has to answer a delivery")
+	fs.StringVar(&c.NotificationsCollection, "notifications-collection", "notifications", "collection holding the notifications sent to customers and watchers")
+	fs.DurationVar(&c.NotificationRetention, "notification-retention", 90*24*time.Hour, "how long notifications are kept")
+	fs.IntVar(&c.NotificationMaxAttempts, "notification-max-attempts", 5, "attempts made at sending a notification before it is given up")
+	fs.StringVar(&c.NotificationTemplatesFile, "notification-templates-file", "", "JSON file of notification templates replacing the built-in ones")
+	fs.StringVar(&c.NotificationTimeZone, "notification-time-zone", "Europe/London", "time zone of the times written in notifications")
+	fs.DurationVar(&c.TestDriveReminderLead, "test-drive-reminder-lead", 24*time.Hour, "how long before a test drive the customer is reminded of it; 0 sends no reminders")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", "", "host:port of the SMTP server notifications are emailed through; none are emailed when empty")
+	fs.StringVar(&c.SMTPUsername, "smtp-username", "", "username to authenticate with the SMTP server")
+	fs.StringVar(&c.SMTPPassword, "smtp-password", "", "password to authenticate with the SMTP server")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", "", "address notifications are emailed from, e.g. \"Car Supermarket <sales@example.com>\"")
+	fs.StringVar(&c.TwilioAccountSID, "twilio-account-sid", "", "Twilio account text message notifications are sent through; none are sent when empty")
+	fs.StringVar(&c.TwilioAuthToken, "twilio-auth-token", "", "auth token of the Twilio account")
+	fs.StringVar(&c.TwilioFrom, "twilio-from", "", "number, or messaging service SID, text messages are sent from")
+	fs.StringVar(&c.OutboxCollection, "outbox-collection", "outbox", "collection keeping inventory events until they are sent to webhooks and the event bus")
+	fs.DurationVar(&c.OutboxRetention, "outbox-retention", 7*24*time.Hour, "how long events sent from the outbox are kept for inspection")
+	fs.StringVar(&c.AnalyticsCollection, "analytics-collection", "analytics", "collection holding the views and clicks of listings")
+	fs.DurationVar(&c.AnalyticsRetention, "analytics-retention", 90*24*time.Hour, "how long views and clicks of listings are kept")
+	fs.StringVar(&c.ServiceHistoryCollection, "service-history-collection", "service_history", "collection holding the service, MOT and repair records of cars")
+	fs.StringVar(&c.DealershipsCollection, "dealerships-collection", "dealerships", "collection holding the dealerships stock is held at")
+	fs.StringVar(&c.MigrationsCollection, "migrations-collection", "migrations", "collection recording the migrations applied")
+	fs.BoolVar(&c.MigrateOnly, "migrate-only", false, "apply the migrations, make the indexes and exit")
+	fs.StringVar(&c.SchemaValidation, "schema-validation", "error", "what MongoDB does with cars written in the wrong shape: error, warn or off")
+	fs.StringVar(&c.IdempotencyCollection, "idempotency-collection", "idempotency_keys", "collection holding the results of requests made with an Idempotency-Key")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long the result of a request made with an Idempotency-Key is replayed")
+	fs.DurationVar(&c.MongoTimeout, "mongo-timeout", 10*time.Second, "timeout for connecting to MongoDB and selecting a server")
+	fs.DurationVar(&c.MongoStartupWait, "mongo-startup-wait", 2*time.Minute, "how long to keep retrying to reach MongoDB at startup")
+	fs.DurationVar(&c.MongoQueryTimeout, "mongo-query-timeout", 0, "timeout for each database operation; 0 has none")
+	fs.BoolVar(&c.MongoRetryReads, "mongo-retry-reads", true, "retry reads once after a network error or failover")
+	fs.BoolVar(&c.MongoRetryWrites, "mongo-retry-writes", true, "retry writes once after a network error or failover")
+	fs.Uint64Var(&c.MaxPoolSize, "mongo-max-pool-size", 100, "maximum number of MongoDB connections")
+	fs.Uint64Var(&c.MinPoolSize, "mongo-min-pool-size", 0, "minimum number of idle MongoDB connections")
+	fs.DurationVar(&c.MongoMaxConnIdleTime, "mongo-max-conn-idle-time", 0, "how long a MongoDB connection may sit idle before it is closed; 0 keeps it")
+	fs.IntVar(&c.BreakerThreshold, "breaker-threshold", 3, "failed MongoDB heartbeats in a row that open the circuit breaker; 0 turns it off")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", 10*time.Second, "how long the circuit breaker stays open before probing the database")
+	fs.StringVar(&c.ListenAddr, "listen-addr", ":8080", "address the HTTP server listens on")
+	fs.StringVar(&c.BasePath, "base-path", "", "path prefix of every route, for serving behind a reverse proxy")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 15*time.Second, "maximum time to read a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 0, "maximum time to write a response; 0 allows long-lived event streams")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 60*time.Second, "how long keep-alive connections stay open")
+	fs.StringVar(&c.Compression, "compression", "gzip", "compression of responses: gzip, zstd (with gzip for clients without it) or off")
+	fs.IntVar(&c.CompressionMinSize, "compression-min-size", 1400, "smallest response in bytes that is compressed")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", 30*time.Second, "deadline of each request other than streams and bulk transfers; 0 sets none")
+	fs.StringVar(&c.GRPCListenAddr, "grpc-listen-addr", ":9090", "address the gRPC service listens on; empty turns it off")
+	fs.DurationVar(&c.HSTSMaxAge, "hsts-max-age", 180*24*time.Hour, "max-age of Strict-Transport-Security on HTTPS responses; 0 sends none")
+	fs.Int64Var(&c.MaxBodySize, "max-body-size", 1<<20, "largest request body in bytes, other than batches and uploads")
+	fs.Int64Var(&c.BatchMaxBodySize, "batch-max-body-size", 8<<20, "largest body in bytes of a batch of cars")
+	fs.StringVar(&c.AdminCSP, "admin-csp", "default-src 'self'; frame-ancestors 'none'; form-action 'self'", "Content-Security-Policy of the admin UI")
+	fs.StringVar(&c.DebugListenAddr, "debug-listen-addr", "", "address pprof and expvar are served on to admins, e.g. 127.0.0.1:6060; empty turns them off")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long in-flight requests may take to finish on shutdown")
+	fs.StringVar(&c.ConsulAddr, "consul-addr", "", "URL of the Consul agent to register with, e.g. http://127.0.0.1:8500; empty turns registration off")
+	fs.StringVar(&c.ConsulToken, "consul-token", "", "ACL token of the Consul agent")
+	fs.StringVar(&c.ConsulServiceName, "consul-service-name", "carsupermarket", "service name registered with Consul")
+	fs.StringVar(&c.ConsulServiceAddress, "consul-service-address", "", "address registered with Consul; empty registers the host name")
+	listVar(fs, &c.ConsulServiceTags, "consul-service-tags", "comma separated tags registered with Consul")
+	fs.DurationVar(&c.ConsulCheckInterval, "consul-check-interval", 10*time.Second, "how often Consul checks /readyz")
+	fs.BoolVar(&c.MaintenanceMode, "maintenance-mode", false, "start read-only, refusing writes with 503 until maintenance is turned off")
+	fs.BoolVar(&c.FaultInjection, "fault-injection", false, "let admins inject faults into requests through /admin/faults, for staging")
+	fs.StringVar(&c.RecordContractsDir, "record-contracts-dir", "", "directory to record sanitized exchanges of each route to, as golden files for contract tests; none are recorded when empty")
+	fs.IntVar(&c.RecordContractsPerRoute, "record-contracts-per-route", 5, "exchanges recorded of each route and method")
+	fs.Func("feature-flags", `comma separated flag=on|off pairs of the feature flags in this environment, e.g. "fuzzy_search=off,problem_details=on"`, func(v string) error {
+		flags, err := parseFeatureFlags(v)
+		c.FeatureFlags = flags
+		return err
+	})
+	fs.StringVar(&c.FeatureFlagsCollection, "feature-flags-collection", "feature_flags", "collection holding the feature flags set by admins")
+	fs.Func("regno-formats", "comma separated registration formats of "+strings.Join(regno.Names(), ", ")+" that registrations must be in; empty allows any", func(v string) error {
+		formats, err := regno.Parse(v)
+		c.RegNoFormats = formats
+		return err
+	})
+	fs.Func("tenant-regno-formats", `semicolon separated tenant=formats pairs of the registration formats of tenants, e.g. "cymru=gb;eire=ie,ni"`, func(v string) error {
+		formats, err := parseTenantRegNoFormats(v)
+		c.TenantRegNoFormats = formats
+		return err
+	})
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", "", "PEM certificate to serve HTTPS with")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", "", "PEM private key of the TLS certificate")
+	listVar(fs, &c.TLSAutocertHosts, "tls-autocert-hosts", "comma separated host names to obtain Let's Encrypt certificates for")
+	fs.StringVar(&c.TLSAutocertCacheDir, "tls-autocert-cache-dir", "/var/cache/carsupermarket/autocert", "directory Let's Encrypt certificates are cached in")
+	fs.StringVar(&c.TLSClientCAFile, "tls-client-ca-file", "", "PEM CA bundle client certificates are verified against")
+	fs.BoolVar(&c.RequireClientCert, "require-client-cert", false, "require a verified client certificate for writes")
+	fs.BoolVar(&c.RequireTenant, "require-tenant", false, "reject requests that do not name their tenant")
+	fs.StringVar(&c.DefaultTenant, "default-tenant", "default", "tenant of requests that do not name one, and of data stored before tenancy")
+	c.CORSAllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	c.CORSAllowedHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match", "X-API-Key", "X-Tenant-ID"}
+	c.CORSExposedHeaders = []string{"Location", "ETag", "Idempotent-Replayed", "Retry-After", "X-Request-ID", "X-Total-Count", "X-Quota-Daily-Remaining", "X-Quota-Monthly-Remaining"}
+	listVar(fs, &c.CORSAllowedOrigins, "cors-allowed-origins", "comma separated origins allowed to make cross-origin requests")
+	listVar(fs, &c.CORSAllowedMethods, "cors-allowed-methods", "comma separated methods allowed in cross-origin requests")
+	listVar(fs, &c.CORSAllowedHeaders, "cors-allowed-headers", "comma separated request headers allowed in cross-origin requests")
+	listVar(fs, &c.CORSExposedHeaders, "cors-exposed-headers", "comma separated response headers exposed to cross-origin callers")
+	fs.DurationVar(&c.CORSMaxAge, "cors-max-age", 10*time.Minute, "how long browsers may cache a preflight response")
+	fs.Float64Var(&c.RateLimit, "rate-limit", 0, "requests per second allowed per client IP or API key; 0 is unlimited")
+	fs.BoolVar(&c.PublicAPI, "public-api", false, "serve the read-only listing API under /public to anyone, for the storefront")
+	fs.Float64Var(&c.PublicRateLimit, "public-rate-limit", 10, "requests per second allowed per client IP to the public API; 0 is unlimited")
+	fs.IntVar(&c.PublicRateBurst, "public-rate-burst", 50, "requests a client may make to the public API in a burst above its rate limit")
+	fs.DurationVar(&c.PublicMaxAge, "public-max-age", 5*time.Minute, "how long browsers and CDNs may cache the responses of the public API")
+	fs.StringVar(&c.PublicSigningSecret, "public-signing-secret", "", "secret the responses of the public API are signed with; unsigned when empty")
+	fs.IntVar(&c.RateBurst, "rate-burst", 20, "requests a client may make in a burst above the rate limit")
+	fs.StringVar(&c.RateLimitStore, "rate-limit-store", "local", "where rate limits are counted: local, per instance, or redis, across instances through REDIS_URL")
+	fs.IntVar(&c.MaxInFlight, "max-in-flight", 0, "requests an instance serves at once, streams aside; 0 is unlimited")
+	fs.Func("route-max-in-flight", `semicolon separated route=requests pairs capping the requests to a route served at once, e.g. "/cars=20;/cars/search=10"`, func(v string) error {
+		caps, err := parseRouteCaps(v)
+		c.RouteMaxInFlight = caps
+		return err
+	})
+	fs.Int64Var(&c.APIKeyDailyQuota, "api-key-daily-quota", 0, "requests an API key without its own quota may make a day; 0 is unlimited")
+	fs.Int64Var(&c.APIKeyMonthlyQuota, "api-key-monthly-quota", 0, "requests an API key without its own quota may make a month; 0 is unlimited")
+	fs.StringVar(&c.UsageCollection, "usage-collection", "usage", "collection counting the requests made with each API key")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", 0, "how long car reads are cached for; 0 turns the cache off")
+	fs.IntVar(&c.CacheMaxEntries, "cache-max-entries", 10000, "responses the in-process cache holds")
+	fs.StringVar(&c.ValuationProvider, "valuation-provider", "depreciation", "what values cars: depreciation")
+	fs.DurationVar(&c.ValuationCacheTTL, "valuation-cache-ttl", 24*time.Hour, "how long a car's valuation is cached for; 0 turns caching off")
+	fs.StringVar(&c.ExchangeRatesURL, "exchange-rates-url", "https://api.frankfurter.app/latest?from={base}", "JSON API answering the exchange rates from {base}; only rates set by hand are used when empty")
+	fs.DurationVar(&c.ExchangeRatesTTL, "exchange-rates-ttl", time.Hour, "how long fetched exchange rates are used before they are fetched again")
+	fs.StringVar(&c.ExchangeRatesCollection, "exchange-rates-collection", "exchange_rates", "collection holding the exchange rates set by hand")
+	fs.StringVar(&c.FuzzySearch, "fuzzy-search", "ngram", "what fuzzy searches of manufacturers and models use: ngram or atlas")
+	fs.StringVar(&c.AtlasSearchIndex, "atlas-search-index", "default", "Atlas Search index on the cars collection fuzzy searches use")
+	fs.StringVar(&c.RegLookupURL, "reg-lookup-url", "", "DVLA Vehicle Enquiry Service URL registrations are looked up at; lookups are off when empty")
+	fs.StringVar(&c.RegLookupAPIKey, "reg-lookup-api-key", "", "API key for the registration lookup")
+	fs.BoolVar(&c.RegLookupEnrich, "reg-lookup-enrich", false, "fill in the details of cars from their registration as they are added")
+	fs.DurationVar(&c.RegLookupCacheTTL, "reg-lookup-cache-ttl", 24*time.Hour, "how long registration lookups are cached for; 0 turns caching off")
+	fs.StringVar(&c.MOTHistoryURL, "mot-history-url", "", "DVSA MOT history API URL registrations are appended to; MOT history is off when empty")
+	fs.StringVar(&c.MOTHistoryAPIKey, "mot-history-api-key", "", "API key for the MOT history API")
+	fs.DurationVar(&c.MOTHistoryCacheTTL, "mot-history-cache-ttl", 24*time.Hour, "how long MOT history is cached for; 0 turns caching off")
+	fs.StringVar(&c.LenderProfilesFile, "lender-profiles-file", "", "JSON file of the lender profiles finance is quoted on")
+	fs.StringVar(&c.FeedsFile, "feeds-file", "", "JSON file of listing feeds added to the built-in ones")
+	fs.StringVar(&c.FeedListingURL, "feed-listing-url", "", "storefront URL of a car in listing feeds, with {vin} standing for its VIN")
+	fs.StringVar(&c.FeedImageBaseURL, "feed-image-base-url", "", "public URL of the API that image links in listing feeds start with")
+	fs.StringVar(&c.QRListingURL, "qr-listing-url", "", "listing page URL car QR codes link to, with {vin} standing for its VIN; the feed listing URL when empty")
+	fs.IntVar(&c.QRSize, "qr-size", 512, "width in pixels car QR codes are drawn at, unless asked otherwise")
+	fs.StringVar(&c.QRErrorCorrection, "qr-error-correction", "M", "error correction level of car QR codes: L, M, Q or H")
+	fs.StringVar(&c.BrochureBrand, "brochure-brand", "Car Supermarket", "name heading car brochures")
+	fs.StringVar(&c.BrochureColour, "brochure-colour", "#1f3a93", "#rrggbb colour of the band car brochures are headed with")
+	fs.StringVar(&c.BrochureTemplateFile, "brochure-template-file", "", "text/template file of the text of car brochures, in place of the built-in one")
+	fs.DurationVar(&c.BrochureCacheTTL, "brochure-cache-ttl", time.Hour, "how long car brochures are cached for; 0 turns caching off")
+	fs.StringVar(&c.RedisURL, "redis-url", "", "redis:// URL of a cache, and optionally rate limits, shared by every instance; the cache is in-process when empty")
+	fs.TextVar(&c.LogLevel, "log-level", slog.LevelInfo, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&c.LogOutput, "log-output", "stderr", "where logs go: stdout, stderr or a file path")
+	fs.IntVar(&c.LogDebugSampling, "log-debug-sampling", 100, "log one in this many debug records of a message after the first ten each second; 1 logs all, 0 none")
+	fs.StringVar(&c.OTLPEndpoint, "otel-exporter-otlp-traces-endpoint", "", "OTLP/HTTP URL traces are sent to; tracing is off when empty")
+	fs.StringVar(&c.EventBus, "event-bus", "", "where inventory events are published: kafka or nats; empty turns publishing off")
+	fs.StringVar(&c.KafkaRESTURL, "kafka-rest-url", "", "URL of the Kafka REST Proxy events are published through")
+	fs.StringVar(&c.KafkaTopic, "kafka-topic", "carsupermarket.cars", "Kafka topic events are published to")
+	fs.StringVar(&c.NATSURL, "nats-url", "nats://localhost:4222", "nats:// or tls:// URL of the NATS server events are published to, with any credentials")
+	fs.StringVar(&c.NATSSubject, "nats-subject", "carsupermarket.cars", "prefix of the NATS subjects events are published at, followed by the event type")
+	fs.StringVar(&c.JWKSURL, "jwt-jwks-url", "", "URL of the key set bearer tokens are verified with; authentication is off when empty")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", "", "required issuer of bearer tokens")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", "", "required audience of bearer tokens")
+	fs.BoolVar(&c.RequireAuth, "require-auth", false, "require a bearer token or API key for writes; implied by JWT_JWKS_URL")
+	fs.DurationVar(&c.RequestSignatureSkew, "request-signature-skew", 5*time.Minute, "how far the time of a signed request may be from the server's; 0 refuses signed requests")
+	fs.StringVar(&c.NoncesCollection, "nonces-collection", "nonces", "collection holding the nonces of signed requests")
+	listVar(fs, &c.AdminSubjects, "admin-subjects", "comma separated token subjects that are always admins")
+	fs.StringVar(&c.UsersCollection, "users-collection", "users", "collection holding the users who sign in with a password")
+	fs.StringVar(&c.RefreshTokensCollection, "refresh-tokens-collection", "refresh_tokens", "collection holding the refresh tokens issued to users")
+	fs.StringVar(&c.SessionSigningKey, "session-signing-key", "", "secret the access tokens issued at login are signed with; random per instance when empty")
+	fs.DurationVar(&c.SessionTTL, "session-ttl", 15*time.Minute, "how long access tokens issued at login are valid")
+	fs.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "how long refresh tokens issued at login are valid")
+	fs.StringVar(&c.BootstrapAdmin, "bootstrap-admin", "", "username of an admin user made at startup if missing")
+	fs.StringVar(&c.BootstrapAdminPassword, "bootstrap-admin-password", "", "password of the bootstrap admin")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", "", "issuer URL of the OIDC provider users sign in with; single sign-on is off when empty")
+	fs.StringVar(&c.OIDCClientID, "oidc-client-id", "", "client ID registered with the OIDC provider, and the audience of its tokens")
+	fs.StringVar(&c.OIDCClientSecret, "oidc-client-secret", "", "client secret registered with the OIDC provider")
+	fs.StringVar(&c.OIDCRedirectURL, "oidc-redirect-url", "", "URL of /auth/oidc/callback as the OIDC provider sends people back to it")
+	c.OIDCScopes = []string{"openid", "profile", "email"}
+	listVar(fs, &c.OIDCScopes, "oidc-scopes", "comma separated scopes asked of the OIDC provider")
+	fs.StringVar(&c.OIDCGroupsClaim, "oidc-groups-claim", "groups", "claim of OIDC tokens listing the groups of the user")
+	fs.Func("oidc-group-roles", `semicolon separated group=role pairs giving IdP groups API roles, e.g. "car-sales=editor;it-ops=admin"`, func(v string) error {
+		roles, err := parseGroupRoles(v)
+		c.OIDCGroupRoles = roles
+		return err
+	})
+	fs.StringVar(&c.OIDCPostLoginURL, "oidc-post-login-url", "", "where people are sent once signed in with the OIDC provider; the admin UI when empty")
+	fs.DurationVar(&c.ArchiveRetention, "archive-retention", 90*24*time.Hour, "how long sold cars stay in stock before being archived")
+	c.AgingThresholds = []int{30, 60, 90}
+	fs.Func("aging-thresholds", "comma separated, ascending days in stock the aging report buckets cars by", func(v string) error {
+		days, err := parseDays(v)
+		c.AgingThresholds = days
+		return err
+	})
+	c.SimilarWeights = map[string]float64{"manufacturer": 2, "model": 3, "price": 2, "mileage": 1}
+	fs.Func("similar-weights", `comma separated factor=weight pairs similar cars are scored by, e.g. "manufacturer=2,model=3,price=2,mileage=1"`, func(v string) error {
+		weights, err := parseWeights(v)
+		c.SimilarWeights = weights
+		return err
+	})
+	fs.IntVar(&c.PriceReviewDays, "price-review-days", 0, "days in stock without a price change after which cars are flagged for price review; 0 flags none")
+	fs.Func("job-schedules", `semicolon separated job=schedule pairs overriding when background jobs run, e.g. "archive=0 3 * * *;hold-sweep=off"`, func(v string) error {
+		schedules, err := parseSchedules(v)
+		c.JobSchedules = schedules
+		return err
+	})
+	fs.DurationVar(&c.LeaderLeaseTTL, "leader-lease-ttl", 30*time.Second, "how long the lease electing the instance that runs background jobs lasts unrenewed; 0 runs them on every instance")
+	fs.StringVar(&c.LeasesCollection, "leases-collection", "leases", "collection holding the lease electing the instance that runs background jobs")
+	c.ImageRenditions = map[string]int{"thumbnail": 320, "medium": 1024}
+	fs.Func("image-renditions", `semicolon separated name=pixels pairs of the renditions made of car photos, e.g. "thumbnail=320;medium=1024"; "off" makes none`, func(v string) error {
+		renditions, err := parseRenditions(v)
+		c.ImageRenditions = renditions
+		return err
+	})
+	fs.StringVar(&c.PhotoStore, "photo-store", "gridfs", "where the bytes of photos are kept: gridfs, dir or s3")
+	fs.StringVar(&c.PhotoDir, "photo-dir", "", "directory photos are kept in when PHOTO_STORE is dir")
+	fs.StringVar(&c.PhotoS3Bucket, "photo-s3-bucket", "", "S3 bucket photos are kept in when PHOTO_STORE is s3")
+	fs.StringVar(&c.PhotoS3Region, "photo-s3-region", "eu-west-2", "region of the photo bucket")
+	fs.StringVar(&c.PhotoS3Endpoint, "photo-s3-endpoint", "", "URL of an S3-compatible store holding the photo bucket; AWS when empty")
+	fs.StringVar(&c.PhotoS3AccessKey, "photo-s3-access-key", "", "access key ID for the photo bucket")
+	fs.StringVar(&c.PhotoS3SecretKey, "photo-s3-secret-key", "", "secret access key for the photo bucket")
+	fs.DurationVar(&c.PhotoS3LinkTTL, "photo-s3-link-ttl", 0, "how long the pre-signed URLs photos are redirected to are valid; 0 serves photos through the API")
+	fs.Func("document-roles", `semicolon separated kind=role pairs giving the role that may see each kind of car document, e.g. "v5c=admin;inspection_report=viewer"`, func(v string) error {
+		roles, err := parseKindRoles(v)
+		c.DocumentRoles = roles
+		return err
+	})
+	fs.StringVar(&c.DocumentScanURL, "document-scan-url", "", "URL car documents are posted to, to be scanned for viruses before they are kept; none are scanned when empty")
+	fs.StringVar(&c.BackupDir, "backup-dir", "", "directory backups are written to")
+	fs.StringVar(&c.BackupS3Bucket, "backup-s3-bucket", "", "S3 bucket backups are written to")
+	fs.StringVar(&c.BackupS3Region, "backup-s3-region", "eu-west-2", "region of the backup bucket")
+	fs.StringVar(&c.BackupS3Endpoint, "backup-s3-endpoint", "", "URL of an S3-compatible store holding the backup bucket; AWS when empty")
+	fs.StringVar(&c.BackupS3AccessKey, "backup-s3-access-key", "", "access key ID for the backup bucket")
+	fs.StringVar(&c.BackupS3SecretKey, "backup-s3-secret-key", "", "secret access key for the backup bucket")
+	fs.StringVar(&c.AccountingExportDir, "accounting-export-dir", "", "directory accounting exports are written to")
+	fs.StringVar(&c.AccountingExportS3Bucket, "accounting-export-s3-bucket", "", "S3 bucket accounting exports are written to")
+	fs.StringVar(&c.AccountingExportS3Region, "accounting-export-s3-region", "eu-west-2", "region of the accounting export bucket")
+	fs.StringVar(&c.AccountingExportS3Endpoint, "accounting-export-s3-endpoint", "", "URL of an S3-compatible store holding the accounting export bucket; AWS when empty")
+	fs.StringVar(&c.AccountingExportS3AccessKey, "accounting-export-s3-access-key", "", "access key ID for the accounting export bucket")
+	fs.StringVar(&c.AccountingExportS3SecretKey, "accounting-export-s3-secret-key", "", "secret access key for the accounting export bucket")
+	fs.StringVar(&c.AccountingExportSFTPAddr, "accounting-export-sftp-addr", "", "host:port of the SFTP server accounting exports are written to")
+	fs.StringVar(&c.AccountingExportSFTPUser, "accounting-export-sftp-user", "", "user to sign in to the accounting export SFTP server as")
+	fs.StringVar(&c.AccountingExportSFTPPassword, "accounting-export-sftp-password", "", "password of the accounting export SFTP user")
+	fs.StringVar(&c.AccountingExportSFTPKeyFile, "accounting-export-sftp-key-file", "", "PEM private key file of the accounting export SFTP user, used rather than the password")
+	fs.StringVar(&c.AccountingExportSFTPHostKey, "accounting-export-sftp-host-key", "", `public key the accounting export SFTP server must present, in authorized_keys format, e.g. "ssh-ed25519 AAAA..."`)
+	fs.StringVar(&c.AccountingExportSFTPDir, "accounting-export-sftp-dir", "", "directory on the SFTP server accounting exports are written under; the user's home when empty")
+	fs.Func("accounting-layouts", `semicolon separated name=columns pairs of the layouts of accounting exports, the columns comma separated fields or field:Header, e.g. "sage=sold_at:Date,order_id:Reference,balance:Net"`, func(v string) error {
+		layouts, err := parseLayouts(v)
+		c.AccountingLayouts = layouts
+		return err
+	})
+	fs.StringVar(&c.AccountingDateLayout, "accounting-date-layout", "2006-01-02", "Go time layout of the dates in accounting exports, e.g. 02/01/2006")
+	fs.IntVar(&c.SeedCars, "seed-cars", 0, "cars generated from fixtures to stock an empty inventory with at startup; 0 seeds none")
+	fs.Int64Var(&c.SeedValue, "seed-value", 1, "seed the generated cars are made from; the same seed gives the same cars")
+	fs.BoolVar(&c.Mock, "mock", false, "serve a mock of the API from generated data, without a database")
+	fs.IntVar(&c.MockCars, "mock-cars", 200, "cars the mock API is stocked with")
+	fs.DurationVar(&c.MockLatency, "mock-latency", 0, "how long each request to the mock API takes")
+	fs.Float64Var(&c.MockErrorRate, "mock-error-rate", 0, "fraction of the requests to the mock API that fail, from 0 to 1")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if err != nil || set[f.Name] || !ok {
+			return
+		}
+		if e := f.Value.Set(v); e != nil {
+			err = fmt.Errorf("invalid %s: %v", name, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ConfigFile != "" {
+		file, err := readConfigFile(c.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			name := envName(f.Name)
+			v, ok := file[name]
+			if err != nil || set[f.Name] || !ok || f.Name == "config-file" {
+				return
+			}
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("invalid %s in %s: %v", name, c.ConfigFile, e)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readConfigFile reads the NAME=value lines of a configuration file. Blank
+// lines and those starting with # are skipped.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CONFIG_FILE: %w", err)
+	}
+	settings := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, v, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("%s:%d is not NAME=value", path, i+1)
+		}
+		settings[strings.TrimSpace(name)] = strings.TrimSpace(v)
+	}
+	return settings, nil
+}
+
+// listVar defines a flag holding a comma separated list. Setting it replaces
+// the default list.
+func listVar(fs *flag.FlagSet, p *[]string, name, usage string) {
+	fs.Func(name, usage, func(v string) error {
+		*p = splitList(v)
+		return nil
+	})
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseSchedules parses semicolon separated name=schedule pairs, checking
+// each schedule.
+func parseSchedules(v string) (map[string]string, error) {
+	schedules := map[string]string{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(pair, "=")
+		name, spec = strings.TrimSpace(name), strings.TrimSpace(spec)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not job=schedule", pair)
+		}
+		if spec != "off" {
+			if _, err := cron.Parse(spec); err != nil {
+				return nil, err
+			}
+		}
+		schedules[name] = spec
+	}
+	return schedules, nil
+}
+
+// parseFeatureFlags parses comma separated flag=on|off pairs. The names are
+// checked against the flags there are by the server.
+func parseFeatureFlags(v string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, state, ok := strings.Cut(pair, "=")
+		name, state = strings.TrimSpace(name), strings.TrimSpace(state)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not flag=on or flag=off", pair)
+		}
+		switch state {
+		case "on":
+			flags[name] = true
+		case "off":
+			flags[name] = false
+		default:
+			return nil, fmt.Errorf("feature flag %q must be on or off, got %q", name, state)
+		}
+	}
+	return flags, nil
+}
+
+// parseRenditions parses semicolon separated name=pixels pairs, checking each
+// size.
+func parseRenditions(v string) (map[string]int, error) {
+	renditions := map[string]int{}
+	if strings.TrimSpace(v) == "off" {
+		return renditions, nil
+	}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(pair, "=")
+		name, size = strings.TrimSpace(name), strings.TrimSpace(size)
+		if !ok || name == "" || name == "original" {
+			return nil, fmt.Errorf("%q is not name=pixels", pair)
+		}
+		px, err := strconv.Atoi(size)
+		if err != nil || px < 16 || px > 4096 {
+			return nil, fmt.Errorf("rendition %q must be 16 to 4096 pixels, got %q", name, size)
+		}
+		renditions[name] = px
+	}
+	return renditions, nil
+}
+
+// parseDays parses comma separated days, checking they are ascending.
+func parseDays(v string) ([]int, error) {
+	var days []int
+	for _, item := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a positive number of days", item)
+		}
+		if len(days) > 0 && n <= days[len(days)-1] {
+			return nil, fmt.Errorf("days must be ascending, got %d after %d", n, days[len(days)-1])
+		}
+		days = append(days, n)
+	}
+	return days, nil
+}
+
+// parseKindRoles parses semicolon separated kind=role pairs.
+func parseKindRoles(v string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kind, role, ok := strings.Cut(pair, "=")
+		kind, role = strings.TrimSpace(kind), strings.TrimSpace(role)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("%q is not kind=role", pair)
+		}
+		switch role {
+		case "viewer", "editor", "admin":
+		default:
+			return nil, fmt.Errorf("role of kind %q must be viewer, editor or admin, got %q", kind, role)
+		}
+		roles[kind] = role
+	}
+	return roles, nil
+}
+
+// parseRouteCaps parses semicolon separated route=requests pairs, the routes
+// being patterns under the API version.
+func parseRouteCaps(v string) (map[string]int, error) {
+	caps := map[string]int{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(pair, "=")
+		route = strings.TrimSpace(route)
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || !strings.HasPrefix(route, "/") || err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not route=requests with a route starting / and at least 1 request", pair)
+		}
+		caps[route] = n
+	}
+	return caps, nil
+}
+
+// parseWeights parses comma separated factor=weight pairs of similar cars,
+// checking each factor. Factors left out weigh nothing.
+func parseWeights(v string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, pair := range strings.Split(v, ",") {
+		factor, weight, ok := strings.Cut(pair, "=")
+		factor = strings.TrimSpace(factor)
+		n, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not factor=weight with a weight of 0 or more", pair)
+		}
+		switch factor {
+		case "manufacturer", "model", "price", "mileage":
+		default:
+			return nil, fmt.Errorf("factor must be manufacturer, model, price or mileage, got %q", factor)
+		}
+		weights[factor] = n
+	}
+	return weights, nil
+}
+
+// parseTenantRegNoFormats parses semicolon separated tenant=formats pairs,
+// the formats being comma separated.
+func parseTenantRegNoFormats(v string) (map[string]regno.Set, error) {
+	formats := map[string]regno.Set{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tenant, names, ok := strings.Cut(pair, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("%q is not tenant=formats", pair)
+		}
+		set, err := regno.Parse(names)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", tenant, err)
+		}
+		formats[tenant] = set
+	}
+	return formats, nil
+}
+
+// parseLayouts parses semicolon separated name=columns pairs, the columns
+// comma separated. The fields are checked by the server.
+func parseLayouts(v string) (map[string][]string, error) {
+	layouts := map[string][]string{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, columns, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		cols := splitList(columns)
+		if !ok || name == "" || len(cols) == 0 {
+			return nil, fmt.Errorf("%q is not name=columns", pair)
+		}
+		layouts[name] = cols
+	}
+	return layouts, nil
+}
+
+// parseGroupRoles parses semicolon separated group=role pairs, checking each
+// role.
+func parseGroupRoles(v string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(v, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("%q is not group=role", pair)
+		}
+		switch role {
+		case "viewer", "editor", "admin":
+		default:
+			return nil, fmt.Errorf("role of group %q must be viewer, editor or admin, got %q", group, role)
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+func envName(flagName string) string {
+	return strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func (c *Config) validate() error {
+	if !strings.HasPrefix(c.MongoURI, "mongodb://") && !strings.HasPrefix(c.MongoURI, "mongodb+srv://") {
+		return fmt.Errorf("MONGO_URI must be a mongodb:// or mongodb+srv:// URI, got %q", c.MongoURI)
+	}
+	if c.DBName == "" || c.CarsCollection == "" || c.ArchiveCollection == "" || c.APIKeysCollection == "" || c.RolesCollection == "" ||
+		c.AuditCollection == "" || c.PriceHistoryCollection == "" || c.ExchangeRatesCollection == "" || c.DealershipsCollection == "" || c.CustomersCollection == "" || c.TestDrivesCollection == "" || c.OrdersCollection == "" || c.ReservationsCollection == "" || c.FeatureFlagsCollection == "" || c.LeasesCollection == "" || c.NoncesCollection == "" || c.ServiceHistoryCollection == "" || c.TradeInsCollection == "" || c.SavedSearchesCollection == "" || c.FavoritesCollection == "" || c.StockLevelsCollection == "" || c.StockAlertsCollection == "" || c.WebhooksCollection == "" || c.WebhookDeliveriesCollection == "" || c.OutboxCollection == "" || c.AnalyticsCollection == "" || c.UsageCollection == "" || c.UsersCollection == "" || c.RefreshTokensCollection == "" || c.IdempotencyCollection == "" || c.MigrationsCollection == "" {
+		return errors.New("DB_NAME and the collection names must not be empty")
+	}
+	if c.CarsCollection == c.ArchiveCollection {
+		return errors.New("CARS_COLLECTION and ARCHIVE_COLLECTION must differ")
+	}
+	if c.MongoTimeout <= 0 {
+		return errors.New("MONGO_TIMEOUT must be positive")
+	}
+	if c.MongoStartupWait < 0 || c.MongoQueryTimeout < 0 || c.MongoMaxConnIdleTime < 0 {
+		return errors.New("MONGO_STARTUP_WAIT, MONGO_QUERY_TIMEOUT and MONGO_MAX_CONN_IDLE_TIME must not be negative")
+	}
+	if c.MinPoolSize > c.MaxPoolSize && c.MaxPoolSize != 0 {
+		return errors.New("MONGO_MIN_POOL_SIZE must not exceed MONGO_MAX_POOL_SIZE")
+	}
+	if c.BreakerThreshold < 0 {
+		return errors.New("BREAKER_THRESHOLD must not be negative")
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown <= 0 {
+		return errors.New("BREAKER_COOLDOWN must be positive")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("LISTEN_ADDR must not be empty")
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.RequestTimeout < 0 {
+		return errors.New("READ_TIMEOUT, WRITE_TIMEOUT, IDLE_TIMEOUT and REQUEST_TIMEOUT must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.DefaultTenant == "" {
+		return errors.New("DEFAULT_TENANT must not be empty")
+	}
+	if c.ConsulAddr != "" {
+		if !strings.HasPrefix(c.ConsulAddr, "https://") && !strings.HasPrefix(c.ConsulAddr, "http://") {
+			return fmt.Errorf("CONSUL_ADDR must be an http(s) URL, got %q", c.ConsulAddr)
+		}
+		if c.ConsulServiceName == "" {
+			return errors.New("CONSUL_SERVICE_NAME must not be empty")
+		}
+		if c.ConsulCheckInterval <= 0 {
+			return errors.New("CONSUL_CHECK_INTERVAL must be positive")
+		}
+	}
+	if c.JWKSURL != "" && !strings.HasPrefix(c.JWKSURL, "https://") && !strings.HasPrefix(c.JWKSURL, "http://") {
+		return fmt.Errorf("JWT_JWKS_URL must be an http(s) URL, got %q", c.JWKSURL)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSCertFile != "" && len(c.TLSAutocertHosts) > 0 {
+		return errors.New("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS are mutually exclusive")
+	}
+	tls := c.TLSCertFile != "" || len(c.TLSAutocertHosts) > 0
+	if c.TLSClientCAFile != "" && !tls {
+		return errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+	}
+	if c.RequireClientCert && c.TLSClientCAFile == "" {
+		return errors.New("REQUIRE_CLIENT_CERT needs TLS_CLIENT_CA_FILE")
+	}
+	if c.CORSMaxAge < 0 {
+		return errors.New("CORS_MAX_AGE must not be negative")
+	}
+	if c.RequestSignatureSkew < 0 {
+		return errors.New("REQUEST_SIGNATURE_SKEW must not be negative")
+	}
+	if c.LeaderLeaseTTL != 0 && c.LeaderLeaseTTL < 3*time.Second {
+		return errors.New("LEADER_LEASE_TTL must be 0 or at least 3s")
+	}
+	if c.RateLimit < 0 {
+		return errors.New("RATE_LIMIT must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return errors.New("RATE_BURST must be at least 1")
+	}
+	if c.MaxInFlight < 0 {
+		return errors.New("MAX_IN_FLIGHT must not be negative")
+	}
+	if c.RecordContractsDir != "" && c.RecordContractsPerRoute < 1 {
+		return errors.New("RECORD_CONTRACTS_PER_ROUTE must be at least 1")
+	}
+	if c.PublicRateLimit < 0 {
+		return errors.New("PUBLIC_RATE_LIMIT must not be negative")
+	}
+	if c.PublicRateLimit > 0 && c.PublicRateBurst < 1 {
+		return errors.New("PUBLIC_RATE_BURST must be at least 1")
+	}
+	if c.PublicMaxAge < 0 {
+		return errors.New("PUBLIC_MAX_AGE must not be negative")
+	}
+	switch c.RateLimitStore {
+	case "local":
+	case "redis":
+		if c.RedisURL == "" {
+			return errors.New("RATE_LIMIT_STORE redis needs REDIS_URL")
+		}
+	default:
+		return fmt.Errorf("RATE_LIMIT_STORE must be local or redis, got %q", c.RateLimitStore)
+	}
+	if c.OIDCIssuer != "" {
+		if c.JWKSURL != "" {
+			return errors.New("OIDC_ISSUER and JWT_JWKS_URL must not both be set; the provider's key set is found by discovery")
+		}
+		if !strings.HasPrefix(c.OIDCIssuer, "https://") && !strings.HasPrefix(c.OIDCIssuer, "http://") {
+			return fmt.Errorf("OIDC_ISSUER must be an http(s) URL, got %q", c.OIDCIssuer)
+		}
+		if c.OIDCClientID == "" || c.OIDCRedirectURL == "" {
+			return errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set with OIDC_ISSUER")
+		}
+	}
+	if c.SessionSigningKey != "" && len(c.SessionSigningKey) < 32 {
+		return errors.New("SESSION_SIGNING_KEY must be at least 32 characters")
+	}
+	if c.SessionTTL < time.Second || c.RefreshTokenTTL < c.SessionTTL {
+		return errors.New("SESSION_TTL must be at least a second, and REFRESH_TOKEN_TTL at least SESSION_TTL")
+	}
+	if (c.BootstrapAdmin == "") != (c.BootstrapAdminPassword == "") {
+		return errors.New("BOOTSTRAP_ADMIN and BOOTSTRAP_ADMIN_PASSWORD must be set together")
+	}
+	if c.APIKeyDailyQuota < 0 || c.APIKeyMonthlyQuota < 0 {
+		return errors.New("API_KEY_DAILY_QUOTA and API_KEY_MONTHLY_QUOTA must not be negative")
+	}
+	switch c.Compression {
+	case "gzip", "zstd", "off":
+	default:
+		return fmt.Errorf("COMPRESSION must be gzip, zstd or off, got %q", c.Compression)
+	}
+	if c.CompressionMinSize < 0 {
+		return errors.New("COMPRESSION_MIN_SIZE must not be negative")
+	}
+	if c.HSTSMaxAge < 0 {
+		return errors.New("HSTS_MAX_AGE must not be negative")
+	}
+	if c.MaxBodySize <= 0 || c.BatchMaxBodySize <= 0 {
+		return errors.New("MAX_BODY_SIZE and BATCH_MAX_BODY_SIZE must be positive")
+	}
+	if c.AdminCSP == "" {
+		return errors.New("ADMIN_CSP must not be empty")
+	}
+	if c.LogDebugSampling < 0 {
+		return errors.New("LOG_DEBUG_SAMPLING must not be negative")
+	}
+	if c.LogOutput == "" {
+		return errors.New("LOG_OUTPUT must not be empty")
+	}
+	if c.IdempotencyTTL < time.Second {
+		return errors.New("IDEMPOTENCY_TTL must be at least a second")
+	}
+	if c.WebhookDeliveryRetention < time.Second {
+		return errors.New("WEBHOOK_DELIVERY_RETENTION must be at least a second")
+	}
+	if c.OutboxRetention < time.Second {
+		return errors.New("OUTBOX_RETENTION must be at least a second")
+	}
+	if c.AnalyticsRetention < 24*time.Hour {
+		return errors.New("ANALYTICS_RETENTION must be at least a day")
+	}
+	if c.WebhookMaxAttempts < 1 {
+		return errors.New("WEBHOOK_MAX_ATTEMPTS must be at least 1")
+	}
+	if c.WebhookTimeout <= 0 {
+		return errors.New("WEBHOOK_TIMEOUT must be positive")
+	}
+	if c.NotificationsCollection == "" {
+		return errors.New("NOTIFICATIONS_COLLECTION must not be empty")
+	}
+	if c.NotificationRetention < time.Second {
+		return errors.New("NOTIFICATION_RETENTION must be at least a second")
+	}
+	if c.NotificationMaxAttempts < 1 {
+		return errors.New("NOTIFICATION_MAX_ATTEMPTS must be at least 1")
+	}
+	if _, err := time.LoadLocation(c.NotificationTimeZone); err != nil {
+		return errors.New("NOTIFICATION_TIME_ZONE must be a time zone, e.g. Europe/London")
+	}
+	if c.TestDriveReminderLead < 0 {
+		return errors.New("TEST_DRIVE_REMINDER_LEAD must not be negative")
+	}
+	if c.SMTPAddr != "" && c.SMTPFrom == "" {
+		return errors.New("SMTP_FROM must be set with SMTP_ADDR")
+	}
+	if c.TwilioAccountSID != "" && (c.TwilioAuthToken == "" || c.TwilioFrom == "") {
+		return errors.New("TWILIO_AUTH_TOKEN and TWILIO_FROM must be set with TWILIO_ACCOUNT_SID")
+	}
+	if c.TestDriveNoShowGrace <= 0 {
+		return errors.New("TEST_DRIVE_NO_SHOW_GRACE must be positive")
+	}
+	if c.CacheTTL < 0 {
+		return errors.New("CACHE_TTL must not be negative")
+	}
+	if c.CacheTTL > 0 && c.RedisURL == "" && c.CacheMaxEntries < 1 {
+		return errors.New("CACHE_MAX_ENTRIES must be at least 1")
+	}
+	switch c.EventBus {
+	case "":
+	case "kafka":
+		if !strings.HasPrefix(c.KafkaRESTURL, "https://") && !strings.HasPrefix(c.KafkaRESTURL, "http://") {
+			return fmt.Errorf("EVENT_BUS kafka needs KAFKA_REST_URL to be an http(s) URL, got %q", c.KafkaRESTURL)
+		}
+		if c.KafkaTopic == "" {
+			return errors.New("KAFKA_TOPIC must not be empty")
+		}
+	case "nats":
+		if !strings.HasPrefix(c.NATSURL, "nats://") && !strings.HasPrefix(c.NATSURL, "tls://") {
+			return fmt.Errorf("NATS_URL must be a nats:// or tls:// URL, got %q", c.NATSURL)
+		}
+		if c.NATSSubject == "" || strings.ContainsAny(c.NATSSubject, " \t*>") {
+			return errors.New("NATS_SUBJECT must be a subject without spaces or wildcards")
+		}
+	default:
+		return errors.New("EVENT_BUS must be kafka, nats or empty")
+	}
+	if c.RegLookupURL != "" && !strings.HasPrefix(c.RegLookupURL, "https://") && !strings.HasPrefix(c.RegLookupURL, "http://") {
+		return fmt.Errorf("REG_LOOKUP_URL must be an http(s) URL, got %q", c.RegLookupURL)
+	}
+	if c.MOTHistoryURL != "" && !strings.HasPrefix(c.MOTHistoryURL, "https://") && !strings.HasPrefix(c.MOTHistoryURL, "http://") {
+		return fmt.Errorf("MOT_HISTORY_URL must be an http(s) URL, got %q", c.MOTHistoryURL)
+	}
+	if c.MOTHistoryCacheTTL < 0 {
+		return errors.New("MOT_HISTORY_CACHE_TTL must not be negative")
+	}
+	if c.RegLookupEnrich && c.RegLookupURL == "" {
+		return errors.New("REG_LOOKUP_ENRICH needs REG_LOOKUP_URL")
+	}
+	if c.RegLookupCacheTTL < 0 {
+		return errors.New("REG_LOOKUP_CACHE_TTL must not be negative")
+	}
+	if c.ValuationProvider != "depreciation" {
+		return errors.New("VALUATION_PROVIDER must be depreciation")
+	}
+	if c.ValuationCacheTTL < 0 {
+		return errors.New("VALUATION_CACHE_TTL must not be negative")
+	}
+	if _, err := strconv.ParseUint(strings.TrimPrefix(c.BrochureColour, "#"), 16, 32); err != nil || len(c.BrochureColour) != 7 || c.BrochureColour[0] != '#' {
+		return errors.New("BROCHURE_COLOUR must be an #rrggbb colour")
+	}
+	listing := c.QRListingURL
+	if listing == "" {
+		listing = c.FeedListingURL
+	}
+	level, err := qr.ParseLevel(c.QRErrorCorrection)
+	if err != nil {
+		return errors.New("QR_ERROR_CORRECTION must be L, M, Q or H")
+	}
+	if len(strings.ReplaceAll(listing, "{vin}", "WVWZZZ1JZXW000001")) > qr.Capacity(level) {
+		return fmt.Errorf("QR_LISTING_URL is too long for a QR code at level %s", level)
+	}
+	if c.QRSize < 64 || c.QRSize > 4096 {
+		return errors.New("QR_SIZE must be from 64 to 4096")
+	}
+	if c.BrochureCacheTTL < 0 {
+		return errors.New("BROCHURE_CACHE_TTL must not be negative")
+	}
+	if c.ExchangeRatesURL != "" && !strings.HasPrefix(c.ExchangeRatesURL, "https://") && !strings.HasPrefix(c.ExchangeRatesURL, "http://") {
+		return fmt.Errorf("EXCHANGE_RATES_URL must be an http(s) URL, got %q", c.ExchangeRatesURL)
+	}
+	if c.ExchangeRatesTTL <= 0 {
+		return errors.New("EXCHANGE_RATES_TTL must be positive")
+	}
+	if c.SeedCars < 0 || c.SeedCars > 5000 {
+		return errors.New("SEED_CARS must be between 0 and 5000")
+	}
+	if c.MockCars < 0 || c.MockCars > 5000 {
+		return errors.New("MOCK_CARS must be between 0 and 5000")
+	}
+	if c.MockLatency < 0 {
+		return errors.New("MOCK_LATENCY must not be negative")
+	}
+	if c.MockErrorRate < 0 || c.MockErrorRate > 1 {
+		return errors.New("MOCK_ERROR_RATE must be between 0 and 1")
+	}
+	if c.ArchiveRetention <= 0 {
+		return errors.New("ARCHIVE_RETENTION must be positive")
+	}
+	if c.PriceReviewDays < 0 || c.PriceReviewDays > 365 {
+		return errors.New("PRICE_REVIEW_DAYS must be between 0 and 365")
+	}
+	var weight float64
+	for _, w := range c.SimilarWeights {
+		weight += w
+	}
+	if weight == 0 {
+		return errors.New("SIMILAR_WEIGHTS must weigh at least one factor")
+	}
+	if c.BackupDir != "" && c.BackupS3Bucket != "" {
+		return errors.New("BACKUP_DIR and BACKUP_S3_BUCKET are mutually exclusive")
+	}
+	if c.BackupS3Bucket != "" && (c.BackupS3Region == "" || c.BackupS3AccessKey == "" || c.BackupS3SecretKey == "") {
+		return errors.New("BACKUP_S3_BUCKET needs BACKUP_S3_REGION, BACKUP_S3_ACCESS_KEY and BACKUP_S3_SECRET_KEY")
+	}
+	if c.BackupS3Endpoint != "" && !strings.HasPrefix(c.BackupS3Endpoint, "https://") && !strings.HasPrefix(c.BackupS3Endpoint, "http://") {
+		return fmt.Errorf("BACKUP_S3_ENDPOINT must be an http(s) URL, got %q", c.BackupS3Endpoint)
+	}
+	destinations := 0
+	for _, d := range []string{c.AccountingExportDir, c.AccountingExportS3Bucket, c.AccountingExportSFTPAddr} {
+		if d != "" {
+			destinations++
+		}
+	}
+	if destinations > 1 {
+		return errors.New("ACCOUNTING_EXPORT_DIR, ACCOUNTING_EXPORT_S3_BUCKET and ACCOUNTING_EXPORT_SFTP_ADDR are mutually exclusive")
+	}
+	if c.AccountingExportS3Bucket != "" && (c.AccountingExportS3Region == "" || c.AccountingExportS3AccessKey == "" || c.AccountingExportS3SecretKey == "") {
+		return errors.New("ACCOUNTING_EXPORT_S3_BUCKET needs ACCOUNTING_EXPORT_S3_REGION, ACCOUNTING_EXPORT_S3_ACCESS_KEY and ACCOUNTING_EXPORT_S3_SECRET_KEY")
+	}
+	if c.AccountingExportS3Endpoint != "" && !strings.HasPrefix(c.AccountingExportS3Endpoint, "https://") && !strings.HasPrefix(c.AccountingExportS3Endpoint, "http://") {
+		return fmt.Errorf("ACCOUNTING_EXPORT_S3_ENDPOINT must be an http(s) URL, got %q", c.AccountingExportS3Endpoint)
+	}
+	if c.AccountingExportSFTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AccountingExportSFTPAddr); err != nil {
+			return fmt.Errorf("ACCOUNTING_EXPORT_SFTP_ADDR must be host:port, got %q", c.AccountingExportSFTPAddr)
+		}
+		if c.AccountingExportSFTPUser == "" || c.AccountingExportSFTPHostKey == "" || (c.AccountingExportSFTPKeyFile == "" && c.AccountingExportSFTPPassword == "") {
+			return errors.New("ACCOUNTING_EXPORT_SFTP_ADDR needs ACCOUNTING_EXPORT_SFTP_USER, ACCOUNTING_EXPORT_SFTP_HOST_KEY and ACCOUNTING_EXPORT_SFTP_KEY_FILE or ACCOUNTING_EXPORT_SFTP_PASSWORD")
+		}
+	}
+	if c.AccountingDateLayout == "" {
+		return errors.New("ACCOUNTING_DATE_LAYOUT must not be empty")
+	}
+
+	if c.FuzzySearch != "ngram" && c.FuzzySearch != "atlas" {
+		return fmt.Errorf("FUZZY_SEARCH must be ngram or atlas, got %q", c.FuzzySearch)
+	}
+	if c.FuzzySearch == "atlas" && c.AtlasSearchIndex == "" {
+		return errors.New("FUZZY_SEARCH atlas needs ATLAS_SEARCH_INDEX")
+	}
+	switch c.SchemaValidation {
+	case "error", "warn", "off":
+	default:
+		return fmt.Errorf("SCHEMA_VALIDATION must be error, warn or off, got %q", c.SchemaValidation)
+	}
+	switch c.Storage {
+	case "mongo", "memory":
+	case "postgres":
+		return errors.New("STORAGE postgres is not supported yet, as much of the API still reads and writes the cars in MongoDB; try it as SHADOW_STORAGE")
+	default:
+		return fmt.Errorf("STORAGE must be mongo or memory, got %q", c.Storage)
+	}
+	switch c.ShadowStorage {
+	case "", "mongo", "memory":
+	case "postgres":
+		if c.PostgresURL == "" {
+			return errors.New("POSTGRES_URL must be set when SHADOW_STORAGE is postgres")
+		}
+	default:
+		return fmt.Errorf("SHADOW_STORAGE must be mongo, postgres or memory, got %q", c.ShadowStorage)
+	}
+	if c.Storage == "memory" {
+		if c.ShadowStorage != "" {
+			return errors.New("SHADOW_STORAGE must not be set when STORAGE is memory")
+		}
+		if c.RequireAuth || c.JWKSURL != "" || c.OIDCIssuer != "" {
+			return errors.New("STORAGE memory serves without credentials; REQUIRE_AUTH, JWT_JWKS_URL and OIDC_ISSUER must not be set")
+		}
+	}
+	if c.ShadowStorage != "" && c.ShadowStorage == c.Storage {
+		return errors.New("SHADOW_STORAGE must be another storage than STORAGE")
+	}
+	if c.SlowQueryThreshold < 0 {
+		return errors.New("SLOW_QUERY_THRESHOLD must not be negative")
+	}
+	if c.ShadowLogSample < 0 || c.ShadowLogSample > 1 {
+		return errors.New("SHADOW_LOG_SAMPLE must be from 0 to 1")
+	}
+	switch c.PhotoStore {
+	case "gridfs":
+	case "dir":
+		if c.PhotoDir == "" {
+			return errors.New("PHOTO_STORE dir needs PHOTO_DIR")
+		}
+	case "s3":
+		if c.PhotoS3Bucket == "" || c.PhotoS3Region == "" || c.PhotoS3AccessKey == "" || c.PhotoS3SecretKey == "" {
+			return errors.New("PHOTO_STORE s3 needs PHOTO_S3_BUCKET, PHOTO_S3_REGION, PHOTO_S3_ACCESS_KEY and PHOTO_S3_SECRET_KEY")
+		}
+	default:
+		return fmt.Errorf("PHOTO_STORE must be gridfs, dir or s3, got %q", c.PhotoStore)
+	}
+	if c.PhotoS3Endpoint != "" && !strings.HasPrefix(c.PhotoS3Endpoint, "https://") && !strings.HasPrefix(c.PhotoS3Endpoint, "http://") {
+		return fmt.Errorf("PHOTO_S3_ENDPOINT must be an http(s) URL, got %q", c.PhotoS3Endpoint)
+	}
+	// S3 caps pre-signed URLs at a week.
+	if c.PhotoS3LinkTTL < 0 || c.PhotoS3LinkTTL > 7*24*time.Hour {
+		return errors.New("PHOTO_S3_LINK_TTL must be between 0 and 168h")
+	}
+
+	basePath, err := parseBasePath(c.BasePath)
+	if err != nil {
+		return err
+	}
+	c.BasePath = basePath
+
+	return nil
+}
+
+// parseBasePath checks that p starts with a slash and strips any trailing
+// one, so "/" is the same as no prefix.
+func parseBasePath(p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("BASE_PATH must start with '/', got %q", p)
+	}
+	return strings.TrimRight(p, "/"), nil
+}
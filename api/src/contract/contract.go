@@ -0,0 +1,171 @@
+// Package contract records the requests made to the API and its responses
+// as golden files, and tells whether the API still answers in their shape,
+// so that changes breaking clients are caught before the clients are.
+//
+// A recording is sanitized as it is made: credentials are never kept, and
+// the values of fields that may hold secrets or personal details are
+// replaced. Responses are compared by shape, not value, since the data they
+// are replayed against differs: every field of a golden body must still be
+// there, holding the same kind of value, or null. Fields added since do not
+// break the contract. Recordings are best made and replayed against servers
+// seeded alike, with the same SEED_VALUE, so that the same cars are there.
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the strings of sensitive fields.
+const Redacted = "[redacted]"
+
+// Headers are the request and response headers kept of an exchange; others,
+// credentials above all, are dropped.
+var Headers = []string{"Accept", "Accept-Language", "Content-Type", "If-Match", "If-None-Match", "X-Tenant-ID"}
+
+// sensitive are the fields whose values are redacted, wherever they are in a
+// body.
+var sensitive = map[string]bool{
+	"password": true, "secret": true, "token": true, "access_token": true, "refresh_token": true,
+	"api_key": true, "key": true, "email": true, "phone": true, "address": true, "name": true,
+	"notify": true, "customer": true,
+}
+
+// Exchange is a recorded request and the response it was answered with.
+type Exchange struct {
+	// Route is the pattern the request was routed by, e.g. /v1/cars/:vin.
+	Route      string            `json:"route"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query,omitempty"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	Response   Response          `json:"response"`
+	RecordedAt time.Time         `json:"recorded_at"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   json.RawMessage   `json:"body,omitempty"`
+}
+
+// Sanitize returns body with the values of sensitive fields redacted, or nil
+// if it is not JSON, which is not recorded.
+func Sanitize(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	b, err := json.Marshal(sanitize(v, false))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func sanitize(v interface{}, redact bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			v[k] = sanitize(field, redact || sensitive[strings.ToLower(k)])
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sanitize(item, redact)
+		}
+		return v
+	case string:
+		if redact {
+			return Redacted
+		}
+	case float64:
+		if redact {
+			return 0.0
+		}
+	}
+	return v
+}
+
+// Compare returns how body differs in shape from golden, a path and what is
+// wrong at it per difference; none if body keeps to it. Bodies that are not
+// JSON are not compared.
+func Compare(golden, body []byte) []string {
+	if len(golden) == 0 {
+		return nil
+	}
+	var want, got interface{}
+	if err := json.Unmarshal(golden, &want); err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		return []string{"$: the body is no longer JSON"}
+	}
+	var diffs []string
+	compare("$", want, got, &diffs)
+	return diffs
+}
+
+func compare(path string, want, got interface{}, diffs *[]string) {
+	// A field that was null was not seen holding anything, so it may hold
+	// anything now; one null now may be so of other data.
+	if want == nil || got == nil {
+		return
+	}
+	if kind(want) != kind(got) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: was %s, now %s", path, kind(want), kind(got)))
+		return
+	}
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got := got.(map[string]interface{})
+		names := make([]string, 0, len(want))
+		for k := range want {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			field, ok := got[k]
+			if !ok {
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing", path, k))
+				continue
+			}
+			compare(path+"."+k, want[k], field, diffs)
+		}
+	case []interface{}:
+		// The items of a golden array show the shape of every item now.
+		got := got.([]interface{})
+		if len(want) == 0 {
+			return
+		}
+		for i, item := range got {
+			compare(fmt.Sprintf("%s[%d]", path, i), want[0], item, diffs)
+		}
+	}
+}
+
+func kind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,157 @@
+// Package cron parses the schedules of periodic jobs: five field cron
+// expressions, such as "*/15 * * * *", and the shorthands "@hourly",
+// "@daily", "@weekly" and "@every 10m".
+//
+// Cron expressions are read in UTC. As in cron, when both the day of the
+// month and the day of the week are restricted, a day matching either will
+// do.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a job is next due.
+type Schedule interface {
+	// Next returns the first time after t the job is due, or the zero time
+	// if it never is.
+	Next(t time.Time) time.Time
+}
+
+// Every is a schedule due at a fixed interval.
+type Every time.Duration
+
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// fields of a cron expression, a bit set each.
+type expr struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for a "*" day field, which then does not
+	// widen the days matched by the other.
+	domAny, dowAny bool
+}
+
+var shorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Parse parses a schedule.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("cron: %q: the interval must be a duration of at least 1s", spec)
+		}
+		return Every(interval), nil
+	}
+	if s, ok := shorthands[spec]; ok {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: %q: want 5 fields, got %d", spec, len(fields))
+	}
+	var e expr
+	var err error
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&e.minute, &e.hour, &e.dom, &e.month, &e.dow}
+	for i, f := range fields {
+		if *sets[i], err = parseField(f, bounds[i][0], bounds[i][1]); err != nil {
+			return nil, fmt.Errorf("cron: %q: %v", spec, err)
+		}
+	}
+	// Sunday is 0 or 7.
+	if e.dow&(1<<7) != 0 {
+		e.dow |= 1
+	}
+	e.domAny, e.dowAny = fields[2] == "*", fields[4] == "*"
+	return &e, nil
+}
+
+// parseField parses a comma separated list of "*", values and ranges, each
+// with an optional "/step".
+func parseField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q", stepText)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loText); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiText); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// maxSearch bounds the search for the next time due; every valid expression
+// is due at least once in that time, except one asking for the 30th or 31st
+// of February, which is never due.
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+func (e *expr) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(maxSearch)
+	for t.Before(end) {
+		switch {
+		case e.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !e.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case e.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case e.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (e *expr) day(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case e.domAny:
+		return dow
+	case e.dowAny:
+		return dom
+	}
+	return dom || dow
+}
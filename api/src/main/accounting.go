@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// accountingExportSchedule pushes the exports of the month just ended early
+// on the 1st.
+const accountingExportSchedule = "0 2 1 * *"
+
+// defaultAccountingLayout names the layout of every field, used when none
+// are configured.
+const defaultAccountingLayout = "default"
+
+// exportStore is where accounting exports are pushed to: a directory, an S3
+// bucket or an SFTP server.
+type exportStore interface {
+	// put stores the size bytes of r, whose SHA-256 is sum, at key.
+	put(ctx context.Context, key string, r io.Reader, size int64, sum []byte) error
+}
+
+// sale is a car sold, as accounting records it: its completed order, the car
+// and who completed the sale.
+type sale struct {
+	order  order
+	car    vehicle
+	soldBy string
+}
+
+// accountingFields are the fields the columns of accounting exports may
+// have, in the order of the default layout, and how each is read from a
+// sale given the layout of dates.
+var accountingFields = []struct {
+	name  string
+	value func(s *sale, dates string) string
+}{
+	{"order_id", func(s *sale, _ string) string { return s.order.ID }},
+	{"vin", func(s *sale, _ string) string { return s.order.VIN }},
+	{"regno", func(s *sale, _ string) string { return s.car.RegNo }},
+	{"manufacturer", func(s *sale, _ string) string { return s.car.Manurfacturer }},
+	{"model", func(s *sale, _ string) string { return s.car.Model }},
+	{"year", func(s *sale, _ string) string { return optionalInt(s.car.Year) }},
+	{"dealer", func(s *sale, _ string) string { return s.car.Dealer }},
+	{"branch", func(s *sale, _ string) string { return s.car.Branch }},
+	{"buyer", func(s *sale, _ string) string { return s.order.Buyer.Name }},
+	{"customer_id", func(s *sale, _ string) string { return s.order.Buyer.CustomerID }},
+	{"currency", func(s *sale, _ string) string { return s.order.Price.Currency }},
+	{"price", func(s *sale, _ string) string { return strconv.FormatInt(s.order.Price.Amount, 10) }},
+	{"deposit", func(s *sale, _ string) string {
+		if s.order.Deposit == nil {
+			return ""
+		}
+		return strconv.FormatInt(s.order.Deposit.Amount, 10)
+	}},
+	{"trade_in", func(s *sale, _ string) string {
+		if s.order.TradeIn == nil {
+			return ""
+		}
+		return strconv.FormatInt(s.order.TradeIn.Value.Amount, 10)
+	}},
+	{"balance", func(s *sale, _ string) string { return strconv.FormatInt(s.balance(), 10) }},
+	{"ordered_at", func(s *sale, dates string) string { return s.order.CreatedAt.UTC().Format(dates) }},
+	{"sold_at", func(s *sale, dates string) string {
+		if s.order.CompletedAt == nil {
+			return ""
+		}
+		return s.order.CompletedAt.UTC().Format(dates)
+	}},
+	{"sold_by", func(s *sale, _ string) string { return s.soldBy }},
+}
+
+// balance is what is left to pay of the price once the deposit and the
+// trade-in, when in its currency, are taken off.
+func (s *sale) balance() int64 {
+	balance := s.order.Price.Amount
+	if s.order.Deposit != nil {
+		balance -= s.order.Deposit.Amount
+	}
+	if s.order.TradeIn != nil && s.order.TradeIn.Value.Currency == s.order.Price.Currency {
+		balance -= s.order.TradeIn.Value.Amount
+	}
+	return balance
+}
+
+// accountingColumn is a column of a layout: a field under a header.
+type accountingColumn struct {
+	header string
+	value  func(s *sale, dates string) string
+}
+
+// newAccountingLayouts returns the layouts configured, each column a field
+// or field:Header, or the default layout of every field when there are
+// none.
+func newAccountingLayouts(configured map[string][]string) (map[string][]accountingColumn, error) {
+	if len(configured) == 0 {
+		var all []string
+		for _, f := range accountingFields {
+			all = append(all, f.name)
+		}
+		configured = map[string][]string{defaultAccountingLayout: all}
+	}
+	layouts := map[string][]accountingColumn{}
+	for name, specs := range configured {
+		for _, spec := range specs {
+			field, header, ok := strings.Cut(spec, ":")
+			if !ok {
+				header = field
+			}
+			col := accountingColumn{header: header}
+			for _, f := range accountingFields {
+				if f.name == field {
+					col.value = f.value
+				}
+			}
+			if col.value == nil {
+				return nil, fmt.Errorf("accounting layout %s: unknown field %q", name, field)
+			}
+			layouts[name] = append(layouts[name], col)
+		}
+	}
+	return layouts, nil
+}
+
+// accountingExports writes the sales of a period as CSV files for the
+// accounts, one in each layout, to download or to push to store.
+type accountingExports struct {
+	orders  *mongo.Collection
+	cars    *mongo.Collection
+	archive *mongo.Collection
+	audit   *mongo.Collection
+	layouts map[string][]accountingColumn
+	// dates is the Go time layout dates are written in.
+	dates string
+	// store is nil when exports are only downloaded.
+	store exportStore
+}
+
+// layoutNames lists the layouts, in order.
+func (a *accountingExports) layoutNames() []string {
+	names := make([]string, 0, len(a.layouts))
+	for name := range a.layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sales returns the sales of the tenant of ctx completed from from until
+// to, in the order they were completed.
+func (a *accountingExports) sales(ctx context.Context, from, to time.Time) ([]sale, error) {
+	var orders []order
+	filter := forTenant(ctx, bson.M{"status": orderCompleted, "completedat": bson.M{"$gte": from, "$lt": to}})
+	cur, err := a.orders.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "completedat", Value: 1}, {Key: "orderid", Value: 1}}))
+	if err == nil {
+		err = cur.All(ctx, &orders)
+	}
+	if err != nil || len(orders) == 0 {
+		return nil, err
+	}
+
+	vins := make([]string, len(orders))
+	for i, o := range orders {
+		vins[i] = o.VIN
+	}
+	// A sold car is in stock until it is archived; one sold, bought back
+	// and sold again is the same car either way.
+	cars := map[string]vehicle{}
+	for _, c := range []*mongo.Collection{a.archive, a.cars} {
+		var found []vehicle
+		cur, err := c.Find(ctx, forTenant(ctx, bson.M{"vin": bson.M{"$in": vins}}))
+		if err == nil {
+			err = cur.All(ctx, &found)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, car := range found {
+			cars[car.VIN] = car
+		}
+	}
+
+	var entries []auditEntry
+	filter = forTenant(ctx, bson.M{"vin": bson.M{"$in": vins}, "action": auditSold, "at": bson.M{"$gte": from}})
+	cur, err = a.audit.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "at", Value: 1}}))
+	if err == nil {
+		err = cur.All(ctx, &entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sales := make([]sale, len(orders))
+	for i, o := range orders {
+		sales[i] = sale{order: o, car: cars[o.VIN]}
+		// The sale is audited just after its order is completed.
+		for _, e := range entries {
+			if e.VIN == o.VIN && !e.At.Before(*o.CompletedAt) {
+				sales[i].soldBy = e.Actor
+				break
+			}
+		}
+	}
+	return sales, nil
+}
+
+// write writes sales as CSV in layout, under a header row.
+func (a *accountingExports) write(w io.Writer, layout []accountingColumn, sales []sale) error {
+	cw := csv.NewWriter(w)
+	record := make([]string, len(layout))
+	for i, col := range layout {
+		record[i] = col.header
+	}
+	cw.Write(record)
+	for i := range sales {
+		for j, col := range layout {
+			record[j] = col.value(&sales[i], a.dates)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// pushedExport is an export pushed to the store.
+type pushedExport struct {
+	Layout string `json:"layout"`
+	Key    string `json:"key"`
+	Sales  int    `json:"sales"`
+}
+
+// push writes the sales of the tenant of ctx in the period to the store, in
+// every layout, as <tenant>/<layout>/<period>.csv.
+func (a *accountingExports) push(ctx context.Context, p accountingPeriod) ([]pushedExport, error) {
+	sales, err := a.sales(ctx, p.from, p.to)
+	if err != nil {
+		return nil, err
+	}
+	var pushed []pushedExport
+	for _, name := range a.layoutNames() {
+		var buf bytes.Buffer
+		if err := a.write(&buf, a.layouts[name], sales); err != nil {
+			return nil, err
+		}
+		key := tenantFrom(ctx) + "/" + name + "/" + p.name + ".csv"
+		sum := sha256.Sum256(buf.Bytes())
+		if err := a.store.put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), sum[:]); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		pushed = append(pushed, pushedExport{Layout: name, Key: key, Sales: len(sales)})
+	}
+	return pushed, nil
+}
+
+// monthEnd pushes the exports of the month just ended for every tenant with
+// sales in it, as the month-end extract. It is off without a store.
+func (a *accountingExports) monthEnd(ctx context.Context) error {
+	if a.store == nil {
+		return errors.New("no store to push accounting exports to")
+	}
+	p := lastMonth(time.Now())
+	tenants, err := a.orders.Distinct(ctx, "tenant", bson.M{"status": orderCompleted, "completedat": bson.M{"$gte": p.from, "$lt": p.to}})
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		tenant, _ := t.(string)
+		pushed, err := a.push(withTenant(ctx, tenant), p)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+		slog.Info("Accounting exports pushed", "tenant", tenant, "period", p.name, "exports", len(pushed))
+	}
+	return nil
+}
+
+// accountingPeriod is the span of time an export is of, from inclusive to
+// to exclusive, with the name its files have.
+type accountingPeriod struct {
+	name     string
+	from, to time.Time
+}
+
+// lastMonth is the calendar month, in UTC, before the one now is in.
+func lastMonth(now time.Time) accountingPeriod {
+	now = now.UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -1, 0)
+	return accountingPeriod{name: from.Format("2006-01"), from: from, to: to}
+}
+
+// periodParam reads the period of an export from ?month=YYYY-MM, or from
+// and to, RFC 3339 times; without either it is the last month. The returned
+// error is suitable for showing to the client in a 400 response.
+func periodParam(r *http.Request) (accountingPeriod, error) {
+	query := r.URL.Query()
+	if month := query.Get("month"); month != "" {
+		from, err := time.Parse("2006-01", month)
+		if err != nil {
+			return accountingPeriod{}, errors.New("Parameter \"month\" must be a month, e.g. 2024-03")
+		}
+		return accountingPeriod{name: month, from: from, to: from.AddDate(0, 1, 0)}, nil
+	}
+	if query.Get("from") == "" && query.Get("to") == "" {
+		return lastMonth(time.Now()), nil
+	}
+	var p accountingPeriod
+	for name, t := range map[string]*time.Time{"from": &p.from, "to": &p.to} {
+		v, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			return p, fmt.Errorf("Parameter %q must be an RFC 3339 time", name)
+		}
+		*t = v.UTC()
+	}
+	if !p.from.Before(p.to) {
+		return p, errors.New("Parameter \"from\" must be before \"to\"")
+	}
+	p.name = p.from.Format("20060102T150405Z") + "-" + p.to.Format("20060102T150405Z")
+	return p, nil
+}
+
+// downloadAccountingExport downloads the sales of a period in a layout,
+// ?layout=, which may be left out when there is only one.
+func downloadAccountingExport(a *accountingExports) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := periodParam(r)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Query().Get("layout")
+		if names := a.layoutNames(); name == "" && len(names) == 1 {
+			name = names[0]
+		}
+		layout, ok := a.layouts[name]
+		if !ok {
+			errorWithJSON(w, "Parameter \"layout\" must be one of "+strings.Join(a.layoutNames(), ", "), http.StatusBadRequest)
+			return
+		}
+
+		sales, err := a.sales(r.Context(), p.from, p.to)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed export sales", "err", err)
+			return
+		}
+		w.Header().Set("Content-Type", exportTypes["csv"])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"accounting-%s-%s.csv\"", name, p.name))
+		if err := a.write(w, layout, sales); err != nil {
+			slog.ErrorContext(r.Context(), "Failed export sales", "err", err)
+		}
+	}
+}
+
+// pushAccountingExport pushes the sales of a period to the store in every
+// layout, as the month-end job does, to send a period again or another.
+func pushAccountingExport(a *accountingExports) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.store == nil {
+			errorWithJSON(w, "Accounting exports are not configured", http.StatusServiceUnavailable)
+			return
+		}
+		p, err := periodParam(r)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushed, err := a.push(r.Context(), p)
+		if err != nil {
+			errorWithJSON(w, "Accounting export failed", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed push accounting export", "err", err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Accounting exports pushed", "period", p.name, "exports", len(pushed))
+
+		respBody, err := json.MarshalIndent(pushed, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
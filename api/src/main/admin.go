@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"problem"
+)
+
+// indexer builds the indexes of a collection, leaving those already built.
+type indexer func(ctx context.Context) error
+
+// reindex builds again the indexes the API makes at startup, for operators
+// who have dropped or rebuilt a collection.
+func reindex(indexers []indexer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, ensure := range indexers {
+			if err := ensure(r.Context()); err != nil {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed build indexes", "err", err)
+				return
+			}
+		}
+		slog.InfoContext(r.Context(), "Rebuilt indexes")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,205 @@
+// The admin UI. It calls the API with the session cookie the server set at
+// sign-in, so it holds no credentials itself; when the session expires the
+// page is reloaded, which signs the user in again.
+(function () {
+  "use strict";
+
+  var api = document.querySelector('meta[name="api-base"]').content;
+  var role = document.querySelector('meta[name="role"]').content;
+  var rank = { "": 0, viewer: 1, editor: 2, admin: 3 };
+  var canEdit = role === "" || rank[role] >= rank.editor;
+  var canDelete = role === "" || rank[role] >= rank.admin;
+
+  var $ = function (id) { return document.getElementById(id); };
+  var listing = { url: null, cursor: "" };
+  var current = null; // the car open, and its ETag
+
+  function show(section) {
+    ["inventory", "car"].forEach(function (id) { $(id).hidden = id !== section; });
+  }
+
+  function say(text, isError) {
+    $("message").textContent = text || "";
+    $("message").className = isError ? "error" : "";
+  }
+
+  function call(method, path, body, headers) {
+    var opts = { method: method, headers: Object.assign({ Accept: "application/json" }, headers || {}) };
+    if (body !== undefined) {
+      opts.body = JSON.stringify(body);
+      if (!opts.headers["Content-Type"]) {
+        opts.headers["Content-Type"] = "application/json";
+      }
+    }
+    return fetch(api + path, opts).then(function (resp) {
+      if (resp.status === 401) {
+        location.reload();
+        throw new Error("Your session has expired");
+      }
+      if (resp.status === 204) {
+        return { resp: resp, body: null };
+      }
+      return resp.json().then(function (json) {
+        if (!resp.ok) {
+          throw new Error(json.detail || json.title || resp.statusText);
+        }
+        return { resp: resp, body: json };
+      });
+    });
+  }
+
+  function cell(row, text) {
+    var td = document.createElement("td");
+    td.textContent = text === undefined || text === null ? "" : text;
+    row.appendChild(td);
+  }
+
+  function money(p) {
+    return p ? (p.amount / 100).toFixed(2) + " " + p.currency : "";
+  }
+
+  function list(reset) {
+    var form = $("search-form");
+    if (reset) {
+      var q = form.q.value.trim();
+      var params = new URLSearchParams({ limit: "50" });
+      if (q) {
+        params.set("q", q);
+      }
+      if (form.include_deleted.checked) {
+        params.set("include_deleted", "true");
+      }
+      listing.url = (q ? "/cars/search?" : "/cars?") + params.toString();
+      listing.cursor = "";
+      $("cars").textContent = "";
+    }
+    var url = listing.url + "&cursor=" + encodeURIComponent(listing.cursor);
+    call("GET", url).then(function (res) {
+      var page = res.body;
+      page.cars.forEach(function (car) {
+        var row = document.createElement("tr");
+        row.className = "car" + (car.deleted_at ? " deleted" : "");
+        [car.vin, car.regno, car.manufacturer, car.model, car.year, car.status, money(car.price)].forEach(function (v) {
+          cell(row, v);
+        });
+        row.addEventListener("click", function () { open(car); });
+        $("cars").appendChild(row);
+      });
+      listing.cursor = page.next_cursor || "";
+      $("more").hidden = !listing.cursor;
+      $("total").textContent = page.total + " cars";
+      say("");
+    }).catch(function (err) { say(err.message, true); });
+  }
+
+  function open(car) {
+    show("car");
+    say("");
+    fill(car, null);
+    if (!car.deleted_at) {
+      call("GET", "/cars/" + encodeURIComponent(car.vin)).then(function (res) {
+        fill(res.body, res.resp.headers.get("ETag"));
+      }).catch(function (err) { say(err.message, true); });
+    }
+    history(car.vin);
+  }
+
+  function fill(car, etag) {
+    current = { car: car, etag: etag };
+    $("car-title").textContent = [car.manufacturer, car.model, car.regno || car.vin].join(" ");
+    var form = $("car-form");
+    ["manufacturer", "model", "regno", "year", "mileage", "colour", "dealer"].forEach(function (name) {
+      form[name].value = car[name] === undefined ? "" : car[name];
+      form[name].disabled = !canEdit || !!car.deleted_at;
+    });
+    form.querySelector('button[type="submit"]').hidden = !canEdit || !!car.deleted_at;
+    $("delete").hidden = !canDelete || !!car.deleted_at;
+    $("restore").hidden = !canDelete || !car.deleted_at;
+  }
+
+  function history(vin) {
+    $("history").textContent = "";
+    if (!canDelete) {
+      cell($("history").insertRow(), "The history is shown to admins");
+      return;
+    }
+    call("GET", "/cars/" + encodeURIComponent(vin) + "/history").then(function (res) {
+      res.body.forEach(function (entry) {
+        var row = $("history").insertRow();
+        cell(row, new Date(entry.at).toLocaleString());
+        cell(row, entry.action);
+        cell(row, entry.actor);
+        cell(row, (entry.changes || []).map(function (c) {
+          return c.field + ": " + JSON.stringify(c.old) + " → " + JSON.stringify(c.new);
+        }).join("; "));
+      });
+    }).catch(function (err) { say(err.message, true); });
+  }
+
+  function save(event) {
+    event.preventDefault();
+    var form = $("car-form");
+    var patch = {};
+    ["manufacturer", "model", "regno", "colour", "dealer"].forEach(function (name) {
+      if (form[name].value !== (current.car[name] || "")) {
+        patch[name] = form[name].value;
+      }
+    });
+    ["year", "mileage"].forEach(function (name) {
+      var v = form[name].value === "" ? null : Number(form[name].value);
+      if (v !== (current.car[name] || null)) {
+        patch[name] = v;
+      }
+    });
+    if (Object.keys(patch).length === 0) {
+      say("Nothing has changed");
+      return;
+    }
+    var headers = { "Content-Type": "application/merge-patch+json" };
+    if (current.etag) {
+      headers["If-Match"] = current.etag;
+    }
+    call("PATCH", "/cars/" + encodeURIComponent(current.car.vin), patch, headers).then(function (res) {
+      fill(res.body, res.resp.headers.get("ETag"));
+      history(res.body.vin);
+      say("Saved");
+    }).catch(function (err) { say(err.message, true); });
+  }
+
+  function remove() {
+    if (!confirm("Delete " + current.car.vin + "? It can be restored later.")) {
+      return;
+    }
+    var headers = current.etag ? { "If-Match": current.etag } : {};
+    call("DELETE", "/cars/" + encodeURIComponent(current.car.vin), undefined, headers).then(function () {
+      say("Deleted " + current.car.vin);
+      show("inventory");
+      list(true);
+    }).catch(function (err) { say(err.message, true); });
+  }
+
+  function restore() {
+    call("POST", "/cars/" + encodeURIComponent(current.car.vin) + "/restore").then(function (res) {
+      open(res.body || current.car);
+      say("Restored");
+    }).catch(function (err) { say(err.message, true); });
+  }
+
+  $("search-form").addEventListener("submit", function (event) {
+    event.preventDefault();
+    list(true);
+  });
+  $("more").addEventListener("click", function () { list(false); });
+  $("back").addEventListener("click", function () {
+    show("inventory");
+    say("");
+  });
+  $("car-form").addEventListener("submit", save);
+  $("delete").addEventListener("click", remove);
+  $("restore").addEventListener("click", restore);
+
+  if (!canDelete) {
+    $("search-form").include_deleted.parentElement.hidden = true;
+  }
+  list(true);
+})();
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// refreshCookie holds the refresh token of someone signed in to the admin UI
+// with a password. It is only sent to the admin UI, which uses it to sign
+// them in again when their session cookie expires.
+const refreshCookie = "carsupermarket_refresh"
+
+//go:embed admin
+var adminFiles embed.FS
+
+var adminTemplates = template.Must(template.ParseFS(adminFiles, "admin/index.html", "admin/login.html"))
+
+// adminUI serves the admin interface under /admin, for staff to browse,
+// search, edit and delete cars and read their history from a browser. The
+// page only calls the API, as the person signed in, so what they may do is
+// decided there by their role. People sign in with a password or, when it
+// is configured, single sign-on.
+type adminUI struct {
+	auth     *authenticator
+	users    *userStore
+	sessions *sessionIssuer
+	// sso is nil unless sign-in with an OIDC provider is configured.
+	sso    *oidcLogin
+	csp    string
+	static http.Handler
+}
+
+func newAdminUI(auth *authenticator, users *userStore, sessions *sessionIssuer, sso *oidcLogin, csp string) *adminUI {
+	files, err := fs.Sub(adminFiles, "admin")
+	if err != nil {
+		panic(err)
+	}
+	return &adminUI{auth: auth, users: users, sessions: sessions, sso: sso, csp: csp,
+		static: http.StripPrefix(route("/admin/"), http.FileServer(http.FS(files)))}
+}
+
+// serve serves the page and the files it loads.
+func (ui *adminUI) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", ui.csp)
+	if r.URL.Path != route("/admin/") {
+		if strings.HasSuffix(r.URL.Path, ".html") {
+			http.NotFound(w, r)
+			return
+		}
+		ui.static.ServeHTTP(w, r)
+		return
+	}
+
+	p := principalFrom(r.Context())
+	if p == nil && ui.auth.required {
+		if ui.resume(w, r) {
+			return
+		}
+		ui.loginPage(w, "", "", http.StatusOK)
+		return
+	}
+
+	data := struct{ API, Subject, Role string }{API: apiRoute("")}
+	if p != nil {
+		data.Subject, data.Role = p.Subject, p.Role
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplates.ExecuteTemplate(w, "index.html", data); err != nil {
+		slog.ErrorContext(r.Context(), "Failed render admin UI", "err", err)
+	}
+}
+
+func (ui *adminUI) loginPage(w http.ResponseWriter, username, message string, status int) {
+	data := struct{ Base, Username, Error, SSOLogin string }{Base: route("/admin/"), Username: username, Error: message}
+	if ui.sso != nil {
+		data.SSOLogin = route("/auth/oidc/login")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := adminTemplates.ExecuteTemplate(w, "login.html", data); err != nil {
+		slog.Error("Failed render admin sign-in", "err", err)
+	}
+}
+
+// resume signs the browser in again with its refresh token, if it has one
+// that is still good, reporting whether it did.
+func (ui *adminUI) resume(w http.ResponseWriter, r *http.Request) bool {
+	c, err := r.Cookie(refreshCookie)
+	if err != nil {
+		return false
+	}
+	username, err := ui.sessions.use(r.Context(), c.Value)
+	var u *user
+	if err == nil {
+		u, err = ui.users.enabled(r.Context(), username)
+	}
+	if err != nil {
+		if err != errInvalidLogin {
+			slog.ErrorContext(r.Context(), "Failed resume admin session", "err", err)
+		}
+		return false
+	}
+	if err := ui.startSession(w, r, u); err != nil {
+		slog.ErrorContext(r.Context(), "Failed resume admin session", "err", err)
+		return false
+	}
+	http.Redirect(w, r, route("/admin/"), http.StatusSeeOther)
+	return true
+}
+
+// login signs someone in to the admin UI with their username and password.
+func (ui *adminUI) login(w http.ResponseWriter, r *http.Request) {
+	username, password := r.PostFormValue("username"), r.PostFormValue("password")
+	u, err := ui.users.authenticate(r.Context(), username, password)
+	if err == errInvalidLogin {
+		ui.loginPage(w, username, "The username or password is wrong", http.StatusUnauthorized)
+		return
+	}
+	if err == nil {
+		err = ui.startSession(w, r, u)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed sign in to admin UI", "err", err)
+		ui.loginPage(w, username, "Signing in failed; try again", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, route("/admin/"), http.StatusSeeOther)
+}
+
+// startSession sets the cookies of a session for u.
+func (ui *adminUI) startSession(w http.ResponseWriter, r *http.Request, u *user) error {
+	tokens, err := ui.sessions.issue(r.Context(), u)
+	if err != nil {
+		return err
+	}
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: tokens.AccessToken, Path: "/",
+		MaxAge: tokens.ExpiresIn, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Value: tokens.RefreshToken, Path: route("/admin/"),
+		MaxAge: int(ui.sessions.refreshTTL.Seconds()), HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode})
+	return nil
+}
+
+// logout signs the browser out, revoking its refresh token.
+func (ui *adminUI) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(refreshCookie); err == nil {
+		if _, err := ui.sessions.use(r.Context(), c.Value); err != nil && err != errInvalidLogin {
+			slog.ErrorContext(r.Context(), "Failed revoke refresh token", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: route("/admin/"), MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, route("/admin/"), http.StatusSeeOther)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// priceReviewSchedule is when cars are flagged for price review, unless
+// configured otherwise.
+const priceReviewSchedule = "0 6 * * *"
+
+// dayMillis is a day in the milliseconds dates are subtracted in.
+const dayMillis = float64(24 * time.Hour / time.Millisecond)
+
+// agingBucket counts the cars on sale for between MinDays and MaxDays, or
+// for MinDays or more in the last bucket, which has no MaxDays.
+type agingBucket struct {
+	MinDays int   `json:"min_days"`
+	MaxDays *int  `json:"max_days,omitempty"`
+	Count   int64 `json:"count"`
+	// Value is the asking prices of the cars, summed by currency.
+	Value []price `json:"value"`
+}
+
+// agingReport buckets the cars on sale by how long they have been so.
+type agingReport struct {
+	Thresholds []int         `json:"thresholds"`
+	Buckets    []agingBucket `json:"buckets"`
+	// PriceReview counts the cars flagged for their price to be reviewed.
+	PriceReview int64     `json:"price_review"`
+	At          time.Time `json:"at"`
+}
+
+// onSale matches the live cars in stock or reserved, which are listed.
+var onSale = bson.M{
+	"deletedat": bson.M{"$exists": false},
+	"status":    bson.M{"$in": bson.A{carInStock, carReserved}},
+	"listedat":  bson.M{"$exists": true},
+}
+
+// parseThresholds parses ascending, comma separated days.
+func parseThresholds(v string) ([]int, error) {
+	var days []int
+	for _, item := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < 1 || (len(days) > 0 && n <= days[len(days)-1]) {
+			return nil, fmt.Errorf("Parameter \"thresholds\" must be ascending days, e.g. 30,60,90")
+		}
+		days = append(days, n)
+	}
+	return days, nil
+}
+
+// agingReportOf buckets the tenant's cars on sale by days in stock, with
+// ?thresholds= overriding the configured bucket boundaries.
+func agingReportOf(c *mongo.Collection, thresholds []int) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bounds := thresholds
+		if v := r.URL.Query().Get("thresholds"); v != "" {
+			var err error
+			if bounds, err = parseThresholds(v); err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		now := time.Now().UTC()
+		days := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, "$listedat"}}, dayMillis}}
+		// Each car falls in the bucket of the first threshold it is under.
+		branches := bson.A{}
+		for i, t := range bounds {
+			branches = append(branches, bson.M{"case": bson.M{"$lt": bson.A{"$days", t}}, "then": i})
+		}
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: forTenant(r.Context(), onSale)}},
+			{{Key: "$set", Value: bson.M{"days": days}}},
+			{{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"bucket":   bson.M{"$switch": bson.M{"branches": branches, "default": len(bounds)}},
+					"currency": "$price.currency",
+				},
+				"count":  bson.M{"$sum": 1},
+				"amount": bson.M{"$sum": "$price.amount"},
+				"review": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$pricereviewat", nil}}, 1, 0}}},
+			}}},
+		}
+
+		var groups []struct {
+			ID struct {
+				Bucket   int
+				Currency string
+			} `bson:"_id"`
+			Count  int64
+			Amount int64
+			Review int64
+		}
+		cur, err := c.Aggregate(r.Context(), pipeline)
+		if err == nil {
+			err = cur.All(r.Context(), &groups)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed compute aging report", "err", err)
+			return
+		}
+
+		report := agingReport{Thresholds: bounds, Buckets: make([]agingBucket, len(bounds)+1), At: now}
+		for i := range report.Buckets {
+			b := &report.Buckets[i]
+			b.Value = []price{}
+			if i > 0 {
+				b.MinDays = bounds[i-1]
+			}
+			if i < len(bounds) {
+				b.MaxDays = &bounds[i]
+			}
+		}
+		for _, g := range groups {
+			b := &report.Buckets[g.ID.Bucket]
+			b.Count += g.Count
+			report.PriceReview += g.Review
+			if g.ID.Currency != "" {
+				b.Value = append(b.Value, price{Amount: g.Amount, Currency: g.ID.Currency})
+			}
+		}
+		for _, b := range report.Buckets {
+			sort.Slice(b.Value, func(i, j int) bool { return b.Value[i].Currency < b.Value[j].Currency })
+		}
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// priceReviewer flags the cars in stock for longer than days whose price has
+// not changed in that time either, so that staff review it, and clears the
+// flag once the price changes or the car is no longer in stock.
+type priceReviewer struct {
+	cars   *mongo.Collection
+	prices *priceHistory
+	days   int
+}
+
+func (p *priceReviewer) review(ctx context.Context) error {
+	if p.days <= 0 {
+		slog.WarnContext(ctx, "Price review needs PRICE_REVIEW_DAYS")
+		return nil
+	}
+	now := time.Now().UTC()
+	cutoff := now.AddDate(0, 0, -p.days)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"deletedat": bson.M{"$exists": false}, "status": carInStock, "listedat": bson.M{"$lt": cutoff}},
+			bson.M{"pricereviewat": bson.M{"$exists": true}},
+		}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": p.prices.c.Name(),
+			"let":  bson.M{"tenant": "$tenant", "vin": "$vin"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$tenant", "$$tenant"}},
+					bson.M{"$eq": bson.A{"$vin", "$$vin"}},
+					bson.M{"$gte": bson.A{"$at", cutoff}},
+				}}}},
+				bson.M{"$limit": 1},
+			},
+			"as": "recent",
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"flagged": bson.M{"$gt": bson.A{"$pricereviewat", nil}},
+			"stale": bson.M{"$and": bson.A{
+				bson.M{"$not": bson.A{bson.M{"$gt": bson.A{"$deletedat", nil}}}},
+				bson.M{"$eq": bson.A{"$status", carInStock}},
+				bson.M{"$lt": bson.A{"$listedat", cutoff}},
+				bson.M{"$eq": bson.A{bson.M{"$size": "$recent"}, 0}},
+			}},
+		}}},
+	}
+
+	var cars []struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Flagged bool
+		Stale   bool
+	}
+	cur, err := p.cars.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cur.All(ctx, &cars)
+	}
+	if err != nil {
+		return fmt.Errorf("find cars for price review: %w", err)
+	}
+
+	flag, clear := bson.A{}, bson.A{}
+	for _, c := range cars {
+		switch {
+		case c.Stale && !c.Flagged:
+			flag = append(flag, c.ID)
+		case !c.Stale && c.Flagged:
+			clear = append(clear, c.ID)
+		}
+	}
+	if len(flag) > 0 {
+		_, err := p.cars.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": flag}},
+			bson.M{"$set": bson.M{"pricereviewat": now}, "$inc": incRevision})
+		if err != nil {
+			return fmt.Errorf("flag cars for price review: %w", err)
+		}
+	}
+	if len(clear) > 0 {
+		_, err := p.cars.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": clear}},
+			bson.M{"$unset": bson.M{"pricereviewat": ""}, "$inc": incRevision})
+		if err != nil {
+			return fmt.Errorf("clear price review flags: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "Reviewed stale stock", "days", p.days, "flagged", len(flag), "cleared", len(clear))
+	return nil
+}
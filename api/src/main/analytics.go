@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"problem"
+	"vin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// analyticsFlushInterval is how often buffered views are written.
+	analyticsFlushInterval = 5 * time.Second
+	// analyticsBatchSize is how many buffered views have them written at
+	// once rather than on the next flush.
+	analyticsBatchSize = 500
+	// maxBufferedViews is the most views kept waiting to be written; more
+	// are dropped, as losing some counts beats running out of memory.
+	maxBufferedViews = 20000
+	// maxViewsPerRequest is the most views one POST /events may send.
+	maxViewsPerRequest = 50
+	// defaultStatsDays is the days GET /cars/:vin/stats counts over.
+	defaultStatsDays = 30
+)
+
+// The types of view event.
+const (
+	viewListing = "view"
+	viewClick   = "click"
+)
+
+var viewTypes = map[string]bool{viewListing: true, viewClick: true}
+
+var viewsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "carsupermarket_analytics_views_dropped_total",
+	Help: "View events dropped because the buffer was full or could not be written.",
+})
+
+func init() {
+	prometheus.MustRegister(viewsDropped)
+}
+
+// view is someone looking at or clicking through to a car's listing.
+type view struct {
+	VIN     string    `json:"vin"`
+	Type    string    `json:"type"`
+	Session string    `json:"session"`
+	At      time.Time `json:"-"`
+	Tenant  string    `json:"-" bson:"tenant"`
+}
+
+func (v *view) validate() *fieldError {
+	c := &checks{}
+	c.require("vin", v.VIN, "The VIN is required")
+	c.oneOf("type", v.Type, viewTypes, "The type must be view or click")
+	c.maxLength("session", v.Session, 64)
+	return c.err()
+}
+
+// analytics buffers the views the storefront sends and writes them in
+// batches, so that counting them does not cost a write per page. Views are
+// kept for retention.
+type analytics struct {
+	c         *mongo.Collection
+	retention time.Duration
+
+	mu    sync.Mutex
+	views []interface{}
+	full  chan struct{}
+}
+
+func newAnalytics(c *mongo.Collection, retention time.Duration) *analytics {
+	return &analytics{c: c, retention: retention, full: make(chan struct{}, 1)}
+}
+
+func (a *analytics) ensureIndex(ctx context.Context) error {
+	_, err := a.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}, {Key: "at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(a.retention.Seconds())),
+		},
+	})
+	return err
+}
+
+// add buffers views to be written, dropping those there is no room for.
+func (a *analytics) add(views []view) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, v := range views {
+		if len(a.views) >= maxBufferedViews {
+			viewsDropped.Inc()
+			continue
+		}
+		a.views = append(a.views, v)
+	}
+	if len(a.views) >= analyticsBatchSize {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the buffered views.
+func (a *analytics) flush(ctx context.Context) {
+	a.mu.Lock()
+	views := a.views
+	a.views = nil
+	a.mu.Unlock()
+	if len(views) == 0 {
+		return
+	}
+
+	if _, err := a.c.InsertMany(ctx, views, options.InsertMany().SetOrdered(false)); err != nil {
+		viewsDropped.Add(float64(len(views)))
+		slog.Error("Failed write views", "views", len(views), "err", err)
+	}
+}
+
+// run writes the buffered views every analyticsFlushInterval, or sooner when
+// a batch is full, until stop is closed. Then it writes those left and
+// closes done.
+func (a *analytics) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(analyticsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			a.flush(context.Background())
+			return
+		case <-a.full:
+		case <-ticker.C:
+		}
+		a.flush(context.Background())
+	}
+}
+
+// addViews takes a JSON array of views from the storefront. They are
+// written a few seconds later, in a batch with others, so the response is
+// 202.
+func addViews(a *analytics) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var views []view
+		if !decodeBody(w, r.Body, &views) {
+			return
+		}
+		if len(views) == 0 || len(views) > maxViewsPerRequest {
+			fieldErrorWithJSON(w, "events", "invalid", fmt.Sprintf("Between 1 and %d events must be sent", maxViewsPerRequest))
+			return
+		}
+
+		now := time.Now().UTC()
+		for i := range views {
+			if err := views[i].validate(); err != nil {
+				err.Message = fmt.Sprintf("Event %d: %s", i, err.Message)
+				fieldErrorsWithJSON(w, err)
+				return
+			}
+			views[i].VIN = vin.Normalize(views[i].VIN)
+			views[i].At = now
+			views[i].Tenant = tenantFrom(r.Context())
+		}
+		a.add(views)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// carStats is how often a car's listing was looked at over the last Days.
+type carStats struct {
+	VIN      string `json:"vin"`
+	Days     int    `json:"days"`
+	Views    int64  `json:"views"`
+	Clicks   int64  `json:"clicks"`
+	Sessions int64  `json:"sessions"`
+}
+
+// viewStats counts the views and clicks of the car with the VIN, and the
+// sessions they came from, over the last ?days=.
+func viewStats(a *analytics) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days := defaultStatsDays
+		if v := r.URL.Query().Get("days"); v != "" {
+			var err error
+			if days, err = parseCount("days", v, 1, int(a.retention/(24*time.Hour))); err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		stats := carStats{VIN: carVIN(r), Days: days}
+		since := time.Now().UTC().AddDate(0, 0, -days)
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: forTenant(r.Context(), bson.M{"vin": stats.VIN, "at": bson.M{"$gte": since}})}},
+			{{Key: "$group", Value: bson.M{
+				"_id":      nil,
+				"views":    bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$type", viewListing}}, 1, 0}}},
+				"clicks":   bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$type", viewClick}}, 1, 0}}},
+				"sessions": bson.M{"$addToSet": "$session"},
+			}}},
+			{{Key: "$project", Value: bson.M{"views": 1, "clicks": 1, "sessions": bson.M{"$size": "$sessions"}}}},
+		}
+		var counts []carStats
+		cur, err := a.c.Aggregate(r.Context(), pipeline)
+		if err == nil {
+			err = cur.All(r.Context(), &counts)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count views", "err", err)
+			return
+		}
+		if len(counts) > 0 {
+			stats.Views, stats.Clicks, stats.Sessions = counts[0].Views, counts[0].Clicks, counts[0].Sessions
+		}
+
+		respBody, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
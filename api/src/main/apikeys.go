@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// An API key is presented as "<id>.<secret>". Only a hash of the secret is
+// stored, so a key cannot be recovered after it has been minted.
+type apiKey struct {
+	ID         string    `json:"id" bson:"keyid"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	SecretHash string    `json:"-" bson:"secrethash"`
+	CreatedAt  time.Time `json:"created_at" bson:"createdat"`
+	CreatedBy  string    `json:"created_by,omitempty" bson:"createdby,omitempty"`
+	// Tenant is the tenant the key was minted in and is bound to.
+	Tenant string `json:"tenant" bson:"tenant"`
+	// Quota is the key's own quota; without one it has the default.
+	Quota *quota `json:"quota,omitempty" bson:",omitempty"`
+	// Signed keys are only accepted on signed requests, so that their
+	// secret is never sent; see signatureHeader.
+	Signed    bool       `json:"signed" bson:",omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" bson:"revokedat,omitempty"`
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+type apiKeyStore struct {
+	c *mongo.Collection
+}
+
+func (s *apiKeyStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "keyid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// verify returns the unrevoked key matching presented, unless it may only
+// sign requests.
+func (s *apiKeyStore) verify(ctx context.Context, presented string) (*apiKey, error) {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	key, err := s.byID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if key.Signed {
+		return nil, errMustSign
+	}
+
+	return key, nil
+}
+
+// byID returns the unrevoked key with the ID id.
+func (s *apiKeyStore) byID(ctx context.Context, id string) (*apiKey, error) {
+	var key apiKey
+	err := s.c.FindOne(ctx, bson.M{"keyid": id, "revokedat": bson.M{"$exists": false}}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// mintedKey is the response to minting a key; it is the only time the full
+// key is shown.
+type mintedKey struct {
+	apiKey
+	Key string `json:"key"`
+}
+
+func mintAPIKey(s *apiKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name   string `json:"name"`
+			Role   string `json:"role"`
+			Quota  *quota `json:"quota"`
+			Signed bool   `json:"signed"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&req)
+		if err != nil || req.Name == "" {
+			errorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		// Feed importers are the usual holders of keys, so they default to
+		// being able to write.
+		if req.Role == "" {
+			req.Role = roleEditor
+		}
+		if _, ok := roleRank[req.Role]; !ok {
+			errorWithJSON(w, "Role must be viewer, editor or admin", http.StatusBadRequest)
+			return
+		}
+		if req.Quota != nil && !req.Quota.valid() {
+			fieldErrorWithJSON(w, "quota", "invalid", "Quotas must not be negative")
+			return
+		}
+
+		id, err := randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		secret, err := randomHex(32)
+		if err != nil {
+			panic(err)
+		}
+
+		key := mintedKey{
+			apiKey: apiKey{
+				ID:         id,
+				Name:       req.Name,
+				Role:       req.Role,
+				SecretHash: hashSecret(secret),
+				CreatedAt:  time.Now().UTC(),
+				Tenant:     tenantFrom(r.Context()),
+				Quota:      req.Quota,
+				Signed:     req.Signed,
+			},
+			Key: id + "." + secret,
+		}
+		if p := principalFrom(r.Context()); p != nil {
+			key.CreatedBy = p.Subject
+		}
+
+		_, err = s.c.InsertOne(r.Context(), key.apiKey)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert API key", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/api-keys/"+id))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func allAPIKeys(s *apiKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := []apiKey{}
+		cur, err := s.c.Find(r.Context(), forTenant(r.Context(), bson.M{}), options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}}))
+		if err == nil {
+			err = cur.All(r.Context(), &keys)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list API keys", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func revokeAPIKey(s *apiKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := pat.Param(r, "id")
+
+		res, err := s.c.UpdateOne(r.Context(),
+			forTenant(r.Context(), bson.M{"keyid": id, "revokedat": bson.M{"$exists": false}}),
+			bson.M{"$set": bson.M{"revokedat": time.Now().UTC()}})
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed revoke API key", "err", err)
+			return
+		}
+
+		if res.MatchedCount == 0 {
+			errorWithJSON(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
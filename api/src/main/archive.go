@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// archiveSchedule is when sold cars are archived, unless configured otherwise.
+const archiveSchedule = "@hourly"
+
+const archiveBatchSize = 100
+
+// archivedVehicle is a car as the archive stores it: its fields, and when it
+// was archived. The car is a named field, as the driver skips unexported
+// embedded ones, and is written out flat by MarshalJSON.
+type archivedVehicle struct {
+	Vehicle    vehicle   `bson:",inline"`
+	ArchivedAt time.Time `json:"archived_at" bson:"archived_at"`
+}
+
+func (a archivedVehicle) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		vehicle
+		ArchivedAt time.Time `json:"archived_at"`
+	}{a.Vehicle, a.ArchivedAt})
+}
+
+// archiver periodically moves cars sold longer than retention ago out of the
+// cars collection and into the archive collection.
+type archiver struct {
+	cars      *mongo.Collection
+	archived  *mongo.Collection
+	audit     *auditLog
+	retention time.Duration
+}
+
+// archive moves the cars sold before the retention in batches, until none is
+// left or ctx is cancelled. A batch in progress is always completed.
+func (a *archiver) archive(ctx context.Context) error {
+	cutoff := time.Now().Add(-a.retention)
+
+	for {
+		n, err := a.archiveBatch(cutoff)
+		if err != nil {
+			return fmt.Errorf("archive sold cars: %w", err)
+		}
+
+		if n < archiveBatchSize || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// archiverPrincipal is the actor the archiver's writes are audited as.
+var archiverPrincipal = &principal{Subject: "system:archiver", Method: "system"}
+
+func (a *archiver) archiveBatch(cutoff time.Time) (int, error) {
+	ctx := context.WithValue(context.Background(), principalKey{}, archiverPrincipal)
+
+	var batch []vehicle
+	cur, err := a.cars.Find(ctx, bson.M{"soldat": bson.M{"$lt": cutoff}}, options.Find().SetLimit(archiveBatchSize))
+	if err == nil {
+		err = cur.All(ctx, &batch)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, car := range batch {
+		ctx := withTenant(ctx, car.Tenant)
+
+		// Upserting keeps the move safe to repeat if we stop between the
+		// insert and the delete.
+		doc := archivedVehicle{Vehicle: car, ArchivedAt: time.Now()}
+		_, err = a.archived.ReplaceOne(ctx, forTenant(ctx, bson.M{"vin": car.VIN}), doc, options.Replace().SetUpsert(true))
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = a.cars.DeleteOne(ctx, forTenant(ctx, bson.M{"vin": car.VIN}))
+		if err != nil {
+			return 0, err
+		}
+		a.audit.change(ctx, auditArchived, car.VIN, &car, nil)
+	}
+
+	return len(batch), nil
+}
+
+func archivedCarByVIN(c *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var car archivedVehicle
+		err := c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"vin": vin})).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find archived car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Archived car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(car, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// withArchive is the pipeline yielding the cars matching filter from both
+// the collection it is run on and archive, in the order of params, and with
+// paged only those of its page.
+func withArchive(archive *mongo.Collection, filter bson.M, params ListParams, paged bool) mongo.Pipeline {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$unionWith", Value: bson.M{"coll": archive.Name(), "pipeline": bson.A{bson.M{"$match": filter}}}}},
+	}
+	if len(params.Sort) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: params.Sort}})
+	}
+	if paged {
+		if params.Offset > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$skip", Value: params.Offset}})
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: pageFetch(params)}})
+	}
+	if params.Projection != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: params.Projection}})
+	}
+	return pipeline
+}
+
+// findWithArchive is findPage over the cars in stock and those archived.
+func findWithArchive(ctx context.Context, c, archive *mongo.Collection, params ListParams) ([]vehicle, int64, string, error) {
+	forTenant(ctx, params.Filter)
+	counted := append(withArchive(archive, params.Filter, ListParams{}, false), bson.D{{Key: "$count", Value: "total"}})
+	var counts []struct {
+		Total int64 `bson:"total"`
+	}
+	cur, err := c.Aggregate(ctx, counted)
+	if err == nil {
+		err = cur.All(ctx, &counts)
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var total int64
+	if len(counts) > 0 {
+		total = counts[0].Total
+	}
+
+	cars := []vehicle{}
+	cur, err = c.Aggregate(ctx, withArchive(archive, params.cursorFilter(), params, true))
+	if err == nil {
+		err = cur.All(ctx, &cars)
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if params.UseCursor && len(cars) > params.Limit {
+		cars = cars[:params.Limit]
+		next = encodeCursor(cars[len(cars)-1].VIN)
+	}
+	return cars, total, next, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestArchivedVehicleRoundTrip(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	car := archivedVehicle{
+		Vehicle: vehicle{
+			Manurfacturer: "Ford",
+			Model:         "Focus",
+			VIN:           "WF0AXXGCDA1234567",
+			RegNo:         "AB12CDE",
+			Status:        carSold,
+			Price:         &price{Amount: 899500, Currency: "GBP"},
+			Mileage:       42000,
+			Revision:      3,
+			Tenant:        "north",
+		},
+		ArchivedAt: at,
+	}
+
+	b, err := bson.Marshal(car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"manufacturer", "model", "vin", "regno", "status", "price", "mileage", "revision", "tenant", "archived_at"} {
+		if _, ok := doc[key]; !ok {
+			t.Errorf("stored archived car has no %s: %v", key, doc)
+		}
+	}
+
+	var got archivedVehicle
+	if err := bson.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	got.ArchivedAt = got.ArchivedAt.UTC()
+	if !reflect.DeepEqual(got, car) {
+		t.Errorf("archived car decoded as %+v, want %+v", got, car)
+	}
+}
+
+func TestArchivedVehicleJSON(t *testing.T) {
+	car := archivedVehicle{
+		Vehicle:    vehicle{Manurfacturer: "Ford", Model: "Focus", VIN: "WF0AXXGCDA1234567"},
+		ArchivedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+	b, err := json.Marshal(car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["vin"] != car.Vehicle.VIN || fields["manufacturer"] != "Ford" || fields["archived_at"] != "2024-03-01T12:00:00Z" {
+		t.Errorf("archived car written as %s", b)
+	}
+	if _, ok := fields["Vehicle"]; ok {
+		t.Errorf("archived car written nested: %s", b)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audited actions.
+const (
+	auditCreated         = "created"
+	auditUpdated         = "updated"
+	auditDeleted         = "deleted"
+	auditRestored        = "restored"
+	auditImageAdded      = "image_added"
+	auditImageRemoved    = "image_removed"
+	auditArchived        = "archived"
+	auditReserved        = "reserved"
+	auditSold            = "sold"
+	auditReleased        = "released"
+	auditServiceAdded    = "service_added"
+	auditServiceRemoved  = "service_removed"
+	auditMerged          = "merged"
+	auditDocumentAdded   = "document_added"
+	auditDocumentRemoved = "document_removed"
+)
+
+// fieldChange is the old and new value of a field changed by a write. A
+// value is missing when the field was not set.
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty" bson:",omitempty"`
+	New   interface{} `json:"new,omitempty" bson:",omitempty"`
+}
+
+// auditEntry records who changed a car, when and how: by its principal, and
+// the API key it was made with and whether the request was signed with it.
+type auditEntry struct {
+	VIN        string        `json:"vin"`
+	Action     string        `json:"action"`
+	Actor      string        `json:"actor"`
+	AuthMethod string        `json:"auth_method,omitempty" bson:"authmethod,omitempty"`
+	KeyID      string        `json:"key_id,omitempty" bson:"keyid,omitempty"`
+	Signed     bool          `json:"signed,omitempty" bson:",omitempty"`
+	At         time.Time     `json:"at"`
+	RequestID  string        `json:"request_id,omitempty" bson:"requestid,omitempty"`
+	Changes    []fieldChange `json:"changes"`
+	Tenant     string        `json:"-"`
+	// price is the change of price the write made, if any, which is
+	// recorded in the price history too.
+	price *priceChange
+}
+
+// auditLog keeps the audit trail of every write to the inventory.
+type auditLog struct {
+	// c is nil when nothing is recorded, as on the mock server.
+	c *mongo.Collection
+	// prices is nil when price changes are not kept apart.
+	prices *priceHistory
+}
+
+func (l *auditLog) ensureIndex(ctx context.Context) error {
+	_, err := l.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "keyid", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+// maxAuditEntries is the most entries of the audit trail listed at once.
+const maxAuditEntries = 1000
+
+// auditTrail lists the audit trail across cars, newest first, narrowed to
+// the writes of an API key, an actor or a request and to a span of time, as
+// when finding what an integration wrote.
+func auditTrail(l *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := forTenant(r.Context(), bson.M{})
+		for param, field := range map[string]string{"key_id": "keyid", "actor": "actor", "request_id": "requestid", "action": "action"} {
+			if v := query.Get(param); v != "" {
+				filter[field] = v
+			}
+		}
+
+		at := bson.M{}
+		for name, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+			value := query.Get(name)
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errorWithJSON(w, "Parameter \""+name+"\" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			at[op] = t
+		}
+		if len(at) > 0 {
+			filter["at"] = at
+		}
+		limit := maxAuditEntries
+		if v := query.Get("limit"); v != "" {
+			n, err := parseCount("limit", v, 1, maxAuditEntries)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		entries := []auditEntry{}
+		opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(int64(limit))
+		cur, err := l.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &entries)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list audit trail", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// entry describes the change of a car from before to after by the caller in
+// ctx. Before is nil for a new car and after is nil for one that is gone.
+func (l *auditLog) entry(ctx context.Context, action, vin string, before, after *vehicle) auditEntry {
+	e := auditEntry{
+		VIN:       vin,
+		Action:    action,
+		Actor:     "anonymous",
+		At:        time.Now().UTC(),
+		RequestID: requestID(ctx),
+		Changes:   changes(before, after),
+		Tenant:    tenantFrom(ctx),
+		price:     priceChangeOf(before, after),
+	}
+	if p := principalFrom(ctx); p != nil {
+		e.Actor = p.Subject
+		e.AuthMethod = p.Method
+		e.KeyID = p.KeyID
+		e.Signed = p.Signed
+	}
+	return e
+}
+
+// record adds entries to the audit trail. The writes they describe have
+// already been made, so a failure is logged rather than returned.
+func (l *auditLog) record(ctx context.Context, entries ...auditEntry) {
+	if len(entries) == 0 || l.c == nil {
+		return
+	}
+
+	docs := make([]interface{}, len(entries))
+	for i := range entries {
+		docs[i] = entries[i]
+	}
+
+	if _, err := l.c.InsertMany(ctx, docs); err != nil {
+		slog.ErrorContext(ctx, "Failed record audit trail", "vin", entries[0].VIN, "action", entries[0].Action, "err", err)
+	}
+
+	var prices []interface{}
+	for _, e := range entries {
+		if e.price != nil && l.prices != nil {
+			c := *e.price
+			c.Actor, c.At, c.Tenant = e.Actor, e.At, e.Tenant
+			prices = append(prices, c)
+		}
+	}
+	if len(prices) > 0 {
+		if _, err := l.prices.c.InsertMany(ctx, prices); err != nil {
+			slog.ErrorContext(ctx, "Failed record price history", "vin", entries[0].VIN, "err", err)
+		}
+	}
+}
+
+// change records a single change of a car.
+func (l *auditLog) change(ctx context.Context, action, vin string, before, after *vehicle) {
+	l.record(ctx, l.entry(ctx, action, vin, before, after))
+}
+
+// changes lists the fields that differ between before and after, by their
+// JSON names.
+func changes(before, after *vehicle) []fieldChange {
+	old, new := jsonFields(before), jsonFields(after)
+
+	names := make([]string, 0, len(old)+len(new))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diff := []fieldChange{}
+	for _, name := range names {
+		// Every write changes the revision, so it says nothing.
+		if name == "revision" {
+			continue
+		}
+		if !reflect.DeepEqual(old[name], new[name]) {
+			diff = append(diff, fieldChange{Field: name, Old: old[name], New: new[name]})
+		}
+	}
+	return diff
+}
+
+// jsonFields returns the fields v is shown to clients with.
+func jsonFields(v *vehicle) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if v == nil {
+		return fields
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		panic(err)
+	}
+	return fields
+}
+
+// carHistory lists the audit trail of a car, and of the cars merged into it,
+// newest first.
+func carHistory(l *auditLog, cars vehicleRepository) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		vins, err := mergedInto(r.Context(), cars, vin)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find merged cars", "err", err)
+			return
+		}
+
+		entries := []auditEntry{}
+		opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}})
+		filter := forTenant(r.Context(), bson.M{"vin": bson.M{"$in": append(vins, vin)}})
+		cur, err := l.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &entries)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed get car history", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
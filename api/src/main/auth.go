@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Subject string
+	Issuer  string
+	// Method is how the caller authenticated: "jwt", "session" for a token
+	// issued at login or single sign-on, or "api_key".
+	Method string
+	KeyID  string
+	Role   string
+	// Tenant is the tenant the credentials are bound to, if any.
+	Tenant string
+	// Quota is the API key's own quota, if it has one.
+	Quota *quota
+	// Signed is set when the request was signed with the API key rather
+	// than sending it.
+	Signed bool
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller of the request, or nil if the request is
+// anonymous.
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// tokenVerifier validates bearer tokens signed by a key from a JWKS. The
+// groups listed in the groupsClaim claim of a token give its subject the
+// highest of their roles in groupRoles.
+type tokenVerifier struct {
+	keys        *keySet
+	parser      *jwt.Parser
+	groupsClaim string
+	groupRoles  map[string]string
+}
+
+func newTokenVerifier(jwksURL, issuer, audience string) *tokenVerifier {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	return &tokenVerifier{keys: newKeySet(jwksURL), parser: jwt.NewParser(opts...)}
+}
+
+// tokenClaims are the claims read from bearer tokens. All holds every claim,
+// for those named by configuration.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Tenant string                 `json:"tenant"`
+	All    map[string]interface{} `json:"-"`
+}
+
+func (c *tokenClaims) UnmarshalJSON(b []byte) error {
+	type plain tokenClaims
+	if err := json.Unmarshal(b, (*plain)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.All)
+}
+
+// strings returns the claim as a list, whether it is one string or several.
+func (c *tokenClaims) strings(name string) []string {
+	switch v := c.All[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (v *tokenVerifier) verify(raw string) (*principal, error) {
+	p, _, err := v.verifyClaims(raw)
+	return p, err
+}
+
+// verifyClaims returns the caller a token identifies, with its role from
+// their groups, and the token's claims.
+func (v *tokenVerifier) verifyClaims(raw string) (*principal, *tokenClaims, error) {
+	var claims tokenClaims
+	_, err := v.parser.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(kid)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims.Subject == "" {
+		return nil, nil, errors.New("token has no subject")
+	}
+
+	p := &principal{Subject: claims.Subject, Issuer: claims.Issuer, Method: "jwt", Tenant: claims.Tenant}
+	if v.groupsClaim != "" {
+		for _, group := range claims.strings(v.groupsClaim) {
+			if role := v.groupRoles[group]; roleRank[role] > roleRank[p.Role] {
+				p.Role = role
+			}
+		}
+	}
+	return p, &claims, nil
+}
+
+// isRead reports whether r only reads the inventory.
+func isRead(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// authenticator identifies callers by bearer token or API key. Tokens is nil
+// when bearer tokens from an identity provider are not configured; sessions
+// verifies those issued at login. When required is false anonymous callers
+// may also write.
+type authenticator struct {
+	tokens   *tokenVerifier
+	sessions *sessionIssuer
+	keys     *apiKeyStore
+	roles    *roleStore
+	// nonces is nil when signed requests are not accepted.
+	nonces   *nonceStore
+	required bool
+}
+
+// authenticate puts the caller identified by an X-API-Key header, a request
+// signed with an API key or a bearer token into the request context. Reads
+// may be anonymous; writes must be authenticated when a.required is set.
+func authenticate(a *authenticator) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.identify(r)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Rejected credentials", "err", err)
+				unauthorized(w, "Invalid credentials")
+				return
+			}
+
+			if p == nil {
+				if a.required && !isRead(r) {
+					unauthorized(w, "Authentication required")
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// identify returns the caller's principal, nil for an anonymous request, or
+// an error when the credentials presented are not valid.
+func (a *authenticator) identify(r *http.Request) (*principal, error) {
+	if header := r.Header.Get(signatureHeader); header != "" {
+		k, err := a.verifySigned(r, header)
+		if err != nil {
+			return nil, err
+		}
+		return &principal{Subject: "api-key:" + k.Name, Method: "api_key", KeyID: k.ID, Role: k.Role, Tenant: k.Tenant, Quota: k.Quota, Signed: true}, nil
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		k, err := a.keys.verify(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		return &principal{Subject: "api-key:" + k.Name, Method: "api_key", KeyID: k.ID, Role: k.Role, Tenant: k.Tenant, Quota: k.Quota}, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		// People signed in to the admin UI carry their token in a cookie.
+		// Browsers send it unasked, so an expired one is no error: the
+		// request is anonymous, and the UI signs them in again.
+		if c, err := r.Cookie(sessionCookie); err == nil && a.sessions != nil {
+			if p, err := a.session(c.Value); err == nil {
+				return p, nil
+			}
+		}
+		return nil, nil
+	}
+
+	raw := strings.TrimPrefix(header, "Bearer ")
+	if raw == header || (a.tokens == nil && a.sessions == nil) {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+
+	if a.sessions != nil && (a.tokens == nil || a.sessions.issued(raw)) {
+		return a.session(raw)
+	}
+
+	p, err := a.tokens.verify(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.assignRole(r.Context(), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// session returns the caller a token issued here identifies. Their role is
+// in the token, which is short-lived so that a change of role soon applies.
+func (a *authenticator) session(raw string) (*principal, error) {
+	p, err := a.sessions.verify(raw)
+	if err == nil && a.roles.admins[p.Subject] {
+		p.Role = roleAdmin
+	}
+	return p, err
+}
+
+// assignRole gives p the role assigned to its subject, when that is above
+// the one given by its groups.
+func (a *authenticator) assignRole(ctx context.Context, p *principal) error {
+	assigned, err := a.roles.roleOf(ctx, p.Subject)
+	if err != nil {
+		return err
+	}
+	if roleRank[assigned] > roleRank[p.Role] {
+		p.Role = assigned
+	}
+	return nil
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="carsupermarket"`)
+	errorWithJSON(w, message, http.StatusUnauthorized)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"goji.io/pat"
+)
+
+// backupNameLayout names a backup by the time it was taken.
+const backupNameLayout = "20060102T150405Z"
+
+var backupName = regexp.MustCompile(`^\d{8}T\d{6}Z$`)
+
+// restoreBatchSize is how many documents a restore inserts at a time.
+const restoreBatchSize = 500
+
+// maxBackupLine bounds a line of a backup file, which holds one document;
+// MongoDB documents are at most 16MB, and Extended JSON is not much bigger.
+const maxBackupLine = 64 << 20
+
+// errBackupCorrupt is returned for a backup whose files do not match its
+// manifest.
+var errBackupCorrupt = errors.New("backup does not match its manifest")
+
+// backupManifest describes a backup; it is written once the files it lists
+// are stored, so that a failed backup is never listed.
+type backupManifest struct {
+	Name        string             `json:"name"`
+	Tenant      string             `json:"tenant"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Collections []backupCollection `json:"collections"`
+}
+
+// backupCollection is the file of one collection in a backup: gzip
+// compressed canonical Extended JSON, a document a line. SHA256 and Bytes
+// are of the compressed file.
+type backupCollection struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Documents  int64  `json:"documents"`
+	Bytes      int64  `json:"bytes"`
+	SHA256     string `json:"sha256"`
+}
+
+// backedUp is a collection included in backups, under a name that does not
+// change with its configured collection name.
+type backedUp struct {
+	name string
+	c    *mongo.Collection
+}
+
+// backupManager takes and restores backups of a tenant's data.
+type backupManager struct {
+	store       backupStore
+	collections []backedUp
+	maint       *maintenance
+	cache       *responseCache
+}
+
+func (b *backupManager) key(tenant, name, file string) string {
+	return tenant + "/" + name + "/" + file
+}
+
+// create backs up the tenant of ctx.
+func (b *backupManager) create(ctx context.Context) (*backupManifest, error) {
+	now := time.Now().UTC()
+	m := &backupManifest{Name: now.Format(backupNameLayout), Tenant: tenantFrom(ctx), CreatedAt: now}
+	if _, err := b.manifest(ctx, m.Name); err != errBlobNotFound {
+		if err == nil {
+			err = fmt.Errorf("backup %s already exists", m.Name)
+		}
+		return nil, err
+	}
+
+	for _, coll := range b.collections {
+		entry, err := b.dump(ctx, m, coll)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", coll.name, err)
+		}
+		m.Collections = append(m.Collections, entry)
+	}
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(body)
+	if err := b.store.put(ctx, b.key(m.Tenant, m.Name, "manifest.json"), bytes.NewReader(body), int64(len(body)), sum[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dump writes the tenant's documents in coll to a temporary file, to learn
+// its size and hash before it is stored.
+func (b *backupManager) dump(ctx context.Context, m *backupManifest, coll backedUp) (backupCollection, error) {
+	entry := backupCollection{Collection: coll.name, Key: b.key(m.Tenant, m.Name, coll.name+".ndjson.gz")}
+	f, err := os.CreateTemp("", "backup-*.ndjson.gz")
+	if err != nil {
+		return entry, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, hash))
+	cur, err := coll.c.Find(ctx, forTenant(ctx, bson.M{}))
+	if err != nil {
+		return entry, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cur.Current, true, false)
+		if err != nil {
+			return entry, err
+		}
+		if _, err := zw.Write(append(line, '\n')); err != nil {
+			return entry, err
+		}
+		entry.Documents++
+	}
+	if err := cur.Err(); err != nil {
+		return entry, err
+	}
+	if err := zw.Close(); err != nil {
+		return entry, err
+	}
+
+	if entry.Bytes, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return entry, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return entry, err
+	}
+	sum := hash.Sum(nil)
+	entry.SHA256 = hex.EncodeToString(sum)
+	return entry, b.store.put(ctx, entry.Key, f, entry.Bytes, sum)
+}
+
+// manifest returns the manifest of the tenant's backup name.
+func (b *backupManager) manifest(ctx context.Context, name string) (*backupManifest, error) {
+	rc, err := b.store.get(ctx, b.key(tenantFrom(ctx), name, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var m backupManifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest of %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// list returns the manifests of the tenant's backups, newest first.
+func (b *backupManager) list(ctx context.Context) ([]backupManifest, error) {
+	keys, err := b.store.list(ctx, tenantFrom(ctx)+"/")
+	if err != nil {
+		return nil, err
+	}
+	manifests := []backupManifest{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 || parts[2] != "manifest.json" || !backupName.MatchString(parts[1]) {
+			continue
+		}
+		m, err := b.manifest(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, *m)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Name > manifests[j].Name })
+	return manifests, nil
+}
+
+// restore replaces the tenant's documents in every collection with those of
+// its backup name. Every file is fetched and checked against the manifest
+// before anything is written, so that a corrupt backup leaves the data as it
+// was. Should a write fail part way, the restore can be run again.
+func (b *backupManager) restore(ctx context.Context, name string) (*backupManifest, error) {
+	m, err := b.manifest(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if m.Tenant != tenantFrom(ctx) {
+		return nil, fmt.Errorf("%w: backup of tenant %q", errBackupCorrupt, m.Tenant)
+	}
+
+	colls := make([]*mongo.Collection, len(m.Collections))
+	files := make([]*os.File, len(m.Collections))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}()
+	for i, entry := range m.Collections {
+		for _, coll := range b.collections {
+			if coll.name == entry.Collection {
+				colls[i] = coll.c
+			}
+		}
+		if colls[i] == nil {
+			return nil, fmt.Errorf("%w: unknown collection %q", errBackupCorrupt, entry.Collection)
+		}
+		if !strings.HasPrefix(entry.Key, b.key(m.Tenant, m.Name, "")) || strings.Contains(entry.Key, "..") {
+			return nil, fmt.Errorf("%w: file %q is outside the backup", errBackupCorrupt, entry.Key)
+		}
+		if files[i], err = b.fetch(ctx, m.Tenant, entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Collection, err)
+		}
+	}
+
+	for i, entry := range m.Collections {
+		if err := load(ctx, colls[i], files[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Collection, err)
+		}
+	}
+	b.cache.dropAll()
+	return m, nil
+}
+
+// fetch downloads the file of entry and checks its hash, size and documents,
+// which must all belong to tenant. It returns the file rewound.
+func (b *backupManager) fetch(ctx context.Context, tenant string, entry backupCollection) (*os.File, error) {
+	rc, err := b.store.get(ctx, entry.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp("", "restore-*.ndjson.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), rc)
+	if err == nil && (n != entry.Bytes || hex.EncodeToString(hash.Sum(nil)) != entry.SHA256) {
+		err = fmt.Errorf("%w: checksum mismatch", errBackupCorrupt)
+	}
+	var docs int64
+	if err == nil {
+		docs, err = scanBackup(f, func(doc bson.D) error {
+			var t interface{}
+			for _, e := range doc {
+				if e.Key == "tenant" {
+					t = e.Value
+				}
+			}
+			if t != tenant {
+				return fmt.Errorf("%w: a document belongs to tenant %v", errBackupCorrupt, t)
+			}
+			return nil
+		})
+	}
+	if err == nil && docs != entry.Documents {
+		err = fmt.Errorf("%w: %d documents, not %d", errBackupCorrupt, docs, entry.Documents)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// scanBackup calls fn with each document in the backup file f, from its
+// start, and returns how many there were.
+func scanBackup(f *os.File, fn func(bson.D) error) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBackupCorrupt, err)
+	}
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(nil, maxBackupLine)
+	var n int64
+	for sc.Scan() {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(sc.Bytes(), true, &doc); err != nil {
+			return n, fmt.Errorf("%w: document %d: %v", errBackupCorrupt, n+1, err)
+		}
+		if err := fn(doc); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return n, fmt.Errorf("%w: %v", errBackupCorrupt, err)
+	}
+	return n, nil
+}
+
+// load replaces the tenant's documents in c with those of the backup file f.
+func load(ctx context.Context, c *mongo.Collection, f *os.File) error {
+	if _, err := c.DeleteMany(ctx, forTenant(ctx, bson.M{})); err != nil {
+		return err
+	}
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := c.InsertMany(ctx, batch)
+		batch = batch[:0]
+		return err
+	}
+	_, err := scanBackup(f, func(doc bson.D) error {
+		if batch = append(batch, doc); len(batch) == restoreBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// backupError answers a request whose backup operation failed with err.
+func backupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errBlobNotFound):
+		errorWithJSON(w, "Backup not found", http.StatusNotFound)
+	case errors.Is(err, errBackupCorrupt):
+		errorWithCode(w, problem.CodeBackupCorrupt, err.Error(), http.StatusUnprocessableEntity)
+		slog.ErrorContext(r.Context(), "Backup corrupt", "err", err)
+	default:
+		errorWithJSON(w, "Backup failed", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed backup operation", "err", err)
+	}
+}
+
+// backupNameParam reads the backup named in the path of r, answering the
+// request itself when the name is malformed.
+func backupNameParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := pat.Param(r, "name")
+	if !backupName.MatchString(name) {
+		errorWithJSON(w, "Backup not found", http.StatusNotFound)
+		return "", false
+	}
+	return name, true
+}
+
+// backupsOff answers a request made while backups are not configured, and
+// reports whether it did.
+func backupsOff(w http.ResponseWriter, b *backupManager) bool {
+	if b == nil {
+		errorWithJSON(w, "Backups are not configured", http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// createBackup backs up the tenant's cars, archive, orders and audit trail.
+func createBackup(b *backupManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupsOff(w, b) {
+			return
+		}
+		m, err := b.create(r.Context())
+		if err != nil {
+			backupError(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Backup taken", "backup", m.Name)
+
+		respBody, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/admin/backups/"+m.Name))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func allBackups(b *backupManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupsOff(w, b) {
+			return
+		}
+		manifests, err := b.list(r.Context())
+		if err != nil {
+			backupError(w, r, err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(manifests, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func backupByName(b *backupManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupsOff(w, b) {
+			return
+		}
+		name, ok := backupNameParam(w, r)
+		if !ok {
+			return
+		}
+		m, err := b.manifest(r.Context(), name)
+		if err != nil {
+			backupError(w, r, err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// restoreBackup restores the tenant's data from a backup. Requests are still
+// served from the collections as it restores them, so it is only done in
+// maintenance mode, while nothing else writes to them.
+func restoreBackup(b *backupManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if backupsOff(w, b) {
+			return
+		}
+		name, ok := backupNameParam(w, r)
+		if !ok {
+			return
+		}
+		if !b.maint.get().Enabled {
+			errorWithCode(w, problem.CodeConflict, "Turn maintenance mode on before restoring a backup", http.StatusConflict)
+			return
+		}
+
+		slog.WarnContext(r.Context(), "Restoring backup", "backup", name)
+		m, err := b.restore(r.Context(), name)
+		if err != nil {
+			backupError(w, r, err)
+			return
+		}
+		slog.WarnContext(r.Context(), "Backup restored", "backup", name)
+
+		respBody, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
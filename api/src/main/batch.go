@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxBatchSize is the most cars one batch request may add.
+const maxBatchSize = 5000
+
+// Statuses of the cars in a batch.
+const (
+	batchCreated        = "created"
+	batchValid          = "valid"
+	batchDuplicate      = "duplicate_vin"
+	batchDuplicateRegNo = "duplicate_regno"
+	batchInvalid        = "invalid"
+	batchFailed         = "failed"
+)
+
+// batchResult says what happened to one car of a batch, by its position in
+// the request.
+type batchResult struct {
+	Index   int    `json:"index"`
+	VIN     string `json:"vin"`
+	Status  string `json:"status"`
+	Field   string `json:"field,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Errors lists every field of an invalid car that failed validation.
+	Errors []problem.FieldError `json:"errors,omitempty"`
+}
+
+// batchReport is what became of a batch. Validated only, the cars that would
+// have been added are counted as Valid rather than Created.
+type batchReport struct {
+	ValidateOnly bool          `json:"validate_only,omitempty"`
+	Created      int           `json:"created"`
+	Valid        int           `json:"valid,omitempty"`
+	Failed       int           `json:"failed"`
+	Results      []batchResult `json:"results"`
+}
+
+// batchCheck stands in for the insert of the batches of a request validated
+// only, remembering the VINs and registrations of the cars that would have
+// been added so that later cars repeating them are duplicates.
+type batchCheck struct {
+	vins, regnos map[string]bool
+}
+
+func newBatchCheck() *batchCheck {
+	return &batchCheck{vins: map[string]bool{}, regnos: map[string]bool{}}
+}
+
+// addCars adds an array of cars with one unordered bulk write, so a car that
+// fails does not stop the others being added. With ?validate_only=true the
+// cars are checked, for duplicates too, and reported on without adding them.
+func addCars(c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, ok := validateOnly(w, r)
+		if !ok {
+			return
+		}
+
+		var cars []vehicle
+		if !decodeBody(w, r.Body, &cars) {
+			return
+		}
+
+		if len(cars) == 0 {
+			errorWithJSON(w, "The batch is empty", http.StatusBadRequest)
+			return
+		}
+		if len(cars) > maxBatchSize {
+			errorWithJSON(w, fmt.Sprintf("A batch may hold at most %d cars", maxBatchSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var check *batchCheck
+		if dryRun {
+			check = newBatchCheck()
+		}
+		report := insertCars(r.Context(), c, events, audit, cars, check)
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// insertCars validates cars and inserts the valid ones, reporting on each
+// car by its index in cars. With a check, nothing is inserted: the valid
+// cars are looked for among those stored and checked instead.
+func insertCars(ctx context.Context, c *mongo.Collection, events *broker, audit *auditLog, cars []vehicle, check *batchCheck) batchReport {
+	results := make([]batchResult, len(cars))
+
+	var models []mongo.WriteModel
+	var indexes []int // position in cars of each model
+	for i := range cars {
+		results[i] = batchResult{Index: i, VIN: cars[i].VIN, Status: batchCreated}
+
+		if err := prepareNewCar(ctx, &cars[i]); err != nil {
+			results[i].Status = batchInvalid
+			results[i].Field = err.Field
+			results[i].Reason = err.Reason
+			results[i].Message = err.Message
+			results[i].Errors = err.all()
+			continue
+		}
+
+		models = append(models, mongo.NewInsertOneModel().SetDocument(cars[i]))
+		indexes = append(indexes, i)
+	}
+
+	if check != nil {
+		check.check(ctx, c, cars, indexes, results)
+		report := batchReport{ValidateOnly: true, Results: results}
+		for _, res := range results {
+			if res.Status == batchValid {
+				report.Valid++
+			} else {
+				report.Failed++
+			}
+		}
+		return report
+	}
+
+	// A write error ends a transaction, undoing the cars written in it, so
+	// in one the cars that fail are left out and the others written again.
+	// Without one, the others were written as they are.
+	for len(models) > 0 {
+		failed := map[int]bool{} // position in models of each failed write
+		err := events.transact(ctx, func(ctx context.Context) error {
+			clear(failed)
+			_, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+			var bulkErr mongo.BulkWriteException
+			if errors.As(err, &bulkErr) {
+				for _, we := range bulkErr.WriteErrors {
+					failed[we.Index] = true
+				}
+			} else if err != nil {
+				return err
+			}
+			for j, i := range indexes {
+				if !failed[j] {
+					events.publish(ctx, inventoryEvent{Type: eventCreated, VIN: cars[i].VIN, Car: &cars[i]})
+				}
+			}
+			return err
+		})
+
+		var bulkErr mongo.BulkWriteException
+		if err != nil && (!errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0) {
+			// The write as a whole failed, so none of the cars are known to
+			// have been added.
+			slog.ErrorContext(ctx, "Failed insert cars", "err", err)
+			for _, i := range indexes {
+				results[i].Status = batchFailed
+				results[i].Message = "Database error"
+			}
+			break
+		}
+		for _, we := range bulkErr.WriteErrors {
+			res := &results[indexes[we.Index]]
+			if we.HasErrorCode(11000) {
+				res.Status = batchDuplicate
+				res.Message = "A car with this VIN already exists"
+				if strings.Contains(we.Message, regNoIndex) {
+					res.Status = batchDuplicateRegNo
+					res.Message = "A car with this registration already exists"
+				}
+			} else {
+				res.Status = batchFailed
+				res.Message = "Database error"
+				slog.ErrorContext(ctx, "Failed insert car", "vin", res.VIN, "err", we)
+			}
+		}
+		if err == nil || !events.transactional() {
+			break
+		}
+
+		var retried []mongo.WriteModel
+		var retriedIndexes []int
+		for j := range models {
+			if !failed[j] {
+				retried = append(retried, models[j])
+				retriedIndexes = append(retriedIndexes, indexes[j])
+			}
+		}
+		models, indexes = retried, retriedIndexes
+	}
+
+	report := batchReport{Results: results}
+	var entries []auditEntry
+	for i, res := range results {
+		if res.Status != batchCreated {
+			report.Failed++
+			continue
+		}
+		report.Created++
+		entries = append(entries, audit.entry(ctx, auditCreated, cars[i].VIN, nil, &cars[i]))
+	}
+	audit.record(ctx, entries...)
+
+	return report
+}
+
+// check reports on the valid cars at indexes as the insert of them would:
+// duplicates of a stored car, deleted or not, or of a car before them, or
+// valid.
+func (bc *batchCheck) check(ctx context.Context, c *mongo.Collection, cars []vehicle, indexes []int, results []batchResult) {
+	if len(indexes) == 0 {
+		return
+	}
+	vins, regnos := bson.A{}, bson.A{}
+	for _, i := range indexes {
+		vins = append(vins, cars[i].VIN)
+		if cars[i].RegNo != "" {
+			regnos = append(regnos, cars[i].RegNo)
+		}
+	}
+
+	var stored []vehicle
+	filter := forTenant(ctx, bson.M{"$or": bson.A{bson.M{"vin": bson.M{"$in": vins}}, bson.M{"regno": bson.M{"$in": regnos}}}})
+	cur, err := c.Find(ctx, filter, options.Find().SetProjection(bson.M{"vin": 1, "regno": 1}))
+	if err == nil {
+		err = cur.All(ctx, &stored)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed find duplicate cars", "err", err)
+		for _, i := range indexes {
+			results[i].Status = batchFailed
+			results[i].Message = "Database error"
+		}
+		return
+	}
+	storedVINs, storedRegNos := map[string]bool{}, map[string]bool{}
+	for _, car := range stored {
+		storedVINs[car.VIN] = true
+		if car.RegNo != "" {
+			storedRegNos[car.RegNo] = true
+		}
+	}
+
+	for _, i := range indexes {
+		car, res := cars[i], &results[i]
+		switch {
+		case storedVINs[car.VIN] || bc.vins[car.VIN]:
+			res.Status = batchDuplicate
+			res.Message = "A car with this VIN already exists"
+		case car.RegNo != "" && (storedRegNos[car.RegNo] || bc.regnos[car.RegNo]):
+			res.Status = batchDuplicateRegNo
+			res.Message = "A car with this registration already exists"
+		default:
+			res.Status = batchValid
+			bc.vins[car.VIN] = true
+			if car.RegNo != "" {
+				bc.regnos[car.RegNo] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errBlobNotFound is returned by a blob store for an object it does not
+// hold.
+var errBlobNotFound = errors.New("blob not found")
+
+// backupStore holds the files of backups under slash separated keys.
+type backupStore interface {
+	// put stores the size bytes of r, whose SHA-256 is sum, at key.
+	put(ctx context.Context, key string, r io.Reader, size int64, sum []byte) error
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	// list returns the keys starting with prefix, in order.
+	list(ctx context.Context, prefix string) ([]string, error)
+}
+
+// blobStore holds files, such as photos, under slash separated keys, and can
+// delete them.
+type blobStore interface {
+	backupStore
+	delete(ctx context.Context, key string) error
+}
+
+// dirBlobs keeps files in a local directory.
+type dirBlobs struct {
+	dir string
+}
+
+func (d *dirBlobs) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d *dirBlobs) put(ctx context.Context, key string, r io.Reader, size int64, sum []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	// The file is written under another name and renamed, so that a failed
+	// backup never leaves a partial file behind under its own.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *dirBlobs) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (d *dirBlobs) delete(ctx context.Context, key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *dirBlobs) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.dir, func(path string, e os.DirEntry, err error) error {
+		if err != nil || e.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	sort.Strings(keys)
+	return keys, err
+}
+
+// s3Blobs keeps files in an S3 bucket, or one of a compatible store at
+// endpoint, addressed by path. Requests are signed with AWS Signature
+// Version 4.
+type s3Blobs struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Blobs(endpoint, bucket, region, accessKey, secretKey string) *s3Blobs {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &s3Blobs{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{},
+	}
+}
+
+// emptySHA256 is the SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do makes a signed request for key, which is empty for the bucket itself.
+func (s *s3Blobs) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := s.endpoint + s3Escape(path, false)
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, path, query, payloadHash, time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds the Signature Version 4 headers to req for the unescaped path.
+func (s *s3Blobs) sign(req *http.Request, path string, query url.Values, payloadHash string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(path, false),
+		s3Query(query),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + stamp + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		s.accessKey, day, s.region, signedHeaders, s.signature(canonical, now)))
+}
+
+// signature signs a canonical request made at now.
+func (s *s3Blobs) signature(canonical string, now time.Time) string {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// presign returns a URL key may be downloaded from without credentials until
+// ttl has passed, served with contentType.
+func (s *s3Blobs) presign(key, contentType string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := stamp[:8]
+	path := "/" + s.bucket + "/" + key
+	query := url.Values{
+		"X-Amz-Algorithm":        {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":       {s.accessKey + "/" + day + "/" + s.region + "/s3/aws4_request"},
+		"X-Amz-Date":             {stamp},
+		"X-Amz-Expires":          {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders":    {"host"},
+		"response-content-type":  {contentType},
+		"response-cache-control": {"private, max-age=" + strconv.Itoa(int(ttl.Seconds()))},
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		s3Escape(path, false),
+		s3Query(query),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(canonical, now))
+	return s.endpoint + s3Escape(path, false) + "?" + s3Query(query), nil
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires, leaving
+// slashes alone unless slash is set.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || (c == '/' && !slash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query in the canonical form, sorted by name.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, v := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error returns the error of a response that is not 2xx.
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return errBlobNotFound
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 %s: %s: %s", resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3 %s", resp.Status)
+}
+
+func (s *s3Blobs) put(ctx context.Context, key string, r io.Reader, size int64, sum []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, nil, r, size, hex.EncodeToString(sum))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Blobs) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Blobs) delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Blobs) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if resp.StatusCode/100 != 2 {
+			err = s3Error(resp)
+		} else {
+			var body []byte
+			body, err = io.ReadAll(resp.Body)
+			if err == nil {
+				err = xml.NewDecoder(bytes.NewReader(body)).Decode(&page)
+			}
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated {
+			sort.Strings(keys)
+			return keys, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"problem"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The states of a breaker, as reported by breakerState.
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var (
+	breakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "carsupermarket_db_breaker_state",
+		Help: "State of the database circuit breaker: 0 closed, 1 half-open, 2 open.",
+	})
+
+	breakerRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "carsupermarket_db_breaker_rejections_total",
+		Help: "Requests failed fast because the database circuit breaker was open.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(breakerState, breakerRejections)
+}
+
+// breaker fails requests fast while the database is down, rather than leaving
+// each to wait out its timeout on a dead connection. It learns of failures
+// from the driver's heartbeats, which keep probing servers the pool has lost,
+// and of recoveries from those and from commands that succeed.
+//
+// It opens after threshold heartbeats fail in a row. Once open for cooldown
+// it is half-open: one request at a time is let through, and the first
+// success closes it while another failure opens it again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may go ahead and, if it is the half-open
+// probe, that it is; the probe must be released when done. Otherwise it
+// returns how long until the next probe.
+func (b *breaker) allow(now time.Time) (ok, probe bool, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.set(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerClosed:
+		return true, false, 0
+	case b.state == breakerHalfOpen && !b.probing:
+		b.probing = true
+		return true, true, 0
+	case b.state == breakerHalfOpen:
+		return false, false, time.Second
+	}
+	return false, false, b.cooldown - now.Sub(b.openedAt)
+}
+
+// release lets another probe through once a probe request is done, if its
+// outcome did not settle the state.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		slog.Info("Database available again; closing circuit breaker")
+		b.set(breakerClosed)
+	}
+}
+
+func (b *breaker) failed(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		slog.Warn("Database unavailable; opening circuit breaker", "failures", b.failures, "err", err)
+		b.set(breakerOpen)
+		b.openedAt = time.Now()
+	}
+}
+
+// set moves to state; the caller holds mu.
+func (b *breaker) set(state int) {
+	b.state = state
+	b.probing = false
+	breakerState.Set(float64(state))
+}
+
+// serverMonitor feeds the driver's heartbeats to b.
+func (b *breaker) serverMonitor() *event.ServerMonitor {
+	return &event.ServerMonitor{
+		ServerHeartbeatSucceeded: func(*event.ServerHeartbeatSucceededEvent) { b.succeeded() },
+		ServerHeartbeatFailed:    func(e *event.ServerHeartbeatFailedEvent) { b.failed(e.Failure) },
+	}
+}
+
+// breakOnDatabaseDown answers requests with 503 while b is open. The health
+// and metrics endpoints are always served, so that probes see the outage
+// rather than the breaker. A nil breaker lets every request through.
+func breakOnDatabaseDown(b *breaker) func(http.Handler) http.Handler {
+	exempt := map[string]bool{route("/healthz"): true, route("/readyz"): true, route("/metrics"): true}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b == nil || exempt[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ok, probe, wait := b.allow(time.Now())
+			if !ok {
+				breakerRejections.Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+				errorWithCode(w, problem.CodeUnavailable, "The database is unavailable; try again later", http.StatusServiceUnavailable)
+				return
+			}
+			if probe {
+				defer b.release()
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
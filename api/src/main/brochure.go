@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// brochurePhotos is how many of a car's photos its brochure shows: the
+	// first large, the next ones beneath it.
+	brochurePhotos = 3
+	// brochurePhotoEdge is the most pixels a photo is embedded at across
+	// its longer edge, plenty for a printed page.
+	brochurePhotoEdge = 1200
+	// brochureCacheEntries is how many brochures are cached, which are
+	// far larger than the responses the API caches.
+	brochureCacheEntries = 100
+	brochureMargin       = 40.0
+	brochureBand         = 70.0
+)
+
+// defaultBrochureTemplate lays out the text of a brochure. Each line it
+// renders is a paragraph: those starting "# " are headings, and those of a
+// "Label: value" are laid out as a table. Blank lines add space.
+const defaultBrochureTemplate = `# Specification
+{{with .Car.Year}}Year: {{.}}
+{{end}}{{with .Car.Mileage}}Mileage: {{number .}} miles
+{{end}}{{with .Car.FuelType}}Fuel: {{.}}
+{{end}}{{with .Car.Transmission}}Transmission: {{.}}
+{{end}}{{with .Car.Colour}}Colour: {{.}}
+{{end}}{{with .Car.Condition}}Condition: {{.}}
+{{end}}{{with .Car.RegNo}}Registration: {{.}}
+{{end}}VIN: {{.Car.VIN}}
+{{with .Car.ServiceHistory}}Services: {{.ServiceCount}} recorded
+{{end}}
+{{with .Branch}}# Contact us
+{{.Name}}
+{{with .Address}}{{range .Lines}}{{.}}
+{{end}}{{with .Town}}{{.}}
+{{end}}{{with .Postcode}}{{.}}
+{{end}}{{end}}{{with .Phone}}Phone: {{.}}
+{{end}}{{with .Email}}Email: {{.}}
+{{end}}{{end}}`
+
+// brochureData is what a brochure template is executed with.
+type brochureData struct {
+	Brand string
+	// Title is the car's year, manufacturer and model.
+	Title string
+	// Price is the asking price written out, or empty.
+	Price string
+	Car   vehicle
+	// Branch is the dealership the car is at, when it has one.
+	Branch *dealership
+}
+
+var brochureFuncs = template.FuncMap{
+	"price":  formatPrice,
+	"number": func(n int) string { return formatNumber(int64(n)) },
+}
+
+// loadBrochureTemplate returns the brochure template in the file at path,
+// or the default one when path is empty.
+func loadBrochureTemplate(path string) (*template.Template, error) {
+	text := defaultBrochureTemplate
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading brochure template: %v", err)
+		}
+		text = string(b)
+	}
+	t, err := template.New("brochure").Funcs(brochureFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("loading brochure template: %v", err)
+	}
+	return t, nil
+}
+
+// brochures renders the printable spec sheets of cars, for sales staff to
+// hand out or email. A brochure is cached for ttl by the car's revision, so
+// that a change to the car renders it again; one to its dealership shows
+// once the cached copy expires.
+type brochures struct {
+	photos      photoStore
+	dealerships *dealershipStore
+	tmpl        *template.Template
+	brand       string
+	// colour is the red, green and blue of the brand, from 0 to 1.
+	colour [3]float64
+	cache  cacheStore
+	ttl    time.Duration
+}
+
+func newBrochures(photos photoStore, dealerships *dealershipStore, tmpl *template.Template, brand, colour string, ttl time.Duration) *brochures {
+	b := &brochures{photos: photos, dealerships: dealerships, tmpl: tmpl, brand: brand, cache: newMemoryCache(brochureCacheEntries), ttl: ttl}
+	rgb, _ := strconv.ParseUint(strings.TrimPrefix(colour, "#"), 16, 32)
+	for i := range b.colour {
+		b.colour[i] = float64(rgb>>(16-8*i)&0xff) / 255
+	}
+	return b
+}
+
+func (b *brochures) cacheKey(car vehicle) string {
+	return "brochure:" + car.Tenant + ":" + car.VIN + ":" + strconv.FormatInt(car.Revision, 10)
+}
+
+// render returns the PDF brochure of car.
+func (b *brochures) render(ctx context.Context, car vehicle) ([]byte, error) {
+	data := brochureData{Brand: b.brand, Car: car, Title: carTitle(car)}
+	if car.Price != nil {
+		data.Price = formatPrice(*car.Price)
+	}
+	if car.Branch != "" {
+		d, err := b.dealerships.find(ctx, car.Branch)
+		switch err {
+		case nil:
+			data.Branch = &d
+		case mongo.ErrNoDocuments:
+		default:
+			return nil, err
+		}
+	}
+	var text bytes.Buffer
+	if err := b.tmpl.Execute(&text, data); err != nil {
+		return nil, err
+	}
+
+	doc := &pdfDoc{}
+	page := doc.addPage()
+	page.rect(0, pdfPageHeight-brochureBand, pdfPageWidth, brochureBand, b.colour[0], b.colour[1], b.colour[2])
+	page.text(brochureMargin, pdfPageHeight-brochureBand/2-8, pdfBold, 22, 1, b.brand)
+
+	width := pdfPageWidth - 2*brochureMargin
+	y := pdfPageHeight - brochureBand - 40
+	for _, line := range pdfWrap(data.Title, 20, width) {
+		page.text(brochureMargin, y, pdfBold, 20, 0, line)
+		y -= 24
+	}
+	if data.Price != "" {
+		page.text(brochureMargin, y, pdfBold, 16, 0.2, data.Price)
+		y -= 20
+	}
+	y -= 8
+
+	var shown []pdfImage
+	for _, img := range car.Images {
+		if len(shown) == brochurePhotos {
+			break
+		}
+		photo, err := b.photo(ctx, img)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed embed photo in brochure", "vin", car.VIN, "photo", img.ID, "err", err)
+			continue
+		}
+		if photo != nil {
+			shown = append(shown, *photo)
+		}
+	}
+	if len(shown) > 0 {
+		h := min(width*float64(shown[0].height)/float64(shown[0].width), 320)
+		w := h * float64(shown[0].width) / float64(shown[0].height)
+		y -= h
+		page.image(doc.addJPEG(shown[0].jpeg, shown[0].width, shown[0].height), brochureMargin, y, w, h)
+		y -= 10
+	}
+	if len(shown) > 1 {
+		cell := (width - 10) / 2
+		rowHeight := 0.0
+		for i, photo := range shown[1:] {
+			h := min(cell*float64(photo.height)/float64(photo.width), 160)
+			w := h * float64(photo.width) / float64(photo.height)
+			page.image(doc.addJPEG(photo.jpeg, photo.width, photo.height), brochureMargin+float64(i)*(cell+10), y-h, w, h)
+			rowHeight = max(rowHeight, h)
+		}
+		y -= rowHeight + 10
+	}
+
+	// The template's lines, breaking onto a new page at the bottom margin.
+	const labelWidth = 130.0
+	next := func(height float64) {
+		y -= height
+		if y < brochureMargin+20 {
+			page = doc.addPage()
+			y = pdfPageHeight - brochureMargin - height
+		}
+	}
+	y -= 8
+	for _, line := range strings.Split(text.String(), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		label, value, table := strings.Cut(line, ": ")
+		switch {
+		case line == "":
+			y -= 8
+		case strings.HasPrefix(line, "# "):
+			next(26)
+			page.text(brochureMargin, y, pdfBold, 14, 0, strings.TrimPrefix(line, "# "))
+			y -= 4
+		case table && len(label) <= 24:
+			for i, l := range pdfWrap(value, 11, width-labelWidth) {
+				next(15)
+				if i == 0 {
+					page.text(brochureMargin, y, pdfBold, 11, 0.2, label)
+				}
+				page.text(brochureMargin+labelWidth, y, pdfRegular, 11, 0, l)
+			}
+		default:
+			for _, l := range pdfWrap(line, 11, width) {
+				next(15)
+				page.text(brochureMargin, y, pdfRegular, 11, 0, l)
+			}
+		}
+	}
+	for i, p := range doc.pages {
+		footer := car.VIN
+		if len(doc.pages) > 1 {
+			footer += fmt.Sprintf("    Page %d of %d", i+1, len(doc.pages))
+		}
+		p.text(brochureMargin, 24, pdfRegular, 8, 0.5, footer)
+	}
+
+	var out bytes.Buffer
+	if _, err := doc.WriteTo(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// photo returns the car photo as a JPEG for a brochure, shrunk to
+// brochurePhotoEdge and turned upright. It returns nil for a WebP photo,
+// which cannot be decoded here.
+func (b *brochures) photo(ctx context.Context, img carImage) (*pdfImage, error) {
+	if img.ContentType != "image/jpeg" && img.ContentType != "image/png" {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(img.ID)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := b.photos.open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var original bytes.Buffer
+	_, err = original.ReadFrom(stream)
+	stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxRenditionPixels {
+		return nil, fmt.Errorf("photo of %dx%d is too large to embed", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	var rgba *image.RGBA
+	if bounds := src.Bounds(); max(bounds.Dx(), bounds.Dy()) > brochurePhotoEdge {
+		rgba = scale(src, brochurePhotoEdge).(*image.RGBA)
+	} else {
+		// Drawn on white, as scale does, for transparent PNGs.
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Over)
+	}
+	if img.ContentType == "image/jpeg" {
+		rgba = orient(rgba, exifOrientation(original.Bytes()))
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: renditionQuality}); err != nil {
+		return nil, err
+	}
+	return &pdfImage{jpeg: buf.Bytes(), width: rgba.Bounds().Dx(), height: rgba.Bounds().Dy()}, nil
+}
+
+// carTitle names a car as listings do: its year, manufacturer and model.
+func carTitle(car vehicle) string {
+	var parts []string
+	if car.Year != 0 {
+		parts = append(parts, strconv.Itoa(car.Year))
+	}
+	for _, s := range []string{car.Manurfacturer, car.Model} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// currencySymbols are written before the prices in their currencies; others
+// are written after, by their codes.
+var currencySymbols = map[string]string{"GBP": "£", "EUR": "€", "USD": "$"}
+
+// formatPrice writes p out for people, e.g. £12,495.00.
+func formatPrice(p price) string {
+	amount := p.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	s := formatNumber(amount/100) + fmt.Sprintf(".%02d", amount%100)
+	if symbol, ok := currencySymbols[p.Currency]; ok {
+		return sign + symbol + s
+	}
+	return sign + s + " " + p.Currency
+}
+
+// formatNumber writes n with its thousands separated by commas.
+func formatNumber(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	start := 0
+	if n < 0 {
+		start = 1
+	}
+	for i := len(s) - 3; i > start; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// carBrochure serves the PDF brochure of a car.
+func carBrochure(c *mongo.Collection, b *brochures) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		key := b.cacheKey(car)
+		body, cached := b.cache.get(key)
+		if !cached {
+			body, err = b.render(r.Context(), car)
+			if err != nil {
+				errorWithJSON(w, "Failed to render the brochure", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed render brochure", "vin", car.VIN, "err", err)
+				return
+			}
+			if b.ttl > 0 {
+				b.cache.set(key, body, b.ttl)
+			}
+		}
+
+		if cached {
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		if notModified(w, r, etag(body)) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `inline; filename="`+car.VIN+`.pdf"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// cacheStore holds cached responses. Generations are counters that cache keys
+// include, so that bumping one drops every entry keyed with it at once.
+type cacheStore interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte, ttl time.Duration)
+	del(key string)
+	generation(name string) uint64
+	bump(name string)
+}
+
+// responseCache caches the responses of the car reads. Writes are learnt of
+// from the broker: one drops the cached car and every cached listing. Should
+// the cache miss events it drops everything, as it cannot tell what changed.
+//
+// With the in-process store, writes made through other instances are only
+// seen once their entries expire, so the TTL bounds how stale a read can be.
+// The Redis store is shared, so it is dropped from by every instance.
+type responseCache struct {
+	store cacheStore
+	ttl   time.Duration
+}
+
+// entryLayout is in the keys of the entries, for entries laid out by older
+// versions, still in a shared store, not to be read.
+const entryLayout = "2"
+
+// cachedHeaders are the response headers kept with a cached body.
+var cachedHeaders = []string{"ETag", "X-Total-Count"}
+
+func (rc *responseCache) carKey(tenant, vin string) string {
+	return "car" + entryLayout + ":" + strconv.FormatUint(rc.store.generation("all"), 10) + ":" + tenant + ":" + vin
+}
+
+func (rc *responseCache) listKey(r *http.Request) string {
+	return "cars" + entryLayout + ":" + strconv.FormatUint(rc.store.generation("all"), 10) + ":" +
+		strconv.FormatUint(rc.store.generation("list"), 10) + ":" + tenantFrom(r.Context()) + ":" +
+		r.URL.Path + "?" + r.URL.Query().Encode()
+}
+
+// dropAll drops every cached response, for writes made around the broker.
+func (rc *responseCache) dropAll() {
+	if rc != nil {
+		rc.store.bump("all")
+	}
+}
+
+// car caches the responses of GET /cars/:vin.
+func (rc *responseCache) car(h http.HandlerFunc) http.HandlerFunc {
+	if rc == nil {
+		return h
+	}
+	cached := rc.serve(func(r *http.Request) string { return rc.carKey(tenantFrom(r.Context()), carVIN(r)) }, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Only whole cars are cached; a selection of fields, a car with its
+		// links or with a converted price is rendered as asked.
+		if r.URL.Query().Has("fields") || r.URL.Query().Has("links") || r.URL.Query().Has("currency") {
+			h(w, r)
+			return
+		}
+		cached(w, r)
+	}
+}
+
+// listing caches the responses of a listing, keyed by its query.
+func (rc *responseCache) listing(h http.HandlerFunc) http.HandlerFunc {
+	if rc == nil {
+		return h
+	}
+	cached := rc.serve(rc.listKey, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A dump is streamed, and too big to cache.
+		if r.URL.Query().Get("format") == "ndjson" {
+			h(w, r)
+			return
+		}
+		cached(w, r)
+	}
+}
+
+// serve answers from the cache when it can, and caches the 200 responses of h
+// otherwise. An entry is the values of cachedHeaders, a line each, and the
+// body.
+func (rc *responseCache) serve(key func(r *http.Request) string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := key(r)
+		if entry, ok := rc.store.get(k); ok {
+			var value []byte
+			for _, name := range cachedHeaders {
+				value, entry, _ = bytes.Cut(entry, []byte("\n"))
+				if len(value) > 0 {
+					w.Header().Set(name, string(value))
+				}
+			}
+			w.Header().Set("X-Cache", "HIT")
+			if notModified(w, r, w.Header().Get("ETag")) {
+				return
+			}
+			responseWithJSON(w, entry, http.StatusOK)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cachingWriter{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+
+		// A 304 has no body to cache.
+		if rec.status == http.StatusOK {
+			var entry []byte
+			for _, name := range cachedHeaders {
+				entry = append(entry, w.Header().Get(name)+"\n"...)
+			}
+			rc.store.set(k, append(entry, rec.body.Bytes()...), rc.ttl)
+		}
+	}
+}
+
+// invalidate drops the entries that the events received on ch make stale,
+// until ch is closed.
+func (rc *responseCache) invalidate(ch chan inventoryEvent) {
+	var last uint64
+	for e := range ch {
+		if last != 0 && e.Seq != last+1 {
+			slog.Warn("Missed inventory events; dropping the response cache", "after", last, "next", e.Seq)
+			rc.store.bump("all")
+		}
+		last = e.Seq
+
+		if e.Car != nil {
+			rc.store.del(rc.carKey(e.Car.Tenant, e.VIN))
+		}
+		rc.store.bump("list")
+	}
+}
+
+// cachingWriter keeps a copy of the body written through it.
+type cachingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cw *cachingWriter) WriteHeader(code int) {
+	cw.status = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cachingWriter) Write(b []byte) (int, error) {
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+// memoryCache is an in-process cacheStore holding at most max entries, least
+// recently used first out.
+type memoryCache struct {
+	mu          sync.Mutex
+	max         int
+	entries     map[string]*list.Element
+	lru         *list.List
+	generations map[string]uint64
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache(max int) *memoryCache {
+	return &memoryCache{
+		max:         max,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		generations: make(map[string]uint64),
+	}
+}
+
+func (m *memoryCache) get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (m *memoryCache) set(key string, value []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+
+	for m.lru.Len() > m.max {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memoryCache) del(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+}
+
+func (m *memoryCache) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryEntry).key)
+}
+
+func (m *memoryCache) generation(name string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generations[name]
+}
+
+// Bumping "all" also drops every entry, as nothing will look them up again.
+// Listings of an old "list" generation are left to expire or be pushed out.
+func (m *memoryCache) bump(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.generations[name]++
+	if name == "all" {
+		m.entries = make(map[string]*list.Element)
+		m.lru.Init()
+	}
+}
+
+// redisCache is a cacheStore shared through Redis. Failures are logged and
+// treated as misses so that the API keeps serving from Mongo when Redis is
+// down.
+type redisCache struct {
+	pool *redis.Pool
+}
+
+func newRedisCache(url string) *redisCache {
+	return &redisCache{pool: newRedisPool(url)}
+}
+
+// newRedisPool returns a pool of connections to the Redis at url, each
+// giving up on a command after a second.
+func newRedisPool(url string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url, redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second), redis.DialWriteTimeout(time.Second))
+		},
+	}
+}
+
+const redisPrefix = "carsupermarket:"
+
+func (rc *redisCache) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := rc.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do(cmd, args...)
+	if err != nil && err != redis.ErrNil {
+		slog.Error("Failed redis "+strings.ToLower(cmd), "err", err)
+	}
+	return reply, err
+}
+
+func (rc *redisCache) get(key string) ([]byte, bool) {
+	value, err := redis.Bytes(rc.do("GET", redisPrefix+key))
+	return value, err == nil
+}
+
+func (rc *redisCache) set(key string, value []byte, ttl time.Duration) {
+	rc.do("SET", redisPrefix+key, value, "PX", ttl.Milliseconds())
+}
+
+func (rc *redisCache) del(key string) {
+	rc.do("DEL", redisPrefix+key)
+}
+
+func (rc *redisCache) generation(name string) uint64 {
+	gen, _ := redis.Uint64(rc.do("GET", redisPrefix+"generation:"+name))
+	return gen
+}
+
+func (rc *redisCache) bump(name string) {
+	rc.do("INCR", redisPrefix+"generation:"+name)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"problem"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxCompareCars is the most cars one comparison may hold.
+const maxCompareCars = 4
+
+// comparedFields are the specs of the cars a comparison lines up, in the
+// order they are shown.
+var comparedFields = []string{
+	"manufacturer", "model", "year", "mileage", "price", "fuel_type",
+	"transmission", "colour", "condition", "service_history", "status",
+}
+
+// comparison is the response of GET /cars/compare: the cars, in the order
+// asked for, and each of their specs side by side.
+type comparison struct {
+	Cars   []vehicle       `json:"cars"`
+	Fields []comparedField `json:"fields"`
+	// Differing names the fields whose values are not all the same.
+	Differing []string `json:"differing"`
+}
+
+// comparedField is one spec of the cars compared, with a value for each car
+// in the order of Cars; null where a car has none.
+type comparedField struct {
+	Field   string        `json:"field"`
+	Values  []interface{} `json:"values"`
+	Differs bool          `json:"differs"`
+}
+
+// compareCars lines up the specs of the live cars in ?vins=, so that a
+// storefront can show them side by side without fetching each one. With
+// ?currency= the prices compared are those converted to it.
+func compareCars(cars vehicleRepository, rates *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currency := r.URL.Query().Get("currency")
+		if currency != "" && !currencyCode.MatchString(currency) {
+			errorWithJSON(w, "Parameter \"currency\" must be an ISO 4217 code such as EUR", http.StatusBadRequest)
+			return
+		}
+
+		var vins []string
+		seen := map[string]bool{}
+		for _, v := range strings.Split(r.URL.Query().Get("vins"), ",") {
+			if vin := vin.Normalize(v); vin != "" && !seen[vin] {
+				seen[vin] = true
+				vins = append(vins, vin)
+			}
+		}
+		if len(vins) < 2 || len(vins) > maxCompareCars {
+			errorWithJSON(w, fmt.Sprintf("Parameter \"vins\" must name between 2 and %d different cars", maxCompareCars), http.StatusBadRequest)
+			return
+		}
+
+		found := make(map[string]vehicle, len(vins))
+		params := ListParams{Filter: bson.M{"vin": bson.M{"$in": vins}, "deletedat": bson.M{"$exists": false}}}
+		err := cars.each(r.Context(), params, func(car vehicle) error {
+			found[car.VIN] = car
+			return nil
+		})
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find cars to compare", "err", err)
+			return
+		}
+
+		res := comparison{Cars: make([]vehicle, 0, len(vins)), Differing: []string{}}
+		for _, vin := range vins {
+			car, ok := found[vin]
+			if !ok {
+				errorWithJSON(w, "Car not found: "+vin, http.StatusNotFound)
+				return
+			}
+			res.Cars = append(res.Cars, car)
+		}
+		if !displayPricesOrFail(w, r, rates, res.Cars, currency) {
+			return
+		}
+		labelCars(r.Context(), res.Cars)
+
+		fields := append([]string(nil), comparedFields...)
+		if currency != "" {
+			fields[slices.Index(fields, "price")] = "display_price"
+		}
+		specs := make([]map[string]interface{}, len(res.Cars))
+		for i, car := range res.Cars {
+			if specs[i], err = selectFields(car, fields); err != nil {
+				panic(err)
+			}
+		}
+		for _, name := range fields {
+			f := comparedField{Field: name, Values: make([]interface{}, len(specs))}
+			for i, spec := range specs {
+				f.Values[i] = spec[name]
+				if i > 0 && !reflect.DeepEqual(f.Values[i], f.Values[0]) {
+					f.Differs = true
+				}
+			}
+			if f.Differs {
+				res.Differing = append(res.Differing, name)
+			}
+			res.Fields = append(res.Fields, f)
+		}
+
+		respBody, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
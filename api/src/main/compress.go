@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression a server offers; with compressZstd, zstd is used for the
+// clients that accept it and gzip for the others.
+const (
+	compressOff  = "off"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return zw
+}}
+
+var zstdWriters = sync.Pool{New: func() interface{} {
+	zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+	return zw
+}}
+
+// compressResponses compresses the responses of minSize bytes or more for the
+// clients whose Accept-Encoding allows, as offered. Responses already encoded,
+// and images, video and archives, which are compressed already, are sent as
+// they are.
+func compressResponses(offered string, minSize int) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if offered == compressOff {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateCompression(r.Header.Get("Accept-Encoding"), offered == compressZstd)
+			if encoding == "" || r.Method == http.MethodHead {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, status: http.StatusOK}
+			// Not deferred: a panicking handler's response is left for
+			// recoverPanics to answer.
+			h.ServeHTTP(cw, r)
+			cw.close()
+		})
+	}
+}
+
+// negotiateCompression returns the encoding to compress with for the
+// Accept-Encoding header accept, or "" for none.
+func negotiateCompression(accept string, zstdOffered bool) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == compressZstd && !zstdOffered || coding != compressZstd && coding != compressGzip {
+			continue
+		}
+		// zstd wins a tie, being faster for the same ratio.
+		if q > bestQ || q == bestQ && q > 0 && coding == compressZstd {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the start of a response until it has minSize
+// bytes, or is flushed or ends, to tell whether it is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	zw          io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	// A response with no body or that switches protocols goes as it is.
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressing the response from now on if big is
+// set and it is of a type worth compressing, then sends what was held back.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if big && cw.status != http.StatusPartialContent && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == compressZstd {
+			zw := zstdWriters.Get().(*zstd.Encoder)
+			zw.Reset(cw.ResponseWriter)
+			cw.zw = zw
+		} else {
+			zw := gzipWriters.Get().(*gzip.Writer)
+			zw.Reset(cw.ResponseWriter)
+			cw.zw = zw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compressible reports whether a response of contentType is worth
+// compressing: those of types stored compressed are not.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return mediaType == "image/svg+xml"
+	case mediaType == "application/zip", mediaType == "application/gzip", mediaType == "application/zstd",
+		mediaType == "application/pdf", mediaType == "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+		return false
+	}
+	return true
+}
+
+// close sends what is held back of a small response as it is, or ends the
+// compressed stream, returning its writer to its pool.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.zw == nil {
+		return
+	}
+	cw.zw.Close()
+	switch zw := cw.zw.(type) {
+	case *gzip.Writer:
+		zw.Reset(nil)
+		gzipWriters.Put(zw)
+	case *zstd.Encoder:
+		zw.Reset(nil)
+		zstdWriters.Put(zw)
+	}
+	cw.zw = nil
+}
+
+// Flush sends what has been written so far, so event streams and streamed
+// pages still arrive as they are written.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.minSize)
+	}
+	if f, ok := cw.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	cw.decided = true
+	return h.Hijack()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulTimeout bounds each call to the Consul agent.
+const consulTimeout = 5 * time.Second
+
+// consulRegistration registers the instance with the local Consul agent as
+// a service, with an HTTP check of /readyz, so that it is only sent traffic
+// while it can reach its database.
+type consulRegistration struct {
+	agent  string
+	token  string
+	client *http.Client
+
+	id      string
+	service consulService
+}
+
+type consulService struct {
+	ID      string      `json:"ID"`
+	Name    string      `json:"Name"`
+	Address string      `json:"Address,omitempty"`
+	Port    int         `json:"Port"`
+	Tags    []string    `json:"Tags,omitempty"`
+	Check   consulCheck `json:"Check"`
+}
+
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// newConsulRegistration describes the instance listening on listenAddr as
+// name at address, or at the host name when address is empty. The ID is
+// unique to the instance, so that replicas are registered side by side.
+func newConsulRegistration(agent, token, name, address, listenAddr string, tags []string, https bool, interval time.Duration) (*consulRegistration, error) {
+	_, portText, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_ADDR has no port to register: %q", listenAddr)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		address = host
+	}
+
+	scheme := "http"
+	if https {
+		scheme = "https"
+	}
+	id := name + "-" + host + "-" + portText
+	return &consulRegistration{
+		agent:  strings.TrimSuffix(agent, "/"),
+		token:  token,
+		client: &http.Client{Timeout: consulTimeout},
+		id:     id,
+		service: consulService{
+			ID:      id,
+			Name:    name,
+			Address: address,
+			Port:    port,
+			Tags:    tags,
+			Check: consulCheck{
+				HTTP:     (&url.URL{Scheme: scheme, Host: net.JoinHostPort(address, portText), Path: route("/readyz")}).String(),
+				Interval: interval.String(),
+				Timeout:  readyTimeout.String(),
+				// An instance that died without deregistering is removed
+				// once it has failed its check this long.
+				DeregisterCriticalServiceAfter: "10m",
+			},
+		},
+	}, nil
+}
+
+// register adds the service. Consul starts its check as critical, so no
+// traffic is routed to the instance before it answers /readyz.
+func (c *consulRegistration) register(ctx context.Context) error {
+	body, err := json.Marshal(c.service)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, "/v1/agent/service/register", body)
+}
+
+// deregister removes the service, so that traffic stops being routed to the
+// instance before it drains its connections.
+func (c *consulRegistration) deregister(ctx context.Context) error {
+	return c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(c.id), nil)
+}
+
+// deregister removes the registration, if any, logging a failure: Consul
+// drops the service itself once its check has been critical long enough.
+func deregister(c *consulRegistration) {
+	if c == nil {
+		return
+	}
+	if err := c.deregister(context.Background()); err != nil {
+		slog.Error("Failed deregister from Consul", "err", err)
+	}
+}
+
+func (c *consulRegistration) put(ctx context.Context, path string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, consulTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.agent+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul agent answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contract"
+)
+
+// maxRecordedBody is the largest request or response body recorded; larger
+// exchanges are not.
+const maxRecordedBody = 256 << 10
+
+// contractRecorder records up to perRoute exchanges of each route and
+// method, sanitized, as golden files in dir, for carsctl contracts to replay
+// against later servers. Only exchanges with JSON bodies, or none, are
+// recorded. It is for staging, with traffic like the partners', never for
+// production.
+type contractRecorder struct {
+	dir      string
+	perRoute int
+
+	mu       sync.Mutex
+	recorded map[string]int
+}
+
+func newContractRecorder(dir string, perRoute int) *contractRecorder {
+	return &contractRecorder{dir: dir, perRoute: perRoute, recorded: map[string]int{}}
+}
+
+// take reserves the next file of the route, if it has room left for one.
+func (c *contractRecorder) take(name string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.recorded[name]
+	if n >= c.perRoute {
+		return 0, false
+	}
+	c.recorded[name] = n + 1
+	return n + 1, true
+}
+
+// recordContracts records the exchanges of c. A nil c records none. Streams,
+// WebSockets, health checks and metrics are never recorded.
+func recordContracts(c *contractRecorder) func(http.Handler) http.Handler {
+	skipped := map[string]bool{route("/healthz"): true, route("/readyz"): true, route("/metrics"): true}
+	for _, p := range uncappedRoutes {
+		skipped[apiRoute(p)] = true
+	}
+	return func(h http.Handler) http.Handler {
+		if c == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern := routePattern(r)
+			if skipped[r.URL.Path] || pattern == "unmatched" || r.ContentLength < 0 || r.ContentLength > maxRecordedBody {
+				h.ServeHTTP(w, r)
+				return
+			}
+			name := strings.ToLower(r.Method) + strings.NewReplacer("/", "_", ":", "").Replace(strings.TrimPrefix(pattern, basePath))
+			n, ok := c.take(name)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			var reqBody []byte
+			if r.Body != nil {
+				var err error
+				reqBody, err = io.ReadAll(io.LimitReader(r.Body, maxRecordedBody))
+				if err != nil {
+					errorWithJSON(w, "The request body could not be read", http.StatusBadRequest)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(reqBody))
+			}
+			rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(rec, r)
+
+			ex := contract.Exchange{
+				Route:      strings.TrimPrefix(pattern, basePath),
+				Method:     r.Method,
+				Path:       strings.TrimPrefix(r.URL.Path, basePath),
+				Query:      r.URL.RawQuery,
+				Header:     keptHeaders(r.Header),
+				Body:       contract.Sanitize(reqBody),
+				Response:   contract.Response{Status: rec.status, Header: keptHeaders(w.Header()), Body: contract.Sanitize(rec.body.Bytes())},
+				RecordedAt: time.Now().UTC(),
+			}
+			if rec.over || (len(reqBody) > 0 && ex.Body == nil) || (rec.body.Len() > 0 && ex.Response.Body == nil) {
+				return
+			}
+			if err := c.write(name, n, ex); err != nil {
+				slog.WarnContext(r.Context(), "Failed record exchange", "route", pattern, "err", err)
+			}
+		})
+	}
+}
+
+func (c *contractRecorder) write(name string, n int, ex contract.Exchange) error {
+	b, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(c.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, strconv.Itoa(n)+".json"), b, 0o644)
+}
+
+// keptHeaders returns the values of the contract.Headers that header has.
+func keptHeaders(header http.Header) map[string]string {
+	kept := map[string]string{}
+	for _, name := range contract.Headers {
+		if v := header.Get(name); v != "" {
+			kept[name] = v
+		}
+	}
+	return kept
+}
+
+// recordingWriter keeps a copy of the response written through it, until it
+// is too large to record.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	over   bool
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if !rw.over {
+		if rw.body.Len()+len(b) > maxRecordedBody {
+			rw.over = true
+			rw.body.Reset()
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
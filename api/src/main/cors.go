@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// corsPolicy says which browser origins may call the API and how.
+type corsPolicy struct {
+	origins map[string]bool // "*" allows any origin
+	methods string
+	headers map[string]bool
+	expose  string
+	maxAge  time.Duration
+}
+
+// newCORSPolicy returns the policy allowing origins, or nil, which
+// disables CORS, when there are none.
+func newCORSPolicy(origins, methods, headers, expose []string, maxAge time.Duration) *corsPolicy {
+	if len(origins) == 0 {
+		return nil
+	}
+	p := &corsPolicy{
+		origins: make(map[string]bool),
+		methods: strings.Join(methods, ", "),
+		headers: make(map[string]bool),
+		expose:  strings.Join(expose, ", "),
+		maxAge:  maxAge,
+	}
+	for _, o := range origins {
+		p.origins[o] = true
+	}
+	for _, h := range headers {
+		p.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return p
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	return p.origins["*"] || p.origins[origin]
+}
+
+// cors adds Access-Control-Allow-* headers for the origins the policy
+// allows and answers preflight requests itself. The policy may be replaced
+// as the server runs; a nil one disables CORS.
+func cors(policy *atomic.Pointer[corsPolicy]) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := policy.Load()
+			origin := r.Header.Get("Origin")
+			if p == nil || origin == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !p.allowsOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			if !preflight {
+				if p.expose != "" {
+					w.Header().Set("Access-Control-Expose-Headers", p.expose)
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+				name = strings.TrimSpace(name)
+				if name != "" && !p.headers[http.CanonicalHeaderKey(name)] {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", p.methods)
+			if r.Header.Get("Access-Control-Request-Headers") != "" {
+				w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// customer is a person known to the business, with the enquiries they have
+// made and the cars they have bought. Customers are personal data, so only
+// editors may see them and only admins may erase them.
+type customer struct {
+	ID        string     `json:"id" bson:"customerid"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email,omitempty" bson:",omitempty"`
+	Phone     string     `json:"phone,omitempty" bson:",omitempty"`
+	Address   *address   `json:"address,omitempty" bson:",omitempty"`
+	Consent   consent    `json:"consent"`
+	Enquiries []enquiry  `json:"enquiries" bson:"enquiries"`
+	Purchases []purchase `json:"purchases" bson:"purchases"`
+	CreatedAt time.Time  `json:"created_at" bson:"createdat"`
+	UpdatedAt time.Time  `json:"updated_at" bson:"updatedat"`
+	Tenant    string     `json:"-" bson:"tenant"`
+}
+
+// consent records what the customer has agreed to be contacted about, as
+// GDPR requires. Nothing is consented to unless it is given.
+type consent struct {
+	MarketingEmail bool `json:"marketing_email" bson:"marketingemail"`
+	MarketingPhone bool `json:"marketing_phone" bson:"marketingphone"`
+	MarketingPost  bool `json:"marketing_post" bson:"marketingpost"`
+	// UpdatedAt is when the consent was last given or withdrawn.
+	UpdatedAt *time.Time `json:"updated_at,omitempty" bson:"updatedat,omitempty"`
+}
+
+// enquiry is a customer's interest in a car.
+type enquiry struct {
+	ID      string    `json:"id" bson:"enquiryid"`
+	VIN     string    `json:"vin"`
+	Channel string    `json:"channel,omitempty" bson:",omitempty"`
+	Message string    `json:"message,omitempty" bson:",omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// purchase is a car bought by a customer.
+type purchase struct {
+	ID    string    `json:"id" bson:"purchaseid"`
+	VIN   string    `json:"vin"`
+	Price *price    `json:"price,omitempty" bson:",omitempty"`
+	At    time.Time `json:"at"`
+}
+
+var enquiryChannels = map[string]bool{"web": true, "phone": true, "email": true, "showroom": true}
+
+func (c *customer) validate() *fieldError {
+	v := &checks{}
+	v.require("name", c.Name, "The name is required")
+	v.maxLength("name", c.Name, maxNameLength)
+	v.check(c.Email == "" || strings.Contains(c.Email, "@"), "email", "The email address is not valid")
+	return v.err()
+}
+
+type customerStore struct {
+	c *mongo.Collection
+}
+
+func (s *customerStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "customerid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "enquiries.vin", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "purchases.vin", Value: 1}}},
+	})
+	return err
+}
+
+func writeCustomer(w http.ResponseWriter, c customer, status int) {
+	respBody, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, status)
+}
+
+// customerNotFound writes the response for a failed lookup of a customer.
+func customerNotFound(w http.ResponseWriter, err error, op string) {
+	switch err {
+	default:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.Error("Failed "+op, "err", err)
+	case mongo.ErrNoDocuments:
+		errorWithJSON(w, "Customer not found", http.StatusNotFound)
+	}
+}
+
+func addCustomer(s *customerStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c customer
+		if !decodeBody(w, r.Body, &c) {
+			return
+		}
+
+		if err := c.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		c.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		c.CreatedAt = time.Now().UTC()
+		c.UpdatedAt = c.CreatedAt
+		c.Consent.UpdatedAt = &c.CreatedAt
+		c.Enquiries = []enquiry{}
+		c.Purchases = []purchase{}
+		c.Tenant = tenantFrom(r.Context())
+
+		_, err = s.c.InsertOne(r.Context(), c)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert customer", "err", err)
+			return
+		}
+
+		w.Header().Set("Location", apiRoute("/customers/"+c.ID))
+		writeCustomer(w, c, http.StatusCreated)
+	}
+}
+
+// allCustomers lists the customers, optionally only those with an email
+// address or who consent to a kind of marketing, for CRM exports.
+func allCustomers(s *customerStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := forTenant(r.Context(), bson.M{})
+		if email := r.URL.Query().Get("email"); email != "" {
+			filter["email"] = email
+		}
+		switch consentTo := r.URL.Query().Get("consent"); consentTo {
+		case "":
+		case "marketing_email", "marketing_phone", "marketing_post":
+			filter["consent."+strings.Replace(consentTo, "_", "", 1)] = true
+		default:
+			errorWithJSON(w, "Parameter \"consent\" must be marketing_email, marketing_phone or marketing_post", http.StatusBadRequest)
+			return
+		}
+
+		customers := []customer{}
+		opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "customerid", Value: 1}})
+		cur, err := s.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &customers)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list customers", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(customers, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func customerByID(s *customerStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c customer
+		err := s.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"customerid": pat.Param(r, "id")})).Decode(&c)
+		if err != nil {
+			customerNotFound(w, err, "find customer")
+			return
+		}
+
+		writeCustomer(w, c, http.StatusOK)
+	}
+}
+
+// updateCustomer replaces the details and consent of a customer. Their
+// enquiries and purchases are kept.
+func updateCustomer(s *customerStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c customer
+		if !decodeBody(w, r.Body, &c) {
+			return
+		}
+
+		if err := c.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		filter := forTenant(r.Context(), bson.M{"customerid": pat.Param(r, "id")})
+
+		var before customer
+		err := s.c.FindOne(r.Context(), filter).Decode(&before)
+		if err != nil {
+			customerNotFound(w, err, "find customer")
+			return
+		}
+
+		now := time.Now().UTC()
+		c.Consent.UpdatedAt = before.Consent.UpdatedAt
+		if c.Consent.MarketingEmail != before.Consent.MarketingEmail ||
+			c.Consent.MarketingPhone != before.Consent.MarketingPhone ||
+			c.Consent.MarketingPost != before.Consent.MarketingPost {
+			c.Consent.UpdatedAt = &now
+		}
+
+		update := bson.M{"$set": bson.M{
+			"name":      c.Name,
+			"email":     c.Email,
+			"phone":     c.Phone,
+			"address":   c.Address,
+			"consent":   c.Consent,
+			"updatedat": now,
+		}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = s.c.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&c)
+		if err != nil {
+			customerNotFound(w, err, "update customer")
+			return
+		}
+
+		writeCustomer(w, c, http.StatusOK)
+	}
+}
+
+// eraseCustomer deletes a customer and everything held about them, for
+// GDPR erasure requests.
+func eraseCustomer(s *customerStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.c.DeleteOne(r.Context(), forTenant(r.Context(), bson.M{"customerid": pat.Param(r, "id")}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete customer", "err", err)
+			return
+		}
+
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// linkToCustomer adds what link decodes from the body to the named array of
+// the customer, once it has checked that the car it is about is in stock.
+func linkToCustomer(s *customerStore, cars *mongo.Collection, field string,
+	link func(r *http.Request, id string, at time.Time) (interface{}, string, *fieldError)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+
+		item, vin, ferr := link(r, id, time.Now().UTC())
+		if ferr != nil {
+			if ferr.Field == "" {
+				errorWithJSON(w, ferr.Message, http.StatusBadRequest)
+				return
+			}
+			fieldErrorWithJSON(w, ferr.Field, ferr.Reason, ferr.Message)
+			return
+		}
+
+		n, err := cars.CountDocuments(r.Context(), liveCar(r.Context(), vin))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			return
+		}
+		if n == 0 {
+			fieldErrorWithJSON(w, "vin", "not_found", "There is no car with this VIN")
+			return
+		}
+
+		var c customer
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		filter := forTenant(r.Context(), bson.M{"customerid": pat.Param(r, "id")})
+		update := bson.M{"$push": bson.M{field: item}, "$set": bson.M{"updatedat": time.Now().UTC()}}
+		err = s.c.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&c)
+		if err != nil {
+			customerNotFound(w, err, "link to customer")
+			return
+		}
+
+		writeCustomer(w, c, http.StatusCreated)
+	}
+}
+
+func addEnquiry(s *customerStore, cars *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return linkToCustomer(s, cars, "enquiries", func(r *http.Request, id string, at time.Time) (interface{}, string, *fieldError) {
+		var e enquiry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			return nil, "", &fieldError{Message: "Incorrect body"}
+		}
+		if e.Channel != "" && !enquiryChannels[e.Channel] {
+			return nil, "", &fieldError{Message: "The channel must be web, phone, email or showroom", Field: "channel", Reason: "invalid"}
+		}
+		e.ID = id
+		e.At = at
+		return e, e.VIN, nil
+	})
+}
+
+func addPurchase(s *customerStore, cars *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return linkToCustomer(s, cars, "purchases", func(r *http.Request, id string, at time.Time) (interface{}, string, *fieldError) {
+		var p purchase
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return nil, "", &fieldError{Message: "Incorrect body"}
+		}
+		if p.Price != nil && (p.Price.Amount < 0 || !currencyCode.MatchString(p.Price.Currency)) {
+			return nil, "", &fieldError{Message: "The price must not be negative and in an ISO 4217 currency", Field: "price", Reason: "invalid"}
+		}
+		p.ID = id
+		if p.At.IsZero() {
+			p.At = at
+		}
+		return p, p.VIN, nil
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultQualitySample and maxQualitySample are how many VINs are
+	// listed of each issue, unless ?sample= says otherwise, and the most it
+	// may.
+	defaultQualitySample = 10
+	maxQualitySample     = 100
+	// defaultStaleDays is how long a car may go without a write before it is
+	// stale, unless ?stale_days= says otherwise.
+	defaultStaleDays = 90
+)
+
+// The issues the data-quality report looks for, in the order it lists them.
+const (
+	issueMissingPrice  = "missing_price"
+	issueMissingImages = "missing_images"
+	issueInvalidVIN    = "invalid_vin"
+	issueBlankRegNo    = "blank_regno"
+	issueStale         = "stale"
+)
+
+var qualityIssues = []string{issueMissingPrice, issueMissingImages, issueInvalidVIN, issueBlankRegNo, issueStale}
+
+// qualityIssue counts the cars with an issue, listing the first of them by
+// VIN.
+type qualityIssue struct {
+	Issue  string   `json:"issue"`
+	Count  int64    `json:"count"`
+	Sample []string `json:"sample"`
+}
+
+// qualityReport is what is wrong with the cars in the inventory, issue by
+// issue.
+type qualityReport struct {
+	Cars      int64          `json:"cars"`
+	StaleDays int            `json:"stale_days"`
+	Issues    []qualityIssue `json:"issues"`
+	At        time.Time      `json:"at"`
+}
+
+// dataQualityReport scans the tenant's inventory, its live cars not yet sold
+// or written off, for what the data team cleans up: cars without a price or
+// photos, whose VIN fails its check digit, without a registration, or not
+// written to in ?stale_days= days. A car last written before there was an
+// audit trail is as old as its record. Check digits are checked here rather
+// than by the database, so every car is read, a few fields of each.
+func dataQualityReport(c *mongo.Collection, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sample, staleDays := defaultQualitySample, defaultStaleDays
+		if v := r.URL.Query().Get("sample"); v != "" {
+			n, err := parseCount("sample", v, 1, maxQualitySample)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sample = n
+		}
+		if v := r.URL.Query().Get("stale_days"); v != "" {
+			n, err := parseCount("stale_days", v, 1, 3650)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			staleDays = n
+		}
+
+		now := time.Now().UTC()
+		cutoff := now.AddDate(0, 0, -staleDays)
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: forTenant(r.Context(), bson.M{
+				"deletedat": bson.M{"$exists": false},
+				"status":    bson.M{"$nin": bson.A{carSold, carWrittenOff}},
+			})}},
+			{{Key: "$sort", Value: bson.D{{Key: "vin", Value: 1}}}},
+			{{Key: "$lookup", Value: bson.M{
+				"from": audit.c.Name(),
+				"let":  bson.M{"tenant": "$tenant", "vin": "$vin"},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$tenant", "$$tenant"}},
+						bson.M{"$eq": bson.A{"$vin", "$$vin"}},
+					}}}},
+					bson.M{"$sort": bson.M{"at": -1}},
+					bson.M{"$limit": 1},
+					bson.M{"$project": bson.M{"at": 1}},
+				},
+				"as": "last",
+			}}},
+			{{Key: "$project", Value: bson.M{
+				"vin":    1,
+				"regno":  1,
+				"priced": bson.M{"$gt": bson.A{"$price.amount", 0}},
+				"photos": bson.M{"$size": bson.M{"$ifNull": bson.A{"$images", bson.A{}}}},
+				"written": bson.M{"$ifNull": bson.A{
+					bson.M{"$arrayElemAt": bson.A{"$last.at", 0}},
+					bson.M{"$toDate": "$_id"},
+				}},
+			}}},
+		}
+
+		issues := make(map[string]*qualityIssue, len(qualityIssues))
+		report := qualityReport{StaleDays: staleDays, At: now}
+		for _, name := range qualityIssues {
+			report.Issues = append(report.Issues, qualityIssue{Issue: name, Sample: []string{}})
+		}
+		for i := range report.Issues {
+			issues[report.Issues[i].Issue] = &report.Issues[i]
+		}
+		found := func(name, vin string) {
+			issue := issues[name]
+			issue.Count++
+			if len(issue.Sample) < sample {
+				issue.Sample = append(issue.Sample, vin)
+			}
+		}
+
+		cur, err := c.Aggregate(r.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err == nil {
+			defer cur.Close(r.Context())
+			for cur.Next(r.Context()) {
+				var car struct {
+					VIN     string
+					RegNo   string
+					Priced  bool
+					Photos  int
+					Written time.Time
+				}
+				if err = cur.Decode(&car); err != nil {
+					break
+				}
+				report.Cars++
+				if !car.Priced {
+					found(issueMissingPrice, car.VIN)
+				}
+				if car.Photos == 0 {
+					found(issueMissingImages, car.VIN)
+				}
+				if vin.Validate(car.VIN) != nil {
+					found(issueInvalidVIN, car.VIN)
+				}
+				if strings.TrimSpace(car.RegNo) == "" {
+					found(issueBlankRegNo, car.VIN)
+				}
+				if car.Written.Before(cutoff) {
+					found(issueStale, car.VIN)
+				}
+			}
+			if err == nil {
+				err = cur.Err()
+			}
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed compute data-quality report", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
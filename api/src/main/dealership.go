@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// dealership is a branch that holds stock. Cars name the branch they are at
+// in their branch field.
+type dealership struct {
+	ID       string    `json:"id" bson:"dealershipid"`
+	Name     string    `json:"name"`
+	Address  *address  `json:"address,omitempty" bson:",omitempty"`
+	Location *geoPoint `json:"location,omitempty" bson:",omitempty"`
+	Phone    string    `json:"phone,omitempty" bson:",omitempty"`
+	Email    string    `json:"email,omitempty" bson:",omitempty"`
+	// TestDriveSlots is how many test drives the branch can run at a time;
+	// zero is no limit.
+	TestDriveSlots int `json:"test_drive_slots,omitempty" bson:"testdriveslots,omitempty"`
+	// CreatedAt and UpdatedAt are set by the server.
+	CreatedAt time.Time `json:"created_at" bson:"createdat"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updatedat"`
+	Tenant    string    `json:"-" bson:"tenant"`
+}
+
+type address struct {
+	Lines    []string `json:"lines,omitempty" bson:",omitempty"`
+	Town     string   `json:"town,omitempty" bson:",omitempty"`
+	Postcode string   `json:"postcode,omitempty" bson:",omitempty"`
+	Country  string   `json:"country,omitempty" bson:",omitempty"`
+}
+
+// geoPoint is a GeoJSON point, stored as such so it can be indexed for
+// geospatial queries. Coordinates are longitude then latitude.
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+func (d *dealership) validate() *fieldError {
+	c := &checks{}
+	c.require("name", d.Name, "The name is required")
+	c.maxLength("name", d.Name, maxNameLength)
+	if d.Location != nil {
+		lng, lat := d.Location.Coordinates[0], d.Location.Coordinates[1]
+		c.check(d.Location.Type == "Point" && lng >= -180 && lng <= 180 && lat >= -90 && lat <= 90,
+			"location", "The location must be a GeoJSON point of longitude and latitude")
+	}
+	c.check(d.Email == "" || strings.Contains(d.Email, "@"), "email", "The email address is not valid")
+	c.check(d.TestDriveSlots >= 0, "test_drive_slots", "The number of test drive slots must not be negative")
+	return c.err()
+}
+
+type dealershipStore struct {
+	c *mongo.Collection
+}
+
+func (s *dealershipStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "dealershipid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+	})
+	return err
+}
+
+// find returns the tenant's dealership with the ID.
+func (s *dealershipStore) find(ctx context.Context, id string) (dealership, error) {
+	var d dealership
+	err := s.c.FindOne(ctx, forTenant(ctx, bson.M{"dealershipid": id})).Decode(&d)
+	return d, err
+}
+
+// findDealership writes the error response and returns false when the
+// dealership with the ID in the route cannot be found.
+func findDealership(w http.ResponseWriter, r *http.Request, s *dealershipStore) (dealership, bool) {
+	d, err := s.find(r.Context(), pat.Param(r, "id"))
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find dealership", "err", err)
+			return d, false
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Dealership not found", http.StatusNotFound)
+			return d, false
+		}
+	}
+	return d, true
+}
+
+func addDealership(s *dealershipStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d dealership
+		if !decodeBody(w, r.Body, &d) {
+			return
+		}
+
+		if err := d.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		d.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		d.CreatedAt = time.Now().UTC()
+		d.UpdatedAt = d.CreatedAt
+		d.Tenant = tenantFrom(r.Context())
+
+		_, err = s.c.InsertOne(r.Context(), d)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert dealership", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/dealerships/"+d.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func allDealerships(s *dealershipStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dealerships := []dealership{}
+		opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "dealershipid", Value: 1}})
+		cur, err := s.c.Find(r.Context(), forTenant(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &dealerships)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list dealerships", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(dealerships, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func dealershipByID(s *dealershipStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := findDealership(w, r, s)
+		if !ok {
+			return
+		}
+
+		respBody, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func updateDealership(s *dealershipStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d dealership
+		if !decodeBody(w, r.Body, &d) {
+			return
+		}
+
+		if err := d.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		update := bson.M{"$set": bson.M{
+			"name":           d.Name,
+			"address":        d.Address,
+			"location":       d.Location,
+			"phone":          d.Phone,
+			"email":          d.Email,
+			"testdriveslots": d.TestDriveSlots,
+			"updatedat":      time.Now().UTC(),
+		}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		filter := forTenant(r.Context(), bson.M{"dealershipid": pat.Param(r, "id")})
+		err := s.c.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&d)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed update dealership", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Dealership not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// deleteDealership deletes a dealership that holds no cars. Its stock must
+// be moved to another branch first, so that no car is left at a branch that
+// does not exist.
+func deleteDealership(s *dealershipStore, cars *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := pat.Param(r, "id")
+
+		n, err := cars.CountDocuments(r.Context(), forTenant(r.Context(), bson.M{"branch": id}), options.Count().SetLimit(1))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count dealership cars", "err", err)
+			return
+		}
+		if n > 0 {
+			errorWithJSON(w, "The dealership still holds cars", http.StatusConflict)
+			return
+		}
+
+		res, err := s.c.DeleteOne(r.Context(), forTenant(r.Context(), bson.M{"dealershipid": id}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete dealership", "err", err)
+			return
+		}
+
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "Dealership not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dealershipCars lists the cars at a dealership, taking the same parameters
+// as GET /cars.
+func dealershipCars(s *dealershipStore, cars vehicleRepository, rates *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseListParams(r)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d, ok := findDealership(w, r, s)
+		if !ok {
+			return
+		}
+		params.Filter["branch"] = d.ID
+
+		listCars(w, r, cars, rates, params)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+var startedAt = time.Now()
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} { return int64(time.Since(startedAt).Seconds()) }))
+}
+
+// requireAdmin lets only signed-in admins through, even when authentication
+// is not required of the API's callers.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		if p == nil {
+			unauthorized(w, "Authentication required")
+			return
+		}
+		if roleRank[p.Role] < roleRank[roleAdmin] {
+			errorWithJSON(w, "The "+roleAdmin+" role is required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newDebugServer serves the runtime profiles of net/http/pprof under
+// /debug/pprof/ and the variables of expvar, such as memory statistics and
+// goroutines, at /debug/vars, to admins only. It listens apart from the API
+// so that it can be kept off the public network, and has no write timeout,
+// as a CPU profile takes as long as it is asked to.
+func newDebugServer(addr string, a *authenticator) *http.Server {
+	mux := goji.NewMux()
+	mux.Use(logRequests)
+	mux.Use(authenticate(a))
+	mux.Use(requireAdmin)
+	mux.HandleFunc(pat.Get("/debug/pprof/cmdline"), pprof.Cmdline)
+	mux.HandleFunc(pat.Get("/debug/pprof/profile"), pprof.Profile)
+	mux.HandleFunc(pat.Get("/debug/pprof/symbol"), pprof.Symbol)
+	mux.HandleFunc(pat.Post("/debug/pprof/symbol"), pprof.Symbol)
+	mux.HandleFunc(pat.Get("/debug/pprof/trace"), pprof.Trace)
+	// Index serves the other profiles, such as heap and goroutine, by name.
+	mux.HandleFunc(pat.Get("/debug/pprof/*"), pprof.Index)
+	mux.Handle(pat.Get("/debug/vars"), expvar.Handler())
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+}
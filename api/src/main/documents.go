@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// maxDocumentSize is the largest document that may be uploaded. Documents
+// are held whole while they are scanned.
+const maxDocumentSize = 20 << 20
+
+// The kinds of document kept of a car.
+const (
+	documentLogbook    = "v5c"
+	documentInvoice    = "purchase_invoice"
+	documentInspection = "inspection_report"
+	documentOther      = "other"
+)
+
+// defaultDocumentRoles are the roles that may see and upload each kind of
+// document unless DOCUMENT_ROLES says otherwise: what was paid for a car is
+// for admins, and inspection reports are shown to buyers.
+var defaultDocumentRoles = map[string]string{
+	documentLogbook:    roleEditor,
+	documentInvoice:    roleAdmin,
+	documentInspection: roleViewer,
+	documentOther:      roleEditor,
+}
+
+const documentKindsMessage = "The kind must be v5c, purchase_invoice, inspection_report or other"
+
+// documentTypes are the content types documents may have, as sniffed from
+// their first bytes: PDFs and scans.
+var documentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+// The results of scanning a document. A document is unscanned when no
+// scanner is configured; infected ones are refused.
+const (
+	scanClean     = "clean"
+	scanUnscanned = "unscanned"
+)
+
+// carDocument describes a document of a car, such as its logbook.
+type carDocument struct {
+	ID          string    `json:"id"`
+	VIN         string    `json:"vin"`
+	Kind        string    `json:"kind"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Scan        string    `json:"scan"`
+	UploadedBy  string    `json:"uploaded_by,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// documentFile is a document as its store describes it, shaped like a GridFS
+// file.
+type documentFile struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Length     int64
+	Filename   string
+	UploadDate time.Time `bson:"uploadDate"`
+	Metadata   struct {
+		VIN         string `bson:"vin"`
+		Kind        string `bson:"kind"`
+		ContentType string `bson:"contenttype"`
+		Scan        string `bson:"scan"`
+		UploadedBy  string `bson:"uploadedby,omitempty"`
+	}
+}
+
+func (f *documentFile) document() carDocument {
+	return carDocument{
+		ID:          f.ID.Hex(),
+		VIN:         f.Metadata.VIN,
+		Kind:        f.Metadata.Kind,
+		Filename:    f.Filename,
+		ContentType: f.Metadata.ContentType,
+		Size:        f.Length,
+		Scan:        f.Metadata.Scan,
+		UploadedBy:  f.Metadata.UploadedBy,
+		UploadedAt:  f.UploadDate,
+	}
+}
+
+// virusScanner scans documents before they are stored. scan returns the
+// threat it found in data, or "" if it is clean.
+type virusScanner interface {
+	scan(ctx context.Context, filename, contentType string, data []byte) (string, error)
+}
+
+// httpScanner scans documents with a scanning service, which is posted each
+// one and answers {"clean": true} or {"clean": false, "threat": "..."}.
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPScanner(url string) *httpScanner {
+	return &httpScanner{url: url, client: &http.Client{Timeout: time.Minute}}
+}
+
+func (s *httpScanner) scan(ctx context.Context, filename, contentType string, data []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	req.Header.Set("Accept", "application/json")
+	forwardRequestID(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("virus scan: %s", resp.Status)
+	}
+
+	var v struct {
+		Clean  *bool  `json:"clean"`
+		Threat string `json:"threat"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil || v.Clean == nil {
+		return "", fmt.Errorf("virus scan: unexpected answer: %v", err)
+	}
+	if *v.Clean {
+		return "", nil
+	}
+	if v.Threat == "" {
+		v.Threat = "unknown"
+	}
+	return v.Threat, nil
+}
+
+// carDocuments keeps the documents of cars, in a store of their own but
+// kept where photos are, and says who may see them: each kind to its role
+// and above. Documents are never public, nor linked to, and are only served
+// through the API, to those allowed.
+type carDocuments struct {
+	store photoStore
+	roles map[string]string
+	// scanner, when set, refuses infected documents.
+	scanner virusScanner
+	auth    *authenticator
+}
+
+// newCarDocuments returns the documents with the roles configured for kinds
+// in place of the defaults, which only name known kinds.
+func newCarDocuments(store photoStore, configured map[string]string, scanner virusScanner, auth *authenticator) (*carDocuments, error) {
+	roles := map[string]string{}
+	for kind, role := range defaultDocumentRoles {
+		roles[kind] = role
+	}
+	for kind, role := range configured {
+		if _, ok := defaultDocumentRoles[kind]; !ok {
+			return nil, fmt.Errorf("DOCUMENT_ROLES names unknown document kind %q", kind)
+		}
+		roles[kind] = role
+	}
+	return &carDocuments{store: store, roles: roles, scanner: scanner, auth: auth}, nil
+}
+
+func (d *carDocuments) ensureIndex(ctx context.Context) error {
+	_, err := d.store.files().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "metadata.tenant", Value: 1}, {Key: "metadata.vin", Value: 1}, {Key: "uploadDate", Value: -1}},
+	})
+	return err
+}
+
+// visible returns the kinds of document the caller of ctx may see.
+func (d *carDocuments) visible(ctx context.Context) []string {
+	kinds := []string{}
+	for kind, role := range d.roles {
+		if hasRole(ctx, d.auth, role) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// find returns the document of the car with the VIN, if the caller of ctx
+// may see it; mongo.ErrNoDocuments if there is none they may.
+func (d *carDocuments) find(ctx context.Context, vin, id string) (documentFile, error) {
+	var file documentFile
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return file, mongo.ErrNoDocuments
+	}
+	err = d.store.files().FindOne(ctx, bson.M{
+		"_id": oid, "metadata.vin": vin, "metadata.tenant": tenantFrom(ctx), "metadata.kind": bson.M{"$in": d.visible(ctx)},
+	}).Decode(&file)
+	return file, err
+}
+
+// carDocumentList lists the documents of a car the caller may see, latest
+// first.
+func carDocumentList(d *carDocuments) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{"metadata.vin": carVIN(r), "metadata.tenant": tenantFrom(r.Context()), "metadata.kind": bson.M{"$in": d.visible(r.Context())}}
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			if _, ok := d.roles[kind]; !ok {
+				fieldErrorWithJSON(w, "kind", "invalid", documentKindsMessage)
+				return
+			}
+			filter["metadata.kind"] = bson.M{"$in": d.visible(r.Context()), "$eq": kind}
+		}
+
+		var files []documentFile
+		opts := options.Find().SetSort(bson.D{{Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}})
+		cur, err := d.store.files().Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &files)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list documents", "err", err)
+			return
+		}
+
+		docs := make([]carDocument, 0, len(files))
+		for _, f := range files {
+			docs = append(docs, f.document())
+		}
+
+		respBody, err := json.MarshalIndent(docs, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// uploadCarDocument stores the document in the "file" part of a multipart
+// upload, of the kind of the "kind" parameter, once it is scanned.
+func uploadCarDocument(c *mongo.Collection, d *carDocuments, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+		kind := r.URL.Query().Get("kind")
+		role, ok := d.roles[kind]
+		if !ok {
+			fieldErrorWithJSON(w, "kind", "invalid", documentKindsMessage)
+			return
+		}
+		// Editors upload what they may see; admins upload the rest too.
+		if roleRank[role] < roleRank[roleEditor] {
+			role = roleEditor
+		}
+		if !hasRole(r.Context(), d.auth, role) {
+			errorWithJSON(w, "The "+kind+" documents are for the "+role+" role", http.StatusForbidden)
+			return
+		}
+
+		n, err := c.CountDocuments(r.Context(), liveCar(r.Context(), vin))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			return
+		}
+		if n == 0 {
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxDocumentSize+64<<10)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			errorWithJSON(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+			return
+		}
+		var filename string
+		var data []byte
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				errorWithJSON(w, "No \"file\" part in the upload", http.StatusBadRequest)
+				return
+			}
+			if p.FormName() == "file" {
+				filename = path.Base(p.FileName())
+				data, err = io.ReadAll(io.LimitReader(p, maxDocumentSize+1))
+				if err != nil {
+					var tooLarge *http.MaxBytesError
+					if errors.As(err, &tooLarge) {
+						errorWithJSON(w, fmt.Sprintf("Documents may be at most %d MB", maxDocumentSize>>20), http.StatusRequestEntityTooLarge)
+						return
+					}
+					errorWithJSON(w, "The upload could not be read", http.StatusBadRequest)
+					return
+				}
+				break
+			}
+		}
+		if len(data) > maxDocumentSize {
+			errorWithJSON(w, fmt.Sprintf("Documents may be at most %d MB", maxDocumentSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		contentType := http.DetectContentType(data)
+		if !documentTypes[contentType] {
+			errorWithJSON(w, "Documents must be PDFs or JPEG or PNG scans", http.StatusUnsupportedMediaType)
+			return
+		}
+		if filename == "" || filename == "." || filename == "/" {
+			filename = kind
+		}
+
+		scan := scanUnscanned
+		if d.scanner != nil {
+			threat, err := d.scanner.scan(r.Context(), filename, contentType, data)
+			if err != nil {
+				errorWithJSON(w, "The document could not be scanned for viruses; try again later", http.StatusServiceUnavailable)
+				slog.ErrorContext(r.Context(), "Failed scan document", "err", err)
+				return
+			}
+			if threat != "" {
+				fieldErrorWithJSON(w, "file", "infected", "The document failed its virus scan")
+				slog.WarnContext(r.Context(), "Refused infected document", "vin", vin, "threat", threat)
+				return
+			}
+			scan = scanClean
+		}
+
+		var by string
+		if p := principalFrom(r.Context()); p != nil {
+			by = p.Subject
+		}
+		metadata := bson.M{"vin": vin, "kind": kind, "contenttype": contentType, "scan": scan, "tenant": tenantFrom(r.Context())}
+		if by != "" {
+			metadata["uploadedby"] = by
+		}
+		id, err := d.store.upload(r.Context(), filename, bytes.NewReader(data), metadata)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed store document", "err", err)
+			return
+		}
+
+		doc := carDocument{
+			ID: id.Hex(), VIN: vin, Kind: kind, Filename: filename, ContentType: contentType,
+			Size: int64(len(data)), Scan: scan, UploadedBy: by, UploadedAt: time.Now().UTC(),
+		}
+		entry := audit.entry(r.Context(), auditDocumentAdded, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "documents", New: doc}}
+		audit.record(r.Context(), entry)
+
+		respBody, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/cars/"+vin+"/documents/"+doc.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+// carDocumentByID serves a document of a car to those who may see it, as an
+// attachment kept by no cache.
+func carDocumentByID(d *carDocuments) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, err := d.find(r.Context(), carVIN(r), pat.Param(r, "id"))
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find document", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Document not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		stream, err := d.store.open(r.Context(), file.ID)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed open document", "err", err)
+			return
+		}
+		defer stream.Close()
+
+		w.Header().Set("Content-Type", file.Metadata.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Length, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+		w.Header().Set("Cache-Control", "private, no-store")
+		if _, err := io.Copy(w, stream); err != nil {
+			slog.ErrorContext(r.Context(), "Failed send document", "err", err)
+		}
+	}
+}
+
+// deleteCarDocument deletes a document of a car the caller may see.
+func deleteCarDocument(d *carDocuments, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+		file, err := d.find(r.Context(), vin, pat.Param(r, "id"))
+		if err == nil {
+			err = d.store.delete(r.Context(), file.ID)
+		}
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed delete document", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Document not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		entry := audit.entry(r.Context(), auditDocumentRemoved, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "documents", Old: file.ID.Hex()}}
+		audit.record(r.Context(), entry)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"problem"
+)
+
+// dumpFlushEvery is how many cars are written between flushes of a dump.
+const dumpFlushEvery = 100
+
+// dumpCars streams every car matching params as newline-delimited JSON,
+// as the repository yields them, so that a dump of the whole inventory is
+// never held in memory.
+func dumpCars(w http.ResponseWriter, r *http.Request, cars vehicleRepository, params ListParams) {
+	for _, name := range []string{"limit", "offset", "page", "cursor", "facets", "links"} {
+		if _, ok := r.URL.Query()[name]; ok {
+			errorWithJSON(w, fmt.Sprintf("Parameter %q is not supported with format ndjson", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	// The status is sent with the first car, so that a query that fails
+	// outright is still answered with an error.
+	sent := false
+	send := func() {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		sent = true
+	}
+
+	n := 0
+	err := cars.each(r.Context(), params, func(car vehicle) error {
+		if !sent {
+			send()
+		}
+		var v interface{} = car
+		if params.Fields != nil {
+			var err error
+			if v, err = selectFields(car, params.Fields); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		if n++; n%dumpFlushEvery == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !sent:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed dump cars", "err", err)
+	case err != nil:
+		// The status has been sent, so a failure part way through can only
+		// be logged; the client sees a truncated dump.
+		slog.ErrorContext(r.Context(), "Failed dump cars", "err", err)
+	case !sent:
+		send()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxVINTypos is the most characters two VINs may differ by for their cars
+// to be reported as near-duplicates.
+const maxVINTypos = 2
+
+// nearDuplicate is a pair of cars that are likely one car entered twice,
+// with a mistyped VIN.
+type nearDuplicate struct {
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	RegNo        string   `json:"regno,omitempty"`
+	VINs         []string `json:"vins"`
+	// Distance is how many characters have to be changed, added or removed
+	// to make one VIN the other.
+	Distance int `json:"distance"`
+}
+
+// carDuplicates reports the tenant's live cars of the same manufacturer and
+// model, with the same registration once spacing and case are ignored or
+// with one missing, whose VINs differ by at most maxVINTypos characters.
+// Closest first.
+func carDuplicates(cars vehicleRepository) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := ListParams{
+			Filter:     bson.M{"deletedat": bson.M{"$exists": false}},
+			Projection: bson.M{"vin": 1, "manufacturer": 1, "model": 1, "regno": 1},
+		}
+		groups := map[string][]vehicle{}
+		err := cars.each(r.Context(), params, func(car vehicle) error {
+			key := strings.ToLower(strings.TrimSpace(car.Manurfacturer)) + "\x00" + strings.ToLower(strings.TrimSpace(car.Model))
+			groups[key] = append(groups[key], car)
+			return nil
+		})
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list cars", "err", err)
+			return
+		}
+
+		found := []nearDuplicate{}
+		for _, group := range groups {
+			for i, a := range group {
+				for _, b := range group[i+1:] {
+					if d, ok := nearDuplicates(a, b); ok {
+						found = append(found, d)
+					}
+				}
+			}
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].Distance != found[j].Distance {
+				return found[i].Distance < found[j].Distance
+			}
+			return found[i].VINs[0] < found[j].VINs[0]
+		})
+
+		respBody, err := json.MarshalIndent(found, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// nearDuplicates tells whether a and b, of the same manufacturer and model,
+// are likely the same car.
+func nearDuplicates(a, b vehicle) (nearDuplicate, bool) {
+	regA, regB := normalRegNo(a.RegNo), normalRegNo(b.RegNo)
+	if regA != "" && regB != "" && regA != regB {
+		return nearDuplicate{}, false
+	}
+	d := editDistance(strings.ToUpper(a.VIN), strings.ToUpper(b.VIN))
+	if d > maxVINTypos {
+		return nearDuplicate{}, false
+	}
+	vins := []string{a.VIN, b.VIN}
+	sort.Strings(vins)
+	regno := a.RegNo
+	if regno == "" {
+		regno = b.RegNo
+	}
+	return nearDuplicate{Manufacturer: a.Manurfacturer, Model: a.Model, RegNo: regno, VINs: vins, Distance: d}, true
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
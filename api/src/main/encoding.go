@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// encoder renders a JSON document, decoded with UseNumber, in another
+// format. Handlers write JSON; negotiateContent re-encodes it for clients
+// that ask for something else.
+type encoder interface {
+	encode(v interface{}) ([]byte, error)
+}
+
+// encoders are the formats besides JSON a client may ask for, by the media
+// type it asks with.
+var encoders = map[string]encoder{
+	"application/xml":       xmlEncoder{},
+	"text/xml":              xmlEncoder{},
+	"application/msgpack":   msgpackEncoder{},
+	"application/x-msgpack": msgpackEncoder{},
+}
+
+// negotiateEncoder returns the first media type in an Accept header that
+// there is an encoder for. It returns "" for JSON, which is also what clients
+// get when they ask for nothing known.
+func negotiateEncoder(accept string) string {
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return ""
+		}
+		if _, ok := encoders[mediaType]; ok {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// negotiateContent re-encodes the JSON responses of h in the format asked for
+// in the Accept header. Other responses, such as images, CSV and event
+// streams, are passed through untouched.
+func negotiateContent(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		mediaType := negotiateEncoder(r.Header.Get("Accept"))
+		if mediaType == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		tw := &transcodingWriter{ResponseWriter: w, mediaType: mediaType, status: http.StatusOK}
+		h.ServeHTTP(tw, r)
+		tw.finish()
+	})
+}
+
+// transcodingWriter holds back a JSON response until it is complete, so that
+// it can be re-encoded. It decides when the header is written, so responses
+// of other types are streamed as they are written.
+type transcodingWriter struct {
+	http.ResponseWriter
+	mediaType   string
+	status      int
+	wroteHeader bool
+	json        bool
+	body        bytes.Buffer
+}
+
+func (tw *transcodingWriter) WriteHeader(code int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.status = code
+	contentType, _, _ := mime.ParseMediaType(tw.Header().Get("Content-Type"))
+	tw.json = contentType == "application/json" || contentType == "application/problem+json"
+	if !tw.json {
+		tw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (tw *transcodingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.json {
+		return tw.body.Write(b)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *transcodingWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.json {
+		f.Flush()
+	}
+}
+
+func (tw *transcodingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// finish writes the held back JSON response in the negotiated format. A body
+// that is not valid JSON is sent as it was written.
+func (tw *transcodingWriter) finish() {
+	if !tw.json {
+		return
+	}
+
+	header := tw.Header()
+	header.Del("Content-Length")
+	body := tw.body.Bytes()
+	if len(body) > 0 {
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err := decoder.Decode(&v)
+		if err == nil {
+			var encoded []byte
+			encoded, err = encoders[tw.mediaType].encode(v)
+			if err == nil {
+				body = encoded
+				contentType := tw.mediaType
+				if strings.HasSuffix(contentType, "xml") {
+					contentType += "; charset=utf-8"
+				}
+				header.Set("Content-Type", contentType)
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed re-encode response; sending it as JSON", "type", tw.mediaType, "err", err)
+		}
+	}
+
+	tw.ResponseWriter.WriteHeader(tw.status)
+	tw.ResponseWriter.Write(body)
+}
+
+// xmlEncoder renders a document as XML under a <response> element. Object
+// members become elements named after their keys, and array items become
+// <item> elements.
+type xmlEncoder struct{}
+
+func (xmlEncoder) encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := writeXML(&buf, "response", v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeXML(buf *bytes.Buffer, name string, v interface{}) error {
+	buf.WriteString("<" + name + ">")
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			if err := writeXML(buf, xmlName(k), v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXML(buf, "item", item); err != nil {
+				return err
+			}
+		}
+	case string:
+		if err := xml.EscapeText(buf, []byte(v)); err != nil {
+			return err
+		}
+	case json.Number:
+		buf.WriteString(v.String())
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// xmlName returns key as an XML element name. Keys of the API's documents are
+// identifiers already; others, such as the counts keyed by status, have the
+// characters a name cannot hold replaced.
+func xmlName(key string) string {
+	name := []rune(key)
+	for i, c := range name {
+		letter := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '-' || c == '.')) {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+// msgpackEncoder renders a document as MessagePack. Whole numbers are
+// encoded as integers and others as 64-bit floats.
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeMsgpackLen(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLen(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackLen(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			writeMsgpack(buf, k)
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: unsupported value")
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n < 128, n < 0 && n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeMsgpackLen writes the header of a string, array or map of length n:
+// the fix form below fixMax, else the 8 bit form if the type has one, else
+// the 16 or 32 bit form.
+func writeMsgpackLen(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
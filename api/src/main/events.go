@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	eventCreated  = "created"
+	eventUpdated  = "updated"
+	eventDeleted  = "deleted"
+	eventSold     = "sold"
+	eventRestored = "restored"
+)
+
+const (
+	// heartbeatInterval is how often an idle event stream sends a comment
+	// line so that proxies do not close the connection.
+	heartbeatInterval = 15 * time.Second
+
+	// replaySize is how many recent events are kept for clients resuming a
+	// stream.
+	replaySize = 1000
+)
+
+type inventoryEvent struct {
+	// Seq numbers the events published by a broker, from 1.
+	Seq  uint64   `json:"-"`
+	Type string   `json:"type"`
+	VIN  string   `json:"vin"`
+	Car  *vehicle `json:"car,omitempty"`
+	// Changes are the fields a change of a car made different, with their
+	// old and new values, when the car as it was is known.
+	Changes []fieldChange `json:"changes,omitempty"`
+}
+
+// broker fans inventory events out to every subscriber. Subscribers that fall
+// behind miss events rather than blocking the write handlers. Closing the
+// broker closes every subscription, which ends the streams on shutdown.
+//
+// The most recent events are kept so a client that reconnects can be sent
+// what it missed. Event IDs carry the broker's epoch so that IDs from before
+// a restart are not mistaken for current ones.
+//
+// With an outbox, events are also kept there to be relayed beyond the
+// instance; see transact.
+type broker struct {
+	out *outbox
+
+	mu      sync.Mutex
+	subs    map[chan inventoryEvent]struct{}
+	closed  bool
+	epoch   string
+	seq     uint64
+	history []inventoryEvent
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan inventoryEvent]struct{}), epoch: newRequestID()}
+}
+
+func (b *broker) subscribe() chan inventoryEvent {
+	ch, _, _ := b.subscribeAfter("")
+	return ch
+}
+
+// eventID returns the ID clients resume a stream after e with.
+func (b *broker) eventID(e inventoryEvent) string {
+	return fmt.Sprintf("%s-%d", b.epoch, e.Seq)
+}
+
+// subscribeAfter subscribes and returns the kept events published after the
+// event with the given ID. ok is false when lastID is not empty and the
+// events since it are no longer all known.
+func (b *broker) subscribeAfter(lastID string) (ch chan inventoryEvent, missed []inventoryEvent, ok bool) {
+	ch = make(chan inventoryEvent, 16)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, nil, true
+	}
+	b.subs[ch] = struct{}{}
+
+	if lastID == "" {
+		return ch, nil, true
+	}
+
+	rest, found := strings.CutPrefix(lastID, b.epoch+"-")
+	seq, err := strconv.ParseUint(rest, 10, 64)
+	if !found || err != nil || seq > b.seq {
+		return ch, nil, false
+	}
+
+	// history holds consecutive events ending with b.seq.
+	oldest := b.seq - uint64(len(b.history)) + 1
+	if seq+1 < oldest {
+		return ch, nil, false
+	}
+	missed = append(missed, b.history[seq+1-oldest:]...)
+	return ch, missed, true
+}
+
+func (b *broker) unsubscribe(ch chan inventoryEvent) {
+	b.mu.Lock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+}
+
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// pendingEventsKey is the context key of the events published in a
+// transaction, sent once it commits.
+type pendingEventsKey struct{}
+
+// publish sends e, or in a transaction of transact, queues it until the
+// transaction commits. Outside a transaction it is added to the outbox after
+// the change it is for, so a crash in between loses it.
+func (b *broker) publish(ctx context.Context, e inventoryEvent) {
+	if pending, ok := ctx.Value(pendingEventsKey{}).(*[]inventoryEvent); ok {
+		*pending = append(*pending, e)
+		return
+	}
+	if b.out != nil {
+		if err := b.out.add(context.WithoutCancel(ctx), e); err != nil {
+			slog.ErrorContext(ctx, "Failed add event to outbox", "type", e.Type, "vin", e.VIN, "err", err)
+		} else {
+			b.out.notify()
+		}
+	}
+	b.send(e)
+}
+
+// commitHooksKey is the context key of the functions run once a transaction
+// of transact commits.
+type commitHooksKey struct{}
+
+// afterCommit runs fn once the transaction of ctx commits, or at once outside
+// a transaction; it is dropped if the transaction aborts. Writes to storage
+// other than MongoDB, which the transaction does not cover and which a retry
+// would repeat, are made through it.
+func afterCommit(ctx context.Context, fn func()) {
+	if hooks, ok := ctx.Value(commitHooksKey{}).(*[]func()); ok {
+		*hooks = append(*hooks, fn)
+		return
+	}
+	fn()
+}
+
+// transact runs fn in a transaction, in which the events it publishes are
+// added to the outbox, so that they are kept if and only if its writes are.
+// The transaction is a MongoDB session's, and covers only the writes fn
+// makes to MongoDB, which keeps the cars; writes elsewhere are left to
+// afterCommit. The transaction is retried on transient errors, running fn
+// again. Without an outbox fn is run as it is.
+func (b *broker) transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	if b.out == nil {
+		return fn(ctx)
+	}
+	session, err := b.out.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	var pending []inventoryEvent
+	var hooks []func()
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		pending, hooks = pending[:0], hooks[:0]
+		txCtx := context.WithValue(context.WithValue(sc, pendingEventsKey{}, &pending), commitHooksKey{}, &hooks)
+		if err := fn(txCtx); err != nil {
+			return nil, err
+		}
+		return nil, b.out.add(sc, pending...)
+	})
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	if len(pending) > 0 {
+		b.out.notify()
+	}
+	for _, e := range pending {
+		b.send(e)
+	}
+	return nil
+}
+
+// transactional tells whether transact runs its function in a transaction,
+// undoing its writes if it fails.
+func (b *broker) transactional() bool {
+	return b.out != nil
+}
+
+// send fans e out to the subscribers.
+func (b *broker) send(e inventoryEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	if len(b.history) == replaySize {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, e)
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("Dropped event for slow subscriber", "type", e.Type, "vin", e.VIN)
+		}
+	}
+}
+
+// carEvents streams inventory events as server-sent events. A client that
+// reconnects with the Last-Event-ID header, or ?last_event_id= where it
+// cannot set headers, is first sent the events it missed. When those are no
+// longer known it is sent a "reset" event and should reload the inventory.
+func carEvents(events *broker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			errorWithJSON(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		dealer := r.URL.Query().Get("dealer")
+		fields, err := fieldsParam(r.URL.Query().Get("fields"))
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tenant := tenantFrom(r.Context())
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+
+		ch, missed, resumed := events.subscribeAfter(lastID)
+		defer events.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		if !resumed {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+
+		send := func(e inventoryEvent) {
+			if !e.inTenant(tenant) {
+				return
+			}
+			if dealer != "" && (e.Car == nil || e.Car.Dealer != dealer) {
+				return
+			}
+			if fields != nil && !e.changesAny(fields) {
+				return
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed marshal event", "err", err)
+				return
+			}
+
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", events.eventID(e), e.Type, data)
+		}
+
+		for _, e := range missed {
+			send(e)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				send(e)
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// errNoRate is returned when there is no rate between two currencies.
+var errNoRate = errors.New("no exchange rate")
+
+// minorUnits are the digits after the point of the currencies that do not
+// have two, which prices are converted between.
+var minorUnits = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "OMR": 3, "VND": 0,
+}
+
+// exchangeRate is how much of To one unit of From buys. Source is
+// "override" for a rate set with PUT /exchange-rates/:from/:to, or the
+// provider's name.
+type exchangeRate struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updatedat"`
+	UpdatedBy string    `json:"updated_by,omitempty" bson:"updatedby,omitempty"`
+	Tenant    string    `json:"-"`
+}
+
+// displayPrice is a car's price converted to the currency a reader asked
+// for; it is not stored.
+type displayPrice struct {
+	Amount   int64   `json:"amount"`
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+}
+
+// rateProvider fetches exchange rates.
+type rateProvider interface {
+	name() string
+	// rates returns what a unit of base buys of each currency it has.
+	rates(ctx context.Context, base string) (map[string]float64, error)
+}
+
+// httpRates fetches rates from a JSON API at url, in which {base} is
+// replaced by the base currency, answering {"rates": {"EUR": 1.17, ...}}
+// as Frankfurter and most rate services do.
+type httpRates struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpRates) name() string { return "provider" }
+
+func (h *httpRates) rates(ctx context.Context, base string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(h.url, "{base}", base), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange rate provider answered %s", resp.Status)
+	}
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Rates, nil
+}
+
+// fetchedRates are the rates from a base currency fetched at a time.
+type fetchedRates struct {
+	rates map[string]float64
+	at    time.Time
+}
+
+// exchangeRates converts prices, with the rates the tenant has set itself
+// in place of the provider's. The provider's are cached for ttl, and kept
+// beyond it while the provider cannot be reached.
+type exchangeRates struct {
+	overrides *mongo.Collection
+	// provider is nil when only the rates set by hand are used.
+	provider rateProvider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	fetched map[string]fetchedRates
+}
+
+func newExchangeRates(overrides *mongo.Collection, provider rateProvider, ttl time.Duration) *exchangeRates {
+	return &exchangeRates{overrides: overrides, provider: provider, ttl: ttl, fetched: map[string]fetchedRates{}}
+}
+
+func (x *exchangeRates) ensureIndex(ctx context.Context) error {
+	_, err := x.overrides.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "from", Value: 1}, {Key: "to", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// rate returns the rate from one currency to another for the tenant of ctx.
+func (x *exchangeRates) rate(ctx context.Context, from, to string) (exchangeRate, error) {
+	if from == to {
+		return exchangeRate{From: from, To: to, Rate: 1, Source: "identity", UpdatedAt: time.Now().UTC()}, nil
+	}
+
+	var r exchangeRate
+	err := x.overrides.FindOne(ctx, forTenant(ctx, bson.M{"from": from, "to": to})).Decode(&r)
+	if err != mongo.ErrNoDocuments {
+		return r, err
+	}
+	if x.provider == nil {
+		return exchangeRate{}, errNoRate
+	}
+
+	f, err := x.fetch(ctx, from)
+	if err != nil {
+		return exchangeRate{}, err
+	}
+	rate, ok := f.rates[to]
+	if !ok || rate <= 0 {
+		return exchangeRate{}, errNoRate
+	}
+	return exchangeRate{From: from, To: to, Rate: rate, Source: x.provider.name(), UpdatedAt: f.at}, nil
+}
+
+// fetch returns the provider's rates from base, from the cache while fresh.
+func (x *exchangeRates) fetch(ctx context.Context, base string) (fetchedRates, error) {
+	x.mu.Lock()
+	f, ok := x.fetched[base]
+	x.mu.Unlock()
+	if ok && time.Since(f.at) < x.ttl {
+		return f, nil
+	}
+
+	rates, err := x.provider.rates(ctx, base)
+	if err != nil {
+		if ok {
+			slog.WarnContext(ctx, "Failed fetch exchange rates; using the last fetched", "base", base, "fetched_at", f.at, "err", err)
+			return f, nil
+		}
+		return fetchedRates{}, err
+	}
+	f = fetchedRates{rates: rates, at: time.Now().UTC()}
+	x.mu.Lock()
+	x.fetched[base] = f
+	x.mu.Unlock()
+	return f, nil
+}
+
+// convert returns p in the currency to at rate.
+func convert(p price, to string, rate float64) displayPrice {
+	scale := func(currency string) float64 {
+		digits, ok := minorUnits[currency]
+		if !ok {
+			digits = 2
+		}
+		return math.Pow10(digits)
+	}
+	major := float64(p.Amount) / scale(p.Currency) * rate
+	return displayPrice{Amount: int64(math.Round(major * scale(to))), Currency: to, Rate: rate}
+}
+
+// displayPrices sets the display prices of the priced cars in currency, with
+// a rate fetched once for each currency they are priced in.
+func (x *exchangeRates) displayPrices(ctx context.Context, cars []vehicle, currency string) error {
+	rates := map[string]float64{}
+	for i := range cars {
+		p := cars[i].Price
+		if p == nil {
+			continue
+		}
+		rate, ok := rates[p.Currency]
+		if !ok {
+			r, err := x.rate(ctx, p.Currency, currency)
+			if err != nil {
+				return err
+			}
+			rate = r.Rate
+			rates[p.Currency] = rate
+		}
+		d := convert(*p, currency, rate)
+		cars[i].DisplayPrice = &d
+	}
+	return nil
+}
+
+// displayPricesOrFail sets the display prices when the reader asked for a
+// currency. It writes the error response and returns false when it cannot.
+func displayPricesOrFail(w http.ResponseWriter, r *http.Request, x *exchangeRates, cars []vehicle, currency string) bool {
+	if currency == "" {
+		return true
+	}
+	err := x.displayPrices(r.Context(), cars, currency)
+	switch {
+	case err == nil:
+		return true
+	case err == errNoRate:
+		fieldErrorWithJSON(w, "currency", "unsupported", fmt.Sprintf("There is no exchange rate to %s for these prices", currency))
+	default:
+		errorWithJSON(w, "Exchange rates are unavailable", http.StatusBadGateway)
+		slog.ErrorContext(r.Context(), "Failed get exchange rates", "err", err)
+	}
+	return false
+}
+
+// rateCurrencies returns the currencies of an /exchange-rates/:from/:to
+// path, writing the error response and returning false when they are not
+// currency codes.
+func rateCurrencies(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	from, to := strings.ToUpper(pat.Param(r, "from")), strings.ToUpper(pat.Param(r, "to"))
+	if !currencyCode.MatchString(from) || !currencyCode.MatchString(to) || from == to {
+		errorWithJSON(w, "Exchange rates are between two ISO 4217 currency codes such as GBP and EUR", http.StatusNotFound)
+		return "", "", false
+	}
+	return from, to, true
+}
+
+// exchangeRateByPair returns the rate used between two currencies.
+func exchangeRateByPair(x *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, ok := rateCurrencies(w, r)
+		if !ok {
+			return
+		}
+
+		rate, err := x.rate(r.Context(), from, to)
+		switch {
+		case err == errNoRate:
+			errorWithJSON(w, "No exchange rate between these currencies", http.StatusNotFound)
+			return
+		case err != nil:
+			errorWithJSON(w, "Exchange rates are unavailable", http.StatusBadGateway)
+			slog.ErrorContext(r.Context(), "Failed get exchange rate", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(rate, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// allExchangeRateOverrides lists the rates the tenant has set by hand.
+func allExchangeRateOverrides(x *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rates := []exchangeRate{}
+		opts := options.Find().SetSort(bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}})
+		cur, err := x.overrides.Find(r.Context(), forTenant(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &rates)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list exchange rates", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(rates, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// setExchangeRate sets the rate between two currencies by hand, in place of
+// the provider's.
+func setExchangeRate(x *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, ok := rateCurrencies(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Rate float64 `json:"rate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if req.Rate <= 0 || math.IsInf(req.Rate, 0) {
+			fieldErrorWithJSON(w, "rate", "invalid", "The rate must be a positive number")
+			return
+		}
+
+		rate := exchangeRate{From: from, To: to, Rate: req.Rate, Source: "override", UpdatedAt: time.Now().UTC(), Tenant: tenantFrom(r.Context())}
+		if p := principalFrom(r.Context()); p != nil {
+			rate.UpdatedBy = p.Subject
+		}
+		_, err := x.overrides.ReplaceOne(r.Context(), forTenant(r.Context(), bson.M{"from": from, "to": to}), rate, options.Replace().SetUpsert(true))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed set exchange rate", "err", err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Exchange rate set", "from", from, "to", to, "rate", req.Rate, "by", rate.UpdatedBy)
+
+		respBody, err := json.MarshalIndent(rate, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// deleteExchangeRate removes the rate set by hand between two currencies, so
+// that the provider's is used again.
+func deleteExchangeRate(x *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, ok := rateCurrencies(w, r)
+		if !ok {
+			return
+		}
+
+		res, err := x.overrides.DeleteOne(r.Context(), forTenant(r.Context(), bson.M{"from": from, "to": to}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete exchange rate", "err", err)
+			return
+		}
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "No exchange rate was set between these currencies", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
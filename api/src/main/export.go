@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportColumns are the columns of an export, in order, and how each is
+// read from a car.
+var exportColumns = []struct {
+	name  string
+	value func(*vehicle) string
+}{
+	{"manufacturer", func(v *vehicle) string { return v.Manurfacturer }},
+	{"model", func(v *vehicle) string { return v.Model }},
+	{"vin", func(v *vehicle) string { return v.VIN }},
+	{"regno", func(v *vehicle) string { return v.RegNo }},
+	{"dealer", func(v *vehicle) string { return v.Dealer }},
+	{"branch", func(v *vehicle) string { return v.Branch }},
+	{"status", func(v *vehicle) string { return v.Status }},
+	{"price", func(v *vehicle) string {
+		if v.Price == nil {
+			return ""
+		}
+		return strconv.FormatInt(v.Price.Amount, 10)
+	}},
+	{"currency", func(v *vehicle) string {
+		if v.Price == nil {
+			return ""
+		}
+		return v.Price.Currency
+	}},
+	{"mileage", func(v *vehicle) string { return optionalInt(v.Mileage) }},
+	{"year", func(v *vehicle) string { return optionalInt(v.Year) }},
+	{"fuel_type", func(v *vehicle) string { return v.FuelType }},
+	{"transmission", func(v *vehicle) string { return v.Transmission }},
+	{"colour", func(v *vehicle) string { return v.Colour }},
+	{"condition", func(v *vehicle) string { return v.Condition }},
+	{"sold_at", func(v *vehicle) string {
+		if v.SoldAt == nil {
+			return ""
+		}
+		return v.SoldAt.Format(time.RFC3339)
+	}},
+}
+
+func optionalInt(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// rowWriter is implemented by csv.Writer and xlsxWriter.
+type rowWriter interface {
+	Write(cells []string) error
+}
+
+var exportTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// exportCars streams every car matching the GET /cars filters as a CSV or
+// Excel download, chosen with ?format=.
+func exportCars(c *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		format := query.Get("format")
+		contentType, ok := exportTypes[format]
+		if !ok {
+			errorWithJSON(w, "Parameter \"format\" must be csv or xlsx", http.StatusBadRequest)
+			return
+		}
+
+		for _, name := range []string{"limit", "offset", "page", "cursor"} {
+			if _, ok := query[name]; ok {
+				errorWithJSON(w, fmt.Sprintf("Parameter %q is not supported by export", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The format is not one of the listing formats, so it is checked
+		// here instead of by parseListParams.
+		query.Del("format")
+		listReq := r.Clone(r.Context())
+		listReq.URL.RawQuery = query.Encode()
+		params, err := parseListParams(listReq)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		columns := exportColumns
+		if params.Fields != nil {
+			columns = columns[:0:0]
+			for _, field := range params.Fields {
+				for _, col := range exportColumns {
+					// The currency goes with the price it is the unit of.
+					if col.name == field || (field == "price" && col.name == "currency") {
+						columns = append(columns, col)
+					}
+				}
+			}
+		}
+
+		opts := options.Find()
+		if len(params.Sort) > 0 {
+			opts.SetSort(params.Sort)
+		}
+		if params.Projection != nil {
+			opts.SetProjection(params.Projection)
+		}
+
+		cur, err := c.Find(r.Context(), forTenant(r.Context(), params.Filter), opts)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed export cars", "err", err)
+			return
+		}
+		defer cur.Close(r.Context())
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"inventory-%s.%s\"",
+			time.Now().UTC().Format("2006-01-02"), format))
+
+		var rows rowWriter
+		var finish func() error
+		switch format {
+		case "csv":
+			cw := csv.NewWriter(w)
+			rows = cw
+			finish = func() error { cw.Flush(); return cw.Error() }
+		case "xlsx":
+			xw, err := newXLSXWriter(w)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed export cars", "err", err)
+				return
+			}
+			rows, finish = xw, xw.Close
+		}
+
+		header := make([]string, len(columns))
+		for i, col := range columns {
+			header[i] = col.name
+		}
+		err = rows.Write(header)
+
+		record := make([]string, len(columns))
+		for err == nil && cur.Next(r.Context()) {
+			var car vehicle
+			if err = cur.Decode(&car); err != nil {
+				break
+			}
+			for i, col := range columns {
+				record[i] = col.value(&car)
+			}
+			err = rows.Write(record)
+		}
+		if err == nil {
+			err = cur.Err()
+		}
+		if err == nil {
+			err = finish()
+		}
+
+		// The status has been sent, so a failure part way through can only
+		// be logged; the client sees a truncated file.
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed export cars", "err", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// priceBands and yearBands are the lower bounds of the bands listings are
+// faceted into; prices are in the minor unit of their currency. Cars above
+// the last bound fall in its band.
+var (
+	priceBands = []int64{0, 500000, 1000000, 1500000, 2000000, 3000000, 5000000}
+	yearBands  = []int{1900, 2005, 2010, 2015, 2020, 2025}
+)
+
+// carFacets counts the cars a listing matches by the values the storefront
+// filters on.
+type carFacets struct {
+	Manufacturer []facetCount `json:"manufacturer"`
+	FuelType     []facetCount `json:"fuel_type"`
+	Price        []facetBand  `json:"price"`
+	Year         []facetBand  `json:"year"`
+}
+
+type facetCount struct {
+	Value string `json:"value" bson:"_id"`
+	Count int64  `json:"count"`
+}
+
+// facetBand counts the cars from Min up to but not including Max. The last
+// band has no Max.
+type facetBand struct {
+	Min   int64  `json:"min" bson:"_id"`
+	Max   *int64 `json:"max,omitempty" bson:"-"`
+	Count int64  `json:"count"`
+}
+
+// bandBy returns the stages banding field at bounds. Cars without the field
+// are left out.
+func bandBy(field string, bounds []int64) bson.A {
+	boundaries := bson.A{}
+	for _, b := range bounds {
+		boundaries = append(boundaries, b)
+	}
+	// The last band is open, so its upper bound is past any value.
+	boundaries = append(boundaries, int64(1)<<62)
+	return bson.A{
+		bson.M{"$match": bson.M{field: bson.M{"$type": "number"}}},
+		bson.M{"$bucket": bson.M{"groupBy": "$" + field, "boundaries": boundaries, "default": "other"}},
+		bson.M{"$match": bson.M{"_id": bson.M{"$ne": "other"}}},
+	}
+}
+
+// bands gives each counted band the upper bound the next of bounds starts
+// at. Bands without cars are not counted, so the next counted band may start
+// higher.
+func bands(counted []facetBand, bounds []int64) []facetBand {
+	for i := range counted {
+		for j := 0; j+1 < len(bounds); j++ {
+			if bounds[j] == counted[i].Min {
+				counted[i].Max = &bounds[j+1]
+			}
+		}
+	}
+	return counted
+}
+
+// findFacets counts the tenant's cars matching filter by every facet, in a
+// single aggregation.
+func findFacets(ctx context.Context, c *mongo.Collection, filter bson.M) (*carFacets, error) {
+	years := make([]int64, len(yearBands))
+	for i, y := range yearBands {
+		years[i] = int64(y)
+	}
+	countBy := func(field string) bson.A {
+		return bson.A{
+			bson.M{"$match": bson.M{field: bson.M{"$nin": bson.A{nil, ""}}}},
+			bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: forTenant(ctx, filter)}},
+		{{Key: "$facet", Value: bson.M{
+			"manufacturer": countBy("manufacturer"),
+			"fueltype":     countBy("fueltype"),
+			"price":        bandBy("price.amount", priceBands),
+			"year":         bandBy("year", years),
+		}}},
+	}
+
+	var res []struct {
+		Manufacturer []facetCount `bson:"manufacturer"`
+		FuelType     []facetCount `bson:"fueltype"`
+		Price        []facetBand  `bson:"price"`
+		Year         []facetBand  `bson:"year"`
+	}
+	cur, err := c.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cur.All(ctx, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := res[0]
+	return &carFacets{
+		Manufacturer: f.Manufacturer,
+		FuelType:     f.FuelType,
+		Price:        bands(f.Price, priceBands),
+		Year:         bands(f.Year, years),
+	}, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxFaultLatency is the most latency a fault may add to a request.
+	maxFaultLatency = time.Minute
+	// faultHeader tells clients which fault was injected into a response.
+	faultHeader = "X-Fault-Injected"
+)
+
+// faultRule injects faults into a percentage of the requests it matches: of
+// Method, or any, to Route, a route pattern as the metrics label it, e.g.
+// "/v1/cars/:vin", or any. Latency delays them; then Drop cuts their
+// connection without a response, or Status, a 5xx, answers them instead of
+// the handler.
+type faultRule struct {
+	Method    string  `json:"method,omitempty"`
+	Route     string  `json:"route,omitempty"`
+	Percent   float64 `json:"percent"`
+	LatencyMS int64   `json:"latency_ms,omitempty"`
+	Drop      bool    `json:"drop,omitempty"`
+	Status    int     `json:"status,omitempty"`
+}
+
+func (f *faultRule) validate(field string) *fieldError {
+	c := &checks{}
+	c.check(f.Percent > 0 && f.Percent <= 100, field+".percent", "The percent must be more than 0 and at most 100")
+	c.check(f.LatencyMS >= 0 && f.LatencyMS <= maxFaultLatency.Milliseconds(), field+".latency_ms", "The latency must be from 0 to 60000 milliseconds")
+	c.check(f.Status == 0 || (f.Status >= 500 && f.Status <= 599), field+".status", "The status must be a 5xx")
+	c.check(!(f.Drop && f.Status != 0), field+".drop", "A fault either drops the connection or answers with a status")
+	c.check(f.LatencyMS > 0 || f.Drop || f.Status != 0, field, "A fault needs a latency, drop or status")
+	return c.err()
+}
+
+func (f *faultRule) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) && (f.Route == "" || f.Route == routePattern(r))
+}
+
+// faults are the faults injected into requests, for staging to try clients'
+// retries and circuit breakers out against, as the mock server's are for
+// frontends. Like maintenance they are held per instance, and they start
+// with none.
+type faults struct {
+	mu    sync.Mutex
+	state faultState
+}
+
+type faultState struct {
+	Rules     []faultRule `json:"rules"`
+	UpdatedBy string      `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time  `json:"updated_at,omitempty"`
+}
+
+func (f *faults) get() faultState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := f.state
+	if state.Rules == nil {
+		state.Rules = []faultRule{}
+	}
+	return state
+}
+
+// pick returns the first rule matching r, if it picks r by its percentage.
+func (f *faults) pick(r *http.Request) *faultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rule := range f.state.Rules {
+		if rule.matches(r) {
+			if rand.Float64()*100 < rule.Percent {
+				return &rule
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// injectFaultRules injects the faults of f into the requests they match. A nil
+// f, fault injection being off, injects none. Faults are never injected into
+// /admin/faults, so that they can be taken away, nor into health checks and
+// metrics, so that an instance is not restarted or lost sight of for them.
+func injectFaultRules(f *faults) func(http.Handler) http.Handler {
+	exempt := map[string]bool{apiRoute("/admin/faults"): true, route("/healthz"): true, route("/readyz"): true, route("/metrics"): true}
+	return func(h http.Handler) http.Handler {
+		if f == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exempt[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			rule := f.pick(r)
+			if rule == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if rule.LatencyMS > 0 {
+				w.Header().Set(faultHeader, "latency")
+				t := time.NewTimer(time.Duration(rule.LatencyMS) * time.Millisecond)
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					t.Stop()
+					return
+				}
+			}
+			switch {
+			case rule.Drop:
+				// The server closes the connection of a handler aborted so,
+				// without writing a response.
+				panic(http.ErrAbortHandler)
+			case rule.Status != 0:
+				w.Header().Set(faultHeader, "status")
+				if rule.Status == http.StatusServiceUnavailable {
+					w.Header().Set("Retry-After", "1")
+				}
+				errorWithJSON(w, "Injected failure", rule.Status)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// faultStatus lists the faults injected.
+func faultStatus(f *faults) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respBody, err := json.MarshalIndent(f.get(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// setFaults replaces the faults injected; no rules stops injecting them.
+func setFaults(f *faults) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Rules []faultRule `json:"rules"`
+		}
+		if !decodeStrict(w, r.Body, &req) {
+			return
+		}
+		for i := range req.Rules {
+			req.Rules[i].Method = strings.ToUpper(req.Rules[i].Method)
+			if err := req.Rules[i].validate(fmt.Sprintf("rules[%d]", i)); err != nil {
+				fieldErrorsWithJSON(w, err)
+				return
+			}
+		}
+
+		now := time.Now().UTC()
+		state := faultState{Rules: req.Rules, UpdatedAt: &now}
+		if p := principalFrom(r.Context()); p != nil {
+			state.UpdatedBy = p.Subject
+		}
+		f.mu.Lock()
+		f.state = state
+		f.mu.Unlock()
+		if len(req.Rules) > 0 {
+			slog.WarnContext(r.Context(), "Fault injection on", "rules", len(req.Rules))
+		} else {
+			slog.InfoContext(r.Context(), "Fault injection off")
+		}
+
+		respBody, err := json.MarshalIndent(f.get(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
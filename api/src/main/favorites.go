@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxFavorites is the most cars one person may keep on their watchlist.
+const maxFavorites = 200
+
+// favorite is a car on someone's watchlist.
+type favorite struct {
+	Owner   string    `json:"-"`
+	VIN     string    `json:"vin"`
+	AddedAt time.Time `json:"added_at" bson:"addedat"`
+	// Notify is where the owner is told of price drops of the car, if they
+	// asked to be.
+	Notify *contact `json:"notify,omitempty" bson:",omitempty"`
+	// Price is the car's price the owner was last told of, or added it at.
+	Price  *price   `json:"-" bson:",omitempty"`
+	Car    *vehicle `json:"car,omitempty" bson:"-"`
+	Tenant string   `json:"-" bson:"tenant"`
+}
+
+// favorites keeps the watchlists people sync across their devices. Cars
+// leave every watchlist once they are sold or deleted.
+type favorites struct {
+	c    *mongo.Collection
+	cars *mongo.Collection
+}
+
+func (f *favorites) ensureIndex(ctx context.Context) error {
+	_, err := f.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}, {Key: "vin", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}}},
+	})
+	return err
+}
+
+// ownFavorites is the filter for the caller's watchlist.
+func ownFavorites(ctx context.Context, filter bson.M) bson.M {
+	filter["owner"] = principalFrom(ctx).Subject
+	return forTenant(ctx, filter)
+}
+
+// forget is the outbox sink of favorites: it takes cars sold or deleted off
+// every watchlist.
+func (f *favorites) forget(ctx context.Context, e outboxEvent) error {
+	if e.Type != eventSold && e.Type != eventDeleted {
+		return nil
+	}
+	_, err := f.c.DeleteMany(ctx, forTenant(ctx, bson.M{"vin": e.VIN}))
+	return err
+}
+
+// myFavorites lists the caller's watchlist, most recently added first, with
+// the cars as they are now.
+func myFavorites(f *favorites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := []favorite{}
+		opts := options.Find().SetSort(bson.D{{Key: "addedat", Value: -1}})
+		cur, err := f.c.Find(r.Context(), ownFavorites(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &list)
+		}
+		var cars []vehicle
+		if err == nil {
+			vins := bson.A{}
+			for _, fav := range list {
+				vins = append(vins, fav.VIN)
+			}
+			filter := forTenant(r.Context(), bson.M{"vin": bson.M{"$in": vins}, "deletedat": bson.M{"$exists": false}})
+			cur, err = f.cars.Find(r.Context(), filter)
+			if err == nil {
+				err = cur.All(r.Context(), &cars)
+			}
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list favorites", "err", err)
+			return
+		}
+
+		// Cars gone but not yet taken off are left out.
+		byVIN := map[string]*vehicle{}
+		for i := range cars {
+			byVIN[cars[i].VIN] = &cars[i]
+		}
+		live := []favorite{}
+		for _, fav := range list {
+			if fav.Car = byVIN[fav.VIN]; fav.Car != nil {
+				live = append(live, fav)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(live, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// addFavorite puts a car on the caller's watchlist. Adding it again is not an
+// error, and keeps when it was first added. A body of {"notify": {"email",
+// "phone"}} asks for the caller to be told there when the car's price drops;
+// adding the car again with one changes it.
+func addFavorite(f *favorites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+		dbError := func(err error) {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed add favorite", "err", err)
+		}
+
+		var body struct {
+			Notify *contact `json:"notify"`
+		}
+		if r.ContentLength != 0 {
+			if !decodeStrict(w, r.Body, &body) {
+				return
+			}
+		}
+		if body.Notify != nil {
+			if err := body.Notify.validate("notify"); err != nil {
+				fieldErrorsWithJSON(w, err)
+				return
+			}
+		}
+
+		var car vehicle
+		err := f.cars.FindOne(r.Context(), liveCar(r.Context(), vin), options.FindOne().SetProjection(bson.M{"price": 1})).Decode(&car)
+		if err == mongo.ErrNoDocuments {
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(err)
+			return
+		}
+		n, err := f.c.CountDocuments(r.Context(), ownFavorites(r.Context(), bson.M{}))
+		if err != nil {
+			dbError(err)
+			return
+		}
+		if n >= maxFavorites {
+			errorWithJSON(w, fmt.Sprintf("At most %d cars may be on a watchlist", maxFavorites), http.StatusConflict)
+			return
+		}
+
+		fav := favorite{Owner: principalFrom(r.Context()).Subject, VIN: vin, AddedAt: time.Now().UTC(), Tenant: tenantFrom(r.Context())}
+		update := bson.M{"$setOnInsert": fav}
+		if body.Notify != nil {
+			update["$set"] = bson.M{"notify": body.Notify, "price": car.Price}
+		}
+		res, err := f.c.UpdateOne(r.Context(), ownFavorites(r.Context(), bson.M{"vin": vin}),
+			update, options.Update().SetUpsert(true))
+		if err != nil {
+			dbError(err)
+			return
+		}
+
+		if res.UpsertedCount == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func deleteFavorite(f *favorites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := f.c.DeleteOne(r.Context(), ownFavorites(r.Context(), bson.M{"vin": carVIN(r)}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete favorite", "err", err)
+			return
+		}
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "The car is not on the watchlist", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
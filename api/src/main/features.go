@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The feature flags, gating behaviors that are rolled out an environment or
+// tenant at a time.
+const (
+	// flagValuation serves GET /cars/:vin/valuation.
+	flagValuation = "valuation"
+	// flagFuzzySearch has ?fuzzy=true widen searches to near misses; off,
+	// searches match the words as they are.
+	flagFuzzySearch = "fuzzy_search"
+	// flagProblemDetails writes errors as problem details; off, errors have
+	// the body they had before, {"message": ...} with the field and reason
+	// of a validation error.
+	flagProblemDetails = "problem_details"
+	// The shadow flags compare what the routes they are named after read
+	// from the car storage with what SHADOW_STORAGE has, and
+	// flagShadowWrites makes the writes of the car routes to it too. They do
+	// nothing without a shadow storage.
+	flagShadowListCars   = "shadow_list_cars"
+	flagShadowSearchCars = "shadow_search_cars"
+	flagShadowCountCars  = "shadow_count_cars"
+	flagShadowGetCar     = "shadow_get_car"
+	flagShadowWrites     = "shadow_writes"
+)
+
+const featureFlagRefreshSchedule = "@every 30s"
+
+// featureFlagDefaults are whether each flag is on when neither the
+// configuration nor an admin says otherwise.
+var featureFlagDefaults = map[string]bool{
+	flagValuation:      true,
+	flagFuzzySearch:    true,
+	flagProblemDetails: true,
+
+	flagShadowListCars:   false,
+	flagShadowSearchCars: false,
+	flagShadowCountCars:  false,
+	flagShadowGetCar:     false,
+	flagShadowWrites:     false,
+}
+
+// featureFlag is a flag as an admin has set it. Enabled, when set, overrides
+// the default of the environment, and Tenants override both for a tenant.
+type featureFlag struct {
+	Name       string          `json:"name"`
+	Enabled    *bool           `json:"enabled,omitempty" bson:",omitempty"`
+	Tenants    map[string]bool `json:"tenants,omitempty" bson:",omitempty"`
+	UpdatedBy  string          `json:"updated_by,omitempty" bson:"updatedby,omitempty"`
+	UpdatedAt  *time.Time      `json:"updated_at,omitempty" bson:"updatedat,omitempty"`
+	Default    bool            `json:"default" bson:"-"`
+	EnabledFor bool            `json:"enabled_for_tenant" bson:"-"`
+}
+
+// featureFlags answers whether a flag is on, from the flags set by admins in
+// the feature flags collection over the defaults of the environment. The
+// flags set are loaded on every refresh, so that a request never waits on
+// the database for them; instances see one another's changes within a
+// refresh.
+type featureFlags struct {
+	c        *mongo.Collection
+	defaults map[string]bool
+
+	mu  sync.RWMutex
+	set map[string]featureFlag
+}
+
+// newFeatureFlags returns the flags with the defaults configured for the
+// environment, which only name known flags.
+func newFeatureFlags(c *mongo.Collection, configured map[string]bool) (*featureFlags, error) {
+	defaults := map[string]bool{}
+	for name, on := range featureFlagDefaults {
+		defaults[name] = on
+	}
+	for name, on := range configured {
+		if _, ok := featureFlagDefaults[name]; !ok {
+			return nil, fmt.Errorf("FEATURE_FLAGS names unknown flag %q", name)
+		}
+		defaults[name] = on
+	}
+	return &featureFlags{c: c, defaults: defaults, set: map[string]featureFlag{}}, nil
+}
+
+func (f *featureFlags) ensureIndex(ctx context.Context) error {
+	_, err := f.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// refresh loads the flags admins have set.
+func (f *featureFlags) refresh(ctx context.Context) error {
+	var flags []featureFlag
+	cur, err := f.c.Find(ctx, bson.M{})
+	if err == nil {
+		err = cur.All(ctx, &flags)
+	}
+	if err != nil {
+		return err
+	}
+
+	set := map[string]featureFlag{}
+	for _, flag := range flags {
+		set[flag.Name] = flag
+	}
+	f.mu.Lock()
+	f.set = set
+	f.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether flag is on for the tenant of ctx. A nil f has
+// every flag at its default.
+func (f *featureFlags) enabled(ctx context.Context, flag string) bool {
+	if f == nil {
+		return featureFlagDefaults[flag]
+	}
+	return f.get(flag).enabledFor(tenantFrom(ctx))
+}
+
+// get returns flag as it is set, with the default of the environment.
+func (f *featureFlags) get(flag string) featureFlag {
+	f.mu.RLock()
+	set, ok := f.set[flag]
+	f.mu.RUnlock()
+	if !ok {
+		set = featureFlag{Name: flag}
+	}
+	set.Default = f.defaults[flag]
+	return set
+}
+
+func (flag featureFlag) enabledFor(tenant string) bool {
+	if on, ok := flag.Tenants[tenant]; ok {
+		return on
+	}
+	if flag.Enabled != nil {
+		return *flag.Enabled
+	}
+	return flag.Default
+}
+
+// allFeatureFlags lists every flag, whether it is on for the caller's tenant
+// and what admins have set it to.
+func allFeatureFlags(f *featureFlags) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(featureFlagDefaults))
+		for name := range featureFlagDefaults {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		flags := make([]featureFlag, 0, len(names))
+		for _, name := range names {
+			flag := f.get(name)
+			flag.EnabledFor = flag.enabledFor(tenantFrom(r.Context()))
+			flags = append(flags, flag)
+		}
+
+		respBody, err := json.MarshalIndent(flags, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// setFeatureFlag sets a flag on or off for the environment, with "enabled",
+// and for tenants, with "tenants". Either left out or null goes back to the
+// default; the whole of what was set before is replaced.
+func setFeatureFlag(f *featureFlags) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := pat.Param(r, "name")
+		if _, ok := featureFlagDefaults[name]; !ok {
+			errorWithJSON(w, "Feature flag not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Enabled *bool           `json:"enabled"`
+			Tenants map[string]bool `json:"tenants"`
+		}
+		if !decodeStrict(w, r.Body, &req) {
+			return
+		}
+		for tenant := range req.Tenants {
+			if !tenantID.MatchString(tenant) {
+				fieldErrorWithJSON(w, "tenants", "invalid", fmt.Sprintf("%q is not a valid tenant ID", tenant))
+				return
+			}
+		}
+
+		now := time.Now().UTC()
+		flag := featureFlag{Name: name, Enabled: req.Enabled, Tenants: req.Tenants, UpdatedAt: &now}
+		if p := principalFrom(r.Context()); p != nil {
+			flag.UpdatedBy = p.Subject
+		}
+		_, err := f.c.ReplaceOne(r.Context(), bson.M{"name": name}, flag, options.Replace().SetUpsert(true))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed set feature flag", "err", err)
+			return
+		}
+		f.mu.Lock()
+		f.set[name] = flag
+		f.mu.Unlock()
+		slog.InfoContext(r.Context(), "Feature flag set", "flag", name, "enabled", req.Enabled, "tenants", req.Tenants)
+
+		flag = f.get(name)
+		flag.EnabledFor = flag.enabledFor(tenantFrom(r.Context()))
+		respBody, err := json.MarshalIndent(flag, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// legacyErrorsUnlessFlagged writes problem details in the error format of
+// before for the tenants with flagProblemDetails off. It runs once the
+// tenant is known, so errors of authentication keep the new format.
+func legacyErrorsUnlessFlagged(f *featureFlags) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if f.enabled(r.Context(), flagProblemDetails) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			lw := &problemRewriter{ResponseWriter: w, rewrite: func(p *problem.Details) (string, []byte) {
+				localeFrom(r.Context()).translate(p)
+				body, err := json.Marshal(legacyError{Message: p.Detail, Field: p.Field, Reason: p.Reason})
+				if err != nil {
+					panic(err)
+				}
+				return "application/json; charset=utf-8", body
+			}}
+			h.ServeHTTP(lw, r)
+			lw.flush()
+		})
+	}
+}
+
+// legacyError is the body errors had before problem details.
+type legacyError struct {
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// problemRewriter holds back a problem details body, to write it as rewrite
+// makes it once the handler is done. Other responses pass through, with the
+// Flusher and Hijacker of the wrapped writer.
+type problemRewriter struct {
+	http.ResponseWriter
+	rewrite func(p *problem.Details) (contentType string, body []byte)
+	status  int
+	problem *bytes.Buffer
+}
+
+func (w *problemRewriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.Header().Get("Content-Type") == problem.ContentType {
+		w.problem = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *problemRewriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.problem != nil {
+		return w.problem.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *problemRewriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.problem == nil {
+		f.Flush()
+	}
+}
+
+func (w *problemRewriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (w *problemRewriter) flush() {
+	if w.problem == nil {
+		return
+	}
+	var p problem.Details
+	json.Unmarshal(w.problem.Bytes(), &p)
+	contentType, body := w.rewrite(&p)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
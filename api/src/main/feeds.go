@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// feedSchedule is how often the feeds are rendered again.
+const feedSchedule = "@every 1h"
+
+var feedTypes = map[string]string{
+	"csv": "text/csv; charset=utf-8",
+	"xml": "application/xml; charset=utf-8",
+}
+
+// feed is a listing feed marketplaces fetch the cars on sale from, as CSV or
+// as XML of Item elements under a Root element. Each field of a car is read
+// from one of the feedSources, or is the constant Value.
+type feed struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Root   string `json:"root,omitempty"`
+	Item   string `json:"item,omitempty"`
+	// ListingURL is the storefront page of a car, with {vin} standing for
+	// its VIN; the configured listing URL when empty.
+	ListingURL string      `json:"listing_url,omitempty"`
+	Fields     []feedField `json:"fields"`
+}
+
+type feedField struct {
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// feedContext is what the sources of a feed read besides the car.
+type feedContext struct {
+	listingURL   string
+	imageBaseURL string
+}
+
+// feedSources are what a feed field can be read from: the columns of an
+// export, and these made for marketplaces.
+var feedSources = func() map[string]func(*feedContext, *vehicle) string {
+	sources := map[string]func(*feedContext, *vehicle) string{}
+	for _, col := range exportColumns {
+		value := col.value
+		sources[col.name] = func(_ *feedContext, v *vehicle) string { return value(v) }
+	}
+	sources["title"] = func(_ *feedContext, v *vehicle) string {
+		return strings.TrimSpace(strings.Join([]string{optionalInt(v.Year), v.Manurfacturer, v.Model}, " "))
+	}
+	// price_decimal is the price in the major unit, e.g. 12999.00.
+	sources["price_decimal"] = func(_ *feedContext, v *vehicle) string {
+		if v.Price == nil {
+			return ""
+		}
+		return fmt.Sprintf("%d.%02d", v.Price.Amount/100, v.Price.Amount%100)
+	}
+	// price_text is the price with its currency, e.g. 12999.00 GBP.
+	sources["price_text"] = func(f *feedContext, v *vehicle) string {
+		if v.Price == nil {
+			return ""
+		}
+		return sources["price_decimal"](f, v) + " " + v.Price.Currency
+	}
+	sources["url"] = func(f *feedContext, v *vehicle) string {
+		return strings.ReplaceAll(f.listingURL, "{vin}", url.PathEscape(v.VIN))
+	}
+	// image is the URL of the car's first image.
+	sources["image"] = func(f *feedContext, v *vehicle) string {
+		if len(v.Images) == 0 {
+			return ""
+		}
+		return f.imageBaseURL + apiRoute("/cars/"+url.PathEscape(v.VIN)+"/images/"+v.Images[0].ID)
+	}
+	return sources
+}()
+
+// defaultFeeds are the feeds there are without a feeds file: an
+// AutoTrader-style XML feed and a Facebook Marketplace vehicle catalog.
+var defaultFeeds = []feed{
+	{
+		Name: "autotrader", Format: "xml", Root: "stock", Item: "vehicle",
+		Fields: []feedField{
+			{Name: "vin", Source: "vin"}, {Name: "registration", Source: "regno"},
+			{Name: "make", Source: "manufacturer"}, {Name: "model", Source: "model"},
+			{Name: "year", Source: "year"}, {Name: "mileage", Source: "mileage"},
+			{Name: "price", Source: "price_decimal"}, {Name: "currency", Source: "currency"},
+			{Name: "fuel_type", Source: "fuel_type"}, {Name: "transmission", Source: "transmission"},
+			{Name: "colour", Source: "colour"}, {Name: "condition", Source: "condition"},
+			{Name: "url", Source: "url"}, {Name: "image", Source: "image"},
+		},
+	},
+	{
+		Name: "facebook", Format: "csv",
+		Fields: []feedField{
+			{Name: "vehicle_id", Source: "vin"}, {Name: "title", Source: "title"},
+			{Name: "make", Source: "manufacturer"}, {Name: "model", Source: "model"},
+			{Name: "year", Source: "year"}, {Name: "mileage.value", Source: "mileage"},
+			{Name: "mileage.unit", Value: "MI"}, {Name: "price", Source: "price_text"},
+			{Name: "exterior_color", Source: "colour"}, {Name: "fuel_type", Source: "fuel_type"},
+			{Name: "transmission", Source: "transmission"}, {Name: "state_of_vehicle", Source: "condition"},
+			{Name: "url", Source: "url"}, {Name: "image[0].url", Source: "image"},
+			{Name: "vin", Source: "vin"},
+		},
+	},
+}
+
+func (f *feed) validate() error {
+	if f.Name == "" {
+		return errors.New("a feed has no name")
+	}
+	if _, ok := feedTypes[f.Format]; !ok {
+		return fmt.Errorf("feed %q: format must be csv or xml, got %q", f.Name, f.Format)
+	}
+	if f.Format == "xml" && (!validXMLName(f.Root) || !validXMLName(f.Item)) {
+		return fmt.Errorf("feed %q: root and item must be XML names", f.Name)
+	}
+	if len(f.Fields) == 0 {
+		return fmt.Errorf("feed %q has no fields", f.Name)
+	}
+	for _, field := range f.Fields {
+		if field.Name == "" || f.Format == "xml" && !validXMLName(field.Name) {
+			return fmt.Errorf("feed %q: field %q is not a valid name", f.Name, field.Name)
+		}
+		if _, ok := feedSources[field.Source]; field.Source != "" && !ok {
+			return fmt.Errorf("feed %q: field %q has unknown source %q", f.Name, field.Name, field.Source)
+		}
+	}
+	return nil
+}
+
+// validXMLName reports whether s can name an element as written by renderXML.
+func validXMLName(s string) bool {
+	if s == "" || strings.ContainsAny(s[:1], "0123456789-.") {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '-' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFeeds returns the default feeds with those of the JSON file at path
+// added, a feed in the file replacing a default one of its name.
+func loadFeeds(path string) ([]feed, error) {
+	feeds := append([]feed(nil), defaultFeeds...)
+	if path == "" {
+		return feeds, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading feeds: %v", err)
+	}
+	var loaded []feed
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		return nil, fmt.Errorf("loading feeds: %v", err)
+	}
+	for _, f := range loaded {
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("loading feeds: %v", err)
+		}
+		replaced := false
+		for i := range feeds {
+			if feeds[i].Name == f.Name {
+				feeds[i], replaced = f, true
+			}
+		}
+		if !replaced {
+			feeds = append(feeds, f)
+		}
+	}
+	return feeds, nil
+}
+
+// renderedFeed is a feed as served until it is rendered again.
+type renderedFeed struct {
+	body []byte
+	at   time.Time
+}
+
+// feedRenderer keeps the feeds of each tenant rendered, from its cars on
+// sale. A tenant's are rendered on its first request, then again on each
+// refresh, so marketplaces polling them cost no queries.
+type feedRenderer struct {
+	cars  *mongo.Collection
+	feeds map[string]*feed
+	ctx   feedContext
+
+	mu       sync.Mutex
+	byTenant map[string]map[string]*renderedFeed
+}
+
+func newFeedRenderer(cars *mongo.Collection, feeds []feed, listingURL, imageBaseURL string) *feedRenderer {
+	r := &feedRenderer{
+		cars:     cars,
+		feeds:    map[string]*feed{},
+		ctx:      feedContext{listingURL: listingURL, imageBaseURL: strings.TrimSuffix(imageBaseURL, "/")},
+		byTenant: map[string]map[string]*renderedFeed{},
+	}
+	for i := range feeds {
+		r.feeds[feeds[i].Name] = &feeds[i]
+	}
+	return r
+}
+
+// render renders every feed of the tenant of ctx.
+func (fr *feedRenderer) render(ctx context.Context) (map[string]*renderedFeed, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "vin", Value: 1}})
+	cur, err := fr.cars.Find(ctx, forTenant(ctx, bson.M{
+		"deletedat": bson.M{"$exists": false},
+		"status":    bson.M{"$in": bson.A{carInStock, carReserved}},
+	}), opts)
+	if err != nil {
+		return nil, err
+	}
+	var cars []vehicle
+	if err := cur.All(ctx, &cars); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	rendered := make(map[string]*renderedFeed, len(fr.feeds))
+	for name, f := range fr.feeds {
+		fc := fr.ctx
+		if f.ListingURL != "" {
+			fc.listingURL = f.ListingURL
+		}
+		rows := make([][]string, len(cars))
+		for i := range cars {
+			row := make([]string, len(f.Fields))
+			for j, field := range f.Fields {
+				row[j] = field.Value
+				if field.Source != "" {
+					row[j] = feedSources[field.Source](&fc, &cars[i])
+				}
+			}
+			rows[i] = row
+		}
+
+		var buf bytes.Buffer
+		if f.Format == "xml" {
+			err = renderXML(&buf, f, rows)
+		} else {
+			err = renderCSV(&buf, f, rows)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("render feed %s: %w", name, err)
+		}
+		rendered[name] = &renderedFeed{body: buf.Bytes(), at: now}
+	}
+	return rendered, nil
+}
+
+func renderCSV(buf *bytes.Buffer, f *feed, rows [][]string) error {
+	w := csv.NewWriter(buf)
+	header := make([]string, len(f.Fields))
+	for i, field := range f.Fields {
+		header[i] = field.Name
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+// renderXML writes an element for each row, with one for each field that
+// has a value.
+func renderXML(buf *bytes.Buffer, f *feed, rows [][]string) error {
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	root := xml.StartElement{Name: xml.Name{Local: f.Root}}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		item := xml.StartElement{Name: xml.Name{Local: f.Item}}
+		if err := enc.EncodeToken(item); err != nil {
+			return err
+		}
+		for i, value := range row {
+			if value == "" {
+				continue
+			}
+			if err := enc.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: f.Fields[i].Name}}); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(item.End()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// get returns the feeds of the tenant of ctx.
+func (fr *feedRenderer) get(ctx context.Context) (map[string]*renderedFeed, error) {
+	tenant := tenantFrom(ctx)
+	fr.mu.Lock()
+	rendered, ok := fr.byTenant[tenant]
+	fr.mu.Unlock()
+	if ok {
+		return rendered, nil
+	}
+
+	rendered, err := fr.render(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fr.mu.Lock()
+	fr.byTenant[tenant] = rendered
+	fr.mu.Unlock()
+	return rendered, nil
+}
+
+// refresh renders the feeds of every tenant asked for them again.
+func (fr *feedRenderer) refresh(ctx context.Context) error {
+	fr.mu.Lock()
+	tenants := make([]string, 0, len(fr.byTenant))
+	for t := range fr.byTenant {
+		tenants = append(tenants, t)
+	}
+	fr.mu.Unlock()
+
+	for _, t := range tenants {
+		rendered, err := fr.render(withTenant(ctx, t))
+		if err != nil {
+			return err
+		}
+		fr.mu.Lock()
+		fr.byTenant[t] = rendered
+		fr.mu.Unlock()
+	}
+	return nil
+}
+
+// feedByName serves the feed with the name, as last rendered.
+func feedByName(fr *feedRenderer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := fr.feeds[pat.Param(r, "name")]
+		if !ok {
+			errorWithJSON(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		rendered, err := fr.get(r.Context())
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed render feeds", "err", err)
+			return
+		}
+		out := rendered[f.Name]
+
+		w.Header().Set("Content-Type", feedTypes[f.Format])
+		http.ServeContent(w, r, "", out.at, bytes.NewReader(out.body))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Field events are sent for a change to one field of a car, for consumers
+// that care about it rather than about every update. They are named
+//
+//	car.<field>.changed           for any change of the field
+//	car.<field>.increased         when a number goes up
+//	car.<field>.decreased         when a number goes down
+//	car.<field>.changed:<value>   when the field changes to value
+//
+// e.g. car.price.decreased or car.status.changed:sold.
+const (
+	fieldChanged   = "changed"
+	fieldIncreased = "increased"
+	fieldDecreased = "decreased"
+)
+
+// eventFields are the fields of a car field events are sent for, and whether
+// each is a number that increases and decreases.
+var eventFields = map[string]bool{
+	"price":     true,
+	"mileage":   true,
+	"year":      true,
+	"status":    false,
+	"dealer":    false,
+	"branch":    false,
+	"regno":     false,
+	"colour":    false,
+	"condition": false,
+}
+
+func eventFieldNames() []string {
+	names := make([]string, 0, len(eventFields))
+	for name := range eventFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldEvent is the payload of a field event.
+type fieldEvent struct {
+	VIN   string      `json:"vin"`
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+	Car   *vehicle    `json:"car"`
+}
+
+// carChanged is the event of a write that made before into after, with the
+// fields it changed.
+func carChanged(event string, before, after *vehicle) inventoryEvent {
+	return inventoryEvent{Type: event, VIN: after.VIN, Car: after, Changes: changes(before, after)}
+}
+
+// events names the field events of c, the most specific first, or none when
+// its field has no events.
+func (c fieldChange) events() []string {
+	numeric, ok := eventFields[c.Field]
+	if !ok {
+		return nil
+	}
+	prefix := "car." + c.Field + "."
+	var names []string
+	if s, ok := c.New.(string); ok && s != "" {
+		names = append(names, prefix+fieldChanged+":"+s)
+	}
+	if numeric {
+		old, okOld := eventNumber(c.Old)
+		new, okNew := eventNumber(c.New)
+		switch {
+		case !okOld || !okNew || old == new || !c.sameCurrency():
+		case new > old:
+			names = append(names, prefix+fieldIncreased)
+		default:
+			names = append(names, prefix+fieldDecreased)
+		}
+	}
+	return append(names, prefix+fieldChanged)
+}
+
+// eventNumber returns the number a numeric field is valued at: itself, or
+// the amount of a price.
+func eventNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case map[string]interface{}:
+		amount, ok := v["amount"].(float64)
+		return amount, ok
+	}
+	return 0, false
+}
+
+// sameCurrency reports whether a change of price is between prices in one
+// currency, so that its amounts compare.
+func (c fieldChange) sameCurrency() bool {
+	old, _ := c.Old.(map[string]interface{})
+	new, _ := c.New.(map[string]interface{})
+	return old == nil || new == nil || old["currency"] == new["currency"]
+}
+
+// validFieldEvent reports whether name is a field event that can be sent.
+func validFieldEvent(name string) bool {
+	rest, ok := strings.CutPrefix(name, "car.")
+	if !ok {
+		return false
+	}
+	field, kind, ok := strings.Cut(rest, ".")
+	numeric, known := eventFields[field]
+	if !ok || !known {
+		return false
+	}
+	kind, value, valued := strings.Cut(kind, ":")
+	switch kind {
+	case fieldChanged:
+		return !valued || value != ""
+	case fieldIncreased, fieldDecreased:
+		return numeric && !valued
+	}
+	return false
+}
+
+// isFieldEvent reports whether name is a field event rather than a car
+// event, which webhooks are only sent when they name it.
+func isFieldEvent(name string) bool {
+	for _, car := range webhookEvents {
+		if name == car {
+			return false
+		}
+	}
+	return strings.HasPrefix(name, "car.")
+}
+
+// changesAny reports whether e changed any of fields.
+func (e inventoryEvent) changesAny(fields map[string]bool) bool {
+	for _, c := range e.Changes {
+		if fields[c.Field] {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldsParam parses the comma separated fields of a car a stream is
+// limited to the changes of, which have field events.
+func fieldsParam(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := map[string]bool{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := eventFields[f]; !ok {
+			return nil, fmt.Errorf("Unknown field %q", f)
+		}
+		fields[f] = true
+	}
+	return fields, nil
+}
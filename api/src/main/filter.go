@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// filterOperators are the only query operators a filter built from a
+// client's parameters may hold, each taking a plain value.
+var filterOperators = map[string]bool{
+	"$gte":    true,
+	"$lte":    true,
+	"$lt":     true,
+	"$exists": true,
+	"$search": true,
+}
+
+// filterKeys are the stored keys, besides those of listFields, that the
+// parameters of a listing filter on.
+var filterKeys = map[string]bool{
+	"$text":         true,
+	"deletedat":     true,
+	"pricereviewat": true,
+}
+
+// equal narrows the filter to the cars whose stored key holds value. The
+// value is always a string, integer or boolean, so whatever the client
+// sent, it is matched as it is and never read as an operator.
+func (p *ListParams) equal(key string, value interface{}) {
+	p.Filter[key] = value
+}
+
+// bound narrows the filter to the cars whose stored key compares with n by
+// op, keeping any other bound already set on it.
+func (p *ListParams) bound(key, op string, n interface{}) {
+	if !filterOperators[op] {
+		panic("filter operator " + op + " is not allowed")
+	}
+	bounds, ok := p.Filter[key].(bson.M)
+	if !ok {
+		bounds = bson.M{}
+		p.Filter[key] = bounds
+	}
+	bounds[op] = n
+}
+
+// checkFilter makes sure filter, built from a client's parameters, only
+// filters on the keys of listFields and filterKeys, with plain values or
+// the filterOperators of plain values, so that no operator can have been
+// smuggled in by a value such as {"$gt": ""}.
+func checkFilter(filter bson.M) error {
+	for key, value := range filter {
+		if !filterKeys[key] && !storedListField(key) {
+			return fmt.Errorf("Cannot filter on %q", key)
+		}
+		ops, ok := value.(bson.M)
+		if !ok {
+			if !plainValue(value) {
+				return fmt.Errorf("Cannot filter %q on a %T", key, value)
+			}
+			continue
+		}
+		for op, v := range ops {
+			if !filterOperators[op] || !plainValue(v) {
+				return fmt.Errorf("Cannot filter %q with %q", key, op)
+			}
+		}
+	}
+	return nil
+}
+
+func storedListField(key string) bool {
+	for _, stored := range listFields {
+		if stored == key {
+			return true
+		}
+	}
+	return false
+}
+
+// plainValue reports whether v is a value matched as it is rather than a
+// document or array, which the database could read as an operator.
+func plainValue(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, int, int64, float64:
+		return true
+	}
+	return false
+}
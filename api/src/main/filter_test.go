@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestListQueryKeepsValuesPlain sends the operators a client could try to
+// smuggle into a filter, and checks every one reaches the filter as the
+// plain value it was sent as, or is refused.
+func TestListQueryKeepsValuesPlain(t *testing.T) {
+	values := []string{
+		`{"$gt": ""}`,
+		`{"$ne": null}`,
+		`{"$regex": ".*"}`,
+		`{"$where": "sleep(1000)"}`,
+		`{"$expr": {"$eq": [1, 1]}}`,
+		`$gt`,
+		`["a", "b"]`,
+		`{$ne: 1}`,
+		"\x00$gt",
+	}
+	for _, name := range []string{"manufacturer", "model", "vin", "regno", "dealer", "branch", "colour"} {
+		for _, v := range values {
+			params, err := parseListQuery(url.Values{name: {v}})
+			if err != nil {
+				continue
+			}
+			key := listFields[name]
+			if _, ok := params.Filter[key].(string); !ok {
+				t.Errorf("?%s=%s: filter %v holds a %T, want a string", name, v, params.Filter[key], params.Filter[key])
+			}
+		}
+	}
+	for _, name := range []string{"price", "price_min", "year_max", "mileage_max", "status"} {
+		for _, v := range values {
+			if _, err := parseListQuery(url.Values{name: {v}}); err == nil {
+				t.Errorf("?%s=%s: no error", name, v)
+			}
+		}
+	}
+	for _, v := range values {
+		params, err := parseListQuery(url.Values{"q": {v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if search, _ := params.Filter["$text"].(bson.M); search["$search"] != v {
+			t.Errorf("?q=%s: filter %v, want the search as sent", v, params.Filter["$text"])
+		}
+	}
+}
+
+func TestListQueryRefusesOperatorKeys(t *testing.T) {
+	for _, name := range []string{
+		"$where", "$or", "$and", "$expr", "$text", "manufacturer[$ne]", "manufacturer.$ne",
+		"price[$gt]", "price.amount", "tenant", "deletedat", "_id", "cost", "status[$nin]",
+	} {
+		if params, err := parseListQuery(url.Values{name: {"1"}}); err == nil {
+			t.Errorf("?%s=1: no error, filter %v", name, params.Filter)
+		}
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	allowed := []bson.M{
+		{"manufacturer": "Ford"},
+		{"price.amount": bson.M{"$gte": int64(1), "$lte": int64(9)}},
+		{"deletedat": bson.M{"$exists": false}},
+		{"$text": bson.M{"$search": "ford focus"}},
+	}
+	for _, f := range allowed {
+		if err := checkFilter(f); err != nil {
+			t.Errorf("checkFilter(%v) = %v, want nil", f, err)
+		}
+	}
+
+	refused := []bson.M{
+		{"$where": "sleep(1000)"},
+		{"$or": bson.A{bson.M{"manufacturer": "Ford"}}},
+		{"$expr": bson.M{"$eq": bson.A{1, 1}}},
+		{"tenant": "other"},
+		{"cost.amount": int64(1)},
+		{"manufacturer": bson.M{"$ne": "Ford"}},
+		{"manufacturer": bson.M{"$regex": ".*"}},
+		{"manufacturer": bson.M{"$gt": ""}},
+		{"manufacturer": bson.M{"$in": bson.A{"Ford"}}},
+		{"manufacturer": bson.A{"Ford"}},
+		{"manufacturer": []string{"Ford"}},
+		{"manufacturer": nil},
+		{"manufacturer": bson.D{{Key: "$gt", Value: ""}}},
+		{"price.amount": bson.M{"$gte": bson.M{"$gt": 0}}},
+		{"price.amount": bson.M{"$lte": bson.A{1}}},
+		{"$text": bson.M{"$search": "ford", "$language": "none"}},
+		{"$text": bson.M{"$search": bson.M{"$gt": ""}}},
+	}
+	for _, f := range refused {
+		if err := checkFilter(f); err == nil {
+			t.Errorf("checkFilter(%v) = nil, want an error", f)
+		}
+	}
+}
+
+func TestBoundRefusesOperators(t *testing.T) {
+	for _, op := range []string{"$where", "$ne", "$regex", "$in", "$expr", "$gt"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("bound with %s did not panic", op)
+				}
+			}()
+			params := ListParams{Filter: bson.M{}}
+			params.bound("price.amount", op, 1)
+		}()
+	}
+}
+
+// TestMemoryListsSmuggledValuesPlainly checks a smuggled operator matches
+// the cars holding it as a value, none, rather than every car.
+func TestMemoryListsSmuggledValuesPlainly(t *testing.T) {
+	repo := newMemoryVehicles()
+	ctx := context.Background()
+	for _, car := range seedCars(1, 3) {
+		if err := prepareNewCar(ctx, &car); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.create(ctx, car); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{`{"$gt": ""}`, `{"$ne": null}`, `$gt`} {
+		params, err := parseListQuery(url.Values{"manufacturer": {v}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cars, total, _, err := repo.list(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 || len(cars) != 0 {
+			t.Errorf("?manufacturer=%s listed %d cars, want none", v, total)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// lenderProfile is the terms a lender offers finance on.
+type lenderProfile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// MinAPR and MaxAPR bound the APR, in percent, a quote may be made at.
+	MinAPR        float64 `json:"min_apr"`
+	MaxAPR        float64 `json:"max_apr"`
+	MinTermMonths int     `json:"min_term_months"`
+	MaxTermMonths int     `json:"max_term_months"`
+	// MinDepositPercent is the least deposit taken, as a percentage of the
+	// cash price.
+	MinDepositPercent float64 `json:"min_deposit_percent"`
+	// ArrangementFee is added to the first payment and OptionFee, paid to
+	// own the car, to the last, both in the minor unit of the currency.
+	ArrangementFee int64 `json:"arrangement_fee"`
+	OptionFee      int64 `json:"option_fee"`
+}
+
+// defaultLenders are offered when no lender profiles are configured.
+var defaultLenders = []lenderProfile{{
+	ID:                "standard",
+	Name:              "Standard hire purchase",
+	MinAPR:            0,
+	MaxAPR:            29.9,
+	MinTermMonths:     12,
+	MaxTermMonths:     60,
+	MinDepositPercent: 10,
+}}
+
+// loadLenders reads the lender profiles from the JSON file at path, or
+// returns the default ones when path is empty.
+func loadLenders(path string) ([]lenderProfile, error) {
+	if path == "" {
+		return defaultLenders, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading lender profiles: %v", err)
+	}
+	var lenders []lenderProfile
+	if err := json.Unmarshal(b, &lenders); err != nil {
+		return nil, fmt.Errorf("loading lender profiles: %v", err)
+	}
+	if len(lenders) == 0 {
+		return nil, errors.New("the lender profiles file holds no profiles")
+	}
+	for _, l := range lenders {
+		if l.ID == "" || l.MinAPR < 0 || l.MaxAPR < l.MinAPR || l.MinTermMonths < 1 || l.MaxTermMonths < l.MinTermMonths {
+			return nil, fmt.Errorf("lender profile %q is not valid", l.ID)
+		}
+	}
+	return lenders, nil
+}
+
+type quoteRequest struct {
+	VIN string `json:"vin"`
+	// Lender is the ID of the lender profile; the first one by default.
+	Lender     string  `json:"lender"`
+	Deposit    int64   `json:"deposit"`
+	TermMonths int     `json:"term_months"`
+	APR        float64 `json:"apr"`
+}
+
+// financeQuote is what a car costs on finance. Every payment is the monthly
+// payment but for the first, which adds the arrangement fee, and the last,
+// which adds the option fee and makes up the pence the others were rounded
+// by.
+type financeQuote struct {
+	VIN            string  `json:"vin"`
+	Lender         string  `json:"lender"`
+	Currency       string  `json:"currency"`
+	CashPrice      int64   `json:"cash_price"`
+	Deposit        int64   `json:"deposit"`
+	AmountFinanced int64   `json:"amount_financed"`
+	TermMonths     int     `json:"term_months"`
+	APR            float64 `json:"apr"`
+	MonthlyPayment int64   `json:"monthly_payment"`
+	FirstPayment   int64   `json:"first_payment"`
+	FinalPayment   int64   `json:"final_payment"`
+	// TotalCharge is the interest and fees; TotalPayable adds the cash
+	// price to it.
+	TotalCharge  int64 `json:"total_charge_for_credit"`
+	TotalPayable int64 `json:"total_payable"`
+}
+
+// quote works out the payments on the amount financed over q's term at q's APR.
+// The APR is the annual rate compounded, so the monthly rate is its twelfth
+// root.
+func quote(l lenderProfile, q quoteRequest, cash int64) financeQuote {
+	financed := cash - q.Deposit
+	n := float64(q.TermMonths)
+
+	var exact float64
+	if rate := math.Pow(1+q.APR/100, 1.0/12) - 1; rate == 0 {
+		exact = float64(financed) / n
+	} else {
+		exact = float64(financed) * rate / (1 - math.Pow(1+rate, -n))
+	}
+	monthly := int64(math.Round(exact))
+	repaid := int64(math.Round(exact * n))
+
+	first := monthly + l.ArrangementFee
+	final := repaid - monthly*int64(q.TermMonths-1) + l.OptionFee
+	if q.TermMonths == 1 {
+		first = final + l.ArrangementFee
+		final = first
+	}
+	charge := repaid - financed + l.ArrangementFee + l.OptionFee
+
+	return financeQuote{
+		VIN:            q.VIN,
+		Lender:         l.ID,
+		CashPrice:      cash,
+		Deposit:        q.Deposit,
+		AmountFinanced: financed,
+		TermMonths:     q.TermMonths,
+		APR:            q.APR,
+		MonthlyPayment: monthly,
+		FirstPayment:   first,
+		FinalPayment:   final,
+		TotalCharge:    charge,
+		TotalPayable:   cash + charge,
+	}
+}
+
+// financeQuoteHandler quotes finance on a car at its asking price, so that
+// every storefront shows the same payments.
+func financeQuoteHandler(c *mongo.Collection, lenders []lenderProfile) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q quoteRequest
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&q); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		l := lenders[0]
+		if q.Lender != "" {
+			found := false
+			for _, p := range lenders {
+				if p.ID == q.Lender {
+					l, found = p, true
+				}
+			}
+			if !found {
+				fieldErrorWithJSON(w, "lender", "invalid", "There is no such lender")
+				return
+			}
+		}
+
+		switch {
+		case q.TermMonths < l.MinTermMonths || q.TermMonths > l.MaxTermMonths:
+			fieldErrorWithJSON(w, "term_months", "invalid", fmt.Sprintf("The term must be between %d and %d months", l.MinTermMonths, l.MaxTermMonths))
+			return
+		case q.APR < l.MinAPR || q.APR > l.MaxAPR:
+			fieldErrorWithJSON(w, "apr", "invalid", fmt.Sprintf("The APR must be between %g%% and %g%%", l.MinAPR, l.MaxAPR))
+			return
+		}
+
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), q.VIN)).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				fieldErrorWithJSON(w, "vin", "not_found", "There is no car with this VIN")
+				return
+			}
+		}
+		if car.Price == nil || car.Price.Amount <= 0 {
+			errorWithJSON(w, "The car has no price to quote finance on", http.StatusConflict)
+			return
+		}
+
+		cash := car.Price.Amount
+		minDeposit := int64(math.Ceil(float64(cash) * l.MinDepositPercent / 100))
+		if q.Deposit < minDeposit || q.Deposit >= cash {
+			fieldErrorWithJSON(w, "deposit", "invalid", fmt.Sprintf("The deposit must be at least %d and less than the cash price", minDeposit))
+			return
+		}
+
+		fq := quote(l, q, cash)
+		fq.Currency = car.Price.Currency
+
+		respBody, err := json.MarshalIndent(fq, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// minTrigramSimilarity is how alike by trigrams a word of a search must
+	// be to a manufacturer or model word to be taken as a misspelling of it.
+	minTrigramSimilarity = 0.3
+	// vocabularyTTL is how long the manufacturer and model words of a tenant
+	// are kept before they are read again.
+	vocabularyTTL = 5 * time.Minute
+	// maxFuzzyMatches is the most cars an Atlas fuzzy search finds.
+	maxFuzzyMatches = 1000
+)
+
+// fuzzySearch widens a search with ?fuzzy=true to the cars whose
+// manufacturer or model is spelt close to the words searched for, so that
+// "Volkswagon" finds Volkswagens.
+type fuzzySearch interface {
+	// widen rewrites the search in params, and reports whether its results
+	// can still be ranked by text score.
+	widen(ctx context.Context, params *ListParams) (bool, error)
+}
+
+// ngramSearch corrects the words of a search to the manufacturer and model
+// words of the tenant's cars they have the most trigrams in common with,
+// then searches the text index for the words and their corrections.
+type ngramSearch struct {
+	cars *mongo.Collection
+
+	mu     sync.Mutex
+	vocabs map[string]*vocabulary
+}
+
+// vocabulary is the words of the manufacturers and models of a tenant's
+// cars, with their trigrams.
+type vocabulary struct {
+	words map[string]map[string]bool
+	at    time.Time
+}
+
+func newNgramSearch(cars *mongo.Collection) *ngramSearch {
+	return &ngramSearch{cars: cars, vocabs: map[string]*vocabulary{}}
+}
+
+func (n *ngramSearch) widen(ctx context.Context, params *ListParams) (bool, error) {
+	vocab, err := n.vocabulary(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	terms := strings.Fields(strings.ToLower(params.Text))
+	for _, term := range terms {
+		// Phrases and negated words are searched for as they are.
+		if _, known := vocab.words[term]; known || strings.ContainsAny(term, `"-`) {
+			continue
+		}
+		if word := vocab.nearest(term); word != "" {
+			terms = append(terms, word)
+		}
+	}
+	params.Text = strings.Join(terms, " ")
+	params.Filter["$text"] = bson.M{"$search": params.Text}
+	return true, nil
+}
+
+// vocabulary returns the words of the tenant of ctx, reading them again
+// once they are older than vocabularyTTL.
+func (n *ngramSearch) vocabulary(ctx context.Context) (*vocabulary, error) {
+	tenant := tenantFrom(ctx)
+	n.mu.Lock()
+	vocab := n.vocabs[tenant]
+	n.mu.Unlock()
+	if vocab != nil && time.Since(vocab.at) < vocabularyTTL {
+		return vocab, nil
+	}
+
+	vocab = &vocabulary{words: map[string]map[string]bool{}, at: time.Now()}
+	live := forTenant(ctx, bson.M{"deletedat": bson.M{"$exists": false}})
+	for _, field := range []string{"manufacturer", "model"} {
+		values, err := n.cars.Distinct(ctx, field, live)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			s, _ := v.(string)
+			// The text index splits on the same characters.
+			for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+				return r == ' ' || r == '-' || r == '/' || r == '.'
+			}) {
+				vocab.words[word] = trigrams(word)
+			}
+		}
+	}
+
+	n.mu.Lock()
+	n.vocabs[tenant] = vocab
+	n.mu.Unlock()
+	return vocab, nil
+}
+
+// nearest returns the word most like term by trigrams, or "" when none is
+// alike enough.
+func (v *vocabulary) nearest(term string) string {
+	grams := trigrams(term)
+	best, bestScore := "", minTrigramSimilarity
+	for word, wordGrams := range v.words {
+		shared := 0
+		for g := range grams {
+			if wordGrams[g] {
+				shared++
+			}
+		}
+		score := float64(shared) / float64(len(grams)+len(wordGrams)-shared)
+		if score > bestScore || score == bestScore && best != "" && word < best {
+			best, bestScore = word, score
+		}
+	}
+	return best
+}
+
+// trigrams returns the three letter sequences of word, padded so that its
+// start and end count too.
+func trigrams(word string) map[string]bool {
+	r := []rune("  " + word + " ")
+	grams := make(map[string]bool, len(r))
+	for i := 0; i+3 <= len(r); i++ {
+		grams[string(r[i:i+3])] = true
+	}
+	return grams
+}
+
+// atlasSearch searches manufacturers and models with an Atlas Search index,
+// allowing two edits per word. The cars found are listed by the search's
+// sort, as Atlas's relevance cannot be combined with a listing's filters.
+type atlasSearch struct {
+	cars  *mongo.Collection
+	index string
+}
+
+func (a *atlasSearch) widen(ctx context.Context, params *ListParams) (bool, error) {
+	match := bson.M{}
+	if vin, ok := params.Filter["vin"]; ok {
+		match["vin"] = vin
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: bson.M{
+			"index": a.index,
+			"text": bson.M{
+				"query": params.Text,
+				"path":  bson.A{"manufacturer", "model"},
+				"fuzzy": bson.M{"maxEdits": 2},
+			},
+		}}},
+		{{Key: "$match", Value: forTenant(ctx, match)}},
+		{{Key: "$limit", Value: maxFuzzyMatches}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "vin": 1}}},
+	}
+	cur, err := a.cars.Aggregate(ctx, pipeline)
+	if err != nil {
+		return false, err
+	}
+	var found []struct{ VIN string }
+	if err := cur.All(ctx, &found); err != nil {
+		return false, err
+	}
+
+	vins := bson.A{}
+	for _, f := range found {
+		vins = append(vins, f.VIN)
+	}
+	delete(params.Filter, "$text")
+	params.Filter["vin"] = bson.M{"$in": vins}
+	return false, nil
+}
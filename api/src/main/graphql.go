@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"vin"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// graphQLRequest is the body of a GraphQL request. GET requests pass the same
+// fields in the query string.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLError is an error reported in the errors of a GraphQL response, with
+// a code in its extensions that clients can switch on.
+type graphQLError struct {
+	message string
+	code    string
+}
+
+func (e *graphQLError) Error() string { return e.message }
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+var errCarNotFound = &graphQLError{"Car not found", "NOT_FOUND"}
+
+// gqlDBError returns the error for a failed database call, logging failures
+// other than a missing car.
+func gqlDBError(msg string, err error) error {
+	switch err {
+	case mongo.ErrNoDocuments:
+		return errCarNotFound
+	case errDuplicateVIN:
+		return badInput("A car with this VIN already exists")
+	case errDuplicateRegNo:
+		return badInput("A car with this registration already exists")
+	}
+	slog.Error(msg, "err", err)
+	return &graphQLError{"Database error", "INTERNAL"}
+}
+
+func badInput(message string) error {
+	return &graphQLError{message, "BAD_USER_INPUT"}
+}
+
+// gqlRequireRole is requireRole for resolvers.
+func gqlRequireRole(ctx context.Context, a *authenticator, role string) error {
+	if !a.required {
+		return nil
+	}
+
+	p := principalFrom(ctx)
+	if p == nil {
+		return &graphQLError{"Authentication required", "UNAUTHENTICATED"}
+	}
+	if roleRank[p.Role] < roleRank[role] {
+		return &graphQLError{"The " + role + " role is required", "FORBIDDEN"}
+	}
+	return nil
+}
+
+// newGraphQLSchema returns the schema served at /graphql. Fields and listing
+// arguments use the names of the REST API so that both can share client
+// types.
+func newGraphQLSchema(c *mongo.Collection, events *broker, audit *auditLog, auth *authenticator) (graphql.Schema, error) {
+	priceType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Price",
+		Description: "An asking price in the minor unit of its currency, e.g. pence.",
+		Fields: graphql.Fields{
+			"amount":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"currency": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	imageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Image",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"content_type": &graphql.Field{Type: graphql.String},
+			"size":         &graphql.Field{Type: graphql.Int},
+			"uploaded_at":  &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	holdType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Hold",
+		Description: "A time-limited reservation of a car.",
+		Fields: graphql.Fields{
+			"until":       &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"by":          &graphql.Field{Type: graphql.String},
+			"customer_id": &graphql.Field{Type: graphql.String},
+			"note":        &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	vehicleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Vehicle",
+		Fields: graphql.Fields{
+			"manufacturer": &graphql.Field{Type: graphql.String},
+			"model":        &graphql.Field{Type: graphql.String},
+			"vin":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"regno":        &graphql.Field{Type: graphql.String},
+			"dealer":       &graphql.Field{Type: graphql.String},
+			"branch":       &graphql.Field{Type: graphql.String},
+			"status":       &graphql.Field{Type: graphql.String},
+			"order":        &graphql.Field{Type: graphql.String},
+			"hold":         &graphql.Field{Type: holdType},
+			"sold_at":      &graphql.Field{Type: graphql.DateTime},
+			"price":        &graphql.Field{Type: priceType},
+			"mileage":      &graphql.Field{Type: graphql.Int},
+			"year":         &graphql.Field{Type: graphql.Int},
+			"fuel_type":    &graphql.Field{Type: graphql.String},
+			"transmission": &graphql.Field{Type: graphql.String},
+			"colour":       &graphql.Field{Type: graphql.String},
+			"condition":    &graphql.Field{Type: graphql.String},
+			"images":       &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(imageType))},
+			"deleted_at":   &graphql.Field{Type: graphql.DateTime},
+			"revision":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	// Image URLs need the VIN of the car, so they are resolved on the car.
+	vehicleType.AddFieldConfig("image_urls", &graphql.Field{
+		Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			car := p.Source.(vehicle)
+			urls := []string{}
+			for _, img := range car.Images {
+				urls = append(urls, apiRoute("/cars/"+car.VIN+"/images/"+img.ID))
+			}
+			return urls, nil
+		},
+	})
+
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "CarPage",
+		Fields: graphql.Fields{
+			"cars":        &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(vehicleType))},
+			"total":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"limit":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"page":        &graphql.Field{Type: graphql.Int},
+			"offset":      &graphql.Field{Type: graphql.Int},
+			"next_cursor": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	priceInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PriceInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"amount":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"currency": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	vehicleInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "VehicleInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"manufacturer": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"model":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"vin":          &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"regno":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"dealer":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"branch":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"sold_at":      &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
+			"price":        &graphql.InputObjectFieldConfig{Type: priceInput},
+			"mileage":      &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"year":         &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"fuel_type":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"transmission": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"colour":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"condition":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	// The cars query takes the parameters of GET /cars as arguments.
+	listArgs := graphql.FieldConfigArgument{
+		"q":               &graphql.ArgumentConfig{Type: graphql.String},
+		"sort":            &graphql.ArgumentConfig{Type: graphql.String},
+		"limit":           &graphql.ArgumentConfig{Type: graphql.Int},
+		"offset":          &graphql.ArgumentConfig{Type: graphql.Int},
+		"page":            &graphql.ArgumentConfig{Type: graphql.Int},
+		"cursor":          &graphql.ArgumentConfig{Type: graphql.String},
+		"include_deleted": &graphql.ArgumentConfig{Type: graphql.Boolean},
+	}
+	for name := range listFields {
+		if !numericFields[name] {
+			listArgs[name] = &graphql.ArgumentConfig{Type: graphql.String}
+			continue
+		}
+		listArgs[name] = &graphql.ArgumentConfig{Type: graphql.Int}
+		for suffix := range rangeSuffixes {
+			listArgs[name+suffix] = &graphql.ArgumentConfig{Type: graphql.Int}
+		}
+	}
+
+	carInput := func(p graphql.ResolveParams) (vehicle, error) {
+		var car vehicle
+		b, err := json.Marshal(p.Args["car"])
+		if err == nil {
+			err = json.Unmarshal(b, &car)
+		}
+		if err != nil {
+			return car, badInput("Incorrect car")
+		}
+		return car, nil
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"car": &graphql.Field{
+				Type: vehicleType,
+				Args: graphql.FieldConfigArgument{
+					"vin": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var car vehicle
+					err := c.FindOne(p.Context, liveCar(p.Context, vin.Normalize(p.Args["vin"].(string)))).Decode(&car)
+					if err == mongo.ErrNoDocuments {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, gqlDBError("Failed find car", err)
+					}
+					return car, nil
+				},
+			},
+			"cars": &graphql.Field{
+				Type: graphql.NewNonNull(pageType),
+				Args: listArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					values := url.Values{}
+					for name, arg := range p.Args {
+						values.Set(name, fmt.Sprint(arg))
+					}
+
+					params, err := parseListQuery(values)
+					if err != nil {
+						return nil, badInput(err.Error())
+					}
+					if params.IncludeDeleted {
+						if err := gqlRequireRole(p.Context, auth, roleAdmin); err != nil {
+							return nil, err
+						}
+					}
+
+					cars, total, next, err := findPage(p.Context, c, params)
+					if err != nil {
+						return nil, gqlDBError("Failed get all cars", err)
+					}
+
+					page := carPage{Cars: cars, Total: total, Limit: params.Limit}
+					if params.UseCursor {
+						page.NextCursor = next
+					} else {
+						page.Page = &params.Page
+						page.Offset = &params.Offset
+					}
+					return page, nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createCar": &graphql.Field{
+				Type: graphql.NewNonNull(vehicleType),
+				Args: graphql.FieldConfigArgument{
+					"car": &graphql.ArgumentConfig{Type: graphql.NewNonNull(vehicleInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := gqlRequireRole(p.Context, auth, roleEditor); err != nil {
+						return nil, err
+					}
+
+					car, err := carInput(p)
+					if err != nil {
+						return nil, err
+					}
+					if err := prepareNewCar(p.Context, &car); err != nil {
+						return nil, badInput(err.String())
+					}
+
+					err = events.transact(p.Context, func(ctx context.Context) error {
+						if _, err := c.InsertOne(ctx, car); err != nil {
+							return err
+						}
+						events.publish(ctx, inventoryEvent{Type: eventCreated, VIN: car.VIN, Car: &car})
+						return nil
+					})
+					if err != nil {
+						return nil, gqlDBError("Failed insert car", duplicateKey(err))
+					}
+
+					audit.change(p.Context, auditCreated, car.VIN, nil, &car)
+					return car, nil
+				},
+			},
+			"updateCar": &graphql.Field{
+				Type: graphql.NewNonNull(vehicleType),
+				Args: graphql.FieldConfigArgument{
+					"vin": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"car": &graphql.ArgumentConfig{Type: graphql.NewNonNull(vehicleInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := gqlRequireRole(p.Context, auth, roleEditor); err != nil {
+						return nil, err
+					}
+
+					car, err := carInput(p)
+					if err != nil {
+						return nil, err
+					}
+					if err := car.validateReplacement(p.Context); err != nil {
+						return nil, badInput(err.String())
+					}
+
+					// As with PUT, the VIN argument wins over the one in car.
+					car.VIN = vin.Normalize(p.Args["vin"].(string))
+
+					var before vehicle
+					err = events.transact(p.Context, func(ctx context.Context) error {
+						var err error
+						if before, err = replaceCar(ctx, c, &car, anyRevision); err != nil {
+							return err
+						}
+						events.publish(ctx, carChanged(eventUpdated, &before, &car))
+						return nil
+					})
+					if err != nil {
+						return nil, gqlDBError("Failed update car", err)
+					}
+
+					audit.change(p.Context, auditUpdated, car.VIN, &before, &car)
+					return car, nil
+				},
+			},
+			"deleteCar": &graphql.Field{
+				Type: graphql.NewNonNull(vehicleType),
+				Args: graphql.FieldConfigArgument{
+					"vin": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if err := gqlRequireRole(p.Context, auth, roleAdmin); err != nil {
+						return nil, err
+					}
+
+					var car vehicle
+					err := events.transact(p.Context, func(ctx context.Context) error {
+						var err error
+						if car, err = softDelete(ctx, c, vin.Normalize(p.Args["vin"].(string)), anyRevision); err != nil {
+							return err
+						}
+						events.publish(ctx, inventoryEvent{Type: eventDeleted, VIN: car.VIN, Car: &car})
+						return nil
+					})
+					if err != nil {
+						return nil, gqlDBError("Failed delete car", err)
+					}
+
+					before := car
+					before.DeletedAt = nil
+					before.Revision--
+					audit.change(p.Context, auditDeleted, car.VIN, &before, &car)
+					return car, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphQL serves GraphQL requests as JSON bodies on POST, and queries but not
+// mutations on GET.
+func graphQL(schema graphql.Schema, maint *maintenance) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if r.Method == http.MethodGet {
+			query := r.URL.Query()
+			req.Query = query.Get("query")
+			req.OperationName = query.Get("operationName")
+			if v := query.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					errorWithJSON(w, "Incorrect variables", http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		if req.Query == "" {
+			errorWithJSON(w, "A query is required", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet && isMutation(req) {
+			w.Header().Set("Allow", http.MethodPost)
+			errorWithJSON(w, "Mutations must be sent with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if isMutation(req) && maint.refuse(w) {
+			return
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			OperationName:  req.OperationName,
+			VariableValues: req.Variables,
+			Context:        r.Context(),
+		})
+
+		respBody, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// isMutation reports whether the operation req would run is a mutation. A
+// request that does not parse is not; it fails when it is run instead.
+func isMutation(req graphQLRequest) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return false
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if req.OperationName == "" || (op.Name != nil && op.Name.Value == req.OperationName) {
+			return op.Operation == ast.OperationTypeMutation
+		}
+	}
+	return false
+}
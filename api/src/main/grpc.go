@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"proto/carpb"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcRoles are the roles the gRPC methods that write need, as with the REST
+// routes.
+var grpcRoles = map[string]string{
+	carpb.CarService_CreateCar_FullMethodName: roleEditor,
+	carpb.CarService_UpdateCar_FullMethodName: roleEditor,
+	carpb.CarService_DeleteCar_FullMethodName: roleAdmin,
+}
+
+// listOptions are the listing parameters that ListCars sets from its own
+// fields, so they may not be passed as filters.
+var listOptions = map[string]bool{
+	"limit": true, "offset": true, "page": true, "cursor": true,
+	"sort": true, "fields": true, "format": true, "include_deleted": true,
+}
+
+// carServer implements the gRPC CarService on the same repository, broker
+// and audit log, and with the same rules, as the REST handlers.
+type carServer struct {
+	carpb.UnimplementedCarServiceServer
+
+	cars   vehicleRepository
+	events *broker
+	audit  *auditLog
+}
+
+// grpcAuth authenticates calls from the "authorization" or "x-api-key"
+// metadata the way authenticate does HTTP requests, and enforces grpcRoles.
+func grpcAuth(a *authenticator, t *tenancy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, info.FullMethod, nil)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Internal error")
+		}
+		for _, name := range []string{"Authorization", "X-API-Key", tenantHeader} {
+			if v := md.Get(name); len(v) > 0 {
+				r.Header.Set(name, v[0])
+			}
+		}
+
+		p, err := a.identify(r)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid credentials")
+		}
+		if p != nil {
+			ctx = context.WithValue(ctx, principalKey{}, p)
+		}
+
+		tenant, perr := t.resolve(p, r.Header.Get(tenantHeader))
+		if perr != nil {
+			code := codes.InvalidArgument
+			if perr.Status == http.StatusForbidden {
+				code = codes.PermissionDenied
+			}
+			return nil, status.Error(code, perr.Detail)
+		}
+		ctx = withTenant(ctx, tenant)
+
+		if role, ok := grpcRoles[info.FullMethod]; ok && a.required {
+			if p == nil {
+				return nil, status.Error(codes.Unauthenticated, "Authentication required")
+			}
+			if roleRank[p.Role] < roleRank[role] {
+				return nil, status.Error(codes.PermissionDenied, "The "+role+" role is required")
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func (s *carServer) ListCars(ctx context.Context, req *carpb.ListCarsRequest) (*carpb.ListCarsResponse, error) {
+	query := url.Values{}
+	for name, value := range req.Filter {
+		if listOptions[name] {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown filter %q", name)
+		}
+		query.Set(name, value)
+	}
+	if req.PageSize != 0 {
+		query.Set("limit", strconv.Itoa(int(req.PageSize)))
+	}
+
+	// Unsorted listings page with a cursor. Sorted ones page by offset, which
+	// the token then holds.
+	if req.Sort == "" {
+		query.Set("cursor", req.PageToken)
+	} else {
+		query.Set("sort", req.Sort)
+		if req.PageToken != "" {
+			offset, err := decodeCursor(req.PageToken)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, "Invalid page token")
+			}
+			query.Set("offset", offset)
+		}
+	}
+
+	params, err := parseListQuery(query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	cars, total, next, err := s.cars.list(ctx, params)
+	if err != nil {
+		return nil, dbError("Failed get all cars", err)
+	}
+
+	if !params.UseCursor && int64(params.Offset+len(cars)) < total {
+		next = encodeCursor(strconv.Itoa(params.Offset + len(cars)))
+	}
+
+	resp := &carpb.ListCarsResponse{Total: total, NextPageToken: next}
+	for i := range cars {
+		resp.Cars = append(resp.Cars, toProto(&cars[i]))
+	}
+	return resp, nil
+}
+
+func (s *carServer) GetCar(ctx context.Context, req *carpb.GetCarRequest) (*carpb.Vehicle, error) {
+	car, err := s.cars.get(ctx, vin.Normalize(req.Vin), nil)
+	if err != nil {
+		return nil, dbError("Failed find car", err)
+	}
+	return toProto(&car), nil
+}
+
+func (s *carServer) CreateCar(ctx context.Context, req *carpb.CreateCarRequest) (*carpb.Vehicle, error) {
+	car := fromProto(req.Car)
+	if err := prepareNewCar(ctx, &car); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.String())
+	}
+
+	err := s.events.transact(ctx, func(ctx context.Context) error {
+		if err := s.cars.create(ctx, car); err != nil {
+			return err
+		}
+		s.events.publish(ctx, inventoryEvent{Type: eventCreated, VIN: car.VIN, Car: &car})
+		return nil
+	})
+	if err != nil {
+		return nil, dbError("Failed insert car", err)
+	}
+
+	s.audit.change(ctx, auditCreated, car.VIN, nil, &car)
+	return toProto(&car), nil
+}
+
+func (s *carServer) UpdateCar(ctx context.Context, req *carpb.UpdateCarRequest) (*carpb.Vehicle, error) {
+	car := fromProto(req.Car)
+	car.VIN = vin.Normalize(car.VIN)
+	if err := car.validateReplacement(ctx); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.String())
+	}
+
+	var before vehicle
+	err := s.events.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if before, err = s.cars.replace(ctx, &car, anyRevision); err != nil {
+			return err
+		}
+		s.events.publish(ctx, carChanged(eventUpdated, &before, &car))
+		return nil
+	})
+	if err != nil {
+		return nil, dbError("Failed update car", err)
+	}
+
+	s.audit.change(ctx, auditUpdated, car.VIN, &before, &car)
+	return toProto(&car), nil
+}
+
+func (s *carServer) DeleteCar(ctx context.Context, req *carpb.DeleteCarRequest) (*emptypb.Empty, error) {
+	var car vehicle
+	err := s.events.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if car, err = s.cars.delete(ctx, vin.Normalize(req.Vin), anyRevision); err != nil {
+			return err
+		}
+		s.events.publish(ctx, inventoryEvent{Type: eventDeleted, VIN: car.VIN, Car: &car})
+		return nil
+	})
+	if err != nil {
+		return nil, dbError("Failed delete car", err)
+	}
+
+	before := car
+	before.DeletedAt = nil
+	before.Revision--
+	s.audit.change(ctx, auditDeleted, car.VIN, &before, &car)
+	return &emptypb.Empty{}, nil
+}
+
+// dbError returns the status for a failed database call, logging failures
+// other than a missing car.
+func dbError(msg string, err error) error {
+	switch err {
+	case mongo.ErrNoDocuments:
+		return status.Error(codes.NotFound, "Car not found")
+	case errDuplicateVIN:
+		return status.Error(codes.AlreadyExists, "A car with this VIN already exists")
+	case errDuplicateRegNo:
+		return status.Error(codes.AlreadyExists, "A car with this registration already exists")
+	}
+	slog.Error(msg, "err", err)
+	return status.Error(codes.Internal, "Database error")
+}
+
+func toProto(v *vehicle) *carpb.Vehicle {
+	p := &carpb.Vehicle{
+		Manufacturer: v.Manurfacturer,
+		Model:        v.Model,
+		Vin:          v.VIN,
+		Regno:        v.RegNo,
+		Dealer:       v.Dealer,
+		Branch:       v.Branch,
+		Status:       v.Status,
+		Mileage:      int32(v.Mileage),
+		Year:         int32(v.Year),
+		FuelType:     v.FuelType,
+		Transmission: v.Transmission,
+		Colour:       v.Colour,
+		Condition:    v.Condition,
+	}
+	if v.SoldAt != nil {
+		p.SoldAt = timestamppb.New(*v.SoldAt)
+	}
+	if v.Price != nil {
+		p.Price = &carpb.Price{Amount: v.Price.Amount, Currency: v.Price.Currency}
+	}
+	return p
+}
+
+func fromProto(p *carpb.Vehicle) vehicle {
+	if p == nil {
+		return vehicle{}
+	}
+
+	v := vehicle{
+		Manurfacturer: p.Manufacturer,
+		Model:         p.Model,
+		VIN:           p.Vin,
+		RegNo:         p.Regno,
+		Dealer:        p.Dealer,
+		Branch:        p.Branch,
+		Mileage:       int(p.Mileage),
+		Year:          int(p.Year),
+		FuelType:      p.FuelType,
+		Transmission:  p.Transmission,
+		Colour:        p.Colour,
+		Condition:     p.Condition,
+	}
+	if p.SoldAt != nil {
+		t := p.SoldAt.AsTime()
+		v.SoldAt = &t
+	}
+	if p.Price != nil {
+		v.Price = &price{Amount: p.Price.Amount, Currency: p.Price.Currency}
+	}
+	return v
+}
+
+// stopGRPC stops s gracefully, cutting calls off once timeout has passed.
+func stopGRPC(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.Stop()
+	}
+}
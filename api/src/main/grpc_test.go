@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"proto/carpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCarServerUsesRepository(t *testing.T) {
+	events := newBroker()
+	defer events.close()
+	sub := events.subscribe()
+	s := &carServer{cars: newMemoryVehicles(), events: events, audit: &auditLog{}}
+	ctx := withTenant(context.Background(), "north")
+
+	car := seedCars(1, 1)[0]
+	created, err := s.CreateCar(ctx, &carpb.CreateCarRequest{Car: toProto(&car)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-sub; e.Type != eventCreated || e.VIN != created.Vin {
+		t.Errorf("published %s %s, want created %s", e.Type, e.VIN, created.Vin)
+	}
+	if _, err := s.CreateCar(ctx, &carpb.CreateCarRequest{Car: toProto(&car)}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second create: %v, want AlreadyExists", err)
+	}
+
+	got, err := s.GetCar(ctx, &carpb.GetCarRequest{Vin: created.Vin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Manufacturer != car.Manurfacturer || got.Model != car.Model {
+		t.Errorf("got %s %s, want %s %s", got.Manufacturer, got.Model, car.Manurfacturer, car.Model)
+	}
+	if _, err := s.GetCar(withTenant(context.Background(), "south"), &carpb.GetCarRequest{Vin: created.Vin}); status.Code(err) != codes.NotFound {
+		t.Errorf("get for another tenant: %v, want NotFound", err)
+	}
+
+	list, err := s.ListCars(ctx, &carpb.ListCarsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || len(list.Cars) != 1 || list.Cars[0].Vin != created.Vin {
+		t.Errorf("listed %d of %d cars, want the one created", len(list.Cars), list.Total)
+	}
+
+	got.Colour = "green"
+	if _, err := s.UpdateCar(ctx, &carpb.UpdateCarRequest{Car: got}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-sub; e.Type != eventUpdated || e.Car == nil || e.Car.Colour != "green" {
+		t.Errorf("published %s of %+v, want the update", e.Type, e.Car)
+	}
+
+	if _, err := s.DeleteCar(ctx, &carpb.DeleteCarRequest{Vin: created.Vin}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-sub; e.Type != eventDeleted {
+		t.Errorf("published %s, want deleted", e.Type)
+	}
+	if _, err := s.GetCar(ctx, &carpb.GetCarRequest{Vin: created.Vin}); status.Code(err) != codes.NotFound {
+		t.Errorf("get after delete: %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"goji.io"
+	"goji.io/pat"
+)
+
+// handlerMux routes the handlers of the car routes that are built on a
+// vehicleRepository, without the authentication and caching main puts in
+// front of them, as main routes them.
+func handlerMux(repo vehicleRepository) http.Handler {
+	events, audit := newBroker(), &auditLog{}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get(apiRoute("/cars")), allCars(repo, nil, nil, nil))
+	mux.HandleFunc(pat.Post(apiRoute("/cars")), addCar(repo, nil, events, audit))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/lookup")), lookupVINs(repo))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/count")), countCars(repo))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/duplicates")), carDuplicates(repo))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/compare")), compareCars(repo, nil))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/search")), searchCars(repo, nil, nil, nil))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin")), carByVIN(repo, nil))
+	mux.HandleFunc(pat.Put(apiRoute("/cars/:vin")), updateCar(repo, events, audit))
+	mux.HandleFunc(pat.Patch(apiRoute("/cars/:vin")), patchCar(repo, events, audit))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin")), deleteCar(repo, events, audit))
+	mux.HandleFunc(pat.New("/*"), unknownRoute)
+	return mux
+}
+
+// stockedRepository is a memory repository holding the cars of seedCars(1, 3).
+func stockedRepository(t *testing.T) (*memoryVehicles, []vehicle) {
+	t.Helper()
+	repo := newMemoryVehicles()
+	cars := seedCars(1, 3)
+	for i := range cars {
+		if err := prepareNewCar(context.Background(), &cars[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.create(context.Background(), cars[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo, cars
+}
+
+func carJSON(t *testing.T, car vehicle, change func(map[string]interface{})) string {
+	t.Helper()
+	b, err := json.Marshal(car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	if change != nil {
+		change(fields)
+	}
+	b, _ = json.Marshal(fields)
+	return string(b)
+}
+
+type handlerCase struct {
+	name           string
+	method, target string
+	body           string
+	header         map[string]string
+	status         int
+	// code is the problem code of an error response.
+	code string
+	// check checks the response further.
+	check func(t *testing.T, rec *httptest.ResponseRecorder)
+}
+
+func runHandlerCases(t *testing.T, newRepo func(t *testing.T) vehicleRepository, cases []handlerCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := handlerMux(newRepo(t))
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req := httptest.NewRequest(tc.method, tc.target, body)
+			req.Header.Set("Content-Type", "application/json")
+			for name, v := range tc.header {
+				req.Header.Set(name, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Fatalf("%s %s: status = %d, want %d: %s", tc.method, tc.target, rec.Code, tc.status, rec.Body)
+			}
+			if rec.Code >= 400 {
+				if ct := rec.Header().Get("Content-Type"); ct != problem.ContentType {
+					t.Errorf("Content-Type = %q, want %q", ct, problem.ContentType)
+				}
+				var details problem.Details
+				if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+					t.Fatalf("error body %s: %v", rec.Body, err)
+				}
+				if details.Status != tc.status || details.Detail == "" {
+					t.Errorf("error body %s has status %d and detail %q", rec.Body, details.Status, details.Detail)
+				}
+				if tc.code != "" && details.Code != tc.code {
+					t.Errorf("code = %q, want %q", details.Code, tc.code)
+				}
+			}
+			if tc.check != nil {
+				tc.check(t, rec)
+			}
+		})
+	}
+}
+
+func wantTotal(n int64) func(t *testing.T, rec *httptest.ResponseRecorder) {
+	return func(t *testing.T, rec *httptest.ResponseRecorder) {
+		var page struct {
+			Total int64 `json:"total"`
+			Count int64 `json:"count"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total+page.Count != n {
+			t.Errorf("total = %d, want %d: %s", page.Total+page.Count, n, rec.Body)
+		}
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	_, cars := stockedRepository(t)
+	stocked := func(t *testing.T) vehicleRepository {
+		repo, _ := stockedRepository(t)
+		return repo
+	}
+	v0, v1 := cars[0].VIN, cars[1].VIN
+	byVIN := map[string]vehicle{}
+	for _, car := range cars {
+		byVIN[car.VIN] = car
+	}
+	word := strings.Fields(cars[0].Model)[0]
+	unknown := seedCars(2, 1)[0]
+	fresh := seedCars(3, 1)[0]
+	fresh.RegNo = "NEW1 CAR"
+
+	cases := []handlerCase{
+		{name: "list", method: "GET", target: apiRoute("/cars"), status: 200, check: wantTotal(3)},
+		{name: "list filtered", method: "GET", target: apiRoute("/cars?vin=" + strings.ToLower(v0)), status: 200, check: wantTotal(1)},
+		{name: "list ndjson", method: "GET", target: apiRoute("/cars?format=ndjson"), status: 200,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if n := strings.Count(rec.Body.String(), "\n"); n != 3 {
+					t.Errorf("%d lines, want 3", n)
+				}
+			}},
+		{name: "list bad limit", method: "GET", target: apiRoute("/cars?limit=0"), status: 400, code: problem.CodeBadRequest},
+		{name: "list bad sort", method: "GET", target: apiRoute("/cars?sort=cost"), status: 400, code: problem.CodeBadRequest},
+		{name: "list unknown filter", method: "GET", target: apiRoute("/cars?owner=me"), status: 400, code: problem.CodeBadRequest},
+		{name: "list ndjson near", method: "GET", target: apiRoute("/cars?format=ndjson&near=51.5,-0.12"), status: 400},
+		{name: "list ndjson paged", method: "GET", target: apiRoute("/cars?format=ndjson&limit=2"), status: 400},
+
+		{name: "count", method: "GET", target: apiRoute("/cars/count"), status: 200, check: wantTotal(3)},
+		{name: "count filtered", method: "GET", target: apiRoute("/cars/count?vin=" + v1), status: 200, check: wantTotal(1)},
+		{name: "count bad filter", method: "GET", target: apiRoute("/cars/count?price=cheap"), status: 400},
+
+		{name: "search", method: "GET", target: apiRoute("/cars/search?q=" + word), status: 200,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				var page struct {
+					Cars []vehicle `json:"cars"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				var want []string
+				for _, car := range cars {
+					if textScore(toDoc(car), word) > 0 {
+						want = append(want, car.VIN)
+					}
+				}
+				sort.Strings(want)
+				if len(page.Cars) != len(want) {
+					t.Fatalf("found %d cars, want %v: %s", len(page.Cars), want, rec.Body)
+				}
+				for i, car := range page.Cars {
+					stored := byVIN[car.VIN]
+					if car.VIN != want[i] || car.Manurfacturer != stored.Manurfacturer || car.Model != stored.Model || car.RegNo != stored.RegNo {
+						t.Errorf("car %d = %s %s %s %s, want %s %s %s %s", i, car.VIN, car.Manurfacturer, car.Model, car.RegNo,
+							want[i], byVIN[want[i]].Manurfacturer, byVIN[want[i]].Model, byVIN[want[i]].RegNo)
+					}
+				}
+			}},
+		{name: "search without q", method: "GET", target: apiRoute("/cars/search"), status: 400},
+		{name: "search with cursor", method: "GET", target: apiRoute("/cars/search?q=a&cursor="), status: 400},
+
+		{name: "compare", method: "GET", target: apiRoute("/cars/compare?vins=" + v1 + "," + v0), status: 200,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				var res comparison
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if len(res.Cars) != 2 || res.Cars[0].VIN != v1 || res.Cars[1].VIN != v0 {
+					t.Fatalf("compared cars %s, want %s then %s", rec.Body, v1, v0)
+				}
+				if len(res.Fields) != len(comparedFields) {
+					t.Fatalf("%d fields compared, want %d", len(res.Fields), len(comparedFields))
+				}
+				model := res.Fields[slices.Index(comparedFields, "model")]
+				differs := cars[1].Model != cars[0].Model
+				if model.Field != "model" || model.Values[0] != cars[1].Model || model.Values[1] != cars[0].Model || model.Differs != differs {
+					t.Errorf("model compared as %+v", model)
+				}
+				if slices.Contains(res.Differing, "model") != differs {
+					t.Errorf("differing = %v", res.Differing)
+				}
+			}},
+		{name: "compare one", method: "GET", target: apiRoute("/cars/compare?vins=" + v0 + "," + v0), status: 400},
+		{name: "compare unknown", method: "GET", target: apiRoute("/cars/compare?vins=" + v0 + "," + unknown.VIN), status: 404, code: problem.CodeNotFound},
+
+		{name: "duplicates", method: "GET", target: apiRoute("/cars/duplicates"), status: 200},
+
+		{name: "lookup", method: "POST", target: apiRoute("/cars/lookup"), body: `{"vins":["` + v0 + `","` + unknown.VIN + `"]}`, status: 200,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				var res vinLookup
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if len(res.Cars) != 1 || len(res.Missing) != 1 || res.Missing[0] != unknown.VIN {
+					t.Fatalf("lookup = %s", rec.Body)
+				}
+				if car := res.Cars[0]; car.VIN != v0 || car.Manurfacturer != cars[0].Manurfacturer || car.Model != cars[0].Model || car.RegNo != cars[0].RegNo {
+					t.Errorf("looked up %s %s %s %s, want %s %s %s %s", car.VIN, car.Manurfacturer, car.Model, car.RegNo,
+						v0, cars[0].Manurfacturer, cars[0].Model, cars[0].RegNo)
+				}
+			}},
+		{name: "lookup none", method: "POST", target: apiRoute("/cars/lookup"), body: `{"vins":[]}`, status: 422, code: problem.CodeValidation},
+		{name: "lookup malformed", method: "POST", target: apiRoute("/cars/lookup"), body: `{"vins":`, status: 400},
+
+		{name: "get", method: "GET", target: apiRoute("/cars/" + v0), status: 200,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if etag := rec.Header().Get("ETag"); etag != `"1"` {
+					t.Errorf("ETag = %q, want \"1\"", etag)
+				}
+			}},
+		{name: "get lowercase", method: "GET", target: apiRoute("/cars/" + strings.ToLower(v0)), status: 200},
+		{name: "get not modified", method: "GET", target: apiRoute("/cars/" + v0), header: map[string]string{"If-None-Match": `"1"`}, status: 304},
+		{name: "get fields", method: "GET", target: apiRoute("/cars/" + v0 + "?fields=vin,model"), status: 200},
+		{name: "get unknown field", method: "GET", target: apiRoute("/cars/" + v0 + "?fields=cost"), status: 400},
+		{name: "get bad currency", method: "GET", target: apiRoute("/cars/" + v0 + "?currency=pounds"), status: 400},
+		{name: "get not found", method: "GET", target: apiRoute("/cars/" + unknown.VIN), status: 404, code: problem.CodeNotFound},
+
+		{name: "add", method: "POST", target: apiRoute("/cars"), body: carJSON(t, fresh, nil), status: 201,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if loc := rec.Header().Get("Location"); loc != apiRoute("/cars/"+fresh.VIN) {
+					t.Errorf("Location = %q", loc)
+				}
+			}},
+		{name: "add duplicate VIN", method: "POST", target: apiRoute("/cars"), body: carJSON(t, cars[0], nil), status: 400, code: problem.CodeDuplicateVIN},
+		{name: "add duplicate VIN spaced", method: "POST", target: apiRoute("/cars"), status: 400, code: problem.CodeDuplicateVIN,
+			body: carJSON(t, cars[0], func(f map[string]interface{}) { f["vin"], f["regno"] = " "+strings.ToLower(v0)+" ", "OTHER1" })},
+		{name: "add duplicate registration", method: "POST", target: apiRoute("/cars"), status: 400, code: problem.CodeDuplicateRegNo,
+			body: carJSON(t, fresh, func(f map[string]interface{}) { f["regno"] = strings.ToLower(cars[1].RegNo) })},
+		{name: "add invalid VIN", method: "POST", target: apiRoute("/cars"), status: 422, code: problem.CodeValidation,
+			body: carJSON(t, fresh, func(f map[string]interface{}) { f["vin"] = "NOT-A-VIN" })},
+		{name: "add wrong type", method: "POST", target: apiRoute("/cars"), body: `{"model": 5}`, status: 422, code: problem.CodeValidation},
+		{name: "add malformed", method: "POST", target: apiRoute("/cars"), body: `{"model": "Focus"`, status: 400, code: problem.CodeBadRequest},
+		{name: "add array", method: "POST", target: apiRoute("/cars"), body: `[]`, status: 400},
+		{name: "add empty", method: "POST", target: apiRoute("/cars"), status: 400},
+		{name: "add dry run", method: "POST", target: apiRoute("/cars?validate_only=true"), body: carJSON(t, fresh, nil), status: 200},
+
+		{name: "replace", method: "PUT", target: apiRoute("/cars/" + v0), status: 200,
+			body: carJSON(t, cars[0], func(f map[string]interface{}) { f["model"] = "Replaced" }),
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				var car vehicle
+				json.Unmarshal(rec.Body.Bytes(), &car)
+				if car.Model != "Replaced" || car.Revision != 2 {
+					t.Errorf("replaced %s", rec.Body)
+				}
+			}},
+		{name: "replace at revision", method: "PUT", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"1"`}, status: 200,
+			body: carJSON(t, cars[0], nil)},
+		{name: "replace stale", method: "PUT", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"7"`}, status: 409,
+			code: problem.CodeRevisionConflict, body: carJSON(t, cars[0], nil)},
+		{name: "replace two tags", method: "PUT", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"1", "2"`}, status: 400,
+			body: carJSON(t, cars[0], nil)},
+		{name: "replace not found", method: "PUT", target: apiRoute("/cars/" + unknown.VIN), body: carJSON(t, unknown, nil), status: 404},
+		{name: "replace without model", method: "PUT", target: apiRoute("/cars/" + v0), status: 422, code: problem.CodeValidation,
+			body: carJSON(t, cars[0], func(f map[string]interface{}) { delete(f, "model") })},
+		{name: "replace taken registration", method: "PUT", target: apiRoute("/cars/" + v0), status: 400, code: problem.CodeDuplicateRegNo,
+			body: carJSON(t, cars[0], func(f map[string]interface{}) { f["regno"] = cars[1].RegNo })},
+		{name: "replace malformed", method: "PUT", target: apiRoute("/cars/" + v0), body: `{`, status: 400},
+
+		{name: "patch", method: "PATCH", target: apiRoute("/cars/" + v0), body: `{"colour":"Teal"}`, status: 200},
+		{name: "patch not found", method: "PATCH", target: apiRoute("/cars/" + unknown.VIN), body: `{"colour":"Teal"}`, status: 404},
+		{name: "patch stale", method: "PATCH", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"9"`}, body: `{"colour":"Teal"}`, status: 409},
+		{name: "patch remove required", method: "PATCH", target: apiRoute("/cars/" + v0), body: `{"model":null}`, status: 400, code: problem.CodeBadRequest},
+		{name: "patch wrong type", method: "PATCH", target: apiRoute("/cars/" + v0), body: `{"mileage":"far"}`, status: 422},
+		{name: "patch malformed", method: "PATCH", target: apiRoute("/cars/" + v0), body: `{"colour":`, status: 400},
+
+		{name: "delete", method: "DELETE", target: apiRoute("/cars/" + v0), status: 204},
+		{name: "delete at revision", method: "DELETE", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"1"`}, status: 204},
+		{name: "delete stale", method: "DELETE", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `"2"`}, status: 412,
+			code: problem.CodeRevisionConflict},
+		{name: "delete weak tag", method: "DELETE", target: apiRoute("/cars/" + v0), header: map[string]string{"If-Match": `W/"1"`}, status: 412},
+		{name: "delete not found", method: "DELETE", target: apiRoute("/cars/" + unknown.VIN), status: 404, code: problem.CodeNotFound},
+
+		{name: "unknown route", method: "GET", target: apiRoute("/lorries"), status: 404, code: problem.CodeNotFound},
+	}
+	runHandlerCases(t, stocked, cases)
+}
+
+func TestHandlersDeletedCar(t *testing.T) {
+	repo, cars := stockedRepository(t)
+	if _, err := repo.delete(context.Background(), cars[0].VIN, anyRevision); err != nil {
+		t.Fatal(err)
+	}
+	deleted := func(t *testing.T) vehicleRepository { return repo }
+	v0 := cars[0].VIN
+	runHandlerCases(t, deleted, []handlerCase{
+		{name: "get", method: "GET", target: apiRoute("/cars/" + v0), status: 404},
+		{name: "list", method: "GET", target: apiRoute("/cars"), status: 200, check: wantTotal(2)},
+		{name: "replace", method: "PUT", target: apiRoute("/cars/" + v0), body: carJSON(t, cars[0], nil), status: 404},
+		{name: "patch", method: "PATCH", target: apiRoute("/cars/" + v0), body: `{"colour":"Teal"}`, status: 404},
+		{name: "delete", method: "DELETE", target: apiRoute("/cars/" + v0), status: 404},
+	})
+}
+
+// failingVehicles is a vehicleRepository whose database is down.
+type failingVehicles struct{}
+
+var errDatabaseDown = errors.New("database down")
+
+func (failingVehicles) get(context.Context, string, bson.M) (vehicle, error) {
+	return vehicle{}, errDatabaseDown
+}
+
+func (failingVehicles) list(context.Context, ListParams) ([]vehicle, int64, string, error) {
+	return nil, 0, "", errDatabaseDown
+}
+
+func (failingVehicles) each(context.Context, ListParams, func(vehicle) error) error {
+	return errDatabaseDown
+}
+
+func (failingVehicles) facets(context.Context, bson.M) (*carFacets, error) {
+	return nil, errDatabaseDown
+}
+
+func (failingVehicles) count(context.Context, bson.M) (int64, error) {
+	return 0, errDatabaseDown
+}
+
+func (failingVehicles) create(context.Context, vehicle) error {
+	return errDatabaseDown
+}
+
+func (failingVehicles) replace(context.Context, *vehicle, int64) (vehicle, error) {
+	return vehicle{}, errDatabaseDown
+}
+
+func (failingVehicles) update(context.Context, string, int64, bson.M, bson.M) (vehicle, error) {
+	return vehicle{}, errDatabaseDown
+}
+
+func (failingVehicles) delete(context.Context, string, int64) (vehicle, error) {
+	return vehicle{}, errDatabaseDown
+}
+
+func TestHandlersDatabaseErrors(t *testing.T) {
+	car := seedCars(1, 1)[0]
+	down := func(t *testing.T) vehicleRepository { return failingVehicles{} }
+	var cases []handlerCase
+	for _, r := range []struct{ method, target, body string }{
+		{"GET", apiRoute("/cars"), ""},
+		{"GET", apiRoute("/cars/count"), ""},
+		{"GET", apiRoute("/cars/duplicates"), ""},
+		{"GET", apiRoute("/cars/compare?vins=" + car.VIN + ",1HGCM82633A004352"), ""},
+		{"GET", apiRoute("/cars/search?q=ford"), ""},
+		{"POST", apiRoute("/cars/lookup"), `{"vins":["` + car.VIN + `"]}`},
+		{"GET", apiRoute("/cars/" + car.VIN), ""},
+		{"POST", apiRoute("/cars"), carJSON(t, car, nil)},
+		{"PUT", apiRoute("/cars/" + car.VIN), carJSON(t, car, nil)},
+		{"PATCH", apiRoute("/cars/" + car.VIN), `{"colour":"Teal"}`},
+		{"DELETE", apiRoute("/cars/" + car.VIN), ""},
+	} {
+		cases = append(cases, handlerCase{
+			name: r.method + " " + r.target, method: r.method, target: r.target, body: r.body,
+			status: 500, code: problem.CodeDatabase,
+			check: func(t *testing.T, rec *httptest.ResponseRecorder) {
+				if strings.Contains(rec.Body.String(), errDatabaseDown.Error()) {
+					t.Errorf("the body gives the database error away: %s", rec.Body)
+				}
+			},
+		})
+	}
+	runHandlerCases(t, down, cases)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// readyTimeout bounds how long the readiness probe waits for MongoDB.
+const readyTimeout = 2 * time.Second
+
+// healthz reports that the process is up and serving requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	responseWithJSON(w, []byte(`{"status": "ok"}`), http.StatusOK)
+}
+
+// readyz reports whether the API can reach its database.
+func readyz(client *mongo.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		err := client.Ping(ctx, readpref.Primary())
+		if err != nil {
+			errorWithJSON(w, "Database unavailable", http.StatusServiceUnavailable)
+			slog.ErrorContext(r.Context(), "Failed ping database", "err", err)
+			return
+		}
+
+		responseWithJSON(w, []byte(`{"status": "ready"}`), http.StatusOK)
+	}
+}
+
+// Connecting at startup is retried with exponential backoff from
+// connectBackoff up to maxConnectBackoff between attempts.
+const (
+	connectBackoff    = 500 * time.Millisecond
+	maxConnectBackoff = 10 * time.Second
+)
+
+// waitForMongo pings MongoDB until it answers, for at most wait, so that the
+// API can start before the database has. Each attempt waits up to timeout.
+func waitForMongo(client *mongo.Client, timeout, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	delay := connectBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := client.Ping(ctx, readpref.Primary())
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		slog.Warn("Database unavailable; retrying", "attempt", attempt, "retry_in", delay, "err", err)
+		time.Sleep(delay)
+		delay = min(2*delay, maxConnectBackoff)
+	}
+}
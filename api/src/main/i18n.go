@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"problem"
+)
+
+// defaultLanguage is the language the API's messages are written in, which
+// is answered when a request asks for none that there is a bundle for.
+const defaultLanguage = "en"
+
+// The translation bundles, one for each language, named by its tag, e.g.
+// cy.json for Welsh.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var locales = mustLoadLocales()
+
+// locale is the translation bundle of a language. Messages are keyed by the
+// English they translate; a key may hold placeholders, {1}, {2} and so on,
+// that stand for the parts of a message made for the request, such as a
+// field name, and are put back where the translation has them. Labels are
+// the display values of enumerations, by field and value.
+type locale struct {
+	Language string                       `json:"-"`
+	Titles   map[string]string            `json:"titles"`
+	Messages map[string]string            `json:"messages"`
+	Labels   map[string]map[string]string `json:"labels"`
+
+	patterns []messagePattern
+}
+
+// messagePattern matches the messages a key with placeholders translates.
+type messagePattern struct {
+	re       *regexp.Regexp
+	template string
+}
+
+var placeholder = regexp.MustCompile(`\{[1-9]\}`)
+
+func mustLoadLocales() map[string]*locale {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	all := map[string]*locale{}
+	for _, f := range files {
+		b, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		l := &locale{Language: strings.TrimSuffix(f.Name(), ".json")}
+		if err := json.Unmarshal(b, l); err != nil {
+			panic(f.Name() + ": " + err.Error())
+		}
+		for key, translation := range l.Messages {
+			if !placeholder.MatchString(key) {
+				continue
+			}
+			var re strings.Builder
+			re.WriteString("^")
+			last := 0
+			for _, m := range placeholder.FindAllStringIndex(key, -1) {
+				re.WriteString(regexp.QuoteMeta(key[last:m[0]]))
+				re.WriteString("(?P<p" + key[m[0]+1:m[1]-1] + ">.+)")
+				last = m[1]
+			}
+			re.WriteString(regexp.QuoteMeta(key[last:]) + "$")
+			// Placeholders are named groups, for the translation to put
+			// back in any order.
+			template := placeholder.ReplaceAllStringFunc(translation, func(p string) string {
+				return "${p" + p[1:len(p)-1] + "}"
+			})
+			l.patterns = append(l.patterns, messagePattern{re: regexp.MustCompile(re.String()), template: template})
+		}
+		// The longest keys are the most specific, so they are tried first.
+		sort.Slice(l.patterns, func(i, j int) bool {
+			return len(l.patterns[i].re.String()) > len(l.patterns[j].re.String())
+		})
+		all[l.Language] = l
+	}
+	if all[defaultLanguage] == nil {
+		panic("no bundle for " + defaultLanguage)
+	}
+	return all
+}
+
+// negotiateLocale returns the bundle of the language an Accept-Language
+// header prefers of those there are, matching a tag such as cy-GB to cy.
+func negotiateLocale(header string) *locale {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if lang != "" && q > 0 {
+			tags = append(tags, tag{strings.ToLower(lang), q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if t.lang == "*" {
+			break
+		}
+		primary, _, _ := strings.Cut(t.lang, "-")
+		if l, ok := locales[primary]; ok {
+			return l
+		}
+	}
+	return locales[defaultLanguage]
+}
+
+// localeLanguages lists the languages there are bundles for.
+func localeLanguages() []string {
+	langs := make([]string, 0, len(locales))
+	for lang := range locales {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+type localeKey struct{}
+
+func withLocale(ctx context.Context, l *locale) context.Context {
+	return context.WithValue(ctx, localeKey{}, l)
+}
+
+// localeFrom returns the bundle of the language of the request, or of the
+// default language outside one.
+func localeFrom(ctx context.Context) *locale {
+	if l, ok := ctx.Value(localeKey{}).(*locale); ok {
+		return l
+	}
+	return locales[defaultLanguage]
+}
+
+// message translates an English message, or returns it as it is when the
+// bundle has no translation.
+func (l *locale) message(s string) string {
+	if t, ok := l.Messages[s]; ok {
+		return t
+	}
+	for _, p := range l.patterns {
+		if m := p.re.FindStringSubmatchIndex(s); m != nil {
+			return string(p.re.ExpandString(nil, p.template, s, m))
+		}
+	}
+	return s
+}
+
+// label returns the display value of an enumeration, in the bundle's
+// language or else in English, or the value itself when there is none.
+func (l *locale) label(field, value string) string {
+	if s, ok := l.Labels[field][value]; ok {
+		return s
+	}
+	if s, ok := locales[defaultLanguage].Labels[field][value]; ok {
+		return s
+	}
+	return value
+}
+
+// translate translates the title and details of p.
+func (l *locale) translate(p *problem.Details) {
+	if t, ok := l.Titles[p.Title]; ok {
+		p.Title = t
+	}
+	p.Detail = l.message(p.Detail)
+	for i := range p.Errors {
+		p.Errors[i].Detail = l.message(p.Errors[i].Detail)
+	}
+}
+
+// carLabels are the display values of a car's enumerations, in the language
+// of the request; they are not stored.
+type carLabels struct {
+	FuelType     string `json:"fuel_type,omitempty"`
+	Transmission string `json:"transmission,omitempty"`
+	Condition    string `json:"condition,omitempty"`
+}
+
+// labelCars sets the display values of the cars' enumerations in the
+// language of ctx.
+func labelCars(ctx context.Context, cars []vehicle) {
+	l := localeFrom(ctx)
+	for i := range cars {
+		c := &cars[i]
+		if c.FuelType == "" && c.Transmission == "" && c.Condition == "" {
+			continue
+		}
+		c.Labels = &carLabels{}
+		if c.FuelType != "" {
+			c.Labels.FuelType = l.label("fuel_type", c.FuelType)
+		}
+		if c.Transmission != "" {
+			c.Labels.Transmission = l.label("transmission", c.Transmission)
+		}
+		if c.Condition != "" {
+			c.Labels.Condition = l.label("condition", c.Condition)
+		}
+	}
+}
+
+// localize answers each request in the language its Accept-Language header
+// prefers: problem details have their title and messages translated, and
+// handlers find the language's bundle in the context, for the display values
+// of enumerations.
+func localize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := negotiateLocale(r.Header.Get("Accept-Language"))
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", l.Language)
+		r = r.WithContext(withLocale(r.Context(), l))
+		if l.Language == defaultLanguage {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		lw := &problemRewriter{ResponseWriter: w, rewrite: func(p *problem.Details) (string, []byte) {
+			l.translate(p)
+			body, err := json.Marshal(p)
+			if err != nil {
+				panic(err)
+			}
+			return problem.ContentType, body
+		}}
+		h.ServeHTTP(lw, r)
+		lw.flush()
+	})
+}
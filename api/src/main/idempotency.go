@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxIdempotencyKey is the longest Idempotency-Key accepted.
+	maxIdempotencyKey = 255
+
+	// maxIdempotentBody is the largest request body that is fingerprinted.
+	// It is room for a full batch.
+	maxIdempotentBody = 8 << 20
+
+	// pendingLease is how long a request may stay in flight before its key
+	// is taken to be abandoned, e.g. by an instance that crashed.
+	pendingLease = 5 * time.Minute
+)
+
+// replayedHeaders are the response headers kept with an idempotent result.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotentResult is the stored outcome of a request made with an
+// Idempotency-Key. It is pending while the first request is in flight.
+type idempotentResult struct {
+	Key         string            `bson:"key"`
+	Fingerprint string            `bson:"fingerprint"`
+	Pending     bool              `bson:"pending"`
+	Status      int               `bson:"status,omitempty"`
+	Header      map[string]string `bson:"header,omitempty"`
+	Body        []byte            `bson:"body,omitempty"`
+	CreatedAt   time.Time         `bson:"createdat"`
+}
+
+// idempotencyStore remembers the results of requests made with an
+// Idempotency-Key until they are ttl old, when Mongo deletes them.
+type idempotencyStore struct {
+	c   *mongo.Collection
+	ttl time.Duration
+}
+
+func (s *idempotencyStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "createdat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(s.ttl.Seconds())),
+		},
+	})
+	return err
+}
+
+// idempotent replays the stored response when a request is retried with the
+// same Idempotency-Key, instead of running h again. Keys are scoped to the
+// tenant, caller and route, so callers cannot see each other's results.
+// Reusing a key for a different body is rejected, as is retrying while the
+// first request is still in flight. Failures are not stored, so the request
+// can be retried.
+func idempotent(s *idempotencyStore, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			errorWithJSON(w, "The Idempotency-Key header is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		if err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			errorWithJSON(w, "The body is too large to be sent with an Idempotency-Key", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		caller := tenantFrom(r.Context()) + "/anonymous"
+		if p := principalFrom(r.Context()); p != nil {
+			caller = tenantFrom(r.Context()) + "/" + p.Method + ":" + p.Subject
+		}
+		sum := sha256.Sum256(body)
+		result := idempotentResult{
+			Key:         caller + " " + r.Method + " " + r.URL.Path + " " + key,
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Pending:     true,
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		_, err = s.c.InsertOne(r.Context(), result)
+		if mongo.IsDuplicateKeyError(err) {
+			replay(w, r, s, result)
+			return
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed store idempotency key", "err", err)
+			return
+		}
+
+		rec := &cachingWriter{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+
+		// The request is finished with whether or not the client is still
+		// waiting, so the result is stored without its context.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if rec.status >= http.StatusInternalServerError {
+			if _, err := s.c.DeleteOne(ctx, bson.M{"key": result.Key}); err != nil {
+				slog.ErrorContext(r.Context(), "Failed release idempotency key", "err", err)
+			}
+			return
+		}
+
+		header := make(map[string]string)
+		for _, name := range replayedHeaders {
+			if v := w.Header().Get(name); v != "" {
+				header[name] = v
+			}
+		}
+		update := bson.M{"$set": bson.M{"pending": false, "status": rec.status, "header": header, "body": rec.body.Bytes()}}
+		if _, err := s.c.UpdateOne(ctx, bson.M{"key": result.Key}, update); err != nil {
+			slog.ErrorContext(r.Context(), "Failed store idempotent result", "err", err)
+		}
+	}
+}
+
+// replay writes the stored result for the key of attempt.
+func replay(w http.ResponseWriter, r *http.Request, s *idempotencyStore, attempt idempotentResult) {
+	var stored idempotentResult
+	err := s.c.FindOne(r.Context(), bson.M{"key": attempt.Key}).Decode(&stored)
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find idempotent result", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			// The first attempt failed, or the result expired, between the
+			// insert and now.
+			errorWithJSON(w, "The request with this Idempotency-Key did not finish; retry it", http.StatusConflict)
+			return
+		}
+	}
+
+	if stored.Fingerprint != attempt.Fingerprint {
+		errorWithCode(w, problem.CodeIdempotencyKeyReused, "The Idempotency-Key was used for a different request",
+			http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.Pending {
+		if time.Since(stored.CreatedAt) > pendingLease {
+			_, err := s.c.DeleteOne(r.Context(), bson.M{"key": stored.Key, "pending": true, "createdat": stored.CreatedAt})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed release idempotency key", "err", err)
+			}
+		}
+		w.Header().Set("Retry-After", "1")
+		errorWithCode(w, problem.CodeInProgress, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	for name, v := range stored.Header {
+		w.Header().Set(name, v)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// maxImageSize is the largest photo that may be uploaded.
+const maxImageSize = 10 << 20
+
+// imageTypes are the content types photos may have, as sniffed from their
+// first bytes; the type the client claims is not trusted.
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// carImage describes a photo of a car. The photo itself is held in GridFS
+// under the same ID.
+type carImage struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"content_type" bson:"contenttype"`
+	Size        int64     `json:"size"`
+	UploadedAt  time.Time `json:"uploaded_at" bson:"uploadedat"`
+	// Variants are the renditions made of the photo.
+	Variants []imageVariant `json:"variants,omitempty" bson:",omitempty"`
+}
+
+// imageFile is the part of a GridFS file document the API reads.
+type imageFile struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Length   int64
+	Metadata struct {
+		VIN         string `bson:"vin"`
+		ContentType string `bson:"contenttype"`
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadImage stores the photo in the "file" part of a multipart upload and
+// its renditions, and adds it to the car's images.
+func uploadImage(c *mongo.Collection, photos photoStore, rends *renditions, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		n, err := c.CountDocuments(r.Context(), liveCar(r.Context(), vin))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			return
+		}
+		if n == 0 {
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		}
+
+		image, ok := storePhoto(w, r, photos, vin, bson.M{"vin": vin})
+		if !ok {
+			return
+		}
+		// A photo without renditions is still served, in full.
+		variants, err := rends.make(r.Context(), image, bson.M{"vin": vin, "tenant": tenantFrom(r.Context())})
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed make photo renditions", "id", image.ID, "err", err)
+		}
+		image.Variants = variants
+
+		var car vehicle
+		after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = events.transact(r.Context(), func(ctx context.Context) error {
+			err := c.FindOneAndUpdate(ctx, liveCar(ctx, vin), bson.M{"$push": bson.M{"images": image}, "$inc": incRevision}, after).Decode(&car)
+			if err != nil {
+				return err
+			}
+			events.publish(ctx, inventoryEvent{Type: eventUpdated, VIN: vin, Car: &car})
+			return nil
+		})
+		if err != nil {
+			// The photo belongs to no car, so it is not kept.
+			if id, err := primitive.ObjectIDFromHex(image.ID); err == nil {
+				photos.delete(context.WithoutCancel(r.Context()), id)
+				rends.remove(context.WithoutCancel(r.Context()), id)
+			}
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed add photo", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		entry := audit.entry(r.Context(), auditImageAdded, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "images", New: image}}
+		audit.record(r.Context(), entry)
+
+		respBody, err := json.MarshalIndent(image, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/cars/"+vin+"/images/"+image.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+// storePhoto stores the photo in the "file" part of a multipart upload under
+// name, with metadata, and describes it. It writes the error
+// response and returns false when the upload is not a photo that can be
+// stored.
+func storePhoto(w http.ResponseWriter, r *http.Request, photos photoStore, name string, metadata bson.M) (carImage, bool) {
+	// Leave room for the multipart headers around the photo.
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+64<<10)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		errorWithJSON(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return carImage{}, false
+	}
+
+	var part io.Reader
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			errorWithJSON(w, "No \"file\" part in the upload", http.StatusBadRequest)
+			return carImage{}, false
+		}
+		if p.FormName() == "file" {
+			part = p
+			break
+		}
+	}
+
+	buffered := bufio.NewReaderSize(part, 512)
+	head, _ := buffered.Peek(512)
+	contentType := http.DetectContentType(head)
+	if !imageTypes[contentType] {
+		errorWithJSON(w, "Photos must be JPEG, PNG or WebP images", http.StatusUnsupportedMediaType)
+		return carImage{}, false
+	}
+
+	body := &countingReader{r: io.LimitReader(buffered, maxImageSize+1)}
+	metadata["contenttype"] = contentType
+	metadata["tenant"] = tenantFrom(r.Context())
+	id, err := photos.upload(r.Context(), name, body, metadata)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorWithJSON(w, "The photo is too large", http.StatusRequestEntityTooLarge)
+			return carImage{}, false
+		}
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed store photo", "err", err)
+		return carImage{}, false
+	}
+	if body.n > maxImageSize {
+		photos.delete(context.WithoutCancel(r.Context()), id)
+		errorWithJSON(w, fmt.Sprintf("Photos may be at most %d MB", maxImageSize>>20), http.StatusRequestEntityTooLarge)
+		return carImage{}, false
+	}
+
+	return carImage{ID: id.Hex(), ContentType: contentType, Size: body.n, UploadedAt: time.Now().UTC()}, true
+}
+
+// imageByID serves a photo of a car, or the rendition of it the variant
+// parameter names. Photos with no rendition of that size, being no larger or
+// of a type that cannot be resized, are served as they are.
+func imageByID(photos photoStore, rends *renditions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := primitive.ObjectIDFromHex(pat.Param(r, "id"))
+		if err != nil {
+			errorWithJSON(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		vin := carVIN(r)
+
+		variant := r.URL.Query().Get("variant")
+		if variant != "" && variant != "original" {
+			if !rends.has(variant) {
+				fieldErrorWithJSON(w, "variant", "unknown", fmt.Sprintf("There is no %q rendition of photos", variant))
+				return
+			}
+			var file imageFile
+			err := photos.files().FindOne(r.Context(), bson.M{
+				"metadata.original": id, "metadata.variant": variant, "metadata.vin": vin, "metadata.tenant": tenantFrom(r.Context()),
+			}).Decode(&file)
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find photo", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+			case nil:
+				id = file.ID
+			}
+		}
+
+		sendPhoto(w, r, photos, bson.M{"_id": id, "metadata.vin": vin}, true)
+	}
+}
+
+// sendPhoto serves the tenant's photo the filter matches, or redirects to it
+// when the store links to photos. Public photos may be kept by shared caches.
+func sendPhoto(w http.ResponseWriter, r *http.Request, photos photoStore, filter bson.M, public bool) {
+	var file imageFile
+	filter["metadata.tenant"] = tenantFrom(r.Context())
+	err := photos.files().FindOne(r.Context(), filter).Decode(&file)
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find photo", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	link, err := photos.link(file)
+	if err != nil {
+		errorWithJSON(w, "Photo store error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed link photo", "err", err)
+		return
+	}
+	if link != "" {
+		// The link expires, so the redirect is not kept for long.
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	stream, err := photos.open(r.Context(), file.ID)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed open photo", "err", err)
+		return
+	}
+	defer stream.Close()
+
+	// A photo never changes once uploaded.
+	w.Header().Set("Content-Type", file.Metadata.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Length, 10))
+	if public {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	}
+	if _, err := io.Copy(w, stream); err != nil {
+		slog.ErrorContext(r.Context(), "Failed send photo", "err", err)
+	}
+}
+
+// deleteImage removes a photo and its renditions from a car and the store.
+func deleteImage(c *mongo.Collection, photos photoStore, rends *renditions, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+		id := pat.Param(r, "id")
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			errorWithJSON(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+
+		var car vehicle
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		filter := liveCar(r.Context(), vin)
+		filter["images.id"] = id
+		err = events.transact(r.Context(), func(ctx context.Context) error {
+			err := c.FindOneAndUpdate(ctx, filter,
+				bson.M{"$pull": bson.M{"images": bson.M{"id": id}}, "$inc": incRevision}, opts).Decode(&car)
+			if err != nil {
+				return err
+			}
+			events.publish(ctx, inventoryEvent{Type: eventUpdated, VIN: vin, Car: &car})
+			return nil
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed remove photo", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Photo not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		if err := photos.delete(r.Context(), oid); err != nil {
+			slog.ErrorContext(r.Context(), "Failed delete photo", "id", id, "err", err)
+		}
+		if err := rends.remove(r.Context(), oid); err != nil {
+			slog.ErrorContext(r.Context(), "Failed delete photo renditions", "id", id, "err", err)
+		}
+
+		entry := audit.entry(r.Context(), auditImageRemoved, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "images", Old: id}}
+		audit.record(r.Context(), entry)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
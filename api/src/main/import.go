@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// importBatchSize is how many rows of an import are inserted at a time.
+const importBatchSize = 500
+
+// csvColumns maps the CSV header names to the vehicle fields they fill. The
+// price is in the minor unit of the currency column.
+var csvColumns = map[string]func(*vehicle, string) error{
+	"manufacturer": textColumn(func(v *vehicle) *string { return &v.Manurfacturer }),
+	"model":        textColumn(func(v *vehicle) *string { return &v.Model }),
+	"vin":          textColumn(func(v *vehicle) *string { return &v.VIN }),
+	"regno":        textColumn(func(v *vehicle) *string { return &v.RegNo }),
+	"dealer":       textColumn(func(v *vehicle) *string { return &v.Dealer }),
+	"branch":       textColumn(func(v *vehicle) *string { return &v.Branch }),
+	"fuel_type":    textColumn(func(v *vehicle) *string { return &v.FuelType }),
+	"transmission": textColumn(func(v *vehicle) *string { return &v.Transmission }),
+	"colour":       textColumn(func(v *vehicle) *string { return &v.Colour }),
+	"condition":    textColumn(func(v *vehicle) *string { return &v.Condition }),
+	"mileage":      intColumn(func(v *vehicle) *int { return &v.Mileage }),
+	"year":         intColumn(func(v *vehicle) *int { return &v.Year }),
+	"price": func(v *vehicle, s string) error {
+		if s == "" {
+			return nil
+		}
+		amount, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("The price must be an integer")
+		}
+		if v.Price == nil {
+			v.Price = &price{}
+		}
+		v.Price.Amount = amount
+		return nil
+	},
+	"currency": func(v *vehicle, s string) error {
+		if s == "" {
+			return nil
+		}
+		if v.Price == nil {
+			v.Price = &price{}
+		}
+		v.Price.Currency = s
+		return nil
+	},
+}
+
+func textColumn(field func(*vehicle) *string) func(*vehicle, string) error {
+	return func(v *vehicle, s string) error {
+		*field(v) = s
+		return nil
+	}
+}
+
+func intColumn(field func(*vehicle) *int) func(*vehicle, string) error {
+	return func(v *vehicle, s string) error {
+		if s == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("Expected an integer")
+		}
+		*field(v) = n
+		return nil
+	}
+}
+
+// rejectedRow is a CSV row that was not imported. Line counts the header as
+// line 1.
+type rejectedRow struct {
+	Line    int    `json:"line"`
+	VIN     string `json:"vin,omitempty"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// importReport is what became of an import. Validated only, the rows that
+// would have been imported are counted as Valid rather than Imported.
+type importReport struct {
+	ValidateOnly bool          `json:"validate_only,omitempty"`
+	Imported     int           `json:"imported"`
+	Valid        int           `json:"valid,omitempty"`
+	Rejected     []rejectedRow `json:"rejected"`
+}
+
+// importCars adds the cars in a CSV file uploaded as the "file" part of a
+// multipart form. The first row names the columns. Rows are read as they
+// arrive and inserted in batches, so large feeds are not held in memory.
+// With ?validate_only=true the file is checked as it would be imported,
+// duplicates included, and reported on without adding any car, for feed
+// providers to check their files first.
+func importCars(c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, ok := validateOnly(w, r)
+		if !ok {
+			return
+		}
+		var check *batchCheck
+		if dryRun {
+			check = newBatchCheck()
+		}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			errorWithJSON(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+			return
+		}
+
+		var file io.Reader
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				errorWithJSON(w, "No \"file\" part in the upload", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "file" {
+				file = part
+				break
+			}
+		}
+
+		rows := csv.NewReader(file)
+		rows.TrimLeadingSpace = true
+		rows.ReuseRecord = true
+
+		header, err := rows.Read()
+		if err != nil {
+			errorWithJSON(w, "The CSV file has no header row", http.StatusBadRequest)
+			return
+		}
+		setters := make([]func(*vehicle, string) error, len(header))
+		for i, name := range header {
+			set, ok := csvColumns[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				errorWithJSON(w, fmt.Sprintf("Unknown column %q", name), http.StatusBadRequest)
+				return
+			}
+			setters[i] = set
+		}
+
+		report := importReport{ValidateOnly: dryRun, Rejected: []rejectedRow{}}
+		var cars []vehicle
+		var lines []int
+
+		flush := func() {
+			batch := insertCars(r.Context(), c, events, audit, cars, check)
+			report.Imported += batch.Created
+			report.Valid += batch.Valid
+			for _, res := range batch.Results {
+				if res.Status == batchCreated || res.Status == batchValid {
+					continue
+				}
+				report.Rejected = append(report.Rejected, rejectedRow{
+					Line:    lines[res.Index],
+					VIN:     res.VIN,
+					Reason:  res.Status,
+					Message: res.Message,
+				})
+			}
+			// Events hold pointers into cars, so it is not reused.
+			cars, lines = nil, nil
+		}
+
+		for {
+			record, err := rows.Read()
+			if err == io.EOF {
+				break
+			}
+			line, _ := rows.FieldPos(0)
+
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+				report.Rejected = append(report.Rejected, rejectedRow{
+					Line:    line,
+					Reason:  "malformed",
+					Message: fmt.Sprintf("Expected %d fields", len(header)),
+				})
+				continue
+			}
+			if err != nil {
+				// The rest of the file cannot be read, but what was read
+				// is still imported and reported.
+				report.Rejected = append(report.Rejected, rejectedRow{
+					Line:    line,
+					Reason:  "malformed",
+					Message: err.Error(),
+				})
+				break
+			}
+
+			var car vehicle
+			var setErr error
+			for i, value := range record {
+				if setErr = setters[i](&car, strings.TrimSpace(value)); setErr != nil {
+					setErr = fmt.Errorf("%s: %v", header[i], setErr)
+					break
+				}
+			}
+			if setErr != nil {
+				report.Rejected = append(report.Rejected, rejectedRow{
+					Line:    line,
+					VIN:     car.VIN,
+					Reason:  batchInvalid,
+					Message: setErr.Error(),
+				})
+				continue
+			}
+			cars = append(cars, car)
+			lines = append(lines, line)
+
+			if len(cars) == importBatchSize {
+				flush()
+			}
+		}
+		if len(cars) > 0 {
+			flush()
+		}
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inFlightRetryAfter is the Retry-After of requests refused for too many in
+// flight; they are shed in bursts, which pass quickly.
+const inFlightRetryAfter = time.Second
+
+// uncappedRoutes are not counted against the instance's cap: streams and
+// WebSockets are held open for as long as the client wants, and health
+// checks and metrics have to answer under load. Their routes can still be
+// capped on their own.
+var uncappedRoutes = []string{"/cars/events", "/cars/stream", "/cars/ws"}
+
+var inFlightRefusals = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carsupermarket_in_flight_refusals_total",
+	Help: "Requests refused with 503 for too many in flight, by route and by the cap reached.",
+}, []string{"route", "cap"})
+
+func init() {
+	prometheus.MustRegister(inFlightRefusals)
+}
+
+// inFlightLimiter caps the requests an instance serves at once, in all and to
+// each route pattern, so that a burst of expensive listings and searches
+// cannot swamp the database. A slot is a place in a buffered channel.
+type inFlightLimiter struct {
+	all    chan struct{}
+	routes map[string]chan struct{}
+}
+
+// newInFlightLimiter returns the limiter of max requests, zero being any
+// number, and of routes, caps by pattern under the API version; nil if
+// there are no caps.
+func newInFlightLimiter(max int, routes map[string]int) *inFlightLimiter {
+	if max == 0 && len(routes) == 0 {
+		return nil
+	}
+	l := &inFlightLimiter{routes: map[string]chan struct{}{}}
+	if max > 0 {
+		l.all = make(chan struct{}, max)
+	}
+	for p, n := range routes {
+		l.routes[apiRoute(p)] = make(chan struct{}, n)
+	}
+	return l
+}
+
+// takeSlot takes a slot from slots, if there is one free, and reports
+// whether it did. Nil slots are unlimited.
+func takeSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func giveSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// limitInFlight refuses requests with 503 while the caps of l are reached,
+// the route's being checked first. A nil l refuses none.
+func limitInFlight(l *inFlightLimiter) func(http.Handler) http.Handler {
+	uncapped := map[string]bool{route("/healthz"): true, route("/readyz"): true, route("/metrics"): true}
+	for _, p := range uncappedRoutes {
+		uncapped[apiRoute(p)] = true
+	}
+	return func(h http.Handler) http.Handler {
+		if l == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern := routePattern(r)
+			slots := l.routes[pattern]
+			if !takeSlot(slots) {
+				refuseInFlight(w, pattern, "route")
+				return
+			}
+			defer giveSlot(slots)
+
+			all := l.all
+			if uncapped[r.URL.Path] {
+				all = nil
+			}
+			if !takeSlot(all) {
+				refuseInFlight(w, pattern, "instance")
+				return
+			}
+			defer giveSlot(all)
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func refuseInFlight(w http.ResponseWriter, pattern, limit string) {
+	inFlightRefusals.WithLabelValues(pattern, limit).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(inFlightRetryAfter.Seconds())))
+	errorWithJSON(w, "Too many requests in progress; try again shortly", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,340 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"problem"
+
+	"github.com/gorilla/websocket"
+)
+
+// The tests of this file run against a whole API server, TEST_API_URL, and
+// the MongoDB it keeps everything in, the one storage the whole API is
+// served from; docker compose --profile test run --rm test starts both, as
+// docker-compose.yml describes. Each test writes cars to a tenant of its own,
+// so that tests and runs do not see each other's cars.
+
+// apiClient makes requests as one tenant of the API under test.
+type apiClient struct {
+	t      *testing.T
+	url    string
+	tenant string
+}
+
+// testAPI returns a client of the API at TEST_API_URL, once it is ready, for
+// a tenant of the test's own. Tests needing one are skipped without it.
+func testAPI(t *testing.T) *apiClient {
+	t.Helper()
+	base := os.Getenv("TEST_API_URL")
+	if base == "" {
+		t.Skip("TEST_API_URL is not set")
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		resp, err := http.Get(base + route("/readyz"))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not ready: %v", base, err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	return &apiClient{t: t, url: base, tenant: newTestTenant()}
+}
+
+var testTenants atomic.Int64
+
+// newTestTenant returns a tenant ID no other test or run has used.
+func newTestTenant() string {
+	return "it-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(testTenants.Add(1), 10)
+}
+
+// elsewhere returns a client of the same API for another tenant.
+func (c *apiClient) elsewhere() *apiClient {
+	return &apiClient{t: c.t, url: c.url, tenant: newTestTenant()}
+}
+
+// do makes a request of the API, sending body as JSON unless it is nil, and
+// returns the response with its body read.
+func (c *apiClient) do(method, path string, body interface{}, header map[string]string) (*http.Response, []byte) {
+	c.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.url+apiRoute(path), r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tenantHeader, c.tenant)
+	for name, v := range header {
+		req.Header.Set(name, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp, b
+}
+
+// add adds the cars, failing the test unless each is created.
+func (c *apiClient) add(cars ...vehicle) {
+	c.t.Helper()
+	for _, car := range cars {
+		if resp, b := c.do(http.MethodPost, "/cars", car, nil); resp.StatusCode != http.StatusCreated {
+			c.t.Fatalf("add %s: status %d: %s", car.VIN, resp.StatusCode, b)
+		}
+	}
+}
+
+func problemCode(b []byte) string {
+	var details problem.Details
+	json.Unmarshal(b, &details)
+	return details.Code
+}
+
+func TestIntegrationUniqueIndexes(t *testing.T) {
+	api := testAPI(t)
+	cars := seedCars(time.Now().UnixNano(), 2)
+	api.add(cars[0])
+
+	resp, b := api.do(http.MethodPost, "/cars", cars[0], nil)
+	if resp.StatusCode != http.StatusBadRequest || problemCode(b) != problem.CodeDuplicateVIN {
+		t.Errorf("add a taken VIN: status %d: %s", resp.StatusCode, b)
+	}
+	other := cars[1]
+	other.RegNo = strings.ToLower(cars[0].RegNo)
+	resp, b = api.do(http.MethodPost, "/cars", other, nil)
+	if resp.StatusCode != http.StatusBadRequest || problemCode(b) != problem.CodeDuplicateRegNo {
+		t.Errorf("add a taken registration: status %d: %s", resp.StatusCode, b)
+	}
+
+	// Racing adds of one car are told apart by the index, not by a read
+	// before the write.
+	racer := seedCars(time.Now().UnixNano()+1, 1)[0]
+	const racers = 10
+	statuses := make([]int, racers)
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := api.do(http.MethodPost, "/cars", racer, nil)
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("racing add: status %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d of %d racing adds of one VIN created it, want 1", created, racers)
+	}
+
+	// Another tenant may have the same VIN and registration.
+	api.elsewhere().add(cars[0])
+}
+
+func TestIntegrationPagination(t *testing.T) {
+	api := testAPI(t)
+	const stocked, limit = 23, 5
+	cars := seedCars(time.Now().UnixNano(), stocked)
+	api.add(cars...)
+	var want []string
+	for _, car := range cars {
+		want = append(want, car.VIN)
+	}
+	sort.Strings(want)
+
+	var byCursor []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > stocked {
+			t.Fatal("the cursor never ends")
+		}
+		resp, b := api.do(http.MethodGet, "/cars?limit="+strconv.Itoa(limit)+"&cursor="+url.QueryEscape(cursor), nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: status %d: %s", pages+1, resp.StatusCode, b)
+		}
+		var page struct {
+			Cars       []vehicle `json:"cars"`
+			Total      int64     `json:"total"`
+			NextCursor string    `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(b, &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != stocked {
+			t.Errorf("page %d: total %d, want %d", pages+1, page.Total, stocked)
+		}
+		for _, car := range page.Cars {
+			byCursor = append(byCursor, car.VIN)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if strings.Join(byCursor, ",") != strings.Join(want, ",") {
+		t.Errorf("by cursor:\n\t%v\nwant\n\t%v", byCursor, want)
+	}
+
+	var byPage []string
+	for n := 1; n <= (stocked+limit-1)/limit; n++ {
+		resp, b := api.do(http.MethodGet, fmt.Sprintf("/cars?limit=%d&page=%d&sort=vin", limit, n), nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: status %d: %s", n, resp.StatusCode, b)
+		}
+		var page struct {
+			Cars []vehicle `json:"cars"`
+		}
+		json.Unmarshal(b, &page)
+		for _, car := range page.Cars {
+			byPage = append(byPage, car.VIN)
+		}
+	}
+	if strings.Join(byPage, ",") != strings.Join(want, ",") {
+		t.Errorf("by page:\n\t%v\nwant\n\t%v", byPage, want)
+	}
+}
+
+func TestIntegrationConcurrentWrites(t *testing.T) {
+	api := testAPI(t)
+	car := seedCars(time.Now().UnixNano(), 1)[0]
+	api.add(car)
+
+	// Writers holding the same revision: one wins, the others conflict.
+	const writers = 8
+	statuses := make([]int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := api.do(http.MethodPatch, "/cars/"+car.VIN, map[string]interface{}{"mileage": 1000 + i},
+				map[string]string{"If-Match": `"1"`})
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	won := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("conditional write: status %d", status)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d of %d writes at revision 1 succeeded, want 1", won, writers)
+	}
+
+	// Writers without a precondition all succeed, none lost.
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if resp, b := api.do(http.MethodPatch, "/cars/"+car.VIN, map[string]interface{}{"mileage": 2000 + i}, nil); resp.StatusCode != http.StatusOK {
+				t.Errorf("unconditional write: status %d: %s", resp.StatusCode, b)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, b := api.do(http.MethodGet, "/cars/"+car.VIN, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get: status %d: %s", resp.StatusCode, b)
+	}
+	var got vehicle
+	json.Unmarshal(b, &got)
+	if want := int64(1 + 1 + writers); got.Revision != want {
+		t.Errorf("revision %d after %d writes, want %d", got.Revision, 1+writers, want)
+	}
+	if got.Mileage < 2000 {
+		t.Errorf("mileage %d is not of the last writes", got.Mileage)
+	}
+}
+
+func TestIntegrationChangeStream(t *testing.T) {
+	api := testAPI(t)
+	u := "ws" + strings.TrimPrefix(api.url, "http") + apiRoute("/cars/stream")
+	conn, resp, err := websocket.DefaultDialer.Dial(u, http.Header{tenantHeader: {api.tenant}})
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", u, err, status)
+	}
+	defer conn.Close()
+	// The stream is opened before the upgrade, so changes made from here are
+	// in it.
+
+	car := seedCars(time.Now().UnixNano(), 1)[0]
+	api.add(car)
+	if resp, b := api.do(http.MethodPatch, "/cars/"+car.VIN, map[string]interface{}{"colour": "Teal"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch: status %d: %s", resp.StatusCode, b)
+	}
+	if resp, b := api.do(http.MethodDelete, "/cars/"+car.VIN, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", resp.StatusCode, b)
+	}
+	api.elsewhere().add(seedCars(time.Now().UnixNano()+1, 1)[0])
+
+	var got []string
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for len(got) < 3 {
+		var e inventoryEvent
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatalf("read after %v: %v", got, err)
+		}
+		if e.VIN != car.VIN {
+			t.Errorf("event of another tenant's car %s: %+v", e.VIN, e)
+			continue
+		}
+		got = append(got, e.Type)
+	}
+	if want := []string{eventCreated, eventUpdated, eventDeleted}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
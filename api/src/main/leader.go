@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "carsupermarket_scheduler_leader",
+	Help: "Whether this instance holds the scheduler lease and runs the jobs that run once across the deployment.",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// schedulerLease names the lease the instance running the scheduled jobs
+// holds.
+const schedulerLease = "scheduler"
+
+// lease elects one instance of the deployment to lead, through a document in
+// the leases collection. The leader renews the lease every third of its ttl;
+// an instance that cannot stops leading at once, and another takes the lease
+// over once it has expired. Expiry is reckoned by the database's clock, so
+// the instances' clocks need not agree.
+type lease struct {
+	c      *mongo.Collection
+	name   string
+	holder string
+	ttl    time.Duration
+
+	held atomic.Bool
+}
+
+// newLease returns the lease name, held as this instance: its host name and
+// a random suffix, so that instances on one host are told apart.
+func newLease(c *mongo.Collection, name string, ttl time.Duration) *lease {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		panic(err)
+	}
+	return &lease{c: c, name: name, holder: host + "-" + suffix, ttl: ttl}
+}
+
+func (l *lease) ensureIndex(ctx context.Context) error {
+	_, err := l.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// leading reports whether this instance holds the lease. A nil lease is
+// always held, as there is no one else to lead.
+func (l *lease) leading() bool {
+	return l == nil || l.held.Load()
+}
+
+// acquire takes the lease, or renews it, unless another instance holds it
+// and it has not expired. It reports whether this instance now holds it.
+func (l *lease) acquire(ctx context.Context) (bool, error) {
+	filter := bson.M{"name": l.name, "$or": bson.A{
+		bson.M{"holder": l.holder},
+		bson.M{"$expr": bson.M{"$lt": bson.A{"$expiresat", "$$NOW"}}},
+	}}
+	update := bson.A{bson.M{"$set": bson.M{
+		"holder":    l.holder,
+		"renewedat": "$$NOW",
+		"expiresat": bson.M{"$add": bson.A{"$$NOW", l.ttl.Milliseconds()}},
+	}}}
+	_, err := l.c.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// Another instance holds the lease, so the upsert found nothing
+		// to update and could not insert another.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release gives the lease up, for another instance to take over without
+// waiting for it to expire.
+func (l *lease) release(ctx context.Context) {
+	if _, err := l.c.DeleteOne(ctx, bson.M{"name": l.name, "holder": l.holder}); err != nil {
+		slog.Error("Failed release lease", "lease", l.name, "err", err)
+	}
+}
+
+// campaign holds or tries for the lease until stop is closed, then gives it
+// up if held and closes done.
+func (l *lease) campaign(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		held, err := l.acquire(ctx)
+		cancel()
+		if err != nil {
+			slog.Error("Failed renew lease", "lease", l.name, "err", err)
+		}
+		if l.held.Swap(held) != held {
+			if held {
+				leaderGauge.Set(1)
+				slog.Info("Took the lease; leading", "lease", l.name, "holder", l.holder)
+			} else {
+				leaderGauge.Set(0)
+				slog.Warn("Lost the lease; no longer leading", "lease", l.name, "holder", l.holder)
+			}
+		}
+
+		select {
+		case <-stop:
+			if l.held.Swap(false) {
+				leaderGauge.Set(0)
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				l.release(ctx)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
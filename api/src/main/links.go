@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// link is where a client can go from a resource. With ?links=true responses
+// carry their links under "_links", so clients need not build URLs
+// themselves.
+type link struct {
+	Href string `json:"href"`
+}
+
+type carLinks struct {
+	Self           link   `json:"self"`
+	Collection     link   `json:"collection"`
+	Images         []link `json:"images,omitempty"`
+	History        link   `json:"history"`
+	ServiceHistory link   `json:"service_history"`
+}
+
+type pageLinks struct {
+	Self link  `json:"self"`
+	Next *link `json:"next,omitempty"`
+}
+
+// wantLinks reports whether the client asked for links with ?links=true.
+func wantLinks(r *http.Request) bool {
+	links, _ := strconv.ParseBool(r.URL.Query().Get("links"))
+	return links
+}
+
+func linksOf(car vehicle) carLinks {
+	self := apiRoute("/cars/" + url.PathEscape(car.VIN))
+	links := carLinks{
+		Self:           link{self},
+		Collection:     link{apiRoute("/cars")},
+		History:        link{self + "/history"},
+		ServiceHistory: link{self + "/service-history"},
+	}
+	for _, image := range car.Images {
+		links.Images = append(links.Images, link{self + "/images/" + image.ID})
+	}
+	return links
+}
+
+// nextPage returns the link to the page after the one listed, or nil on the
+// last page.
+func nextPage(r *http.Request, params ListParams, listed int, total int64, cursor string) *link {
+	query := r.URL.Query()
+	switch {
+	case params.UseCursor:
+		if cursor == "" {
+			return nil
+		}
+		query.Set("cursor", cursor)
+	case int64(params.Offset+listed) >= total:
+		return nil
+	default:
+		query.Del("page")
+		query.Set("offset", strconv.Itoa(params.Offset+params.Limit))
+	}
+	return &link{r.URL.Path + "?" + query.Encode()}
+}
+
+// withLinks renders v, a car or a selection of its fields, as a JSON object
+// with the links of car added.
+func withLinks(v interface{}, car vehicle) (map[string]interface{}, error) {
+	all, ok := v.(map[string]interface{})
+	if !ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+	}
+	all["_links"] = linksOf(car)
+	return all, nil
+}
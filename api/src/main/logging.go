@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// requestIDHeader carries the ID of a request, both ways: a client or proxy
+// may send one to have it used, and it is echoed in every response.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the longest request ID accepted from a client.
+const maxRequestIDLen = 128
+
+// requestID returns the ID assigned to the request by logRequests.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// incomingRequestID returns the request ID sent with r if it is one that can
+// go safely into logs and headers, or a new one.
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		return newRequestID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// forwardRequestID passes the ID of the request being served on to another
+// service called while serving it.
+func forwardRequestID(req *http.Request) {
+	if id := requestID(req.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// newLogger returns a JSON logger writing to output, which is "stdout",
+// "stderr" or the path of a file to append to, and what changes its level
+// while it runs. Debug records are sampled as samplingHandler describes,
+// keeping one in every debugSampling after the first of each second.
+func newLogger(level slog.Level, output string, debugSampling int) (*slog.Logger, *logLevel, error) {
+	var w io.Writer
+	switch output {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = f
+	}
+
+	lv := &logLevel{configured: level}
+	lv.level.Set(level)
+	var h slog.Handler = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: &lv.level})
+	h = &samplingHandler{Handler: h, every: debugSampling, counts: &sampleCounts{byMessage: map[string]int{}}}
+	return slog.New(requestIDHandler{h}), lv, nil
+}
+
+// logLevel is the lowest level logged, which an admin may lower to turn on
+// diagnostics without a redeploy, until a time after which the configured
+// level is restored. It is held per instance.
+type logLevel struct {
+	level      slog.LevelVar
+	configured slog.Level
+
+	mu     sync.Mutex
+	until  *time.Time
+	revert *time.Timer
+}
+
+type logLevelState struct {
+	Level      string     `json:"level"`
+	Configured string     `json:"configured"`
+	Until      *time.Time `json:"until,omitempty"`
+}
+
+func (l *logLevel) get() logLevelState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return logLevelState{Level: l.level.Level().String(), Configured: l.configured.String(), Until: l.until}
+}
+
+// set logs at level, for d or, when d is 0, until set again.
+func (l *logLevel) set(level slog.Level, d time.Duration) logLevelState {
+	l.mu.Lock()
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert, l.until = nil, nil
+	}
+	l.level.Set(level)
+	if d > 0 {
+		until := time.Now().UTC().Add(d)
+		l.until = &until
+		l.revert = time.AfterFunc(d, func() {
+			l.mu.Lock()
+			l.level.Set(l.configured)
+			l.revert, l.until = nil, nil
+			l.mu.Unlock()
+			slog.Info("Log level restored", "level", l.configured.String())
+		})
+	}
+	l.mu.Unlock()
+	return l.get()
+}
+
+// reconfigure makes level the configured one, logging at it now unless an
+// admin's change for a while is in force.
+func (l *logLevel) reconfigure(level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.configured = level
+	if l.revert == nil {
+		l.level.Set(level)
+	}
+}
+
+// logSampleFirst is how many debug records of a message are logged each
+// second before they are sampled.
+const logSampleFirst = 10
+
+// samplingHandler keeps high-volume debug logging from flooding the logs:
+// of the debug records with the same message, the first logSampleFirst each
+// second are logged, then one in every, or none when every is 0. Records of
+// other levels are all logged.
+type samplingHandler struct {
+	slog.Handler
+	every  int
+	counts *sampleCounts
+}
+
+type sampleCounts struct {
+	mu        sync.Mutex
+	second    int64
+	byMessage map[string]int
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level == slog.LevelDebug && h.every != 1 && !h.counts.keep(rec.Message, rec.Time.Unix(), h.every) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+// keep counts a record of message in second, reporting whether it is logged.
+func (c *sampleCounts) keep(message string, second int64, every int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if second != c.second {
+		c.second = second
+		clear(c.byMessage)
+	}
+	c.byMessage[message]++
+	n := c.byMessage[message] - logSampleFirst
+	return n <= 0 || every > 0 && n%every == 0
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{h.Handler.WithAttrs(attrs), h.every, h.counts}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{h.Handler.WithGroup(name), h.every, h.counts}
+}
+
+// logLevelStatus reports the level logged at, and until when if it was
+// changed for a while.
+func logLevelStatus(l *logLevel) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respBody, err := json.MarshalIndent(l.get(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// setLogLevel changes the level logged at by this instance, for "for" if
+// given, e.g. {"level": "debug", "for": "15m"}.
+func setLogLevel(l *logLevel) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Level string `json:"level"`
+			For   string `json:"for"`
+		}
+		if !decodeStrict(w, r.Body, &req) {
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			fieldErrorWithJSON(w, "level", "invalid", "The level must be debug, info, warn or error")
+			return
+		}
+		var d time.Duration
+		if req.For != "" {
+			var err error
+			if d, err = time.ParseDuration(req.For); err != nil || d <= 0 {
+				fieldErrorWithJSON(w, "for", "invalid", "The duration must be positive, e.g. 15m")
+				return
+			}
+		}
+
+		state := l.set(level, d)
+		slog.WarnContext(r.Context(), "Log level changed", "level", state.Level, "until", state.Until)
+
+		respBody, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// requestIDHandler adds the ID of the request being served to the records
+// logged with its context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logRequests writes one log line per request once it has been served. It
+// gives the request its ID, which every line logged with the request's
+// context carries.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := incomingRequestID(r)
+		w.Header().Set(requestIDHeader, id)
+		rec := newStatusRecorder(w)
+
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		h.ServeHTTP(rec, r)
+
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		slog.LogAttrs(r.Context(), level, "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("remote_ip", remote),
+		)
+	})
+}
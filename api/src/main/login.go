@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionIssuerName is the issuer of the access tokens POST /login issues,
+// which tells them apart from those verified with the JWKS.
+const sessionIssuerName = "carsupermarket"
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// sessionClaims are the claims of the access tokens issued to users.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	Tenant string `json:"tenant"`
+	Role   string `json:"role"`
+}
+
+// refreshToken is kept for each refresh token issued. Like an API key it is
+// presented as "<id>.<secret>" and only a hash of the secret is stored. Each
+// is used once, for new tokens, and a token used twice ends all the user's
+// sessions, as one of the two uses was by someone who stole it.
+type refreshToken struct {
+	ID         string     `bson:"tokenid"`
+	SecretHash string     `bson:"secrethash"`
+	Username   string     `bson:"username"`
+	CreatedAt  time.Time  `bson:"createdat"`
+	ExpiresAt  time.Time  `bson:"expiresat"`
+	RevokedAt  *time.Time `bson:"revokedat,omitempty"`
+}
+
+// sessionIssuer issues users short-lived access tokens, signed with secret,
+// and refresh tokens to get more with.
+type sessionIssuer struct {
+	secret     []byte
+	ttl        time.Duration
+	refreshTTL time.Duration
+	refresh    *mongo.Collection
+	parser     *jwt.Parser
+}
+
+func newSessionIssuer(secret []byte, ttl, refreshTTL time.Duration, refresh *mongo.Collection) *sessionIssuer {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"HS256"}), jwt.WithIssuer(sessionIssuerName), jwt.WithExpirationRequired())
+	return &sessionIssuer{secret: secret, ttl: ttl, refreshTTL: refreshTTL, refresh: refresh, parser: parser}
+}
+
+func (s *sessionIssuer) ensureIndex(ctx context.Context) error {
+	_, err := s.refresh.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tokenid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// issued reports whether raw claims to be an access token issued here, so
+// that it is verified here rather than with the JWKS.
+func (s *sessionIssuer) issued(raw string) bool {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, &claims); err != nil {
+		return false
+	}
+	return claims.Issuer == sessionIssuerName
+}
+
+func (s *sessionIssuer) verify(raw string) (*principal, error) {
+	var claims sessionClaims
+	_, err := s.parser.ParseWithClaims(raw, &claims, func(*jwt.Token) (interface{}, error) {
+		return s.secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &principal{Subject: claims.Subject, Issuer: claims.Issuer, Method: "session", Role: claims.Role, Tenant: claims.Tenant}, nil
+}
+
+// sessionTokens is the response of a login or a refresh.
+type sessionTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// accessToken returns a new access token for the subject.
+func (s *sessionIssuer) accessToken(subject, tenant, role string) (string, error) {
+	now := time.Now().UTC()
+	claims := sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessionIssuerName,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+		Tenant: tenant,
+		Role:   role,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+}
+
+// issue returns a new access token and refresh token for u.
+func (s *sessionIssuer) issue(ctx context.Context, u *user) (sessionTokens, error) {
+	now := time.Now().UTC()
+	access, err := s.accessToken(u.subject(), u.Tenant, u.Role)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	_, err = s.refresh.InsertOne(ctx, refreshToken{
+		ID:         id,
+		SecretHash: hashSecret(secret),
+		Username:   u.Username,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(s.refreshTTL),
+	})
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	return sessionTokens{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(s.ttl.Seconds()), RefreshToken: id + "." + secret}, nil
+}
+
+// use revokes the unexpired refresh token presented, returning the username
+// it was issued to.
+func (s *sessionIssuer) use(ctx context.Context, presented string) (string, error) {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok {
+		return "", errInvalidLogin
+	}
+
+	var t refreshToken
+	err := s.refresh.FindOneAndUpdate(ctx,
+		bson.M{"tokenid": id, "secrethash": hashSecret(secret), "revokedat": bson.M{"$exists": false}, "expiresat": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"revokedat": time.Now().UTC()}}).Decode(&t)
+	if err == nil {
+		return t.Username, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return "", err
+	}
+
+	// A token that is valid but used already was replayed.
+	err = s.refresh.FindOne(ctx, bson.M{"tokenid": id, "secrethash": hashSecret(secret)}).Decode(&t)
+	if err == nil && t.RevokedAt != nil && t.ExpiresAt.After(time.Now()) {
+		slog.WarnContext(ctx, "Refresh token reused; ending the user's sessions", "username", t.Username)
+		if err := s.revokeAll(ctx, t.Username); err != nil {
+			return "", err
+		}
+	}
+	return "", errInvalidLogin
+}
+
+// revokeAll revokes the refresh tokens of the user.
+func (s *sessionIssuer) revokeAll(ctx context.Context, username string) error {
+	_, err := s.refresh.UpdateMany(ctx, bson.M{"username": username, "revokedat": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedat": time.Now().UTC()}})
+	return err
+}
+
+// login issues tokens to a user who gives their username and password.
+func login(users *userStore, sessions *sessionIssuer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		u, err := users.authenticate(r.Context(), req.Username, req.Password)
+		writeSession(w, r, sessions, u, err)
+	}
+}
+
+// refreshSession issues new tokens for a refresh token, which is used up.
+func refreshSession(users *userStore, sessions *sessionIssuer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		username, err := sessions.use(r.Context(), req.RefreshToken)
+		var u *user
+		if err == nil {
+			u, err = users.enabled(r.Context(), username)
+		}
+		writeSession(w, r, sessions, u, err)
+	}
+}
+
+// logout revokes a refresh token, if one is given, and signs the browser out
+// of the admin UI. The access tokens issued with the refresh token remain
+// valid until they expire.
+func logout(sessions *sessionIssuer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			incorrectBody(w, err)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+		if req.RefreshToken == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		_, err := sessions.use(r.Context(), req.RefreshToken)
+		if err != nil && err != errInvalidLogin {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed revoke refresh token", "err", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeSession answers a login or refresh for u, found with err.
+func writeSession(w http.ResponseWriter, r *http.Request, sessions *sessionIssuer, u *user, err error) {
+	if err == errInvalidLogin {
+		unauthorized(w, "Invalid credentials")
+		return
+	}
+	var tokens sessionTokens
+	if err == nil {
+		tokens, err = sessions.issue(r.Context(), u)
+	}
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed issue session tokens", "err", err)
+		return
+	}
+
+	respBody, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	responseWithJSON(w, respBody, http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"problem"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxLookupVINs is the most VINs one lookup may ask for.
+const maxLookupVINs = 500
+
+// vinLookup is the response of a lookup by VIN: the cars found, in the order
+// asked for, and the VINs of those not found.
+type vinLookup struct {
+	Cars    []vehicle `json:"cars"`
+	Missing []string  `json:"missing"`
+}
+
+// lookupCars serves POST /cars/lookup: a lookup by registration, for editors,
+// when ?regno= is given, and otherwise a lookup of the cars with the VINs in
+// the body.
+func lookupCars(a *authenticator, regs *regLookup, cars vehicleRepository) http.HandlerFunc {
+	byRegNo := requireRole(a, roleEditor, lookupRegistration(regs))
+	byVIN := lookupVINs(cars)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("regno") {
+			byRegNo(w, r)
+			return
+		}
+		byVIN(w, r)
+	}
+}
+
+// lookupVINs returns the live cars with the VINs in the body, in one query,
+// for clients that would otherwise get them one at a time.
+func lookupVINs(cars vehicleRepository) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			VINs []string `json:"vins"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if len(req.VINs) == 0 || len(req.VINs) > maxLookupVINs {
+			fieldErrorWithJSON(w, "vins", "invalid", fmt.Sprintf("Between 1 and %d VINs must be given", maxLookupVINs))
+			return
+		}
+
+		// Each VIN is answered once, however often it is asked for.
+		var vins []string
+		seen := make(map[string]bool, len(req.VINs))
+		for _, v := range req.VINs {
+			vin := vin.Normalize(v)
+			if !seen[vin] {
+				seen[vin] = true
+				vins = append(vins, vin)
+			}
+		}
+
+		found := make(map[string]vehicle, len(vins))
+		params := ListParams{Filter: bson.M{"vin": bson.M{"$in": vins}, "deletedat": bson.M{"$exists": false}}}
+		err := cars.each(r.Context(), params, func(car vehicle) error {
+			found[car.VIN] = car
+			return nil
+		})
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed look up cars", "err", err)
+			return
+		}
+
+		res := vinLookup{Cars: []vehicle{}, Missing: []string{}}
+		for _, vin := range vins {
+			if car, ok := found[vin]; ok {
+				res.Cars = append(res.Cars, car)
+			} else {
+				res.Missing = append(res.Missing, vin)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
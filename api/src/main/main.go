@@ -1,184 +1,1919 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"config"
+	"migrations"
+	"notify"
+	"problem"
+	"proto/carpb"
+	"qr"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"goji.io"
 	"goji.io/pat"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"vin"
 )
 
-func errorWithJSON(w http.ResponseWriter, message string, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "{message: %q}", message)
+// errorWithJSON writes a problem details response with the code for status.
+func errorWithJSON(w http.ResponseWriter, message string, status int) {
+	problem.Write(w, problem.New(status, message))
+}
+
+// errorWithCode writes a problem details response with a more specific code.
+func errorWithCode(w http.ResponseWriter, code, message string, status int) {
+	problem.Write(w, problem.WithCode(status, code, message))
+}
+
+// fieldErrorWithJSON writes a validation problem for a request field that
+// failed it.
+func fieldErrorWithJSON(w http.ResponseWriter, field, reason, message string) {
+	problem.Write(w, problem.Invalid(field, reason, message))
+}
+
+// unknownRoute answers requests that no route matched, so that they get a
+// problem details body like every other error.
+func unknownRoute(w http.ResponseWriter, r *http.Request) {
+	errorWithJSON(w, "No such route", http.StatusNotFound)
+}
+
+func responseWithJSON(w http.ResponseWriter, json []byte, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(json)
+}
+
+// carPage is one page of a car listing.
+type carPage struct {
+	Cars       interface{} `json:"cars"`
+	Total      int64       `json:"total"`
+	Limit      int         `json:"limit"`
+	Page       *int        `json:"page,omitempty"`
+	Offset     *int        `json:"offset,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Facets     *carFacets  `json:"facets,omitempty"`
+	Links      *pageLinks  `json:"_links,omitempty"`
+}
+
+type vehicle struct {
+	Manurfacturer string `json:"manufacturer" bson:"manufacturer"`
+	Model         string `json:"model"`
+	VIN           string `json:"vin"`
+	RegNo         string `json:"regno"`
+	Dealer        string `json:"dealer,omitempty"`
+	// Branch is the ID of the dealership the car is at.
+	Branch string `json:"branch,omitempty" bson:",omitempty"`
+	// Status is where the car is in its lifecycle, changed through POST
+	// /cars/:vin/status or by its hold or order.
+	Status string     `json:"status,omitempty" bson:",omitempty"`
+	Order  string     `json:"order,omitempty" bson:",omitempty"`
+	Hold   *hold      `json:"hold,omitempty" bson:",omitempty"`
+	SoldAt *time.Time `json:"sold_at,omitempty" bson:",omitempty"`
+	// ListedAt is when the car first went on sale.
+	ListedAt *time.Time `json:"listed_at,omitempty" bson:",omitempty"`
+	// PriceReviewAt is set when the car was flagged for its price to be
+	// reviewed, having been in stock long without it changing.
+	PriceReviewAt *time.Time `json:"price_review_at,omitempty" bson:",omitempty"`
+	Price         *price     `json:"price,omitempty" bson:",omitempty"`
+	Mileage       int        `json:"mileage,omitempty" bson:",omitempty"`
+	Year          int        `json:"year,omitempty" bson:",omitempty"`
+	FuelType      string     `json:"fuel_type,omitempty" bson:",omitempty"`
+	Transmission  string     `json:"transmission,omitempty" bson:",omitempty"`
+	Colour        string     `json:"colour,omitempty" bson:",omitempty"`
+	Condition     string     `json:"condition,omitempty" bson:",omitempty"`
+	Images        []carImage `json:"images,omitempty" bson:",omitempty"`
+	// DistanceKm is how far the car's branch is from the point a listing
+	// is near; it is not stored.
+	DistanceKm *float64 `json:"distance_km,omitempty" bson:"distancekm,omitempty"`
+	// DisplayPrice is the price in the currency a reader asked for; it is
+	// not stored.
+	DisplayPrice *displayPrice `json:"display_price,omitempty" bson:"-"`
+	// Labels are the display values of the enumerations, in the language a
+	// reader asked for; they are not stored.
+	Labels *carLabels `json:"labels,omitempty" bson:"-"`
+	// ServiceHistory sums up the car's service records.
+	ServiceHistory *serviceSummary `json:"service_history,omitempty" bson:"servicehistory,omitempty"`
+	DeletedAt      *time.Time      `json:"deleted_at,omitempty" bson:",omitempty"`
+	// MergedInto is the VIN of the car a deleted car was merged into.
+	MergedInto string `json:"merged_into,omitempty" bson:"mergedinto,omitempty"`
+	// Revision counts the writes made to the car, from 1.
+	Revision int64 `json:"revision"`
+	// Tenant owns the car. Only the tenant's requests can see it.
+	Tenant string `json:"-" bson:"tenant"`
+}
+
+// price is an asking price in the minor unit of its currency, e.g. pence.
+type price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// basePath is prepended to every route and every URL the API generates, so
+// the service can be mounted under a path on a reverse proxy. It is empty by
+// default, which serves the API from the root.
+var basePath string
+
+// route returns p prefixed with the configured base path.
+func route(p string) string {
+	return basePath + p
+}
+
+func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	basePath = cfg.BasePath
+	regNoFormats, tenantRegNoFormats = cfg.RegNoFormats, cfg.TenantRegNoFormats
+
+	logger, levels, err := newLogger(cfg.LogLevel, cfg.LogOutput, cfg.LogDebugSampling)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	if cfg.Mock {
+		log.Fatal(serveMock(cfg))
+	}
+	if cfg.Storage == "memory" {
+		log.Fatal(serveMemory(cfg))
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	var dbBreaker *breaker
+	if cfg.BreakerThreshold > 0 {
+		dbBreaker = newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+
+	opts := options.Client().
+		ApplyURI(cfg.MongoURI).
+		SetConnectTimeout(cfg.MongoTimeout).
+		SetServerSelectionTimeout(cfg.MongoTimeout).
+		SetRetryReads(cfg.MongoRetryReads).
+		SetRetryWrites(cfg.MongoRetryWrites).
+		SetMaxPoolSize(cfg.MaxPoolSize).
+		SetMinPoolSize(cfg.MinPoolSize).
+		SetMaxConnIdleTime(cfg.MongoMaxConnIdleTime).
+		SetMonitor(commandMonitor(dbBreaker)).
+		SetPoolMonitor(poolMonitor()).
+		SetRegistry(carRegistry())
+	if dbBreaker != nil {
+		opts.SetServerMonitor(dbBreaker.serverMonitor())
+	}
+	if cfg.MongoQueryTimeout > 0 {
+		opts.SetTimeout(cfg.MongoQueryTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MongoTimeout)
+	client, err := mongo.Connect(ctx, opts)
+	cancel()
+
+	if err != nil {
+		log.Fatalf("Failed configure MongoDB client: %v", err)
+	}
+	if err := waitForMongo(client, cfg.MongoTimeout, cfg.MongoStartupWait); err != nil {
+		log.Fatalf("MongoDB unreachable after %s: %v", cfg.MongoStartupWait, err)
+	}
+
+	defer client.Disconnect(context.Background())
+	db := client.Database(cfg.DBName)
+	cars := db.Collection(cfg.CarsCollection)
+	archive := db.Collection(cfg.ArchiveCollection)
+	var repo vehicleRepository = &mongoVehicles{c: cars, archive: archive}
+	if cfg.ShadowStorage != "" {
+		var shadow vehicleRepository = &mongoVehicles{c: cars, archive: archive}
+		switch cfg.ShadowStorage {
+		case "memory":
+			shadow = newMemoryVehicles()
+		case "postgres":
+			pg, err := openPostgres(cfg.PostgresURL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer pg.Close()
+			shadow = &postgresVehicles{db: pg}
+		}
+		repo = newShadowVehicles(repo, shadow, cfg.ShadowLogSample)
+	}
+	timed := &timedVehicles{next: repo, threshold: cfg.SlowQueryThreshold}
+	repo = timed
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName("photos"))
+	if err != nil {
+		panic(err)
+	}
+	docBucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName("documents"))
+	if err != nil {
+		panic(err)
+	}
+	var photos photoStore = &gridfsPhotos{bucket: bucket}
+	var docStore photoStore = &gridfsPhotos{bucket: docBucket}
+	switch cfg.PhotoStore {
+	case "dir":
+		photos = &blobPhotos{c: bucket.GetFilesCollection(), blobs: &dirBlobs{dir: cfg.PhotoDir}}
+		docStore = &blobPhotos{c: docBucket.GetFilesCollection(), blobs: &dirBlobs{dir: cfg.PhotoDir}, prefix: "documents"}
+	case "s3":
+		blobs := newS3Blobs(cfg.PhotoS3Endpoint, cfg.PhotoS3Bucket, cfg.PhotoS3Region, cfg.PhotoS3AccessKey, cfg.PhotoS3SecretKey)
+		photos = &blobPhotos{c: bucket.GetFilesCollection(), blobs: blobs, linkTTL: cfg.PhotoS3LinkTTL}
+		docStore = &blobPhotos{c: docBucket.GetFilesCollection(), blobs: blobs, prefix: "documents"}
+	}
+	rends := newRenditions(photos, cfg.ImageRenditions)
+	if err := rends.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	backfillTenant(cfg.DefaultTenant, map[*mongo.Collection]string{
+		cars:                                 "tenant",
+		archive:                              "tenant",
+		photos.files():                       "metadata.tenant",
+		db.Collection(cfg.AuditCollection):   "tenant",
+		db.Collection(cfg.APIKeysCollection): "tenant",
+	})
+	migrationsColl := db.Collection(cfg.MigrationsCollection)
+	steps := carMigrations(cars, archive, map[*mongo.Collection]string{
+		photos.files():                              "metadata.vin",
+		db.Collection(cfg.AuditCollection):          "vin",
+		db.Collection(cfg.TestDrivesCollection):     "vin",
+		db.Collection(cfg.OrdersCollection):         "vin",
+		db.Collection(cfg.ReservationsCollection):   "vin",
+		db.Collection(cfg.ServiceHistoryCollection): "vin",
+	})
+	// A merge moves everything made against a car but its audit trail.
+	mergedRefs := map[*mongo.Collection]string{
+		photos.files():                              "metadata.vin",
+		db.Collection(cfg.TestDrivesCollection):     "vin",
+		db.Collection(cfg.OrdersCollection):         "vin",
+		db.Collection(cfg.ServiceHistoryCollection): "vin",
+	}
+	if _, err := migrations.Apply(context.Background(), migrationsColl, steps); err != nil {
+		panic(err)
+	}
+	if err := ensureSchema(context.Background(), cars, archive, cfg.SchemaValidation); err != nil {
+		panic(err)
+	}
+	enablePreImages(db, cfg.CarsCollection)
+
+	prices := &priceHistory{c: db.Collection(cfg.PriceHistoryCollection)}
+	if err := prices.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	audit := &auditLog{c: db.Collection(cfg.AuditCollection), prices: prices}
+	if err := audit.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	idempotency := &idempotencyStore{c: db.Collection(cfg.IdempotencyCollection), ttl: cfg.IdempotencyTTL}
+	if err := idempotency.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	dealerships := &dealershipStore{c: db.Collection(cfg.DealershipsCollection)}
+	if err := dealerships.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	customers := &customerStore{c: db.Collection(cfg.CustomersCollection)}
+	if err := customers.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	testDrives := &testDriveStore{c: db.Collection(cfg.TestDrivesCollection)}
+	if err := testDrives.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	orders := &orderStore{c: db.Collection(cfg.OrdersCollection)}
+	if err := orders.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	reservations := &reservationStore{c: db.Collection(cfg.ReservationsCollection)}
+	if err := reservations.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	tradeIns := &tradeInStore{c: db.Collection(cfg.TradeInsCollection)}
+	if err := tradeIns.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	services := &serviceHistoryStore{c: db.Collection(cfg.ServiceHistoryCollection)}
+	if err := services.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	hooks := newWebhooks(db.Collection(cfg.WebhooksCollection), db.Collection(cfg.WebhookDeliveriesCollection),
+		cfg.WebhookTimeout, cfg.WebhookMaxAttempts, cfg.WebhookDeliveryRetention)
+	if err := hooks.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	searches := &savedSearches{c: db.Collection(cfg.SavedSearchesCollection), cars: cars, hooks: hooks}
+	if err := searches.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	favs := &favorites{c: db.Collection(cfg.FavoritesCollection), cars: cars}
+	if err := favs.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	views := newAnalytics(db.Collection(cfg.AnalyticsCollection), cfg.AnalyticsRetention)
+	if err := views.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	out := newOutbox(db.Collection(cfg.OutboxCollection), client, cfg.OutboxRetention)
+	if err := out.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	var regs, enrich *regLookup
+	if cfg.RegLookupURL != "" {
+		regs = &regLookup{provider: newDVLAClient(cfg.RegLookupURL, cfg.RegLookupAPIKey), cache: newMemoryCache(cfg.CacheMaxEntries), ttl: cfg.RegLookupCacheTTL}
+		if cfg.RegLookupEnrich {
+			enrich = regs
+		}
+	}
+
+	var mots *motHistory
+	if cfg.MOTHistoryURL != "" {
+		mots = &motHistory{provider: newDVSAClient(cfg.MOTHistoryURL, cfg.MOTHistoryAPIKey), cache: newMemoryCache(cfg.CacheMaxEntries), ttl: cfg.MOTHistoryCacheTTL}
+	}
+
+	valuations := &valuer{provider: defaultDepreciation, cache: newMemoryCache(cfg.CacheMaxEntries), ttl: cfg.ValuationCacheTTL}
+
+	var rateSource rateProvider
+	if cfg.ExchangeRatesURL != "" {
+		rateSource = &httpRates{url: cfg.ExchangeRatesURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	rates := newExchangeRates(db.Collection(cfg.ExchangeRatesCollection), rateSource, cfg.ExchangeRatesTTL)
+	var fuzzy fuzzySearch = newNgramSearch(cars)
+	suggestions := newSuggester(cars)
+	if cfg.FuzzySearch == "atlas" {
+		fuzzy = &atlasSearch{cars: cars, index: cfg.AtlasSearchIndex}
+	}
+	if err := rates.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	keys := &apiKeyStore{c: db.Collection(cfg.APIKeysCollection)}
+	usage := &usageStore{c: db.Collection(cfg.UsageCollection), defaults: quota{Daily: cfg.APIKeyDailyQuota, Monthly: cfg.APIKeyMonthlyQuota}}
+	if err := keys.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+
+	roles := &roleStore{c: db.Collection(cfg.RolesCollection), admins: make(map[string]bool)}
+	if err := roles.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	for _, subject := range cfg.AdminSubjects {
+		roles.admins[subject] = true
+	}
+
+	users := &userStore{c: db.Collection(cfg.UsersCollection)}
+	if err := users.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	signingKey := []byte(cfg.SessionSigningKey)
+	if len(signingKey) == 0 {
+		slog.Warn("SESSION_SIGNING_KEY is not set; tokens issued at login are only accepted by this instance until it restarts")
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			panic(err)
+		}
+	}
+	sessions := newSessionIssuer(signingKey, cfg.SessionTTL, cfg.RefreshTokenTTL, db.Collection(cfg.RefreshTokensCollection))
+	if err := sessions.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	if cfg.BootstrapAdmin != "" {
+		if err := users.bootstrap(context.Background(), cfg.DefaultTenant, cfg.BootstrapAdmin, cfg.BootstrapAdminPassword); err != nil {
+			panic(err)
+		}
+	}
+
+	if cfg.MigrateOnly {
+		slog.Info("Migrations applied and indexes made")
+		return
+	}
+
+	auth := &authenticator{keys: keys, roles: roles, sessions: sessions, required: cfg.RequireAuth || cfg.JWKSURL != "" || cfg.OIDCIssuer != ""}
+	tenants := &tenancy{required: cfg.RequireTenant, authRequired: auth.required, fallback: cfg.DefaultTenant}
+	var scanner virusScanner
+	if cfg.DocumentScanURL != "" {
+		scanner = newHTTPScanner(cfg.DocumentScanURL)
+	}
+	docs, err := newCarDocuments(docStore, cfg.DocumentRoles, scanner, auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.RequestSignatureSkew > 0 {
+		auth.nonces = &nonceStore{c: db.Collection(cfg.NoncesCollection), skew: cfg.RequestSignatureSkew}
+		if err := auth.nonces.ensureIndex(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	if cfg.JWKSURL != "" {
+		auth.tokens = newTokenVerifier(cfg.JWKSURL, cfg.JWTIssuer, cfg.JWTAudience)
+	}
+	var sso *oidcLogin
+	if cfg.OIDCIssuer != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		provider, err := discoverOIDC(client, cfg.OIDCIssuer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Tokens for API calls are for the audience of JWT_AUDIENCE when it
+		// is set, and otherwise, like ID tokens, for this client.
+		audience := cfg.JWTAudience
+		if audience == "" {
+			audience = cfg.OIDCClientID
+		}
+		auth.tokens = newTokenVerifier(provider.JWKSURI, provider.Issuer, audience)
+		idTokens := newTokenVerifier(provider.JWKSURI, provider.Issuer, cfg.OIDCClientID)
+		idTokens.keys = auth.tokens.keys
+		idTokens.groupsClaim, idTokens.groupRoles = cfg.OIDCGroupsClaim, cfg.OIDCGroupRoles
+		postLogin := cfg.OIDCPostLoginURL
+		if postLogin == "" {
+			postLogin = route("/admin/")
+		}
+		sso = &oidcLogin{provider: provider, clientID: cfg.OIDCClientID, clientSecret: cfg.OIDCClientSecret,
+			redirectURL: cfg.OIDCRedirectURL, scopes: cfg.OIDCScopes, postLogin: postLogin,
+			idTokens: idTokens, auth: auth, client: client}
+	}
+	if auth.tokens != nil {
+		auth.tokens.groupsClaim, auth.tokens.groupRoles = cfg.OIDCGroupsClaim, cfg.OIDCGroupRoles
+	}
+	if !auth.required {
+		slog.Warn("Authentication is not required; anyone can write to the inventory")
+	}
+
+	var corsP atomic.Pointer[corsPolicy]
+	corsP.Store(newCORSPolicy(cfg.CORSAllowedOrigins, cfg.CORSAllowedMethods, cfg.CORSAllowedHeaders,
+		cfg.CORSExposedHeaders, cfg.CORSMaxAge))
+
+	limiter := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	if cfg.RateLimitStore == "redis" {
+		limiter.shared = &redisBuckets{pool: newRedisPool(cfg.RedisURL)}
+	}
+	reloads := &reloader{args: os.Args[1:], cfg: cfg, levels: levels, limiter: limiter, cors: &corsP}
+
+	maint := newMaintenance(cfg.MaintenanceMode)
+	var injected *faults
+	if cfg.FaultInjection {
+		injected = &faults{}
+		slog.Warn("Fault injection is enabled; admins can make requests fail")
+	}
+	var recorder *contractRecorder
+	if cfg.RecordContractsDir != "" {
+		recorder = newContractRecorder(cfg.RecordContractsDir, cfg.RecordContractsPerRoute)
+		slog.Warn("Recording exchanges for contract tests", "dir", cfg.RecordContractsDir)
+	}
+
+	flags, err := newFeatureFlags(db.Collection(cfg.FeatureFlagsCollection), cfg.FeatureFlags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := flags.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	if err := flags.refresh(context.Background()); err != nil {
+		panic(err)
+	}
+
+	tlsConfig, err := serverTLS(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lenders, err := loadLenders(cfg.LenderProfilesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	feeds, err := loadFeeds(cfg.FeedsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	marketFeeds := newFeedRenderer(cars, feeds, cfg.FeedListingURL, cfg.FeedImageBaseURL)
+
+	brochureTemplate, err := loadBrochureTemplate(cfg.BrochureTemplateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	carBrochures := newBrochures(photos, dealerships, brochureTemplate, cfg.BrochureBrand, cfg.BrochureColour, cfg.BrochureCacheTTL)
+
+	qrListingURL := cfg.QRListingURL
+	if qrListingURL == "" {
+		qrListingURL = cfg.FeedListingURL
+	}
+	qrLevel, _ := qr.ParseLevel(cfg.QRErrorCorrection)
+
+	notificationTemplates, err := loadNotificationTemplates(cfg.NotificationTemplatesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	zone, _ := time.LoadLocation(cfg.NotificationTimeZone)
+	notifications := &notifier{
+		c:           db.Collection(cfg.NotificationsCollection),
+		senders:     map[string]notify.Sender{},
+		templates:   notificationTemplates,
+		cars:        cars,
+		customers:   customers,
+		favorites:   favs,
+		drives:      testDrives,
+		dealerships: dealerships,
+		listingURL:  qrListingURL,
+		zone:        zone,
+		maxAttempts: cfg.NotificationMaxAttempts,
+		retention:   cfg.NotificationRetention,
+		slots:       make(chan struct{}, notificationConcurrency),
+	}
+	if err := notifications.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	stock := &stockLevels{
+		c:      db.Collection(cfg.StockLevelsCollection),
+		alerts: db.Collection(cfg.StockAlertsCollection),
+		cars:   cars,
+		notes:  notifications,
+	}
+	if err := stock.ensureIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	if cfg.SMTPAddr != "" {
+		notifications.senders[notify.Email] = &notify.SMTP{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.SMTPFrom}
+	}
+	if cfg.TwilioAccountSID != "" {
+		notifications.senders[notify.SMS] = &notify.Twilio{AccountSID: cfg.TwilioAccountSID, AuthToken: cfg.TwilioAuthToken, From: cfg.TwilioFrom,
+			HTTP: &http.Client{Timeout: notificationTimeout}}
+	}
+
+	events := newBroker()
+	events.out = out
+
+	var cache *responseCache
+	if cfg.CacheTTL > 0 {
+		cache = &responseCache{store: newMemoryCache(cfg.CacheMaxEntries), ttl: cfg.CacheTTL}
+		if cfg.RedisURL != "" {
+			cache.store = newRedisCache(cfg.RedisURL)
+		}
+		go cache.invalidate(events.subscribe())
+	}
+	out.sinks = append(out.sinks, hooks.deliver, notifications.notice, favs.forget, stock.observe)
+
+	var bus publisher
+	switch cfg.EventBus {
+	case "kafka":
+		bus = newKafkaPublisher(cfg.KafkaRESTURL, cfg.KafkaTopic)
+	case "nats":
+		if bus, err = newNATSPublisher(cfg.NATSURL, cfg.NATSSubject); err != nil {
+			panic(err)
+		}
+	}
+	if bus != nil {
+		out.sinks = append(out.sinks, publishTo(bus))
+	}
+
+	var backups *backupManager
+	var store backupStore
+	switch {
+	case cfg.BackupDir != "":
+		store = &dirBlobs{dir: cfg.BackupDir}
+	case cfg.BackupS3Bucket != "":
+		store = newS3Blobs(cfg.BackupS3Endpoint, cfg.BackupS3Bucket, cfg.BackupS3Region, cfg.BackupS3AccessKey, cfg.BackupS3SecretKey)
+	}
+	if store != nil {
+		backups = &backupManager{store: store, maint: maint, cache: cache, collections: []backedUp{
+			{"cars", cars},
+			{"archive", archive},
+			{"orders", orders.c},
+			{"audit", audit.c},
+		}}
+	}
+
+	layouts, err := newAccountingLayouts(cfg.AccountingLayouts)
+	if err != nil {
+		panic(err)
+	}
+	accounts := &accountingExports{orders: orders.c, cars: cars, archive: archive, audit: audit.c, layouts: layouts, dates: cfg.AccountingDateLayout}
+	switch {
+	case cfg.AccountingExportDir != "":
+		accounts.store = &dirBlobs{dir: cfg.AccountingExportDir}
+	case cfg.AccountingExportS3Bucket != "":
+		accounts.store = newS3Blobs(cfg.AccountingExportS3Endpoint, cfg.AccountingExportS3Bucket, cfg.AccountingExportS3Region, cfg.AccountingExportS3AccessKey, cfg.AccountingExportS3SecretKey)
+	case cfg.AccountingExportSFTPAddr != "":
+		sftp, err := newSFTPStore(cfg.AccountingExportSFTPAddr, cfg.AccountingExportSFTPUser, cfg.AccountingExportSFTPPassword,
+			cfg.AccountingExportSFTPKeyFile, cfg.AccountingExportSFTPHostKey, cfg.AccountingExportSFTPDir)
+		if err != nil {
+			panic(err)
+		}
+		accounts.store = sftp
+	}
+
+	schema, err := newGraphQLSchema(cars, events, audit, auth)
+	if err != nil {
+		panic(err)
+	}
+
+	// Cancelled on shutdown to end the change stream feeds.
+	streams, endStreams := context.WithCancel(context.Background())
+
+	sales := &orderWrites{orders: orders, reservations: reservations, cars: cars, events: events, audit: audit}
+
+	seedIfEmpty(withTenant(context.Background(), cfg.DefaultTenant), cars, events, audit, cfg.SeedValue, cfg.SeedCars)
+
+	indexes := []indexer{
+		func(ctx context.Context) error { return ensureSchema(ctx, cars, archive, cfg.SchemaValidation) },
+		audit.ensureIndex, prices.ensureIndex, rates.ensureIndex, idempotency.ensureIndex, dealerships.ensureIndex, customers.ensureIndex,
+		testDrives.ensureIndex, orders.ensureIndex, reservations.ensureIndex, tradeIns.ensureIndex, services.ensureIndex,
+		keys.ensureIndex, usage.ensureIndex, users.ensureIndex, sessions.ensureIndex, roles.ensureIndex, hooks.ensureIndex, searches.ensureIndex, favs.ensureIndex, views.ensureIndex, out.ensureIndex, rends.ensureIndex,
+		notifications.ensureIndex, stock.ensureIndex, flags.ensureIndex, docs.ensureIndex,
+	}
+	if auth.nonces != nil {
+		indexes = append(indexes, auth.nonces.ensureIndex)
+	}
+
+	jobs := newScheduler(cfg.JobSchedules)
+	if cfg.LeaderLeaseTTL > 0 {
+		jobs.leader = newLease(db.Collection(cfg.LeasesCollection), schedulerLease, cfg.LeaderLeaseTTL)
+		if err := jobs.leader.ensureIndex(context.Background()); err != nil {
+			panic(err)
+		}
+		indexes = append(indexes, jobs.leader.ensureIndex)
+	}
+	reviewSchedule := priceReviewSchedule
+	if cfg.PriceReviewDays == 0 {
+		reviewSchedule = jobOff
+	}
+	reminderSchedule := testDriveReminderSchedule
+	if cfg.TestDriveReminderLead == 0 {
+		reminderSchedule = jobOff
+	}
+	accountingSchedule := accountingExportSchedule
+	if accounts.store == nil {
+		accountingSchedule = jobOff
+	}
+	for _, err := range []error{
+		jobs.add("archive", archiveSchedule, (&archiver{cars: cars, archived: archive, audit: audit, retention: cfg.ArchiveRetention}).archive),
+		jobs.addLocal("feature-flags", featureFlagRefreshSchedule, flags.refresh),
+		jobs.add("hold-sweep", holdSweepSchedule, (&holdSweeper{sales: sales}).sweep),
+		jobs.add("test-drive-no-shows", noShowSchedule, (&noShowReleaser{drives: testDrives, grace: cfg.TestDriveNoShowGrace}).release),
+		jobs.add("webhook-retry", webhookRetrySchedule, hooks.retry),
+		jobs.add("notification-retry", notificationRetrySchedule, notifications.retry),
+		jobs.add("test-drive-reminders", reminderSchedule, (&reminders{n: notifications, lead: cfg.TestDriveReminderLead}).remind),
+		jobs.addLocal("suggestions", suggestSchedule, suggestions.refresh),
+		jobs.addLocal("feeds", feedSchedule, marketFeeds.refresh),
+		jobs.add("saved-search-alerts", savedSearchSchedule, searches.alertAll),
+		jobs.add("stock-recount", stockRecountSchedule, stock.recountAll),
+		jobs.add("manufacturer-backfill", legacyManufacturerSchedule, backfillManufacturer(cars, archive)),
+		jobs.add("accounting-export", accountingSchedule, accounts.monthEnd),
+		jobs.add("price-review", reviewSchedule, (&priceReviewer{cars: cars, prices: prices, days: cfg.PriceReviewDays}).review),
+		jobs.check(),
+	} {
+		if err != nil {
+			panic(err)
+		}
+	}
+	stop := make(chan struct{})
+	jobsDone := make(chan struct{})
+	go jobs.run(stop, jobsDone)
+	leaseDone := make(chan struct{})
+	if jobs.leader != nil {
+		go jobs.leader.campaign(stop, leaseDone)
+	} else {
+		close(leaseDone)
+	}
+	relayDone := make(chan struct{})
+	go out.relay(stop, relayDone)
+	viewsDone := make(chan struct{})
+	go views.run(stop, viewsDone)
+
+	mux := goji.NewMux()
+	mux.Use(logRequests)
+	mux.Use(recoverPanics)
+	mux.Use(traceRequests)
+	mux.Use(instrument)
+	mux.Use(injectFaultRules(injected))
+	mux.Use(recordContracts(recorder))
+	mux.Use(compressResponses(cfg.Compression, cfg.CompressionMinSize))
+	mux.Use(secureHeaders(cfg.HSTSMaxAge))
+	mux.Use(cors(&corsP))
+	mux.Use(negotiateContent)
+	mux.Use(localize)
+	mux.Use(requireContentType)
+	mux.Use(limitBodies(cfg.MaxBodySize, map[string]int64{apiRoute("/cars/batch"): cfg.BatchMaxBodySize}))
+	mux.Use(breakOnDatabaseDown(dbBreaker))
+	mux.Use(limitInFlight(newInFlightLimiter(cfg.MaxInFlight, cfg.RouteMaxInFlight)))
+	mux.Use(deadlineRequests(cfg.RequestTimeout))
+	mux.Use(requireClientCert(cfg.RequireClientCert))
+	mux.Use(authenticate(auth))
+	mux.Use(scopeTenant(tenants))
+	mux.Use(legacyErrorsUnlessFlagged(flags))
+	mux.Use(limitRate(limiter))
+	mux.Use(enforceQuota(usage))
+	mux.Use(readOnlyDuringMaintenance(maint))
+	mux.Handle(pat.Get(route("/metrics")), promhttp.Handler())
+	mux.HandleFunc(pat.Get(route("/healthz")), healthz)
+	mux.HandleFunc(pat.Get(route("/readyz")), readyz(client))
+	mux.HandleFunc(pat.Get(route("/openapi.json")), openAPI())
+	mux.HandleFunc(pat.Get(route("/docs")), apiDocs)
+	mux.HandleFunc(pat.Post(apiRoute("/api-keys")), requireRole(auth, roleAdmin, mintAPIKey(keys)))
+	mux.HandleFunc(pat.Get(apiRoute("/api-keys")), requireRole(auth, roleAdmin, allAPIKeys(keys)))
+	mux.HandleFunc(pat.Delete(apiRoute("/api-keys/:id")), requireRole(auth, roleAdmin, revokeAPIKey(keys)))
+	mux.HandleFunc(pat.Put(apiRoute("/api-keys/:id/quota")), requireRole(auth, roleAdmin, setAPIKeyQuota(keys)))
+	mux.HandleFunc(pat.Get(apiRoute("/api-keys/:id/usage")), requireRole(auth, roleAdmin, apiKeyUsage(keys, usage)))
+	mux.HandleFunc(pat.Get(apiRoute("/usage")), callerUsage(usage))
+	mux.HandleFunc(pat.Post(apiRoute("/users")), requireRole(auth, roleAdmin, createUser(users)))
+	mux.HandleFunc(pat.Get(apiRoute("/users")), requireRole(auth, roleAdmin, allUsers(users)))
+	mux.HandleFunc(pat.Post(apiRoute("/users/:username/disable")), requireRole(auth, roleAdmin, disableUser(users, sessions)))
+	mux.HandleFunc(pat.Put(apiRoute("/users/:username/password")), changePassword(auth, users, sessions))
+	mux.HandleFunc(pat.Post(apiRoute("/login")), login(users, sessions))
+	if sso != nil {
+		mux.HandleFunc(pat.Get(route("/auth/oidc/login")), sso.start)
+		mux.HandleFunc(pat.Get(route("/auth/oidc/callback")), sso.callback)
+	}
+	ui := newAdminUI(auth, users, sessions, sso, cfg.AdminCSP)
+	mux.Handle(pat.Get(route("/admin")), http.RedirectHandler(route("/admin/"), http.StatusMovedPermanently))
+	mux.HandleFunc(pat.Post(route("/admin/login")), ui.login)
+	mux.HandleFunc(pat.Post(route("/admin/logout")), ui.logout)
+	mux.HandleFunc(pat.Get(route("/admin/*")), ui.serve)
+	mux.HandleFunc(pat.Post(apiRoute("/login/refresh")), refreshSession(users, sessions))
+	mux.HandleFunc(pat.Post(apiRoute("/logout")), logout(sessions))
+	mux.HandleFunc(pat.Get(apiRoute("/roles")), requireRole(auth, roleAdmin, allRoles(roles)))
+	mux.HandleFunc(pat.Put(apiRoute("/roles/:subject")), requireRole(auth, roleAdmin, assignRole(roles)))
+	mux.HandleFunc(pat.Post(apiRoute("/saved-searches")), requireSignIn(addSavedSearch(searches)))
+	mux.HandleFunc(pat.Get(apiRoute("/saved-searches")), requireSignIn(allSavedSearches(searches)))
+	mux.HandleFunc(pat.Get(apiRoute("/saved-searches/:id/cars")), requireSignIn(savedSearchCars(searches, repo, rates)))
+	mux.HandleFunc(pat.Delete(apiRoute("/saved-searches/:id")), requireSignIn(deleteSavedSearch(searches)))
+	mux.HandleFunc(pat.Get(apiRoute("/users/me/favorites")), requireSignIn(myFavorites(favs)))
+	mux.HandleFunc(pat.Post(apiRoute("/users/me/favorites/:vin")), requireSignIn(addFavorite(favs)))
+	mux.HandleFunc(pat.Delete(apiRoute("/users/me/favorites/:vin")), requireSignIn(deleteFavorite(favs)))
+	mux.HandleFunc(pat.Post(apiRoute("/webhooks")), requireRole(auth, roleAdmin, addWebhook(hooks)))
+	mux.HandleFunc(pat.Get(apiRoute("/webhooks")), requireRole(auth, roleAdmin, allWebhooks(hooks)))
+	mux.HandleFunc(pat.Get(apiRoute("/webhooks/:id")), requireRole(auth, roleAdmin, webhookByID(hooks)))
+	mux.HandleFunc(pat.Delete(apiRoute("/webhooks/:id")), requireRole(auth, roleAdmin, deleteWebhook(hooks)))
+	mux.HandleFunc(pat.Get(apiRoute("/webhooks/:id/deliveries")), requireRole(auth, roleAdmin, webhookDeliveries(hooks)))
+	mux.HandleFunc(pat.Get(apiRoute("/notifications")), requireRole(auth, roleEditor, allNotifications(notifications)))
+	mux.HandleFunc(pat.Get(apiRoute("/notifications/:id")), requireRole(auth, roleEditor, notificationByID(notifications)))
+	mux.HandleFunc(pat.Get(apiRoute("/dealerships")), allDealerships(dealerships))
+	mux.HandleFunc(pat.Post(apiRoute("/dealerships")), requireRole(auth, roleEditor, addDealership(dealerships)))
+	mux.HandleFunc(pat.Get(apiRoute("/dealerships/:id")), dealershipByID(dealerships))
+	mux.HandleFunc(pat.Put(apiRoute("/dealerships/:id")), requireRole(auth, roleEditor, updateDealership(dealerships)))
+	mux.HandleFunc(pat.Delete(apiRoute("/dealerships/:id")), requireRole(auth, roleAdmin, deleteDealership(dealerships, cars)))
+	mux.HandleFunc(pat.Get(apiRoute("/dealerships/:id/cars")), deletedForAdmins(auth, dealershipCars(dealerships, repo, rates)))
+	mux.HandleFunc(pat.Get(apiRoute("/stock-levels")), requireRole(auth, roleEditor, allStockLevels(stock)))
+	mux.HandleFunc(pat.Get(apiRoute("/stock-alerts")), requireRole(auth, roleEditor, allStockAlerts(stock)))
+	mux.HandleFunc(pat.Post(apiRoute("/stock-alerts")), requireRole(auth, roleEditor, addStockAlert(stock)))
+	mux.HandleFunc(pat.Delete(apiRoute("/stock-alerts/:id")), requireRole(auth, roleEditor, deleteStockAlert(stock)))
+	mux.HandleFunc(pat.Get(apiRoute("/customers")), requireRole(auth, roleEditor, allCustomers(customers)))
+	mux.HandleFunc(pat.Post(apiRoute("/customers")), requireRole(auth, roleEditor, addCustomer(customers)))
+	mux.HandleFunc(pat.Get(apiRoute("/customers/:id")), requireRole(auth, roleEditor, customerByID(customers)))
+	mux.HandleFunc(pat.Put(apiRoute("/customers/:id")), requireRole(auth, roleEditor, updateCustomer(customers)))
+	mux.HandleFunc(pat.Delete(apiRoute("/customers/:id")), requireRole(auth, roleAdmin, eraseCustomer(customers)))
+	mux.HandleFunc(pat.Post(apiRoute("/customers/:id/enquiries")), requireRole(auth, roleEditor, addEnquiry(customers, cars)))
+	mux.HandleFunc(pat.Post(apiRoute("/customers/:id/purchases")), requireRole(auth, roleEditor, addPurchase(customers, cars)))
+	mux.HandleFunc(pat.Post(apiRoute("/finance/quote")), financeQuoteHandler(cars, lenders))
+	mux.HandleFunc(pat.Get(apiRoute("/orders")), requireRole(auth, roleEditor, allOrders(orders)))
+	mux.HandleFunc(pat.Post(apiRoute("/orders")), requireRole(auth, roleEditor, createOrder(sales)))
+	mux.HandleFunc(pat.Get(apiRoute("/orders/:id")), requireRole(auth, roleEditor, orderByID(orders)))
+	mux.HandleFunc(pat.Post(apiRoute("/orders/:id/complete")), requireRole(auth, roleEditor, completeOrder(sales)))
+	mux.HandleFunc(pat.Post(apiRoute("/orders/:id/cancel")), requireRole(auth, roleEditor, cancelOrder(sales)))
+	mux.HandleFunc(pat.Get(apiRoute("/stats")), requireRole(auth, roleEditor, stats(cars)))
+	mux.HandleFunc(pat.Get(apiRoute("/reports/aging")), requireRole(auth, roleEditor, agingReportOf(cars, cfg.AgingThresholds)))
+	mux.HandleFunc(pat.Get(apiRoute("/reports/data-quality")), requireRole(auth, roleEditor, dataQualityReport(cars, audit)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/reindex")), requireRole(auth, roleAdmin, reindex(indexes)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/migrations")), requireRole(auth, roleAdmin, migrationStatus(migrationsColl, steps)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/seed")), requireRole(auth, roleAdmin, seedInventory(cars, events, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/maintenance")), requireRole(auth, roleAdmin, maintenanceStatus(maint)))
+	mux.HandleFunc(pat.Put(apiRoute("/admin/maintenance")), requireRole(auth, roleAdmin, setMaintenance(maint)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/slow-queries")), requireRole(auth, roleAdmin, slowQueries(timed)))
+	if injected != nil {
+		mux.HandleFunc(pat.Get(apiRoute("/admin/faults")), requireRole(auth, roleAdmin, faultStatus(injected)))
+		mux.HandleFunc(pat.Put(apiRoute("/admin/faults")), requireRole(auth, roleAdmin, setFaults(injected)))
+	}
+	mux.HandleFunc(pat.Get(apiRoute("/admin/feature-flags")), requireRole(auth, roleAdmin, allFeatureFlags(flags)))
+	mux.HandleFunc(pat.Put(apiRoute("/admin/feature-flags/:name")), requireRole(auth, roleAdmin, setFeatureFlag(flags)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/log-level")), requireRole(auth, roleAdmin, logLevelStatus(levels)))
+	mux.HandleFunc(pat.Put(apiRoute("/admin/log-level")), requireRole(auth, roleAdmin, setLogLevel(levels)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/config/reload")), requireRole(auth, roleAdmin, reloadConfig(reloads)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/audit")), requireRole(auth, roleAdmin, auditTrail(audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/outbox")), requireRole(auth, roleAdmin, outboxEvents(out)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/accounting-export")), requireRole(auth, roleAdmin, downloadAccountingExport(accounts)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/accounting-export")), requireRole(auth, roleAdmin, pushAccountingExport(accounts)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/backups")), requireRole(auth, roleAdmin, createBackup(backups)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/backups")), requireRole(auth, roleAdmin, allBackups(backups)))
+	mux.HandleFunc(pat.Get(apiRoute("/admin/backups/:name")), requireRole(auth, roleAdmin, backupByName(backups)))
+	mux.HandleFunc(pat.Post(apiRoute("/admin/backups/:name/restore")), requireRole(auth, roleAdmin, restoreBackup(backups)))
+	mux.HandleFunc(pat.Post(apiRoute("/trade-ins")), submitTradeIn(tradeIns))
+	mux.HandleFunc(pat.Get(apiRoute("/trade-ins")), requireRole(auth, roleEditor, allTradeIns(tradeIns)))
+	mux.HandleFunc(pat.Get(apiRoute("/trade-ins/:id")), requireRole(auth, roleEditor, tradeInByID(tradeIns)))
+	mux.HandleFunc(pat.Post(apiRoute("/trade-ins/:id/photos")), uploadTradeInPhoto(tradeIns, photos))
+	mux.HandleFunc(pat.Get(apiRoute("/trade-ins/:id/photos/:photo")), requireRole(auth, roleEditor, tradeInPhoto(photos)))
+	mux.HandleFunc(pat.Put(apiRoute("/trade-ins/:id/appraisal")), requireRole(auth, roleEditor, appraiseTradeIn(tradeIns)))
+	mux.HandleFunc(pat.Post(apiRoute("/trade-ins/:id/accept")), requireRole(auth, roleEditor, acceptTradeIn(tradeIns)))
+	mux.HandleFunc(pat.Post(apiRoute("/trade-ins/:id/decline")), requireRole(auth, roleEditor, declineTradeIn(tradeIns)))
+	mux.HandleFunc(pat.Post(apiRoute("/trade-ins/:id/order")), requireRole(auth, roleEditor, linkTradeIn(tradeIns, orders)))
+	mux.HandleFunc(pat.Get(apiRoute("/graphql")), graphQL(schema, maint))
+	mux.HandleFunc(pat.Post(apiRoute("/graphql")), graphQL(schema, maint))
+	mux.HandleFunc(pat.Get(apiRoute("/suggest")), suggest(suggestions))
+	mux.HandleFunc(pat.Get(apiRoute("/cars")), deletedForAdmins(auth, cache.listing(shadowed(flags, flagShadowListCars, allCars(repo, dealerships, prices, rates)))))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars")), requireRole(auth, roleAdmin, deleteCars(cars, events, audit)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars")), requireRole(auth, roleEditor, idempotent(idempotency, shadowed(flags, flagShadowWrites, addCar(repo, enrich, events, audit)))))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/lookup")), lookupCars(auth, regs, repo))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/batch")), requireRole(auth, roleEditor, idempotent(idempotency, addCars(cars, events, audit))))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/status-batch")), requireRole(auth, roleEditor, changeStatuses(sales)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/import")), requireRole(auth, roleEditor, importCars(cars, events, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/count")), deletedForAdmins(auth, cache.listing(shadowed(flags, flagShadowCountCars, countCars(repo)))))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/duplicates")), requireRole(auth, roleEditor, carDuplicates(repo)))
+	mux.HandleFunc(pat.Post(apiRoute("/events")), addViews(views))
+	mux.HandleFunc(pat.Get(apiRoute("/feeds/:name")), feedByName(marketFeeds))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/compare")), compareCars(repo, rates))
+	mux.HandleFunc(pat.Get(apiRoute("/search")), globalSearch(auth, repo, customers, orders))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/search")), deletedForAdmins(auth, cache.listing(shadowed(flags, flagShadowSearchCars, searchCars(repo, fuzzy, rates, flags)))))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/export")), deletedForAdmins(auth, exportCars(cars)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/events")), carEvents(events))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/ws")), carWebSocket(events))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/stream")), carStream(cars, streams))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/archive/:vin")), archivedCarByVIN(archive))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin")), cache.car(shadowed(flags, flagShadowGetCar, carByVIN(repo, rates))))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/decoded")), decodedVIN)
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/stats")), requireRole(auth, roleViewer, viewStats(views)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/similar")), similarCars(cars, cfg.SimilarWeights))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/history")), requireRole(auth, roleAdmin, carHistory(audit, repo)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/merge-from/:other")), requireRole(auth, roleAdmin, mergeCar(repo, mergedRefs, services, events, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/price-history")), requireRole(auth, roleViewer, carPriceHistory(prices)))
+	mux.HandleFunc(pat.Put(apiRoute("/cars/:vin")), requireRole(auth, roleEditor, shadowed(flags, flagShadowWrites, updateCar(repo, events, audit))))
+	mux.HandleFunc(pat.Patch(apiRoute("/cars/:vin")), requireRole(auth, roleEditor, shadowed(flags, flagShadowWrites, patchCar(repo, events, audit))))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin")), requireRole(auth, roleAdmin, shadowed(flags, flagShadowWrites, deleteCar(repo, events, audit))))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/restore")), requireRole(auth, roleAdmin, restoreCar(cars, events, audit)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/images")), requireRole(auth, roleEditor, uploadImage(cars, photos, rends, events, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/images/:id")), imageByID(photos, rends))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/documents")), requireRole(auth, roleViewer, carDocumentList(docs)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/documents")), requireRole(auth, roleEditor, uploadCarDocument(cars, docs, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/documents/:id")), requireRole(auth, roleViewer, carDocumentByID(docs)))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin/documents/:id")), requireRole(auth, roleAdmin, deleteCarDocument(docs, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/mot")), carMOTHistory(cars, services, mots))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/valuation")), valueCar(cars, valuations, flags))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/qr.png")), carQRCode(cars, qrListingURL, cfg.QRSize, qrLevel))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/brochure.pdf")), requireRole(auth, roleViewer, carBrochure(cars, carBrochures)))
+	mux.HandleFunc(pat.Get(apiRoute("/exchange-rates")), requireRole(auth, roleAdmin, allExchangeRateOverrides(rates)))
+	mux.HandleFunc(pat.Get(apiRoute("/exchange-rates/:from/:to")), exchangeRateByPair(rates))
+	mux.HandleFunc(pat.Put(apiRoute("/exchange-rates/:from/:to")), requireRole(auth, roleAdmin, setExchangeRate(rates)))
+	mux.HandleFunc(pat.Delete(apiRoute("/exchange-rates/:from/:to")), requireRole(auth, roleAdmin, deleteExchangeRate(rates)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/service-history")), serviceHistory(services))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/service-history")), requireRole(auth, roleEditor, addServiceRecord(services, cars, events, audit)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/service-history/:id")), serviceRecordByID(services))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin/service-history/:id")), requireRole(auth, roleEditor, deleteServiceRecord(services, cars, events, audit)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/status")), requireRole(auth, roleEditor, changeStatus(sales)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/reserve")), requireRole(auth, roleEditor, reserveCar(sales)))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin/reserve")), requireRole(auth, roleEditor, releaseCar(sales)))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin/testdrives")), requireRole(auth, roleEditor, carTestDrives(testDrives)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/testdrives")), requireRole(auth, roleEditor, bookTestDrive(testDrives, cars, dealerships)))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin/testdrives/:id")), requireRole(auth, roleEditor, cancelTestDrive(testDrives)))
+	mux.HandleFunc(pat.Post(apiRoute("/cars/:vin/testdrives/:id/start")), requireRole(auth, roleEditor, startTestDrive(testDrives)))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin/images/:id")), requireRole(auth, roleEditor, deleteImage(cars, photos, rends, events, audit)))
+	// Registered last so that it only matches what no other route does.
+	mux.HandleFunc(pat.New("/*"), unknownRoute)
+
+	var public http.Handler
+	if cfg.PublicAPI {
+		storefront := &publicAPI{cars: repo, maxAge: cfg.PublicMaxAge, secret: cfg.PublicSigningSecret}
+		publicLimiter := newRateLimiter(cfg.PublicRateLimit, cfg.PublicRateBurst)
+		if cfg.RateLimitStore == "redis" {
+			publicLimiter.shared = &redisBuckets{pool: newRedisPool(cfg.RedisURL), scope: "public:"}
+		}
+		publicMux := goji.NewMux()
+		publicMux.Use(logRequests)
+		publicMux.Use(recoverPanics)
+		publicMux.Use(traceRequests)
+		publicMux.Use(instrument)
+		publicMux.Use(recordContracts(recorder))
+		publicMux.Use(compressResponses(cfg.Compression, cfg.CompressionMinSize))
+		publicMux.Use(secureHeaders(cfg.HSTSMaxAge))
+		publicMux.Use(negotiateContent)
+		publicMux.Use(localize)
+		publicMux.Use(breakOnDatabaseDown(dbBreaker))
+		publicMux.Use(deadlineRequests(cfg.RequestTimeout))
+		publicMux.Use(scopeTenant(tenants))
+		publicMux.Use(limitRate(publicLimiter))
+		publicMux.Use(storefront.headers)
+		publicMux.HandleFunc(pat.Get(apiRoute("/public/cars")), cache.listing(storefront.list))
+		publicMux.HandleFunc(pat.Get(apiRoute("/public/cars/:vin")), cache.listing(storefront.car))
+		publicMux.HandleFunc(pat.New("/*"), unknownRoute)
+		public = publicMux
+	}
+
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      versioned(publicFirst(public, mux)),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		TLSConfig:    tlsConfig,
+	}
+	// Event streams never go idle, so they are ended explicitly to let
+	// Shutdown finish.
+	server.RegisterOnShutdown(events.close)
+	server.RegisterOnShutdown(endStreams)
+
+	serveErr := make(chan error, 1)
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCListenAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCListenAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(grpcAuth(auth, tenants), grpcReadOnlyDuringMaintenance(maint))}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = grpc.NewServer(opts...)
+		carpb.RegisterCarServiceServer(grpcServer, &carServer{cars: repo, events: events, audit: audit})
+
+		go func() {
+			serveErr <- grpcServer.Serve(lis)
+		}()
+	}
+
+	var debugServer *http.Server
+	if cfg.DebugListenAddr != "" {
+		debugServer = newDebugServer(cfg.DebugListenAddr, auth)
+		go func() {
+			serveErr <- debugServer.ListenAndServe()
+		}()
+	}
+
+	// Registering only now, with the database reached, migrated and indexed,
+	// keeps the orchestration of startup out of the deployment.
+	var consul *consulRegistration
+	if cfg.ConsulAddr != "" {
+		consul, err = newConsulRegistration(cfg.ConsulAddr, cfg.ConsulToken, cfg.ConsulServiceName,
+			cfg.ConsulServiceAddress, cfg.ListenAddr, cfg.ConsulServiceTags, tlsConfig != nil, cfg.ConsulCheckInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := consul.register(context.Background()); err != nil {
+			log.Fatalf("Failed register with Consul: %v", err)
+		}
+		slog.Info("Registered with Consul", "service", cfg.ConsulServiceName)
+	}
+
+	go func() {
+		if tlsConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			if _, err := reloads.reload(); err != nil {
+				slog.Error("Failed reload configuration", "err", err)
+			}
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		slog.Error("Server stopped", "err", err)
+		deregister(consul)
+	case sig := <-sigs:
+		slog.Info("Shutting down", "signal", sig.String())
+		deregister(consul)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Failed drain connections", "err", err)
+		}
+		cancel()
+	}
+
+	if debugServer != nil {
+		debugServer.Close()
+	}
+
+	if grpcServer != nil {
+		stopGRPC(grpcServer, cfg.ShutdownTimeout)
+	}
+
+	close(stop)
+	<-jobsDone
+	<-leaseDone
+	<-relayDone
+	<-viewsDone
+	if bus != nil {
+		bus.close()
+	}
+}
+
+func ensureIndex(ctx context.Context, cars, archive *mongo.Collection) error {
+	// VINs are unique per tenant: two dealerships may both list a car they
+	// have each been offered. The indexes made before tenancy are dropped by
+	// a migration.
+	vinIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"vin": bson.M{"$type": "string"}}),
+	}
+
+	_, err := cars.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		vinIndex,
+		// Listing filters and sorts within a tenant: manufacturer alone or
+		// with model, model and registration.
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "model", Value: 1}}},
+		// Registrations are unique per tenant too, though cars may have none.
+		{
+			Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "regno", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"regno": bson.M{"$gt": ""}}),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "price.amount", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "mileage", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "year", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "branch", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "manufacturer", Value: "text"},
+			{Key: "model", Value: "text"},
+			{Key: "regno", Value: "text"},
+		}},
+		{
+			Keys:    bson.D{{Key: "soldat", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "hold.until", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Indexes().CreateOne(ctx, vinIndex)
+	return err
+}
+
+// dropIndex drops the named index of c if it is there.
+func dropIndex(ctx context.Context, c *mongo.Collection, name string) error {
+	_, err := c.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+		return err
+	}
+	return nil
+}
+
+// allCars lists the cars. With ?near=lat,lng it lists those at the
+// dealerships within ?radius= km, nearest first, and with
+// ?reduced_within_days= those whose price went down lately. With
+// ?format=ndjson it streams every matching car instead of a page.
+func allCars(cars vehicleRepository, dealerships *dealershipStore, prices *priceHistory, rates *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		point, radius, err := parseNear(query)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reduced, err := parseReduced(query)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params, err := parseListQuery(query)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reduced > 0 && !reducedCars(w, r, prices, &params, reduced) {
+			return
+		}
+		if params.Format == "ndjson" {
+			if point != nil {
+				errorWithJSON(w, "Parameter \"near\" is not supported with format ndjson", http.StatusBadRequest)
+				return
+			}
+			dumpCars(w, r, cars, params)
+			return
+		}
+		if point != nil && !nearCars(w, r, dealerships, &params, *point, radius) {
+			return
+		}
+
+		listCars(w, r, cars, rates, params)
+	}
 }
 
-func responseWithJSON(w http.ResponseWriter, json []byte, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-	w.Write(json)
-}
+// searchCars lists the cars matching the full-text query ?q=, most relevant
+// first unless another sort is asked for. With ?fuzzy=true it finds the cars
+// whose manufacturer or model is a near miss of the words too, where
+// flagFuzzySearch is on.
+func searchCars(cars vehicleRepository, fuzzy fuzzySearch, rates *exchangeRates, flags *featureFlags) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseListParams(r)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-type vehicle struct {
-	Manurfacturer string `json:"manufacturer"`
-	Model         string `json:"model"`
-	VIN           string `json:"vin"`
-	RegNo         string `json:"regno"`
-}
+		if params.Text == "" {
+			errorWithJSON(w, "Parameter \"q\" is required", http.StatusBadRequest)
+			return
+		}
 
-func main() {
-	session, err := mgo.Dial("mongo")
+		if params.UseCursor {
+			errorWithJSON(w, "Parameter \"cursor\" is not supported by search", http.StatusBadRequest)
+			return
+		}
 
-	if err != nil {
-		panic(err)
-	}
+		ranked := true
+		if params.Fuzzy && flags.enabled(r.Context(), flagFuzzySearch) {
+			if ranked, err = fuzzy.widen(r.Context(), &params); err != nil {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed fuzzy search", "err", err)
+				return
+			}
+		}
 
-	defer session.Close()
-	session.SetMode(mgo.Monotonic, true)
-	ensureIndex(session)
+		if r.URL.Query().Get("sort") == "" && ranked {
+			if params.Projection == nil {
+				params.Projection = bson.M{}
+			}
+			params.Projection["score"] = bson.M{"$meta": "textScore"}
+			params.Sort = bson.D{
+				{Key: "score", Value: bson.M{"$meta": "textScore"}},
+				{Key: "vin", Value: 1},
+			}
+		}
 
-	mux := goji.NewMux()
-	mux.HandleFunc(pat.Get("/cars"), allCars(session))
-	mux.HandleFunc(pat.Post("/cars"), addCar(session))
-	mux.HandleFunc(pat.Get("/cars/:vin"), carByVIN(session))
-	mux.HandleFunc(pat.Delete("/cars/:vin"), deleteCar(session))
-	http.ListenAndServe(":8080", mux)
+		listCars(w, r, cars, rates, params)
+	}
 }
 
-func ensureIndex(s *mgo.Session) {
-	session := s.Copy()
-	defer session.Close()
+// listCars writes the page of cars described by params. Pages of more than
+// streamPageMin cars are streamed, as streamPage describes, unless they
+// include the archive, whose cars are only counted with the page.
+func listCars(w http.ResponseWriter, r *http.Request, repo vehicleRepository, rates *exchangeRates, params ListParams) {
+	if params.Limit > streamPageMin && params.near == nil && !params.IncludeArchived {
+		streamPage(w, r, repo, rates, params)
+		return
+	}
+
+	cars, total, next, err := repo.list(r.Context(), params)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed get all cars", "err", err)
+		return
+	}
+	if !displayPricesOrFail(w, r, rates, cars, params.Currency) {
+		return
+	}
+	labelCars(r.Context(), cars)
+	if params.Currency != "" && params.Fields != nil {
+		params.Fields = append(params.Fields, "display_price")
+	}
 
-	c := session.DB("carsupermarket").C("cars")
+	page := carPage{Total: total, Limit: params.Limit}
+	if params.Facets {
+		filter := bson.M{}
+		for k, v := range params.Filter {
+			filter[k] = v
+		}
+		page.Facets, err = repo.facets(r.Context(), filter)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count facets", "err", err)
+			return
+		}
+	}
+	if params.UseCursor {
+		page.NextCursor = next
+	} else {
+		page.Page = &params.Page
+		page.Offset = &params.Offset
+	}
 
-	index := mgo.Index{
-		Key:        []string{"vin"},
-		Unique:     true,
-		DropDups:   true,
-		Background: true,
-		Sparse:     true,
+	var body interface{} = cars
+	if params.Fields != nil {
+		selected := make([]map[string]interface{}, len(cars))
+		for i := range cars {
+			selected[i], err = selectFields(cars[i], params.Fields)
+			if err != nil {
+				panic(err)
+			}
+		}
+		body = selected
 	}
-	err := c.EnsureIndex(index)
+	if params.Links {
+		linked := make([]map[string]interface{}, len(cars))
+		for i := range cars {
+			var v interface{} = cars[i]
+			if params.Fields != nil {
+				v = body.([]map[string]interface{})[i]
+			}
+			linked[i], err = withLinks(v, cars[i])
+			if err != nil {
+				panic(err)
+			}
+		}
+		body = linked
+		page.Links = &pageLinks{
+			Self: link{r.URL.RequestURI()},
+			Next: nextPage(r, params, len(cars), total, next),
+		}
+	}
+
+	page.Cars = body
+
+	respBody, err := json.MarshalIndent(page, "", "  ")
 	if err != nil {
 		panic(err)
 	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if notModified(w, r, etag(respBody)) {
+		return
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
 }
 
-func allCars(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// countCars counts the cars matching the listing filters, for showing how
+// many there are without fetching them. The count is also in X-Total-Count,
+// as on listings.
+func countCars(cars vehicleRepository) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		c := session.DB("carsupermarket").C("cars")
+		params, err := parseListParams(r)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		var cars []vehicle
-		err := c.Find(bson.M{}).All(&cars)
+		total, err := cars.count(r.Context(), params.Filter)
 		if err != nil {
-			errorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed get all cars: ", err)
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count cars", "err", err)
 			return
 		}
 
-		respBody, err := json.MarshalIndent(cars, "", "  ")
+		respBody, err := json.MarshalIndent(struct {
+			Count int64 `json:"count"`
+		}{total}, "", "  ")
 		if err != nil {
-			log.Fatal(err)
+			panic(err)
+		}
+
+		w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+		if notModified(w, r, etag(respBody)) {
+			return
 		}
 
 		responseWithJSON(w, respBody, http.StatusOK)
 	}
 }
 
-func addCar(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// pageFetch is how many cars are fetched for the page of params: in cursor
+// mode one extra, to learn whether there is another page.
+func pageFetch(params ListParams) int {
+	if params.UseCursor {
+		return params.Limit + 1
+	}
+	return params.Limit
+}
+
+// findPage returns the page of cars described by params and how many cars
+// match in all. In cursor mode it also returns the cursor of the next page,
+// which is empty on the last.
+func findPage(ctx context.Context, c *mongo.Collection, params ListParams) ([]vehicle, int64, string, error) {
+	forTenant(ctx, params.Filter)
+	total, err := c.CountDocuments(ctx, params.Filter)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if params.near != nil {
+		cars, err := findNearPage(ctx, c, params)
+		return cars, total, "", err
+	}
+
+	opts := options.Find().SetSkip(int64(params.Offset)).SetLimit(int64(pageFetch(params)))
+	if len(params.Sort) > 0 {
+		opts.SetSort(params.Sort)
+	}
+	if params.Projection != nil {
+		opts.SetProjection(params.Projection)
+	}
+
+	cars := []vehicle{}
+	cur, err := c.Find(ctx, params.cursorFilter(), opts)
+	if err == nil {
+		err = cur.All(ctx, &cars)
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if params.UseCursor && len(cars) > params.Limit {
+		cars = cars[:params.Limit]
+		next = encodeCursor(cars[len(cars)-1].VIN)
+	}
+
+	return cars, total, next, nil
+}
+
+// addCar adds a car, filling in its details from its registration first when
+// enrich is set. With ?validate_only=true the car is checked, for duplicates
+// too, and answered as it would be stored, without adding it.
+func addCar(cars vehicleRepository, enrich *regLookup, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
+		dryRun, ok := validateOnly(w, r)
+		if !ok {
+			return
+		}
 
 		var car vehicle
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&car)
-		if err != nil {
-			errorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+		if !decodeBody(w, r.Body, &car) {
 			return
 		}
 
-		c := session.DB("carsupermarket").C("cars")
+		enrich.enrich(r.Context(), &car)
+		if err := prepareNewCar(r.Context(), &car); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
 
-		err = c.Insert(car)
+		var err error
+		if dryRun {
+			err = duplicateOf(r.Context(), cars, car)
+		} else {
+			err = events.transact(r.Context(), func(ctx context.Context) error {
+				if err := cars.create(ctx, car); err != nil {
+					return err
+				}
+				events.publish(ctx, inventoryEvent{Type: eventCreated, VIN: car.VIN, Car: &car})
+				return nil
+			})
+		}
 		if err != nil {
-			if mgo.IsDup(err) {
-				errorWithJSON(w, "A car with this VIN already exists", http.StatusBadRequest)
+			switch err {
+			case errDuplicateVIN:
+				errorWithCode(w, problem.CodeDuplicateVIN, "A car with this VIN already exists", http.StatusBadRequest)
 				return
+			case errDuplicateRegNo:
+				errorWithCode(w, problem.CodeDuplicateRegNo, "A car with this registration already exists", http.StatusBadRequest)
+				return
+			}
+
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert car", "err", err)
+			return
+		}
+
+		if dryRun {
+			respBody, err := json.MarshalIndent(car, "", "  ")
+			if err != nil {
+				panic(err)
 			}
 
-			errorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed insert car: ", err)
+			responseWithJSON(w, respBody, http.StatusOK)
 			return
 		}
 
+		audit.change(r.Context(), auditCreated, car.VIN, nil, &car)
+
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Location", r.URL.Path+"/"+car.VIN)
+		w.Header().Set("Location", apiRoute("/cars/"+car.VIN))
+		w.Header().Set("ETag", carETag(car))
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
-func carByVIN(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// prepareNewCar checks a car about to be added by the tenant of ctx and fills
+// in what can be decoded from its VIN.
+func prepareNewCar(ctx context.Context, car *vehicle) *fieldError {
+	car.VIN = vin.Normalize(car.VIN)
+	c := &checks{}
+	decoded, err := vin.Decode(car.VIN)
+	if err != nil {
+		e := err.(*vin.Error)
+		c.fail("vin", e.Reason, e.Msg)
+	}
+	car.check(ctx, c)
+	if err := c.err(); err != nil {
+		return err
+	}
+	car.DeletedAt = nil
+	// New cars are in stock unless still being prepared for sale.
+	if car.Status != carInPrep {
+		car.Status = carInStock
+	}
+	car.Order = ""
+	car.Hold = nil
+	car.ServiceHistory = nil
+	car.DistanceKm = nil
+	car.ListedAt = nil
+	if car.Status == carInStock {
+		now := time.Now().UTC()
+		car.ListedAt = &now
+	}
+	car.PriceReviewAt = nil
+	car.Revision = 1
+	car.Tenant = tenantFrom(ctx)
+
+	// Only the manufacturer can be filled in; the model is not encoded in a
+	// standard way.
+	if car.Manurfacturer == "" {
+		car.Manurfacturer = decoded.Manufacturer
+	}
+	return nil
+}
+
+// carVIN returns the VIN in the path of r, normalised as VINs are stored
+// so that it is found however it is cased or spaced.
+func carVIN(r *http.Request) string {
+	return vin.Normalize(pat.Param(r, "vin"))
+}
+
+// sameVIN tells whether a and b are the same VIN once normalised.
+func sameVIN(a, b string) bool {
+	return vin.Normalize(a) == vin.Normalize(b)
+}
+
+func carByVIN(cars vehicleRepository, rates *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
+		vin := carVIN(r)
+		currency := r.URL.Query().Get("currency")
+		if currency != "" && !currencyCode.MatchString(currency) {
+			errorWithJSON(w, "Parameter \"currency\" must be an ISO 4217 code such as EUR", http.StatusBadRequest)
+			return
+		}
 
-		vin := pat.Param(r, "vin")
+		var fields []string
+		var projection bson.M
+		if value := r.URL.Query().Get("fields"); value != "" {
+			var err error
+			fields, projection, err = parseFields(value)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The revision is fetched for the ETag.
+			projection["revision"] = 1
+		}
 
-		c := session.DB("carsupermarket").C("cars")
+		car, err := cars.get(r.Context(), vin, projection)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
 
-		var car vehicle
-		err := c.Find(bson.M{"vin": vin}).One(&car)
+		cars := []vehicle{car}
+		if !displayPricesOrFail(w, r, rates, cars, currency) {
+			return
+		}
+		labelCars(r.Context(), cars)
+		car = cars[0]
+		// A converted price changes with the rate, which the revision in the
+		// ETag does not follow, so it is always sent.
+		if car.DisplayPrice != nil {
+			w.Header().Set("ETag", carETag(car))
+		} else if notModified(w, r, carETag(car)) {
+			return
+		}
+		if fields != nil && car.DisplayPrice != nil {
+			fields = append(fields, "display_price")
+		}
+
+		var body interface{} = car
+		if fields != nil {
+			body, err = selectFields(car, fields)
+			if err != nil {
+				panic(err)
+			}
+		}
+		if wantLinks(r) {
+			body, err = withLinks(body, car)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(body, "", "  ")
 		if err != nil {
-			errorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed find car: ", err)
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// decodedVIN describes what can be learnt from the VIN in the path. The car
+// does not need to be in the inventory.
+func decodedVIN(w http.ResponseWriter, r *http.Request) {
+	decoded, err := vin.Decode(carVIN(r))
+	if err != nil {
+		e := err.(*vin.Error)
+		fieldErrorWithJSON(w, "vin", e.Reason, e.Msg)
+		return
+	}
+
+	respBody, err := json.MarshalIndent(decoded, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
+}
+
+func updateCar(cars vehicleRepository, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var car vehicle
+		if !decodeBody(w, r.Body, &car) {
+			return
+		}
+
+		if err := car.validateReplacement(r.Context()); err != nil {
+			fieldErrorsWithJSON(w, err)
 			return
 		}
 
-		if car.VIN == "" {
-			errorWithJSON(w, "Car not found", http.StatusNotFound)
+		rev, ok := expectedRevision(w, r, cars, vin, car.Revision)
+		if !ok {
 			return
 		}
 
+		// The VIN identifies the car and cannot be changed; the path wins.
+		car.VIN = vin
+		car.DeletedAt = nil
+
+		var before vehicle
+		err := events.transact(r.Context(), func(ctx context.Context) error {
+			var err error
+			if before, err = cars.replace(ctx, &car, rev); err != nil {
+				return err
+			}
+			events.publish(ctx, carChanged(eventUpdated, &before, &car))
+			return nil
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed update car", "err", err)
+				return
+			case errDuplicateRegNo:
+				errorWithCode(w, problem.CodeDuplicateRegNo, "A car with this registration already exists", http.StatusBadRequest)
+				return
+			case mongo.ErrNoDocuments:
+				missingOrConflict(w, r, cars, vin, rev)
+				return
+			}
+		}
+		audit.change(r.Context(), auditUpdated, vin, &before, &car)
+
+		w.Header().Set("ETag", carETag(car))
 		respBody, err := json.MarshalIndent(car, "", "  ")
 		if err != nil {
-			log.Fatal(err)
+			panic(err)
 		}
 
 		responseWithJSON(w, respBody, http.StatusOK)
 	}
 }
 
-func deleteCar(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// mergePatch returns car with a validated merge patch applied.
+func mergePatch(car vehicle, patch map[string]json.RawMessage) vehicle {
+	b, err := json.Marshal(car)
+	if err != nil {
+		panic(err)
+	}
+	p, err := json.Marshal(patch)
+	if err != nil {
+		panic(err)
+	}
+
+	var patched vehicle
+	if err := json.Unmarshal(mergeJSON(b, p), &patched); err != nil {
+		panic(err)
+	}
+	return patched
+}
+
+// mergeJSON applies the merge patch to target as RFC 7386 has it: the members
+// of an object patch are merged into those of target, recursively, null
+// removing them; any other patch replaces target.
+func mergeJSON(target, patch json.RawMessage) json.RawMessage {
+	var members map[string]json.RawMessage
+	if !jsonObject(patch) || json.Unmarshal(patch, &members) != nil {
+		return patch
+	}
+	var fields map[string]json.RawMessage
+	if !jsonObject(target) || json.Unmarshal(target, &fields) != nil {
+		fields = map[string]json.RawMessage{}
+	}
+
+	for name, value := range members {
+		if string(bytes.TrimSpace(value)) == "null" {
+			delete(fields, name)
+		} else {
+			fields[name] = mergeJSON(fields[name], value)
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func jsonObject(v json.RawMessage) bool {
+	v = bytes.TrimSpace(v)
+	return len(v) > 0 && v[0] == '{'
+}
+
+// replaceCar replaces the stored car with the VIN of car, if it is at revision
+// rev, and returns it as it was. Photos are managed through their own
+// endpoints, so the car's images are kept rather than replaced, and car is
+// given them. So are the car's status, which only its transitions change, its
+// service summary and when it was listed and flagged for price review.
+func replaceCar(ctx context.Context, c *mongo.Collection, car *vehicle, rev int64) (vehicle, error) {
+	car.Tenant = tenantFrom(ctx)
+	car.Status = ""
+	car.Order = ""
+	car.Hold = nil
+	car.ServiceHistory = nil
+	car.DistanceKm = nil
+	car.ListedAt = nil
+	car.PriceReviewAt = nil
+	replace := bson.D{{Key: "$replaceWith", Value: bson.M{
+		"$mergeObjects": bson.A{bson.M{"$literal": car}, bson.M{
+			"images":         "$images",
+			"status":         "$status",
+			"order":          "$order",
+			"hold":           "$hold",
+			"servicehistory": "$servicehistory",
+			"listedat":       "$listedat",
+			"pricereviewat":  "$pricereviewat",
+			"revision":       bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$revision", 0}}, 1}},
+		}},
+	}}}
+
+	var before vehicle
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := c.FindOneAndUpdate(ctx, atRevision(ctx, car.VIN, rev), mongo.Pipeline{replace}, opts).Decode(&before)
+	car.Images = before.Images
+	car.Status = before.Status
+	car.Order = before.Order
+	car.Hold = before.Hold
+	car.ServiceHistory = before.ServiceHistory
+	car.ListedAt = before.ListedAt
+	car.PriceReviewAt = before.PriceReviewAt
+	car.Revision = before.Revision + 1
+	return before, duplicateKey(err)
+}
+
+// patchFields maps the JSON fields a merge patch may touch to their stored
+// keys. Required fields cannot be removed with null.
+var patchFields = map[string]struct {
+	key      string
+	required bool
+}{
+	"manufacturer": {"manufacturer", true},
+	"model":        {"model", true},
+	"regno":        {"regno", false},
+	"dealer":       {"dealer", false},
+	"branch":       {"branch", false},
+	"sold_at":      {"soldat", false},
+	"price":        {"price", false},
+	"mileage":      {"mileage", false},
+	"year":         {"year", false},
+	"fuel_type":    {"fueltype", false},
+	"transmission": {"transmission", false},
+	"colour":       {"colour", false},
+	"condition":    {"condition", false},
+}
+
+// nestedPatch tells whether the merge patch has objects to merge into the
+// car's.
+func nestedPatch(patch map[string]json.RawMessage) bool {
+	for _, value := range patch {
+		if jsonObject(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// patchCar applies an RFC 7386 JSON Merge Patch to a car.
+func patchCar(cars vehicleRepository, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
+		vin := carVIN(r)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		var patch map[string]json.RawMessage
+		var patched vehicle
+		if json.Unmarshal(body, &patch) != nil {
+			errorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+		if !decodeBody(w, bytes.NewReader(body), &patched) {
+			return
+		}
+
+		rev, ok := expectedRevision(w, r, cars, vin, patched.Revision)
+		if !ok {
+			return
+		}
+
+		// The objects in the patch are merged into the car's, so the car is
+		// read for them, and written only if still at the revision read.
+		if nestedPatch(patch) {
+			current, err := cars.get(r.Context(), vin, nil)
+			if err != nil {
+				switch err {
+				default:
+					errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+					slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				case mongo.ErrNoDocuments:
+					errorWithJSON(w, "Car not found", http.StatusNotFound)
+				}
+				return
+			}
+			if rev != anyRevision && rev != current.Revision {
+				missingOrConflict(w, r, cars, vin, rev)
+				return
+			}
+			rev = current.Revision
+
+			b, err := json.Marshal(current)
+			if err != nil {
+				panic(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(b, &fields); err != nil {
+				panic(err)
+			}
+			for name, value := range patch {
+				if jsonObject(value) {
+					patch[name] = mergeJSON(fields[name], value)
+				}
+			}
+			if b, err = json.Marshal(patch); err != nil {
+				panic(err)
+			}
+			patched = vehicle{}
+			if !decodeBody(w, bytes.NewReader(b), &patched) {
+				return
+			}
+		}
+
+		if err := patched.validate(r.Context()); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		raw, err := bson.Marshal(patched)
+		if err != nil {
+			panic(err)
+		}
+		var values bson.M
+		if err := bson.Unmarshal(raw, &values); err != nil {
+			panic(err)
+		}
+
+		set := bson.M{}
+		unset := bson.M{}
+		for name, value := range patch {
+			// A revision in the patch is a precondition, like If-Match.
+			if name == "revision" {
+				continue
+			}
+			if name == "vin" {
+				if !sameVIN(patched.VIN, vin) {
+					errorWithJSON(w, "The VIN of a car cannot be changed", http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+
+			field, ok := patchFields[name]
+			if !ok {
+				errorWithJSON(w, fmt.Sprintf("Unknown field %q", name), http.StatusBadRequest)
+				return
+			}
 
-		vin := pat.Param(r, "vin")
+			if string(value) == "null" {
+				if field.required {
+					errorWithJSON(w, fmt.Sprintf("Field %q cannot be removed", name), http.StatusBadRequest)
+					return
+				}
+				unset[field.key] = ""
+				continue
+			}
 
-		c := session.DB("carsupermarket").C("cars")
+			set[field.key] = values[field.key]
+		}
 
-		err := c.Remove(bson.M{"vin": vin})
+		// The update made is the patch, so applying it to the car as it was
+		// gives the car as it is now.
+		changed := len(set) > 0 || len(unset) > 0
+		var before, car vehicle
+		err = events.transact(r.Context(), func(ctx context.Context) error {
+			var err error
+			if before, err = cars.update(ctx, vin, rev, set, unset); err != nil {
+				return err
+			}
+			car = mergePatch(before, patch)
+			if _, ok := set["regno"]; ok {
+				car.RegNo = patched.RegNo
+			}
+			car.Revision = before.Revision
+			if changed {
+				car.Revision++
+				events.publish(ctx, carChanged(eventUpdated, &before, &car))
+			}
+			return nil
+		})
 		if err != nil {
 			switch err {
 			default:
-				errorWithJSON(w, "Database error", http.StatusInternalServerError)
-				log.Println("Failed delete car: ", err)
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed patch car", "err", err)
 				return
-			case mgo.ErrNotFound:
-				errorWithJSON(w, "Car not found", http.StatusNotFound)
+			case errDuplicateRegNo:
+				errorWithCode(w, problem.CodeDuplicateRegNo, "A car with this registration already exists", http.StatusBadRequest)
+				return
+			case mongo.ErrNoDocuments:
+				missingOrConflict(w, r, cars, vin, rev)
 				return
 			}
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		if changed {
+			audit.change(r.Context(), auditUpdated, vin, &before, &car)
+		}
+
+		w.Header().Set("ETag", carETag(car))
+		respBody, err := json.MarshalIndent(car, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
 	}
 }
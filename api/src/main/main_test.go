@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"price":{"amount":500,"currency":"GBP"}}`, `{"price":{"amount":100}}`, `{"price":{"amount":100,"currency":"GBP"}}`},
+	}
+	for _, tt := range tests {
+		got := mergeJSON(json.RawMessage(tt.target), json.RawMessage(tt.patch))
+		var g, w interface{}
+		if err := json.Unmarshal(got, &g); err != nil {
+			t.Fatalf("merge %s into %s: %v", tt.patch, tt.target, err)
+		}
+		json.Unmarshal([]byte(tt.want), &w)
+		gb, _ := json.Marshal(g)
+		wb, _ := json.Marshal(w)
+		if string(gb) != string(wb) {
+			t.Errorf("merge %s into %s = %s, want %s", tt.patch, tt.target, gb, wb)
+		}
+	}
+}
+
+// patchServer serves PATCH /cars/:vin on a memory repository holding car.
+func patchServer(t *testing.T, car vehicle) (*httptest.Server, vehicleRepository) {
+	t.Helper()
+	repo := newMemoryVehicles()
+	if err := prepareNewCar(context.Background(), &car); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.create(context.Background(), car); err != nil {
+		t.Fatal(err)
+	}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Patch(apiRoute("/cars/:vin")), patchCar(repo, newBroker(), &auditLog{}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, repo
+}
+
+func patch(t *testing.T, srv *httptest.Server, vin, body string) (*http.Response, vehicle) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPatch, srv.URL+apiRoute("/cars/"+vin), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var car vehicle
+	json.NewDecoder(resp.Body).Decode(&car)
+	return resp, car
+}
+
+func TestPatchCarNestedObject(t *testing.T) {
+	car := seedCars(1, 1)[0]
+	car.Price = &price{Amount: 1299500, Currency: "GBP"}
+	srv, repo := patchServer(t, car)
+
+	resp, got := patch(t, srv, car.VIN, `{"price":{"amount":100}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	want := price{Amount: 100, Currency: "GBP"}
+	if got.Price == nil || *got.Price != want {
+		t.Errorf("answered price %+v, want %+v", got.Price, want)
+	}
+	stored, err := repo.get(context.Background(), car.VIN, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Price == nil || *stored.Price != want {
+		t.Errorf("stored price %+v, want %+v", stored.Price, want)
+	}
+	if stored.Manurfacturer != car.Manurfacturer || stored.Revision != 2 {
+		t.Errorf("stored %s at revision %d, want %s at 2", stored.Manurfacturer, stored.Revision, car.Manurfacturer)
+	}
+}
+
+func TestPatchCarNestedNull(t *testing.T) {
+	car := seedCars(1, 1)[0]
+	car.Price = &price{Amount: 1299500, Currency: "GBP"}
+	srv, _ := patchServer(t, car)
+
+	// Removing a required member of an object leaves it invalid.
+	if resp, _ := patch(t, srv, car.VIN, `{"price":{"currency":null}}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422", resp.StatusCode)
+	}
+	// Removing the object removes it all.
+	resp, got := patch(t, srv, car.VIN, `{"price":null}`)
+	if resp.StatusCode != http.StatusOK || got.Price != nil {
+		t.Errorf("status = %d with price %+v, want 200 without", resp.StatusCode, got.Price)
+	}
+}
+
+func TestPatchCarNestedRevision(t *testing.T) {
+	car := seedCars(1, 1)[0]
+	car.Price = &price{Amount: 1299500, Currency: "GBP"}
+	srv, _ := patchServer(t, car)
+
+	if resp, _ := patch(t, srv, car.VIN, `{"price":{"amount":100},"revision":5}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("status = %d, want 409", resp.StatusCode)
+	}
+	if resp, _ := patch(t, srv, "WBA00000000000000", `{"price":{"amount":100}}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"problem"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maintenanceRetryAfter is the Retry-After of writes refused for maintenance.
+const maintenanceRetryAfter = 5 * time.Minute
+
+// defaultMaintenanceMessage is shown for writes refused for maintenance when
+// the operator gives no message.
+const defaultMaintenanceMessage = "The inventory is read-only for maintenance; try again later"
+
+// maintenance is whether the API is read-only, so that the database can be
+// maintained without taking the storefront down. It is held per instance:
+// every instance behind a load balancer has to be switched.
+type maintenance struct {
+	mu    sync.Mutex
+	state maintenanceState
+}
+
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+func newMaintenance(enabled bool) *maintenance {
+	m := &maintenance{}
+	if enabled {
+		m.set(true, "")
+	}
+	return m
+}
+
+func (m *maintenance) get() maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *maintenance) set(enabled bool, message string) maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !enabled:
+		m.state = maintenanceState{}
+	case !m.state.Enabled:
+		now := time.Now().UTC()
+		m.state = maintenanceState{Enabled: true, Since: &now}
+	}
+	if enabled {
+		m.state.Message = message
+	}
+	return m.state
+}
+
+// refuse writes the response to a write refused for maintenance, if the API
+// is read-only, and reports whether it did.
+func (m *maintenance) refuse(w http.ResponseWriter) bool {
+	state := m.get()
+	if !state.Enabled {
+		return false
+	}
+	message := state.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	errorWithCode(w, problem.CodeMaintenance, message, http.StatusServiceUnavailable)
+	return true
+}
+
+// readOnlyDuringMaintenance refuses requests other than reads while m is on.
+// The maintenance switch stays writable, so that it can be turned off, as do
+// backups, which are restored during maintenance. GraphQL requests are left
+// to graphQL, as queries are posted too, and lookups only read.
+func readOnlyDuringMaintenance(m *maintenance) func(http.Handler) http.Handler {
+	exempt := map[string]bool{apiRoute("/admin/maintenance"): true, apiRoute("/graphql"): true, apiRoute("/cars/lookup"): true,
+		apiRoute("/login"): true, apiRoute("/login/refresh"): true, apiRoute("/logout"): true,
+		route("/admin/login"): true, route("/admin/logout"): true}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if !exempt[r.URL.Path] && !strings.HasPrefix(r.URL.Path, apiRoute("/admin/backups")) && m.refuse(w) {
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// grpcWrites are the gRPC methods refused during maintenance.
+var grpcWrites = map[string]bool{"CreateCar": true, "UpdateCar": true, "DeleteCar": true}
+
+// grpcReadOnlyDuringMaintenance refuses the gRPC writes while m is on.
+func grpcReadOnlyDuringMaintenance(m *maintenance) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		if state := m.get(); state.Enabled && grpcWrites[method] {
+			return nil, status.Error(codes.Unavailable, defaultMaintenanceMessage)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// maintenanceStatus reports whether the API is read-only.
+func maintenanceStatus(m *maintenance) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respBody, err := json.MarshalIndent(m.get(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// setMaintenance turns maintenance on or off, with a message for the writes
+// refused meanwhile.
+func setMaintenance(m *maintenance) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Enabled *bool  `json:"enabled"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			errorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		state := m.set(*req.Enabled, req.Message)
+		if state.Enabled {
+			slog.WarnContext(r.Context(), "Maintenance mode on; writes are refused", "message", state.Message)
+		} else {
+			slog.InfoContext(r.Context(), "Maintenance mode off")
+		}
+
+		respBody, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"goji.io/pat"
+)
+
+// Merge policies, saying whose value a field set on both cars keeps.
+const (
+	// mergeFill keeps the car merged into's values, filling in only those
+	// it does not have from the car merged from.
+	mergeFill = "fill"
+	// mergePreferOther takes every value the car merged from has.
+	mergePreferOther = "prefer_other"
+)
+
+// errMergedChanged is returned when the car merged from changed during the
+// merge.
+var errMergedChanged = errors.New("car merged from changed")
+
+// mergeRequest says how two cars are merged. Fields overrides Policy for
+// the fields it names, by their JSON names, with "this" or "other".
+type mergeRequest struct {
+	Policy string            `json:"policy"`
+	Fields map[string]string `json:"fields"`
+}
+
+// mergedFields are the fields a merge resolves, by their JSON names, with
+// their stored keys. The rest are the car merged into's, or are combined.
+var mergedFields = map[string]string{
+	"manufacturer": "manufacturer",
+	"model":        "model",
+	"regno":        "regno",
+	"dealer":       "dealer",
+	"branch":       "branch",
+	"price":        "price",
+	"mileage":      "mileage",
+	"year":         "year",
+	"fuel_type":    "fueltype",
+	"transmission": "transmission",
+	"colour":       "colour",
+	"condition":    "condition",
+}
+
+func (m *mergeRequest) validate() *fieldError {
+	c := &checks{}
+	c.check(m.Policy == "" || m.Policy == mergeFill || m.Policy == mergePreferOther, "policy",
+		"The policy must be fill or prefer_other")
+	for field, side := range m.Fields {
+		if _, ok := mergedFields[field]; !ok {
+			c.fail("fields."+field, "invalid", "Only manufacturer, model, regno, dealer, branch, price, mileage, year, fuel_type, transmission, colour and condition are merged")
+			continue
+		}
+		c.check(side == "this" || side == "other", "fields."+field, "Each field must keep this or other")
+	}
+	return c.err()
+}
+
+// takeOther says whether the merged car gets the car merged from's value of
+// field, given which of the two have one.
+func (m *mergeRequest) takeOther(field string, thisSet, otherSet bool) bool {
+	switch m.Fields[field] {
+	case "this":
+		return false
+	case "other":
+		return true
+	}
+	if m.Policy == mergePreferOther {
+		return otherSet
+	}
+	return !thisSet && otherSet
+}
+
+// mergeSet returns the stored keys to set on car for it to take the values
+// of other that req resolves in other's favour.
+func mergeSet(req *mergeRequest, car, other vehicle) bson.M {
+	set := bson.M{}
+	take := func(field string, thisSet, otherSet bool, v interface{}) {
+		if req.takeOther(field, thisSet, otherSet) {
+			set[mergedFields[field]] = v
+		}
+	}
+	take("manufacturer", car.Manurfacturer != "", other.Manurfacturer != "", other.Manurfacturer)
+	take("model", car.Model != "", other.Model != "", other.Model)
+	take("regno", car.RegNo != "", other.RegNo != "", other.RegNo)
+	take("dealer", car.Dealer != "", other.Dealer != "", other.Dealer)
+	take("branch", car.Branch != "", other.Branch != "", other.Branch)
+	take("price", car.Price != nil, other.Price != nil, other.Price)
+	take("mileage", car.Mileage != 0, other.Mileage != 0, other.Mileage)
+	take("year", car.Year != 0, other.Year != 0, other.Year)
+	take("fuel_type", car.FuelType != "", other.FuelType != "", other.FuelType)
+	take("transmission", car.Transmission != "", other.Transmission != "", other.Transmission)
+	take("colour", car.Colour != "", other.Colour != "", other.Colour)
+	take("condition", car.Condition != "", other.Condition != "", other.Condition)
+	return set
+}
+
+// mergeCar merges the car with the VIN in :other into the one with the VIN
+// in :vin, for the two records an import made of one car. The car merged
+// into takes the other's field values as the request's policy resolves
+// them, its photos, and the test drives, orders and service records made
+// against it; the other is deleted as merged_into the first, which lists its
+// audit history as its own. The car merged from must not be reserved or
+// sold. If-Match is the revision of the car merged into.
+func mergeCar(cars vehicleRepository, refs map[*mongo.Collection]string, services *serviceHistoryStore, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		intoVIN, fromVIN := carVIN(r), vin.Normalize(pat.Param(r, "other"))
+		if intoVIN == fromVIN {
+			errorWithJSON(w, "A car cannot be merged with itself", http.StatusBadRequest)
+			return
+		}
+
+		req := mergeRequest{Policy: mergeFill}
+		if r.ContentLength != 0 {
+			if !decodeStrict(w, r.Body, &req) {
+				return
+			}
+		}
+		if err := req.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		rev, ok := expectedRevision(w, r, cars, intoVIN, 0)
+		if !ok {
+			return
+		}
+		other, err := cars.get(r.Context(), fromVIN, nil)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "The car to merge from was not found", http.StatusNotFound)
+				return
+			}
+		}
+		if other.Order != "" || other.Hold != nil || other.Status == carSold {
+			errorWithJSON(w, "The car to merge from is reserved or sold; release it first", http.StatusConflict)
+			return
+		}
+
+		var before, merged, tombstone vehicle
+		now := time.Now().UTC()
+		err = events.transact(r.Context(), func(ctx context.Context) error {
+			car, err := cars.get(ctx, intoVIN, nil)
+			if err != nil {
+				return err
+			}
+			if rev != anyRevision && car.Revision != rev {
+				return mongo.ErrNoDocuments
+			}
+
+			// The registration is given up for the car merged into to be
+			// able to take it; the audit trail keeps it.
+			gone, kept := bson.M{"deletedat": now, "mergedinto": intoVIN}, bson.M{"regno": ""}
+			tombstoneBefore, err := cars.update(ctx, fromVIN, other.Revision, gone, kept)
+			if err == mongo.ErrNoDocuments {
+				return errMergedChanged
+			}
+			if err != nil {
+				return err
+			}
+			tombstone = updating(tombstoneBefore, gone, kept)
+
+			for c, key := range refs {
+				_, err := c.UpdateMany(ctx, forTenant(ctx, bson.M{key: fromVIN}), bson.M{"$set": bson.M{key: intoVIN}})
+				if err != nil {
+					return err
+				}
+			}
+
+			set := mergeSet(&req, car, other)
+			unset := bson.M{}
+			if len(other.Images) > 0 {
+				set["images"] = append(append([]carImage{}, car.Images...), other.Images...)
+			}
+			summary, err := services.summary(ctx, intoVIN)
+			switch {
+			case err != nil:
+				return err
+			case summary != nil:
+				set["servicehistory"] = summary
+			case car.ServiceHistory != nil:
+				unset["servicehistory"] = ""
+			}
+			if before, err = cars.update(ctx, intoVIN, car.Revision, set, unset); err != nil {
+				return err
+			}
+
+			events.publish(ctx, inventoryEvent{Type: eventDeleted, VIN: fromVIN, Car: &tombstone})
+			merged = updating(before, set, unset)
+			events.publish(ctx, carChanged(eventUpdated, &before, &merged))
+			return nil
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed merge cars", "vin", intoVIN, "other", fromVIN, "err", err)
+				return
+			case errDuplicateRegNo:
+				errorWithCode(w, problem.CodeDuplicateRegNo, "A car with this registration already exists", http.StatusBadRequest)
+				return
+			case errMergedChanged:
+				errorWithCode(w, problem.CodeRevisionConflict, "The car to merge from was changed by someone else; try again",
+					http.StatusConflict)
+				return
+			case mongo.ErrNoDocuments:
+				missingOrConflict(w, r, cars, intoVIN, rev)
+				return
+			}
+		}
+
+		audit.change(r.Context(), auditDeleted, fromVIN, &other, &tombstone)
+		audit.change(r.Context(), auditMerged, intoVIN, &before, &merged)
+
+		w.Header().Set("ETag", carETag(merged))
+		respBody, err := json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// mergedInto returns the VINs of the cars merged into the car with the VIN,
+// and of those merged into them in turn.
+func mergedInto(ctx context.Context, cars vehicleRepository, intoVIN string) ([]string, error) {
+	vins := []string{}
+	next := []string{intoVIN}
+	for len(next) > 0 {
+		params := ListParams{
+			Filter:     bson.M{"mergedinto": bson.M{"$in": next}, "deletedat": bson.M{"$exists": true}},
+			Projection: bson.M{"vin": 1},
+		}
+		next = nil
+		err := cars.each(ctx, params, func(car vehicle) error {
+			next = append(next, car.VIN)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		vins = append(vins, next...)
+	}
+	return vins, nil
+}
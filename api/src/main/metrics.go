@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "carsupermarket_http_requests_total",
+		Help: "HTTP requests by method, route and status class.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "carsupermarket_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "carsupermarket_mongo_command_duration_seconds",
+		Help:    "MongoDB command latency by command and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command", "outcome"})
+
+	mongoCheckouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "carsupermarket_mongo_connection_checkouts_total",
+		Help: "Connections checked out of the MongoDB pool.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, mongoDuration, mongoCheckouts)
+}
+
+// instrument records request counts and latencies, labelled with the route
+// pattern that matched rather than the raw path.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+
+		h.ServeHTTP(rec, r)
+
+		route := routePattern(r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status/100)+"xx").Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// commandMonitor records command latencies and traces each command. Commands
+// that succeed close b, if there is one.
+func commandMonitor(b *breaker) *event.CommandMonitor {
+	spans := &mongoSpans{}
+
+	return &event.CommandMonitor{
+		Started: spans.started,
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+			spans.finished(&e.CommandFinishedEvent, "")
+			if b != nil {
+				b.succeeded()
+			}
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+			spans.finished(&e.CommandFinishedEvent, e.Failure)
+		},
+	}
+}
+
+func poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			if e.Type == event.GetSucceeded {
+				mongoCheckouts.Inc()
+			}
+		},
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"problem"
+
+	"goji.io/middleware"
+)
+
+// routePattern returns the route pattern that matched r, for use as a low
+// cardinality label, or "unmatched".
+func routePattern(r *http.Request) string {
+	if p := middleware.Pattern(r.Context()); p != nil {
+		if s, ok := p.(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+	return "unmatched"
+}
+
+// statusRecorder remembers the status code written through it. It keeps the
+// Flusher and Hijacker behaviour of the wrapped writer so that event streams
+// and WebSocket upgrades still work behind middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// recoverPanics answers a request whose handler panics with 500 and logs the
+// panic with its stack, so that one bad request cannot take the server down.
+// Requests aborted with http.ErrAbortHandler are left to the server.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "Panic serving request", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			// Once the response has started it can only be cut short.
+			if pw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			errorWithCode(w, problem.CodeInternal, "Internal server error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(pw, r)
+	})
+}
+
+// panicWriter remembers whether a response has been started.
+type panicWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (pw *panicWriter) WriteHeader(code int) {
+	pw.wrote = true
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *panicWriter) Write(b []byte) (int, error) {
+	pw.wrote = true
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *panicWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (pw *panicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := pw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	pw.wrote = true
+	return h.Hijack()
+}
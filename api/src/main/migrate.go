@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"migrations"
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// carMigrations are the changes made to the stored cars over time. They are
+// applied at startup, before the indexes are made. Append new steps with the
+// next version; never change or reorder those already released. refs are the
+// other collections that refer to cars by VIN, with the key they keep it in.
+func carMigrations(cars, archive *mongo.Collection, refs map[*mongo.Collection]string) []migrations.Migration {
+	return []migrations.Migration{
+		{
+			Version: 1,
+			Name:    "drop the indexes made before tenancy",
+			Up: func(ctx context.Context) error {
+				return dropIndexes(ctx, map[*mongo.Collection][]string{
+					cars:    {"vin_1", "manurfacturer_text_model_text_regno_text"},
+					archive: {"vin_1"},
+				})
+			},
+		},
+		{
+			Version: 2,
+			Name:    "give a status to the cars stored before there were any",
+			Up: func(ctx context.Context) error {
+				if err := backfillStatus(ctx, cars); err != nil {
+					return err
+				}
+				return backfillStatus(ctx, archive)
+			},
+		},
+		{
+			Version: 3,
+			Name:    "store the manufacturer under manufacturer instead of manurfacturer",
+			Up: func(ctx context.Context) error {
+				// The indexes on the old key are made again on the new one.
+				err := dropIndexes(ctx, map[*mongo.Collection][]string{
+					cars: {"tenant_1_manurfacturer_1_model_1", "tenant_1_manurfacturer_text_model_text_regno_text"},
+				})
+				if err != nil {
+					return err
+				}
+				for _, c := range []*mongo.Collection{cars, archive} {
+					_, err := c.UpdateMany(ctx, bson.M{"manurfacturer": bson.M{"$exists": true}},
+						bson.M{"$rename": bson.M{"manurfacturer": "manufacturer"}})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 4,
+			Name:    "make registrations unique within a tenant",
+			Up: func(ctx context.Context) error {
+				// The unique index cannot be made while cars share a
+				// registration, so those must be told apart first.
+				if err := sharedRegNos(ctx, cars); err != nil {
+					return err
+				}
+				return dropIndexes(ctx, map[*mongo.Collection][]string{cars: {regNoIndex}})
+			},
+		},
+		{
+			Version: 5,
+			Name:    "store VINs and registrations upper-cased and without spaces",
+			Up: func(ctx context.Context) error {
+				// Cars whose VINs or registrations only differ by case or
+				// spacing collide here, on the unique indexes, and fail the
+				// migration; they must be told apart by hand.
+				for _, c := range []*mongo.Collection{cars, archive} {
+					for _, key := range []string{"vin", "regno"} {
+						if err := normalizeKey(ctx, c, key); err != nil {
+							return err
+						}
+					}
+				}
+				for c, key := range refs {
+					if err := normalizeKey(ctx, c, key); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 6,
+			Name:    "date when cars on sale were listed",
+			Up: func(ctx context.Context) error {
+				// Cars listed before it was recorded are taken to have been
+				// listed when they were added, which their IDs tell.
+				for _, c := range []*mongo.Collection{cars, archive} {
+					_, err := c.UpdateMany(ctx,
+						bson.M{"listedat": bson.M{"$exists": false}, "status": bson.M{"$ne": carInPrep}},
+						mongo.Pipeline{{{Key: "$set", Value: bson.M{"listedat": bson.M{"$toDate": "$_id"}}}}})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// legacyManufacturerSchedule is when the cars still stored with the
+// misspelt key are moved to the right one.
+const legacyManufacturerSchedule = "15 3 * * *"
+
+// carRegistry is the registry cars are decoded with, taking a car's
+// manufacturer from the manurfacturer key when it has none under
+// manufacturer. Migration 3 moved every car off that key, but cars written by
+// instances older than it, while it rolled out, or restored from backups made
+// before it, are stored so until backfillManufacturer moves them. The types
+// that hold a car inline are registered too, as their fields are decoded in
+// place of the car's decoder.
+func carRegistry() *bsoncodec.Registry {
+	reg := bson.NewRegistry()
+	reg.RegisterTypeDecoder(reflect.TypeOf(vehicle{}), legacyManufacturer(func(v reflect.Value) *vehicle {
+		return v.Addr().Interface().(*vehicle)
+	}))
+	reg.RegisterTypeDecoder(reflect.TypeOf(archivedVehicle{}), legacyManufacturer(func(v reflect.Value) *vehicle {
+		return &v.Addr().Interface().(*archivedVehicle).Vehicle
+	}))
+	reg.RegisterTypeDecoder(reflect.TypeOf(similarCar{}), legacyManufacturer(func(v reflect.Value) *vehicle {
+		return &v.Addr().Interface().(*similarCar).Vehicle
+	}))
+	return reg
+}
+
+// legacyManufacturer decodes a struct as the driver does, then sets the
+// manufacturer of the car in it, which car returns, from the manurfacturer
+// key if it was not stored under manufacturer.
+func legacyManufacturer(car func(reflect.Value) *vehicle) bsoncodec.ValueDecoder {
+	structs, err := bsoncodec.NewStructCodec(bsoncodec.DefaultStructTagParser)
+	if err != nil {
+		panic(err)
+	}
+	return bsoncodec.ValueDecoderFunc(func(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+		if t := vr.Type(); t == bsontype.Null || t == bsontype.Undefined {
+			return structs.DecodeValue(dc, vr, val)
+		}
+		doc, err := bsonrw.Copier{}.CopyDocumentToBytes(vr)
+		if err != nil {
+			return err
+		}
+		if err := structs.DecodeValue(dc, bsonrw.NewBSONDocumentReader(doc), val); err != nil {
+			return err
+		}
+		if v := car(val); v.Manurfacturer == "" {
+			if legacy, ok := bson.Raw(doc).Lookup("manurfacturer").StringValueOK(); ok {
+				v.Manurfacturer = legacy
+			}
+		}
+		return nil
+	})
+}
+
+// backfillManufacturer moves the manufacturer of the cars, and archived cars,
+// still stored under the manurfacturer key to manufacturer, as migration 3
+// did once. Those stored under both, having been written since by an update
+// of a newer instance, keep manufacturer, and lose the stale key.
+func backfillManufacturer(cars, archive *mongo.Collection) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var moved, dropped int64
+		for _, c := range []*mongo.Collection{cars, archive} {
+			res, err := c.UpdateMany(ctx,
+				bson.M{"manurfacturer": bson.M{"$exists": true}, "manufacturer": bson.M{"$exists": false}},
+				bson.M{"$rename": bson.M{"manurfacturer": "manufacturer"}, "$inc": incRevision})
+			if err != nil {
+				return fmt.Errorf("move legacy manufacturers of %s: %w", c.Name(), err)
+			}
+			moved += res.ModifiedCount
+			res, err = c.UpdateMany(ctx,
+				bson.M{"manurfacturer": bson.M{"$exists": true}},
+				bson.M{"$unset": bson.M{"manurfacturer": ""}})
+			if err != nil {
+				return fmt.Errorf("drop legacy manufacturers of %s: %w", c.Name(), err)
+			}
+			dropped += res.ModifiedCount
+		}
+		if moved > 0 || dropped > 0 {
+			slog.InfoContext(ctx, "Backfilled legacy manufacturers", "moved", moved, "dropped", dropped)
+		}
+		return nil
+	}
+}
+
+// normalizeKey stores the string under key, where it has lower-case letters
+// or whitespace, as vin.Normalize would give it.
+func normalizeKey(ctx context.Context, c *mongo.Collection, key string) error {
+	field := "$" + key
+	var stripped interface{} = field
+	for _, space := range []string{" ", "\t", "\n", "\r"} {
+		stripped = bson.M{"$replaceAll": bson.M{"input": stripped, "find": space, "replacement": ""}}
+	}
+	_, err := c.UpdateMany(ctx,
+		bson.M{key: bson.M{"$type": "string", "$regex": `[a-z\s]`}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{key: bson.M{"$toUpper": stripped}}}}})
+	return err
+}
+
+// sharedRegNos returns an error naming some of the registrations that more
+// than one car of a tenant has.
+func sharedRegNos(ctx context.Context, cars *mongo.Collection) error {
+	cur, err := cars.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"regno": bson.M{"$gt": ""}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"tenant": "$tenant", "regno": "$regno"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 10}},
+	})
+	if err != nil {
+		return err
+	}
+	var shared []struct {
+		ID struct {
+			Tenant string
+			RegNo  string
+		} `bson:"_id"`
+	}
+	if err := cur.All(ctx, &shared); err != nil {
+		return err
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	regnos := make([]string, len(shared))
+	for i, s := range shared {
+		regnos[i] = s.ID.Tenant + "/" + s.ID.RegNo
+	}
+	return fmt.Errorf("cars share the registrations %s; give each its own, or remove it, and start again", strings.Join(regnos, ", "))
+}
+
+func dropIndexes(ctx context.Context, indexes map[*mongo.Collection][]string) error {
+	for c, names := range indexes {
+		for _, name := range names {
+			if err := dropIndex(ctx, c, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrationStatus lists the migrations applied and those still pending.
+func migrationStatus(c *mongo.Collection, steps []migrations.Migration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applied, err := migrations.Applied(r.Context(), c)
+		var pending []migrations.Migration
+		if err == nil {
+			pending, err = migrations.Pending(r.Context(), c, steps)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list migrations", "err", err)
+			return
+		}
+
+		type step struct {
+			Version int    `json:"version"`
+			Name    string `json:"name"`
+		}
+		resp := struct {
+			Applied []migrations.Record `json:"applied"`
+			Pending []step              `json:"pending"`
+		}{Applied: applied, Pending: []step{}}
+		for _, m := range pending {
+			resp.Pending = append(resp.Pending, step{m.Version, m.Name})
+		}
+
+		respBody, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
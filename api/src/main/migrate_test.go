@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLegacyManufacturerDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  bson.M
+		want string
+	}{
+		{"misspelt key", bson.M{"manurfacturer": "Ford", "vin": "V1"}, "Ford"},
+		{"correct key", bson.M{"manufacturer": "Vauxhall", "vin": "V1"}, "Vauxhall"},
+		{"both keys", bson.M{"manufacturer": "Vauxhall", "manurfacturer": "Ford", "vin": "V1"}, "Vauxhall"},
+		{"neither key", bson.M{"vin": "V1"}, ""},
+	}
+	reg := carRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var car vehicle
+			if err := bson.UnmarshalWithRegistry(reg, b, &car); err != nil {
+				t.Fatal(err)
+			}
+			if car.Manurfacturer != tt.want || car.VIN != "V1" {
+				t.Errorf("car decoded as %q %q, want %q V1", car.Manurfacturer, car.VIN, tt.want)
+			}
+
+			var held struct {
+				Car  *vehicle
+				Cars []vehicle
+			}
+			b, err = bson.Marshal(bson.M{"car": tt.doc, "cars": bson.A{tt.doc}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bson.UnmarshalWithRegistry(reg, b, &held); err != nil {
+				t.Fatal(err)
+			}
+			if held.Car.Manurfacturer != tt.want || held.Cars[0].Manurfacturer != tt.want {
+				t.Errorf("held cars decoded as %q and %q, want %q", held.Car.Manurfacturer, held.Cars[0].Manurfacturer, tt.want)
+			}
+
+			doc := bson.M{"archived_at": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), "score": 1.5}
+			for k, v := range tt.doc {
+				doc[k] = v
+			}
+			b, err = bson.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var archived archivedVehicle
+			if err := bson.UnmarshalWithRegistry(reg, b, &archived); err != nil {
+				t.Fatal(err)
+			}
+			if archived.Vehicle.Manurfacturer != tt.want || archived.ArchivedAt.IsZero() {
+				t.Errorf("archived car decoded as %q at %v, want %q", archived.Vehicle.Manurfacturer, archived.ArchivedAt, tt.want)
+			}
+			var similar similarCar
+			if err := bson.UnmarshalWithRegistry(reg, b, &similar); err != nil {
+				t.Fatal(err)
+			}
+			if similar.Vehicle.Manurfacturer != tt.want || similar.Score != 1.5 {
+				t.Errorf("similar car decoded as %q scoring %v, want %q", similar.Vehicle.Manurfacturer, similar.Score, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyManufacturerRoundTrip(t *testing.T) {
+	b, err := bson.Marshal(bson.M{"manurfacturer": "Ford", "model": "Focus", "vin": "V1", "revision": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var car vehicle
+	if err := bson.UnmarshalWithRegistry(carRegistry(), b, &car); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written back, the car is stored under the right key only.
+	b, err = bson.Marshal(car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["manufacturer"] != "Ford" {
+		t.Errorf("manufacturer stored as %v", doc["manufacturer"])
+	}
+	if _, ok := doc["manurfacturer"]; ok {
+		t.Errorf("misspelt key written back: %v", doc)
+	}
+}
+
+func TestBackfillManufacturer(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	cars, archive := db.Collection("cars"), db.Collection("archive")
+
+	_, err := cars.InsertMany(ctx, []interface{}{
+		bson.M{"vin": "LEGACY", "manurfacturer": "Ford", "revision": 1},
+		bson.M{"vin": "BOTH", "manufacturer": "Vauxhall", "manurfacturer": "Ford", "revision": 4},
+		bson.M{"vin": "CURRENT", "manufacturer": "Kia", "revision": 2},
+	})
+	if err == nil {
+		_, err = archive.InsertOne(ctx, bson.M{"vin": "ARCHIVED", "manurfacturer": "Rover", "revision": 7})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backfill := backfillManufacturer(cars, archive)
+	for i := 0; i < 2; i++ {
+		if err := backfill(ctx); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+
+	want := []struct {
+		c         string
+		vin, make string
+		revision  int64
+	}{
+		{"cars", "LEGACY", "Ford", 2},
+		{"cars", "BOTH", "Vauxhall", 4},
+		{"cars", "CURRENT", "Kia", 2},
+		{"archive", "ARCHIVED", "Rover", 8},
+	}
+	for _, w := range want {
+		var doc bson.M
+		if err := db.Collection(w.c).FindOne(ctx, bson.M{"vin": w.vin}).Decode(&doc); err != nil {
+			t.Fatalf("%s %s: %v", w.c, w.vin, err)
+		}
+		if doc["manufacturer"] != w.make {
+			t.Errorf("%s %s: manufacturer = %v, want %s", w.c, w.vin, doc["manufacturer"], w.make)
+		}
+		if _, ok := doc["manurfacturer"]; ok {
+			t.Errorf("%s %s: misspelt key left", w.c, w.vin)
+		}
+		if rev, _ := number(doc["revision"]); int64(rev) != w.revision {
+			t.Errorf("%s %s: revision = %v, want %d", w.c, w.vin, doc["revision"], w.revision)
+		}
+	}
+}
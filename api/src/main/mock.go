@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goji.io"
+	"goji.io/pat"
+
+	"config"
+)
+
+// mockDepth is how deeply nested the objects made up for a response are;
+// deeper ones are left out.
+const mockDepth = 4
+
+// serveMock serves the API without a database, for frontends to be built
+// against. The car endpoints read and write cars generated as SEED_VALUE
+// gives, kept in memory; every other operation of the OpenAPI document
+// answers with data made up to fit its response. Each request is delayed
+// by MOCK_LATENCY and fails with MOCK_ERROR_RATE, and no credentials are
+// needed.
+func serveMock(cfg *config.Config) error {
+	slog.Warn("Serving the mock API; no data is stored", "addr", cfg.ListenAddr, "cars", cfg.MockCars)
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      mockHandler(cfg),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	return server.ListenAndServe()
+}
+
+// mockHandler routes the requests to the mock API.
+func mockHandler(cfg *config.Config) http.Handler {
+	repo := newMemoryVehicles()
+	events := newBroker()
+	audit := &auditLog{}
+	tenants := &tenancy{required: cfg.RequireTenant, fallback: cfg.DefaultTenant}
+	seedRepository(withTenant(context.Background(), cfg.DefaultTenant), repo, events, audit, cfg.SeedValue, cfg.MockCars)
+
+	var corsP atomic.Pointer[corsPolicy]
+	corsP.Store(newCORSPolicy(cfg.CORSAllowedOrigins, cfg.CORSAllowedMethods, cfg.CORSAllowedHeaders,
+		cfg.CORSExposedHeaders, cfg.CORSMaxAge))
+
+	mux := goji.NewMux()
+	mux.Use(logRequests)
+	mux.Use(recoverPanics)
+	mux.Use(cors(&corsP))
+	mux.Use(negotiateContent)
+	mux.Use(injectFaults(cfg.MockLatency, cfg.MockErrorRate, cfg.SeedValue))
+	mux.Use(scopeTenant(tenants))
+
+	mux.HandleFunc(pat.Get(route("/healthz")), healthz)
+	mux.HandleFunc(pat.Get(route("/readyz")), healthz)
+	mux.HandleFunc(pat.Get(route("/openapi.json")), openAPI())
+	mux.HandleFunc(pat.Get(route("/docs")), apiDocs)
+
+	memoryCarRoutes(mux, repo, events, audit)
+
+	fake := &mockData{rng: rand.New(rand.NewSource(cfg.SeedValue))}
+	fake.route(mux, openAPISpec())
+	mux.HandleFunc(pat.New("/*"), unknownRoute)
+	return versioned(mux)
+}
+
+// memoryCarRoutes registers the car endpoints served from the cars kept in
+// the process, which the servers without a database have.
+func memoryCarRoutes(mux *goji.Mux, repo vehicleRepository, events *broker, audit *auditLog) {
+	mux.HandleFunc(pat.Get(apiRoute("/cars")), withoutCurrency(withoutStores(allCars(repo, nil, nil, nil))))
+	mux.HandleFunc(pat.Post(apiRoute("/cars")), addCar(repo, nil, events, audit))
+	mux.HandleFunc(pat.Get(apiRoute("/cars/:vin")), withoutCurrency(carByVIN(repo, nil)))
+	mux.HandleFunc(pat.Put(apiRoute("/cars/:vin")), updateCar(repo, events, audit))
+	mux.HandleFunc(pat.Patch(apiRoute("/cars/:vin")), patchCar(repo, events, audit))
+	mux.HandleFunc(pat.Delete(apiRoute("/cars/:vin")), deleteCar(repo, events, audit))
+}
+
+// withoutCurrency refuses ?currency=, as a server without a database has
+// no exchange rates to convert prices with.
+func withoutCurrency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("currency") != "" {
+			fieldErrorWithJSON(w, "currency", "unsupported", "Prices are not converted without a database")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withoutStores refuses ?near= and ?reduced_within_days=, as a server
+// without a database has no dealerships or price history to narrow the cars
+// listed by.
+func withoutStores(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"near", "reduced_within_days"} {
+			if _, ok := r.URL.Query()[name]; ok {
+				fieldErrorWithJSON(w, name, "unsupported", "Dealerships and price history are not kept without a database")
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// injectFaults delays every request by latency, give or take a quarter, and
+// fails errorRate of them with 500 or 503, as a frontend must cope with.
+func injectFaults(latency time.Duration, errorRate float64, seed int64) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			jitter := rng.Float64()/2 + 0.75
+			fail := rng.Float64() < errorRate
+			unavailable := rng.Intn(2) == 0
+			mu.Unlock()
+
+			if latency > 0 {
+				select {
+				case <-time.After(time.Duration(float64(latency) * jitter)):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if fail && !strings.HasPrefix(r.URL.Path, route("/healthz")) {
+				if unavailable {
+					w.Header().Set("Retry-After", "1")
+					errorWithJSON(w, "Injected failure", http.StatusServiceUnavailable)
+					return
+				}
+				errorWithJSON(w, "Injected failure", http.StatusInternalServerError)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// mockData makes up the responses of the operations the mock server has no
+// handler of its own for, from the schemas of the OpenAPI document.
+type mockData struct {
+	schemas obj
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// route registers a handler for every operation in spec. The handlers
+// registered before take precedence.
+func (m *mockData) route(mux *goji.Mux, spec obj) {
+	m.schemas = spec["components"].(obj)["schemas"].(obj)
+	eachOperation(spec, func(p *pat.Pattern, op obj) {
+		mux.HandleFunc(p, m.respond(op))
+	})
+}
+
+// eachOperation calls fn with the route and the definition of every
+// operation in spec, in the order of their paths.
+func eachOperation(spec obj, fn func(p *pat.Pattern, op obj)) {
+	paths := spec["paths"].(obj)
+	names := make([]string, 0, len(paths))
+	for path := range paths {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+	for _, path := range names {
+		pattern := apiRoute(pathParamPattern.ReplaceAllString(path, ":$1"))
+		for method, op := range paths[path].(obj) {
+			op, ok := op.(obj)
+			if !ok {
+				continue
+			}
+			fn(pat.NewWithMethods(pattern, strings.ToUpper(method)), op)
+		}
+	}
+}
+
+// respond answers as op does when it succeeds, with the first of its 2xx
+// responses.
+func (m *mockData) respond(op obj) http.HandlerFunc {
+	responses := op["responses"].(obj)
+	codes := []int{}
+	for code := range responses {
+		if n, err := strconv.Atoi(code); err == nil && n/100 == 2 {
+			codes = append(codes, n)
+		}
+	}
+	sort.Ints(codes)
+	status := http.StatusOK
+	var schema obj
+	if len(codes) > 0 {
+		status = codes[0]
+		resp := responses[strconv.Itoa(status)].(obj)
+		if content, ok := resp["content"].(obj); ok {
+			if body, ok := content["application/json"].(obj); ok {
+				schema, _ = body["schema"].(obj)
+			}
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if schema == nil {
+			w.WriteHeader(status)
+			return
+		}
+		m.mu.Lock()
+		v := m.value(schema, "", 0)
+		m.mu.Unlock()
+
+		respBody, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, status)
+	}
+}
+
+// value makes up a value of schema for a property called name. The caller
+// holds mu.
+func (m *mockData) value(schema obj, name string, depth int) interface{} {
+	if ref, ok := schema["$ref"].(string); ok {
+		s, _ := m.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(obj)
+		return m.value(s, name, depth)
+	}
+	for _, key := range []string{"allOf", "oneOf", "anyOf"} {
+		if all, ok := schema[key].([]obj); ok && len(all) > 0 {
+			return m.value(all[0], name, depth)
+		}
+	}
+	if example, ok := schema["example"]; ok {
+		return example
+	}
+	if enum, ok := schema["enum"].([]string); ok && len(enum) > 0 {
+		return enum[m.rng.Intn(len(enum))]
+	}
+
+	switch schema["type"] {
+	case "object":
+		v := map[string]interface{}{}
+		props, _ := schema["properties"].(obj)
+		if depth >= mockDepth {
+			return v
+		}
+		for prop, s := range props {
+			if s, ok := s.(obj); ok {
+				v[prop] = m.value(s, prop, depth+1)
+			}
+		}
+		return v
+	case "array":
+		items, _ := schema["items"].(obj)
+		if items == nil || depth >= mockDepth {
+			return []interface{}{}
+		}
+		v := make([]interface{}, 1+m.rng.Intn(3))
+		for i := range v {
+			v[i] = m.value(items, name, depth+1)
+		}
+		return v
+	case "integer":
+		min := 0
+		if n, ok := schema["minimum"].(int); ok {
+			min = n
+		}
+		switch {
+		case name == "year" || strings.HasSuffix(name, "_year"):
+			return seedOldestYear + m.rng.Intn(seedNewestYear-seedOldestYear+1)
+		case name == "amount" || strings.HasPrefix(name, "price"):
+			return (200 + m.rng.Intn(4000)) * 5000
+		}
+		return min + m.rng.Intn(100)
+	case "number":
+		return float64(m.rng.Intn(10000)) / 100
+	case "boolean":
+		return m.rng.Intn(2) == 0
+	case "string":
+		return m.text(schema, name)
+	}
+	return nil
+}
+
+// text makes up a string of schema for a property called name.
+func (m *mockData) text(schema obj, name string) string {
+	now := time.Now().UTC()
+	switch schema["format"] {
+	case "date-time":
+		return now.Add(-time.Duration(m.rng.Intn(30*24)) * time.Hour).Truncate(time.Second).Format(time.RFC3339)
+	case "date":
+		return now.AddDate(0, 0, -m.rng.Intn(365)).Format("2006-01-02")
+	case "email":
+		return fmt.Sprintf("customer%d@example.com", m.rng.Intn(1000))
+	case "uri":
+		return "https://example.com/" + m.hex(4)
+	}
+
+	switch {
+	case name == "vin":
+		return seedVIN(m.rng, "WVW", seedNewestYear, m.rng.Intn(1000000))
+	case name == "regno":
+		return seedRegNo(m.rng, seedNewestYear)
+	case name == "manufacturer":
+		return seedFixtures[m.rng.Intn(len(seedFixtures))].name
+	case name == "colour":
+		return seedColours[m.rng.Intn(len(seedColours))]
+	case name == "currency":
+		return "GBP"
+	case name == "id" || strings.HasSuffix(name, "_id"):
+		return m.hex(12)
+	}
+	if name == "" {
+		name = "value"
+	}
+	return name + "-" + m.hex(3)
+}
+
+func (m *mockData) hex(n int) string {
+	b := make([]byte, n)
+	m.rng.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"config"
+	"problem"
+)
+
+func TestMockListsCarsAsNDJSON(t *testing.T) {
+	h := mockHandler(&config.Config{MockCars: 5, SeedValue: 1})
+
+	req := httptest.NewRequest(http.MethodGet, apiRoute("/cars")+"?format=ndjson", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/x-ndjson") {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	lines := 0
+	for sc := bufio.NewScanner(rec.Body); sc.Scan(); lines++ {
+		if !strings.HasPrefix(sc.Text(), "{") {
+			t.Errorf("line %d = %q, want a car", lines+1, sc.Text())
+		}
+	}
+	if lines != 5 {
+		t.Errorf("got %d lines, want 5", lines)
+	}
+}
+
+func TestMockRefusesStores(t *testing.T) {
+	h := mockHandler(&config.Config{MockCars: 1, SeedValue: 1})
+	for _, query := range []string{"near=51.5,-0.1", "reduced_within_days=7", "currency=EUR"} {
+		req := httptest.NewRequest(http.MethodGet, apiRoute("/cars")+"?"+query, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("?%s: status = %d, want 422", query, rec.Code)
+		}
+	}
+}
+
+func TestMemoryServesCarsAlone(t *testing.T) {
+	h := memoryHandler(&config.Config{SeedCars: 3, SeedValue: 1})
+
+	req := httptest.NewRequest(http.MethodGet, apiRoute("/cars"), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /cars: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	wantTotal(3)(t, rec)
+
+	for _, target := range []string{"/dealerships", "/orders", "/cars/WF0AXXGCDA1234567/history"} {
+		req := httptest.NewRequest(http.MethodGet, apiRoute(target), nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s: status = %d, want 501", target, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), problem.CodeNotImplemented) {
+			t.Errorf("GET %s: body = %s, want code %s", target, rec.Body, problem.CodeNotImplemented)
+		}
+	}
+}
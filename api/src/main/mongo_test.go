@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase returns a database of its own for the test, on the MongoDB
+// TEST_MONGO_URI names, dropped when the test ends. Tests needing one are
+// skipped without it.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGO_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetRegistry(carRegistry()))
+	if err == nil {
+		err = client.Ping(ctx, nil)
+	}
+	if err != nil {
+		t.Fatalf("connect to %s: %v", uri, err)
+	}
+
+	db := client.Database("cars_test_" + strconv.FormatInt(time.Now().UnixNano(), 36))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := db.Drop(ctx); err != nil {
+			t.Logf("drop %s: %v", db.Name(), err)
+		}
+		client.Disconnect(ctx)
+	})
+	return db
+}
+
+// TestTransactShadowsOnCommit checks the writes to a shadow storage in a
+// transaction are made once it commits, and not when it is retried or
+// aborted.
+func TestTransactShadowsOnCommit(t *testing.T) {
+	db := testDatabase(t)
+	events := newBroker()
+	events.out = newOutbox(db.Collection("outbox"), db.Client(), time.Hour)
+	shadow := newMemoryVehicles()
+	repo := newShadowVehicles(&mongoVehicles{c: db.Collection("cars"), archive: db.Collection("archive")}, shadow, 1)
+	ctx := context.WithValue(withTenant(context.Background(), "shadowed"), shadowKey{}, flagShadowWrites)
+
+	cars := seedCars(1, 2)
+	for i := range cars {
+		if err := prepareNewCar(ctx, &cars[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attempts := 0
+	err := events.transact(ctx, func(ctx context.Context) error {
+		attempts++
+		if err := repo.create(ctx, cars[0]); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return mongo.CommandError{Message: "retry", Labels: []string{"TransientTransactionError"}}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("transact = %v after %d attempts, want nil after 2", err, attempts)
+	}
+	if _, err := shadow.get(ctx, cars[0].VIN, nil); err != nil {
+		t.Errorf("shadow get %s: %v", cars[0].VIN, err)
+	}
+
+	aborted := errors.New("aborted")
+	err = events.transact(ctx, func(ctx context.Context) error {
+		if err := repo.create(ctx, cars[1]); err != nil {
+			return err
+		}
+		return aborted
+	})
+	if !errors.Is(err, aborted) {
+		t.Fatalf("transact = %v, want %v", err, aborted)
+	}
+	if n, err := shadow.count(ctx, bson.M{}); err != nil || n != 1 {
+		t.Errorf("shadow holds %d cars (%v), want 1", n, err)
+	}
+}
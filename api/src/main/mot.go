@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// motTest is one MOT test of a vehicle.
+type motTest struct {
+	Number      string    `json:"number"`
+	CompletedAt time.Time `json:"completed_at"`
+	// Result is passed or failed.
+	Result       string `json:"result"`
+	ExpiryDate   string `json:"expiry_date,omitempty"`
+	Odometer     int    `json:"odometer,omitempty"`
+	OdometerUnit string `json:"odometer_unit,omitempty"`
+	// Failures are the defects the vehicle failed on; Advisories and Minor
+	// are those it passed with.
+	Failures   []string `json:"failures,omitempty"`
+	Advisories []string `json:"advisories,omitempty"`
+	Minor      []string `json:"minor,omitempty"`
+}
+
+// motProvider fetches the MOT tests of the vehicle with a registration,
+// latest first. It returns errRegNotFound when it knows of no such vehicle.
+type motProvider interface {
+	motHistory(ctx context.Context, regno string) ([]motTest, error)
+}
+
+// dvsaClient fetches MOT history from the DVSA MOT history API.
+type dvsaClient struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func newDVSAClient(url, apiKey string) *dvsaClient {
+	return &dvsaClient{url: strings.TrimSuffix(url, "/"), apiKey: apiKey, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type dvsaVehicle struct {
+	MOTTests []struct {
+		MOTTestNumber string    `json:"motTestNumber"`
+		CompletedDate time.Time `json:"completedDate"`
+		TestResult    string    `json:"testResult"`
+		ExpiryDate    string    `json:"expiryDate"`
+		OdometerValue string    `json:"odometerValue"`
+		OdometerUnit  string    `json:"odometerUnit"`
+		Defects       []struct {
+			Text string `json:"text"`
+			Type string `json:"type"`
+		} `json:"defects"`
+	} `json:"motTests"`
+}
+
+func (d *dvsaClient) motHistory(ctx context.Context, regno string) ([]motTest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url+"/"+url.PathEscape(regno), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-Key", d.apiKey)
+	forwardRequestID(req)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errRegNotFound
+	default:
+		return nil, fmt.Errorf("MOT history: %s", resp.Status)
+	}
+
+	var v dvsaVehicle
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("MOT history: %v", err)
+	}
+
+	tests := make([]motTest, 0, len(v.MOTTests))
+	for _, t := range v.MOTTests {
+		test := motTest{
+			Number:       t.MOTTestNumber,
+			CompletedAt:  t.CompletedDate,
+			Result:       strings.ToLower(t.TestResult),
+			ExpiryDate:   t.ExpiryDate,
+			OdometerUnit: strings.ToLower(t.OdometerUnit),
+		}
+		// The odometer is unreadable on some tests.
+		test.Odometer, _ = strconv.Atoi(t.OdometerValue)
+		for _, d := range t.Defects {
+			switch d.Type {
+			case "ADVISORY":
+				test.Advisories = append(test.Advisories, d.Text)
+			case "MINOR":
+				test.Minor = append(test.Minor, d.Text)
+			default:
+				test.Failures = append(test.Failures, d.Text)
+			}
+		}
+		tests = append(tests, test)
+	}
+	return tests, nil
+}
+
+// motHistory answers MOT history from a provider, cached per registration
+// for ttl. A vehicle's history only changes when it is tested, so it can be
+// cached for long.
+type motHistory struct {
+	provider motProvider
+	cache    cacheStore
+	ttl      time.Duration
+}
+
+func (m *motHistory) tests(ctx context.Context, regno string) ([]motTest, error) {
+	regno = normalRegNo(regno)
+	key := "mot:" + regno
+
+	var tests []motTest
+	if b, ok := m.cache.get(key); ok && json.Unmarshal(b, &tests) == nil {
+		return tests, nil
+	}
+
+	tests, err := m.provider.motHistory(ctx, regno)
+	if err != nil {
+		return nil, err
+	}
+	if m.ttl > 0 {
+		b, err := json.Marshal(tests)
+		if err != nil {
+			panic(err)
+		}
+		m.cache.set(key, b, m.ttl)
+	}
+	return tests, nil
+}
+
+// carMOTHistory returns the MOT tests of a car by its registration, with the
+// service history kept for it alongside.
+func carMOTHistory(c *mongo.Collection, services *serviceHistoryStore, m *motHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m == nil {
+			errorWithJSON(w, "MOT history is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+		if normalRegNo(car.RegNo) == "" {
+			errorWithJSON(w, "The car has no registration to look its MOT history up by", http.StatusConflict)
+			return
+		}
+
+		tests, err := m.tests(r.Context(), car.RegNo)
+		switch err {
+		case nil:
+		case errRegNotFound:
+			// A car too new for its first MOT has no history.
+			tests = []motTest{}
+		default:
+			w.Header().Set("Retry-After", "60")
+			errorWithJSON(w, "MOT history is unavailable", http.StatusServiceUnavailable)
+			slog.WarnContext(r.Context(), "Failed fetch MOT history", "regno", car.RegNo, "err", err)
+			return
+		}
+
+		records, err := services.forCar(r.Context(), car.VIN)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list service history", "err", err)
+			return
+		}
+
+		resp := struct {
+			VIN            string          `json:"vin"`
+			RegNo          string          `json:"regno"`
+			Tests          []motTest       `json:"tests"`
+			ServiceHistory []serviceRecord `json:"service_history"`
+		}{car.VIN, car.RegNo, tests, records}
+		respBody, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
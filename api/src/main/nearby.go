@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultNearRadius = 50
+	maxNearRadius     = 500
+)
+
+// branchDistance is how far a dealership is from a point.
+type branchDistance struct {
+	ID string  `bson:"dealershipid"`
+	Km float64 `bson:"km"`
+}
+
+// near returns the tenant's dealerships within radius km of point, nearest
+// first.
+func (s *dealershipStore) near(ctx context.Context, point geoPoint, radius float64) ([]branchDistance, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$geoNear", Value: bson.M{
+			"near":               point,
+			"distanceField":      "km",
+			"distanceMultiplier": 0.001,
+			"maxDistance":        radius * 1000,
+			"spherical":          true,
+			"query":              forTenant(ctx, bson.M{}),
+		}}},
+		{{Key: "$project", Value: bson.M{"dealershipid": 1, "km": 1}}},
+	}
+	var branches []branchDistance
+	cur, err := s.c.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cur.All(ctx, &branches)
+	}
+	return branches, err
+}
+
+// parseNear takes ?near=lat,lng and ?radius=km out of query and returns the
+// point and radius, or nil when the listing is not near a point.
+func parseNear(query url.Values) (*geoPoint, float64, error) {
+	v, ok := query["near"]
+	if !ok {
+		if _, ok := query["radius"]; ok {
+			return nil, 0, fmt.Errorf("Parameter \"radius\" needs \"near\"")
+		}
+		return nil, 0, nil
+	}
+	defer query.Del("near")
+	defer query.Del("radius")
+
+	lat, lng, ok := strings.Cut(v[0], ",")
+	la, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	ln, err2 := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if len(v) != 1 || !ok || err1 != nil || err2 != nil || la < -90 || la > 90 || ln < -180 || ln > 180 {
+		return nil, 0, fmt.Errorf("Parameter \"near\" must be a latitude and longitude, e.g. 51.5,-0.12")
+	}
+
+	radius := float64(defaultNearRadius)
+	if r := query.Get("radius"); r != "" {
+		radius, err1 = strconv.ParseFloat(r, 64)
+		if err1 != nil || radius <= 0 || radius > maxNearRadius {
+			return nil, 0, fmt.Errorf("Parameter \"radius\" must be a distance in km up to %d", maxNearRadius)
+		}
+	}
+	return &geoPoint{Type: "Point", Coordinates: [2]float64{ln, la}}, radius, nil
+}
+
+// nearCars narrows params to the cars at the dealerships within radius of
+// point, to be listed nearest first. It writes the error response and
+// returns false when it cannot.
+func nearCars(w http.ResponseWriter, r *http.Request, dealerships *dealershipStore, params *ListParams, point geoPoint, radius float64) bool {
+	switch {
+	case params.UseCursor:
+		errorWithJSON(w, "Parameter \"cursor\" cannot be combined with \"near\"", http.StatusBadRequest)
+		return false
+	case params.Sort != nil:
+		errorWithJSON(w, "Parameter \"sort\" cannot be combined with \"near\"; cars are listed nearest first", http.StatusBadRequest)
+		return false
+	case params.Filter["branch"] != nil:
+		errorWithJSON(w, "Parameter \"branch\" cannot be combined with \"near\"", http.StatusBadRequest)
+		return false
+	}
+
+	branches, err := dealerships.near(r.Context(), point, radius)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed find dealerships near", "err", err)
+		return false
+	}
+
+	ids := bson.A{}
+	for _, b := range branches {
+		ids = append(ids, b.ID)
+	}
+	params.Filter["branch"] = bson.M{"$in": ids}
+	params.near = branches
+	if params.near == nil {
+		params.near = []branchDistance{}
+	}
+	if params.Fields != nil {
+		params.Fields = append(params.Fields, "distance_km")
+	}
+	return true
+}
+
+// findNearPage returns the page of cars params asks for, nearest first, each
+// with its distance set.
+func findNearPage(ctx context.Context, c *mongo.Collection, params ListParams) ([]vehicle, error) {
+	ids, kms := bson.A{}, bson.A{}
+	for _, b := range params.near {
+		ids = append(ids, b.ID)
+		kms = append(kms, b.Km)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: params.Filter}},
+		{{Key: "$set", Value: bson.M{"distancekm": bson.M{"$arrayElemAt": bson.A{kms, bson.M{"$indexOfArray": bson.A{ids, "$branch"}}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "distancekm", Value: 1}, {Key: "vin", Value: 1}}}},
+		{{Key: "$skip", Value: params.Offset}},
+		{{Key: "$limit", Value: params.Limit}},
+	}
+	if params.Projection != nil {
+		projection := bson.M{"distancekm": 1}
+		for k, v := range params.Projection {
+			projection[k] = v
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+
+	cars := []vehicle{}
+	cur, err := c.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cur.All(ctx, &cars)
+	}
+	return cars, err
+}
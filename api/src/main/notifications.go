@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"notify"
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The kinds of notification, named after the templates they are written
+// from.
+const (
+	notifyReservation = "reservation_confirmed"
+	notifyPriceDrop   = "price_drop"
+	notifyTestDrive   = "test_drive_reminder"
+	notifyLowStock    = "low_stock"
+)
+
+// The statuses of a notification. Sent is handed to the provider, which may
+// still fail to deliver it.
+const (
+	notificationPending = "pending"
+	notificationSent    = "sent"
+	notificationFailed  = "failed"
+)
+
+const (
+	notificationRetrySchedule = "@every 1m"
+	testDriveReminderSchedule = "@every 5m"
+	// notificationTimeout bounds each attempt to send a notification.
+	notificationTimeout     = 30 * time.Second
+	notificationConcurrency = 4
+	// maxNotificationsListed is the most notifications listed at once.
+	maxNotificationsListed = 100
+)
+
+// notificationTemplate is a template as NOTIFICATION_TEMPLATES_FILE gives
+// it: text/template sources of the email subject and body and the text
+// message. Either body may be empty for the notification not to be sent on
+// that channel.
+type notificationTemplate struct {
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+	SMS     string `json:"sms"`
+}
+
+var defaultNotificationTemplates = map[string]notificationTemplate{
+	notifyReservation: {
+		Subject: "Your reservation of the {{.Title}}",
+		Email: `Hello {{.Name}},
+
+The {{.Title}}{{with .Car.RegNo}} ({{.}}){{end}} is reserved for you until {{.Until}}.{{with .Price}} Its price is {{.}}.{{end}}
+{{with .Branch}}
+It is at {{.Name}}{{with .Address}}{{with .Town}}, {{.}}{{end}}{{end}}.{{with .Phone}} Call us on {{.}} with any questions.{{end}}
+{{end}}{{with .ListingURL}}
+{{.}}
+{{end}}`,
+		SMS: `The {{.Title}} is reserved for you until {{.Until}}.{{with .Branch}}{{with .Phone}} Questions? Call {{.}}.{{end}}{{end}}`,
+	},
+	notifyPriceDrop: {
+		Subject: "Price drop: the {{.Title}} is now {{.Price}}",
+		Email: `Hello,
+
+The {{.Title}} on your watchlist has gone down from {{.OldPrice}} to {{.Price}}.
+{{with .ListingURL}}
+{{.}}
+{{end}}`,
+		SMS: `The {{.Title}} on your watchlist is now {{.Price}}, down from {{.OldPrice}}.{{with .ListingURL}} {{.}}{{end}}`,
+	},
+	notifyTestDrive: {
+		Subject: "Your test drive of the {{.Title}}",
+		Email: `Hello {{.Name}},
+
+This is a reminder of your test drive of the {{.Title}} at {{.Start}}.
+{{with .Branch}}
+Please come to {{.Name}}{{with .Address}}{{range .Lines}}, {{.}}{{end}}{{with .Town}}, {{.}}{{end}}{{with .Postcode}}, {{.}}{{end}}{{end}}, and bring your driving licence.{{with .Phone}} If you cannot make it, call us on {{.}}.{{end}}
+{{end}}`,
+		SMS: `Reminder: your test drive of the {{.Title}} is at {{.Start}}.{{with .Branch}} {{.Name}}{{with .Phone}}, {{.}}{{end}}.{{end}}`,
+	},
+	notifyLowStock: {
+		Subject: "Low stock: {{.Stock}} {{.Title}} left",
+		Email: `Hello,
+
+There are {{.Stock}} {{.Title}} in stock, below the {{.Threshold}} of your alert.
+`,
+		SMS: `Low stock: {{.Stock}} {{.Title}} in stock, below your alert of {{.Threshold}}.`,
+	},
+}
+
+// loadNotificationTemplates returns the default notification templates with
+// those of the JSON file at path, an object of templates by kind, in their
+// place.
+func loadNotificationTemplates(path string) (map[string]*notify.Template, error) {
+	sources := map[string]notificationTemplate{}
+	for kind, t := range defaultNotificationTemplates {
+		sources[kind] = t
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading notification templates: %v", err)
+		}
+		var loaded map[string]notificationTemplate
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			return nil, fmt.Errorf("loading notification templates: %v", err)
+		}
+		for kind, t := range loaded {
+			if _, ok := defaultNotificationTemplates[kind]; !ok {
+				return nil, fmt.Errorf("loading notification templates: unknown notification %q", kind)
+			}
+			sources[kind] = t
+		}
+	}
+
+	templates := map[string]*notify.Template{}
+	for kind, s := range sources {
+		t, err := notify.ParseTemplate(s.Subject, s.Email, s.SMS)
+		if err != nil {
+			return nil, fmt.Errorf("loading notification templates: %s: %v", kind, err)
+		}
+		templates[kind] = t
+	}
+	return templates, nil
+}
+
+// contact is where someone who asked to be notified is reached.
+type contact struct {
+	Email string `json:"email,omitempty" bson:",omitempty"`
+	// Phone is an E.164 number, e.g. +447700900123, for text messages.
+	Phone string `json:"phone,omitempty" bson:",omitempty"`
+}
+
+func (c *contact) validate(field string) *fieldError {
+	v := &checks{}
+	v.check(c.Email == "" || strings.Contains(c.Email, "@") && !strings.ContainsAny(c.Email, "\r\n"),
+		field+".email", "The email address is not valid")
+	v.check(c.Phone == "" || validPhone(c.Phone), field+".phone", "The phone number must be in E.164 form, e.g. +447700900123")
+	v.check(c.Email != "" || c.Phone != "", field, "An email address or phone number is required")
+	return v.err()
+}
+
+func validPhone(s string) bool {
+	if len(s) < 8 || len(s) > 16 || s[0] != '+' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// notification is a message sent, or to be sent, on one channel. Its ID is
+// named after what it tells of, so that nothing is told twice.
+type notification struct {
+	ID         string `json:"id" bson:"notificationid"`
+	Kind       string `json:"kind"`
+	Channel    string `json:"channel"`
+	To         string `json:"to"`
+	VIN        string `json:"vin,omitempty" bson:",omitempty"`
+	CustomerID string `json:"customer_id,omitempty" bson:"customerid,omitempty"`
+	Subject    string `json:"subject,omitempty" bson:",omitempty"`
+	Body       string `json:"body"`
+	Status     string `json:"status"`
+	Attempts   int    `json:"attempts"`
+	// ProviderID is what the provider knows the message by: its
+	// Message-ID, or the SID of a text message.
+	ProviderID  string     `json:"provider_id,omitempty" bson:"providerid,omitempty"`
+	LastError   string     `json:"last_error,omitempty" bson:"lasterror,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty" bson:"nextattempt,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" bson:"createdat"`
+	SentAt      *time.Time `json:"sent_at,omitempty" bson:"sentat,omitempty"`
+	Tenant      string     `json:"-" bson:"tenant"`
+}
+
+// notificationData is what notification templates are executed with. The
+// times and prices are written out for people.
+type notificationData struct {
+	// Name is the recipient's, when they are a customer.
+	Name       string
+	Car        vehicle
+	Title      string
+	Price      string
+	OldPrice   string
+	ListingURL string
+	// Until is when a hold ends, and Start when a test drive begins.
+	Until  string
+	Start  string
+	Branch *dealership
+	// Stock is how many of a model are in stock, below Threshold.
+	Stock     int64
+	Threshold int64
+}
+
+// notifier tells customers and watchers of what happens to the cars they are
+// interested in: a reservation made for a customer, a price drop of a car on
+// a watchlist with a contact, and a test drive about to start. Each
+// notification is recorded before it is sent and retried until it is handed
+// to the provider or maxAttempts have failed, and kept for retention. A
+// channel without a sender configured is not sent on.
+type notifier struct {
+	c           *mongo.Collection
+	senders     map[string]notify.Sender
+	templates   map[string]*notify.Template
+	cars        *mongo.Collection
+	customers   *customerStore
+	favorites   *favorites
+	drives      *testDriveStore
+	dealerships *dealershipStore
+	listingURL  string
+	zone        *time.Location
+	maxAttempts int
+	retention   time.Duration
+	slots       chan struct{}
+}
+
+func (n *notifier) ensureIndex(ctx context.Context) error {
+	_, err := n.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "notificationid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "customerid", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattempt", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "createdat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(n.retention.Seconds())),
+		},
+	})
+	return err
+}
+
+// data returns the template data of a notification about car.
+func (n *notifier) data(ctx context.Context, car vehicle) (notificationData, error) {
+	d := notificationData{Car: car, Title: carTitle(car)}
+	if car.Price != nil {
+		d.Price = formatPrice(*car.Price)
+	}
+	if n.listingURL != "" {
+		d.ListingURL = strings.ReplaceAll(n.listingURL, "{vin}", url.PathEscape(car.VIN))
+	}
+	if car.Branch != "" {
+		b, err := n.dealerships.find(ctx, car.Branch)
+		switch err {
+		case nil:
+			d.Branch = &b
+		case mongo.ErrNoDocuments:
+		default:
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+func (n *notifier) when(t time.Time) string {
+	return t.In(n.zone).Format("Mon 2 Jan 15:04")
+}
+
+// customer returns the tenant's customer with the ID, or nil when there is
+// none.
+func (n *notifier) customer(ctx context.Context, id string) (*customer, error) {
+	var c customer
+	err := n.customers.c.FindOne(ctx, forTenant(ctx, bson.M{"customerid": id})).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// send records and sends a notification of kind, written with data, to to
+// on each channel it has an address for. key names what it tells of.
+func (n *notifier) send(ctx context.Context, key, kind string, to contact, customerID string, data notificationData) error {
+	t := n.templates[kind]
+	now := time.Now().UTC()
+	for channel, address := range map[string]string{notify.Email: to.Email, notify.SMS: to.Phone} {
+		if address == "" || n.senders[channel] == nil || !t.Has(channel) {
+			continue
+		}
+		msg, err := t.Render(channel, data)
+		if err != nil {
+			return fmt.Errorf("render %s %s: %w", kind, channel, err)
+		}
+		id := key + "-" + channel
+		note := notification{ID: id, Kind: kind, Channel: channel, To: address, VIN: data.Car.VIN, CustomerID: customerID,
+			Subject: msg.Subject, Body: msg.Body, Status: notificationPending, NextAttempt: &now, CreatedAt: now,
+			Tenant: tenantFrom(ctx)}
+		if _, err := n.c.InsertOne(ctx, note); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return err
+		}
+		go n.attempt(ctx, id)
+	}
+	return nil
+}
+
+// retry sends the notifications due a retry.
+func (n *notifier) retry(ctx context.Context) error {
+	var due []notification
+	filter := bson.M{"status": notificationPending, "nextattempt": bson.M{"$lte": time.Now()}}
+	cur, err := n.c.Find(ctx, filter, options.Find().SetProjection(bson.M{"notificationid": 1, "tenant": 1}))
+	if err == nil {
+		err = cur.All(ctx, &due)
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n.attempt(withTenant(ctx, d.Tenant), d.ID)
+	}
+	return nil
+}
+
+// attempt sends a notification if it is due, claiming it first as webhook
+// deliveries are.
+func (n *notifier) attempt(ctx context.Context, id string) {
+	n.slots <- struct{}{}
+	defer func() { <-n.slots }()
+	ctx = context.WithoutCancel(ctx)
+
+	now := time.Now().UTC()
+	var note notification
+	err := n.c.FindOneAndUpdate(ctx,
+		forTenant(ctx, bson.M{"notificationid": id, "status": notificationPending, "nextattempt": bson.M{"$lte": now}}),
+		bson.M{"$set": bson.M{"nextattempt": now.Add(2 * notificationTimeout)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&note)
+	if err == mongo.ErrNoDocuments {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed claim notification", "notification", id, "err", err)
+		return
+	}
+
+	set := bson.M{}
+	sender := n.senders[note.Channel]
+	if sender == nil {
+		set["status"], set["lasterror"] = notificationFailed, note.Channel+" is not configured"
+		n.finish(ctx, &note, set)
+		return
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	providerID, err := sender.Send(sendCtx, notify.Message{To: note.To, Subject: note.Subject, Body: note.Body})
+	cancel()
+	switch {
+	case err == nil:
+		at := time.Now().UTC()
+		set["status"], set["sentat"], set["providerid"] = notificationSent, at, providerID
+	case note.Attempts >= n.maxAttempts:
+		set["status"], set["lasterror"] = notificationFailed, err.Error()
+		slog.WarnContext(ctx, "Gave up notification", "notification", note.ID, "channel", note.Channel, "attempts", note.Attempts, "err", err)
+	default:
+		set["lasterror"], set["nextattempt"] = err.Error(), time.Now().Add(webhookBackoff(note.Attempts)).UTC()
+	}
+	n.finish(ctx, &note, set)
+}
+
+func (n *notifier) finish(ctx context.Context, note *notification, set bson.M) {
+	update := bson.M{"$set": set}
+	if set["status"] != nil {
+		update["$unset"] = bson.M{"nextattempt": ""}
+	}
+	if _, err := n.c.UpdateOne(ctx, forTenant(ctx, bson.M{"notificationid": note.ID}), update); err != nil {
+		slog.ErrorContext(ctx, "Failed record notification", "notification", note.ID, "err", err)
+	}
+}
+
+// notice is the outbox sink of notifications: it confirms holds made for a
+// customer and tells watchers of price drops.
+func (n *notifier) notice(ctx context.Context, e outboxEvent) error {
+	if e.Car == nil || (e.Type != eventUpdated && e.Type != eventCreated) {
+		return nil
+	}
+	if err := n.reservation(ctx, *e.Car); err != nil {
+		return err
+	}
+	return n.priceDrop(ctx, *e.Car)
+}
+
+// reservation confirms the hold on car to the customer it was made for.
+// Each hold, by when it ends, is confirmed once.
+func (n *notifier) reservation(ctx context.Context, car vehicle) error {
+	if car.Hold == nil || car.Hold.CustomerID == "" || car.Order != "" {
+		return nil
+	}
+	c, err := n.customer(ctx, car.Hold.CustomerID)
+	if err != nil || c == nil {
+		return err
+	}
+	data, err := n.data(ctx, car)
+	if err != nil {
+		return err
+	}
+	data.Name, data.Until = c.Name, n.when(car.Hold.Until)
+	key := notifyReservation + "-" + car.VIN + "-" + strconv.FormatInt(car.Hold.Until.Unix(), 10)
+	return n.send(ctx, key, notifyReservation, contact{Email: c.Email, Phone: c.Phone}, c.ID, data)
+}
+
+// priceDrop tells those watching car with a contact when its price has gone
+// below the one they were last told of, or added it at. The price they know
+// is moved to car's either way, for a later drop to be told of too.
+func (n *notifier) priceDrop(ctx context.Context, car vehicle) error {
+	if car.Price == nil {
+		return nil
+	}
+	filter := forTenant(ctx, bson.M{"vin": car.VIN, "notify": bson.M{"$exists": true}})
+	var watching []favorite
+	cur, err := n.favorites.c.Find(ctx, filter)
+	if err == nil {
+		err = cur.All(ctx, &watching)
+	}
+	if err != nil || len(watching) == 0 {
+		return err
+	}
+
+	var data *notificationData
+	for _, f := range watching {
+		was := f.Price
+		if was == nil || was.Currency != car.Price.Currency || car.Price.Amount >= was.Amount {
+			continue
+		}
+		if data == nil {
+			d, err := n.data(ctx, car)
+			if err != nil {
+				return err
+			}
+			data = &d
+		}
+		d := *data
+		d.OldPrice = formatPrice(*was)
+		key := notifyPriceDrop + "-" + car.VIN + "-" + f.Owner + "-" + strconv.FormatInt(car.Price.Amount, 10)
+		if err := n.send(ctx, key, notifyPriceDrop, *f.Notify, "", d); err != nil {
+			return err
+		}
+	}
+	_, err = n.favorites.c.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"price": car.Price}})
+	return err
+}
+
+// reminders is a job reminding customers of the test drives they have
+// booked starting within lead. Each drive is reminded of once.
+type reminders struct {
+	n    *notifier
+	lead time.Duration
+}
+
+func (r *reminders) remind(ctx context.Context) error {
+	n := r.n
+	now := time.Now().UTC()
+	filter := bson.M{
+		"status":     driveBooked,
+		"customerid": bson.M{"$exists": true},
+		"remindedat": bson.M{"$exists": false},
+		"start":      bson.M{"$gt": now, "$lte": now.Add(r.lead)},
+	}
+	var due []testDrive
+	cur, err := n.drives.c.Find(ctx, filter)
+	if err == nil {
+		err = cur.All(ctx, &due)
+	}
+	if err != nil {
+		return fmt.Errorf("find test drives to remind of: %w", err)
+	}
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		ctx := withTenant(ctx, d.Tenant)
+		if err := r.remindOf(ctx, d); err != nil {
+			slog.ErrorContext(ctx, "Failed remind of test drive", "test_drive", d.ID, "err", err)
+			continue
+		}
+		_, err := n.drives.c.UpdateOne(ctx, forTenant(ctx, bson.M{"testdriveid": d.ID}), bson.M{"$set": bson.M{"remindedat": now}})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed record test drive reminder", "test_drive", d.ID, "err", err)
+		}
+	}
+	return nil
+}
+
+func (r *reminders) remindOf(ctx context.Context, d testDrive) error {
+	n := r.n
+	c, err := n.customer(ctx, d.CustomerID)
+	if err != nil || c == nil {
+		return err
+	}
+	var car vehicle
+	err = n.cars.FindOne(ctx, liveCar(ctx, d.VIN)).Decode(&car)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.Branch != "" {
+		car.Branch = d.Branch
+	}
+	data, err := n.data(ctx, car)
+	if err != nil {
+		return err
+	}
+	data.Name, data.Start = c.Name, n.when(d.Start)
+	return n.send(ctx, notifyTestDrive+"-"+d.ID, notifyTestDrive, contact{Email: c.Email, Phone: c.Phone}, c.ID, data)
+}
+
+// allNotifications lists the notifications sent, newest first, optionally
+// only those of a ?status=, ?kind=, ?customer_id= or ?vin=.
+func allNotifications(n *notifier) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := forTenant(r.Context(), bson.M{})
+		switch status := query.Get("status"); status {
+		case "":
+		case notificationPending, notificationSent, notificationFailed:
+			filter["status"] = status
+		default:
+			errorWithJSON(w, "Parameter \"status\" must be pending, sent or failed", http.StatusBadRequest)
+			return
+		}
+		if kind := query.Get("kind"); kind != "" {
+			if _, ok := defaultNotificationTemplates[kind]; !ok {
+				errorWithJSON(w, "Parameter \"kind\" must be reservation_confirmed, price_drop or test_drive_reminder", http.StatusBadRequest)
+				return
+			}
+			filter["kind"] = kind
+		}
+		if id := query.Get("customer_id"); id != "" {
+			filter["customerid"] = id
+		}
+		if v := query.Get("vin"); v != "" {
+			filter["vin"] = strings.ToUpper(v)
+		}
+		limit := maxNotificationsListed
+		if v := query.Get("limit"); v != "" {
+			l, err := parseCount("limit", v, 1, maxNotificationsListed)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+
+		notes := []notification{}
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(int64(limit))
+		cur, err := n.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &notes)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list notifications", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(notes, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// notificationByID returns a notification, with the status of its delivery.
+func notificationByID(n *notifier) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var note notification
+		err := n.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"notificationid": pat.Param(r, "id")})).Decode(&note)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find notification", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Notification not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(note, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
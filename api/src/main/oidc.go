@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"problem"
+)
+
+const (
+	// sessionCookie holds the access token of someone signed in to the
+	// admin UI. It is sent with same-site requests and top-level
+	// navigations only, which keeps other sites from writing with it.
+	sessionCookie = "carsupermarket_session"
+	// oidcFlowCookie holds the state, nonce and PKCE verifier of a sign-in
+	// under way, until the provider sends the browser back.
+	oidcFlowCookie = "carsupermarket_oidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// oidcProvider is an OIDC identity provider, as its discovery document
+// describes it.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// discoverOIDC fetches the discovery document of the provider at issuer.
+func discoverOIDC(client *http.Client, issuer string) (*oidcProvider, error) {
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery at %s answered %s", issuer, resp.Status)
+	}
+
+	var p oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC discovery at %s names the issuer %q", issuer, p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery at %s is missing endpoints", issuer)
+	}
+	return &p, nil
+}
+
+// oidcLogin signs people in to the admin UI with the provider, by the code
+// flow with PKCE. Once the provider vouches for them they are given an
+// access token issued here, in sessionCookie, with the role of their groups.
+type oidcLogin struct {
+	provider     *oidcProvider
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	postLogin    string
+	// idTokens verifies the ID tokens the provider returns.
+	idTokens *tokenVerifier
+	auth     *authenticator
+	client   *http.Client
+}
+
+// secure reports whether the cookies are only to be sent over HTTPS.
+func (o *oidcLogin) secure() bool {
+	return strings.HasPrefix(o.redirectURL, "https://")
+}
+
+// start sends the browser to the provider to sign in.
+func (o *oidcLogin) start(w http.ResponseWriter, r *http.Request) {
+	var flow [3]string // state, nonce and PKCE verifier
+	for i := range flow {
+		v, err := randomHex(32)
+		if err != nil {
+			panic(err)
+		}
+		flow[i] = v
+	}
+	challenge := sha256.Sum256([]byte(flow[2]))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    strings.Join(flow[:], "."),
+		Path:     route("/auth/oidc"),
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.clientID},
+		"redirect_uri":          {o.redirectURL},
+		"scope":                 {strings.Join(o.scopes, " ")},
+		"state":                 {flow[0]},
+		"nonce":                 {flow[1]},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(o.provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, o.provider.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback is where the provider sends the browser back, with a code that is
+// exchanged for the person's ID token.
+func (o *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		slog.WarnContext(r.Context(), "OIDC sign-in refused", "error", e, "description", q.Get("error_description"))
+		unauthorized(w, "The identity provider did not sign you in")
+		return
+	}
+
+	c, err := r.Cookie(oidcFlowCookie)
+	flow := []string{}
+	if err == nil {
+		flow = strings.Split(c.Value, ".")
+	}
+	if len(flow) != 3 || q.Get("state") != flow[0] || q.Get("code") == "" {
+		errorWithJSON(w, "The sign-in has expired or was not started here", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: route("/auth/oidc"), MaxAge: -1, HttpOnly: true})
+
+	idToken, err := o.exchange(r, q.Get("code"), flow[2])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed exchange OIDC code", "err", err)
+		errorWithJSON(w, "The identity provider could not be reached", http.StatusBadGateway)
+		return
+	}
+
+	p, claims, err := o.idTokens.verifyClaims(idToken)
+	if err == nil && claims.All["nonce"] != flow[1] {
+		err = errors.New("ID token nonce does not match")
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected OIDC ID token", "err", err)
+		unauthorized(w, "Invalid credentials")
+		return
+	}
+	if err := o.auth.assignRole(r.Context(), p); err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed find role", "err", err)
+		return
+	}
+	if p.Role == "" {
+		p.Role = roleViewer
+	}
+
+	token, err := o.auth.sessions.accessToken(p.Subject, p.Tenant, p.Role)
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(o.auth.sessions.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   o.secure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	slog.InfoContext(r.Context(), "Signed in with OIDC", "subject", p.Subject, "role", p.Role)
+	http.Redirect(w, r, o.postLogin, http.StatusSeeOther)
+}
+
+// exchange redeems a code at the provider's token endpoint for an ID token.
+func (o *oidcLogin) exchange(r *http.Request, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.redirectURL},
+		"client_id":     {o.clientID},
+		"code_verifier": {verifier},
+	}
+	if o.clientSecret != "" {
+		form.Set("client_secret", o.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, o.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
@@ -0,0 +1,2497 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"notify"
+	"problem"
+)
+
+// obj is a JSON object in the OpenAPI document.
+type obj = map[string]interface{}
+
+func ref(schema string) obj {
+	return obj{"$ref": "#/components/schemas/" + schema}
+}
+
+func jsonContent(schema obj) obj {
+	return obj{"application/json": obj{"schema": schema}}
+}
+
+// response describes a response with a JSON body, or none when schema is nil.
+// The body is re-encoded as XML or MessagePack for clients that accept those.
+func response(description string, schema obj) obj {
+	r := obj{"description": description}
+	if schema != nil {
+		content := jsonContent(schema)
+		for mediaType := range encoders {
+			content[mediaType] = obj{"schema": schema}
+		}
+		r["content"] = content
+	}
+	return r
+}
+
+// withHeaders adds the headers described to response r.
+func withHeaders(r obj, headers obj) obj {
+	r["headers"] = headers
+	return r
+}
+
+func errorResponse(description string) obj {
+	return obj{"description": description, "content": obj{problem.ContentType: obj{"schema": ref("Problem")}}}
+}
+
+func pathParam(name, description string) obj {
+	return obj{"name": name, "in": "path", "required": true, "description": description, "schema": obj{"type": "string"}}
+}
+
+func queryParam(name, description, typ string) obj {
+	return obj{"name": name, "in": "query", "description": description, "schema": obj{"type": typ}}
+}
+
+func headerParam(name, description string) obj {
+	return obj{"name": name, "in": "header", "description": description, "schema": obj{"type": "string"}}
+}
+
+// operation describes an endpoint taking an optional JSON body.
+func operation(summary string, params []obj, body obj, responses obj) obj {
+	op := obj{"summary": summary, "responses": responses}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if body != nil {
+		op["requestBody"] = obj{"required": true, "content": jsonContent(body)}
+	}
+	return op
+}
+
+// optionalBody marks the request body of op as one that may be left out.
+func optionalBody(op obj) obj {
+	op["requestBody"].(obj)["required"] = false
+	return op
+}
+
+// secured marks op as needing a bearer token or API key and documents the
+// errors returned when the caller has neither or lacks the role.
+func secured(op obj) obj {
+	op["security"] = []obj{{"bearer": []string{}}, {"apiKey": []string{}}, {"signedApiKey": []string{}}}
+	responses := op["responses"].(obj)
+	responses["401"] = errorResponse("Missing or invalid credentials")
+	responses["403"] = errorResponse("The caller's role does not allow this")
+	return op
+}
+
+var validateOnlyParam = queryParam("validate_only", "check the cars as they would be added, duplicates included, and answer what would happen without adding them", "boolean")
+
+var linksParam = queryParam("links", "add the links to where a client can go next under _links", "boolean")
+
+var listParams = []obj{
+	queryParam("limit", fmt.Sprintf("cars per page, at most %d", maxListLimit), "integer"),
+	queryParam("offset", "cars to skip", "integer"),
+	queryParam("page", "page number, starting at 1", "integer"),
+	queryParam("cursor", "next_cursor of the previous page; \"\" starts from the first", "string"),
+	queryParam("sort", "comma separated fields; prefix with - for descending", "string"),
+	queryParam("fields", "comma separated fields to return", "string"),
+	queryParam("manufacturer", "only cars of this manufacturer", "string"),
+	queryParam("model", "only cars of this model", "string"),
+	queryParam("regno", "only the car with this registration; spaces and case are ignored", "string"),
+	queryParam("dealer", "only cars held by this dealer", "string"),
+	queryParam("branch", "only cars at this dealership", "string"),
+	queryParam("price_min", "only cars priced at least this, in minor units", "integer"),
+	queryParam("price_max", "only cars priced at most this, in minor units", "integer"),
+	queryParam("mileage_max", "only cars with at most this mileage", "integer"),
+	queryParam("year_min", "only cars from this year or later", "integer"),
+	queryParam("year_max", "only cars from this year or earlier", "integer"),
+	queryParam("fuel_type", "only cars with this fuel type", "string"),
+	queryParam("transmission", "only cars with this transmission", "string"),
+	queryParam("colour", "only cars of this colour", "string"),
+	queryParam("condition", "only cars in this condition", "string"),
+	queryParam("status", "only cars with this status: in_prep, in_stock, reserved, sold or written_off", "string"),
+	queryParam("include_deleted", "list deleted cars too; admins only", "boolean"),
+	queryParam("facets", "count the matching cars by manufacturer, fuel type, price band and year band too", "boolean"),
+	linksParam,
+	currencyParam,
+	queryParam("price_review", "only cars flagged, or not flagged, for price review", "boolean"),
+	queryParam("include_archived", "list the archived sold cars too", "boolean"),
+}
+
+var currencyParam = queryParam("currency", "ISO 4217 code to convert prices to, as display_price", "string")
+
+// accountingPeriodParams choose the period of an accounting export; without
+// them it is the last calendar month.
+var accountingPeriodParams = []obj{
+	queryParam("month", "a calendar month, in UTC, e.g. 2024-03", "string"),
+	queryParam("from", "the start of the period, an RFC 3339 time, with to instead of month", "string"),
+	queryParam("to", "the end of the period, exclusive", "string"),
+}
+
+// keys returns the keys of an enumeration in order.
+func keys(m map[string]bool) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+var vinParam = pathParam("vin", "vehicle identification number; spaces and case are ignored")
+
+var dealershipParam = pathParam("id", "dealership ID")
+
+var customerParam = pathParam("id", "customer ID")
+
+var testDriveParam = pathParam("id", "test drive ID")
+
+var orderParam = pathParam("id", "order ID")
+
+var serviceRecordParam = pathParam("id", "service record ID")
+
+var tradeInParam = pathParam("id", "trade-in ID")
+
+// openAPISpec returns the OpenAPI 3 description of the current API version.
+func openAPISpec() obj {
+	vehicleSchema := obj{
+		"type":     "object",
+		"required": []string{"manufacturer", "model", "vin"},
+		"properties": obj{
+			"manufacturer": obj{"type": "string", "description": "filled in from the VIN when empty on creation"},
+			"model":        obj{"type": "string"},
+			"vin":          obj{"type": "string", "minLength": 17, "maxLength": 17},
+			"regno":        obj{"type": "string", "description": "stored in capitals without spaces; a write fails with reason format when it is in none of the registration formats configured for the tenant"},
+			"dealer":       obj{"type": "string"},
+			"branch":       obj{"type": "string", "description": "ID of the dealership the car is at"},
+			"distance_km":  obj{"type": "number", "readOnly": true, "description": "how far the car's dealership is, in listings with near"},
+			"display_price": obj{"type": "object", "readOnly": true, "description": "the price converted to the currency asked for with ?currency=", "properties": obj{
+				"amount":   obj{"type": "integer"},
+				"currency": obj{"type": "string"},
+				"rate":     obj{"type": "number"},
+			}},
+			"labels": obj{"type": "object", "readOnly": true, "description": "the display values of the enumerations, in the language of Accept-Language (Welsh, cy, or Irish, ga, else English); left out when fields are picked", "properties": obj{
+				"fuel_type":    obj{"type": "string"},
+				"transmission": obj{"type": "string"},
+				"condition":    obj{"type": "string"},
+			}},
+			"status": obj{
+				"type":        "string",
+				"enum":        []string{carInPrep, carInStock, carReserved, carSold, carWrittenOff},
+				"description": "changed through /cars/{vin}/status, or by the car's hold or order; new cars may be created in_prep",
+			},
+			"order":           obj{"type": "string", "readOnly": true, "description": "ID of the order reserving or selling the car"},
+			"hold":            obj{"allOf": []obj{ref("Hold")}, "readOnly": true, "description": "set while the car is on hold"},
+			"service_history": obj{"allOf": []obj{ref("ServiceSummary")}, "readOnly": true, "description": "summary of the records under /cars/{vin}/service-history"},
+			"sold_at":         obj{"type": "string", "format": "date-time"},
+			"listed_at":       obj{"type": "string", "format": "date-time", "readOnly": true, "description": "when the car first went in stock"},
+			"price_review_at": obj{"type": "string", "format": "date-time", "readOnly": true, "description": "when the car was flagged for its price to be reviewed"},
+			"price":           ref("Price"),
+			"mileage":         obj{"type": "integer", "minimum": 0},
+			"year":            obj{"type": "integer", "minimum": firstModelYear},
+			"fuel_type":       obj{"type": "string", "enum": keys(fuelTypes)},
+			"transmission":    obj{"type": "string", "enum": keys(transmissions)},
+			"colour":          obj{"type": "string"},
+			"condition":       obj{"type": "string", "enum": keys(conditions)},
+			"images":          obj{"type": "array", "items": ref("Image"), "readOnly": true},
+			"deleted_at":      obj{"type": "string", "format": "date-time", "readOnly": true},
+			"merged_into":     obj{"type": "string", "readOnly": true, "description": "VIN of the car a deleted duplicate was merged into"},
+			"revision": obj{
+				"type":        "integer",
+				"description": "counts the writes made to the car; sent back on a write, the write fails with 409 if the car has changed since",
+			},
+		},
+	}
+
+	// The public listing takes the parameters of GET /cars it allows.
+	publicListParams := []obj{queryParam("q", "search terms, matched against the manufacturers and models of the cars", "string")}
+	for _, p := range listParams {
+		name := p["name"].(string)
+		field := strings.TrimSuffix(strings.TrimSuffix(name, "_min"), "_max")
+		switch {
+		case name == "sort":
+			publicListParams = append(publicListParams, queryParam("sort", "comma separated fields of "+strings.Join(keys(publicSorts), ", ")+"; prefix with - for descending", "string"))
+		case publicQuery[name] || publicFilters[field]:
+			publicListParams = append(publicListParams, p)
+		}
+	}
+
+	schemas := obj{
+		"Vehicle": vehicleSchema,
+		"PublicCar": obj{
+			"type":        "object",
+			"description": "a car on sale as the storefront shows it, without what it cost, who holds or bought it, or its registration",
+			"properties": obj{
+				"manufacturer": obj{"type": "string"},
+				"model":        obj{"type": "string"},
+				"vin":          obj{"type": "string"},
+				"year":         obj{"type": "integer"},
+				"mileage":      obj{"type": "integer"},
+				"fuel_type":    obj{"type": "string"},
+				"transmission": obj{"type": "string"},
+				"colour":       obj{"type": "string"},
+				"condition":    obj{"type": "string"},
+				"price":        ref("Price"),
+				"reserved":     obj{"type": "boolean"},
+				"branch":       obj{"type": "string", "description": "ID of the dealership the car is at"},
+				"listed_at":    obj{"type": "string", "format": "date-time"},
+				"images":       obj{"type": "array", "items": obj{"type": "string"}, "description": "URLs of the car's photos"},
+				"labels":       vehicleSchema["properties"].(obj)["labels"],
+			},
+		},
+		"PublicCarPage": obj{
+			"type": "object",
+			"properties": obj{
+				"cars":        obj{"type": "array", "items": ref("PublicCar")},
+				"total":       obj{"type": "integer"},
+				"limit":       obj{"type": "integer"},
+				"page":        obj{"type": "integer"},
+				"offset":      obj{"type": "integer"},
+				"next_cursor": obj{"type": "string"},
+			},
+		},
+		"CarPage": obj{
+			"type": "object",
+			"properties": obj{
+				"cars":        obj{"type": "array", "items": ref("Vehicle")},
+				"total":       obj{"type": "integer"},
+				"limit":       obj{"type": "integer"},
+				"page":        obj{"type": "integer"},
+				"offset":      obj{"type": "integer"},
+				"next_cursor": obj{"type": "string"},
+				"facets":      ref("Facets"),
+				"_links":      obj{"type": "object", "description": "with ?links=true: self and, unless on the last page, next", "additionalProperties": ref("Link")},
+			},
+		},
+		"Link": obj{
+			"type":       "object",
+			"properties": obj{"href": obj{"type": "string"}},
+		},
+		"Facets": obj{
+			"type":        "object",
+			"description": "counts of the cars matching the listing, with ?facets=true; bands count from min up to but not including max",
+			"properties": obj{
+				"manufacturer": obj{"type": "array", "items": ref("FacetCount")},
+				"fuel_type":    obj{"type": "array", "items": ref("FacetCount")},
+				"price":        obj{"type": "array", "items": ref("FacetBand")},
+				"year":         obj{"type": "array", "items": ref("FacetBand")},
+			},
+		},
+		"FacetCount": obj{
+			"type":       "object",
+			"properties": obj{"value": obj{"type": "string"}, "count": obj{"type": "integer"}},
+		},
+		"FacetBand": obj{
+			"type": "object",
+			"properties": obj{
+				"min":   obj{"type": "integer"},
+				"max":   obj{"type": "integer", "description": "absent for the last band"},
+				"count": obj{"type": "integer"},
+			},
+		},
+		"DecodedVIN": obj{
+			"type": "object",
+			"properties": obj{
+				"wmi":           obj{"type": "string"},
+				"manufacturer":  obj{"type": "string"},
+				"country":       obj{"type": "string"},
+				"region":        obj{"type": "string"},
+				"descriptor":    obj{"type": "string"},
+				"model_year":    obj{"type": "integer"},
+				"plant_code":    obj{"type": "string"},
+				"serial_number": obj{"type": "string"},
+			},
+		},
+		"ArchivedVehicle": obj{
+			"allOf": []obj{ref("Vehicle"), {
+				"type":       "object",
+				"properties": obj{"archived_at": obj{"type": "string", "format": "date-time"}},
+			}},
+		},
+		"Event": obj{
+			"type": "object",
+			"properties": obj{
+				"type":    obj{"type": "string", "enum": []string{eventCreated, eventUpdated, eventDeleted, eventSold, eventRestored}},
+				"vin":     obj{"type": "string"},
+				"car":     ref("Vehicle"),
+				"changes": obj{"type": "array", "description": "the fields an update changed, when the car as it was is known", "items": ref("FieldChange")},
+			},
+		},
+		"APIKey": obj{
+			"type": "object",
+			"properties": obj{
+				"id":         obj{"type": "string"},
+				"name":       obj{"type": "string"},
+				"role":       obj{"type": "string", "enum": []string{roleViewer, roleEditor, roleAdmin}},
+				"created_at": obj{"type": "string", "format": "date-time"},
+				"created_by": obj{"type": "string"},
+				"revoked_at": obj{"type": "string", "format": "date-time"},
+				"quota":      ref("Quota"),
+				"signed":     obj{"type": "boolean", "description": "the key is only accepted on signed requests"},
+			},
+		},
+		"Quota": obj{
+			"type":        "object",
+			"description": "requests allowed each UTC day and month; 0 is unlimited",
+			"properties": obj{
+				"daily":   obj{"type": "integer"},
+				"monthly": obj{"type": "integer"},
+			},
+		},
+		"PeriodUsage": obj{
+			"type": "object",
+			"properties": obj{
+				"limit":     obj{"type": "integer", "description": "omitted when unlimited"},
+				"used":      obj{"type": "integer"},
+				"remaining": obj{"type": "integer"},
+				"resets_at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Usage": obj{
+			"type": "object",
+			"properties": obj{
+				"key_id":  obj{"type": "string"},
+				"daily":   ref("PeriodUsage"),
+				"monthly": ref("PeriodUsage"),
+				"history": obj{"type": "array", "items": obj{
+					"type":       "object",
+					"properties": obj{"date": obj{"type": "string", "format": "date"}, "count": obj{"type": "integer"}},
+				}},
+			},
+		},
+		"NewAPIKey": obj{
+			"type":       "object",
+			"properties": obj{"key": obj{"type": "string", "description": "shown only once"}},
+		},
+		"Price": obj{
+			"type":     "object",
+			"required": []string{"amount", "currency"},
+			"properties": obj{
+				"amount":   obj{"type": "integer", "minimum": 0, "description": "in the minor unit of the currency"},
+				"currency": obj{"type": "string", "pattern": currencyCode.String()},
+			},
+		},
+		"Address": obj{
+			"type": "object",
+			"properties": obj{
+				"lines":    obj{"type": "array", "items": obj{"type": "string"}},
+				"town":     obj{"type": "string"},
+				"postcode": obj{"type": "string"},
+				"country":  obj{"type": "string"},
+			},
+		},
+		"Dealership": obj{
+			"type":     "object",
+			"required": []string{"name"},
+			"properties": obj{
+				"id":      obj{"type": "string", "readOnly": true},
+				"name":    obj{"type": "string"},
+				"address": ref("Address"),
+				"location": obj{
+					"type":        "object",
+					"description": "a GeoJSON point",
+					"required":    []string{"type", "coordinates"},
+					"properties": obj{
+						"type":        obj{"type": "string", "enum": []string{"Point"}},
+						"coordinates": obj{"type": "array", "items": obj{"type": "number"}, "minItems": 2, "maxItems": 2, "description": "longitude, latitude"},
+					},
+				},
+				"phone":            obj{"type": "string"},
+				"email":            obj{"type": "string", "format": "email"},
+				"test_drive_slots": obj{"type": "integer", "minimum": 0, "description": "test drives the branch can run at a time; none is no limit"},
+				"created_at":       obj{"type": "string", "format": "date-time", "readOnly": true},
+				"updated_at":       obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"TestDrive": obj{
+			"type":     "object",
+			"required": []string{"start", "end"},
+			"properties": obj{
+				"id":          obj{"type": "string", "readOnly": true},
+				"vin":         obj{"type": "string", "readOnly": true},
+				"branch":      obj{"type": "string", "readOnly": true},
+				"customer_id": obj{"type": "string"},
+				"start":       obj{"type": "string", "format": "date-time"},
+				"end":         obj{"type": "string", "format": "date-time", "description": "15 minutes to 3 hours after the start"},
+				"status": obj{
+					"type":     "string",
+					"enum":     []string{driveBooked, driveStarted, driveCancelled, driveNoShow},
+					"readOnly": true,
+				},
+				"booked_by":   obj{"type": "string", "readOnly": true},
+				"created_at":  obj{"type": "string", "format": "date-time", "readOnly": true},
+				"released_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+				"reminded_at": obj{"type": "string", "format": "date-time", "readOnly": true, "description": "when the customer was reminded of the drive"},
+			},
+		},
+		"ServiceRecord": obj{
+			"type":     "object",
+			"required": []string{"kind", "date"},
+			"properties": obj{
+				"id":          obj{"type": "string", "readOnly": true},
+				"vin":         obj{"type": "string", "readOnly": true},
+				"kind":        obj{"type": "string", "enum": keys(workKinds)},
+				"date":        obj{"type": "string", "format": "date-time"},
+				"mileage":     obj{"type": "integer", "minimum": 0},
+				"description": obj{"type": "string", "maxLength": 2000},
+				"cost":        ref("Price"),
+				"garage":      obj{"type": "string"},
+				"created_at":  obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"FinanceQuoteRequest": obj{
+			"type":     "object",
+			"required": []string{"vin", "deposit", "term_months", "apr"},
+			"properties": obj{
+				"vin":         obj{"type": "string"},
+				"lender":      obj{"type": "string", "description": "lender profile ID; the first profile by default"},
+				"deposit":     obj{"type": "integer", "description": "in the minor unit of the car's currency"},
+				"term_months": obj{"type": "integer"},
+				"apr":         obj{"type": "number", "description": "percent"},
+			},
+		},
+		"FinanceQuote": obj{
+			"type":        "object",
+			"description": "Amounts are in the minor unit of the currency. The first payment adds the arrangement fee and the final payment the option fee.",
+			"properties": obj{
+				"vin":                     obj{"type": "string"},
+				"lender":                  obj{"type": "string"},
+				"currency":                obj{"type": "string"},
+				"cash_price":              obj{"type": "integer"},
+				"deposit":                 obj{"type": "integer"},
+				"amount_financed":         obj{"type": "integer"},
+				"term_months":             obj{"type": "integer"},
+				"apr":                     obj{"type": "number"},
+				"monthly_payment":         obj{"type": "integer"},
+				"first_payment":           obj{"type": "integer"},
+				"final_payment":           obj{"type": "integer"},
+				"total_charge_for_credit": obj{"type": "integer"},
+				"total_payable":           obj{"type": "integer"},
+			},
+		},
+		"TradeIn": obj{
+			"type":     "object",
+			"required": []string{"customer", "car"},
+			"properties": obj{
+				"id": obj{"type": "string", "readOnly": true},
+				"customer": obj{
+					"type":        "object",
+					"required":    []string{"name"},
+					"description": "an email address or phone number is required",
+					"properties": obj{
+						"customer_id": obj{"type": "string"},
+						"name":        obj{"type": "string"},
+						"email":       obj{"type": "string", "format": "email"},
+						"phone":       obj{"type": "string"},
+					},
+				},
+				"car": obj{
+					"type":     "object",
+					"required": []string{"manufacturer", "model"},
+					"properties": obj{
+						"vin":          obj{"type": "string"},
+						"regno":        obj{"type": "string"},
+						"manufacturer": obj{"type": "string"},
+						"model":        obj{"type": "string"},
+						"year":         obj{"type": "integer"},
+						"mileage":      obj{"type": "integer", "minimum": 0},
+						"condition":    obj{"type": "string"},
+						"notes":        obj{"type": "string"},
+					},
+				},
+				"photos":       obj{"type": "array", "items": ref("Image"), "readOnly": true},
+				"status":       obj{"type": "string", "enum": []string{tradeInSubmitted, tradeInAppraised, tradeInAccepted, tradeInDeclined}, "readOnly": true},
+				"appraisal":    obj{"allOf": []obj{ref("Appraisal")}, "readOnly": true},
+				"order":        obj{"type": "string", "readOnly": true, "description": "ID of the order the trade-in is put towards"},
+				"submitted_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+				"updated_at":   obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"Appraisal": obj{
+			"type":     "object",
+			"required": []string{"value"},
+			"properties": obj{
+				"value":       ref("Price"),
+				"notes":       obj{"type": "string"},
+				"valid_until": obj{"type": "string", "format": "date-time", "description": "a week after the appraisal by default"},
+				"by":          obj{"type": "string", "readOnly": true},
+				"at":          obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"Stats": obj{
+			"type": "object",
+			"properties": obj{
+				"total":           obj{"type": "integer"},
+				"by_status":       obj{"type": "array", "items": ref("StatsCount")},
+				"by_manufacturer": obj{"type": "array", "items": ref("StatsCount")},
+				"by_model":        obj{"type": "array", "items": ref("StatsCount")},
+				"prices": obj{"type": "array", "items": obj{
+					"type":        "object",
+					"description": "asking prices in one currency, in its minor unit",
+					"properties": obj{
+						"currency": obj{"type": "string"},
+						"count":    obj{"type": "integer"},
+						"average":  obj{"type": "number"},
+						"median":   obj{"type": "number"},
+						"min":      obj{"type": "integer"},
+						"max":      obj{"type": "integer"},
+					},
+				}},
+				"average_days_in_stock": obj{"type": "number", "description": "over the cars not sold or written off"},
+				"oldest_stock": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"vin":           obj{"type": "string"},
+						"manufacturer":  obj{"type": "string"},
+						"model":         obj{"type": "string"},
+						"added_at":      obj{"type": "string", "format": "date-time"},
+						"days_in_stock": obj{"type": "number"},
+					},
+				}},
+				"at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"StatsCount": obj{
+			"type": "object",
+			"properties": obj{
+				"status":       obj{"type": "string"},
+				"manufacturer": obj{"type": "string"},
+				"model":        obj{"type": "string"},
+				"count":        obj{"type": "integer"},
+			},
+		},
+		"MOTTest": obj{
+			"type": "object",
+			"properties": obj{
+				"number":        obj{"type": "string"},
+				"completed_at":  obj{"type": "string", "format": "date-time"},
+				"result":        obj{"type": "string", "enum": []string{"passed", "failed"}},
+				"expiry_date":   obj{"type": "string", "format": "date"},
+				"odometer":      obj{"type": "integer"},
+				"odometer_unit": obj{"type": "string"},
+				"failures":      obj{"type": "array", "items": obj{"type": "string"}},
+				"advisories":    obj{"type": "array", "items": obj{"type": "string"}},
+				"minor":         obj{"type": "array", "items": obj{"type": "string"}},
+			},
+		},
+		"RegDetails": obj{
+			"type": "object",
+			"properties": obj{
+				"regno":           obj{"type": "string"},
+				"manufacturer":    obj{"type": "string"},
+				"colour":          obj{"type": "string"},
+				"fuel_type":       obj{"type": "string"},
+				"year":            obj{"type": "integer"},
+				"engine_capacity": obj{"type": "integer", "description": "cc"},
+				"tax_status":      obj{"type": "string"},
+				"mot_status":      obj{"type": "string"},
+				"mot_expiry":      obj{"type": "string", "format": "date"},
+			},
+		},
+		"Valuation": obj{
+			"type": "object",
+			"properties": obj{
+				"vin":       obj{"type": "string"},
+				"estimate":  ref("Price"),
+				"low":       ref("Price"),
+				"high":      ref("Price"),
+				"provider":  obj{"type": "string"},
+				"valued_at": obj{"type": "string", "format": "date-time"},
+				"revision":  obj{"type": "integer", "description": "revision of the car valued"},
+			},
+		},
+		"ServiceSummary": obj{
+			"type": "object",
+			"properties": obj{
+				"service_count":     obj{"type": "integer"},
+				"last_service_date": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Hold": obj{
+			"type": "object",
+			"properties": obj{
+				"until":       obj{"type": "string", "format": "date-time", "readOnly": true},
+				"by":          obj{"type": "string", "readOnly": true},
+				"customer_id": obj{"type": "string"},
+				"note":        obj{"type": "string"},
+			},
+		},
+		"Order": obj{
+			"type":     "object",
+			"required": []string{"vin", "buyer", "price"},
+			"properties": obj{
+				"id":  obj{"type": "string", "readOnly": true},
+				"vin": obj{"type": "string"},
+				"buyer": obj{
+					"type":     "object",
+					"required": []string{"name"},
+					"properties": obj{
+						"customer_id": obj{"type": "string"},
+						"name":        obj{"type": "string"},
+						"email":       obj{"type": "string", "format": "email"},
+						"phone":       obj{"type": "string"},
+					},
+				},
+				"price":   ref("Price"),
+				"deposit": ref("Price"),
+				"trade_in": obj{
+					"type":        "object",
+					"readOnly":    true,
+					"description": "the accepted trade-in put towards the order",
+					"properties":  obj{"id": obj{"type": "string"}, "value": ref("Price")},
+				},
+				"status":       obj{"type": "string", "enum": keys(orderStatuses), "readOnly": true},
+				"created_by":   obj{"type": "string", "readOnly": true},
+				"created_at":   obj{"type": "string", "format": "date-time", "readOnly": true},
+				"completed_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+				"cancelled_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"Webhook": obj{
+			"type":        "object",
+			"description": "a subscription to inventory events; each is POSTed as {id, type, created_at, data}, signed in X-CarSupermarket-Signature as t=<unix time>,v1=<hex HMAC-SHA256 of the time, a dot and the body>",
+			"required":    []string{"url"},
+			"properties": obj{
+				"id":         obj{"type": "string", "readOnly": true},
+				"url":        obj{"type": "string", "format": "uri"},
+				"events":     obj{"type": "array", "description": "the events sent: car.created, car.updated, car.deleted, car.sold, " + savedSearchEvent + " or field events; all but field events when empty. A field event, sent with a FieldEvent, is car.<field>.changed, car.<field>.increased or car.<field>.decreased for numbers, or car.<field>.changed:<value>, e.g. car.price.decreased or car.status.changed:sold; fields are " + strings.Join(eventFieldNames(), ", "), "items": obj{"type": "string"}},
+				"secret":     obj{"type": "string", "description": "key deliveries are signed with; generated when not given, and only shown when the webhook is added"},
+				"created_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"SavedSearch": obj{
+			"type":        "object",
+			"description": "a listing query saved by the caller; with alerts, the cars listed since checked_at that match it are sent to webhooks as " + savedSearchEvent + " events of {search, total, cars}",
+			"required":    []string{"name", "query"},
+			"properties": obj{
+				"id":         obj{"type": "string", "readOnly": true},
+				"owner":      obj{"type": "string", "readOnly": true},
+				"name":       obj{"type": "string", "maxLength": maxNameLength},
+				"query":      obj{"type": "string", "description": "the query string of a listing, e.g. manufacturer=Volkswagen&model=Golf&price_max=1500000"},
+				"alerts":     obj{"type": "boolean"},
+				"created_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+				"checked_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"View": obj{
+			"type":     "object",
+			"required": []string{"vin", "type"},
+			"properties": obj{
+				"vin":     obj{"type": "string"},
+				"type":    obj{"type": "string", "enum": keys(viewTypes)},
+				"session": obj{"type": "string", "maxLength": 64, "description": "the storefront's session, to count the people looking"},
+			},
+		},
+		"CarStats": obj{
+			"type": "object",
+			"properties": obj{
+				"vin":      obj{"type": "string"},
+				"days":     obj{"type": "integer"},
+				"views":    obj{"type": "integer"},
+				"clicks":   obj{"type": "integer"},
+				"sessions": obj{"type": "integer", "description": "the sessions the views and clicks came from"},
+			},
+		},
+		"LogLevel": obj{
+			"type": "object",
+			"properties": obj{
+				"level":      obj{"type": "string"},
+				"configured": obj{"type": "string", "description": "the level restored once until passes"},
+				"until":      obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Comparison": obj{
+			"type": "object",
+			"properties": obj{
+				"cars": obj{"type": "array", "items": ref("Vehicle")},
+				"fields": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"field":   obj{"type": "string", "enum": append(append([]string(nil), comparedFields...), "display_price")},
+						"values":  obj{"type": "array", "description": "the value of each car, in the order of cars; null where a car has none", "items": obj{}},
+						"differs": obj{"type": "boolean"},
+					},
+				}},
+				"differing": obj{"type": "array", "description": "the fields whose values are not all the same", "items": obj{"type": "string"}},
+			},
+		},
+		"Favorite": obj{
+			"type":        "object",
+			"description": "a car on the caller's watchlist; cars leave every watchlist once sold or deleted",
+			"properties": obj{
+				"vin":      obj{"type": "string"},
+				"added_at": obj{"type": "string", "format": "date-time"},
+				"car":      ref("Vehicle"),
+				"notify":   ref("Contact"),
+			},
+		},
+		"Contact": obj{
+			"type":        "object",
+			"description": "where to tell someone of a price drop; one or both of an email address and an E.164 phone number",
+			"properties": obj{
+				"email": obj{"type": "string", "format": "email"},
+				"phone": obj{"type": "string", "example": "+447700900123"},
+			},
+		},
+		"Notification": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string"},
+				"kind":         obj{"type": "string", "enum": []string{notifyReservation, notifyPriceDrop, notifyTestDrive, notifyLowStock}},
+				"channel":      obj{"type": "string", "enum": []string{notify.Email, notify.SMS}},
+				"to":           obj{"type": "string", "description": "the email address or phone number sent to"},
+				"vin":          obj{"type": "string"},
+				"customer_id":  obj{"type": "string"},
+				"subject":      obj{"type": "string"},
+				"body":         obj{"type": "string", "description": "the message sent"},
+				"status":       obj{"type": "string", "enum": []string{notificationPending, notificationSent, notificationFailed}},
+				"attempts":     obj{"type": "integer"},
+				"provider_id":  obj{"type": "string", "description": "the Message-ID of an email, or SID of a text message"},
+				"last_error":   obj{"type": "string"},
+				"next_attempt": obj{"type": "string", "format": "date-time"},
+				"created_at":   obj{"type": "string", "format": "date-time"},
+				"sent_at":      obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"WebhookDelivery": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string"},
+				"webhook":      obj{"type": "string"},
+				"event":        obj{"type": "string"},
+				"body":         obj{"type": "string", "description": "the body sent"},
+				"status":       obj{"type": "string", "enum": []string{deliveryPending, deliveryDelivered, deliveryFailed}},
+				"attempts":     obj{"type": "integer"},
+				"last_status":  obj{"type": "integer", "description": "HTTP status of the last attempt"},
+				"last_error":   obj{"type": "string"},
+				"next_attempt": obj{"type": "string", "format": "date-time"},
+				"created_at":   obj{"type": "string", "format": "date-time"},
+				"delivered_at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"BulkDeletion": obj{
+			"type": "object",
+			"properties": obj{
+				"dry_run": obj{"type": "boolean"},
+				"count":   obj{"type": "integer", "description": "cars deleted, or that would be in a dry run"},
+				"vins":    obj{"type": "array", "items": obj{"type": "string"}, "description": "the cars deleted"},
+			},
+		},
+		"VINLookup": obj{
+			"type": "object",
+			"properties": obj{
+				"cars":    obj{"type": "array", "items": ref("Vehicle")},
+				"missing": obj{"type": "array", "items": obj{"type": "string"}, "description": "the VINs of no live car"},
+			},
+		},
+		"NearDuplicate": obj{
+			"type": "object",
+			"properties": obj{
+				"manufacturer": obj{"type": "string"},
+				"model":        obj{"type": "string"},
+				"regno":        obj{"type": "string"},
+				"vins":         obj{"type": "array", "items": obj{"type": "string"}, "minItems": 2, "maxItems": 2},
+				"distance":     obj{"type": "integer", "description": "characters changed, added or removed to make one VIN the other"},
+			},
+		},
+		"OutboxEvent": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string", "description": "also the ID of the event on the event bus"},
+				"type":         obj{"type": "string", "enum": []string{eventCreated, eventUpdated, eventDeleted, eventSold, eventRestored}},
+				"vin":          obj{"type": "string"},
+				"car":          ref("Vehicle"),
+				"changes":      obj{"type": "array", "items": ref("FieldChange")},
+				"status":       obj{"type": "string", "enum": []string{outboxPending, outboxPublished}},
+				"attempts":     obj{"type": "integer"},
+				"last_error":   obj{"type": "string"},
+				"next_attempt": obj{"type": "string", "format": "date-time"},
+				"created_at":   obj{"type": "string", "format": "date-time"},
+				"published_at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"OutboxBacklog": obj{
+			"type": "object",
+			"properties": obj{
+				"pending":        obj{"type": "integer", "description": "events waiting to be sent"},
+				"oldest_pending": obj{"type": "string", "format": "date-time", "description": "when the oldest event waiting was written"},
+				"events":         obj{"type": "array", "items": ref("OutboxEvent")},
+			},
+		},
+		"AccountingExport": obj{
+			"type": "object",
+			"properties": obj{
+				"layout": obj{"type": "string"},
+				"key":    obj{"type": "string", "description": "where the file was written: <tenant>/<layout>/<period>.csv"},
+				"sales":  obj{"type": "integer"},
+			},
+		},
+		"SearchResults": obj{
+			"type":        "object",
+			"description": "the results of a global search; customers and orders are left out unless the caller may see them",
+			"properties": obj{
+				"q":         obj{"type": "string"},
+				"cars":      obj{"type": "array", "items": ref("Vehicle")},
+				"customers": obj{"type": "array", "items": ref("Customer")},
+				"orders":    obj{"type": "array", "items": ref("Order")},
+			},
+		},
+		"StockLevel": obj{
+			"type": "object",
+			"properties": obj{
+				"manufacturer": obj{"type": "string"},
+				"model":        obj{"type": "string"},
+				"in_prep":      obj{"type": "integer"},
+				"in_stock":     obj{"type": "integer"},
+				"reserved":     obj{"type": "integer"},
+				"low":          obj{"type": "boolean", "description": "whether in stock is below the threshold of an alert on the model"},
+				"counted_at":   obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"StockAlert": obj{
+			"type":     "object",
+			"required": []string{"manufacturer", "model", "threshold", "notify"},
+			"properties": obj{
+				"id":           obj{"type": "string", "readOnly": true},
+				"manufacturer": obj{"type": "string"},
+				"model":        obj{"type": "string"},
+				"threshold":    obj{"type": "integer", "minimum": 1, "description": "notify is told when the model's cars in stock fall below this"},
+				"notify":       ref("Contact"),
+				"created_by":   obj{"type": "string", "readOnly": true},
+				"created_at":   obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"StatusReport": obj{
+			"type": "object",
+			"properties": obj{
+				"status": obj{"type": "string"},
+				"moved":  obj{"type": "integer"},
+				"failed": obj{"type": "integer"},
+				"results": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"vin":     obj{"type": "string"},
+						"result":  obj{"type": "string", "enum": []string{statusMoved, statusUnchanged, statusConflict, statusNotFound, statusFailed}},
+						"from":    obj{"type": "string", "description": "the status the car was in"},
+						"message": obj{"type": "string"},
+					},
+				}},
+			},
+		},
+		"CarDocument": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string"},
+				"vin":          obj{"type": "string"},
+				"kind":         obj{"type": "string", "enum": []string{documentLogbook, documentInvoice, documentInspection, documentOther}},
+				"filename":     obj{"type": "string"},
+				"content_type": obj{"type": "string", "enum": keys(documentTypes)},
+				"size":         obj{"type": "integer"},
+				"scan":         obj{"type": "string", "enum": []string{scanClean, scanUnscanned}, "description": "unscanned when no virus scanner is configured"},
+				"uploaded_by":  obj{"type": "string"},
+				"uploaded_at":  obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Customer": obj{
+			"type":     "object",
+			"required": []string{"name"},
+			"properties": obj{
+				"id":      obj{"type": "string", "readOnly": true},
+				"name":    obj{"type": "string"},
+				"email":   obj{"type": "string", "format": "email"},
+				"phone":   obj{"type": "string"},
+				"address": ref("Address"),
+				"consent": obj{
+					"type":        "object",
+					"description": "what the customer agrees to be contacted about; nothing unless given",
+					"properties": obj{
+						"marketing_email": obj{"type": "boolean"},
+						"marketing_phone": obj{"type": "boolean"},
+						"marketing_post":  obj{"type": "boolean"},
+						"updated_at":      obj{"type": "string", "format": "date-time", "readOnly": true},
+					},
+				},
+				"enquiries":  obj{"type": "array", "items": ref("Enquiry"), "readOnly": true},
+				"purchases":  obj{"type": "array", "items": ref("Purchase"), "readOnly": true},
+				"created_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+				"updated_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"Enquiry": obj{
+			"type":     "object",
+			"required": []string{"vin"},
+			"properties": obj{
+				"id":      obj{"type": "string", "readOnly": true},
+				"vin":     obj{"type": "string"},
+				"channel": obj{"type": "string", "enum": keys(enquiryChannels)},
+				"message": obj{"type": "string"},
+				"at":      obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"Purchase": obj{
+			"type":     "object",
+			"required": []string{"vin"},
+			"properties": obj{
+				"id":    obj{"type": "string", "readOnly": true},
+				"vin":   obj{"type": "string"},
+				"price": ref("Price"),
+				"at":    obj{"type": "string", "format": "date-time", "description": "now when not given"},
+			},
+		},
+		"RoleAssignment": obj{
+			"type": "object",
+			"properties": obj{
+				"subject":     obj{"type": "string"},
+				"role":        obj{"type": "string", "enum": []string{roleViewer, roleEditor, roleAdmin}},
+				"assigned_by": obj{"type": "string"},
+				"assigned_at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"User": obj{
+			"type": "object",
+			"properties": obj{
+				"username":            obj{"type": "string"},
+				"role":                obj{"type": "string", "enum": []string{roleViewer, roleEditor, roleAdmin}},
+				"tenant":              obj{"type": "string"},
+				"created_at":          obj{"type": "string", "format": "date-time"},
+				"created_by":          obj{"type": "string"},
+				"password_changed_at": obj{"type": "string", "format": "date-time"},
+				"disabled_at":         obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"SessionTokens": obj{
+			"type": "object",
+			"properties": obj{
+				"access_token":  obj{"type": "string", "description": "bearer token"},
+				"token_type":    obj{"type": "string", "enum": []string{"Bearer"}},
+				"expires_in":    obj{"type": "integer", "description": "seconds the access token is valid for"},
+				"refresh_token": obj{"type": "string", "description": "used once, at /login/refresh"},
+			},
+		},
+		"BatchReport": obj{
+			"type": "object",
+			"properties": obj{
+				"validate_only": obj{"type": "boolean"},
+				"created":       obj{"type": "integer"},
+				"valid":         obj{"type": "integer", "description": "validated only, the cars that would have been added"},
+				"failed":        obj{"type": "integer"},
+				"results": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"index":   obj{"type": "integer"},
+						"vin":     obj{"type": "string"},
+						"status":  obj{"type": "string", "enum": []string{batchCreated, batchValid, batchDuplicate, batchDuplicateRegNo, batchInvalid, batchFailed}},
+						"field":   obj{"type": "string"},
+						"reason":  obj{"type": "string"},
+						"message": obj{"type": "string"},
+						"errors":  obj{"type": "array", "items": ref("FieldError"), "description": "every field of an invalid car that failed validation"},
+					},
+				}},
+			},
+		},
+		"ImportReport": obj{
+			"type": "object",
+			"properties": obj{
+				"validate_only": obj{"type": "boolean"},
+				"imported":      obj{"type": "integer"},
+				"valid":         obj{"type": "integer", "description": "validated only, the rows that would have been imported"},
+				"rejected": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"line":    obj{"type": "integer"},
+						"vin":     obj{"type": "string"},
+						"reason":  obj{"type": "string"},
+						"message": obj{"type": "string"},
+					},
+				}},
+			},
+		},
+		"Image": obj{
+			"type": "object",
+			"properties": obj{
+				"id":           obj{"type": "string"},
+				"content_type": obj{"type": "string", "enum": keys(imageTypes)},
+				"size":         obj{"type": "integer"},
+				"uploaded_at":  obj{"type": "string", "format": "date-time"},
+				"variants": obj{"type": "array", "description": "Smaller JPEG copies of the photo, made on upload", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"name":   obj{"type": "string"},
+						"width":  obj{"type": "integer"},
+						"height": obj{"type": "integer"},
+						"size":   obj{"type": "integer"},
+					},
+				}},
+			},
+		},
+		"AuditEntry": obj{
+			"type": "object",
+			"properties": obj{
+				"vin":         obj{"type": "string"},
+				"action":      obj{"type": "string"},
+				"actor":       obj{"type": "string"},
+				"auth_method": obj{"type": "string"},
+				"key_id":      obj{"type": "string", "description": "the API key the write was made with"},
+				"signed":      obj{"type": "boolean", "description": "the request was signed with the API key"},
+				"at":          obj{"type": "string", "format": "date-time"},
+				"request_id":  obj{"type": "string"},
+				"changes":     obj{"type": "array", "items": ref("FieldChange")},
+			},
+		},
+		"FieldChange": obj{
+			"type":        "object",
+			"description": "a field a write changed; old or new is missing when the field was not set",
+			"properties": obj{
+				"field": obj{"type": "string"},
+				"old":   obj{},
+				"new":   obj{},
+			},
+		},
+		"FieldEvent": obj{
+			"type":        "object",
+			"description": "the data of a field event sent to webhooks: the change of one field of a car, and the car as it now is",
+			"properties": obj{
+				"vin":   obj{"type": "string"},
+				"field": obj{"type": "string", "enum": eventFieldNames()},
+				"old":   obj{},
+				"new":   obj{},
+				"car":   ref("Vehicle"),
+			},
+		},
+		"ExchangeRate": obj{
+			"type": "object",
+			"properties": obj{
+				"from":       obj{"type": "string"},
+				"to":         obj{"type": "string"},
+				"rate":       obj{"type": "number", "description": "how much of to one unit of from buys"},
+				"source":     obj{"type": "string", "description": "override when set by hand, else provider"},
+				"updated_at": obj{"type": "string", "format": "date-time"},
+				"updated_by": obj{"type": "string"},
+			},
+		},
+		"PriceChange": obj{
+			"type": "object",
+			"properties": obj{
+				"vin":     obj{"type": "string"},
+				"old":     ref("Price"),
+				"new":     ref("Price"),
+				"reduced": obj{"type": "boolean", "description": "whether the price went down in the same currency"},
+				"actor":   obj{"type": "string"},
+				"at":      obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"DataQualityReport": obj{
+			"type": "object",
+			"properties": obj{
+				"cars":       obj{"type": "integer", "description": "live cars not sold or written off that were scanned"},
+				"stale_days": obj{"type": "integer"},
+				"issues": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"issue":  obj{"type": "string", "enum": qualityIssues},
+						"count":  obj{"type": "integer"},
+						"sample": obj{"type": "array", "items": obj{"type": "string"}, "description": "the first VINs with the issue"},
+					},
+				}},
+				"at": obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"AgingReport": obj{
+			"type": "object",
+			"properties": obj{
+				"thresholds": obj{"type": "array", "items": obj{"type": "integer"}},
+				"buckets": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"min_days": obj{"type": "integer"},
+						"max_days": obj{"type": "integer", "description": "absent from the last bucket"},
+						"count":    obj{"type": "integer"},
+						"value":    obj{"type": "array", "items": ref("Price"), "description": "asking prices summed by currency"},
+					},
+				}},
+				"price_review": obj{"type": "integer", "description": "cars on sale flagged for price review"},
+				"at":           obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Maintenance": obj{
+			"type": "object",
+			"properties": obj{
+				"enabled": obj{"type": "boolean"},
+				"message": obj{"type": "string"},
+				"since":   obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"SlowQueries": obj{
+			"type": "object",
+			"properties": obj{
+				"threshold_ms": obj{"type": "number", "description": "how long an operation takes to be slow; 0 when none are kept"},
+				"queries": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"op":          obj{"type": "string", "enum": []string{"get", "list", "each", "facets", "count", "create", "replace", "update", "delete"}},
+						"filter":      obj{"type": "object", "description": "the filter, with every value replaced by \"?\""},
+						"sort":        obj{"type": "array", "items": obj{"type": "string"}},
+						"duration_ms": obj{"type": "number"},
+						"route":       obj{"type": "string"},
+						"tenant":      obj{"type": "string"},
+						"error":       obj{"type": "string"},
+						"at":          obj{"type": "string", "format": "date-time"},
+					},
+				}},
+			},
+		},
+		"Faults": obj{
+			"type": "object",
+			"properties": obj{
+				"rules": obj{"type": "array", "items": obj{
+					"type":        "object",
+					"required":    []string{"percent"},
+					"description": "the first rule matching a request injects its fault into the percentage of such requests; the latency is added, then the connection is dropped or the status answered",
+					"properties": obj{
+						"method":     obj{"type": "string", "description": "only requests with this method; any when left out"},
+						"route":      obj{"type": "string", "description": "only requests to this route pattern, e.g. /v1/cars/:vin; any when left out"},
+						"percent":    obj{"type": "number", "exclusiveMinimum": 0, "maximum": 100},
+						"latency_ms": obj{"type": "integer", "minimum": 0, "maximum": maxFaultLatency.Milliseconds()},
+						"drop":       obj{"type": "boolean", "description": "close the connection without a response"},
+						"status":     obj{"type": "integer", "minimum": 500, "maximum": 599},
+					},
+				}},
+				"updated_by": obj{"type": "string", "readOnly": true},
+				"updated_at": obj{"type": "string", "format": "date-time", "readOnly": true},
+			},
+		},
+		"FeatureFlag": obj{
+			"type": "object",
+			"properties": obj{
+				"name":               obj{"type": "string", "enum": keys(featureFlagDefaults)},
+				"default":            obj{"type": "boolean", "description": "whether the flag is on in this environment unless set"},
+				"enabled":            obj{"type": "boolean", "description": "set for the environment, overriding the default"},
+				"tenants":            obj{"type": "object", "additionalProperties": obj{"type": "boolean"}, "description": "set for tenants, overriding the rest"},
+				"enabled_for_tenant": obj{"type": "boolean", "description": "whether the flag is on for the caller's tenant"},
+				"updated_by":         obj{"type": "string"},
+				"updated_at":         obj{"type": "string", "format": "date-time"},
+			},
+		},
+		"Backup": obj{
+			"type":        "object",
+			"description": "manifest of a backup of a tenant; each collection is stored as gzip compressed Extended JSON, a document a line",
+			"properties": obj{
+				"name":       obj{"type": "string", "example": "20261014T101500Z"},
+				"tenant":     obj{"type": "string"},
+				"created_at": obj{"type": "string", "format": "date-time"},
+				"collections": obj{"type": "array", "items": obj{
+					"type": "object",
+					"properties": obj{
+						"collection": obj{"type": "string", "enum": []string{"cars", "archive", "orders", "audit"}},
+						"key":        obj{"type": "string"},
+						"documents":  obj{"type": "integer"},
+						"bytes":      obj{"type": "integer"},
+						"sha256":     obj{"type": "string"},
+					},
+				}},
+			},
+		},
+		"Problem": obj{
+			"type":        "object",
+			"description": "RFC 7807 problem details; field and reason are set when a request field failed validation, errors lists every field that did, and request_id is the X-Request-ID of the request",
+			"properties": obj{
+				"type":       obj{"type": "string", "format": "uri"},
+				"title":      obj{"type": "string"},
+				"status":     obj{"type": "integer"},
+				"detail":     obj{"type": "string"},
+				"code":       obj{"type": "string"},
+				"field":      obj{"type": "string"},
+				"reason":     obj{"type": "string"},
+				"errors":     obj{"type": "array", "items": ref("FieldError")},
+				"request_id": obj{"type": "string"},
+			},
+		},
+		"FieldError": obj{
+			"type": "object",
+			"properties": obj{
+				"field":  obj{"type": "string"},
+				"reason": obj{"type": "string", "description": "e.g. required, too_long, type or invalid"},
+				"detail": obj{"type": "string"},
+			},
+		},
+	}
+
+	invalidVIN := errorResponse("The VIN is not valid")
+	notFound := errorResponse("Car not found")
+	idempotencyKey := headerParam("Idempotency-Key", "replays the response to an earlier request with the same key and body")
+	idempotencyInProgress := errorResponse("A request with the same Idempotency-Key is in progress")
+	ifMatch := headerParam("If-Match", "the ETag the car must still have for the write to be made")
+	revisionConflict := errorResponse("The car has changed since the ETag or revision given; ETag holds the current one")
+	notModifiedResponse := obj{"description": "Not modified since the ETag given in If-None-Match"}
+	totalCount := obj{"description": "how many cars match in all", "schema": obj{"type": "integer"}}
+
+	paths := obj{
+		"/cars": obj{
+			"get": operation("List cars", append([]obj{
+				queryParam("near", "latitude,longitude; lists the cars at the dealerships near it, nearest first", "string"),
+				queryParam("radius", fmt.Sprintf("km from near, at most %d; %d by default", maxNearRadius, defaultNearRadius), "number"),
+				queryParam("reduced_within_days", fmt.Sprintf("only cars whose price went down in this many days, at most %d", maxReducedWithinDays), "integer"),
+				queryParam("format", "json for a page, or ndjson to stream every matching car, one per line, without paging", "string"),
+			}, listParams...), nil, obj{
+				"200": obj{
+					"description": "A page of cars, or with ?format=ndjson every matching car",
+					"headers":     obj{"X-Total-Count": totalCount},
+					"content": obj{
+						"application/json":     obj{"schema": ref("CarPage")},
+						"application/x-ndjson": obj{"schema": ref("Vehicle")},
+					},
+				},
+				"304": notModifiedResponse,
+				"400": errorResponse("Invalid parameter"),
+			}),
+			"post": secured(operation("Add a car", []obj{idempotencyKey, validateOnlyParam}, ref("Vehicle"), obj{
+				"200": response("Validated only: the car as it would be added", ref("Vehicle")),
+				"201": obj{"description": "Created; Location holds the car's URL"},
+				"400": errorResponse("Invalid body, or duplicate VIN or registration"),
+				"409": idempotencyInProgress,
+				"422": errorResponse("The VIN is not valid, or the Idempotency-Key was used for another request"),
+			})),
+			"delete": secured(operation("Delete the live cars matching the listing filters, of which one at least is required; admins only", []obj{
+				queryParam("manufacturer", "only cars of this manufacturer; the other listing filters may be given too", "string"),
+				queryParam("older_than", "only cars of a model year before this one", "integer"),
+				queryParam("dry_run", "only count the cars that would be deleted", "boolean"),
+			}, nil, obj{
+				"200": response("The cars deleted, or that would be", ref("BulkDeletion")),
+				"400": errorResponse("Invalid parameter, or no filter given"),
+				"422": errorResponse(fmt.Sprintf("More than %d cars match", maxBulkDelete)),
+			})),
+		},
+		"/cars/lookup": obj{
+			"post": secured(operation(fmt.Sprintf("Look the live cars with up to %d VINs up at once, returning those found in the order asked for and the VINs missing; or, with ?regno= and for editors, look a vehicle up by registration", maxLookupVINs), []obj{
+				queryParam("regno", "registration number; spaces and case are ignored", "string"),
+			}, obj{
+				"type":     "object",
+				"required": []string{"vins"},
+				"properties": obj{
+					"vins": obj{"type": "array", "items": obj{"type": "string"}, "minItems": 1, "maxItems": maxLookupVINs},
+				},
+			}, obj{
+				"200": response("The cars found, or what the registration lookup tells of the vehicle", obj{"oneOf": []obj{ref("VINLookup"), ref("RegDetails")}}),
+				"400": errorResponse("Invalid body, or no registration given"),
+				"404": errorResponse("No vehicle with this registration"),
+				"503": errorResponse("Registration lookup is not configured or unavailable"),
+			})),
+		},
+		"/cars/batch": obj{
+			"post": secured(operation("Add many cars", []obj{idempotencyKey, validateOnlyParam}, obj{"type": "array", "items": ref("Vehicle"), "maxItems": maxBatchSize}, obj{
+				"200": response("What happened to each car", ref("BatchReport")),
+				"400": errorResponse("Invalid body"),
+				"409": idempotencyInProgress,
+				"413": errorResponse("Too many cars"),
+				"422": errorResponse("The Idempotency-Key was used for another request"),
+			})),
+		},
+		"/cars/status-batch": obj{
+			"post": secured(operation("Move many cars to a status, each as /cars/{vin}/status would", nil, obj{
+				"type":     "object",
+				"required": []string{"vins", "status"},
+				"properties": obj{
+					"vins":   obj{"type": "array", "items": obj{"type": "string"}, "minItems": 1, "maxItems": maxStatusBatch},
+					"status": obj{"type": "string", "enum": []string{carInPrep, carInStock, carWrittenOff}},
+				},
+			}, obj{
+				"200": response("What became of each car", ref("StatusReport")),
+				"400": errorResponse("Invalid body, VINs or status"),
+				"409": errorResponse("Cars are reserved and sold through holds and orders"),
+			})),
+		},
+		"/cars/import": obj{
+			"post": secured(obj{
+				"summary":    "Import cars from a CSV file",
+				"parameters": []obj{validateOnlyParam},
+				"requestBody": obj{"required": true, "content": obj{
+					"multipart/form-data": obj{"schema": obj{
+						"type":       "object",
+						"properties": obj{"file": obj{"type": "string", "format": "binary", "description": "CSV with a header row naming the columns"}},
+					}},
+				}},
+				"responses": obj{
+					"200": response("How many rows were imported and why the others were rejected", ref("ImportReport")),
+					"400": errorResponse("Invalid upload, header or parameter"),
+				},
+			}),
+		},
+		"/cars/duplicates": obj{
+			"get": secured(operation("List pairs of live cars of the same manufacturer, model and registration whose VINs differ by a typo or two, closest first", nil, nil, obj{
+				"200": response("The near-duplicates", obj{"type": "array", "items": ref("NearDuplicate")}),
+			})),
+		},
+		"/suggest": obj{
+			"get": operation("Complete a search with the manufacturers and models on sale", []obj{
+				queryParam("prefix", "what has been typed so far", "string"),
+				queryParam("limit", fmt.Sprintf("suggestions to return, at most %d", maxSuggestLimit), "integer"),
+			}, nil, obj{
+				"200": response("The suggestions, those finding the most cars first", obj{
+					"type": "object",
+					"properties": obj{
+						"prefix": obj{"type": "string"},
+						"suggestions": obj{"type": "array", "items": obj{
+							"type": "object",
+							"properties": obj{
+								"text":         obj{"type": "string"},
+								"manufacturer": obj{"type": "string"},
+								"model":        obj{"type": "string"},
+								"count":        obj{"type": "integer", "description": "cars on sale it finds"},
+							},
+						}},
+					},
+				}),
+				"400": errorResponse("Invalid parameter"),
+			}),
+		},
+		"/events": obj{
+			"post": operation("Send views and clicks of listings; they are counted a few seconds later", nil, obj{
+				"type": "array", "maxItems": maxViewsPerRequest, "items": ref("View"),
+			}, obj{
+				"202": obj{"description": "Accepted"},
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("An event is not valid"),
+			}),
+		},
+		"/feeds/{name}": obj{
+			"get": operation("Get a listing feed of the cars on sale for marketplaces, as rendered within the hour", []obj{
+				pathParam("name", "feed name, e.g. autotrader or facebook"),
+			}, nil, obj{
+				"200": obj{"description": "The feed, as CSV or XML by the feed", "content": obj{
+					"text/csv":        obj{"schema": obj{"type": "string"}},
+					"application/xml": obj{"schema": obj{"type": "string"}},
+				}},
+				"304": obj{"description": "Not rendered again since If-Modified-Since"},
+				"404": errorResponse("Feed not found"),
+			}),
+		},
+		"/cars/compare": obj{
+			"get": operation("Compare cars side by side", []obj{
+				queryParam("vins", fmt.Sprintf("comma separated VINs of 2 to %d cars", maxCompareCars), "string"),
+				currencyParam,
+			}, nil, obj{
+				"200": response("The cars and their specs lined up", ref("Comparison")),
+				"400": errorResponse("Invalid parameter"),
+				"404": errorResponse("Car not found"),
+			}),
+		},
+		"/search": obj{
+			"get": operation("Search cars, customers and orders at once, for a global search bar; customers and orders only for editors", []obj{
+				queryParam("q", "search terms: of cars, as for /cars/search; a customer's name, email, phone or ID; an order's buyer, VIN or ID", "string"),
+				queryParam("limit", fmt.Sprintf("results of each kind, at most %d; %d by default", maxSearchLimit, defaultSearchLimit), "integer"),
+			}, nil, obj{
+				"200": response("The results, by kind", ref("SearchResults")),
+				"400": errorResponse("Invalid parameter"),
+			}),
+		},
+		"/cars/search": obj{
+			"get": operation("Full-text search", append([]obj{
+				queryParam("q", "search terms", "string"),
+				queryParam("fuzzy", "find manufacturers and models spelt close to the terms too, e.g. Volkswagon", "boolean"),
+			}, listParams...), nil, obj{
+				"200": withHeaders(response("A page of matching cars, most relevant first", ref("CarPage")), obj{"X-Total-Count": totalCount}),
+				"400": errorResponse("Invalid parameter"),
+			}),
+		},
+		"/cars/count": obj{
+			"get": operation("Count the cars matching the listing filters", listParams[6:], nil, obj{
+				"200": withHeaders(response("How many cars match", obj{
+					"type":       "object",
+					"properties": obj{"count": obj{"type": "integer"}},
+				}), obj{"X-Total-Count": totalCount}),
+				"304": notModifiedResponse,
+				"400": errorResponse("Invalid parameter"),
+			}),
+		},
+		"/cars/export": obj{
+			"get": operation("Download the inventory",
+				append([]obj{queryParam("format", "csv or xlsx", "string")}, listParams[4:]...), nil, obj{
+					"200": obj{"description": "Every matching car", "content": obj{
+						exportTypes["csv"]:  obj{"schema": obj{"type": "string"}},
+						exportTypes["xlsx"]: obj{"schema": obj{"type": "string", "format": "binary"}},
+					}},
+					"400": errorResponse("Invalid parameter"),
+				}),
+		},
+		"/cars/events": obj{
+			"get": operation("Stream inventory changes as server-sent events", []obj{
+				queryParam("dealer", "only this dealer's cars", "string"),
+				queryParam("fields", "only the updates changing one of these comma separated fields: "+strings.Join(eventFieldNames(), ", "), "string"),
+				queryParam("last_event_id", "resume after this event, like the Last-Event-ID header", "string"),
+			}, nil, obj{
+				"200": obj{"description": "An event stream", "content": obj{"text/event-stream": obj{"schema": ref("Event")}}},
+			}),
+		},
+		"/cars/ws": obj{
+			"get": operation("Stream inventory changes over a WebSocket", nil, nil, obj{
+				"101": obj{"description": "Switching to the WebSocket protocol"},
+			}),
+		},
+		"/cars/stream": obj{
+			"get": operation("Stream every change to the inventory over a WebSocket", nil, nil, obj{
+				"101": obj{"description": "Switching to the WebSocket protocol; each message is an Event"},
+				"503": errorResponse("Live updates are not available"),
+			}),
+		},
+		"/cars/archive/{vin}": obj{
+			"get": operation("Get an archived car", []obj{vinParam}, nil, obj{
+				"200": response("The archived car", ref("ArchivedVehicle")),
+				"404": notFound,
+			}),
+		},
+		"/public/cars": obj{
+			"get": operation("List the cars on sale, for the storefront; served only when PUBLIC_API is set, without credentials and cacheable", publicListParams, nil, obj{
+				"200": withHeaders(response("A page of cars on sale", ref("PublicCarPage")), obj{"X-Total-Count": totalCount}),
+				"400": errorResponse("Bad or unknown parameter"),
+				"429": errorResponse("Too many requests"),
+			}),
+		},
+		"/public/cars/{vin}": obj{
+			"get": operation("Get a car on sale, for the storefront", []obj{vinParam}, nil, obj{
+				"200": response("The car", ref("PublicCar")),
+				"304": obj{"description": "The car has not changed since the ETag in If-None-Match"},
+				"404": errorResponse("Car not found, or not on sale"),
+				"429": errorResponse("Too many requests"),
+			}),
+		},
+		"/cars/{vin}": obj{
+			"get": operation("Get a car", []obj{vinParam, queryParam("fields", "comma separated fields to return", "string"), linksParam, currencyParam}, nil, obj{
+				"200": response("The car", ref("Vehicle")),
+				"304": notModifiedResponse,
+				"400": errorResponse("Unknown field"),
+				"404": notFound,
+			}),
+			"put": secured(operation("Replace a car", []obj{vinParam, ifMatch}, ref("Vehicle"), obj{
+				"200": response("The updated car", ref("Vehicle")),
+				"400": errorResponse("Invalid body or duplicate registration"),
+				"404": notFound,
+				"409": revisionConflict,
+			})),
+			"patch": secured(obj{
+				"summary":    "Update a car with a JSON merge patch",
+				"parameters": []obj{vinParam, ifMatch},
+				"requestBody": obj{"required": true, "content": obj{
+					"application/merge-patch+json": obj{"schema": ref("Vehicle")},
+				}},
+				"responses": obj{
+					"200": response("The updated car", ref("Vehicle")),
+					"400": errorResponse("Invalid patch or duplicate registration"),
+					"404": notFound,
+					"409": revisionConflict,
+				},
+			}),
+			"delete": secured(operation("Delete a car", []obj{vinParam, ifMatch}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": notFound,
+				"412": errorResponse("The car has changed since the ETag in If-Match; ETag holds the current one"),
+			})),
+		},
+		"/cars/{vin}/restore": obj{
+			"post": secured(operation("Undo the deletion of a car", []obj{vinParam}, nil, obj{
+				"200": response("The restored car", ref("Vehicle")),
+				"404": errorResponse("Deleted car not found"),
+			})),
+		},
+		"/cars/{vin}/images": obj{
+			"post": secured(obj{
+				"summary":    "Upload a photo of a car",
+				"parameters": []obj{vinParam},
+				"requestBody": obj{"required": true, "content": obj{
+					"multipart/form-data": obj{"schema": obj{
+						"type":       "object",
+						"properties": obj{"file": obj{"type": "string", "format": "binary", "maxLength": maxImageSize}},
+					}},
+				}},
+				"responses": obj{
+					"201": response("The photo; Location holds its URL", ref("Image")),
+					"400": errorResponse("Invalid upload"),
+					"404": notFound,
+					"413": errorResponse("The photo is too large"),
+					"415": errorResponse("The photo is not a JPEG, PNG or WebP image"),
+				},
+			}),
+		},
+		"/cars/{vin}/documents": obj{
+			"get": secured(operation("List the documents of a car the caller may see, latest first", []obj{vinParam,
+				queryParam("kind", "only documents of this kind", "string")}, nil, obj{
+				"200": response("The documents", obj{"type": "array", "items": ref("CarDocument")}),
+				"400": errorResponse("Unknown kind"),
+			})),
+			"post": secured(obj{
+				"summary": "Upload a document of a car, such as its V5C logbook, purchase invoice or inspection report; it is scanned for viruses first",
+				"parameters": []obj{vinParam, {
+					"name": "kind", "in": "query", "required": true, "description": "kind of document",
+					"schema": obj{"type": "string", "enum": []string{documentLogbook, documentInvoice, documentInspection, documentOther}},
+				}},
+				"requestBody": obj{"required": true, "content": obj{
+					"multipart/form-data": obj{"schema": obj{
+						"type":       "object",
+						"properties": obj{"file": obj{"type": "string", "format": "binary", "maxLength": maxDocumentSize}},
+					}},
+				}},
+				"responses": obj{
+					"201": response("The document; Location holds its URL", ref("CarDocument")),
+					"400": errorResponse("Invalid upload or kind"),
+					"403": errorResponse("The caller's role may not upload documents of the kind"),
+					"404": notFound,
+					"413": errorResponse("The document is too large"),
+					"415": errorResponse("The document is not a PDF, JPEG or PNG"),
+					"422": errorResponse("The document failed its virus scan"),
+					"503": errorResponse("The virus scanner is unavailable"),
+				},
+			}),
+		},
+		"/cars/{vin}/documents/{id}": obj{
+			"get": secured(operation("Download a document of a car", []obj{vinParam, pathParam("id", "document ID")}, nil, obj{
+				"200": obj{"description": "The document, as an attachment", "content": obj{
+					"application/pdf": obj{"schema": obj{"type": "string", "format": "binary"}},
+					"image/*":         obj{"schema": obj{"type": "string", "format": "binary"}},
+				}},
+				"404": errorResponse("Document not found, or not one the caller may see"),
+			})),
+			"delete": secured(operation("Delete a document of a car; admins only", []obj{vinParam, pathParam("id", "document ID")}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": errorResponse("Document not found"),
+			})),
+		},
+		"/cars/{vin}/mot": obj{
+			"get": operation("Get a car's MOT history, with its service history", []obj{vinParam}, nil, obj{
+				"200": response("The MOT tests, latest first, and the service records", obj{
+					"type": "object",
+					"properties": obj{
+						"vin":             obj{"type": "string"},
+						"regno":           obj{"type": "string"},
+						"tests":           obj{"type": "array", "items": ref("MOTTest")},
+						"service_history": obj{"type": "array", "items": ref("ServiceRecord")},
+					},
+				}),
+				"404": notFound,
+				"409": errorResponse("The car has no registration"),
+				"503": errorResponse("MOT history is not configured or unavailable"),
+			}),
+		},
+		"/exchange-rates": obj{
+			"get": secured(operation("List the exchange rates set by hand", nil, nil, obj{
+				"200": response("The rates", obj{"type": "array", "items": ref("ExchangeRate")}),
+			})),
+		},
+		"/exchange-rates/{from}/{to}": obj{
+			"get": operation("Get the exchange rate prices are converted with", []obj{pathParam("from", "currency converted from"), pathParam("to", "currency converted to")}, nil, obj{
+				"200": response("The rate", ref("ExchangeRate")),
+				"404": errorResponse("No rate between these currencies"),
+				"502": errorResponse("The exchange rate provider failed"),
+			}),
+			"put": secured(operation("Set the exchange rate between two currencies, in place of the provider's",
+				[]obj{pathParam("from", "currency converted from"), pathParam("to", "currency converted to")},
+				obj{"type": "object", "required": []string{"rate"}, "properties": obj{"rate": obj{"type": "number", "exclusiveMinimum": 0}}}, obj{
+					"200": response("The rate", ref("ExchangeRate")),
+					"422": errorResponse("The rate is not positive"),
+				})),
+			"delete": secured(operation("Use the provider's exchange rate again", []obj{pathParam("from", "currency converted from"), pathParam("to", "currency converted to")}, nil, obj{
+				"204": obj{"description": "Removed"},
+				"404": errorResponse("No rate was set between these currencies"),
+			})),
+		},
+		"/cars/{vin}/valuation": obj{
+			"get": operation("Estimate what a car is worth", []obj{vinParam}, nil, obj{
+				"200": response("The valuation; X-Cache tells whether it was cached", ref("Valuation")),
+				"404": errorResponse("Car not found, or valuations are not enabled"),
+				"422": errorResponse("The car has no price or year to value it from"),
+				"502": errorResponse("The valuation provider failed"),
+			}),
+		},
+		"/cars/{vin}/qr.png": obj{
+			"get": operation("Draw a QR code of a car's listing page, for windscreen displays",
+				[]obj{vinParam,
+					queryParam("size", "most pixels wide the code is drawn, from 64 to 4096, with whole pixels a module", "integer"),
+					queryParam("ecc", "error correction level: L, M, Q or H", "string")},
+				nil, obj{
+					"200": obj{"description": "The QR code", "content": obj{"image/png": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+					"404": notFound,
+					"422": errorResponse("The size or level is not valid, or the listing URL does not fit at the level"),
+					"503": errorResponse("No listing URL is configured"),
+				}),
+		},
+		"/cars/{vin}/brochure.pdf": obj{
+			"get": secured(operation("Render a car's brochure: a printable spec sheet of its details, price, photos and dealership", []obj{vinParam}, nil, obj{
+				"200": obj{"description": "The brochure; X-Cache tells whether it was cached", "content": obj{"application/pdf": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"404": notFound,
+			})),
+		},
+		"/cars/{vin}/service-history": obj{
+			"get": operation("List a car's service history, latest first", []obj{vinParam}, nil, obj{
+				"200": response("The service, MOT and repair records", obj{"type": "array", "items": ref("ServiceRecord")}),
+			}),
+			"post": secured(operation("Record a service, MOT or repair", []obj{vinParam}, ref("ServiceRecord"), obj{
+				"201": response("The record; Location holds its URL", ref("ServiceRecord")),
+				"400": errorResponse("Invalid body"),
+				"404": notFound,
+				"422": errorResponse("The record is not valid"),
+			})),
+		},
+		"/cars/{vin}/service-history/{id}": obj{
+			"get": operation("Get a service record", []obj{vinParam, serviceRecordParam}, nil, obj{
+				"200": response("The record", ref("ServiceRecord")),
+				"404": errorResponse("Service record not found"),
+			}),
+			"delete": secured(operation("Delete a service record", []obj{vinParam, serviceRecordParam}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": errorResponse("Service record not found"),
+			})),
+		},
+		"/cars/{vin}/status": obj{
+			"post": secured(operation("Change the status of a car", []obj{vinParam}, obj{
+				"type":     "object",
+				"required": []string{"status"},
+				"properties": obj{
+					"status": obj{"type": "string", "enum": []string{carInPrep, carInStock, carWrittenOff}},
+				},
+			}, obj{
+				"200": response("The car with its new status", ref("Vehicle")),
+				"400": errorResponse("Invalid body"),
+				"404": notFound,
+				"409": errorResponse("The car cannot move to the status, or is moved to it through /reserve or /orders"),
+				"422": errorResponse("The status is not valid"),
+			})),
+		},
+		"/cars/{vin}/reserve": obj{
+			"post": secured(operation("Put a car on hold; a car whose hold has expired may be held again at once", []obj{
+				vinParam,
+				queryParam("hours", fmt.Sprintf("how long to hold the car for, at most %d; 48 by default", int(maxHold/time.Hour)), "integer"),
+			}, nil, obj{
+				"200": response("The car on hold", ref("Vehicle")),
+				"400": errorResponse("Invalid parameter or body"),
+				"404": notFound,
+				"409": errorResponse("The car is not in stock or already on hold"),
+			})),
+			"delete": secured(operation("Release the hold on a car", []obj{vinParam}, nil, obj{
+				"204": obj{"description": "Released"},
+				"404": errorResponse("Car on hold not found"),
+			})),
+		},
+		"/cars/{vin}/testdrives": obj{
+			"get": secured(operation("List a car's test drives", []obj{
+				vinParam,
+				queryParam("all", "include past, cancelled and no-show drives", "boolean"),
+			}, nil, obj{
+				"200": response("The test drives, soonest first", obj{"type": "array", "items": ref("TestDrive")}),
+			})),
+			"post": secured(operation("Book a test drive", []obj{vinParam}, ref("TestDrive"), obj{
+				"201": response("The booking; Location holds its URL", ref("TestDrive")),
+				"400": errorResponse("Invalid body"),
+				"404": notFound,
+				"409": errorResponse("The car or its branch is already booked for the slot, or the car is sold or written off"),
+				"422": errorResponse("The slot is not valid"),
+			})),
+		},
+		"/cars/{vin}/testdrives/{id}": obj{
+			"delete": secured(operation("Cancel a test drive", []obj{vinParam, testDriveParam}, nil, obj{
+				"200": response("The cancelled booking", ref("TestDrive")),
+				"404": errorResponse("Booked test drive not found"),
+			})),
+		},
+		"/cars/{vin}/testdrives/{id}/start": obj{
+			"post": secured(operation("Check the customer in for a test drive", []obj{vinParam, testDriveParam}, nil, obj{
+				"200": response("The started test drive", ref("TestDrive")),
+				"404": errorResponse("Booked test drive not found"),
+			})),
+		},
+		"/cars/{vin}/images/{id}": obj{
+			"get": operation("Download a photo of a car", []obj{vinParam, pathParam("id", "photo ID"),
+				queryParam("variant", "rendition to download, e.g. thumbnail or medium; the photo itself when it has none that size", "string")}, nil, obj{
+				"200": obj{"description": "The photo", "content": obj{"image/*": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"302": obj{"description": "The photo is downloaded from the pre-signed URL in Location"},
+				"400": errorResponse("Unknown variant"),
+				"404": errorResponse("Photo not found"),
+			}),
+			"delete": secured(operation("Delete a photo of a car", []obj{vinParam, pathParam("id", "photo ID")}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": errorResponse("Photo not found"),
+			})),
+		},
+		"/cars/{vin}/merge-from/{other}": obj{
+			"post": secured(operation("Merge a duplicate record of a car into it, deleting the duplicate; admins only",
+				[]obj{vinParam, pathParam("other", "VIN of the duplicate to merge from"), ifMatch}, obj{
+					"type": "object",
+					"properties": obj{
+						"policy": obj{
+							"type":        "string",
+							"enum":        []string{mergeFill, mergePreferOther},
+							"description": "fill keeps the car's values and fills in those it lacks from the duplicate; prefer_other takes every value the duplicate has",
+						},
+						"fields": obj{
+							"type":                 "object",
+							"description":          "the side, this or other, whose value a field keeps, overriding the policy",
+							"additionalProperties": obj{"type": "string", "enum": []string{"this", "other"}},
+						},
+					},
+				}, obj{
+					"200": response("The merged car, with the duplicate's photos, test drives, orders and service records", ref("Vehicle")),
+					"400": errorResponse("The VINs are the same, or the car would take a registration already in use"),
+					"404": notFound,
+					"409": errorResponse("Either car has changed since it was read, or the duplicate is reserved or sold"),
+					"422": errorResponse("The policy or a field is not valid"),
+				})),
+		},
+		"/cars/{vin}/history": obj{
+			"get": secured(operation("List the changes made to a car and to the cars merged into it, newest first", []obj{vinParam}, nil, obj{
+				"200": response("The audit trail", obj{"type": "array", "items": ref("AuditEntry")}),
+			})),
+		},
+		"/cars/{vin}/price-history": obj{
+			"get": secured(operation("List the changes of a car's price, newest first", []obj{vinParam}, nil, obj{
+				"200": response("The price history", obj{"type": "array", "items": ref("PriceChange")}),
+			})),
+		},
+		"/cars/{vin}/decoded": obj{
+			"get": operation("Decode a VIN", []obj{vinParam}, nil, obj{
+				"200": response("What the VIN says about the car", ref("DecodedVIN")),
+				"422": invalidVIN,
+			}),
+		},
+		"/cars/{vin}/stats": obj{
+			"get": secured(operation("Count the views and clicks of a car's listing", []obj{
+				vinParam,
+				queryParam("days", fmt.Sprintf("days to count over; %d when not given", defaultStatsDays), "integer"),
+			}, nil, obj{
+				"200": response("The counts", ref("CarStats")),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/cars/{vin}/similar": obj{
+			"get": operation("List the cars on sale most like a car, most alike first", []obj{
+				vinParam,
+				queryParam("limit", fmt.Sprintf("cars to return, at most %d", maxSimilarLimit), "integer"),
+			}, nil, obj{
+				"200": response("The similar cars", obj{"type": "array", "items": obj{"allOf": []obj{ref("Vehicle"), {
+					"type": "object",
+					"properties": obj{
+						"score": obj{"type": "number", "description": "the weights of the manufacturer, model, price and mileage, each scaled by how close the car comes"},
+					},
+				}}}}),
+				"400": errorResponse("Invalid parameter"),
+				"404": errorResponse("Car not found"),
+			}),
+		},
+		"/api-keys": obj{
+			"get": secured(operation("List API keys", nil, nil, obj{
+				"200": response("The API keys", obj{"type": "array", "items": ref("APIKey")}),
+			})),
+			"post": secured(operation("Mint an API key", nil, obj{
+				"type":       "object",
+				"properties": obj{"name": obj{"type": "string"}, "role": obj{"type": "string"}, "quota": ref("Quota"), "signed": obj{"type": "boolean"}},
+			}, obj{
+				"201": response("The new key", ref("NewAPIKey")),
+				"400": errorResponse("Invalid body"),
+			})),
+		},
+		"/dealerships": obj{
+			"get": operation("List dealerships", nil, nil, obj{
+				"200": response("The dealerships", obj{"type": "array", "items": ref("Dealership")}),
+			}),
+			"post": secured(operation("Add a dealership", nil, ref("Dealership"), obj{
+				"201": response("The dealership; Location holds its URL", ref("Dealership")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("The dealership is not valid"),
+			})),
+		},
+		"/dealerships/{id}": obj{
+			"get": operation("Get a dealership", []obj{dealershipParam}, nil, obj{
+				"200": response("The dealership", ref("Dealership")),
+				"404": errorResponse("Dealership not found"),
+			}),
+			"put": secured(operation("Replace a dealership", []obj{dealershipParam}, ref("Dealership"), obj{
+				"200": response("The dealership", ref("Dealership")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Dealership not found"),
+				"422": errorResponse("The dealership is not valid"),
+			})),
+			"delete": secured(operation("Delete a dealership", []obj{dealershipParam}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": errorResponse("Dealership not found"),
+				"409": errorResponse("The dealership still holds cars"),
+			})),
+		},
+		"/dealerships/{id}/cars": obj{
+			"get": operation("List the cars at a dealership", append([]obj{dealershipParam}, listParams...), nil, obj{
+				"200": response("A page of cars", ref("CarPage")),
+				"400": errorResponse("Invalid parameter"),
+				"404": errorResponse("Dealership not found"),
+			}),
+		},
+		"/finance/quote": obj{
+			"post": operation("Quote finance on a car at its asking price", nil, ref("FinanceQuoteRequest"), obj{
+				"200": response("The payments and total cost", ref("FinanceQuote")),
+				"400": errorResponse("Invalid body"),
+				"409": errorResponse("The car has no price"),
+				"422": errorResponse("The lender, term, APR or deposit is not valid, or there is no car with the VIN"),
+			}),
+		},
+		"/orders": obj{
+			"get": secured(operation("List orders, newest first", []obj{
+				queryParam("status", "only orders with this status", "string"),
+				queryParam("vin", "only orders for this car", "string"),
+				queryParam("from", "only orders created at or after this time", "string"),
+				queryParam("to", "only orders created before this time", "string"),
+			}, nil, obj{
+				"200": response("The orders", obj{"type": "array", "items": ref("Order")}),
+				"400": errorResponse("Invalid parameter"),
+			})),
+			"post": secured(operation("Open an order, reserving the car", nil, ref("Order"), obj{
+				"201": response("The order; Location holds its URL", ref("Order")),
+				"400": errorResponse("Invalid body"),
+				"409": errorResponse("The car is not in stock"),
+				"422": errorResponse("The order is not valid or the car is not in stock"),
+			})),
+		},
+		"/orders/{id}": obj{
+			"get": secured(operation("Get an order", []obj{orderParam}, nil, obj{
+				"200": response("The order", ref("Order")),
+				"404": errorResponse("Order not found"),
+			})),
+		},
+		"/orders/{id}/complete": obj{
+			"post": secured(operation("Complete an order, selling the car", []obj{orderParam}, nil, obj{
+				"200": response("The order", ref("Order")),
+				"404": errorResponse("Open order not found"),
+			})),
+		},
+		"/orders/{id}/cancel": obj{
+			"post": secured(operation("Cancel an order, making the car available again", []obj{orderParam}, nil, obj{
+				"200": response("The order", ref("Order")),
+				"404": errorResponse("Open order not found"),
+			})),
+		},
+		"/stats": obj{
+			"get": secured(operation("Sum up the inventory", nil, nil, obj{
+				"200": response("Counts, prices and stock ages of the live cars", ref("Stats")),
+			})),
+		},
+		"/reports/aging": obj{
+			"get": secured(operation("Bucket the cars on sale by days in stock", []obj{
+				queryParam("thresholds", "comma separated, ascending days the buckets start at; configured when absent", "string"),
+			}, nil, obj{
+				"200": response("The report", ref("AgingReport")),
+				"400": errorResponse("Bad thresholds"),
+			})),
+		},
+		"/reports/data-quality": obj{
+			"get": secured(operation("Count the cars in the inventory missing a price, photos or registration, with invalid VINs, or not written to for long, with the VINs of some of each", []obj{
+				queryParam("sample", fmt.Sprintf("how many VINs to list of each issue, at most %d; %d when absent", maxQualitySample, defaultQualitySample), "integer"),
+				queryParam("stale_days", fmt.Sprintf("days without a write after which a car is stale; %d when absent", defaultStaleDays), "integer"),
+			}, nil, obj{
+				"200": response("The report", ref("DataQualityReport")),
+				"400": errorResponse("Bad sample or stale_days"),
+			})),
+		},
+		"/admin/reindex": obj{
+			"post": secured(operation("Build the indexes again; admins only", nil, nil, obj{
+				"204": obj{"description": "Built"},
+			})),
+		},
+		"/admin/migrations": obj{
+			"get": secured(operation("List the migrations applied and pending; admins only", nil, nil, obj{
+				"200": response("The migrations", obj{
+					"type": "object",
+					"properties": obj{
+						"applied": obj{"type": "array", "items": obj{
+							"type": "object",
+							"properties": obj{
+								"version":    obj{"type": "integer"},
+								"name":       obj{"type": "string"},
+								"applied_at": obj{"type": "string", "format": "date-time"},
+							},
+						}},
+						"pending": obj{"type": "array", "items": obj{
+							"type": "object",
+							"properties": obj{
+								"version": obj{"type": "integer"},
+								"name":    obj{"type": "string"},
+							},
+						}},
+					},
+				}),
+			})),
+		},
+		"/admin/maintenance": obj{
+			"get": secured(operation("Tell whether the API is read-only for maintenance; admins only", nil, nil, obj{
+				"200": response("The maintenance mode", ref("Maintenance")),
+			})),
+			"put": secured(operation("Turn maintenance mode on or off; while on, writes are refused with 503; admins only", nil, obj{
+				"type":     "object",
+				"required": []string{"enabled"},
+				"properties": obj{
+					"enabled": obj{"type": "boolean"},
+					"message": obj{"type": "string", "description": "shown for the writes refused"},
+				},
+			}, obj{
+				"200": response("The maintenance mode", ref("Maintenance")),
+				"400": errorResponse("Invalid body"),
+			})),
+		},
+		"/admin/slow-queries": obj{
+			"get": secured(operation("List the slowest car storage operations of the instance since it started, slowest first; admins only", []obj{
+				queryParam("limit", "how many to list, at most 100", "integer"),
+			}, nil, obj{
+				"200": response("The slow operations", ref("SlowQueries")),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/admin/faults": obj{
+			"get": secured(operation("List the faults injected into requests; only served with FAULT_INJECTION on; admins only", nil, nil, obj{
+				"200": response("The faults", ref("Faults")),
+			})),
+			"put": secured(operation("Replace the faults injected into requests, on this instance; no rules injects none; admins only", nil, ref("Faults"), obj{
+				"200": response("The faults", ref("Faults")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("A rule is not valid"),
+			})),
+		},
+		"/admin/feature-flags": obj{
+			"get": secured(operation("List the feature flags and whether each is on; admins only", nil, nil, obj{
+				"200": response("The feature flags", obj{"type": "array", "items": ref("FeatureFlag")}),
+			})),
+		},
+		"/admin/feature-flags/{name}": obj{
+			"put": secured(operation("Set a feature flag for the environment and tenants, replacing what was set; left out, each goes back to the default; admins only",
+				[]obj{pathParam("name", "flag name")}, obj{
+					"type": "object",
+					"properties": obj{
+						"enabled": obj{"type": "boolean"},
+						"tenants": obj{"type": "object", "additionalProperties": obj{"type": "boolean"}},
+					},
+				}, obj{
+					"200": response("The feature flag", ref("FeatureFlag")),
+					"400": errorResponse("Invalid body"),
+					"404": errorResponse("Feature flag not found"),
+					"422": errorResponse("Invalid tenant ID"),
+				})),
+		},
+		"/admin/log-level": obj{
+			"get": secured(operation("Tell the level this instance logs at; admins only", nil, nil, obj{
+				"200": response("The log level", ref("LogLevel")),
+			})),
+			"put": secured(operation("Change the level this instance logs at, for a while or until changed again; admins only", nil, obj{
+				"type":     "object",
+				"required": []string{"level"},
+				"properties": obj{
+					"level": obj{"type": "string", "enum": []string{"debug", "info", "warn", "error"}},
+					"for":   obj{"type": "string", "description": "how long before the configured level is restored, e.g. 15m"},
+				},
+			}, obj{
+				"200": response("The log level", ref("LogLevel")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("Invalid level or duration"),
+			})),
+		},
+		"/admin/config/reload": obj{
+			"post": secured(operation("Reload the log level, rate limit and CORS policy of this instance from its configuration, as SIGHUP does; admins only", nil, nil, obj{
+				"200": response("The settings changed", obj{
+					"type":       "object",
+					"properties": obj{"changed": obj{"type": "array", "items": obj{"type": "string"}}},
+				}),
+				"422": errorResponse("The configuration is not valid"),
+			})),
+		},
+		"/admin/audit": obj{
+			"get": secured(operation("List the audit trail across cars, newest first, as written by an API key, an actor or a request; admins only", []obj{
+				queryParam("key_id", "the API key the writes were made with", "string"),
+				queryParam("actor", "the principal that made the writes", "string"),
+				queryParam("request_id", "the request that made the writes", "string"),
+				queryParam("action", "the kind of write, e.g. update", "string"),
+				queryParam("from", "writes at or after this RFC 3339 time", "string"),
+				queryParam("to", "writes before this RFC 3339 time", "string"),
+				queryParam("limit", fmt.Sprintf("entries to list, at most %d, the default", maxAuditEntries), "integer"),
+			}, nil, obj{
+				"200": response("The audit trail", obj{"type": "array", "items": ref("AuditEntry")}),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/admin/outbox": obj{
+			"get": secured(operation("Inspect the events waiting to be sent to webhooks and the event bus, oldest first, or those sent recently, newest first; admins only", []obj{
+				queryParam("status", "pending, the default, or published", "string"),
+				queryParam("limit", fmt.Sprintf("events to list, at most %d", maxOutboxEvents), "integer"),
+			}, nil, obj{
+				"200": response("The backlog", ref("OutboxBacklog")),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/admin/accounting-export": obj{
+			"get": secured(operation("Download the cars sold in a period, by their completed orders, as CSV in an accounting layout; admins only", append([]obj{
+				queryParam("layout", "the layout of the columns; needed when more than one is configured", "string"),
+			}, accountingPeriodParams...), nil, obj{
+				"200": obj{"description": "The sales, oldest first", "content": obj{"text/csv": obj{"schema": obj{"type": "string"}}}},
+				"400": errorResponse("Invalid parameter"),
+			})),
+			"post": secured(operation("Push the export of a period in every layout to the configured directory, S3 bucket or SFTP server, as the month-end job does on the 1st; admins only",
+				accountingPeriodParams, nil, obj{
+					"200": response("The files pushed", obj{"type": "array", "items": ref("AccountingExport")}),
+					"400": errorResponse("Invalid parameter"),
+					"503": errorResponse("Accounting exports are not configured"),
+				})),
+		},
+		"/admin/backups": obj{
+			"get": secured(operation("List the tenant's backups, newest first; admins only", nil, nil, obj{
+				"200": response("The backups", obj{"type": "array", "items": ref("Backup")}),
+				"503": errorResponse("Backups are not configured"),
+			})),
+			"post": secured(operation("Back up the tenant's cars, archive, orders and audit trail; admins only", nil, nil, obj{
+				"201": response("The backup taken", ref("Backup")),
+				"503": errorResponse("Backups are not configured"),
+			})),
+		},
+		"/admin/backups/{name}": obj{
+			"get": secured(operation("Get the manifest of a backup; admins only", []obj{pathParam("name", "backup name")}, nil, obj{
+				"200": response("The backup", ref("Backup")),
+				"404": errorResponse("Backup not found"),
+			})),
+		},
+		"/admin/backups/{name}/restore": obj{
+			"post": secured(operation("Replace the tenant's data with a backup, once its files are checked against the manifest; needs maintenance mode on; admins only",
+				[]obj{pathParam("name", "backup name")}, nil, obj{
+					"200": response("The backup restored", ref("Backup")),
+					"404": errorResponse("Backup not found"),
+					"409": errorResponse("Maintenance mode is off"),
+					"422": errorResponse("The backup does not match its manifest"),
+				})),
+		},
+		"/admin/seed": obj{
+			"post": secured(operation("Add cars generated from fixtures; admins only", []obj{
+				queryParam("count", fmt.Sprintf("cars to add, at most %d", maxSeedCount), "integer"),
+				queryParam("seed", "seed the cars are generated from, 1 by default; the same seed gives the same cars", "integer"),
+			}, nil, obj{
+				"200": response("What happened to each car", ref("BatchReport")),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/trade-ins": obj{
+			"get": secured(operation("List trade-ins, newest first", []obj{
+				queryParam("status", "only trade-ins with this status", "string"),
+			}, nil, obj{
+				"200": response("The trade-ins", obj{"type": "array", "items": ref("TradeIn")}),
+			})),
+			"post": operation("Offer a car in part-exchange", nil, ref("TradeIn"), obj{
+				"201": response("The trade-in; Location holds its URL", ref("TradeIn")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("The trade-in is not valid"),
+			}),
+		},
+		"/trade-ins/{id}": obj{
+			"get": secured(operation("Get a trade-in", []obj{tradeInParam}, nil, obj{
+				"200": response("The trade-in", ref("TradeIn")),
+				"404": errorResponse("Trade-in not found"),
+			})),
+		},
+		"/trade-ins/{id}/photos": obj{
+			"post": operation("Upload a photo of a trade-in awaiting appraisal", []obj{tradeInParam}, nil, obj{
+				"201": response("The photo; Location holds its URL", ref("Image")),
+				"400": errorResponse("Invalid upload"),
+				"404": errorResponse(fmt.Sprintf("No trade-in awaiting appraisal with fewer than %d photos", maxTradeInPhotos)),
+				"413": errorResponse("The photo is too large"),
+				"415": errorResponse("The photo is not a JPEG, PNG or WebP image"),
+			}),
+		},
+		"/trade-ins/{id}/photos/{photo}": obj{
+			"get": secured(operation("Download a photo of a trade-in", []obj{tradeInParam, pathParam("photo", "photo ID")}, nil, obj{
+				"200": obj{"description": "The photo", "content": obj{"image/*": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"302": obj{"description": "The photo is downloaded from the pre-signed URL in Location"},
+				"404": errorResponse("Photo not found"),
+			})),
+		},
+		"/trade-ins/{id}/appraisal": obj{
+			"put": secured(operation("Appraise a trade-in", []obj{tradeInParam}, ref("Appraisal"), obj{
+				"200": response("The appraised trade-in", ref("TradeIn")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Trade-in not found"),
+				"409": errorResponse("The customer has already answered the appraisal"),
+				"422": errorResponse("The appraisal is not valid"),
+			})),
+		},
+		"/trade-ins/{id}/accept": obj{
+			"post": secured(operation("Accept the appraisal of a trade-in for the customer", []obj{tradeInParam}, nil, obj{
+				"200": response("The accepted trade-in", ref("TradeIn")),
+				"404": errorResponse("Trade-in not found"),
+				"409": errorResponse("The trade-in has no valid appraisal"),
+			})),
+		},
+		"/trade-ins/{id}/decline": obj{
+			"post": secured(operation("Decline a trade-in for the customer", []obj{tradeInParam}, nil, obj{
+				"200": response("The declined trade-in", ref("TradeIn")),
+				"404": errorResponse("Trade-in not found"),
+				"409": errorResponse("The trade-in has already been accepted or declined"),
+			})),
+		},
+		"/trade-ins/{id}/order": obj{
+			"post": secured(operation("Put an accepted trade-in towards an open order", []obj{tradeInParam}, obj{
+				"type":       "object",
+				"required":   []string{"order"},
+				"properties": obj{"order": obj{"type": "string", "description": "order ID"}},
+			}, obj{
+				"200": response("The trade-in", ref("TradeIn")),
+				"400": errorResponse("Invalid body"),
+				"409": errorResponse("The trade-in is not accepted or already on an order"),
+				"422": errorResponse("No open order in the trade-in's currency without a trade-in"),
+			})),
+		},
+		"/saved-searches": obj{
+			"get": secured(operation("List the caller's saved searches", nil, nil, obj{
+				"200": response("The saved searches", obj{"type": "array", "items": ref("SavedSearch")}),
+				"401": errorResponse("Not signed in"),
+			})),
+			"post": secured(operation("Save a search", nil, ref("SavedSearch"), obj{
+				"201": response("The saved search; Location holds its URL", ref("SavedSearch")),
+				"400": errorResponse("Invalid body"),
+				"401": errorResponse("Not signed in"),
+				"409": errorResponse("Too many searches saved"),
+				"422": errorResponse("The search is not valid"),
+			})),
+		},
+		"/saved-searches/{id}": obj{
+			"delete": secured(operation("Remove a saved search", []obj{pathParam("id", "saved search ID")}, nil, obj{
+				"204": obj{"description": "Removed"},
+				"404": errorResponse("Saved search not found"),
+			})),
+		},
+		"/saved-searches/{id}/cars": obj{
+			"get": secured(operation("List the cars matching a saved search now", []obj{pathParam("id", "saved search ID")}, nil, obj{
+				"200": response("A page of cars", ref("CarPage")),
+				"404": errorResponse("Saved search not found"),
+			})),
+		},
+		"/webhooks": obj{
+			"get": secured(operation("List the webhooks, without their secrets; admins only", nil, nil, obj{
+				"200": response("The webhooks", obj{"type": "array", "items": ref("Webhook")}),
+			})),
+			"post": secured(operation("Register a webhook; admins only", nil, ref("Webhook"), obj{
+				"201": response("The webhook, with its secret; Location holds its URL", ref("Webhook")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("The webhook is not valid"),
+			})),
+		},
+		"/webhooks/{id}": obj{
+			"get": secured(operation("Get a webhook, without its secret; admins only", []obj{pathParam("id", "webhook ID")}, nil, obj{
+				"200": response("The webhook", ref("Webhook")),
+				"404": errorResponse("Webhook not found"),
+			})),
+			"delete": secured(operation("Remove a webhook; admins only", []obj{pathParam("id", "webhook ID")}, nil, obj{
+				"204": obj{"description": "Removed"},
+				"404": errorResponse("Webhook not found"),
+			})),
+		},
+		"/webhooks/{id}/deliveries": obj{
+			"get": secured(operation("List the deliveries made to a webhook, newest first; admins only", []obj{
+				pathParam("id", "webhook ID"),
+				queryParam("status", "only the deliveries pending, delivered or failed", "string"),
+				queryParam("limit", fmt.Sprintf("deliveries to list, at most %d", maxWebhookDeliveries), "integer"),
+			}, nil, obj{
+				"200": response("The deliveries", obj{"type": "array", "items": ref("WebhookDelivery")}),
+				"400": errorResponse("Invalid parameter"),
+				"404": errorResponse("Webhook not found"),
+			})),
+		},
+		"/notifications": obj{
+			"get": secured(operation("List the emails and text messages sent, newest first; editors only", []obj{
+				queryParam("status", "only the notifications pending, sent or failed", "string"),
+				queryParam("kind", "only the notifications of a kind", "string"),
+				queryParam("customer_id", "only the notifications sent to a customer", "string"),
+				queryParam("vin", "only the notifications about a car", "string"),
+				queryParam("limit", fmt.Sprintf("notifications to list, at most %d", maxNotificationsListed), "integer"),
+			}, nil, obj{
+				"200": response("The notifications", obj{"type": "array", "items": ref("Notification")}),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/notifications/{id}": obj{
+			"get": secured(operation("Get a notification and whether it was sent", []obj{pathParam("id", "notification ID")}, nil, obj{
+				"200": response("The notification", ref("Notification")),
+				"404": errorResponse("Notification not found"),
+			})),
+		},
+		"/stock-levels": obj{
+			"get": secured(operation("List the count of each model's cars by status", []obj{
+				queryParam("manufacturer", "only the models of this manufacturer", "string"),
+				queryParam("model", "only this model", "string"),
+				queryParam("low", "only the models below the threshold of an alert", "boolean"),
+			}, nil, obj{
+				"200": response("The stock levels", obj{"type": "array", "items": ref("StockLevel")}),
+				"400": errorResponse("Invalid parameter"),
+			})),
+		},
+		"/stock-alerts": obj{
+			"get": secured(operation("List low stock alerts", nil, nil, obj{
+				"200": response("The alerts", obj{"type": "array", "items": ref("StockAlert")}),
+			})),
+			"post": secured(operation("Alert someone when a model's cars in stock fall below a threshold", nil, ref("StockAlert"), obj{
+				"201": response("The alert; Location holds its URL", ref("StockAlert")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("The alert is not valid"),
+			})),
+		},
+		"/stock-alerts/{id}": obj{
+			"delete": secured(operation("Delete a low stock alert", []obj{pathParam("id", "alert ID")}, nil, obj{
+				"204": obj{"description": "Deleted"},
+				"404": errorResponse("Stock alert not found"),
+			})),
+		},
+		"/customers": obj{
+			"get": secured(operation("List customers", []obj{
+				queryParam("email", "only the customers with this email address", "string"),
+				queryParam("consent", "only the customers consenting to marketing_email, marketing_phone or marketing_post", "string"),
+			}, nil, obj{
+				"200": response("The customers", obj{"type": "array", "items": ref("Customer")}),
+				"400": errorResponse("Invalid parameter"),
+			})),
+			"post": secured(operation("Add a customer", nil, ref("Customer"), obj{
+				"201": response("The customer; Location holds their URL", ref("Customer")),
+				"400": errorResponse("Invalid body"),
+				"422": errorResponse("The customer is not valid"),
+			})),
+		},
+		"/customers/{id}": obj{
+			"get": secured(operation("Get a customer", []obj{customerParam}, nil, obj{
+				"200": response("The customer", ref("Customer")),
+				"404": errorResponse("Customer not found"),
+			})),
+			"put": secured(operation("Replace a customer's details and consent", []obj{customerParam}, ref("Customer"), obj{
+				"200": response("The customer", ref("Customer")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Customer not found"),
+				"422": errorResponse("The customer is not valid"),
+			})),
+			"delete": secured(operation("Erase a customer and everything held about them", []obj{customerParam}, nil, obj{
+				"204": obj{"description": "Erased"},
+				"404": errorResponse("Customer not found"),
+			})),
+		},
+		"/customers/{id}/enquiries": obj{
+			"post": secured(operation("Record an enquiry by a customer", []obj{customerParam}, ref("Enquiry"), obj{
+				"201": response("The customer", ref("Customer")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Customer not found"),
+				"422": errorResponse("The enquiry is not valid or the car is not in stock"),
+			})),
+		},
+		"/customers/{id}/purchases": obj{
+			"post": secured(operation("Record a purchase by a customer", []obj{customerParam}, ref("Purchase"), obj{
+				"201": response("The customer", ref("Customer")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Customer not found"),
+				"422": errorResponse("The purchase is not valid or the car is not in stock"),
+			})),
+		},
+		"/api-keys/{id}": obj{
+			"delete": secured(operation("Revoke an API key", []obj{pathParam("id", "key ID")}, nil, obj{
+				"204": obj{"description": "Revoked"},
+				"404": errorResponse("Key not found"),
+			})),
+		},
+		"/api-keys/{id}/quota": obj{
+			"put": secured(operation("Change an API key's quota; null gives it the default", []obj{pathParam("id", "key ID")}, ref("Quota"), obj{
+				"200": response("The key", ref("APIKey")),
+				"400": errorResponse("Invalid body"),
+				"404": errorResponse("Key not found"),
+			})),
+		},
+		"/api-keys/{id}/usage": obj{
+			"get": secured(operation("Report an API key's usage", []obj{pathParam("id", "key ID")}, nil, obj{
+				"200": response("The usage", ref("Usage")),
+				"404": errorResponse("Key not found"),
+			})),
+		},
+		"/usage": obj{
+			"get": secured(operation("Report the usage of the API key the request is made with", nil, nil, obj{
+				"200": response("The usage", ref("Usage")),
+				"400": errorResponse("The request is not made with an API key"),
+			})),
+		},
+		"/users": obj{
+			"get": secured(operation("List users", nil, nil, obj{
+				"200": response("The users", obj{"type": "array", "items": ref("User")}),
+			})),
+			"post": secured(operation("Make a user", nil, obj{
+				"type":     "object",
+				"required": []string{"username", "password"},
+				"properties": obj{
+					"username": obj{"type": "string"},
+					"password": obj{"type": "string", "minLength": minPasswordLength},
+					"role":     obj{"type": "string", "enum": []string{roleViewer, roleEditor, roleAdmin}},
+				},
+			}, obj{
+				"201": response("The user", ref("User")),
+				"400": errorResponse("Invalid body"),
+				"409": errorResponse("The username is taken"),
+			})),
+		},
+		"/users/me/favorites": obj{
+			"get": secured(operation("List the caller's watchlist, most recently added first", nil, nil, obj{
+				"200": response("The favourite cars", obj{"type": "array", "items": ref("Favorite")}),
+				"401": errorResponse("Not signed in"),
+			})),
+		},
+		"/users/me/favorites/{vin}": obj{
+			"post": secured(optionalBody(operation("Add a car to the caller's watchlist, optionally to be told when its price drops", []obj{vinParam}, obj{
+				"type":       "object",
+				"properties": obj{"notify": ref("Contact")},
+			}, obj{
+				"201": obj{"description": "Added"},
+				"204": obj{"description": "Already on the watchlist"},
+				"401": errorResponse("Not signed in"),
+				"404": errorResponse("Car not found"),
+				"409": errorResponse("Too many cars on the watchlist"),
+				"422": errorResponse("Invalid contact details"),
+			}))),
+			"delete": secured(operation("Remove a car from the caller's watchlist", []obj{vinParam}, nil, obj{
+				"204": obj{"description": "Removed"},
+				"401": errorResponse("Not signed in"),
+				"404": errorResponse("The car is not on the watchlist"),
+			})),
+		},
+		"/users/{username}/disable": obj{
+			"post": secured(operation("Disable a user, ending their sessions", []obj{pathParam("username", "username")}, nil, obj{
+				"200": response("The user", ref("User")),
+				"404": errorResponse("User not found"),
+			})),
+		},
+		"/users/{username}/password": obj{
+			"put": secured(operation("Change a password; users changing their own give the current one", []obj{pathParam("username", "username")}, obj{
+				"type":     "object",
+				"required": []string{"password"},
+				"properties": obj{
+					"current_password": obj{"type": "string"},
+					"password":         obj{"type": "string", "minLength": minPasswordLength},
+				},
+			}, obj{
+				"204": obj{"description": "Changed"},
+				"400": errorResponse("Invalid body or wrong current password"),
+				"404": errorResponse("User not found"),
+			})),
+		},
+		"/login": obj{
+			"post": operation("Sign in with a username and password", nil, obj{
+				"type":       "object",
+				"properties": obj{"username": obj{"type": "string"}, "password": obj{"type": "string"}},
+			}, obj{
+				"200": response("The tokens", ref("SessionTokens")),
+				"401": errorResponse("Invalid credentials"),
+			}),
+		},
+		"/login/refresh": obj{
+			"post": operation("Exchange a refresh token for new tokens", nil, obj{
+				"type":       "object",
+				"properties": obj{"refresh_token": obj{"type": "string"}},
+			}, obj{
+				"200": response("The tokens", ref("SessionTokens")),
+				"401": errorResponse("Invalid, used or expired refresh token"),
+			}),
+		},
+		"/logout": obj{
+			"post": operation("Revoke a refresh token", nil, obj{
+				"type":       "object",
+				"properties": obj{"refresh_token": obj{"type": "string"}},
+			}, obj{
+				"204": obj{"description": "Revoked"},
+			}),
+		},
+		"/roles": obj{
+			"get": secured(operation("List role assignments", nil, nil, obj{
+				"200": response("The assignments", obj{"type": "array", "items": ref("RoleAssignment")}),
+			})),
+		},
+		"/graphql": obj{
+			"post": operation("Run a GraphQL query or mutation", nil, obj{
+				"type": "object",
+				"properties": obj{
+					"query":         obj{"type": "string"},
+					"operationName": obj{"type": "string"},
+					"variables":     obj{"type": "object"},
+				},
+				"required": []string{"query"},
+			}, obj{
+				"200": response("The GraphQL result; errors are reported in its errors", obj{"type": "object"}),
+				"400": errorResponse("Missing query or incorrect body"),
+			}),
+			"get": operation("Run a GraphQL query", []obj{
+				queryParam("query", "the GraphQL document", "string"),
+				queryParam("operationName", "the operation to run", "string"),
+				queryParam("variables", "the variables as JSON", "string"),
+			}, nil, obj{
+				"200": response("The GraphQL result; errors are reported in its errors", obj{"type": "object"}),
+				"400": errorResponse("Missing query"),
+				"405": errorResponse("Mutations must be sent with POST"),
+			}),
+		},
+		"/roles/{subject}": obj{
+			"put": secured(operation("Assign a role", []obj{pathParam("subject", "token subject")}, obj{
+				"type":       "object",
+				"properties": obj{"role": obj{"type": "string"}},
+			}, obj{
+				"200": response("The assignment", ref("RoleAssignment")),
+				"400": errorResponse("Invalid role"),
+			})),
+		},
+	}
+
+	// Every path acts for a tenant.
+	tenant := headerParam(tenantHeader, "the tenant to act for, unless the credentials are bound to one")
+	for _, item := range paths {
+		item.(obj)["parameters"] = []obj{tenant}
+	}
+
+	return obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":       "Car Supermarket API",
+			"version":     apiVersion,
+			"description": "Errors and the display values of enumerations are in the language of the Accept-Language header, of " + strings.Join(localeLanguages(), ", ") + "; Content-Language says which was used.",
+		},
+		"servers": []obj{{"url": apiRoute("")}},
+		"paths":   paths,
+		"components": obj{
+			"schemas": schemas,
+			"securitySchemes": obj{
+				"bearer": obj{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey": obj{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"signedApiKey": obj{
+					"type": "apiKey", "in": "header", "name": signatureHeader,
+					"description": "key=<key ID>,t=<unix time>,nonce=<16 to 128 URL-safe characters>,v1=<hex HMAC-SHA256>, keyed with the hex SHA-256 of the key's secret, " +
+						"of the time, nonce, method, request URI and hex SHA-256 of the body, joined by newlines. The time must be within the allowed skew and a nonce is accepted once.",
+				},
+			},
+		},
+	}
+}
+
+// openAPI serves the OpenAPI document.
+func openAPI() func(w http.ResponseWriter, r *http.Request) {
+	body, err := json.MarshalIndent(openAPISpec(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		responseWithJSON(w, body, http.StatusOK)
+	}
+}
+
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Car Supermarket API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: %q, dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// apiDocs serves a Swagger UI page for the OpenAPI document.
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, swaggerUI, route("/openapi.json"))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The states of an order. An open order holds its car reserved until it is
+// completed, which sells the car, or cancelled, which makes it available
+// again.
+const (
+	orderOpen      = "open"
+	orderCompleted = "completed"
+	orderCancelled = "cancelled"
+)
+
+// order is the sale of a car to a buyer.
+type order struct {
+	ID      string `json:"id" bson:"orderid"`
+	VIN     string `json:"vin"`
+	Buyer   buyer  `json:"buyer"`
+	Price   price  `json:"price"`
+	Deposit *price `json:"deposit,omitempty" bson:",omitempty"`
+	// TradeIn is the accepted trade-in put towards the order, if any.
+	TradeIn     *tradeInAllowance `json:"trade_in,omitempty" bson:"tradein,omitempty"`
+	Status      string            `json:"status"`
+	CreatedBy   string            `json:"created_by,omitempty" bson:"createdby,omitempty"`
+	CreatedAt   time.Time         `json:"created_at" bson:"createdat"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty" bson:"completedat,omitempty"`
+	CancelledAt *time.Time        `json:"cancelled_at,omitempty" bson:"cancelledat,omitempty"`
+	Tenant      string            `json:"-" bson:"tenant"`
+}
+
+type buyer struct {
+	CustomerID string `json:"customer_id,omitempty" bson:"customerid,omitempty"`
+	Name       string `json:"name"`
+	Email      string `json:"email,omitempty" bson:",omitempty"`
+	Phone      string `json:"phone,omitempty" bson:",omitempty"`
+}
+
+func (o *order) validate() *fieldError {
+	c := &checks{}
+	c.require("vin", o.VIN, "The VIN is required")
+	c.require("buyer", o.Buyer.Name, "The buyer's name is required")
+	c.maxLength("buyer", o.Buyer.Name, maxNameLength)
+	c.check(o.Price.Amount >= 0 && currencyCode.MatchString(o.Price.Currency), "price", "The price must not be negative and in an ISO 4217 currency")
+	if o.Deposit != nil {
+		c.check(o.Deposit.Amount >= 0 && o.Deposit.Amount <= o.Price.Amount && o.Deposit.Currency == o.Price.Currency,
+			"deposit", "The deposit must be in the currency of the price and not more than it")
+	}
+	return c.err()
+}
+
+type orderStore struct {
+	c *mongo.Collection
+}
+
+func (s *orderStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "orderid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// A car has at most one open order.
+		{
+			Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": orderOpen}),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "status", Value: 1}, {Key: "createdat", Value: -1}}},
+	})
+	return err
+}
+
+// orderWrites moves cars through their sale. Each move is a single
+// conditional update of the car, so a car cannot be reserved or sold twice
+// however many requests race for it.
+type orderWrites struct {
+	orders       *orderStore
+	reservations *reservationStore
+	cars         *mongo.Collection
+	events       *broker
+	audit        *auditLog
+}
+
+// moveCar updates the live car matching filter and returns it as it was and
+// as it now is.
+func (o *orderWrites) moveCar(ctx context.Context, filter, update bson.M) (vehicle, vehicle, error) {
+	var before vehicle
+	update["$inc"] = incRevision
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := o.cars.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	if err != nil {
+		return before, before, err
+	}
+
+	var after vehicle
+	err = o.cars.FindOne(ctx, liveCar(ctx, before.VIN)).Decode(&after)
+	return before, after, err
+}
+
+// move moves a car as moveCar does, publishing the move as event in the same
+// transaction.
+func (o *orderWrites) move(ctx context.Context, event string, filter, update bson.M) (before, after vehicle, err error) {
+	err = o.events.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if before, after, err = o.moveCar(ctx, filter, update); err != nil {
+			return err
+		}
+		o.events.publish(ctx, carChanged(event, &before, &after))
+		return nil
+	})
+	return before, after, err
+}
+
+// changed audits a move of a car.
+func (o *orderWrites) changed(ctx context.Context, action string, before, after *vehicle) {
+	o.audit.change(ctx, action, after.VIN, before, after)
+}
+
+func writeOrder(w http.ResponseWriter, o order, status int) {
+	respBody, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, status)
+}
+
+// createOrder opens an order for a car, reserving it for the buyer.
+func createOrder(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ord order
+		if !decodeBody(w, r.Body, &ord) {
+			return
+		}
+
+		if err := ord.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		ord.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		ord.Status = orderOpen
+		ord.CreatedAt = time.Now().UTC()
+		ord.CompletedAt = nil
+		ord.TradeIn = nil
+		ord.CancelledAt = nil
+		ord.Tenant = tenantFrom(r.Context())
+		if p := principalFrom(r.Context()); p != nil {
+			ord.CreatedBy = p.Subject
+		}
+
+		// An order takes over a hold on the car.
+		update := bson.M{"$set": bson.M{"status": carReserved, "order": ord.ID}, "$unset": bson.M{"hold": ""}}
+		// The car is reserved and its order opened in one transaction. Without
+		// one, the car is released again if the order cannot be opened.
+		var before, after vehicle
+		moved := false
+		err = o.events.transact(r.Context(), func(ctx context.Context) error {
+			var err error
+			moved = false
+			if before, after, err = o.moveCar(ctx, holdable(ctx, ord.VIN, true), update); err != nil {
+				return err
+			}
+			moved = true
+			if _, err := o.orders.c.InsertOne(ctx, ord); err != nil {
+				return err
+			}
+			o.events.publish(ctx, carChanged(eventUpdated, &before, &after))
+			return nil
+		})
+		if err != nil && moved {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert order", "err", err)
+
+			// Without its order the reservation would never be released.
+			if !o.events.transactional() {
+				rollback := forTenant(r.Context(), bson.M{"vin": ord.VIN, "order": ord.ID})
+				_, err := o.cars.UpdateOne(context.Background(), rollback,
+					bson.M{"$set": bson.M{"status": carInStock}, "$unset": bson.M{"order": ""}, "$inc": incRevision})
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed release car of failed order", "vin", ord.VIN, "err", err)
+				}
+			}
+			return
+		}
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed reserve car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				n, err := o.cars.CountDocuments(r.Context(), liveCar(r.Context(), ord.VIN))
+				if err != nil {
+					errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+					slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+					return
+				}
+				if n == 0 {
+					fieldErrorWithJSON(w, "vin", "not_found", "There is no car with this VIN")
+					return
+				}
+				errorWithJSON(w, "The car is not in stock", http.StatusConflict)
+				return
+			}
+		}
+
+		if before.Hold != nil {
+			o.reservations.drop(r.Context(), ord.VIN, before.Hold.Until)
+		}
+		o.changed(r.Context(), auditReserved, &before, &after)
+
+		w.Header().Set("Location", apiRoute("/orders/"+ord.ID))
+		writeOrder(w, ord, http.StatusCreated)
+	}
+}
+
+// closeOrder moves an open order to status, and its car with carUpdate.
+func closeOrder(w http.ResponseWriter, r *http.Request, o *orderWrites, status string, carUpdate bson.M, event, action string) {
+	now := time.Now().UTC()
+	set := bson.M{"status": status}
+	if status == orderCompleted {
+		set["completedat"] = now
+	} else {
+		set["cancelledat"] = now
+	}
+
+	var ord order
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	filter := forTenant(r.Context(), bson.M{"orderid": pat.Param(r, "id"), "status": orderOpen})
+	err := o.orders.c.FindOneAndUpdate(r.Context(), filter, bson.M{"$set": set}, opts).Decode(&ord)
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed update order", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Open order not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	carFilter := liveCar(r.Context(), ord.VIN)
+	carFilter["order"] = ord.ID
+	before, after, err := o.move(r.Context(), event, carFilter, carUpdate)
+	switch err {
+	case nil:
+		o.changed(r.Context(), action, &before, &after)
+	case mongo.ErrNoDocuments:
+		// The car has been deleted since; the order is closed all the same.
+		slog.WarnContext(r.Context(), "Closed order of a car no longer in stock", "order", ord.ID, "vin", ord.VIN)
+	default:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed update car of order", "order", ord.ID, "err", err)
+		return
+	}
+
+	writeOrder(w, ord, http.StatusOK)
+}
+
+// completeOrder sells the car of an open order.
+func completeOrder(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		update := bson.M{"$set": bson.M{"status": carSold, "soldat": time.Now().UTC()}}
+		closeOrder(w, r, o, orderCompleted, update, eventSold, auditSold)
+	}
+}
+
+// cancelOrder cancels an open order, making its car available again.
+func cancelOrder(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		update := bson.M{"$set": bson.M{"status": carInStock}, "$unset": bson.M{"order": ""}}
+		closeOrder(w, r, o, orderCancelled, update, eventUpdated, auditReleased)
+	}
+}
+
+func orderByID(s *orderStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ord order
+		err := s.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"orderid": pat.Param(r, "id")})).Decode(&ord)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find order", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Order not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		writeOrder(w, ord, http.StatusOK)
+	}
+}
+
+var orderStatuses = map[string]bool{orderOpen: true, orderCompleted: true, orderCancelled: true}
+
+// allOrders lists orders newest first, optionally only those with a status,
+// for a car, or created in a range: ?status=open&from=2024-01-01T00:00:00Z.
+func allOrders(s *orderStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := forTenant(r.Context(), bson.M{})
+
+		if status := query.Get("status"); status != "" {
+			if !orderStatuses[status] {
+				errorWithJSON(w, "Parameter \"status\" must be open, completed or cancelled", http.StatusBadRequest)
+				return
+			}
+			filter["status"] = status
+		}
+		if vin := query.Get("vin"); vin != "" {
+			filter["vin"] = vin
+		}
+
+		created := bson.M{}
+		for name, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+			value := query.Get(name)
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errorWithJSON(w, "Parameter \""+name+"\" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			created[op] = t
+		}
+		if len(created) > 0 {
+			filter["createdat"] = created
+		}
+
+		orders := []order{}
+		cur, err := s.c.Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}))
+		if err == nil {
+			err = cur.All(r.Context(), &orders)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list orders", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(orders, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
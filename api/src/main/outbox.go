@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var outboxRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carsupermarket_outbox_relayed_total",
+	Help: "Attempts at relaying outbox events to webhooks and the event bus, by outcome: success or failure.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(outboxRelayed)
+}
+
+const (
+	// outboxPollInterval is how often the relay looks for events written by
+	// other instances, or due a retry.
+	outboxPollInterval = 5 * time.Second
+	// outboxLease is how long an event being relayed is left to the instance
+	// relaying it, before another may take it over.
+	outboxLease = time.Minute
+	// outboxFirstRetry is the wait before relaying a failed event again,
+	// doubled for each retry after up to outboxMaxBackoff.
+	outboxFirstRetry = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+	// maxOutboxEvents is the most outbox events listed at once.
+	maxOutboxEvents = 100
+)
+
+// The statuses of an outbox event.
+const (
+	outboxPending   = "pending"
+	outboxPublished = "published"
+)
+
+// outboxEvent is an inventory event as it is kept in the outbox.
+type outboxEvent struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Type        string             `json:"type"`
+	VIN         string             `json:"vin"`
+	Car         *vehicle           `json:"car,omitempty" bson:",omitempty"`
+	Changes     []fieldChange      `json:"changes,omitempty" bson:",omitempty"`
+	Status      string             `json:"status"`
+	Attempts    int                `json:"attempts"`
+	LastError   string             `json:"last_error,omitempty" bson:"lasterror,omitempty"`
+	NextAttempt *time.Time         `json:"next_attempt,omitempty" bson:"nextattempt,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"createdat"`
+	PublishedAt *time.Time         `json:"published_at,omitempty" bson:"publishedat,omitempty"`
+	Tenant      string             `json:"-" bson:"tenant"`
+}
+
+// eventSink is where the relay sends outbox events. It is given each event
+// until it succeeds, so it may be given one more than once and should make
+// that harmless, by its ID.
+type eventSink func(ctx context.Context, e outboxEvent) error
+
+// outbox keeps inventory events until they have been relayed to the sinks,
+// so that webhooks and the event bus are sent every change, once a crash or
+// an unavailable sink is recovered from. Events written with broker.transact
+// are added in the same transaction as the change; those published outside
+// one are added just after it.
+//
+// Events are relayed oldest first, one at a time across the instances: an
+// event that fails is retried with backoff, and the events after it wait.
+// Relayed events are kept for retention.
+type outbox struct {
+	c         *mongo.Collection
+	client    *mongo.Client
+	retention time.Duration
+	sinks     []eventSink
+	wake      chan struct{}
+}
+
+func newOutbox(c *mongo.Collection, client *mongo.Client, retention time.Duration) *outbox {
+	return &outbox{c: c, client: client, retention: retention, wake: make(chan struct{}, 1)}
+}
+
+func (o *outbox) ensureIndex(ctx context.Context) error {
+	_, err := o.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "publishedat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(o.retention.Seconds())),
+		},
+	})
+	return err
+}
+
+// add keeps events to be relayed. Given a session context, they are added in
+// its transaction.
+func (o *outbox) add(ctx context.Context, events ...inventoryEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	docs := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		entry := outboxEvent{ID: primitive.NewObjectID(), Type: e.Type, VIN: e.VIN, Car: e.Car, Changes: e.Changes,
+			Status: outboxPending, NextAttempt: &now, CreatedAt: now, Tenant: tenantFrom(ctx)}
+		if e.Car != nil {
+			entry.Tenant = e.Car.Tenant
+		}
+		docs = append(docs, entry)
+	}
+	_, err := o.c.InsertMany(ctx, docs)
+	return err
+}
+
+// notify wakes the relay, for events just added.
+func (o *outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// relay relays events to the sinks until stop is closed, then closes done.
+func (o *outbox) relay(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			relayed, err := o.relayNext(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("Failed relay outbox event", "err", err)
+			}
+			if !relayed {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayNext relays the oldest pending event if it is due, reporting whether
+// it was. The event is claimed first, by leasing it, so that no other
+// instance relays it at the same time.
+func (o *outbox) relayNext(ctx context.Context) (bool, error) {
+	var head outboxEvent
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})
+	err := o.c.FindOne(ctx, bson.M{"status": outboxPending}, opts).Decode(&head)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	if head.NextAttempt != nil && head.NextAttempt.After(now) {
+		return false, nil
+	}
+
+	lease := now.Add(outboxLease)
+	res, err := o.c.UpdateOne(ctx,
+		bson.M{"_id": head.ID, "status": outboxPending, "nextattempt": head.NextAttempt},
+		bson.M{"$set": bson.M{"nextattempt": lease}, "$inc": bson.M{"attempts": 1}})
+	if err != nil || res.ModifiedCount == 0 {
+		return false, err
+	}
+	head.Attempts++
+
+	sinkCtx := withTenant(context.WithoutCancel(ctx), head.Tenant)
+	for _, sink := range o.sinks {
+		if err = sink(sinkCtx, head); err != nil {
+			break
+		}
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	if sinkErr := err; sinkErr != nil {
+		outboxRelayed.WithLabelValues("failure").Inc()
+		slog.Warn("Failed relay outbox event; will retry", "type", head.Type, "vin", head.VIN, "attempts", head.Attempts, "err", sinkErr)
+		next := time.Now().UTC().Add(outboxBackoff(head.Attempts))
+		_, err = o.c.UpdateOne(ctx, bson.M{"_id": head.ID},
+			bson.M{"$set": bson.M{"nextattempt": next, "lasterror": sinkErr.Error()}})
+		return false, err
+	}
+
+	outboxRelayed.WithLabelValues("success").Inc()
+	_, err = o.c.UpdateOne(ctx, bson.M{"_id": head.ID}, bson.M{
+		"$set":   bson.M{"status": outboxPublished, "publishedat": time.Now().UTC()},
+		"$unset": bson.M{"nextattempt": "", "lasterror": ""},
+	})
+	return err == nil, err
+}
+
+// outboxBackoff returns the wait after the given number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	wait := outboxFirstRetry
+	for i := 1; i < attempts && wait < outboxMaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, outboxMaxBackoff)
+}
+
+// outboxBacklog is the response of GET /admin/outbox.
+type outboxBacklog struct {
+	Pending       int64         `json:"pending"`
+	OldestPending *time.Time    `json:"oldest_pending,omitempty"`
+	Events        []outboxEvent `json:"events"`
+}
+
+// outboxEvents reports the tenant's events waiting to be relayed, or with
+// ?status=published those relayed recently.
+func outboxEvents(o *outbox) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := outboxPending
+		switch v := r.URL.Query().Get("status"); v {
+		case "":
+		case outboxPending, outboxPublished:
+			status = v
+		default:
+			errorWithJSON(w, "Parameter \"status\" must be pending or published", http.StatusBadRequest)
+			return
+		}
+		limit := int64(maxOutboxEvents)
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 || n > maxOutboxEvents {
+				errorWithJSON(w, fmt.Sprintf("Parameter \"limit\" must be between 1 and %d", maxOutboxEvents), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		backlog, err := o.backlog(r.Context(), status, limit)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list outbox events", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(backlog, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// backlog lists the events with the status, pending ones oldest first and
+// published ones newest first.
+func (o *outbox) backlog(ctx context.Context, status string, limit int64) (outboxBacklog, error) {
+	backlog := outboxBacklog{Events: []outboxEvent{}}
+	pending := forTenant(ctx, bson.M{"status": outboxPending})
+	var err error
+	if backlog.Pending, err = o.c.CountDocuments(ctx, pending); err != nil {
+		return backlog, err
+	}
+
+	var oldest outboxEvent
+	err = o.c.FindOne(ctx, pending, options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&oldest)
+	switch err {
+	default:
+		return backlog, err
+	case mongo.ErrNoDocuments:
+	case nil:
+		backlog.OldestPending = &oldest.CreatedAt
+	}
+
+	order := 1
+	if status == outboxPublished {
+		order = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: order}}).SetLimit(limit)
+	cur, err := o.c.Find(ctx, forTenant(ctx, bson.M{"status": status}), opts)
+	if err == nil {
+		err = cur.All(ctx, &backlog.Events)
+	}
+	return backlog, err
+}
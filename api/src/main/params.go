@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// defaultListLimit is the page size used when the client does not ask
+	// for one, and maxListLimit caps the page size a client may ask for.
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// listFields maps the public (JSON) field names that may be filtered, sorted
+// and selected on to the keys they are stored under.
+var listFields = map[string]string{
+	"manufacturer": "manufacturer",
+	"model":        "model",
+	"vin":          "vin",
+	"regno":        "regno",
+	"dealer":       "dealer",
+	"branch":       "branch",
+	"price":        "price.amount",
+	"mileage":      "mileage",
+	"year":         "year",
+	"fuel_type":    "fueltype",
+	"transmission": "transmission",
+	"colour":       "colour",
+	"condition":    "condition",
+	"status":       "status",
+}
+
+// numericFields are the listFields holding integers. Besides matching a value
+// exactly they can be filtered on a range with the _min and _max suffixes,
+// e.g. ?price_min=500000&year_min=2018.
+var numericFields = map[string]bool{
+	"price":   true,
+	"mileage": true,
+	"year":    true,
+}
+
+var rangeSuffixes = map[string]string{
+	"_min": "$gte",
+	"_max": "$lte",
+}
+
+// sortFields is the subset of listFields that may be sorted on. Each is
+// backed by an index created in ensureIndex.
+var sortFields = map[string]bool{
+	"manufacturer": true,
+	"model":        true,
+	"vin":          true,
+	"regno":        true,
+	"price":        true,
+	"mileage":      true,
+	"year":         true,
+}
+
+var listFormats = map[string]bool{
+	"json":   true,
+	"ndjson": true,
+}
+
+// ListParams is the validated form of the query string accepted by list-style
+// endpoints.
+type ListParams struct {
+	Filter     bson.M
+	Text       string
+	Sort       bson.D
+	Limit      int
+	Offset     int
+	Page       int
+	UseCursor  bool
+	After      string
+	Fields     []string
+	Projection bson.M
+	Format     string
+	// Facets asks for facet counts alongside the page.
+	Facets bool
+	// Links asks for the links of the page and of each car.
+	Links bool
+	// IncludeDeleted lists deleted cars too.
+	IncludeDeleted bool
+	// IncludeArchived lists the archived sold cars too.
+	IncludeArchived bool
+	// Currency asks for the prices converted to it too.
+	Currency string
+	// Fuzzy has a search find near misses of manufacturers and models too.
+	Fuzzy bool
+	// near lists the cars at these dealerships, nearest first.
+	near []branchDistance
+	// paged has each yield only the cars of the page, after the cursor or
+	// offset, with one more in cursor mode as findPage fetches.
+	paged bool
+}
+
+// parseListParams validates the query string of r. The returned error is
+// suitable for showing to the client in a 400 response.
+func parseListParams(r *http.Request) (ListParams, error) {
+	return parseListQuery(r.URL.Query())
+}
+
+// parseListQuery validates the parameters of a listing.
+func parseListQuery(query url.Values) (ListParams, error) {
+	params := ListParams{Filter: bson.M{}, Limit: defaultListLimit, Format: "json"}
+
+	if query.Get("page") != "" && query.Get("offset") != "" {
+		return params, fmt.Errorf("Parameters \"page\" and \"offset\" cannot be combined")
+	}
+
+	if _, ok := query["cursor"]; ok {
+		for _, name := range []string{"page", "offset", "sort"} {
+			if _, ok := query[name]; ok {
+				return params, fmt.Errorf("Parameter %q cannot be combined with \"cursor\"", name)
+			}
+		}
+	}
+
+	for name, values := range query {
+		if len(values) != 1 {
+			return params, fmt.Errorf("Parameter %q may only be given once", name)
+		}
+		value := values[0]
+
+		var err error
+		switch name {
+		case "limit":
+			params.Limit, err = parseCount(name, value, 1, maxListLimit)
+		case "offset":
+			params.Offset, err = parseCount(name, value, 0, -1)
+		case "page":
+			params.Page, err = parseCount(name, value, 1, -1)
+		case "q":
+			params.Text = value
+			params.bound("$text", "$search", value)
+		case "cursor":
+			params.UseCursor = true
+			params.After, err = decodeCursor(value)
+		case "sort":
+			params.Sort, err = parseSort(value)
+		case "fields":
+			params.Fields, params.Projection, err = parseFields(value)
+		case "facets", "links":
+			var on bool
+			on, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("Parameter %q must be true or false", name)
+			}
+			if name == "facets" {
+				params.Facets = on
+			} else {
+				params.Links = on
+			}
+		case "fuzzy":
+			params.Fuzzy, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("Parameter %q must be true or false", name)
+			}
+		case "include_deleted":
+			params.IncludeDeleted, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("Parameter %q must be true or false", name)
+			}
+		case "include_archived":
+			params.IncludeArchived, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("Parameter %q must be true or false", name)
+			}
+		case "price_review":
+			var flagged bool
+			flagged, err = strconv.ParseBool(value)
+			if err != nil {
+				err = fmt.Errorf("Parameter %q must be true or false", name)
+			}
+			params.bound("pricereviewat", "$exists", flagged)
+		case "currency":
+			if !currencyCode.MatchString(value) {
+				err = fmt.Errorf("Parameter %q must be an ISO 4217 code such as EUR", name)
+			}
+			params.Currency = value
+		case "format":
+			if !listFormats[value] {
+				err = fmt.Errorf("Unsupported format %q", value)
+			}
+			params.Format = value
+		default:
+			err = params.addFilter(name, value)
+		}
+		if err != nil {
+			return params, err
+		}
+	}
+
+	// The archive has no text index to search.
+	if params.IncludeArchived && params.Text != "" {
+		return params, fmt.Errorf("Parameter \"include_archived\" cannot be combined with \"q\"")
+	}
+	if !params.IncludeDeleted {
+		params.bound("deletedat", "$exists", false)
+	}
+	if err := checkFilter(params.Filter); err != nil {
+		return params, err
+	}
+
+	if params.UseCursor {
+		params.Sort = bson.D{{Key: "vin", Value: 1}}
+	} else if params.Page > 0 {
+		params.Offset = (params.Page - 1) * params.Limit
+	} else {
+		params.Page = params.Offset/params.Limit + 1
+	}
+
+	return params, nil
+}
+
+// addFilter narrows the listing to the cars whose field matches the filter
+// parameter name.
+func (p *ListParams) addFilter(name, value string) error {
+	field, op := name, ""
+	for suffix, o := range rangeSuffixes {
+		if base := strings.TrimSuffix(name, suffix); base != name && numericFields[base] {
+			field, op = base, o
+		}
+	}
+
+	key, ok := listFields[field]
+	if !ok {
+		return fmt.Errorf("Unknown parameter %q", name)
+	}
+
+	if _, ok := carTransitions[value]; field == "status" && !ok {
+		return fmt.Errorf("Parameter %q must be a car status", name)
+	}
+	if !numericFields[field] {
+		switch field {
+		case "vin":
+			value = vin.Normalize(value)
+		case "regno":
+			value = normalRegNo(value)
+		}
+		p.equal(key, value)
+		return nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Parameter %q must be an integer", name)
+	}
+
+	if op == "" {
+		p.equal(key, n)
+	} else {
+		p.bound(key, op, n)
+	}
+	return nil
+}
+
+// parseCount parses a non-negative integer parameter within [min, max]. A
+// negative max means there is no upper bound.
+func parseCount(name, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || (max >= 0 && n > max) {
+		if max < 0 {
+			return 0, fmt.Errorf("Parameter %q must be an integer of at least %d", name, min)
+		}
+		return 0, fmt.Errorf("Parameter %q must be an integer between %d and %d", name, min, max)
+	}
+	return n, nil
+}
+
+// parseSort turns "manufacturer,-model" into sort keys. The VIN is added as a
+// final key when missing so that pages have a stable order.
+func parseSort(value string) (bson.D, error) {
+	var keys bson.D
+	byVIN := false
+	for _, field := range strings.Split(value, ",") {
+		name := strings.TrimPrefix(field, "-")
+		if !sortFields[name] {
+			return nil, fmt.Errorf("Cannot sort by %q", field)
+		}
+		key := listFields[name]
+		byVIN = byVIN || key == "vin"
+		order := 1
+		if strings.HasPrefix(field, "-") {
+			order = -1
+		}
+		keys = append(keys, bson.E{Key: key, Value: order})
+	}
+	if !byVIN {
+		keys = append(keys, bson.E{Key: "vin", Value: 1})
+	}
+	return keys, nil
+}
+
+func parseFields(value string) ([]string, bson.M, error) {
+	fields := strings.Split(value, ",")
+	// The VIN is always fetched because cursors are built from it.
+	projection := bson.M{"_id": 0, "vin": 1}
+	for _, field := range fields {
+		key, ok := listFields[field]
+		if !ok {
+			return nil, nil, fmt.Errorf("Unknown field %q", field)
+		}
+		// Embedded documents such as the price are fetched whole.
+		key, _, _ = strings.Cut(key, ".")
+		projection[key] = 1
+	}
+	return fields, projection, nil
+}
+
+// Cursors are opaque to clients; they encode the VIN of the last car on the
+// previous page. An empty cursor starts from the beginning.
+func encodeCursor(vin string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(vin))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	vin, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("Invalid cursor")
+	}
+	return string(vin), nil
+}
+
+// cursorFilter narrows filter to the cars after the cursor position.
+func (p ListParams) cursorFilter() bson.M {
+	if !p.UseCursor || p.After == "" {
+		return p.Filter
+	}
+	return bson.M{"$and": []bson.M{p.Filter, {"vin": bson.M{"$gt": p.After}}}}
+}
+
+// selectFields renders v as a JSON object holding only the named fields.
+func selectFields(v interface{}, fields []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
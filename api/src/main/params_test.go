@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseListQueryMalformed(t *testing.T) {
+	tests := []struct {
+		query, err string
+	}{
+		{"limit=0", `Parameter "limit" must be an integer between 1 and 500`},
+		{"limit=501", `Parameter "limit" must be an integer between 1 and 500`},
+		{"limit=-1", `Parameter "limit"`},
+		{"limit=ten", `Parameter "limit"`},
+		{"limit=1e2", `Parameter "limit"`},
+		{"limit=", `Parameter "limit"`},
+		{"limit=1&limit=2", `Parameter "limit" may only be given once`},
+		{"offset=-5", `Parameter "offset" must be an integer of at least 0`},
+		{"offset=1.5", `Parameter "offset"`},
+		{"page=0", `Parameter "page" must be an integer of at least 1`},
+		{"page=99999999999999999999", `Parameter "page"`},
+		{"page=2&offset=10", `Parameters "page" and "offset" cannot be combined`},
+		{"cursor=&sort=model", `Parameter "sort" cannot be combined with "cursor"`},
+		{"cursor=&page=2", `Parameter "page" cannot be combined with "cursor"`},
+		{"cursor=&offset=2", `Parameter "offset" cannot be combined with "cursor"`},
+		{"cursor=not*base64", "Invalid cursor"},
+		{"sort=colour", `Cannot sort by "colour"`},
+		{"sort=model,", `Cannot sort by ""`},
+		{"sort=--model", `Cannot sort by "--model"`},
+		{"sort=price.amount", `Cannot sort by "price.amount"`},
+		{"fields=vin,cost", `Unknown field "cost"`},
+		{"fields=", `Unknown field ""`},
+		{"facets=yes", `Parameter "facets" must be true or false`},
+		{"links=2", `Parameter "links" must be true or false`},
+		{"fuzzy=maybe", `Parameter "fuzzy" must be true or false`},
+		{"include_deleted=", `Parameter "include_deleted" must be true or false`},
+		{"include_archived=on", `Parameter "include_archived" must be true or false`},
+		{"include_archived=true&q=ford", `Parameter "include_archived" cannot be combined with "q"`},
+		{"price_review=flagged", `Parameter "price_review" must be true or false`},
+		{"currency=euro", `Parameter "currency" must be an ISO 4217 code`},
+		{"currency=eur", `Parameter "currency" must be an ISO 4217 code`},
+		{"format=xml", `Unsupported format "xml"`},
+		{"price=cheap", `Parameter "price" must be an integer`},
+		{"price_min=1.5", `Parameter "price_min" must be an integer`},
+		{"year_max=", `Parameter "year_max" must be an integer`},
+		{"mileage_max=9223372036854775808", `Parameter "mileage_max" must be an integer`},
+		{"colour_min=red", `Unknown parameter "colour_min"`},
+		{"status=stolen", `Parameter "status" must be a car status`},
+		{"owner=bob", `Unknown parameter "owner"`},
+		{"price.amount=1", `Unknown parameter "price.amount"`},
+		{"deletedat=1", `Unknown parameter "deletedat"`},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseListQuery(query)
+		if err == nil {
+			t.Errorf("?%s: no error, want %q", tt.query, tt.err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("?%s: error %q, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	query, _ := url.ParseQuery("limit=20&page=3&sort=-price,model&fields=vin,price&price_min=1000&price_max=5000&regno=ab12%20cde&vin=1hgcm82633a004352&format=ndjson")
+	params, err := parseListQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Limit != 20 || params.Page != 3 || params.Offset != 40 || params.Format != "ndjson" {
+		t.Errorf("limit %d, page %d, offset %d, format %q; want 20, 3, 40, ndjson", params.Limit, params.Page, params.Offset, params.Format)
+	}
+	wantSort := bson.D{{Key: "price.amount", Value: -1}, {Key: "model", Value: 1}, {Key: "vin", Value: 1}}
+	if !reflect.DeepEqual(params.Sort, wantSort) {
+		t.Errorf("sort = %v, want %v", params.Sort, wantSort)
+	}
+	wantFilter := bson.M{
+		"price.amount": bson.M{"$gte": int64(1000), "$lte": int64(5000)},
+		"regno":        "AB12CDE",
+		"vin":          "1HGCM82633A004352",
+		"deletedat":    bson.M{"$exists": false},
+	}
+	if !reflect.DeepEqual(params.Filter, wantFilter) {
+		t.Errorf("filter = %v, want %v", params.Filter, wantFilter)
+	}
+	wantProjection := bson.M{"_id": 0, "vin": 1, "price": 1}
+	if !reflect.DeepEqual(params.Projection, wantProjection) {
+		t.Errorf("projection = %v, want %v", params.Projection, wantProjection)
+	}
+}
+
+func TestParseListQueryDefaults(t *testing.T) {
+	params, err := parseListQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Limit != defaultListLimit || params.Page != 1 || params.Offset != 0 || params.Format != "json" {
+		t.Errorf("limit %d, page %d, offset %d, format %q", params.Limit, params.Page, params.Offset, params.Format)
+	}
+
+	query, _ := url.ParseQuery("cursor=" + encodeCursor("1HGCM82633A004352") + "&limit=10")
+	params, err = parseListQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.UseCursor || params.After != "1HGCM82633A004352" {
+		t.Errorf("cursor mode %v after %q", params.UseCursor, params.After)
+	}
+	if want := (bson.D{{Key: "vin", Value: 1}}); !reflect.DeepEqual(params.Sort, want) {
+		t.Errorf("sort = %v, want %v", params.Sort, want)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A4 in points, the unit of PDF page coordinates, which run from the bottom
+// left corner.
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// The standard fonts every PDF reader has, so that none is embedded.
+const (
+	pdfRegular = "F1"
+	pdfBold    = "F2"
+)
+
+// pdfDoc lays out a PDF of text, filled rectangles and JPEG photos, which is
+// all a brochure needs.
+type pdfDoc struct {
+	pages  []*pdfPage
+	images []pdfImage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	images  []int
+}
+
+type pdfImage struct {
+	jpeg          []byte
+	width, height int
+}
+
+func (d *pdfDoc) addPage() *pdfPage {
+	p := &pdfPage{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// addJPEG adds a JPEG image of the size given, in pixels, for pages to draw,
+// and returns its index.
+func (d *pdfDoc) addJPEG(b []byte, width, height int) int {
+	d.images = append(d.images, pdfImage{jpeg: b, width: width, height: height})
+	return len(d.images) - 1
+}
+
+// text writes s in font at size points, starting at x and with its baseline
+// at y, in the grey level given, from 0 for black to 1 for white.
+func (p *pdfPage) text(x, y float64, font string, size float64, grey float64, s string) {
+	fmt.Fprintf(&p.content, "BT %.3g g /%s %.3g Tf %.2f %.2f Td (%s) Tj ET\n", grey, font, size, x, y, pdfString(s))
+}
+
+// rect fills a rectangle with its bottom left corner at x, y in the colour
+// given by its red, green and blue, from 0 to 1.
+func (p *pdfPage) rect(x, y, w, h float64, r, g, b float64) {
+	fmt.Fprintf(&p.content, "q %.3g %.3g %.3g rg %.2f %.2f %.2f %.2f re f Q\n", r, g, b, x, y, w, h)
+}
+
+// image draws the image of index i, from addJPEG, across the rectangle with
+// its bottom left corner at x, y.
+func (p *pdfPage) image(i int, x, y, w, h float64) {
+	p.images = append(p.images, i)
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, y, i)
+}
+
+// pdfString escapes s for a PDF string in WinAnsiEncoding, which the standard
+// fonts are written in. Characters it cannot encode are written as ?.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= ' ' && r < 0x7f:
+			b.WriteRune(r)
+		case r == '€':
+			b.WriteString(`\200`)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, `\%03o`, r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// pdfTextWidth estimates how wide s is at size points, from the average
+// width of Helvetica's characters. It is only meant for wrapping lines.
+func pdfTextWidth(s string, size float64) float64 {
+	return float64(len([]rune(s))) * size * 0.52
+}
+
+// pdfWrap breaks s into lines no wider than width at size points.
+func pdfWrap(s string, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		next := word
+		if line != "" {
+			next = line + " " + word
+		}
+		if line != "" && pdfTextWidth(next, size) > width {
+			lines = append(lines, line)
+			next = word
+		}
+		line = next
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// WriteTo writes the document. The objects are numbered: the catalog, the
+// page tree, the two fonts, the images and then each page and its content.
+func (d *pdfDoc) WriteTo(w io.Writer) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	firstImage := 5
+	firstPage := firstImage + len(d.images)
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+	for _, img := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+			img.width, img.height, len(img.jpeg)), img.jpeg)
+	}
+	for i, p := range d.pages {
+		var xobjects strings.Builder
+		for _, img := range p.images {
+			fmt.Fprintf(&xobjects, " /Im%d %d 0 R", img, firstImage+img)
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Contents %d 0 R /Resources << /Font << /%s 3 0 R /%s 4 0 R >> /XObject <<%s >> >> >>",
+			pdfPageWidth, pdfPageHeight, firstPage+2*i+1, pdfRegular, pdfBold, xobjects.String()), nil)
+		object(fmt.Sprintf("<< /Length %d >>", p.content.Len()), p.content.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.WriteTo(w)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// photoStore holds the photos of cars and trade-ins. Wherever their bytes
+// are kept, each photo is described by a document, shaped like a GridFS
+// file's, in the files collection of the "photos" bucket, which is what is
+// queried to find them.
+type photoStore interface {
+	files() *mongo.Collection
+	// upload stores the photo r under name, described with metadata, and
+	// returns its ID.
+	upload(ctx context.Context, name string, r io.Reader, metadata bson.M) (primitive.ObjectID, error)
+	open(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error)
+	delete(ctx context.Context, id primitive.ObjectID) error
+	// link returns a URL the photo may be downloaded from directly, or ""
+	// when it is to be served by the API.
+	link(file imageFile) (string, error)
+}
+
+// gridfsPhotos keeps photos in GridFS.
+type gridfsPhotos struct {
+	bucket *gridfs.Bucket
+}
+
+func (g *gridfsPhotos) files() *mongo.Collection {
+	return g.bucket.GetFilesCollection()
+}
+
+func (g *gridfsPhotos) upload(ctx context.Context, name string, r io.Reader, metadata bson.M) (primitive.ObjectID, error) {
+	return g.bucket.UploadFromStream(name, r, options.GridFSUpload().SetMetadata(metadata))
+}
+
+func (g *gridfsPhotos) open(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	return g.bucket.OpenDownloadStream(id)
+}
+
+func (g *gridfsPhotos) delete(ctx context.Context, id primitive.ObjectID) error {
+	return g.bucket.DeleteContext(ctx, id)
+}
+
+func (g *gridfsPhotos) link(file imageFile) (string, error) {
+	return "", nil
+}
+
+// blobPhotos keeps the bytes of photos in a blob store, under "photos/<id>",
+// or "<prefix>/<id>" for the other files kept like them, so that large
+// deployments need not keep them in MongoDB. When the store is
+// S3 and linkTTL is set, photos are downloaded from it with pre-signed URLs
+// rather than through the API.
+type blobPhotos struct {
+	c       *mongo.Collection
+	blobs   blobStore
+	linkTTL time.Duration
+	prefix  string
+}
+
+func (b *blobPhotos) files() *mongo.Collection {
+	return b.c
+}
+
+func (b *blobPhotos) key(id primitive.ObjectID) string {
+	if b.prefix != "" {
+		return b.prefix + "/" + id.Hex()
+	}
+	return "photos/" + id.Hex()
+}
+
+func (b *blobPhotos) upload(ctx context.Context, name string, r io.Reader, metadata bson.M) (primitive.ObjectID, error) {
+	// Photos are small enough to hold while their hash, which S3 is sent
+	// first, is worked out.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	sum := sha256.Sum256(data)
+	id := primitive.NewObjectID()
+	if err := b.blobs.put(ctx, b.key(id), bytes.NewReader(data), int64(len(data)), sum[:]); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	_, err = b.c.InsertOne(ctx, bson.M{
+		"_id":        id,
+		"length":     int64(len(data)),
+		"uploadDate": time.Now().UTC(),
+		"filename":   name,
+		"metadata":   metadata,
+	})
+	if err != nil {
+		b.blobs.delete(context.WithoutCancel(ctx), b.key(id))
+		return primitive.NilObjectID, err
+	}
+	return id, nil
+}
+
+func (b *blobPhotos) open(ctx context.Context, id primitive.ObjectID) (io.ReadCloser, error) {
+	return b.blobs.get(ctx, b.key(id))
+}
+
+// delete forgets the photo before deleting its bytes, so that it is never
+// found without them.
+func (b *blobPhotos) delete(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := b.c.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return err
+	}
+	return b.blobs.delete(ctx, b.key(id))
+}
+
+func (b *blobPhotos) link(file imageFile) (string, error) {
+	s3, ok := b.blobs.(*s3Blobs)
+	if !ok || b.linkTTL <= 0 {
+		return "", nil
+	}
+	return s3.presign(b.key(file.ID), file.Metadata.ContentType, b.linkTTL)
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// postgresDriver is the database/sql driver the postgres storage connects
+// with. postgres_driver.go registers it in builds with -tags postgres, so
+// that the others do not need it.
+const postgresDriver = "postgres"
+
+// pgTextVector is the text a $text filter searches, that of the fields the
+// Mongo text index covers. The text index is on this same expression.
+const pgTextVector = `to_tsvector('simple', coalesce(doc->>'manufacturer', '') || ' ' || coalesce(doc->>'model', '') || ' ' || coalesce(doc->>'regno', ''))`
+
+// postgresMigrations are the versioned changes to the Postgres schema, which
+// migratePostgres applies in order. A released step is never changed; a new
+// one is added.
+var postgresMigrations = []struct {
+	version int
+	name    string
+	up      string
+}{
+	{1, "create cars", `CREATE TABLE cars (
+		tenant text NOT NULL,
+		vin    text COLLATE "C" NOT NULL,
+		doc    jsonb NOT NULL,
+		PRIMARY KEY (tenant, vin)
+	)`},
+	{2, "unique registrations", `CREATE UNIQUE INDEX cars_tenant_regno ON cars (tenant, (doc->>'regno')) WHERE doc->>'regno' <> ''`},
+	{3, "index manufacturer and model", `CREATE INDEX cars_tenant_manufacturer_model ON cars (tenant, (doc->>'manufacturer'), (doc->>'model'))`},
+	{4, "index price", `CREATE INDEX cars_tenant_price ON cars (tenant, ((doc#>>'{price,amount}')::numeric))`},
+	{5, "index text", `CREATE INDEX cars_text ON cars USING gin (` + pgTextVector + `)`},
+}
+
+// openPostgres connects to the database at url and brings its schema up to
+// date.
+func openPostgres(url string) (*sql.DB, error) {
+	if !slices.Contains(sql.Drivers(), postgresDriver) {
+		return nil, errors.New("SHADOW_STORAGE postgres needs the API built with -tags postgres")
+	}
+	db, err := sql.Open(postgresDriver, url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to Postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate Postgres: %w", err)
+	}
+	return db, nil
+}
+
+// migratePostgres applies the postgresMigrations not yet recorded in
+// schema_migrations, holding a lock so that instances starting together do
+// not apply a step twice. Postgres changes schemas in transactions, so a
+// step that fails leaves nothing behind.
+func migratePostgres(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		name       text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('carsupermarket migrations'))`); err != nil {
+		return err
+	}
+	for _, m := range postgresMigrations {
+		var applied bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+	return tx.Commit()
+}
+
+// postgresVehicles is the vehicleRepository kept in a PostgreSQL table, for
+// deployments that run Postgres rather than MongoDB. Each car is stored as
+// the document Mongo would hold, as Extended JSON in a jsonb column, so that
+// the listing filters, which are Mongo's, translate to SQL on its keys.
+type postgresVehicles struct {
+	db *sql.DB
+}
+
+// pgQuerier is a *sql.DB or a *sql.Tx.
+type pgQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func pgEncode(car vehicle) (string, error) {
+	b, err := bson.MarshalExtJSON(car, false, false)
+	return string(b), err
+}
+
+func pgDecode(b []byte) (bson.M, error) {
+	var doc bson.M
+	err := bson.UnmarshalExtJSON(b, false, &doc)
+	return doc, err
+}
+
+// pgDuplicate returns errDuplicateRegNo or errDuplicateVIN for a unique
+// violation, by the index it is of, and any other error as it is.
+// database/sql has no type for the error, so it is told by the server's
+// message.
+func pgDuplicate(err error) error {
+	if err == nil || !strings.Contains(err.Error(), "duplicate key value") {
+		return err
+	}
+	if strings.Contains(err.Error(), "cars_tenant_regno") {
+		return errDuplicateRegNo
+	}
+	return errDuplicateVIN
+}
+
+// findOne returns the document of the car matching filter, locking its row
+// until the transaction q ends when lock is set.
+func (p *postgresVehicles) findOne(ctx context.Context, q pgQuerier, filter bson.M, lock bool) (bson.M, error) {
+	w := &pgWhere{}
+	where, err := w.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT doc FROM cars WHERE " + where + " LIMIT 1"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var b []byte
+	if err := q.QueryRowContext(ctx, query, w.args...).Scan(&b); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, mongo.ErrNoDocuments
+		}
+		return nil, err
+	}
+	return pgDecode(b)
+}
+
+// query calls fn with the document of each car matching filter, in the
+// order sortBy gives, limit of them from offset; a negative limit sets none.
+func (p *postgresVehicles) query(ctx context.Context, filter bson.M, sortBy bson.D, offset, limit int, fn func(bson.M) error) error {
+	w := &pgWhere{}
+	where, err := w.filter(filter)
+	if err != nil {
+		return err
+	}
+	order, err := pgOrder(sortBy)
+	if err != nil {
+		return err
+	}
+	query := "SELECT doc FROM cars WHERE " + where + " ORDER BY " + order
+	if limit >= 0 {
+		query += " LIMIT " + w.arg(limit)
+	}
+	if offset > 0 {
+		query += " OFFSET " + w.arg(offset)
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, w.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+		doc, err := pgDecode(b)
+		if err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// modify changes the car matching filter to what change makes of it, in a
+// transaction holding its row, and returns it as it was and as it is.
+func (p *postgresVehicles) modify(ctx context.Context, filter bson.M, change func(vehicle) (vehicle, error)) (vehicle, vehicle, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return vehicle{}, vehicle{}, err
+	}
+	defer tx.Rollback()
+
+	doc, err := p.findOne(ctx, tx, filter, true)
+	if err != nil {
+		return vehicle{}, vehicle{}, err
+	}
+	before := fromDoc(doc)
+	after, err := change(before)
+	if err != nil {
+		return vehicle{}, vehicle{}, err
+	}
+	b, err := pgEncode(after)
+	if err != nil {
+		return vehicle{}, vehicle{}, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE cars SET doc = $1 WHERE tenant = $2 AND vin = $3`, b, before.Tenant, before.VIN)
+	if err != nil {
+		return vehicle{}, vehicle{}, pgDuplicate(err)
+	}
+	return before, after, tx.Commit()
+}
+
+func (p *postgresVehicles) get(ctx context.Context, vin string, projection bson.M) (vehicle, error) {
+	doc, err := p.findOne(ctx, p.db, liveCar(ctx, vin), false)
+	if err != nil {
+		return vehicle{}, err
+	}
+	return fromDoc(project(doc, projection, "")), nil
+}
+
+func (p *postgresVehicles) list(ctx context.Context, params ListParams) ([]vehicle, int64, string, error) {
+	forTenant(ctx, params.Filter)
+	if params.near != nil {
+		var docs []bson.M
+		err := p.query(ctx, params.Filter, nil, 0, -1, func(doc bson.M) error {
+			docs = append(docs, doc)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, "", err
+		}
+		cars, total := nearPage(docs, params)
+		return cars, total, "", nil
+	}
+
+	total, err := p.count(ctx, params.Filter)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	cars := []vehicle{}
+	err = p.query(ctx, params.cursorFilter(), params.Sort, params.Offset, pageFetch(params), func(doc bson.M) error {
+		cars = append(cars, fromDoc(project(doc, params.Projection, textSearch(params.Filter))))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if params.UseCursor && len(cars) > params.Limit {
+		cars = cars[:params.Limit]
+		next = encodeCursor(cars[len(cars)-1].VIN)
+	}
+	return cars, total, next, nil
+}
+
+func (p *postgresVehicles) each(ctx context.Context, params ListParams, fn func(vehicle) error) error {
+	filter := forTenant(ctx, params.Filter)
+	offset, limit := 0, -1
+	if params.paged {
+		filter = params.cursorFilter()
+		offset, limit = params.Offset, pageFetch(params)
+	}
+	return p.query(ctx, filter, params.Sort, offset, limit, func(doc bson.M) error {
+		return fn(fromDoc(project(doc, params.Projection, textSearch(params.Filter))))
+	})
+}
+
+func (p *postgresVehicles) facets(ctx context.Context, filter bson.M) (*carFacets, error) {
+	var docs []bson.M
+	err := p.query(ctx, forTenant(ctx, filter), nil, 0, -1, func(doc bson.M) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docFacets(docs), nil
+}
+
+func (p *postgresVehicles) count(ctx context.Context, filter bson.M) (int64, error) {
+	w := &pgWhere{}
+	where, err := w.filter(forTenant(ctx, filter))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = p.db.QueryRowContext(ctx, "SELECT count(*) FROM cars WHERE "+where, w.args...).Scan(&n)
+	return n, err
+}
+
+func (p *postgresVehicles) create(ctx context.Context, car vehicle) error {
+	b, err := pgEncode(car)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, `INSERT INTO cars (tenant, vin, doc) VALUES ($1, $2, $3)`, car.Tenant, car.VIN, b)
+	return pgDuplicate(err)
+}
+
+func (p *postgresVehicles) replace(ctx context.Context, car *vehicle, rev int64) (vehicle, error) {
+	car.Tenant = tenantFrom(ctx)
+	before, _, err := p.modify(ctx, atRevision(ctx, car.VIN, rev), func(before vehicle) (vehicle, error) {
+		replacing(before, car)
+		return *car, nil
+	})
+	return before, err
+}
+
+func (p *postgresVehicles) update(ctx context.Context, vin string, rev int64, set, unset bson.M) (vehicle, error) {
+	if len(set) == 0 && len(unset) == 0 {
+		doc, err := p.findOne(ctx, p.db, atRevision(ctx, vin, rev), false)
+		if err != nil {
+			return vehicle{}, err
+		}
+		return fromDoc(doc), nil
+	}
+	before, _, err := p.modify(ctx, atRevision(ctx, vin, rev), func(before vehicle) (vehicle, error) {
+		return updating(before, set, unset), nil
+	})
+	return before, err
+}
+
+func (p *postgresVehicles) delete(ctx context.Context, vin string, rev int64) (vehicle, error) {
+	_, car, err := p.modify(ctx, atRevision(ctx, vin, rev), func(car vehicle) (vehicle, error) {
+		now := time.Now().UTC()
+		car.DeletedAt = &now
+		car.Revision++
+		return car, nil
+	})
+	return car, err
+}
+
+// pgKey is a stored key a filter or sort may name, such as price.amount;
+// keys are written into SQL, so nothing else is allowed.
+var pgKey = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+
+// pgColumn is how a stored key is read in SQL: json as jsonb, text as text.
+type pgColumn struct {
+	json, text string
+	// column is set for the keys that are columns of their own.
+	column bool
+}
+
+func pgColumnOf(key string) (pgColumn, error) {
+	switch key {
+	case "tenant", "vin":
+		return pgColumn{json: "to_jsonb(" + key + ")", text: key, column: true}, nil
+	}
+	if !pgKey.MatchString(key) {
+		return pgColumn{}, fmt.Errorf("postgres storage cannot filter on %q", key)
+	}
+	path := "'{" + strings.ReplaceAll(key, ".", ",") + "}'"
+	return pgColumn{json: "(doc #> " + path + ")", text: "(doc #>> " + path + ")"}, nil
+}
+
+// pgOrder translates sort keys to an ORDER BY clause, in Mongo's order:
+// missing values first, then by VIN. Sorts by text score are taken as by
+// VIN, as memoryVehicles takes them.
+func pgOrder(sortBy bson.D) (string, error) {
+	var keys []string
+	byVIN := false
+	for _, key := range sortBy {
+		order, ok := key.Value.(int)
+		if !ok {
+			continue
+		}
+		col, err := pgColumnOf(key.Key)
+		if err != nil {
+			return "", err
+		}
+		byVIN = byVIN || key.Key == "vin"
+		if order < 0 {
+			keys = append(keys, col.json+" DESC NULLS LAST")
+		} else {
+			keys = append(keys, col.json+" ASC NULLS FIRST")
+		}
+	}
+	if !byVIN {
+		keys = append(keys, "vin")
+	}
+	return strings.Join(keys, ", "), nil
+}
+
+// pgWhere translates query filters to SQL conditions, collecting the values
+// they compare with as arguments.
+type pgWhere struct {
+	args []interface{}
+}
+
+func (w *pgWhere) arg(v interface{}) string {
+	w.args = append(w.args, v)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+var pgComparisons = map[string]string{"$gt": ">", "$gte": ">=", "$lt": "<", "$lte": "<="}
+
+// filter translates a filter of the operators memoryVehicles understands.
+func (w *pgWhere) filter(filter bson.M) (string, error) {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	// A filter always gives the same SQL, which the server can reuse.
+	sort.Strings(keys)
+
+	var conds []string
+	for _, key := range keys {
+		cond := filter[key]
+		switch key {
+		case "$and", "$or":
+			var subs []string
+			for _, sub := range subFilters(cond) {
+				s, err := w.filter(sub)
+				if err != nil {
+					return "", err
+				}
+				subs = append(subs, "("+s+")")
+			}
+			switch {
+			case len(subs) > 0 && key == "$and":
+				conds = append(conds, strings.Join(subs, " AND "))
+			case len(subs) > 0:
+				conds = append(conds, "("+strings.Join(subs, " OR ")+")")
+			}
+		case "$text":
+			search, _ := cond.(bson.M)["$search"].(string)
+			words := pgTextQuery(search)
+			if words == "" {
+				conds = append(conds, "FALSE")
+				continue
+			}
+			conds = append(conds, pgTextVector+" @@ to_tsquery('simple', "+w.arg(words)+")")
+		default:
+			c, err := w.field(key, cond)
+			if err != nil {
+				return "", err
+			}
+			conds = append(conds, c)
+		}
+	}
+	if len(conds) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// pgTextQuery makes a tsquery matching any word of search, as $text does.
+func pgTextQuery(search string) string {
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		word = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, word)
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " | ")
+}
+
+func (w *pgWhere) field(key string, cond interface{}) (string, error) {
+	col, err := pgColumnOf(key)
+	if err != nil {
+		return "", err
+	}
+	ops, ok := cond.(bson.M)
+	if !ok || !operators(ops) {
+		return w.compare(col, "=", cond)
+	}
+
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	var conds []string
+	for _, op := range names {
+		arg := ops[op]
+		var c string
+		switch op {
+		case "$exists":
+			if want, _ := arg.(bool); want {
+				c = col.json + " IS NOT NULL"
+			} else {
+				c = col.json + " IS NULL"
+			}
+		case "$ne":
+			if c, err = w.compare(col, "=", arg); err != nil {
+				return "", err
+			}
+			c = "NOT coalesce(" + c + ", FALSE)"
+		case "$in", "$nin":
+			var in []string
+			for _, v := range subValues(arg) {
+				s, err := w.compare(col, "=", v)
+				if err != nil {
+					return "", err
+				}
+				in = append(in, s)
+			}
+			c = "FALSE"
+			if len(in) > 0 {
+				c = "(" + strings.Join(in, " OR ") + ")"
+			}
+			if op == "$nin" {
+				c = "NOT coalesce(" + c + ", FALSE)"
+			}
+		default:
+			sqlOp, ok := pgComparisons[op]
+			if !ok {
+				return "", fmt.Errorf("postgres storage cannot filter with %s", op)
+			}
+			if c, err = w.compare(col, sqlOp, arg); err != nil {
+				return "", err
+			}
+		}
+		conds = append(conds, c)
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+// compare translates the comparison of a stored key with v by op. As in
+// Mongo, values only compare with values of their own kind, and a null v
+// equals a missing value.
+func (w *pgWhere) compare(col pgColumn, op string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		if op != "=" || col.column {
+			return "FALSE", nil
+		}
+		return "(" + col.json + " IS NULL OR " + col.json + " = 'null')", nil
+	case string:
+		if op != "=" && !col.column {
+			return col.text + ` COLLATE "C" ` + op + " " + w.arg(v), nil
+		}
+		return col.text + " " + op + " " + w.arg(v), nil
+	case bool:
+		return "(" + col.json + " = to_jsonb(" + w.arg(v) + "::boolean))", nil
+	case int, int32, int64, float64:
+		n, _ := number(v)
+		return "(CASE WHEN jsonb_typeof(" + col.json + ") = 'number' THEN " + col.text + "::numeric " + op + " " + w.arg(n) + " END)", nil
+	case time.Time:
+		return "(CASE WHEN jsonb_typeof(" + col.json + ") = 'object' THEN (" + col.json + "->>'$date')::timestamptz " + op + " " + w.arg(v) + " END)", nil
+	case primitive.DateTime:
+		return w.compare(col, op, v.Time())
+	case primitive.ObjectID:
+		return "(" + col.json + "->>'$oid') " + op + " " + w.arg(v.Hex()), nil
+	}
+	return "", fmt.Errorf("postgres storage cannot compare with a %T", v)
+}
@@ -0,0 +1,6 @@
+//go:build postgres
+
+package main
+
+// The driver of the postgres storage, left out of builds without the tag.
+import _ "github.com/lib/pq"
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPgKey(t *testing.T) {
+	for _, key := range []string{"model", "price.amount", "fueltype", "price_review", "images.0.id", "a1.b2.c3"} {
+		if !pgKey.MatchString(key) {
+			t.Errorf("pgKey refuses %q", key)
+		}
+	}
+	for _, key := range []string{
+		"", ".", "a.", ".a", "a..b", "Model", "price amount", "price-amount", "$gt", "a'b",
+		"model') OR TRUE --", "doc->>'model'", "a;DROP TABLE cars", "a\nb", "a}b", "a,b", "modèle",
+	} {
+		if pgKey.MatchString(key) {
+			t.Errorf("pgKey allows %q", key)
+		}
+		if _, err := pgColumnOf(key); err == nil {
+			t.Errorf("pgColumnOf(%q) has no error", key)
+		}
+	}
+}
+
+func TestPgColumnOf(t *testing.T) {
+	tests := []struct {
+		key  string
+		want pgColumn
+	}{
+		{"vin", pgColumn{json: "to_jsonb(vin)", text: "vin", column: true}},
+		{"tenant", pgColumn{json: "to_jsonb(tenant)", text: "tenant", column: true}},
+		{"model", pgColumn{json: "(doc #> '{model}')", text: "(doc #>> '{model}')"}},
+		{"price.amount", pgColumn{json: "(doc #> '{price,amount}')", text: "(doc #>> '{price,amount}')"}},
+	}
+	for _, tt := range tests {
+		got, err := pgColumnOf(tt.key)
+		if err != nil {
+			t.Fatalf("pgColumnOf(%q): %v", tt.key, err)
+		}
+		if got != tt.want {
+			t.Errorf("pgColumnOf(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPgOrder(t *testing.T) {
+	tests := []struct {
+		sort bson.D
+		want string
+	}{
+		{nil, "vin"},
+		{bson.D{{Key: "vin", Value: 1}}, "to_jsonb(vin) ASC NULLS FIRST"},
+		{bson.D{{Key: "price.amount", Value: -1}, {Key: "model", Value: 1}},
+			"(doc #> '{price,amount}') DESC NULLS LAST, (doc #> '{model}') ASC NULLS FIRST, vin"},
+		{bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "vin", Value: 1}}, "to_jsonb(vin) ASC NULLS FIRST"},
+	}
+	for _, tt := range tests {
+		got, err := pgOrder(tt.sort)
+		if err != nil {
+			t.Fatalf("pgOrder(%v): %v", tt.sort, err)
+		}
+		if got != tt.want {
+			t.Errorf("pgOrder(%v) = %q, want %q", tt.sort, got, tt.want)
+		}
+	}
+	if _, err := pgOrder(bson.D{{Key: "model; DROP TABLE cars", Value: 1}}); err == nil {
+		t.Error("pgOrder sorts by a key pgKey refuses")
+	}
+}
+
+func TestPgWhereFilter(t *testing.T) {
+	number := func(col, op string) string {
+		return "(CASE WHEN jsonb_typeof((doc #> '{" + col + "}')) = 'number' THEN (doc #>> '{" + col + "}')::numeric " + op
+	}
+	tests := []struct {
+		filter bson.M
+		want   string
+		args   []interface{}
+	}{
+		{bson.M{}, "TRUE", nil},
+		{bson.M{"manufacturer": "Ford"}, "(doc #>> '{manufacturer}') = $1", []interface{}{"Ford"}},
+		{bson.M{"tenant": "t1", "vin": "V1"}, "tenant = $1 AND vin = $2", []interface{}{"t1", "V1"}},
+		{bson.M{"price.amount": bson.M{"$gte": int64(100), "$lte": 900}},
+			number("price,amount", ">=") + " $1 END) AND " + number("price,amount", "<=") + " $2 END)", []interface{}{100.0, 900.0}},
+		{bson.M{"year": int64(2020)}, number("year", "=") + " $1 END)", []interface{}{2020.0}},
+		{bson.M{"model": bson.M{"$gt": "F"}}, `(doc #>> '{model}') COLLATE "C" > $1`, []interface{}{"F"}},
+		{bson.M{"deletedat": bson.M{"$exists": false}}, "(doc #> '{deletedat}') IS NULL", nil},
+		{bson.M{"listedat": bson.M{"$exists": true}}, "(doc #> '{listedat}') IS NOT NULL", nil},
+		{bson.M{"regno": nil}, "((doc #> '{regno}') IS NULL OR (doc #> '{regno}') = 'null')", nil},
+		{bson.M{"vin": nil}, "FALSE", nil},
+		{bson.M{"reserved": true}, "((doc #> '{reserved}') = to_jsonb($1::boolean))", []interface{}{true}},
+		{bson.M{"status": bson.M{"$in": bson.A{"in_stock", "reserved"}}},
+			"((doc #>> '{status}') = $1 OR (doc #>> '{status}') = $2)", []interface{}{"in_stock", "reserved"}},
+		{bson.M{"status": bson.M{"$nin": bson.A{"sold"}}}, "NOT coalesce(((doc #>> '{status}') = $1), FALSE)", []interface{}{"sold"}},
+		{bson.M{"model": bson.M{"$in": bson.A{}}}, "FALSE", nil},
+		{bson.M{"model": bson.M{"$ne": "Focus"}}, "NOT coalesce((doc #>> '{model}') = $1, FALSE)", []interface{}{"Focus"}},
+		{bson.M{"$or": bson.A{bson.M{"model": "Focus"}, bson.M{"model": "Fiesta"}}},
+			"(((doc #>> '{model}') = $1) OR ((doc #>> '{model}') = $2))", []interface{}{"Focus", "Fiesta"}},
+		{bson.M{"$and": []bson.M{{"model": "Focus"}, {"vin": bson.M{"$gt": "V1"}}}},
+			"((doc #>> '{model}') = $1) AND (vin > $2)", []interface{}{"Focus", "V1"}},
+		{bson.M{"$text": bson.M{"$search": "Ford's  FOCUS!"}}, pgTextVector + " @@ to_tsquery('simple', $1)", []interface{}{"fords | focus"}},
+		{bson.M{"$text": bson.M{"$search": "&|!"}}, "FALSE", nil},
+	}
+	for _, tt := range tests {
+		w := &pgWhere{}
+		got, err := w.filter(tt.filter)
+		if err != nil {
+			t.Fatalf("filter(%v): %v", tt.filter, err)
+		}
+		if got != tt.want {
+			t.Errorf("filter(%v) =\n\t%s\nwant\n\t%s", tt.filter, got, tt.want)
+		}
+		if !reflect.DeepEqual(w.args, tt.args) {
+			t.Errorf("filter(%v) args = %#v, want %#v", tt.filter, w.args, tt.args)
+		}
+	}
+}
+
+func TestPgWhereFilterRefuses(t *testing.T) {
+	for _, filter := range []bson.M{
+		{"model'); DROP TABLE cars; --": "x"},
+		{"Model": "x"},
+		{"model": bson.M{"$regex": ".*"}},
+		{"model": bson.M{"$where": "1"}},
+		{"model": []string{"Focus"}},
+		{"model": bson.M{"$in": bson.A{[]int{1}}}},
+		{"$or": bson.A{bson.M{"a b": 1}}},
+	} {
+		if got, err := (&pgWhere{}).filter(filter); err == nil {
+			t.Errorf("filter(%v) = %q, want an error", filter, got)
+		}
+	}
+}
+
+func TestPgTextQuery(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"ford":                 "ford",
+		"Ford Focus":           "ford | focus",
+		"land-rover":           "landrover",
+		"a & b | !c":           "a | b | c",
+		"'); DROP TABLE cars;": "drop | table | cars",
+		"Škoda  Octavia":       "škoda | octavia",
+	}
+	for search, want := range tests {
+		if got := pgTextQuery(search); got != want {
+			t.Errorf("pgTextQuery(%q) = %q, want %q", search, got, want)
+		}
+	}
+}
+
+// testPostgres returns a postgresVehicles in a schema of its own, on the
+// Postgres TEST_POSTGRES_DSN names, dropped when the test ends. Tests
+// needing one are skipped without it, or when built without -tags postgres.
+func testPostgres(t *testing.T) *postgresVehicles {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	admin, err := sql.Open(postgresDriver, dsn)
+	if err != nil {
+		t.Skipf("no postgres driver: %v", err)
+	}
+	defer admin.Close()
+
+	schema := "cars_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open(postgresDriver, dsn)
+		if err == nil {
+			_, err = admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			admin.Close()
+		}
+		if err != nil {
+			t.Logf("drop schema %s: %v", schema, err)
+		}
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("TEST_POSTGRES_DSN must be a URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	db, err := openPostgres(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &postgresVehicles{db: db}
+}
+
+func TestPostgresVehicles(t *testing.T) {
+	p := testPostgres(t)
+	ctx := withTenant(context.Background(), "t1")
+
+	cars := seedCars(1, 3)
+	cars[0].Manurfacturer, cars[0].Model, cars[0].RegNo = "Ford", "Focus", "AB12CDE"
+	cars[1].Manurfacturer, cars[1].Model, cars[1].RegNo = "Ford", "Fiesta", "XY34FGH"
+	cars[2].Manurfacturer, cars[2].Model, cars[2].RegNo = "Land Rover", "Defender", "LR51ROV"
+	for i := range cars {
+		cars[i].Price = &price{Amount: int64(i+1) * 100000, Currency: "GBP"}
+		if err := prepareNewCar(ctx, &cars[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.create(ctx, cars[i]); err != nil {
+			t.Fatalf("create %s: %v", cars[i].VIN, err)
+		}
+	}
+	if err := p.create(ctx, cars[0]); err != errDuplicateVIN {
+		t.Errorf("create a taken VIN: %v, want errDuplicateVIN", err)
+	}
+	dup := seedCars(2, 1)[0]
+	dup.RegNo = cars[1].RegNo
+	if err := prepareNewCar(ctx, &dup); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.create(ctx, dup); err != errDuplicateRegNo {
+		t.Errorf("create a taken registration: %v, want errDuplicateRegNo", err)
+	}
+
+	got, err := p.get(ctx, cars[0].VIN, nil)
+	if err != nil || got.Model != "Focus" || got.Price.Amount != 100000 {
+		t.Errorf("get %s = %+v, %v", cars[0].VIN, got, err)
+	}
+	if _, err := p.get(withTenant(context.Background(), "t2"), cars[0].VIN, nil); err != mongo.ErrNoDocuments {
+		t.Errorf("get of another tenant's car: %v, want ErrNoDocuments", err)
+	}
+
+	list := func(query string) []string {
+		t.Helper()
+		values, _ := url.ParseQuery(query)
+		params, err := parseListQuery(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, total, _, err := p.list(ctx, params)
+		if err != nil {
+			t.Fatalf("list ?%s: %v", query, err)
+		}
+		var models []string
+		for _, car := range page {
+			models = append(models, car.Model)
+		}
+		if int(total) < len(models) {
+			t.Errorf("list ?%s: total %d under %d listed", query, total, len(models))
+		}
+		return models
+	}
+	for query, want := range map[string]string{
+		"manufacturer=Ford&sort=-price":            "Fiesta,Focus",
+		"price_min=150000&sort=price":              "Fiesta,Defender",
+		"q=rover&sort=model":                       "Defender",
+		"q=ford+defender&sort=model":               "Defender,Fiesta,Focus",
+		"regno=ab12+cde":                           "Focus",
+		"manufacturer=%7B%22%24gt%22%3A+%22%22%7D": "",
+		"sort=model&limit=2":                       "Defender,Fiesta",
+	} {
+		if got := strings.Join(list(query), ","); got != want {
+			t.Errorf("list ?%s = %s, want %s", query, got, want)
+		}
+	}
+
+	if _, err := p.update(ctx, cars[0].VIN, 7, bson.M{"model": "Puma"}, nil); err != mongo.ErrNoDocuments {
+		t.Errorf("update at a stale revision: %v, want ErrNoDocuments", err)
+	}
+	before, err := p.update(ctx, cars[0].VIN, cars[0].Revision, bson.M{"model": "Puma"}, nil)
+	if err != nil || before.Model != "Focus" {
+		t.Fatalf("update = %+v, %v", before, err)
+	}
+	if _, err := p.update(ctx, cars[0].VIN, anyRevision, bson.M{"regno": cars[1].RegNo}, nil); err != errDuplicateRegNo {
+		t.Errorf("update to a taken registration: %v, want errDuplicateRegNo", err)
+	}
+	if got, _ := p.get(ctx, cars[0].VIN, nil); got.Model != "Puma" {
+		t.Errorf("updated model = %q, want Puma", got.Model)
+	}
+
+	deleted, err := p.delete(ctx, cars[2].VIN, anyRevision)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Fatalf("delete = %+v, %v", deleted, err)
+	}
+	if _, err := p.get(ctx, cars[2].VIN, nil); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("get a deleted car: %v, want ErrNoDocuments", err)
+	}
+	if n, err := p.count(ctx, bson.M{"deletedat": bson.M{"$exists": false}}); err != nil || n != 2 {
+		t.Errorf("count of live cars = %d, %v; want 2", n, err)
+	}
+}
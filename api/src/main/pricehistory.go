@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxReducedWithinDays is the furthest back ?reduced_within_days= looks.
+const maxReducedWithinDays = 90
+
+// priceChange records a change of the asking price of a car, including the
+// price it was added with.
+type priceChange struct {
+	VIN string `json:"vin"`
+	Old *price `json:"old,omitempty" bson:",omitempty"`
+	New *price `json:"new,omitempty" bson:",omitempty"`
+	// Reduced is set when the price went down in the same currency.
+	Reduced bool      `json:"reduced"`
+	Actor   string    `json:"actor"`
+	At      time.Time `json:"at"`
+	Tenant  string    `json:"-"`
+}
+
+// priceChangeOf returns the change of price from before to after, or nil
+// when it did not change or the car is gone.
+func priceChangeOf(before, after *vehicle) *priceChange {
+	if after == nil || after.Price == nil && (before == nil || before.Price == nil) {
+		return nil
+	}
+	var old *price
+	if before != nil {
+		old = before.Price
+	}
+	if old != nil && after.Price != nil && *old == *after.Price {
+		return nil
+	}
+	reduced := old != nil && after.Price != nil && old.Currency == after.Price.Currency && after.Price.Amount < old.Amount
+	return &priceChange{VIN: after.VIN, Old: old, New: after.Price, Reduced: reduced}
+}
+
+// priceHistory keeps every change of the cars' prices. The audit log adds to
+// it as it records the writes that change them.
+type priceHistory struct {
+	c *mongo.Collection
+}
+
+func (h *priceHistory) ensureIndex(ctx context.Context) error {
+	_, err := h.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "reduced", Value: 1}, {Key: "at", Value: -1}}},
+	})
+	return err
+}
+
+// reducedSince returns the VINs of the tenant's cars whose price went down
+// at or after since.
+func (h *priceHistory) reducedSince(ctx context.Context, since time.Time) ([]interface{}, error) {
+	vins, err := h.c.Distinct(ctx, "vin", forTenant(ctx, bson.M{"reduced": true, "at": bson.M{"$gte": since}}))
+	if vins == nil {
+		vins = []interface{}{}
+	}
+	return vins, err
+}
+
+// parseReduced takes ?reduced_within_days= out of query and returns the
+// days, or 0 when the listing is not only of reduced cars.
+func parseReduced(query url.Values) (int, error) {
+	v, ok := query["reduced_within_days"]
+	if !ok {
+		return 0, nil
+	}
+	defer query.Del("reduced_within_days")
+
+	days, err := strconv.Atoi(v[0])
+	if len(v) != 1 || err != nil || days < 1 || days > maxReducedWithinDays {
+		return 0, fmt.Errorf("Parameter \"reduced_within_days\" must be an integer between 1 and %d", maxReducedWithinDays)
+	}
+	return days, nil
+}
+
+// reducedCars narrows params to the cars whose price went down in the last
+// days. It writes the error response and returns false when it cannot.
+func reducedCars(w http.ResponseWriter, r *http.Request, prices *priceHistory, params *ListParams, days int) bool {
+	if params.Filter["vin"] != nil {
+		errorWithJSON(w, "Parameter \"vin\" cannot be combined with \"reduced_within_days\"", http.StatusBadRequest)
+		return false
+	}
+
+	vins, err := prices.reducedSince(r.Context(), time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed find reduced cars", "err", err)
+		return false
+	}
+	params.Filter["vin"] = bson.M{"$in": vins}
+	return true
+}
+
+// carPriceHistory lists the changes of a car's price, newest first.
+func carPriceHistory(h *priceHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes := []priceChange{}
+		opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}})
+		cur, err := h.c.Find(r.Context(), forTenant(r.Context(), bson.M{"vin": carVIN(r)}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &changes)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed get price history", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// publicPrefix is where the public listing API is served, under the API
+// version.
+const publicPrefix = "/public/"
+
+// publicQuery are the parameters of GET /public/cars besides its filters.
+var publicQuery = map[string]bool{"limit": true, "offset": true, "page": true, "cursor": true, "q": true, "sort": true}
+
+// publicSorts are the sortFields the public may sort the cars on sale by;
+// not their registrations, which are not shown.
+var publicSorts = map[string]bool{
+	"manufacturer": true, "model": true, "vin": true, "price": true, "mileage": true, "year": true,
+}
+
+// publicFilters are the listFields the public may filter the cars on sale
+// by: what an advert shows, not registrations, dealers or statuses.
+var publicFilters = map[string]bool{
+	"manufacturer": true, "model": true, "price": true, "mileage": true, "year": true,
+	"fuel_type": true, "transmission": true, "colour": true, "condition": true, "branch": true,
+}
+
+// publicCar is a car as the storefront shows it: its details, asking price
+// and photos, and whether it is reserved. What the car cost, who holds or
+// bought it, its registration and its internal bookkeeping are left out.
+type publicCar struct {
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model"`
+	VIN          string     `json:"vin"`
+	Year         int        `json:"year,omitempty"`
+	Mileage      int        `json:"mileage,omitempty"`
+	FuelType     string     `json:"fuel_type,omitempty"`
+	Transmission string     `json:"transmission,omitempty"`
+	Colour       string     `json:"colour,omitempty"`
+	Condition    string     `json:"condition,omitempty"`
+	Price        *price     `json:"price,omitempty"`
+	Reserved     bool       `json:"reserved"`
+	Branch       string     `json:"branch,omitempty"`
+	ListedAt     *time.Time `json:"listed_at,omitempty"`
+	// Images are the URLs of the car's photos, which are public.
+	Images []string   `json:"images"`
+	Labels *carLabels `json:"labels,omitempty"`
+}
+
+func newPublicCar(car vehicle) publicCar {
+	p := publicCar{
+		Manufacturer: car.Manurfacturer,
+		Model:        car.Model,
+		VIN:          car.VIN,
+		Year:         car.Year,
+		Mileage:      car.Mileage,
+		FuelType:     car.FuelType,
+		Transmission: car.Transmission,
+		Colour:       car.Colour,
+		Condition:    car.Condition,
+		Price:        car.Price,
+		Reserved:     car.Status == carReserved,
+		Branch:       car.Branch,
+		ListedAt:     car.ListedAt,
+		Images:       []string{},
+		Labels:       car.Labels,
+	}
+	for _, img := range car.Images {
+		p.Images = append(p.Images, apiRoute("/cars/"+car.VIN+"/images/"+img.ID))
+	}
+	return p
+}
+
+// publicCarPage is a page of the cars on sale.
+type publicCarPage struct {
+	Cars       []publicCar `json:"cars"`
+	Total      int64       `json:"total"`
+	Limit      int         `json:"limit"`
+	Page       *int        `json:"page,omitempty"`
+	Offset     *int        `json:"offset,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// publicAPI is the read-only listing API the storefront calls directly,
+// without credentials. It has a router and middleware of its own, so that
+// none of the internal API is reachable through it, and is rate limited apart
+// from the internal API. Its responses may be cached by browsers and CDNs for
+// maxAge, and are signed by secret, when set, as webhooks are, for the
+// storefront to tell they came from the API.
+type publicAPI struct {
+	cars   vehicleRepository
+	maxAge time.Duration
+	secret string
+
+	mu sync.Mutex
+	// names are the manufacturers and models of each tenant's cars on sale.
+	names map[string]*publicNames
+}
+
+// publicNames are the manufacturers and models of the cars on sale, which a
+// public search matches its words against.
+type publicNames struct {
+	manufacturers, models []string
+	at                    time.Time
+}
+
+// publicFirst serves the requests to the public API with public, and the
+// others with api.
+func publicFirst(public, api http.Handler) http.Handler {
+	if public == nil {
+		return api
+	}
+	prefix := apiRoute(publicPrefix)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			public.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
+
+// headers lets any origin read the responses of h, and any cache keep the
+// successful ones for maxAge, signing them when there is a secret.
+func (p *publicAPI) headers(h http.Handler) http.Handler {
+	cacheControl := "public, max-age=" + strconv.Itoa(int(p.maxAge.Seconds())) +
+		", stale-while-revalidate=" + strconv.Itoa(int(p.maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, "+webhookSignatureHeader)
+		w.Header().Add("Vary", "Accept-Language")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		sw := &signingWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		if sw.status == http.StatusOK || sw.status == http.StatusNotModified {
+			w.Header().Set("Cache-Control", cacheControl)
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if p.secret != "" && sw.body.Len() > 0 {
+			w.Header().Set(webhookSignatureHeader, signWebhook(p.secret, time.Now(), sw.body.Bytes()))
+		}
+		w.WriteHeader(sw.status)
+		if _, err := w.Write(sw.body.Bytes()); err != nil {
+			slog.DebugContext(r.Context(), "Failed write public response", "err", err)
+		}
+	})
+}
+
+// signingWriter holds a response back until it is whole, for its headers to
+// be set from its status and body.
+type signingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (sw *signingWriter) WriteHeader(code int) {
+	sw.status = code
+}
+
+func (sw *signingWriter) Write(b []byte) (int, error) {
+	return sw.body.Write(b)
+}
+
+// publicParams parses the listing parameters of a public request, which may
+// only filter by publicFilters and sort by publicSorts, and narrows them to
+// the cars on sale. The search ?q= is returned apart, for search to narrow
+// them by.
+func publicParams(r *http.Request) (ListParams, string, error) {
+	query := r.URL.Query()
+	for name := range query {
+		field := name
+		for suffix := range rangeSuffixes {
+			if base := strings.TrimSuffix(name, suffix); base != name && numericFields[base] {
+				field = base
+			}
+		}
+		if !publicQuery[name] && !publicFilters[field] {
+			return ListParams{}, "", fmt.Errorf("Unknown parameter %q", name)
+		}
+	}
+	if v, ok := query["sort"]; ok && len(v) == 1 {
+		for _, field := range strings.Split(v[0], ",") {
+			if !publicSorts[strings.TrimPrefix(field, "-")] {
+				return ListParams{}, "", fmt.Errorf("Cannot sort by %q", field)
+			}
+		}
+	}
+	search := query["q"]
+	if len(search) > 1 {
+		return ListParams{}, "", fmt.Errorf("Parameter %q may only be given once", "q")
+	}
+	query.Del("q")
+
+	params, err := parseListQuery(query)
+	if err != nil {
+		return params, "", err
+	}
+	params.Filter["status"] = bson.M{"$in": bson.A{carInStock, carReserved}}
+	params.Filter["listedat"] = bson.M{"$exists": true}
+	if len(search) == 0 {
+		return params, "", nil
+	}
+	return params, search[0], nil
+}
+
+// search narrows params to the cars with a manufacturer or model of the
+// words of search. The text index is not searched, as it holds the
+// registrations too, which the public must not find cars by.
+func (p *publicAPI) search(ctx context.Context, params *ListParams, search string) error {
+	names, err := p.onSaleNames(ctx)
+	if err != nil {
+		return err
+	}
+	params.Filter["$or"] = bson.A{
+		bson.M{"manufacturer": bson.M{"$in": namesWithWords(names.manufacturers, search)}},
+		bson.M{"model": bson.M{"$in": namesWithWords(names.models, search)}},
+	}
+	return nil
+}
+
+// onSaleNames returns the manufacturers and models of the tenant's cars on
+// sale, read again once vocabularyTTL old.
+func (p *publicAPI) onSaleNames(ctx context.Context) (*publicNames, error) {
+	tenant := tenantFrom(ctx)
+	p.mu.Lock()
+	names := p.names[tenant]
+	p.mu.Unlock()
+	if names != nil && time.Since(names.at) < vocabularyTTL {
+		return names, nil
+	}
+
+	names = &publicNames{at: time.Now()}
+	seen := map[string]bool{}
+	onSale := ListParams{
+		Filter:     bson.M{"status": bson.M{"$in": bson.A{carInStock, carReserved}}, "listedat": bson.M{"$exists": true}},
+		Projection: bson.M{"_id": 0, "manufacturer": 1, "model": 1},
+	}
+	err := p.cars.each(ctx, onSale, func(car vehicle) error {
+		if m := car.Manurfacturer; m != "" && !seen["manufacturer:"+m] {
+			seen["manufacturer:"+m] = true
+			names.manufacturers = append(names.manufacturers, m)
+		}
+		if m := car.Model; m != "" && !seen["model:"+m] {
+			seen["model:"+m] = true
+			names.models = append(names.models, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.names == nil {
+		p.names = map[string]*publicNames{}
+	}
+	p.names[tenant] = names
+	p.mu.Unlock()
+	return names, nil
+}
+
+// namesWithWords returns the names with any of the words of search among
+// theirs, matched as the text index splits and folds them.
+func namesWithWords(names []string, search string) bson.A {
+	split := func(s string) []string {
+		return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return r == ' ' || r == '-' || r == '/' || r == '.'
+		})
+	}
+	words := map[string]bool{}
+	for _, w := range split(search) {
+		words[w] = true
+	}
+	matched := bson.A{}
+	for _, name := range names {
+		for _, w := range split(name) {
+			if words[w] {
+				matched = append(matched, name)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// list lists the cars on sale, as GET /cars does.
+func (p *publicAPI) list(w http.ResponseWriter, r *http.Request) {
+	params, search, err := publicParams(r)
+	if err != nil {
+		errorWithJSON(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if search != "" {
+		if err := p.search(r.Context(), &params, search); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed search public cars", "err", err)
+			return
+		}
+	}
+
+	cars, total, next, err := p.cars.list(r.Context(), params)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed list public cars", "err", err)
+		return
+	}
+	labelCars(r.Context(), cars)
+
+	page := publicCarPage{Cars: make([]publicCar, len(cars)), Total: total, Limit: params.Limit}
+	for i := range cars {
+		page.Cars[i] = newPublicCar(cars[i])
+	}
+	if params.UseCursor {
+		page.NextCursor = next
+	} else {
+		page.Page = &params.Page
+		page.Offset = &params.Offset
+	}
+
+	respBody, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	responseWithJSON(w, respBody, http.StatusOK)
+}
+
+// car gets a car on sale; others are not found.
+func (p *publicAPI) car(w http.ResponseWriter, r *http.Request) {
+	car, err := p.cars.get(r.Context(), carVIN(r), nil)
+	if err == nil && ((car.Status != carInStock && car.Status != carReserved) || car.ListedAt == nil) {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find public car", "err", err)
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	cars := []vehicle{car}
+	labelCars(r.Context(), cars)
+	if notModified(w, r, carETag(cars[0])) {
+		return
+	}
+	respBody, err := json.MarshalIndent(newPublicCar(cars[0]), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// publicServer is a public API over a memory repository holding the cars of
+// seedCars, the first of them made these makes, models and registrations,
+// and listed for sale.
+func publicServer(t *testing.T, makes [][3]string) *publicAPI {
+	t.Helper()
+	repo := newMemoryVehicles()
+	listed := time.Now().UTC()
+	for i, car := range seedCars(1, len(makes)) {
+		car.Manurfacturer, car.Model, car.RegNo = makes[i][0], makes[i][1], makes[i][2]
+		car.Status = carInStock
+		car.ListedAt = &listed
+		if err := prepareNewCar(context.Background(), &car); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.create(context.Background(), car); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &publicAPI{cars: repo}
+}
+
+func publicList(t *testing.T, p *publicAPI, query string) (int, publicCarPage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	p.list(rec, httptest.NewRequest(http.MethodGet, apiRoute("/public/cars")+"?"+query, nil))
+	var page publicCarPage
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, page
+}
+
+func TestPublicSearchSkipsRegistrations(t *testing.T) {
+	p := publicServer(t, [][3]string{
+		{"Ford", "Focus", "AB12 CDE"},
+		{"Land Rover", "Defender", "XY34 FORD"},
+		{"Ford", "Fiesta", "LR51 ROV"},
+	})
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"ford", []string{"Fiesta", "Focus"}},
+		{"FORD focus", []string{"Fiesta", "Focus"}},
+		{"rover", []string{"Defender"}},
+		{"defender", []string{"Defender"}},
+		{"AB12", nil},
+		{"cde", nil},
+		{"xy34", nil},
+	}
+	for _, tt := range tests {
+		code, page := publicList(t, p, "q="+url.QueryEscape(tt.q))
+		if code != http.StatusOK {
+			t.Fatalf("?q=%s: status = %d, want 200", tt.q, code)
+		}
+		var got []string
+		for _, car := range page.Cars {
+			got = append(got, car.Model)
+		}
+		sort.Strings(got)
+		if len(got) != len(tt.want) || int(page.Total) != len(tt.want) {
+			t.Errorf("?q=%s = %v (total %d), want %v", tt.q, got, page.Total, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("?q=%s = %v, want %v", tt.q, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPublicSortKeys(t *testing.T) {
+	p := publicServer(t, [][3]string{{"Ford", "Focus", "AB12 CDE"}})
+	for _, sort := range []string{"price", "-year,model", "vin"} {
+		if code, _ := publicList(t, p, "sort="+sort); code != http.StatusOK {
+			t.Errorf("?sort=%s: status = %d, want 200", sort, code)
+		}
+	}
+	for _, sort := range []string{"regno", "-regno", "price,regno", "status"} {
+		if code, _ := publicList(t, p, "sort="+sort); code != http.StatusBadRequest {
+			t.Errorf("?sort=%s: status = %d, want 400", sort, code)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var eventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carsupermarket_events_published_total",
+	Help: "Inventory events published to the event bus, by outcome: success or failure.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(eventsPublished)
+}
+
+// publishTimeout bounds each attempt at publishing an event.
+const publishTimeout = 10 * time.Second
+
+// publisher sends inventory events to an event bus, for consumers that would
+// otherwise poll the API. The key names the car, for buses that keep the
+// events of a key in order.
+type publisher interface {
+	publish(ctx context.Context, eventType, key string, payload []byte) error
+	close() error
+}
+
+// busEvent is the message published for an inventory event. The ID is the
+// event's in the outbox, for consumers to drop the copies of an event
+// published again after a failure.
+type busEvent struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Tenant string    `json:"tenant"`
+	VIN    string    `json:"vin"`
+	At     time.Time `json:"at"`
+	Car    *vehicle  `json:"car,omitempty"`
+	// Changes are the fields the event changed, for consumers that want
+	// only some changes to filter on.
+	Changes []fieldChange `json:"changes,omitempty"`
+}
+
+// publishTo returns the outbox sink publishing events to p.
+func publishTo(p publisher) eventSink {
+	return func(ctx context.Context, e outboxEvent) error {
+		if e.Car == nil {
+			return nil
+		}
+		msg := busEvent{ID: e.ID.Hex(), Type: "car." + e.Type, Tenant: e.Tenant, VIN: e.VIN, At: e.CreatedAt, Car: e.Car, Changes: e.Changes}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			panic(err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		if err := p.publish(ctx, e.Type, msg.Tenant+"/"+msg.VIN, payload); err != nil {
+			eventsPublished.WithLabelValues("failure").Inc()
+			return err
+		}
+		eventsPublished.WithLabelValues("success").Inc()
+		return nil
+	}
+}
+
+// kafkaPublisher publishes to a Kafka topic through a Kafka REST Proxy, as
+// JSON records keyed by car.
+type kafkaPublisher struct {
+	url    string
+	topic  string
+	client *http.Client
+}
+
+func newKafkaPublisher(restURL, topic string) *kafkaPublisher {
+	return &kafkaPublisher{url: strings.TrimSuffix(restURL, "/"), topic: topic, client: &http.Client{}}
+}
+
+func (k *kafkaPublisher) publish(ctx context.Context, eventType, key string, payload []byte) error {
+	body, err := json.Marshal(obj{"records": []obj{{"key": key, "value": json.RawMessage(payload)}}})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url+"/topics/"+url.PathEscape(k.topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("Kafka REST Proxy %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	// A record the proxy failed to produce is reported in its offset.
+	var res struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	for _, o := range res.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("Kafka REST Proxy: %d %s", *o.ErrorCode, o.Error)
+		}
+	}
+	return nil
+}
+
+func (k *kafkaPublisher) close() error { return nil }
+
+// natsPublisher publishes to NATS, at the subject prefix followed by the
+// event type, such as carsupermarket.cars.updated, so that consumers can
+// subscribe to the events they want. It speaks the NATS client protocol
+// itself, connecting as the first event is published and again after the
+// connection is lost. Each publish is followed by a PING, so that it only
+// succeeds once the server has the message.
+type natsPublisher struct {
+	url     *url.URL
+	subject string
+
+	// mu serialises publishes; wmu the writes to conn, which the reader
+	// also makes, to answer the server's pings.
+	mu    sync.Mutex
+	wmu   sync.Mutex
+	conn  net.Conn
+	w     *bufio.Writer
+	pongs chan error
+}
+
+func newNATSPublisher(natsURL, subject string) (*natsPublisher, error) {
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{url: u, subject: subject}, nil
+}
+
+func (n *natsPublisher) publish(ctx context.Context, eventType, key string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	n.wmu.Lock()
+	fmt.Fprintf(n.w, "PUB %s.%s %d\r\n", n.subject, eventType, len(payload))
+	n.w.Write(payload)
+	n.w.WriteString("\r\nPING\r\n")
+	err := n.w.Flush()
+	n.wmu.Unlock()
+
+	if err == nil {
+		select {
+		case err = <-n.pongs:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		n.disconnect()
+	}
+	return err
+}
+
+// connect dials the server, upgrading to TLS if it asks or the URL has the
+// tls scheme, and logs in with the URL's user and password or token. The
+// caller holds mu.
+func (n *natsPublisher) connect(ctx context.Context) error {
+	host := n.url.Host
+	if n.url.Port() == "" {
+		host = net.JoinHostPort(n.url.Hostname(), "4222")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("NATS: no INFO from %s: %v", host, err)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired || n.url.Scheme == "tls" {
+		tc := tls.Client(conn, &tls.Config{ServerName: n.url.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, r = tc, bufio.NewReader(tc)
+	}
+
+	opts := obj{"verbose": false, "pedantic": false, "name": "carsupermarket", "lang": "go", "protocol": 0}
+	if u := n.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			opts["user"], opts["pass"] = u.Username(), pass
+		} else {
+			opts["auth_token"] = u.Username()
+		}
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		panic(err)
+	}
+	w := bufio.NewWriter(conn)
+	w.WriteString("CONNECT ")
+	w.Write(connect)
+	w.WriteString("\r\nPING\r\n")
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	// Errors such as a failed login come before the PONG.
+	if err := readPong(r); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	n.conn, n.w, n.pongs = conn, w, make(chan error, 1)
+	go n.read(conn, r, n.pongs)
+	return nil
+}
+
+func readPong(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("NATS: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// read answers the server's pings and passes on its pongs and errors until
+// the connection fails.
+func (n *natsPublisher) read(conn net.Conn, r *bufio.Reader, pongs chan<- error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			select {
+			case pongs <- err:
+			default:
+			}
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			n.wmu.Lock()
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				slog.Warn("Failed answer NATS ping", "err", err)
+			}
+			n.wmu.Unlock()
+		case line == "PONG":
+			select {
+			case pongs <- nil:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			select {
+			case pongs <- errors.New("NATS: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))):
+			default:
+			}
+		}
+	}
+}
+
+// disconnect drops the connection, to be made again by the next publish. The
+// caller holds mu.
+func (n *natsPublisher) disconnect() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+}
+
+func (n *natsPublisher) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.disconnect()
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"problem"
+	"qr"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The sizes a QR code may be asked for in, in pixels.
+const (
+	minQRSize = 64
+	maxQRSize = 4096
+)
+
+// carQRCode serves a PNG QR code of the listing page of a car, for the
+// displays in its windscreen on the forecourt. listingURL has {vin} standing
+// for the car's VIN. ?size= is the most pixels wide the code is drawn, as
+// whole pixels a module, and ?ecc= its error correction level, L, M, Q or
+// H; both default to what the server is configured with.
+func carQRCode(c *mongo.Collection, listingURL string, size int, level qr.Level) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if listingURL == "" {
+			errorWithJSON(w, "QR codes are not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := r.URL.Query()
+		if s := q.Get("size"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < minQRSize || n > maxQRSize {
+				fieldErrorWithJSON(w, "size", "invalid", "The size must be from 64 to 4096 pixels")
+				return
+			}
+			size = n
+		}
+		if s := q.Get("ecc"); s != "" {
+			l, err := qr.ParseLevel(s)
+			if err != nil {
+				fieldErrorWithJSON(w, "ecc", "invalid", "The error correction level must be L, M, Q or H")
+				return
+			}
+			level = l
+		}
+
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		code, err := qr.Encode([]byte(strings.ReplaceAll(listingURL, "{vin}", url.PathEscape(car.VIN))), level)
+		if err != nil {
+			// The URL is checked to fit at the configured level on
+			// startup, but may not at a higher one asked for.
+			fieldErrorWithJSON(w, "ecc", "too_long", "The listing URL is too long for a QR code at this error correction level")
+			return
+		}
+		var body bytes.Buffer
+		if err := png.Encode(&body, code.Image(max(1, size/(code.Size+2*qr.QuietZone)))); err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		if notModified(w, r, etag(body.Bytes())) {
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body.Bytes())
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The periods usage is counted, and quotas are set, for. Periods are UTC
+// calendar days and months.
+const (
+	periodDay   = "day"
+	periodMonth = "month"
+)
+
+const (
+	// usageRetention is how long the usage of a period is kept after it ends.
+	usageRetention = 400 * 24 * time.Hour
+	// usageHistoryDays is how many days of usage are reported.
+	usageHistoryDays = 31
+)
+
+// quota is the requests an API key may make each day and each month. Zero
+// is unlimited.
+type quota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+func (q quota) valid() bool {
+	return q.Daily >= 0 && q.Monthly >= 0
+}
+
+// usageCount is the requests a key made in one period.
+type usageCount struct {
+	KeyID     string    `bson:"keyid"`
+	Period    string    `bson:"period"`
+	Start     time.Time `bson:"start"`
+	Count     int64     `bson:"count"`
+	Tenant    string    `bson:"tenant"`
+	ExpiresAt time.Time `bson:"expiresat"`
+}
+
+// usageStore counts the requests made with each API key, and holds the
+// quota of keys minted without their own.
+type usageStore struct {
+	c        *mongo.Collection
+	defaults quota
+}
+
+func (s *usageStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "keyid", Value: 1}, {Key: "period", Value: 1}, {Key: "start", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// quotaOf returns the quota of a key with its own quota q, or the default
+// quota when q is nil.
+func (s *usageStore) quotaOf(q *quota) quota {
+	if q != nil {
+		return *q
+	}
+	return s.defaults
+}
+
+// periodBounds returns when the period holding t starts and ends.
+func periodBounds(period string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	if period == periodDay {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// take counts a request by the key in the period holding now, unless the key
+// has made limit already; zero is no limit. It returns the count and whether
+// the request was counted.
+func (s *usageStore) take(ctx context.Context, keyID, tenant, period string, limit int64, now time.Time) (int64, bool, error) {
+	start, end := periodBounds(period, now)
+	filter := bson.M{"keyid": keyID, "period": period, "start": start}
+	if limit > 0 {
+		filter["count"] = bson.M{"$lt": limit}
+	}
+	update := bson.M{
+		"$inc":         bson.M{"count": 1},
+		"$setOnInsert": bson.M{"tenant": tenant, "expiresat": end.Add(usageRetention)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	// A filter that does not match because the limit is reached makes the
+	// upsert insert a second count for the period, which the unique index
+	// refuses. The first request of a period can be refused the same way,
+	// by another that inserted the count just before, so it is tried again.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var u usageCount
+		err = s.c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&u)
+		if err == nil {
+			return u.Count, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return 0, false, err
+		}
+	}
+	return limit, false, nil
+}
+
+// release uncounts a request taken in the period holding now.
+func (s *usageStore) release(ctx context.Context, keyID, period string, now time.Time) error {
+	start, _ := periodBounds(period, now)
+	_, err := s.c.UpdateOne(ctx, bson.M{"keyid": keyID, "period": period, "start": start}, bson.M{"$inc": bson.M{"count": -1}})
+	return err
+}
+
+// enforceQuota counts each request made with an API key against the key's
+// daily and monthly quotas, and rejects those over either. When the usage
+// cannot be counted the request is let through, so that the API does not
+// become unavailable with the usage store. A nil store counts nothing.
+func enforceQuota(s *usageStore) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := principalFrom(r.Context())
+			if s == nil || p == nil || p.KeyID == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			q := s.quotaOf(p.Quota)
+			ctx := context.WithoutCancel(r.Context())
+			now := time.Now()
+			var taken []string
+			for _, period := range []struct {
+				name   string
+				limit  int64
+				header string
+			}{
+				{periodDay, q.Daily, "X-Quota-Daily-Remaining"},
+				{periodMonth, q.Monthly, "X-Quota-Monthly-Remaining"},
+			} {
+				count, ok, err := s.take(ctx, p.KeyID, p.Tenant, period.name, period.limit, now)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed count API key usage", "key", p.KeyID, "err", err)
+					break
+				}
+				if !ok {
+					for _, name := range taken {
+						if err := s.release(ctx, p.KeyID, name, now); err != nil {
+							slog.ErrorContext(r.Context(), "Failed uncount API key usage", "key", p.KeyID, "err", err)
+						}
+					}
+					_, end := periodBounds(period.name, now)
+					w.Header().Set(period.header, "0")
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(end.Sub(now).Seconds()))))
+					errorWithCode(w, problem.CodeQuotaExceeded, "The API key's quota for the "+period.name+" is used up", http.StatusTooManyRequests)
+					return
+				}
+				taken = append(taken, period.name)
+				if period.limit > 0 {
+					w.Header().Set(period.header, strconv.FormatInt(period.limit-count, 10))
+				}
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// periodUsage is a key's use of its quota for the current period.
+type periodUsage struct {
+	// Limit is omitted when the key is unlimited in the period, and
+	// Remaining with it.
+	Limit     int64     `json:"limit,omitempty"`
+	Used      int64     `json:"used"`
+	Remaining *int64    `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// dayUsage is the requests a key made on one day.
+type dayUsage struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// keyUsage is the response of GET /usage.
+type keyUsage struct {
+	KeyID   string      `json:"key_id"`
+	Daily   periodUsage `json:"daily"`
+	Monthly periodUsage `json:"monthly"`
+	// History is the requests made on each of the last usageHistoryDays
+	// days the key was used, most recent first.
+	History []dayUsage `json:"history"`
+}
+
+// report returns the usage of the key against q.
+func (s *usageStore) report(ctx context.Context, keyID string, q quota) (keyUsage, error) {
+	now := time.Now()
+	usage := keyUsage{KeyID: keyID, History: []dayUsage{}}
+
+	for _, period := range []struct {
+		name  string
+		limit int64
+		usage *periodUsage
+	}{
+		{periodDay, q.Daily, &usage.Daily},
+		{periodMonth, q.Monthly, &usage.Monthly},
+	} {
+		start, end := periodBounds(period.name, now)
+		var u usageCount
+		err := s.c.FindOne(ctx, bson.M{"keyid": keyID, "period": period.name, "start": start}).Decode(&u)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return usage, err
+		}
+		*period.usage = periodUsage{Limit: period.limit, Used: u.Count, ResetsAt: end}
+		if period.limit > 0 {
+			remaining := max(period.limit-u.Count, 0)
+			period.usage.Remaining = &remaining
+		}
+	}
+
+	today, _ := periodBounds(periodDay, now)
+	opts := options.Find().SetSort(bson.D{{Key: "start", Value: -1}})
+	cur, err := s.c.Find(ctx, bson.M{
+		"keyid":  keyID,
+		"period": periodDay,
+		"start":  bson.M{"$gt": today.AddDate(0, 0, -usageHistoryDays)},
+	}, opts)
+	if err != nil {
+		return usage, err
+	}
+	var days []usageCount
+	if err := cur.All(ctx, &days); err != nil {
+		return usage, err
+	}
+	for _, d := range days {
+		usage.History = append(usage.History, dayUsage{Date: d.Start.Format(time.DateOnly), Count: d.Count})
+	}
+	return usage, nil
+}
+
+// callerUsage reports the usage of the API key the request is made with.
+func callerUsage(s *usageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		if p == nil || p.KeyID == "" {
+			errorWithJSON(w, "Usage is only counted for requests made with an API key", http.StatusBadRequest)
+			return
+		}
+		writeUsage(w, r, s, p.KeyID, s.quotaOf(p.Quota))
+	}
+}
+
+// apiKeyUsage reports the usage of any of the tenant's API keys, for admins.
+func apiKeyUsage(keys *apiKeyStore, s *usageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key apiKey
+		err := keys.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"keyid": pat.Param(r, "id")})).Decode(&key)
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find API key", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "API key not found", http.StatusNotFound)
+			return
+		case nil:
+		}
+		writeUsage(w, r, s, key.ID, s.quotaOf(key.Quota))
+	}
+}
+
+func writeUsage(w http.ResponseWriter, r *http.Request, s *usageStore, keyID string, q quota) {
+	usage, err := s.report(r.Context(), keyID, q)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed report API key usage", "err", err)
+		return
+	}
+
+	respBody, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
+}
+
+// setAPIKeyQuota changes the quota of one of the tenant's API keys, to move
+// it to another tier. A body of null gives it the default quota again.
+func setAPIKeyQuota(keys *apiKeyStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var q *quota
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if q != nil && !q.valid() {
+			fieldErrorWithJSON(w, "quota", "invalid", "Quotas must not be negative")
+			return
+		}
+
+		update := bson.M{"$unset": bson.M{"quota": ""}}
+		if q != nil {
+			update = bson.M{"$set": bson.M{"quota": q}}
+		}
+		var key apiKey
+		err := keys.c.FindOneAndUpdate(r.Context(),
+			forTenant(r.Context(), bson.M{"keyid": pat.Param(r, "id"), "revokedat": bson.M{"$exists": false}}),
+			update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&key)
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed set API key quota", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "API key not found", http.StatusNotFound)
+			return
+		case nil:
+		}
+
+		respBody, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
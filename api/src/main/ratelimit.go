@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "carsupermarket_rate_limit_fallbacks_total",
+	Help: "Requests rate limited by the instance alone because the shared rate limit store failed.",
+})
+
+func init() {
+	prometheus.MustRegister(rateFallbacks)
+}
+
+// rateLimiter keeps a token bucket per client. Buckets that have refilled are
+// forgotten periodically so idle clients do not accumulate. A rate of 0
+// lets every request through.
+//
+// With a shared store the buckets are kept there instead, so that a client
+// has one bucket across every instance. While the store fails, and for
+// sharedRetry after, each instance limits with its own buckets again.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens added per second
+	burst     float64 // bucket capacity
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	shared      sharedBuckets
+	sharedDown  bool
+	sharedRetry time.Time
+}
+
+// sharedBuckets is a store of token buckets shared by every instance.
+type sharedBuckets interface {
+	// take takes a token from key's bucket, as allow does.
+	take(key string, rate, burst float64) (bool, time.Duration, error)
+}
+
+// sharedRetryAfter is how long a failed shared store is left alone before
+// it is tried again.
+const sharedRetryAfter = 10 * time.Second
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const rateSweepInterval = time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// set changes the rate and burst. Buckets keep their tokens, up to the new
+// burst.
+func (l *rateLimiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+	if rate == 0 {
+		clear(l.buckets)
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it returns
+// false and how long until a token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	rate, burst := l.rate, l.burst
+	useShared := l.shared != nil && !now.Before(l.sharedRetry)
+	l.mu.Unlock()
+
+	if rate == 0 {
+		return true, 0
+	}
+	if useShared {
+		ok, wait, err := l.shared.take(key, rate, burst)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err == nil {
+			if l.sharedDown {
+				l.sharedDown = false
+				slog.Info("Rate limiting through the shared store again")
+			}
+			return ok, wait
+		}
+		if !l.sharedDown {
+			l.sharedDown = true
+			slog.Warn("Shared rate limit store failed; rate limiting per instance", "retry_in", sharedRetryAfter, "err", err)
+		}
+		l.sharedRetry = now.Add(sharedRetryAfter)
+		rateFallbacks.Inc()
+		return l.allowLocal(key, now)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shared != nil {
+		rateFallbacks.Inc()
+	}
+	return l.allowLocal(key, now)
+}
+
+// allowLocal takes a token from the instance's own bucket for key. l.mu is
+// held.
+func (l *rateLimiter) allowLocal(key string, now time.Time) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+	if now.Sub(l.lastSweep) > rateSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// redisBuckets keeps token buckets in Redis, each a hash of its tokens and
+// when they were last counted, refilled and taken from by a script so that
+// instances racing for a bucket cannot both take its last token. The time
+// is Redis's, so the instances' clocks need not agree. A bucket expires once
+// it would have refilled.
+type redisBuckets struct {
+	pool *redis.Pool
+	// scope keeps the buckets of limiters sharing the store apart.
+	scope string
+}
+
+var takeToken = redis.NewScript(1, `
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(b[1]) or burst, tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return wait
+`)
+
+func (rb *redisBuckets) take(key string, rate, burst float64) (bool, time.Duration, error) {
+	conn := rb.pool.Get()
+	defer conn.Close()
+
+	wait, err := redis.Int64(takeToken.Do(conn, redisPrefix+"rate:"+rb.scope+key, rate, burst))
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+// clientKey identifies the client a request is rate limited as: its API key
+// when it has one, otherwise its IP address.
+func clientKey(r *http.Request) string {
+	if p := principalFrom(r.Context()); p != nil && p.KeyID != "" {
+		return "key:" + p.KeyID
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// limitRate rejects requests from clients that have used up their bucket. A
+// nil limiter lets every request through.
+func limitRate(l *rateLimiter) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ok, wait := l.allow(clientKey(r), time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				errorWithJSON(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
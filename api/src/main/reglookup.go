@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errRegNotFound is returned by a regProvider that knows of no vehicle with
+// the registration.
+var errRegNotFound = errors.New("no vehicle with this registration")
+
+// regDetails is what a registration lookup tells of a vehicle.
+type regDetails struct {
+	RegNo          string `json:"regno"`
+	Manufacturer   string `json:"manufacturer,omitempty"`
+	Colour         string `json:"colour,omitempty"`
+	FuelType       string `json:"fuel_type,omitempty"`
+	Year           int    `json:"year,omitempty"`
+	EngineCapacity int    `json:"engine_capacity,omitempty"`
+	TaxStatus      string `json:"tax_status,omitempty"`
+	MOTStatus      string `json:"mot_status,omitempty"`
+	MOTExpiry      string `json:"mot_expiry,omitempty"`
+}
+
+// fill sets the fields of car that are empty from d.
+func (d regDetails) fill(car *vehicle) {
+	if car.Manurfacturer == "" {
+		car.Manurfacturer = d.Manufacturer
+	}
+	if car.Colour == "" {
+		car.Colour = strings.ToLower(d.Colour)
+	}
+	if car.FuelType == "" {
+		car.FuelType = strings.ToLower(d.FuelType)
+	}
+	if car.Year == 0 {
+		car.Year = d.Year
+	}
+}
+
+// regProvider looks vehicles up by registration number.
+type regProvider interface {
+	lookupReg(ctx context.Context, regno string) (regDetails, error)
+}
+
+// dvlaClient looks vehicles up through the DVLA Vehicle Enquiry Service.
+type dvlaClient struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func newDVLAClient(url, apiKey string) *dvlaClient {
+	return &dvlaClient{url: url, apiKey: apiKey, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+type dvlaVehicle struct {
+	RegistrationNumber string `json:"registrationNumber"`
+	Make               string `json:"make"`
+	Colour             string `json:"colour"`
+	FuelType           string `json:"fuelType"`
+	YearOfManufacture  int    `json:"yearOfManufacture"`
+	EngineCapacity     int    `json:"engineCapacity"`
+	TaxStatus          string `json:"taxStatus"`
+	MOTStatus          string `json:"motStatus"`
+	MOTExpiryDate      string `json:"motExpiryDate"`
+}
+
+func (d *dvlaClient) lookupReg(ctx context.Context, regno string) (regDetails, error) {
+	body, err := json.Marshal(map[string]string{"registrationNumber": regno})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return regDetails{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", d.apiKey)
+	forwardRequestID(req)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return regDetails{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return regDetails{}, errRegNotFound
+	default:
+		return regDetails{}, fmt.Errorf("registration lookup: %s", resp.Status)
+	}
+
+	var v dvlaVehicle
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return regDetails{}, fmt.Errorf("registration lookup: %v", err)
+	}
+	return regDetails{
+		RegNo:          v.RegistrationNumber,
+		Manufacturer:   v.Make,
+		Colour:         v.Colour,
+		FuelType:       v.FuelType,
+		Year:           v.YearOfManufacture,
+		EngineCapacity: v.EngineCapacity,
+		TaxStatus:      v.TaxStatus,
+		MOTStatus:      v.MOTStatus,
+		MOTExpiry:      v.MOTExpiryDate,
+	}, nil
+}
+
+// regLookup answers registration lookups from a provider, cached for ttl.
+// Lookups of registrations the provider does not know are not cached, so a
+// newly registered vehicle is found as soon as the provider has it.
+type regLookup struct {
+	provider regProvider
+	cache    cacheStore
+	ttl      time.Duration
+}
+
+// normalRegNo returns regno as registrations are looked up: in capitals
+// without spaces.
+func normalRegNo(regno string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(regno), ""))
+}
+
+func (l *regLookup) lookup(ctx context.Context, regno string) (regDetails, error) {
+	regno = normalRegNo(regno)
+	key := "reg:" + regno
+
+	var d regDetails
+	if b, ok := l.cache.get(key); ok && json.Unmarshal(b, &d) == nil {
+		return d, nil
+	}
+
+	d, err := l.provider.lookupReg(ctx, regno)
+	if err != nil {
+		return d, err
+	}
+	if l.ttl > 0 {
+		b, err := json.Marshal(d)
+		if err != nil {
+			panic(err)
+		}
+		l.cache.set(key, b, l.ttl)
+	}
+	return d, nil
+}
+
+// enrich fills in what the lookup tells of the car's registration, if it can
+// be looked up. A car is still added when the provider is down, just without
+// the details.
+func (l *regLookup) enrich(ctx context.Context, car *vehicle) {
+	if l == nil || car.RegNo == "" {
+		return
+	}
+	d, err := l.lookup(ctx, car.RegNo)
+	switch err {
+	case nil:
+		d.fill(car)
+	case errRegNotFound:
+	default:
+		slog.WarnContext(ctx, "Failed look up registration; adding the car without its details", "regno", car.RegNo, "err", err)
+	}
+}
+
+// lookupRegistration looks up the vehicle with the ?regno= registration.
+func lookupRegistration(l *regLookup) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			errorWithJSON(w, "Registration lookup is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		regno := r.URL.Query().Get("regno")
+		if normalRegNo(regno) == "" {
+			errorWithJSON(w, "Parameter \"regno\" is required", http.StatusBadRequest)
+			return
+		}
+
+		d, err := l.lookup(r.Context(), regno)
+		if err != nil {
+			switch err {
+			default:
+				w.Header().Set("Retry-After", "60")
+				errorWithJSON(w, "Registration lookup is unavailable", http.StatusServiceUnavailable)
+				slog.WarnContext(r.Context(), "Failed look up registration", "regno", regno, "err", err)
+				return
+			case errRegNotFound:
+				errorWithJSON(w, "No vehicle with this registration", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
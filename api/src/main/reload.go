@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"config"
+)
+
+// reloader loads the configuration again, from the flags the server was
+// started with, the environment and CONFIG_FILE, and applies the settings
+// that can change as it runs: the log level, the rate limit and the CORS
+// policy. The rest take effect on the next restart.
+type reloader struct {
+	args    []string
+	levels  *logLevel
+	limiter *rateLimiter
+	cors    *atomic.Pointer[corsPolicy]
+
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+// reload applies the configuration as it now is and returns the names of
+// the settings it changed. A configuration that is not valid is not applied
+// at all.
+func (rl *reloader) reload() ([]string, error) {
+	next, err := config.Load(rl.args)
+	if err != nil {
+		return nil, err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	prev := rl.cfg
+	changed := []string{}
+	if next.LogLevel != prev.LogLevel {
+		rl.levels.reconfigure(next.LogLevel)
+		changed = append(changed, "LOG_LEVEL")
+	}
+	if next.RateLimit != prev.RateLimit || next.RateBurst != prev.RateBurst {
+		rl.limiter.set(next.RateLimit, next.RateBurst)
+		changed = append(changed, "RATE_LIMIT", "RATE_BURST")
+	}
+	if !slices.Equal(next.CORSAllowedOrigins, prev.CORSAllowedOrigins) || !slices.Equal(next.CORSAllowedMethods, prev.CORSAllowedMethods) ||
+		!slices.Equal(next.CORSAllowedHeaders, prev.CORSAllowedHeaders) || !slices.Equal(next.CORSExposedHeaders, prev.CORSExposedHeaders) ||
+		next.CORSMaxAge != prev.CORSMaxAge {
+		rl.cors.Store(newCORSPolicy(next.CORSAllowedOrigins, next.CORSAllowedMethods, next.CORSAllowedHeaders,
+			next.CORSExposedHeaders, next.CORSMaxAge))
+		changed = append(changed, "CORS_*")
+	}
+
+	// The other settings are compared with those applied left out, to warn
+	// that their changes are waiting on a restart.
+	a, b := *prev, *next
+	for _, c := range []*config.Config{&a, &b} {
+		c.LogLevel, c.RateLimit, c.RateBurst = 0, 0, 0
+		c.CORSAllowedOrigins, c.CORSAllowedMethods, c.CORSAllowedHeaders, c.CORSExposedHeaders, c.CORSMaxAge = nil, nil, nil, nil, 0
+	}
+	if !reflect.DeepEqual(a, b) {
+		slog.Warn("Some changed settings only take effect on restart")
+	}
+	// Keeping the settings applied, not all those loaded, has the others
+	// still warned about on the next reload.
+	prev.LogLevel, prev.RateLimit, prev.RateBurst = next.LogLevel, next.RateLimit, next.RateBurst
+	prev.CORSAllowedOrigins, prev.CORSAllowedMethods, prev.CORSAllowedHeaders = next.CORSAllowedOrigins, next.CORSAllowedMethods, next.CORSAllowedHeaders
+	prev.CORSExposedHeaders, prev.CORSMaxAge = next.CORSExposedHeaders, next.CORSMaxAge
+
+	slog.Info("Configuration reloaded", "changed", changed)
+	return changed, nil
+}
+
+// reloadConfig reloads the configuration as SIGHUP does, answering with the
+// settings that changed, or 422 when the configuration is not valid.
+func reloadConfig(rl *reloader) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changed, err := rl.reload()
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusUnprocessableEntity)
+			slog.WarnContext(r.Context(), "Failed reload configuration", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(struct {
+			Changed []string `json:"changed"`
+		}{changed}, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
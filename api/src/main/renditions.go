@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxRenditionPixels is the largest photo renditions are made of, which
+	// keeps a small file that decodes to a huge image from using up memory.
+	maxRenditionPixels = 50_000_000
+	renditionQuality   = 80
+)
+
+// imageVariant describes a rendition of a photo: a smaller JPEG copy of it,
+// served by GET /cars/:vin/images/:id?variant=<name>.
+type imageVariant struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Size   int64  `json:"size"`
+}
+
+// renditionSize is a rendition made of every photo larger than it: a copy
+// no wider or taller than MaxEdge pixels.
+type renditionSize struct {
+	Name    string
+	MaxEdge int
+}
+
+// renditions makes the smaller copies of car photos listing pages show, on
+// upload. They are stored beside the original, with its ID in
+// metadata.original and their name in metadata.variant. Photos no larger
+// than a rendition, and WebP photos, which cannot be decoded here, have no
+// copy of that size and are served as they are.
+type renditions struct {
+	photos photoStore
+	// sizes are largest first, so that each is made from the one before.
+	sizes []renditionSize
+}
+
+func newRenditions(photos photoStore, sizes map[string]int) *renditions {
+	rs := &renditions{photos: photos}
+	for name, edge := range sizes {
+		rs.sizes = append(rs.sizes, renditionSize{Name: name, MaxEdge: edge})
+	}
+	sort.Slice(rs.sizes, func(i, j int) bool { return rs.sizes[i].MaxEdge > rs.sizes[j].MaxEdge })
+	return rs
+}
+
+func (rs *renditions) ensureIndex(ctx context.Context) error {
+	_, err := rs.photos.files().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "metadata.original", Value: 1}, {Key: "metadata.variant", Value: 1}},
+	})
+	return err
+}
+
+// has reports whether name is a rendition made.
+func (rs *renditions) has(name string) bool {
+	for _, s := range rs.sizes {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// make stores the renditions of the photo, which was stored with metadata.
+func (rs *renditions) make(ctx context.Context, photo carImage, metadata bson.M) ([]imageVariant, error) {
+	if len(rs.sizes) == 0 || (photo.ContentType != "image/jpeg" && photo.ContentType != "image/png") {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(photo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := rs.photos.open(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var original bytes.Buffer
+	_, err = original.ReadFrom(stream)
+	stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxRenditionPixels {
+		return nil, fmt.Errorf("photo of %dx%d is too large to make renditions of", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(original.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if photo.ContentType == "image/jpeg" {
+		orientation = exifOrientation(original.Bytes())
+	}
+
+	var variants []imageVariant
+	for _, size := range rs.sizes {
+		b := img.Bounds()
+		if max(b.Dx(), b.Dy()) <= size.MaxEdge {
+			continue
+		}
+		img = scale(img, size.MaxEdge)
+		out := orient(img.(*image.RGBA), orientation)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: renditionQuality}); err != nil {
+			return variants, err
+		}
+		meta := bson.M{"original": id, "variant": size.Name, "contenttype": "image/jpeg"}
+		for k, v := range metadata {
+			if _, ok := meta[k]; !ok {
+				meta[k] = v
+			}
+		}
+		v := imageVariant{Name: size.Name, Width: out.Bounds().Dx(), Height: out.Bounds().Dy(), Size: int64(buf.Len())}
+		if _, err := rs.photos.upload(ctx, photo.ID+":"+size.Name, &buf, meta); err != nil {
+			return variants, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// remove deletes the renditions of the photo.
+func (rs *renditions) remove(ctx context.Context, id primitive.ObjectID) error {
+	cur, err := rs.photos.files().Find(ctx, bson.M{"metadata.original": id})
+	if err != nil {
+		return err
+	}
+	var files []imageFile
+	if err := cur.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := rs.photos.delete(ctx, f.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scale returns src shrunk to be no wider or taller than maxEdge, each pixel
+// the average of those it covers, on white where src is transparent.
+func scale(src image.Image, maxEdge int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := maxEdge, max(1, sh*maxEdge/sw)
+	if sh > sw {
+		dw, dh = max(1, sw*maxEdge/sh), maxEdge
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := b.Min.Y+dy*sh/dh, b.Min.Y+(dy+1)*sh/dh
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := b.Min.X+dx*sw/dw, b.Min.X+(dx+1)*sw/dw
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := src.At(x, y).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// The colours are premultiplied, so white shows through by
+			// what the pixel lacks of alpha.
+			white := 0xffff - a/n
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i] = uint8((r/n + white) >> 8)
+			dst.Pix[i+1] = uint8((g/n + white) >> 8)
+			dst.Pix[i+2] = uint8((bl/n + white) >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// orient turns img the way the EXIF orientation says it is to be shown, as
+// browsers do with the original.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored on the diagonal
+				sx, sy = y, x
+			case 6: // turned a quarter anticlockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored on the other diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned a quarter clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], img.Pix[img.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the orientation in the EXIF data of a JPEG, or 1,
+// upright, when it has none.
+func exifOrientation(b []byte) int {
+	r := bytes.NewReader(b)
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return 1
+	}
+	for {
+		var seg [4]byte
+		if _, err := io.ReadFull(r, seg[:]); err != nil || seg[0] != 0xff {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(seg[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 1
+		}
+		switch {
+		case seg[1] == 0xe1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")):
+			o, err := tiffOrientation(data[6:])
+			if err != nil {
+				return 1
+			}
+			return o
+		case seg[1] == 0xda: // the image data starts, after any EXIF
+			return 1
+		}
+	}
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of TIFF data.
+func tiffOrientation(t []byte) (int, error) {
+	if len(t) < 8 {
+		return 0, errors.New("short TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("bad TIFF byte order")
+	}
+	ifd := int(order.Uint32(t[4:]))
+	if ifd+2 > len(t) {
+		return 0, errors.New("bad IFD offset")
+	}
+	entries := int(order.Uint16(t[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(t) {
+			break
+		}
+		if order.Uint16(t[e:]) == 0x0112 {
+			return int(order.Uint16(t[e+8:])), nil
+		}
+	}
+	return 1, nil
+}
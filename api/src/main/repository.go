@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errDuplicateVIN is returned when a car is added with the VIN of one the
+// tenant already has, deleted or not.
+var errDuplicateVIN = errors.New("duplicate VIN")
+
+// errDuplicateRegNo is returned when a car is given the registration of one
+// the tenant already has, deleted or not.
+var errDuplicateRegNo = errors.New("duplicate registration")
+
+// regNoIndex is the index keeping registrations unique within a tenant.
+const regNoIndex = "tenant_1_regno_1"
+
+// duplicateKey returns errDuplicateRegNo or errDuplicateVIN for a duplicate
+// key error, by the index it is of, and any other error as it is.
+func duplicateKey(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), regNoIndex) {
+		return errDuplicateRegNo
+	}
+	return errDuplicateVIN
+}
+
+// duplicateOf returns errDuplicateVIN or errDuplicateRegNo when adding car
+// would, as create does, without adding it.
+func duplicateOf(ctx context.Context, cars vehicleRepository, car vehicle) error {
+	n, err := cars.count(ctx, bson.M{"vin": car.VIN})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errDuplicateVIN
+	}
+	if car.RegNo == "" {
+		return nil
+	}
+	n, err = cars.count(ctx, bson.M{"regno": car.RegNo})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errDuplicateRegNo
+	}
+	return nil
+}
+
+// vehicleRepository stores the cars the car handlers serve. Every method acts
+// for the tenant of ctx. Filters are the listing filters of ListParams; those
+// finding a single car return mongo.ErrNoDocuments when there is none, or it
+// is deleted, or it is at another revision than rev.
+type vehicleRepository interface {
+	// get returns the car with the VIN, with only the keys in projection
+	// unless it is nil.
+	get(ctx context.Context, vin string, projection bson.M) (vehicle, error)
+	// list returns the page of cars described by params and how many cars
+	// match in all, and in cursor mode the cursor of the next page.
+	list(ctx context.Context, params ListParams) ([]vehicle, int64, string, error)
+	// each calls fn with every car matching params, or with paged those of
+	// its page, in order, until fn returns an error.
+	each(ctx context.Context, params ListParams, fn func(vehicle) error) error
+	facets(ctx context.Context, filter bson.M) (*carFacets, error)
+	// count returns how many cars match filter.
+	count(ctx context.Context, filter bson.M) (int64, error)
+	// create adds a car, returning errDuplicateVIN when the VIN is taken
+	// and errDuplicateRegNo when the registration is.
+	create(ctx context.Context, car vehicle) error
+	// replace replaces a car as replaceCar does and returns it as it was.
+	replace(ctx context.Context, car *vehicle, rev int64) (vehicle, error)
+	// update sets and unsets the stored keys of the car with the VIN and
+	// returns it as it was. With nothing to set or unset the car is left
+	// as it is. Replace and update return errDuplicateRegNo when the
+	// registration is taken.
+	update(ctx context.Context, vin string, rev int64, set, unset bson.M) (vehicle, error)
+	// delete marks the car with the VIN deleted and returns it.
+	delete(ctx context.Context, vin string, rev int64) (vehicle, error)
+}
+
+// mongoVehicles is the vehicleRepository kept in a MongoDB collection. The
+// sold cars the archiver has moved to archive are listed too when asked.
+type mongoVehicles struct {
+	c       *mongo.Collection
+	archive *mongo.Collection
+}
+
+func (m *mongoVehicles) get(ctx context.Context, vin string, projection bson.M) (vehicle, error) {
+	opts := options.FindOne()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	var car vehicle
+	err := m.c.FindOne(ctx, liveCar(ctx, vin), opts).Decode(&car)
+	return car, err
+}
+
+func (m *mongoVehicles) list(ctx context.Context, params ListParams) ([]vehicle, int64, string, error) {
+	if params.IncludeArchived && params.near == nil {
+		return findWithArchive(ctx, m.c, m.archive, params)
+	}
+	return findPage(ctx, m.c, params)
+}
+
+func (m *mongoVehicles) each(ctx context.Context, params ListParams, fn func(vehicle) error) error {
+	opts := options.Find().SetBatchSize(dumpFlushEvery)
+	if len(params.Sort) > 0 {
+		opts.SetSort(params.Sort)
+	}
+	if params.Projection != nil {
+		opts.SetProjection(params.Projection)
+	}
+	filter := forTenant(ctx, params.Filter)
+	if params.paged {
+		filter = params.cursorFilter()
+		opts.SetSkip(int64(params.Offset)).SetLimit(int64(pageFetch(params)))
+	}
+
+	var cur *mongo.Cursor
+	var err error
+	if params.IncludeArchived {
+		cur, err = m.c.Aggregate(ctx, withArchive(m.archive, filter, params, params.paged), options.Aggregate().SetBatchSize(dumpFlushEvery))
+	} else {
+		cur, err = m.c.Find(ctx, filter, opts)
+	}
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var car vehicle
+		if err := cur.Decode(&car); err != nil {
+			return err
+		}
+		if err := fn(car); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (m *mongoVehicles) facets(ctx context.Context, filter bson.M) (*carFacets, error) {
+	return findFacets(ctx, m.c, filter)
+}
+
+func (m *mongoVehicles) count(ctx context.Context, filter bson.M) (int64, error) {
+	return m.c.CountDocuments(ctx, forTenant(ctx, filter))
+}
+
+func (m *mongoVehicles) create(ctx context.Context, car vehicle) error {
+	_, err := m.c.InsertOne(ctx, car)
+	return duplicateKey(err)
+}
+
+func (m *mongoVehicles) replace(ctx context.Context, car *vehicle, rev int64) (vehicle, error) {
+	return replaceCar(ctx, m.c, car, rev)
+}
+
+func (m *mongoVehicles) update(ctx context.Context, vin string, rev int64, set, unset bson.M) (vehicle, error) {
+	var before vehicle
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		err := m.c.FindOne(ctx, atRevision(ctx, vin, rev)).Decode(&before)
+		return before, err
+	}
+
+	update["$inc"] = incRevision
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := m.c.FindOneAndUpdate(ctx, atRevision(ctx, vin, rev), update, opts).Decode(&before)
+	return before, duplicateKey(err)
+}
+
+func (m *mongoVehicles) delete(ctx context.Context, vin string, rev int64) (vehicle, error) {
+	return softDelete(ctx, m.c, vin, rev)
+}
+
+// memoryVehicles is a vehicleRepository held in a map, for running the
+// handlers without a database. Cars are kept as the documents Mongo would
+// store, so that the same filters select them; it understands the operators
+// listings and revisions use, and $text matches whole words of the fields
+// the text index covers.
+type memoryVehicles struct {
+	mu sync.Mutex
+	// cars are keyed by tenant and VIN.
+	cars map[string]bson.M
+}
+
+func newMemoryVehicles() *memoryVehicles {
+	return &memoryVehicles{cars: map[string]bson.M{}}
+}
+
+// regNoTaken tells whether a car of the tenant other than the one with the
+// VIN has the registration. The caller holds mu.
+func (m *memoryVehicles) regNoTaken(tenant, regno, vin string) bool {
+	if regno == "" {
+		return false
+	}
+	for _, doc := range m.cars {
+		if doc["tenant"] == tenant && doc["regno"] == regno && doc["vin"] != vin {
+			return true
+		}
+	}
+	return false
+}
+
+func memoryKey(tenant, vin string) string {
+	return tenant + "\x00" + vin
+}
+
+// toDoc and fromDoc convert between a car and its stored document.
+func toDoc(car vehicle) bson.M {
+	b, err := bson.Marshal(car)
+	if err != nil {
+		panic(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+func fromDoc(doc bson.M) vehicle {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	var car vehicle
+	if err := bson.Unmarshal(b, &car); err != nil {
+		panic(err)
+	}
+	return car
+}
+
+// find returns the document of the tenant's car with the VIN if it matches
+// filter.
+func (m *memoryVehicles) find(ctx context.Context, vin string, filter bson.M) (bson.M, error) {
+	doc, ok := m.cars[memoryKey(tenantFrom(ctx), vin)]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	if ok, err := matches(doc, filter); err != nil || !ok {
+		if err == nil {
+			err = mongo.ErrNoDocuments
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+// matching returns the documents of the tenant's cars matching filter, in
+// the order sort gives, then by VIN.
+func (m *memoryVehicles) matching(ctx context.Context, filter bson.M, sortBy bson.D) ([]bson.M, error) {
+	forTenant(ctx, filter)
+	docs := []bson.M{}
+	for _, doc := range m.cars {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	search := textSearch(filter)
+	sort.Slice(docs, func(i, j int) bool {
+		for _, key := range sortBy {
+			if _, ok := key.Value.(bson.M); ok {
+				// By text score, best first.
+				if c := compare(textScore(docs[i], search), textScore(docs[j], search)); c != 0 {
+					return c > 0
+				}
+				continue
+			}
+			order, ok := key.Value.(int)
+			if !ok {
+				continue
+			}
+			a, _ := lookup(docs[i], key.Key)
+			b, _ := lookup(docs[j], key.Key)
+			if c := compare(a, b); c != 0 {
+				return c*order < 0
+			}
+		}
+		a, _ := docs[i]["vin"].(string)
+		b, _ := docs[j]["vin"].(string)
+		return a < b
+	})
+	return docs, nil
+}
+
+func (m *memoryVehicles) get(ctx context.Context, vin string, projection bson.M) (vehicle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.find(ctx, vin, liveCar(ctx, vin))
+	if err != nil {
+		return vehicle{}, err
+	}
+	return fromDoc(project(doc, projection, "")), nil
+}
+
+func (m *memoryVehicles) list(ctx context.Context, params ListParams) ([]vehicle, int64, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all, err := m.matching(ctx, params.Filter, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if params.near != nil {
+		cars, total := nearPage(all, params)
+		return cars, total, "", nil
+	}
+
+	docs, err := m.matching(ctx, params.cursorFilter(), params.Sort)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	search := textSearch(params.Filter)
+	cars := []vehicle{}
+	for _, doc := range docs {
+		cars = append(cars, fromDoc(project(doc, params.Projection, search)))
+	}
+
+	cars = window(cars, params.Offset, len(cars))
+	var next string
+	if params.UseCursor && len(cars) > params.Limit {
+		next = encodeCursor(cars[params.Limit-1].VIN)
+	}
+	return window(cars, 0, params.Limit), int64(len(all)), next, nil
+}
+
+// nearPage returns the page of the cars of docs nearest the point of
+// params, as findNearPage does, and how many there are in all.
+func nearPage(docs []bson.M, params ListParams) ([]vehicle, int64) {
+	kms := map[string]float64{}
+	for _, b := range params.near {
+		kms[b.ID] = b.Km
+	}
+	cars := make([]vehicle, len(docs))
+	for i, doc := range docs {
+		branch, _ := doc["branch"].(string)
+		km := kms[branch]
+		cars[i] = fromDoc(project(doc, params.Projection, textSearch(params.Filter)))
+		cars[i].DistanceKm = &km
+	}
+	sort.SliceStable(cars, func(i, j int) bool { return *cars[i].DistanceKm < *cars[j].DistanceKm })
+	return window(cars, params.Offset, params.Limit), int64(len(cars))
+}
+
+// window returns the limit cars from offset.
+func window(cars []vehicle, offset, limit int) []vehicle {
+	if offset > len(cars) {
+		offset = len(cars)
+	}
+	cars = cars[offset:]
+	if limit < len(cars) {
+		cars = cars[:limit]
+	}
+	return cars
+}
+
+func (m *memoryVehicles) each(ctx context.Context, params ListParams, fn func(vehicle) error) error {
+	m.mu.Lock()
+	filter := params.Filter
+	if params.paged {
+		filter = params.cursorFilter()
+	}
+	docs, err := m.matching(ctx, filter, params.Sort)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	search := textSearch(params.Filter)
+	cars := make([]vehicle, len(docs))
+	for i, doc := range docs {
+		cars[i] = fromDoc(project(doc, params.Projection, search))
+	}
+	m.mu.Unlock()
+	if params.paged {
+		cars = window(cars, params.Offset, pageFetch(params))
+	}
+
+	for _, car := range cars {
+		if err := fn(car); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryVehicles) count(ctx context.Context, filter bson.M) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.matching(ctx, filter, nil)
+	return int64(len(docs)), err
+}
+
+func (m *memoryVehicles) facets(ctx context.Context, filter bson.M) (*carFacets, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	docs, err := m.matching(ctx, filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	return docFacets(docs), nil
+}
+
+// docFacets counts the facets of the stored documents of cars, as findFacets
+// does in the database.
+func docFacets(docs []bson.M) *carFacets {
+	years := make([]int64, len(yearBands))
+	for i, y := range yearBands {
+		years[i] = int64(y)
+	}
+	countBy := func(docs []bson.M, key string) []facetCount {
+		counts := map[string]int64{}
+		for _, doc := range docs {
+			if v, _ := doc[key].(string); v != "" {
+				counts[v]++
+			}
+		}
+		facet := []facetCount{}
+		for v, n := range counts {
+			facet = append(facet, facetCount{Value: v, Count: n})
+		}
+		sort.Slice(facet, func(i, j int) bool {
+			if facet[i].Count != facet[j].Count {
+				return facet[i].Count > facet[j].Count
+			}
+			return facet[i].Value < facet[j].Value
+		})
+		return facet
+	}
+	bandBy := func(docs []bson.M, key string, bounds []int64) []facetBand {
+		counts := make([]int64, len(bounds))
+		for _, doc := range docs {
+			v, _ := lookup(doc, key)
+			n, ok := number(v)
+			for i := len(bounds) - 1; ok && i >= 0; i-- {
+				if float64(bounds[i]) <= n {
+					counts[i]++
+					break
+				}
+			}
+		}
+		counted := []facetBand{}
+		for i, n := range counts {
+			if n > 0 {
+				counted = append(counted, facetBand{Min: bounds[i], Count: n})
+			}
+		}
+		return bands(counted, bounds)
+	}
+
+	return &carFacets{
+		Manufacturer: countBy(docs, "manufacturer"),
+		FuelType:     countBy(docs, "fueltype"),
+		Price:        bandBy(docs, "price.amount", priceBands),
+		Year:         bandBy(docs, "year", years),
+	}
+}
+
+func (m *memoryVehicles) create(ctx context.Context, car vehicle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memoryKey(car.Tenant, car.VIN)
+	if _, ok := m.cars[key]; ok {
+		return errDuplicateVIN
+	}
+	if m.regNoTaken(car.Tenant, car.RegNo, car.VIN) {
+		return errDuplicateRegNo
+	}
+	m.cars[key] = toDoc(car)
+	return nil
+}
+
+func (m *memoryVehicles) replace(ctx context.Context, car *vehicle, rev int64) (vehicle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.find(ctx, car.VIN, atRevision(ctx, car.VIN, rev))
+	if err != nil {
+		return vehicle{}, err
+	}
+
+	before := fromDoc(doc)
+	car.Tenant = tenantFrom(ctx)
+	if m.regNoTaken(car.Tenant, car.RegNo, car.VIN) {
+		return vehicle{}, errDuplicateRegNo
+	}
+	replacing(before, car)
+	m.cars[memoryKey(car.Tenant, car.VIN)] = toDoc(*car)
+	return before, nil
+}
+
+// replacing makes car the replacement of before, as replaceCar does: it
+// keeps the fields only the API's own writes set.
+func replacing(before vehicle, car *vehicle) {
+	car.Images = before.Images
+	car.Status = before.Status
+	car.Order = before.Order
+	car.Hold = before.Hold
+	car.ServiceHistory = before.ServiceHistory
+	car.ListedAt = before.ListedAt
+	car.PriceReviewAt = before.PriceReviewAt
+	car.DistanceKm = nil
+	car.Revision = before.Revision + 1
+}
+
+func (m *memoryVehicles) update(ctx context.Context, vin string, rev int64, set, unset bson.M) (vehicle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.find(ctx, vin, atRevision(ctx, vin, rev))
+	if err != nil {
+		return vehicle{}, err
+	}
+
+	before := fromDoc(doc)
+	if len(set) == 0 && len(unset) == 0 {
+		return before, nil
+	}
+	if regno, ok := set["regno"].(string); ok && m.regNoTaken(before.Tenant, regno, vin) {
+		return vehicle{}, errDuplicateRegNo
+	}
+	m.cars[memoryKey(before.Tenant, vin)] = toDoc(updating(before, set, unset))
+	return before, nil
+}
+
+// updating returns before with the stored keys of set set and those of
+// unset removed, at its next revision.
+func updating(before vehicle, set, unset bson.M) vehicle {
+	updated := toDoc(before)
+	for k, v := range set {
+		updated[k] = v
+	}
+	for k := range unset {
+		delete(updated, k)
+	}
+	updated["revision"] = before.Revision + 1
+	// Decoding the document keeps the stored types those of a vehicle.
+	return fromDoc(updated)
+}
+
+func (m *memoryVehicles) delete(ctx context.Context, vin string, rev int64) (vehicle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	doc, err := m.find(ctx, vin, atRevision(ctx, vin, rev))
+	if err != nil {
+		return vehicle{}, err
+	}
+
+	car := fromDoc(doc)
+	now := time.Now().UTC()
+	car.DeletedAt = &now
+	car.Revision++
+	m.cars[memoryKey(car.Tenant, vin)] = toDoc(car)
+	return car, nil
+}
+
+// project returns doc as projection shapes it, as Mongo does: with only the
+// keys it includes, if it includes any, or else without those it excludes,
+// and with the text score of doc for search at the keys of its
+// {"$meta": "textScore"}. A nil projection returns doc itself.
+func project(doc, projection bson.M, search string) bson.M {
+	if projection == nil {
+		return doc
+	}
+	inclusive := false
+	for _, v := range projection {
+		if include, ok := v.(int); ok && include == 1 {
+			inclusive = true
+		}
+	}
+	projected := bson.M{}
+	if !inclusive {
+		for k, v := range doc {
+			projected[k] = v
+		}
+	}
+	for k, v := range projection {
+		switch v := v.(type) {
+		case int:
+			if value, ok := doc[k]; ok && v == 1 {
+				projected[k] = value
+			} else if v == 0 {
+				delete(projected, k)
+			}
+		case bson.M:
+			if v["$meta"] == "textScore" {
+				projected[k] = textScore(doc, search)
+			}
+		}
+	}
+	return projected
+}
+
+// lookup returns the value at a dotted key of doc.
+func lookup(doc bson.M, key string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// matches reports whether doc matches a query filter, or why the filter
+// cannot be matched.
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or":
+			matched := false
+			for _, sub := range subFilters(cond) {
+				ok, err := matches(doc, sub)
+				if err != nil {
+					return false, err
+				}
+				if key == "$and" && !ok {
+					return false, nil
+				}
+				matched = matched || ok
+			}
+			if key == "$or" && !matched {
+				return false, nil
+			}
+		case "$text":
+			if textScore(doc, textSearch(filter)) == 0 {
+				return false, nil
+			}
+		default:
+			v, present := lookup(doc, key)
+			ops, ok := cond.(bson.M)
+			if !ok || !operators(ops) {
+				if !equal(v, present, cond) {
+					return false, nil
+				}
+				continue
+			}
+			for op, arg := range ops {
+				ok, err := operatorMatches(op, v, present, arg)
+				if err != nil || !ok {
+					return false, err
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+func subFilters(cond interface{}) []bson.M {
+	switch c := cond.(type) {
+	case []bson.M:
+		return c
+	case bson.A:
+		subs := make([]bson.M, 0, len(c))
+		for _, sub := range c {
+			if m, ok := sub.(bson.M); ok {
+				subs = append(subs, m)
+			}
+		}
+		return subs
+	}
+	return nil
+}
+
+// operators reports whether a condition is made of query operators rather
+// than being a document to match exactly.
+func operators(cond bson.M) bool {
+	for k := range cond {
+		return strings.HasPrefix(k, "$")
+	}
+	return false
+}
+
+func operatorMatches(op string, v interface{}, present bool, arg interface{}) (bool, error) {
+	switch op {
+	case "$exists":
+		want, _ := arg.(bool)
+		return present == want, nil
+	case "$ne":
+		return !equal(v, present, arg), nil
+	case "$in", "$nin":
+		in := false
+		for _, x := range subValues(arg) {
+			in = in || equal(v, present, x)
+		}
+		return in == (op == "$in"), nil
+	case "$type":
+		_, numeric := number(v)
+		return present && arg == "number" && numeric, nil
+	case "$gt", "$gte", "$lt", "$lte":
+	default:
+		return false, fmt.Errorf("memoryVehicles: unsupported operator %s", op)
+	}
+
+	if !present {
+		return false, nil
+	}
+	_, vNumeric := number(v)
+	_, argNumeric := number(arg)
+	_, vString := v.(string)
+	_, argString := arg.(string)
+	if vNumeric != argNumeric || vString != argString {
+		return false, nil
+	}
+	c := compare(v, arg)
+	switch op {
+	case "$gt":
+		return c > 0, nil
+	case "$gte":
+		return c >= 0, nil
+	case "$lt":
+		return c < 0, nil
+	}
+	return c <= 0, nil
+}
+
+func subValues(arg interface{}) []interface{} {
+	switch a := arg.(type) {
+	case bson.A:
+		return a
+	case []interface{}:
+		return a
+	case []string:
+		values := make([]interface{}, len(a))
+		for i, s := range a {
+			values[i] = s
+		}
+		return values
+	}
+	return nil
+}
+
+// equal reports whether a value, which may be missing, equals want. A null
+// want matches a missing value, as in Mongo.
+func equal(v interface{}, present bool, want interface{}) bool {
+	if want == nil {
+		return !present || v == nil
+	}
+	return present && compare(v, want) == 0
+}
+
+// number returns v as a float64 if it is a number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compare orders two values of the same kind; values of different kinds
+// compare by kind, with missing values first.
+func compare(a, b interface{}) int {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+	if x, ok := a.(primitive.DateTime); ok {
+		if y, ok := b.(primitive.DateTime); ok {
+			return compare(int64(x), int64(y))
+		}
+	}
+	kind := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int, int32, int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	return kind(a) - kind(b)
+}
+
+// textSearch returns the $search of the $text of filter, if any.
+func textSearch(filter bson.M) string {
+	text, _ := filter["$text"].(bson.M)
+	search, _ := text["$search"].(string)
+	return search
+}
+
+// textScore counts the words of search that are words of the fields the
+// text index covers, ignoring case; a doc scoring 0 does not match.
+func textScore(doc bson.M, search string) float64 {
+	words := map[string]bool{}
+	for _, key := range []string{"manufacturer", "model", "regno"} {
+		s, _ := doc[key].(string)
+		for _, w := range strings.Fields(strings.ToLower(s)) {
+			words[w] = true
+		}
+	}
+	score := 0.0
+	for _, w := range strings.Fields(strings.ToLower(search)) {
+		if words[w] {
+			score++
+		}
+	}
+	return score
+}
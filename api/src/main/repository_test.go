@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestProject(t *testing.T) {
+	doc := bson.M{"vin": "WF0AXXGCDA1234567", "manufacturer": "Ford", "model": "Focus", "year": 2019}
+	score := bson.M{"$meta": "textScore"}
+	tests := []struct {
+		name       string
+		projection bson.M
+		want       bson.M
+	}{
+		{"nil", nil, doc},
+		{"inclusive", bson.M{"vin": 1, "model": 1}, bson.M{"vin": "WF0AXXGCDA1234567", "model": "Focus"}},
+		{"exclusive", bson.M{"year": 0}, bson.M{"vin": "WF0AXXGCDA1234567", "manufacturer": "Ford", "model": "Focus"}},
+		{"score alone", bson.M{"score": score},
+			bson.M{"vin": "WF0AXXGCDA1234567", "manufacturer": "Ford", "model": "Focus", "year": 2019, "score": 2.0}},
+		{"inclusive and score", bson.M{"vin": 1, "score": score}, bson.M{"vin": "WF0AXXGCDA1234567", "score": 2.0}},
+	}
+	for _, tt := range tests {
+		got := project(doc, tt.projection, "ford focus estate")
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: %s = %v, want %v", tt.name, k, got[k], v)
+			}
+		}
+	}
+}
+
+// TestMemoryRefusesUnknownOperators checks an operator the memory storage
+// cannot evaluate fails the query rather than the server.
+func TestMemoryRefusesUnknownOperators(t *testing.T) {
+	repo, _ := stockedRepository(t)
+	ctx := context.Background()
+	if _, err := repo.count(ctx, bson.M{"model": bson.M{"$regex": "^F"}}); err == nil {
+		t.Error("count with $regex: want an error")
+	}
+	params := ListParams{Filter: bson.M{"$or": bson.A{bson.M{"year": bson.M{"$mod": bson.A{2, 0}}}}}, Limit: 10}
+	if _, _, _, err := repo.list(ctx, params); err == nil {
+		t.Error("list with $mod: want an error")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultHold = 48 * time.Hour
+	maxHold     = 7 * 24 * time.Hour
+
+	holdSweepSchedule = "@every 1m"
+)
+
+// hold is a time-limited reservation of a car, for instance while a buyer
+// arranges finance. The car is reserved without an order until the hold is
+// released, expires or is taken over by an order.
+type hold struct {
+	Until      time.Time `json:"until"`
+	By         string    `json:"by,omitempty" bson:",omitempty"`
+	CustomerID string    `json:"customer_id,omitempty" bson:"customerid,omitempty"`
+	Note       string    `json:"note,omitempty" bson:",omitempty"`
+}
+
+// errHeld is returned claiming a car already on a hold that has not expired.
+var errHeld = errors.New("car already on hold")
+
+// reservation records a hold on a car in the reservations collection, where
+// a TTL index removes it once it expires. A car has at most one: claiming it
+// is what keeps two holds from being put on a car at once, and as it goes
+// away by itself a car is free to hold again when its hold expires even
+// while the hold sweep is not running.
+type reservation struct {
+	VIN        string    `bson:"vin"`
+	Until      time.Time `bson:"until"`
+	By         string    `bson:"by,omitempty"`
+	CustomerID string    `bson:"customerid,omitempty"`
+	CreatedAt  time.Time `bson:"createdat"`
+	Tenant     string    `bson:"tenant"`
+}
+
+type reservationStore struct {
+	c *mongo.Collection
+}
+
+func (s *reservationStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "until", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// claim records h on the car vin, taking over a reservation that has
+// expired but not yet been removed. It returns errHeld when the car has a
+// hold that has not. A reservation the car does not bear out, left by a car
+// deleted on hold or a release that failed half way, is replaced.
+func (s *reservationStore) claim(ctx context.Context, cars *mongo.Collection, vin string, h hold) error {
+	res := reservation{VIN: vin, Until: h.Until, By: h.By, CustomerID: h.CustomerID, CreatedAt: time.Now().UTC(), Tenant: tenantFrom(ctx)}
+	for attempt := 0; ; attempt++ {
+		filter := forTenant(ctx, bson.M{"vin": vin, "until": bson.M{"$lte": time.Now()}})
+		_, err := s.c.ReplaceOne(ctx, filter, res, options.Replace().SetUpsert(true))
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		if attempt > 0 {
+			return errHeld
+		}
+
+		held := liveCar(ctx, vin)
+		held["status"] = carReserved
+		held["order"] = bson.M{"$exists": false}
+		held["hold.until"] = bson.M{"$gt": time.Now()}
+		n, err := cars.CountDocuments(ctx, held)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errHeld
+		}
+		if _, err := s.c.DeleteOne(ctx, forTenant(ctx, bson.M{"vin": vin})); err != nil {
+			return err
+		}
+	}
+}
+
+// drop removes the reservation of the hold until until on the car vin, once
+// the hold is released, taken over by an order or could not be put on the
+// car. A failure is only logged, as the reservation expires regardless.
+func (s *reservationStore) drop(ctx context.Context, vin string, until time.Time) {
+	_, err := s.c.DeleteOne(context.WithoutCancel(ctx), forTenant(ctx, bson.M{"vin": vin, "until": until}))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed remove reservation", "vin", vin, "err", err)
+	}
+}
+
+// holdable is the filter for the cars a new hold or order may reserve: those
+// in stock and those on a hold that has expired, which the hold sweep has not
+// released yet. Orders also take over holds that have not expired.
+func holdable(ctx context.Context, vin string, withHold bool) bson.M {
+	filter := liveCar(ctx, vin)
+	filter["soldat"] = bson.M{"$exists": false}
+	onHold := bson.M{"status": carReserved, "order": bson.M{"$exists": false}}
+	if !withHold {
+		onHold["hold.until"] = bson.M{"$lte": time.Now()}
+	}
+	filter["$or"] = bson.A{bson.M{"status": carInStock}, onHold}
+	return filter
+}
+
+// reserveCar puts a car in stock on hold for ?hours=, 48 by default. The hold
+// is claimed in the reservations collection first, and the car then checked
+// to still be free to hold as it is moved.
+func reserveCar(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var h hold
+		if r.ContentLength != 0 {
+			decoder := json.NewDecoder(r.Body)
+			if err := decoder.Decode(&h); err != nil {
+				incorrectBody(w, err)
+				return
+			}
+		}
+
+		length := defaultHold
+		if v := r.URL.Query().Get("hours"); v != "" {
+			n, err := parseCount("hours", v, 1, int(maxHold/time.Hour))
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			length = time.Duration(n) * time.Hour
+		}
+		h.Until = time.Now().UTC().Add(length)
+		h.By = ""
+		if p := principalFrom(r.Context()); p != nil {
+			h.By = p.Subject
+		}
+
+		switch err := o.reservations.claim(r.Context(), o.cars, vin, h); err {
+		case nil:
+		case errHeld:
+			errorWithJSON(w, "The car is already on hold", http.StatusConflict)
+			return
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed claim reservation", "err", err)
+			return
+		}
+
+		update := bson.M{"$set": bson.M{"status": carReserved, "hold": h}}
+		before, after, err := o.move(r.Context(), eventUpdated, holdable(r.Context(), vin, false), update)
+		if err != nil {
+			o.reservations.drop(r.Context(), vin, h.Until)
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed reserve car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				n, err := o.cars.CountDocuments(r.Context(), liveCar(r.Context(), vin))
+				if err != nil {
+					errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+					slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+					return
+				}
+				if n == 0 {
+					errorWithJSON(w, "Car not found", http.StatusNotFound)
+					return
+				}
+				errorWithJSON(w, "The car is not in stock", http.StatusConflict)
+				return
+			}
+		}
+		o.changed(r.Context(), auditReserved, &before, &after)
+
+		w.Header().Set("ETag", carETag(after))
+		respBody, err := json.MarshalIndent(after, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// releaseCar releases the hold on a car. Cars reserved by an order are
+// released by cancelling the order.
+func releaseCar(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := liveCar(r.Context(), carVIN(r))
+		filter["hold"] = bson.M{"$exists": true}
+		filter["order"] = bson.M{"$exists": false}
+		before, after, err := o.move(r.Context(), eventUpdated, filter, releaseHold())
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed release car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car on hold not found", http.StatusNotFound)
+				return
+			}
+		}
+		o.reservations.drop(r.Context(), before.VIN, before.Hold.Until)
+		o.changed(r.Context(), auditReleased, &before, &after)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// releaseHold returns the update putting a car on hold back in stock. It is
+// built afresh for each move, as moveCar adds to it.
+func releaseHold() bson.M {
+	return bson.M{"$set": bson.M{"status": carInStock}, "$unset": bson.M{"hold": ""}}
+}
+
+// holdSweeper releases the holds that have expired, putting the cars back in
+// stock for those listing them. Their reservations are removed by the TTL
+// index, and the cars may be held or ordered again without the sweep.
+type holdSweeper struct {
+	sales *orderWrites
+}
+
+// holdSweeperPrincipal is the actor the sweeper's releases are audited as.
+var holdSweeperPrincipal = &principal{Subject: "system:hold-sweeper", Method: "system"}
+
+// sweep releases every expired hold. A sweep under way is finished on
+// shutdown, so ctx is only read for its values.
+func (s *holdSweeper) sweep(ctx context.Context) error {
+	ctx = context.WithValue(context.WithoutCancel(ctx), principalKey{}, holdSweeperPrincipal)
+
+	var expired []vehicle
+	filter := bson.M{
+		"hold.until": bson.M{"$lt": time.Now()},
+		"order":      bson.M{"$exists": false},
+		"deletedat":  bson.M{"$exists": false},
+	}
+	cur, err := s.sales.cars.Find(ctx, filter, options.Find().SetProjection(bson.M{"vin": 1, "tenant": 1}))
+	if err == nil {
+		err = cur.All(ctx, &expired)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, car := range expired {
+		ctx := withTenant(ctx, car.Tenant)
+
+		// The filter is repeated so that a hold renewed or taken over by an
+		// order since is left alone.
+		carFilter := liveCar(ctx, car.VIN)
+		carFilter["hold.until"] = filter["hold.until"]
+		carFilter["order"] = filter["order"]
+		before, after, err := s.sales.move(ctx, eventUpdated, carFilter, releaseHold())
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.sales.changed(ctx, auditReleased, &before, &after)
+	}
+	return nil
+}
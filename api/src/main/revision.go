@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// anyRevision matches a car whatever its revision, for writes made without a
+// precondition.
+const anyRevision int64 = -1
+
+// incRevision is the $inc that every write to a car makes.
+var incRevision = bson.M{"revision": 1}
+
+// atRevision returns the filter for the live car with the VIN at revision rev.
+// Cars stored before revisions were kept have none, which counts as 0.
+func atRevision(ctx context.Context, vin string, rev int64) bson.M {
+	filter := liveCar(ctx, vin)
+	switch rev {
+	case anyRevision:
+	case 0:
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	default:
+		filter["revision"] = rev
+	}
+	return filter
+}
+
+// carETag returns the entity tag of a car, which is its revision.
+func carETag(car vehicle) string {
+	return `"` + strconv.FormatInt(car.Revision, 10) + `"`
+}
+
+// expectedRevision returns the revision a write to the car with the VIN must
+// find: the one in If-Match, else the one from the body, else anyRevision. A
+// body revision of 0 counts as none. It writes the response and returns false
+// when If-Match cannot be met.
+func expectedRevision(w http.ResponseWriter, r *http.Request, cars vehicleRepository, vin string, body int64) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch {
+	case header == "" && body > 0:
+		return body, true
+	case header == "" || header == "*":
+		return anyRevision, true
+	case strings.Contains(header, ","):
+		errorWithJSON(w, "If-Match must hold a single ETag", http.StatusBadRequest)
+		return 0, false
+	}
+
+	// Weak tags never meet If-Match, and neither do tags that are not ours.
+	rev, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil || rev < 0 || len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		missingOrConflict(w, r, cars, vin, 0)
+		return 0, false
+	}
+	return rev, true
+}
+
+// missingOrConflict writes the response for a write to the car with the VIN
+// at revision rev that matched nothing: 404 when there is no such car and 409,
+// with the car's current ETag, when it is at another revision. A delete, whose
+// only precondition is If-Match, fails it with 412 instead, so that a car sold
+// or changed since it was read is not deleted.
+func missingOrConflict(w http.ResponseWriter, r *http.Request, cars vehicleRepository, vin string, rev int64) {
+	if rev == anyRevision {
+		errorWithJSON(w, "Car not found", http.StatusNotFound)
+		return
+	}
+
+	car, err := cars.get(r.Context(), vin, nil)
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	status := http.StatusConflict
+	if r.Method == http.MethodDelete {
+		status = http.StatusPreconditionFailed
+	}
+	w.Header().Set("ETag", carETag(car))
+	errorWithCode(w, problem.CodeRevisionConflict, "The car was changed by someone else; fetch it and try again", status)
+}
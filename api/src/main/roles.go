@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// Roles, from least to most privileged. Each role may do everything the ones
+// below it may.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+type roleAssignment struct {
+	Subject    string    `json:"subject"`
+	Role       string    `json:"role"`
+	AssignedBy string    `json:"assigned_by,omitempty" bson:"assignedby,omitempty"`
+	AssignedAt time.Time `json:"assigned_at" bson:"assignedat"`
+}
+
+// roleStore holds the roles assigned to token subjects. Subjects listed in
+// admins are always admins so that the first assignments can be made.
+type roleStore struct {
+	c      *mongo.Collection
+	admins map[string]bool
+}
+
+func (s *roleStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "subject", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// roleOf returns the role of subject, which is viewer unless another has been
+// assigned.
+func (s *roleStore) roleOf(ctx context.Context, subject string) (string, error) {
+	if s.admins[subject] {
+		return roleAdmin, nil
+	}
+
+	var a roleAssignment
+	err := s.c.FindOne(ctx, bson.M{"subject": subject}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		return roleViewer, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return a.Role, nil
+}
+
+// requireRole rejects callers without at least the given role. Anonymous
+// callers count as viewers, so only write routes need wrapping. Nothing is
+// enforced when authentication is not required.
+func requireRole(a *authenticator, role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.required {
+			h(w, r)
+			return
+		}
+
+		p := principalFrom(r.Context())
+		if p == nil {
+			unauthorized(w, "Authentication required")
+			return
+		}
+
+		if roleRank[p.Role] < roleRank[role] {
+			errorWithJSON(w, "The "+role+" role is required", http.StatusForbidden)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// requireSignIn rejects anonymous callers, whether or not authentication is
+// required, for the routes that keep things per person.
+func requireSignIn(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalFrom(r.Context()) == nil {
+			unauthorized(w, "Authentication required")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func assignRole(s *roleStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := pat.Param(r, "subject")
+
+		var a roleAssignment
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&a)
+		if err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		if _, ok := roleRank[a.Role]; !ok {
+			errorWithJSON(w, "Role must be viewer, editor or admin", http.StatusBadRequest)
+			return
+		}
+
+		a.Subject = subject
+		a.AssignedAt = time.Now().UTC()
+		if p := principalFrom(r.Context()); p != nil {
+			a.AssignedBy = p.Subject
+		}
+
+		_, err = s.c.ReplaceOne(r.Context(), bson.M{"subject": subject}, a, options.Replace().SetUpsert(true))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed assign role", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func allRoles(s *roleStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roles := []roleAssignment{}
+		cur, err := s.c.Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "subject", Value: 1}}))
+		if err == nil {
+			err = cur.All(r.Context(), &roles)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list roles", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(roles, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
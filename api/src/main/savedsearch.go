@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// savedSearchEvent is the webhook event sent when cars newly on sale match a
+// saved search.
+const savedSearchEvent = "saved_search.matched"
+
+const (
+	// savedSearchSchedule is when saved searches are matched against the
+	// cars listed since, unless configured otherwise.
+	savedSearchSchedule = "@every 15m"
+	// maxSavedSearches is the most searches one person may save.
+	maxSavedSearches = 50
+	// maxAlertCars is the most cars one alert names.
+	maxAlertCars = 20
+)
+
+// savedSearch is a listing query someone saved, e.g.
+// "manufacturer=Volkswagen&model=Golf&price_max=1500000". With Alerts set,
+// the cars listed since CheckedAt that match it are sent to the tenant's
+// webhooks, as saved_search.matched events, to notify its owner of.
+type savedSearch struct {
+	ID        string    `json:"id" bson:"searchid"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	Alerts    bool      `json:"alerts"`
+	CreatedAt time.Time `json:"created_at" bson:"createdat"`
+	CheckedAt time.Time `json:"checked_at" bson:"checkedat"`
+	Tenant    string    `json:"-" bson:"tenant"`
+}
+
+// params parses the query of the search as a listing's.
+func (s *savedSearch) params() (ListParams, error) {
+	values, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return ListParams{}, fmt.Errorf("The query is not a query string")
+	}
+	for _, name := range []string{"near", "cursor", "reduced_within_days"} {
+		if values.Has(name) {
+			return ListParams{}, fmt.Errorf("Parameter %q cannot be saved", name)
+		}
+	}
+	return parseListQuery(values)
+}
+
+func (s *savedSearch) validate() *fieldError {
+	c := &checks{}
+	c.require("name", s.Name, "The name is required")
+	c.maxLength("name", s.Name, maxNameLength)
+	c.maxLength("query", s.Query, 2000)
+	if _, err := s.params(); err != nil {
+		c.fail("query", "invalid", err.Error())
+	}
+	return c.err()
+}
+
+type savedSearches struct {
+	c     *mongo.Collection
+	cars  *mongo.Collection
+	hooks *webhooks
+}
+
+func (s *savedSearches) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "searchid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}, {Key: "createdat", Value: 1}}},
+		{Keys: bson.D{{Key: "alerts", Value: 1}, {Key: "checkedat", Value: 1}}},
+	})
+	return err
+}
+
+// ownSearches is the filter for the searches saved by the caller.
+func ownSearches(ctx context.Context, filter bson.M) bson.M {
+	filter["owner"] = principalFrom(ctx).Subject
+	return forTenant(ctx, filter)
+}
+
+// alert sends the cars listed since the search was last checked that match
+// it, and records it checked.
+func (s *savedSearches) alert(ctx context.Context, search *savedSearch, now time.Time) error {
+	params, err := search.params()
+	if err != nil {
+		// The listing parameters changed since it was saved.
+		slog.WarnContext(ctx, "Saved search no longer valid", "search", search.ID, "err", err)
+		return nil
+	}
+	filter := params.Filter
+	filter["status"] = carInStock
+	filter["listedat"] = bson.M{"$gt": search.CheckedAt, "$lte": now}
+	filter = forTenant(ctx, filter)
+
+	total, err := s.cars.CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		cars := []vehicle{}
+		opts := options.Find().SetSort(bson.D{{Key: "listedat", Value: 1}}).SetLimit(maxAlertCars)
+		cur, err := s.cars.Find(ctx, filter, opts)
+		if err == nil {
+			err = cur.All(ctx, &cars)
+		}
+		if err != nil {
+			return err
+		}
+		data := struct {
+			Search *savedSearch `json:"search"`
+			Total  int64        `json:"total"`
+			Cars   []vehicle    `json:"cars"`
+		}{search, total, cars}
+		if err := s.hooks.record(ctx, fmt.Sprintf("%s-%d", search.ID, now.Unix()), []string{savedSearchEvent}, now, data); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.c.UpdateOne(ctx, forTenant(ctx, bson.M{"searchid": search.ID}), bson.M{"$set": bson.M{"checkedat": now}})
+	return err
+}
+
+// alertAll matches every saved search with alerts against the cars listed
+// since it was last checked.
+func (s *savedSearches) alertAll(ctx context.Context) error {
+	var searches []savedSearch
+	cur, err := s.c.Find(ctx, bson.M{"alerts": true})
+	if err == nil {
+		err = cur.All(ctx, &searches)
+	}
+	if err != nil {
+		return fmt.Errorf("find saved searches: %w", err)
+	}
+
+	now := time.Now().UTC()
+	for i := range searches {
+		if ctx.Err() != nil {
+			return nil
+		}
+		search := &searches[i]
+		if err := s.alert(withTenant(ctx, search.Tenant), search, now); err != nil {
+			return fmt.Errorf("alert saved search %s: %w", search.ID, err)
+		}
+	}
+	return nil
+}
+
+// savedSearchNotFound writes the response for a failed lookup of a saved
+// search.
+func savedSearchNotFound(w http.ResponseWriter, r *http.Request, err error, op string) {
+	switch err {
+	default:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed "+op, "err", err)
+	case mongo.ErrNoDocuments:
+		errorWithJSON(w, "Saved search not found", http.StatusNotFound)
+	}
+}
+
+// addSavedSearch saves a search for the caller.
+func addSavedSearch(s *savedSearches) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var search savedSearch
+		if !decodeStrict(w, r.Body, &search) {
+			return
+		}
+		if err := search.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		n, err := s.c.CountDocuments(r.Context(), ownSearches(r.Context(), bson.M{}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count saved searches", "err", err)
+			return
+		}
+		if n >= maxSavedSearches {
+			errorWithJSON(w, fmt.Sprintf("At most %d searches may be saved", maxSavedSearches), http.StatusConflict)
+			return
+		}
+
+		if search.ID, err = randomHex(8); err != nil {
+			panic(err)
+		}
+		search.Owner = principalFrom(r.Context()).Subject
+		search.CreatedAt = time.Now().UTC()
+		search.CheckedAt = search.CreatedAt
+		search.Tenant = tenantFrom(r.Context())
+
+		if _, err := s.c.InsertOne(r.Context(), search); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert saved search", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(search, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/saved-searches/"+search.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+// allSavedSearches lists the caller's saved searches, oldest first.
+func allSavedSearches(s *savedSearches) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		searches := []savedSearch{}
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}})
+		cur, err := s.c.Find(r.Context(), ownSearches(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &searches)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list saved searches", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(searches, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// savedSearchCars lists the cars matching one of the caller's saved searches
+// now, as GET /cars would with its query.
+func savedSearchCars(s *savedSearches, repo vehicleRepository, rates *exchangeRates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var search savedSearch
+		err := s.c.FindOne(r.Context(), ownSearches(r.Context(), bson.M{"searchid": pat.Param(r, "id")})).Decode(&search)
+		if err != nil {
+			savedSearchNotFound(w, r, err, "find saved search")
+			return
+		}
+		params, err := search.params()
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		listCars(w, r, repo, rates, params)
+	}
+}
+
+func deleteSavedSearch(s *savedSearches) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.c.DeleteOne(r.Context(), ownSearches(r.Context(), bson.M{"searchid": pat.Param(r, "id")}))
+		if err == nil && res.DeletedCount == 0 {
+			err = mongo.ErrNoDocuments
+		}
+		if err != nil {
+			savedSearchNotFound(w, r, err, "delete saved search")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cron"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "carsupermarket_job_runs_total",
+		Help: "Runs of background jobs, by outcome: success, failure, skipped for a run due while the last was still going, or follower for a run left to the instance leading.",
+	}, []string{"job", "outcome"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "carsupermarket_job_duration_seconds",
+		Help:    "How long background job runs took.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"job"})
+
+	jobRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "carsupermarket_job_running",
+		Help: "Whether a background job is running.",
+	}, []string{"job"})
+
+	jobLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "carsupermarket_job_last_success_timestamp_seconds",
+		Help: "When a background job last ran successfully, as a Unix time.",
+	}, []string{"job"})
+)
+
+func init() {
+	prometheus.MustRegister(jobRuns, jobDuration, jobRunning, jobLastSuccess)
+}
+
+// jobOff is the schedule of a job turned off.
+const jobOff = "off"
+
+// job is periodic work. The context it is run with is cancelled when the
+// server shuts down, for jobs to check between units of work.
+type job struct {
+	name     string
+	schedule cron.Schedule
+	run      func(ctx context.Context) error
+	running  atomic.Bool
+	// everyInstance has the job run on every instance, rather than only on
+	// the one leading, for work that fills the instance's own memory.
+	everyInstance bool
+}
+
+// scheduler runs jobs on their schedules. A run that falls due while the
+// last run of the job is still going is skipped, so that a slow job never
+// runs twice at once in an instance. With a leader lease, runs are skipped
+// too on the instances not leading, so that a job runs once across the
+// deployment; a run begun just before the lease is lost may still overlap
+// the first run of the next leader.
+type scheduler struct {
+	jobs []*job
+	// schedules override the default schedules of jobs, by name.
+	schedules map[string]string
+	added     map[string]bool
+	leader    *lease
+}
+
+func newScheduler(schedules map[string]string) *scheduler {
+	return &scheduler{schedules: schedules, added: make(map[string]bool)}
+}
+
+// add schedules run as name, on spec unless the schedules override it, to
+// run on the instance leading.
+func (s *scheduler) add(name, spec string, run func(ctx context.Context) error) error {
+	return s.schedule(name, spec, run, false)
+}
+
+// addLocal schedules run as name, as add does, to run on every instance.
+func (s *scheduler) addLocal(name, spec string, run func(ctx context.Context) error) error {
+	return s.schedule(name, spec, run, true)
+}
+
+func (s *scheduler) schedule(name, spec string, run func(ctx context.Context) error, everyInstance bool) error {
+	s.added[name] = true
+	if override, ok := s.schedules[name]; ok {
+		spec = override
+	}
+	if spec == jobOff {
+		slog.Info("Job turned off", "job", name)
+		return nil
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	s.jobs = append(s.jobs, &job{name: name, schedule: schedule, run: run, everyInstance: everyInstance})
+	return nil
+}
+
+// check returns an error naming the schedules overridden for no job added,
+// which are most likely typos.
+func (s *scheduler) check() error {
+	var unknown []string
+	for name := range s.schedules {
+		if !s.added[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("JOB_SCHEDULES names unknown jobs %v", unknown)
+	}
+	return nil
+}
+
+// run runs the jobs until stop is closed, then waits for the runs under way
+// and closes done.
+func (s *scheduler) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop(ctx, j, &wg)
+		}()
+	}
+
+	<-stop
+	cancel()
+	wg.Wait()
+}
+
+// loop starts a run of j each time it falls due, until ctx is cancelled.
+func (s *scheduler) loop(ctx context.Context, j *job, wg *sync.WaitGroup) {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Warn("Job is never due", "job", j.name)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !j.everyInstance && !s.leader.leading() {
+			jobRuns.WithLabelValues(j.name, "follower").Inc()
+			slog.Debug("Left job run to the instance leading", "job", j.name)
+			continue
+		}
+		if !j.running.CompareAndSwap(false, true) {
+			jobRuns.WithLabelValues(j.name, "skipped").Inc()
+			slog.Warn("Skipped job run; the last run is still going", "job", j.name)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer j.running.Store(false)
+			s.execute(ctx, j)
+		}()
+	}
+}
+
+// execute runs j once, recording how it went. A panic fails the run rather
+// than the server.
+func (s *scheduler) execute(ctx context.Context, j *job) {
+	start := time.Now()
+	jobRunning.WithLabelValues(j.name).Set(1)
+	defer jobRunning.WithLabelValues(j.name).Set(0)
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				slog.Error("Job panicked", "job", j.name, "panic", v, "stack", string(debug.Stack()))
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return j.run(ctx)
+	}()
+
+	jobDuration.WithLabelValues(j.name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		jobRuns.WithLabelValues(j.name, "failure").Inc()
+		slog.Error("Job failed", "job", j.name, "err", err)
+		return
+	}
+	jobRuns.WithLabelValues(j.name, "success").Inc()
+	jobLastSuccess.WithLabelValues(j.name).SetToCurrentTime()
+}
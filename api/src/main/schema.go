@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The schema validation actions MongoDB takes on a write that breaks the
+// shape of a car, or schemaOff for no validation.
+const (
+	schemaError = "error"
+	schemaWarn  = "warn"
+	schemaOff   = "off"
+)
+
+// namespaceNotFound is the code of the error collMod gives for a collection
+// that has not been created yet.
+const namespaceNotFound = 26
+
+// Schema fragments for the BSON types the cars are written with. Numbers may
+// be of any numeric type, as the mongo shell writes doubles.
+var (
+	schemaString = bson.M{"bsonType": "string"}
+	schemaNumber = bson.M{"bsonType": "number"}
+	schemaDate   = bson.M{"bsonType": "date"}
+)
+
+func schemaEnum(values ...string) bson.M {
+	return bson.M{"bsonType": "string", "enum": values}
+}
+
+// carSchema is the $jsonSchema of a stored vehicle: the fields the API reads,
+// with their types and the values validate allows. Other fields may be added
+// by other tools, so long as these keep their shape.
+func carSchema() bson.M {
+	price := bson.M{
+		"bsonType": "object",
+		"required": bson.A{"amount", "currency"},
+		"properties": bson.M{
+			"amount":   bson.M{"bsonType": "number", "minimum": 0},
+			"currency": bson.M{"bsonType": "string", "pattern": currencyCode.String()},
+		},
+	}
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"vin", "tenant"},
+		"properties": bson.M{
+			"manufacturer": schemaString,
+			"model":        schemaString,
+			"vin":          bson.M{"bsonType": "string", "minLength": 1},
+			"regno":        schemaString,
+			"dealer":       schemaString,
+			"branch":       schemaString,
+			"status":       schemaEnum(carInPrep, carInStock, carReserved, carSold, carWrittenOff),
+			"order":        schemaString,
+			"hold": bson.M{
+				"bsonType": "object",
+				"required": bson.A{"until"},
+				"properties": bson.M{
+					"until":      schemaDate,
+					"by":         schemaString,
+					"customerid": schemaString,
+					"note":       schemaString,
+				},
+			},
+			"soldat":        schemaDate,
+			"listedat":      schemaDate,
+			"pricereviewat": schemaDate,
+			"price":         price,
+			"mileage":       bson.M{"bsonType": "number", "minimum": 0},
+			"year":          bson.M{"bsonType": "number", "minimum": firstModelYear},
+			"fueltype":      schemaEnum(keys(fuelTypes)...),
+			"transmission":  schemaEnum(keys(transmissions)...),
+			"colour":        schemaString,
+			"condition":     schemaEnum(keys(conditions)...),
+			"images": bson.M{
+				"bsonType": "array",
+				"items": bson.M{
+					"bsonType": "object",
+					"required": bson.A{"id"},
+					"properties": bson.M{
+						"id":          schemaString,
+						"contenttype": schemaString,
+						"size":        schemaNumber,
+						"uploadedat":  schemaDate,
+						"variants":    bson.M{"bsonType": "array"},
+					},
+				},
+			},
+			"servicehistory": bson.M{
+				"bsonType": "object",
+				"properties": bson.M{
+					"servicecount":    schemaNumber,
+					"lastservicedate": schemaDate,
+				},
+			},
+			"deletedat": schemaDate,
+			"revision":  bson.M{"bsonType": "number", "minimum": 1},
+			"tenant":    schemaString,
+		},
+	}
+}
+
+// ensureSchema makes the indexes of the cars and archive collections and has
+// MongoDB check every car written to them against carSchema, taking action
+// on those that break it. The level is moderate, so cars stored before the
+// schema, or stored since by tools that skip validation, can still be
+// updated while they do not match it.
+func ensureSchema(ctx context.Context, cars, archive *mongo.Collection, action string) error {
+	if err := ensureIndex(ctx, cars, archive); err != nil {
+		return err
+	}
+	for _, c := range []*mongo.Collection{cars, archive} {
+		if err := applyValidator(ctx, c, carSchema(), action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyValidator sets the $jsonSchema validator of c, creating it if it is
+// not there yet.
+func applyValidator(ctx context.Context, c *mongo.Collection, schema bson.M, action string) error {
+	validator := bson.M{"$jsonSchema": schema}
+	level := "moderate"
+	if action == schemaOff {
+		level, action = "off", schemaError
+	}
+
+	err := c.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: c.Name()},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: level},
+		{Key: "validationAction", Value: action},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFound {
+		opts := options.CreateCollection().SetValidator(validator).
+			SetValidationLevel(level).SetValidationAction(action)
+		err = c.Database().CreateCollection(ctx, c.Name(), opts)
+	}
+	return err
+}
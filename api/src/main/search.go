@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultSearchLimit is how many results of each kind the global search
+	// returns unless asked for other, and maxSearchLimit the most.
+	defaultSearchLimit = 5
+	maxSearchLimit     = 25
+)
+
+// searchResults are the results of the global search, a bucket for each kind
+// of thing. Buckets the caller's role may not see are left out.
+type searchResults struct {
+	Query     string      `json:"q"`
+	Cars      []vehicle   `json:"cars"`
+	Customers *[]customer `json:"customers,omitempty"`
+	Orders    *[]order    `json:"orders,omitempty"`
+}
+
+// globalSearch searches cars, customers and orders at once, for the admin
+// UI's search bar. Cars are matched as by /cars/search; customers by name,
+// email or phone and orders by buyer, or either by ID, and orders by VIN
+// too. Customers and orders are only searched for editors, who may see them.
+func globalSearch(a *authenticator, cars vehicleRepository, customers *customerStore, orders *orderStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := strings.TrimSpace(query.Get("q"))
+		if q == "" {
+			errorWithJSON(w, "Parameter \"q\" is required", http.StatusBadRequest)
+			return
+		}
+		limit := defaultSearchLimit
+		if v := query.Get("limit"); v != "" {
+			n, err := parseCount("limit", v, 1, maxSearchLimit)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		results := searchResults{Query: q}
+		var err error
+		if results.Cars, err = searchCarsFor(r.Context(), cars, q, limit); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed search cars", "err", err)
+			return
+		}
+		labelCars(r.Context(), results.Cars)
+
+		if hasRole(r.Context(), a, roleEditor) {
+			text := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+			found := []customer{}
+			err := findLimited(r.Context(), customers.c, bson.M{"$or": bson.A{
+				bson.M{"customerid": q}, bson.M{"name": text}, bson.M{"email": text}, bson.M{"phone": text},
+			}}, bson.D{{Key: "name", Value: 1}, {Key: "customerid", Value: 1}}, limit, &found)
+			if err != nil {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed search customers", "err", err)
+				return
+			}
+			results.Customers = &found
+
+			matched := []order{}
+			err = findLimited(r.Context(), orders.c, bson.M{"$or": bson.A{
+				bson.M{"orderid": q}, bson.M{"vin": strings.ToUpper(q)}, bson.M{"buyer.name": text}, bson.M{"buyer.email": text},
+			}}, bson.D{{Key: "createdat", Value: -1}}, limit, &matched)
+			if err != nil {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed search orders", "err", err)
+				return
+			}
+			results.Orders = &matched
+		}
+
+		respBody, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// searchCarsFor returns the cars best matching q, as /cars/search ranks
+// them.
+func searchCarsFor(ctx context.Context, cars vehicleRepository, q string, limit int) ([]vehicle, error) {
+	params, err := parseListQuery(url.Values{"q": {q}, "limit": {strconv.Itoa(limit)}})
+	if err != nil {
+		return nil, err
+	}
+	params.Projection = bson.M{"score": bson.M{"$meta": "textScore"}}
+	params.Sort = bson.D{
+		{Key: "score", Value: bson.M{"$meta": "textScore"}},
+		{Key: "vin", Value: 1},
+	}
+	found, _, _, err := cars.list(ctx, params)
+	if found == nil {
+		found = []vehicle{}
+	}
+	return found, err
+}
+
+// findLimited decodes into out the first limit documents of the tenant
+// matching filter, in the order of sort.
+func findLimited(ctx context.Context, c *mongo.Collection, filter bson.M, sort bson.D, limit int, out interface{}) error {
+	cur, err := c.Find(ctx, forTenant(ctx, filter), options.Find().SetSort(sort).SetLimit(int64(limit)))
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, out)
+}
+
+// hasRole reports whether the caller of ctx has at least role, as
+// requireRole would let them through.
+func hasRole(ctx context.Context, a *authenticator, role string) bool {
+	if !a.required {
+		return true
+	}
+	p := principalFrom(ctx)
+	return p != nil && roleRank[p.Role] >= roleRank[role]
+}
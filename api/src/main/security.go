@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secureHeaders sets the headers that keep browsers from sniffing a
+// response's type or framing it, and, on responses sent over HTTPS, tells
+// them to use only HTTPS for hstsMaxAge.
+func secureHeaders(hstsMaxAge time.Duration) func(http.Handler) http.Handler {
+	hsts := "max-age=" + strconv.FormatInt(int64(hstsMaxAge.Seconds()), 10) + "; includeSubDomains"
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("X-Frame-Options", "DENY")
+			if hstsMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+				header.Set("Strict-Transport-Security", hsts)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireContentType refuses with 415 the writes whose body is not of a type
+// the API takes: JSON, including types such as application/merge-patch+json,
+// and multipart uploads, and, for the admin UI's sign-in form only, form
+// encoding. A body sent as a form or as text/plain, as a page on another site
+// can have a browser send without asking, is so never read as JSON.
+func requireContentType(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		// A write with no body, such as a restore, has no type to check.
+		if r.ContentLength == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch {
+		case err != nil:
+		case mediaType == "application/json", strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+			h.ServeHTTP(w, r)
+			return
+		case mediaType == "multipart/form-data":
+			h.ServeHTTP(w, r)
+			return
+		case mediaType == "application/x-www-form-urlencoded" && strings.HasPrefix(r.URL.Path, route("/admin/")):
+			h.ServeHTTP(w, r)
+			return
+		}
+		errorWithJSON(w, "The body must be JSON or a multipart/form-data upload", http.StatusUnsupportedMediaType)
+	})
+}
+
+// limitBodies caps request bodies at limit bytes, or at the limit larger
+// gives their route pattern, so that one huge request cannot exhaust
+// memory; a body declared bigger is refused with 413 before it is read.
+// Multipart uploads are the handlers' to limit, as imports are streamed and
+// photos have a limit of their own.
+func limitBodies(limit int64, larger map[string]int64) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			n := limit
+			if l, ok := larger[routePattern(r)]; ok {
+				n = l
+			}
+			if r.ContentLength > n {
+				errorWithJSON(w, fmt.Sprintf("The body must be at most %d bytes", n), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
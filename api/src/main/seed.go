@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxSeedCount is the most cars one seeding adds.
+const maxSeedCount = maxBatchSize
+
+// seedModel is a model in the fixtures, with the price it sells for new in
+// pence and the fuel types it comes with.
+type seedModel struct {
+	name  string
+	price int64
+	fuels []string
+}
+
+// seedManufacturer is a manufacturer in the fixtures, with the world
+// manufacturer identifier its VINs start with. Weight is how common its cars
+// are relative to the others.
+type seedManufacturer struct {
+	name   string
+	wmi    string
+	weight int
+	models []seedModel
+}
+
+// seedFixtures are the cars demo environments are stocked with, weighted
+// roughly as on UK forecourts.
+var seedFixtures = []seedManufacturer{
+	{"Ford", "WF0", 14, []seedModel{
+		{"Fiesta", 1900000, []string{"petrol", "diesel"}},
+		{"Focus", 2400000, []string{"petrol", "diesel", "hybrid"}},
+		{"Kuga", 3200000, []string{"petrol", "diesel", "hybrid"}},
+		{"Puma", 2600000, []string{"petrol", "hybrid"}},
+	}},
+	{"Volkswagen", "WVW", 12, []seedModel{
+		{"Polo", 2000000, []string{"petrol"}},
+		{"Golf", 2800000, []string{"petrol", "diesel", "hybrid"}},
+		{"Tiguan", 3400000, []string{"petrol", "diesel"}},
+		{"ID.3", 3700000, []string{"electric"}},
+	}},
+	{"Vauxhall", "W0L", 10, []seedModel{
+		{"Corsa", 1900000, []string{"petrol", "diesel", "electric"}},
+		{"Astra", 2500000, []string{"petrol", "diesel"}},
+		{"Mokka", 2600000, []string{"petrol", "electric"}},
+	}},
+	{"BMW", "WBA", 8, []seedModel{
+		{"1 Series", 3000000, []string{"petrol", "diesel"}},
+		{"3 Series", 4000000, []string{"petrol", "diesel", "hybrid"}},
+		{"X3", 4800000, []string{"diesel", "hybrid"}},
+	}},
+	{"Toyota", "SB1", 8, []seedModel{
+		{"Yaris", 2100000, []string{"hybrid"}},
+		{"Corolla", 2900000, []string{"hybrid"}},
+		{"RAV4", 3600000, []string{"hybrid"}},
+	}},
+	{"Nissan", "SJN", 7, []seedModel{
+		{"Micra", 1700000, []string{"petrol"}},
+		{"Qashqai", 2900000, []string{"petrol", "diesel", "hybrid"}},
+		{"Leaf", 2900000, []string{"electric"}},
+	}},
+	{"Audi", "WAU", 6, []seedModel{
+		{"A3", 3100000, []string{"petrol", "diesel"}},
+		{"A4", 3900000, []string{"petrol", "diesel"}},
+		{"Q5", 4900000, []string{"diesel", "hybrid"}},
+	}},
+	{"Kia", "KNA", 6, []seedModel{
+		{"Picanto", 1400000, []string{"petrol"}},
+		{"Sportage", 3000000, []string{"petrol", "hybrid"}},
+		{"Niro", 3200000, []string{"hybrid", "electric"}},
+	}},
+	{"Tesla", "5YJ", 3, []seedModel{
+		{"Model 3", 4000000, []string{"electric"}},
+		{"Model Y", 4500000, []string{"electric"}},
+	}},
+	{"Porsche", "WP0", 1, []seedModel{
+		{"911", 9500000, []string{"petrol"}},
+		{"Macan", 6000000, []string{"petrol", "electric"}},
+	}},
+}
+
+var seedColours = []string{"black", "white", "grey", "silver", "blue", "red", "green"}
+
+// The model years seeded cars are from. They are fixed rather than counted
+// back from today, so that a seed gives the same cars whenever it is used.
+const (
+	seedNewestYear = 2024
+	seedOldestYear = 2012
+)
+
+// seedCars generates n cars from the fixtures. The same seed always gives
+// the same cars, VINs included, so seeding again adds nothing new.
+func seedCars(seed int64, n int) []vehicle {
+	rng := rand.New(rand.NewSource(seed))
+	totalWeight := 0
+	for _, m := range seedFixtures {
+		totalWeight += m.weight
+	}
+	serial := rng.Intn(1000000)
+
+	cars := make([]vehicle, n)
+	for i := range cars {
+		pick := rng.Intn(totalWeight)
+		var maker seedManufacturer
+		for _, maker = range seedFixtures {
+			if pick < maker.weight {
+				break
+			}
+			pick -= maker.weight
+		}
+		model := maker.models[rng.Intn(len(maker.models))]
+		year := seedNewestYear - int(math.Min(math.Abs(rng.NormFloat64())*4, seedNewestYear-seedOldestYear))
+		age := seedNewestYear - year
+
+		car := vehicle{
+			Manurfacturer: maker.name,
+			Model:         model.name,
+			VIN:           seedVIN(rng, maker.wmi, year, (serial+i)%1000000),
+			RegNo:         seedRegNo(rng, year),
+			Year:          year,
+			FuelType:      model.fuels[rng.Intn(len(model.fuels))],
+			Transmission:  "manual",
+			Colour:        seedColours[rng.Intn(len(seedColours))],
+			Condition:     "used",
+			Status:        carInStock,
+		}
+		if car.FuelType == "electric" || car.FuelType == "hybrid" || rng.Intn(3) == 0 {
+			car.Transmission = "automatic"
+		}
+		switch {
+		case age == 0:
+			car.Condition = "new"
+		case age <= 3 && rng.Intn(4) == 0:
+			car.Condition = "certified"
+		}
+		if age > 0 {
+			car.Mileage = int(math.Max(0, float64(age)*(8000+rng.NormFloat64()*3000)))
+		}
+		if rng.Intn(10) == 0 {
+			car.Status = carInPrep
+		}
+
+		// Cars lose about 15% of their value a year, give or take how well
+		// they have been looked after; prices are rounded to £50.
+		value := float64(model.price) * math.Pow(0.85, float64(age)) * math.Exp(rng.NormFloat64()*0.08)
+		car.Price = &price{Amount: int64(math.Round(value/5000)) * 5000, Currency: "GBP"}
+
+		cars[i] = car
+	}
+	return cars
+}
+
+// seedVIN makes up a valid VIN for a car of the year from a manufacturer.
+func seedVIN(rng *rand.Rand, wmi string, year, serial int) string {
+	const chars = "ABCDEFGHJKLMNPRSTUVWXYZ0123456789"
+	v := []byte(wmi)
+	for i := 0; i < 5; i++ {
+		v = append(v, chars[rng.Intn(len(chars))])
+	}
+	// A letter in the seventh position puts the model year in the cycle
+	// from 2010.
+	v[6] = chars[rng.Intn(23)]
+	v = append(v, '0', yearCodes[year-2010], chars[rng.Intn(len(chars))])
+	v = append(v, fmt.Sprintf("%06d", serial)...)
+
+	check, err := vin.CheckDigit(string(v))
+	if err != nil {
+		panic(err)
+	}
+	v[8] = check
+	return string(v)
+}
+
+// yearCodes are the model year characters from 2010.
+const yearCodes = "ABCDEFGHJKLMNPRSTVWXY"
+
+// seedRegNo makes up a current style UK registration for a car first
+// registered in the year.
+func seedRegNo(rng *rand.Rand, year int) string {
+	const letters = "ABCDEFGHJKLMNOPRSTUVWXY"
+	l := func() byte { return letters[rng.Intn(len(letters))] }
+	age := year % 100
+	if rng.Intn(2) == 0 {
+		age += 50
+	}
+	return fmt.Sprintf("%c%c%02d %c%c%c", l(), l(), age, l(), l(), l())
+}
+
+// seedIfEmpty stocks an empty inventory with n cars generated from seed, for
+// demo environments.
+func seedIfEmpty(ctx context.Context, c *mongo.Collection, events *broker, audit *auditLog, seed int64, n int) {
+	if n == 0 {
+		return
+	}
+	count, err := c.CountDocuments(ctx, forTenant(ctx, bson.M{}))
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		slog.InfoContext(ctx, "Inventory is not empty; not seeding it", "tenant", tenantFrom(ctx))
+		return
+	}
+	report := insertCars(ctx, c, events, audit, seedCars(seed, n), nil)
+	slog.InfoContext(ctx, "Seeded inventory", "tenant", tenantFrom(ctx), "seed", seed, "created", report.Created, "failed", report.Failed)
+}
+
+// seedInventory adds ?count= cars generated from ?seed= to the caller's
+// tenant. Seeding again with the same seed adds no cars, as the VINs are
+// already there.
+func seedInventory(c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		n, err := parseCount("count", query.Get("count"), 1, maxSeedCount)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var seed int64 = 1
+		if value := query.Get("seed"); value != "" {
+			seed, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errorWithJSON(w, "Parameter \"seed\" must be an integer", http.StatusBadRequest)
+				return
+			}
+		}
+
+		report := insertCars(r.Context(), c, events, audit, seedCars(seed, n), nil)
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// seedRepository is seedIfEmpty for the cars kept outside MongoDB, which
+// are added through the repository one at a time.
+func seedRepository(ctx context.Context, repo vehicleRepository, events *broker, audit *auditLog, seed int64, n int) {
+	if n == 0 {
+		return
+	}
+	count, err := repo.count(ctx, bson.M{})
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		slog.InfoContext(ctx, "Inventory is not empty; not seeding it", "tenant", tenantFrom(ctx))
+		return
+	}
+	created, failed := 0, 0
+	for _, car := range seedCars(seed, n) {
+		if prepareNewCar(ctx, &car) != nil {
+			failed++
+			continue
+		}
+		err := events.transact(ctx, func(ctx context.Context) error {
+			if err := repo.create(ctx, car); err != nil {
+				return err
+			}
+			events.publish(ctx, inventoryEvent{Type: eventCreated, VIN: car.VIN, Car: &car})
+			return nil
+		})
+		if err != nil {
+			failed++
+			continue
+		}
+		created++
+		audit.change(ctx, auditCreated, car.VIN, nil, &car)
+	}
+	slog.InfoContext(ctx, "Seeded inventory", "tenant", tenantFrom(ctx), "seed", seed, "created", created, "failed", failed)
+}
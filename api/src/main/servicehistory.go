@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The kinds of work a service record is for.
+const (
+	workService = "service"
+	workMOT     = "mot"
+	workRepair  = "repair"
+)
+
+var workKinds = map[string]bool{workService: true, workMOT: true, workRepair: true}
+
+// serviceRecord is a service, MOT or repair in a car's history. Records are
+// kept in their own collection, so a long history does not weigh on the car.
+type serviceRecord struct {
+	ID          string    `json:"id" bson:"serviceid"`
+	VIN         string    `json:"vin"`
+	Kind        string    `json:"kind"`
+	Date        time.Time `json:"date"`
+	Mileage     int       `json:"mileage,omitempty" bson:",omitempty"`
+	Description string    `json:"description,omitempty" bson:",omitempty"`
+	Cost        *price    `json:"cost,omitempty" bson:",omitempty"`
+	Garage      string    `json:"garage,omitempty" bson:",omitempty"`
+	CreatedAt   time.Time `json:"created_at" bson:"createdat"`
+	Tenant      string    `json:"-" bson:"tenant"`
+}
+
+// serviceSummary sums up a car's service history in the car itself. It is
+// kept up to date as records are added and removed.
+type serviceSummary struct {
+	ServiceCount    int        `json:"service_count" bson:"servicecount"`
+	LastServiceDate *time.Time `json:"last_service_date,omitempty" bson:"lastservicedate,omitempty"`
+}
+
+func (s *serviceRecord) validate() *fieldError {
+	c := &checks{}
+	c.check(workKinds[s.Kind], "kind", "The kind must be service, mot or repair")
+	if s.Date.IsZero() {
+		c.fail("date", "required", "The date is required")
+	}
+	c.check(!s.Date.After(time.Now()), "date", "The date must not be in the future")
+	c.check(s.Mileage >= 0, "mileage", "The mileage must not be negative")
+	if s.Cost != nil {
+		c.check(s.Cost.Amount >= 0 && len(s.Cost.Currency) == 3, "cost", "The cost must be a non-negative amount in a three-letter currency")
+	}
+	c.maxLength("description", s.Description, 2000)
+	return c.err()
+}
+
+type serviceHistoryStore struct {
+	c *mongo.Collection
+}
+
+func (s *serviceHistoryStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "serviceid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}, {Key: "date", Value: -1}}},
+	})
+	return err
+}
+
+// summary sums up the service history of the car with the VIN. It is nil when
+// the car has no services.
+func (s *serviceHistoryStore) summary(ctx context.Context, vin string) (*serviceSummary, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: forTenant(ctx, bson.M{"vin": vin, "kind": workService})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":             nil,
+			"servicecount":    bson.M{"$sum": 1},
+			"lastservicedate": bson.M{"$max": "$date"},
+		}}},
+	}
+	cur, err := s.c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var sums []serviceSummary
+	if err := cur.All(ctx, &sums); err != nil || len(sums) == 0 {
+		return nil, err
+	}
+	return &sums[0], nil
+}
+
+// forCar returns the service history of the car with the VIN, latest first.
+func (s *serviceHistoryStore) forCar(ctx context.Context, vin string) ([]serviceRecord, error) {
+	records := []serviceRecord{}
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}, {Key: "serviceid", Value: 1}})
+	cur, err := s.c.Find(ctx, forTenant(ctx, bson.M{"vin": vin}), opts)
+	if err == nil {
+		err = cur.All(ctx, &records)
+	}
+	return records, err
+}
+
+// serviceHistory lists the service history of a car, latest first.
+func serviceHistory(s *serviceHistoryStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records, err := s.forCar(r.Context(), carVIN(r))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list service history", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// addServiceRecord records a service, MOT or repair of a car. Services count
+// towards the car's service summary.
+func addServiceRecord(s *serviceHistoryStore, c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var rec serviceRecord
+		if !decodeBody(w, r.Body, &rec) {
+			return
+		}
+		rec.Kind = strings.ToLower(rec.Kind)
+
+		if err := rec.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		n, err := c.CountDocuments(r.Context(), liveCar(r.Context(), vin))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			return
+		}
+		if n == 0 {
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		}
+
+		rec.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		rec.VIN = vin
+		rec.Date = rec.Date.UTC()
+		rec.CreatedAt = time.Now().UTC()
+		rec.Tenant = tenantFrom(r.Context())
+
+		_, err = s.c.InsertOne(r.Context(), rec)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert service record", "err", err)
+			return
+		}
+
+		if rec.Kind == workService {
+			var car vehicle
+			update := bson.M{
+				"$inc": bson.M{"servicehistory.servicecount": 1, "revision": 1},
+				"$max": bson.M{"servicehistory.lastservicedate": rec.Date},
+			}
+			after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			err = events.transact(r.Context(), func(ctx context.Context) error {
+				err := c.FindOneAndUpdate(ctx, liveCar(ctx, vin), update, after).Decode(&car)
+				if err != nil {
+					return err
+				}
+				events.publish(ctx, inventoryEvent{Type: eventUpdated, VIN: vin, Car: &car})
+				return nil
+			})
+			if err != nil && err != mongo.ErrNoDocuments {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed update service summary", "err", err)
+				return
+			}
+		}
+		entry := audit.entry(r.Context(), auditServiceAdded, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "service_history", New: rec}}
+		audit.record(r.Context(), entry)
+
+		respBody, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/cars/"+vin+"/service-history/"+rec.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func serviceRecordByID(s *serviceHistoryStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rec serviceRecord
+		filter := forTenant(r.Context(), bson.M{"vin": carVIN(r), "serviceid": pat.Param(r, "id")})
+		err := s.c.FindOne(r.Context(), filter).Decode(&rec)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find service record", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Service record not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// deleteServiceRecord removes a record entered in error. The car's service
+// summary is worked out again from the records left.
+func deleteServiceRecord(s *serviceHistoryStore, c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var rec serviceRecord
+		filter := forTenant(r.Context(), bson.M{"vin": vin, "serviceid": pat.Param(r, "id")})
+		err := s.c.FindOneAndDelete(r.Context(), filter).Decode(&rec)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed delete service record", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Service record not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		if rec.Kind == workService {
+			sum, err := s.summary(r.Context(), vin)
+			if err != nil {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed sum up service history", "err", err)
+				return
+			}
+			update := bson.M{"$inc": incRevision}
+			if sum == nil {
+				update["$unset"] = bson.M{"servicehistory": ""}
+			} else {
+				update["$set"] = bson.M{"servicehistory": sum}
+			}
+
+			var car vehicle
+			after := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			err = events.transact(r.Context(), func(ctx context.Context) error {
+				err := c.FindOneAndUpdate(ctx, liveCar(ctx, vin), update, after).Decode(&car)
+				if err != nil {
+					return err
+				}
+				events.publish(ctx, inventoryEvent{Type: eventUpdated, VIN: vin, Car: &car})
+				return nil
+			})
+			if err != nil && err != mongo.ErrNoDocuments {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed update service summary", "err", err)
+				return
+			}
+		}
+		entry := audit.entry(r.Context(), auditServiceRemoved, vin, nil, nil)
+		entry.Changes = []fieldChange{{Field: "service_history", Old: rec}}
+		audit.record(r.Context(), entry)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
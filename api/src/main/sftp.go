@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpStore writes files to an SFTP server, as accounting packages and
+// finance teams often collect them from. Only what is needed to write files
+// of SFTP version 3 is spoken; a connection is made for each file.
+type sftpStore struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+}
+
+// newSFTPStore returns the store of the server at addr, which must present
+// hostKey, in authorized_keys format. The user signs in with the PEM private
+// key in keyFile or, without one, with password.
+func newSFTPStore(addr, user, password, keyFile, hostKey, dir string) (*sftpStore, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("SFTP host key: %w", err)
+	}
+	auth := ssh.Password(password)
+	if keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("SFTP key file: %w", err)
+		}
+		auth = ssh.PublicKeys(signer)
+	}
+	return &sftpStore{addr: addr, dir: dir, config: &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.FixedHostKey(pub),
+		Timeout:         10 * time.Second,
+	}}, nil
+}
+
+// The SFTP packets and flags used.
+const (
+	sshFxpInit    = 1
+	sshFxpVersion = 2
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpWrite   = 6
+	sshFxpRemove  = 13
+	sshFxpMkdir   = 14
+	sshFxpRename  = 18
+	sshFxpStatus  = 101
+	sshFxpHandle  = 102
+
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFxOK = 0
+
+	// sftpChunk is how much of a file is sent in a write; servers need
+	// only accept 32KB.
+	sftpChunk = 32 << 10
+)
+
+// put writes r to key under the store's directory, making the directories
+// it is in. The file is written under another name and renamed, so that it
+// is never collected half written.
+func (s *sftpStore) put(ctx context.Context, key string, r io.Reader, size int64, sum []byte) error {
+	dialer := &net.Dialer{Timeout: s.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	in, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+
+	f := &sftpConn{w: in, r: out}
+	if err := f.init(); err != nil {
+		return err
+	}
+	name := path.Join(s.dir, key)
+	dirs := strings.Split(path.Dir(name), "/")
+	for i := range dirs {
+		if dir := strings.Join(dirs[:i+1], "/"); dir != "" && dir != "." {
+			// The directory may be there already, so failure is no error.
+			f.call(sshFxpMkdir, func(p *sftpPacket) { p.string(dir).uint32(0) })
+		}
+	}
+
+	tmp := name + ".part"
+	handle, err := f.open(tmp)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunk)
+	var offset uint64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := f.status(sshFxpWrite, func(p *sftpPacket) { p.string(handle).uint64(offset).string(string(buf[:n])) }); err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if err := f.status(sshFxpClose, func(p *sftpPacket) { p.string(handle) }); err != nil {
+		return err
+	}
+	// Version 3 renames onto no existing file, so the last is removed
+	// first; there may be none.
+	f.call(sshFxpRemove, func(p *sftpPacket) { p.string(name) })
+	return f.status(sshFxpRename, func(p *sftpPacket) { p.string(tmp).string(name) })
+}
+
+// sftpConn speaks SFTP over a session's subsystem, a request at a time.
+type sftpConn struct {
+	w  io.Writer
+	r  io.Reader
+	id uint32
+}
+
+// sftpPacket builds the payload of a packet.
+type sftpPacket struct {
+	b []byte
+}
+
+func (p *sftpPacket) uint32(n uint32) *sftpPacket {
+	p.b = binary.BigEndian.AppendUint32(p.b, n)
+	return p
+}
+
+func (p *sftpPacket) uint64(n uint64) *sftpPacket {
+	p.b = binary.BigEndian.AppendUint64(p.b, n)
+	return p
+}
+
+func (p *sftpPacket) string(s string) *sftpPacket {
+	p.uint32(uint32(len(s)))
+	p.b = append(p.b, s...)
+	return p
+}
+
+func (f *sftpConn) send(kind byte, payload []byte) error {
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	_, err := f.w.Write(append(append(header, kind), payload...))
+	return err
+}
+
+func (f *sftpConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, errors.New("sftp: bad packet length")
+	}
+	body := make([]byte, n-1)
+	_, err := io.ReadFull(f.r, body)
+	return header[4], body, err
+}
+
+func (f *sftpConn) init() error {
+	if err := f.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+	kind, _, err := f.receive()
+	if err == nil && kind != sshFxpVersion {
+		err = fmt.Errorf("sftp: unexpected packet %d", kind)
+	}
+	return err
+}
+
+// call sends a request with the next ID, then the rest of its payload, and
+// returns the type and payload of the reply, after its ID.
+func (f *sftpConn) call(kind byte, build func(p *sftpPacket)) (byte, []byte, error) {
+	f.id++
+	p := (&sftpPacket{}).uint32(f.id)
+	build(p)
+	if err := f.send(kind, p.b); err != nil {
+		return 0, nil, err
+	}
+	reply, body, err := f.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(body) < 4 || binary.BigEndian.Uint32(body) != f.id {
+		return 0, nil, errors.New("sftp: reply to another request")
+	}
+	return reply, body[4:], nil
+}
+
+// status makes a request answered by a status, failing unless it is OK.
+func (f *sftpConn) status(kind byte, build func(p *sftpPacket)) error {
+	reply, body, err := f.call(kind, build)
+	if err != nil {
+		return err
+	}
+	return statusError(reply, body)
+}
+
+func statusError(reply byte, body []byte) error {
+	if reply != sshFxpStatus || len(body) < 4 {
+		return fmt.Errorf("sftp: unexpected packet %d", reply)
+	}
+	if code := binary.BigEndian.Uint32(body); code != sshFxOK {
+		msg := ""
+		if len(body) >= 8 {
+			if n := binary.BigEndian.Uint32(body[4:]); int(n) <= len(body)-8 {
+				msg = string(body[8 : 8+n])
+			}
+		}
+		return fmt.Errorf("sftp: status %d: %s", code, msg)
+	}
+	return nil
+}
+
+// open opens name for writing, made anew, and returns its handle.
+func (f *sftpConn) open(name string) (string, error) {
+	reply, body, err := f.call(sshFxpOpen, func(p *sftpPacket) {
+		p.string(name).uint32(sshFxfWrite | sshFxfCreat | sshFxfTrunc).uint32(0)
+	})
+	if err != nil {
+		return "", err
+	}
+	if reply != sshFxpHandle {
+		return "", statusError(reply, body)
+	}
+	if len(body) < 4 || int(binary.BigEndian.Uint32(body)) > len(body)-4 {
+		return "", errors.New("sftp: bad handle")
+	}
+	return string(body[4 : 4+binary.BigEndian.Uint32(body)]), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// shadowTimeout bounds each read of the shadow storage, which the
+	// request does not wait for.
+	shadowTimeout = 5 * time.Second
+	// shadowConcurrency is how many shadow reads may be in flight at once;
+	// beyond it reads are not shadowed rather than queued.
+	shadowConcurrency = 8
+	// maxShadowDiffs is the most differing fields logged of a divergence.
+	maxShadowDiffs = 10
+)
+
+// The outcomes of comparing an operation on the shadow storage with the
+// primary's.
+const (
+	shadowMatched  = "matched"
+	shadowDiverged = "diverged"
+	shadowFailed   = "error"
+	shadowSkipped  = "skipped"
+)
+
+var shadowOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "carsupermarket_shadow_operations_total",
+	Help: "Car storage operations repeated on the shadow storage by operation, route flag and outcome.",
+}, []string{"op", "flag", "outcome"})
+
+func init() {
+	prometheus.MustRegister(shadowOps)
+}
+
+type shadowKey struct{}
+
+// shadowed has the car storage operations of h shadowed when flag is on for
+// the tenant: reads compared with the shadow storage's, or, for
+// flagShadowWrites, writes made to the shadow storage too.
+func shadowed(flags *featureFlags, flag string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if flags.enabled(r.Context(), flag) {
+			r = r.WithContext(context.WithValue(r.Context(), shadowKey{}, flag))
+		}
+		h(w, r)
+	}
+}
+
+// shadowFlag returns the flag the operations of ctx are shadowed under, or
+// "" if they are not.
+func shadowFlag(ctx context.Context) string {
+	flag, _ := ctx.Value(shadowKey{}).(string)
+	return flag
+}
+
+// shadowVehicles serves the cars from primary while a migration to, or from,
+// shadow is tried out. On the routes whose flag is on, reads are repeated on
+// shadow once answered and the answers compared, and on those of
+// flagShadowWrites the writes primary makes are made to shadow too, once
+// made and, in a transaction of transact, once it commits, so that it keeps
+// up. What shadow answers or fails with never reaches
+// the client: divergences are counted, and a sample of them logged. Writes
+// made around the repository, by imports and batches, are not shadowed, and
+// leave shadow behind until it is copied again.
+type shadowVehicles struct {
+	primary vehicleRepository
+	shadow  vehicleRepository
+	// sample is the fraction of divergences logged.
+	sample float64
+	slots  chan struct{}
+}
+
+func newShadowVehicles(primary, shadow vehicleRepository, sample float64) *shadowVehicles {
+	return &shadowVehicles{primary: primary, shadow: shadow, sample: sample, slots: make(chan struct{}, shadowConcurrency)}
+}
+
+func (s *shadowVehicles) get(ctx context.Context, vin string, projection bson.M) (vehicle, error) {
+	car, err := s.primary.get(ctx, vin, projection)
+	s.read(ctx, "get", func(ctx context.Context) {
+		other, serr := s.shadow.get(ctx, vin, projection)
+		if s.compareErrors(ctx, "get", err, serr, "vin", vin) {
+			s.compareCars(ctx, "get", []vehicle{car}, []vehicle{other}, "vin", vin)
+		}
+	})
+	return car, err
+}
+
+func (s *shadowVehicles) list(ctx context.Context, params ListParams) ([]vehicle, int64, string, error) {
+	cars, total, cursor, err := s.primary.list(ctx, params)
+	// The handler goes on to change the cars it is given, as it labels and
+	// prices them, so the page is compared as it was.
+	page := append([]vehicle(nil), cars...)
+	s.read(ctx, "list", func(ctx context.Context) {
+		others, stotal, _, serr := s.shadow.list(ctx, params)
+		if !s.compareErrors(ctx, "list", err, serr) {
+			return
+		}
+		if total != stotal {
+			s.diverged(ctx, "list", "total", total, "shadow_total", stotal)
+			return
+		}
+		// Cursors are the storage's own, so only the pages are compared.
+		s.compareCars(ctx, "list", page, others)
+	})
+	return cars, total, cursor, err
+}
+
+// each is not shadowed: it streams as many cars as match, which the shadow
+// would be read for all over again.
+func (s *shadowVehicles) each(ctx context.Context, params ListParams, fn func(vehicle) error) error {
+	return s.primary.each(ctx, params, fn)
+}
+
+func (s *shadowVehicles) facets(ctx context.Context, filter bson.M) (*carFacets, error) {
+	return s.primary.facets(ctx, filter)
+}
+
+func (s *shadowVehicles) count(ctx context.Context, filter bson.M) (int64, error) {
+	n, err := s.primary.count(ctx, filter)
+	s.read(ctx, "count", func(ctx context.Context) {
+		sn, serr := s.shadow.count(ctx, filter)
+		if s.compareErrors(ctx, "count", err, serr) && n != sn {
+			s.diverged(ctx, "count", "count", n, "shadow_count", sn)
+		}
+	})
+	return n, err
+}
+
+func (s *shadowVehicles) create(ctx context.Context, car vehicle) error {
+	err := s.primary.create(ctx, car)
+	if err == nil && shadowFlag(ctx) == flagShadowWrites {
+		afterCommit(ctx, func() {
+			if s.compareErrors(ctx, "create", nil, s.shadow.create(ctx, car), "vin", car.VIN) {
+				s.matched(ctx, "create")
+			}
+		})
+	}
+	return err
+}
+
+func (s *shadowVehicles) replace(ctx context.Context, car *vehicle, rev int64) (vehicle, error) {
+	same := *car
+	was, err := s.primary.replace(ctx, car, rev)
+	if err == nil && shadowFlag(ctx) == flagShadowWrites {
+		afterCommit(ctx, func() {
+			other, serr := s.shadow.replace(ctx, &same, rev)
+			s.compareWrite(ctx, "replace", was, other, serr)
+		})
+	}
+	return was, err
+}
+
+func (s *shadowVehicles) update(ctx context.Context, vin string, rev int64, set, unset bson.M) (vehicle, error) {
+	was, err := s.primary.update(ctx, vin, rev, set, unset)
+	if err == nil && shadowFlag(ctx) == flagShadowWrites {
+		afterCommit(ctx, func() {
+			other, serr := s.shadow.update(ctx, vin, rev, set, unset)
+			s.compareWrite(ctx, "update", was, other, serr)
+		})
+	}
+	return was, err
+}
+
+func (s *shadowVehicles) delete(ctx context.Context, vin string, rev int64) (vehicle, error) {
+	was, err := s.primary.delete(ctx, vin, rev)
+	if err == nil && shadowFlag(ctx) == flagShadowWrites {
+		afterCommit(ctx, func() {
+			other, serr := s.shadow.delete(ctx, vin, rev)
+			s.compareWrite(ctx, "delete", was, other, serr)
+		})
+	}
+	return was, err
+}
+
+// read runs compare on the shadow storage in the background, if the reads
+// of ctx are shadowed, once the primary has answered. It outlives the
+// request, for as long as shadowTimeout.
+func (s *shadowVehicles) read(ctx context.Context, op string, compare func(ctx context.Context)) {
+	flag := shadowFlag(ctx)
+	if flag == "" || flag == flagShadowWrites {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		shadowOps.WithLabelValues(op, flag, shadowSkipped).Inc()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	go func() {
+		defer func() { <-s.slots }()
+		defer cancel()
+		compare(ctx)
+	}()
+}
+
+// compareWrite compares the car as the shadow storage had it before a write
+// with the primary's.
+func (s *shadowVehicles) compareWrite(ctx context.Context, op string, was, other vehicle, err error) {
+	if s.compareErrors(ctx, op, nil, err, "vin", was.VIN) {
+		s.compareCars(ctx, op, []vehicle{was}, []vehicle{other}, "vin", was.VIN)
+	}
+}
+
+// compareErrors records a divergence unless the shadow storage failed as
+// the primary did, and reports whether both succeeded, so that there are
+// results to compare.
+func (s *shadowVehicles) compareErrors(ctx context.Context, op string, err, serr error, args ...interface{}) bool {
+	switch {
+	case err == nil && serr == nil:
+		return true
+	case errors.Is(serr, err) || (err != nil && serr != nil && err.Error() == serr.Error()):
+		s.matched(ctx, op)
+	case err == nil:
+		shadowOps.WithLabelValues(op, shadowFlag(ctx), shadowFailed).Inc()
+		s.log(ctx, "Shadow storage failed", op, append(args, "err", serr)...)
+	default:
+		s.diverged(ctx, op, append(args, "err", err, "shadow_err", serr)...)
+	}
+	return false
+}
+
+// compareCars records whether the shadow storage's cars are the primary's,
+// in the same order, logging the fields of the first that differs.
+func (s *shadowVehicles) compareCars(ctx context.Context, op string, cars, others []vehicle, args ...interface{}) {
+	if len(cars) != len(others) {
+		s.diverged(ctx, op, append(args, "cars", len(cars), "shadow_cars", len(others))...)
+		return
+	}
+	for i := range cars {
+		if cars[i].VIN != others[i].VIN {
+			s.diverged(ctx, op, append(args, "at", i, "vin", cars[i].VIN, "shadow_vin", others[i].VIN)...)
+			return
+		}
+		if diff := changes(&cars[i], &others[i]); len(diff) > 0 {
+			if len(diff) > maxShadowDiffs {
+				diff = diff[:maxShadowDiffs]
+			}
+			s.diverged(ctx, op, append(args, "vin", cars[i].VIN, "diff", diff)...)
+			return
+		}
+	}
+	s.matched(ctx, op)
+}
+
+func (s *shadowVehicles) matched(ctx context.Context, op string) {
+	shadowOps.WithLabelValues(op, shadowFlag(ctx), shadowMatched).Inc()
+}
+
+func (s *shadowVehicles) diverged(ctx context.Context, op string, args ...interface{}) {
+	shadowOps.WithLabelValues(op, shadowFlag(ctx), shadowDiverged).Inc()
+	s.log(ctx, "Shadow storage diverged", op, args...)
+}
+
+// log logs the sample of divergences.
+func (s *shadowVehicles) log(ctx context.Context, msg, op string, args ...interface{}) {
+	if rand.Float64() >= s.sample {
+		return
+	}
+	slog.WarnContext(ctx, msg, append([]interface{}{"op", op, "flag", shadowFlag(ctx)}, args...)...)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// signatureHeader carries the signature of a request signed with an API
+// key, in place of the key, as
+//
+//	key=<key ID>,t=<unix time>,nonce=<nonce>,v1=<hex HMAC-SHA256>
+//
+// The HMAC is keyed with the hex SHA-256 of the key's secret, which is what
+// the server keeps of it, and is of the time, the nonce, the method and
+// request URI, and the hex SHA-256 of the body, each followed by a newline
+// but the last. A signed request cannot be replayed: it is only accepted
+// within the skew of its time, and its nonce only once.
+const signatureHeader = "X-API-Signature"
+
+// nonce is what a nonce must be: 16 to 128 URL-safe characters.
+var nonce = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+var (
+	errBadSignature = errors.New("invalid request signature")
+	errStale        = errors.New("request signature outside the allowed clock skew")
+	errReplayed     = errors.New("request nonce already used")
+	errMustSign     = errors.New("API key only accepted on signed requests")
+)
+
+// nonceStore keeps the nonces of signed requests until they would be too old
+// to be accepted anyway.
+type nonceStore struct {
+	c *mongo.Collection
+	// skew is how far the time of a request may be from the server's.
+	skew time.Duration
+}
+
+func (s *nonceStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "keyid", Value: 1}, {Key: "nonce", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// A nonce is kept for as long as a request with it could be
+			// on time, either side of the server's clock.
+			Keys:    bson.D{{Key: "at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32((2 * s.skew).Seconds())),
+		},
+	})
+	return err
+}
+
+// use records a nonce of a key as used, failing with errReplayed if it was.
+func (s *nonceStore) use(ctx context.Context, keyID, n string, at time.Time) error {
+	_, err := s.c.InsertOne(ctx, bson.M{"keyid": keyID, "nonce": n, "at": at})
+	if mongo.IsDuplicateKeyError(err) {
+		return errReplayed
+	}
+	return err
+}
+
+// requestSignature is the parsed signature header of a request.
+type requestSignature struct {
+	keyID string
+	at    time.Time
+	nonce string
+	mac   []byte
+}
+
+func parseSignature(header string) (requestSignature, error) {
+	var sig requestSignature
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "key":
+			sig.keyID = value
+		case "t":
+			unix, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return sig, errBadSignature
+			}
+			sig.at = time.Unix(unix, 0)
+		case "nonce":
+			sig.nonce = value
+		case "v1":
+			mac, err := hex.DecodeString(value)
+			if err != nil {
+				return sig, errBadSignature
+			}
+			sig.mac = mac
+		}
+	}
+	if sig.keyID == "" || sig.at.IsZero() || !nonce.MatchString(sig.nonce) || sig.mac == nil {
+		return sig, errBadSignature
+	}
+	return sig, nil
+}
+
+// signRequest returns the MAC of a request, keyed with the hash of an API
+// key's secret.
+func signRequest(secretHash string, at time.Time, n, method, uri string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secretHash))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", at.Unix(), n, method, uri, hex.EncodeToString(sum[:]))
+	return mac.Sum(nil)
+}
+
+// verifySigned returns the key that signed r. The body is read to check it
+// and put back for the handler.
+func (a *authenticator) verifySigned(r *http.Request, header string) (*apiKey, error) {
+	if a.nonces == nil {
+		return nil, errBadSignature
+	}
+	sig, err := parseSignature(header)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if d := now.Sub(sig.at); d > a.nonces.skew || d < -a.nonces.skew {
+		return nil, errStale
+	}
+
+	key, err := a.keys.byID(r.Context(), sig.keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	want := signRequest(key.SecretHash, sig.at, sig.nonce, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal(sig.mac, want) {
+		return nil, errBadSignature
+	}
+	// The nonce is only spent once the signature is known to be the key's,
+	// so that others cannot use up a key's nonces.
+	if err := a.nonces.use(r.Context(), key.ID, sig.nonce, now.UTC()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultSimilarLimit = 6
+	maxSimilarLimit     = 20
+	// minMileageSpread is the mileage difference, at the least, that makes
+	// two cars score nothing for mileage, so the lowest mileages do not
+	// have to match exactly.
+	minMileageSpread = 10000
+)
+
+// similarCar is a car on sale like another, with how alike they are: the
+// sum of the weights of the manufacturer, model, price and mileage, each
+// scaled by how close the car comes to the other's. The car is a named
+// field, as the driver skips unexported embedded ones, and is written out
+// flat by MarshalJSON.
+type similarCar struct {
+	Vehicle vehicle `bson:",inline"`
+	Score   float64 `json:"score" bson:"score"`
+}
+
+func (s similarCar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		vehicle
+		Score float64 `json:"score"`
+	}{s.Vehicle, s.Score})
+}
+
+// closeness is the expression for how near field of a car is to value, from
+// 1 when equal down to 0 at spread apart or more.
+func closeness(field string, value, spread float64) bson.M {
+	return bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{1, bson.M{"$divide": bson.A{
+		bson.M{"$abs": bson.M{"$subtract": bson.A{field, value}}}, spread,
+	}}}}}}
+}
+
+// similarityScore is the expression scoring the cars like car with weights.
+func similarityScore(car vehicle, weights map[string]float64) bson.A {
+	sameMake := bson.M{"$eq": bson.A{"$manufacturer", car.Manurfacturer}}
+	score := bson.A{
+		bson.M{"$cond": bson.A{sameMake, weights["manufacturer"], 0}},
+		bson.M{"$cond": bson.A{bson.M{"$and": bson.A{sameMake, bson.M{"$eq": bson.A{"$model", car.Model}}}}, weights["model"], 0}},
+	}
+	if car.Price != nil && car.Price.Amount > 0 {
+		score = append(score, bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$price.currency", car.Price.Currency}},
+			bson.M{"$multiply": bson.A{weights["price"], closeness("$price.amount", float64(car.Price.Amount), float64(car.Price.Amount))}},
+			0,
+		}})
+	}
+	if car.Mileage > 0 {
+		score = append(score, bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$mileage", 0}},
+			bson.M{"$multiply": bson.A{weights["mileage"], closeness("$mileage", float64(car.Mileage), float64(max(car.Mileage, minMileageSpread)))}},
+			0,
+		}})
+	}
+	return score
+}
+
+// similarCars lists the cars on sale most like the car with the VIN, for a
+// "you may also like" rail, scoring them in one query with the configured
+// weights. ?limit= caps how many are listed.
+func similarCars(c *mongo.Collection, weights map[string]float64) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultSimilarLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			if limit, err = parseCount("limit", v, 1, maxSimilarLimit); err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+			}
+			return
+		}
+
+		match := bson.M{"vin": bson.M{"$ne": car.VIN}}
+		for k, v := range onSale {
+			match[k] = v
+		}
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: forTenant(r.Context(), match)}},
+			{{Key: "$addFields", Value: bson.M{"score": bson.M{"$add": similarityScore(car, weights)}}}},
+			{{Key: "$match", Value: bson.M{"score": bson.M{"$gt": 0}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "vin", Value: 1}}}},
+			{{Key: "$limit", Value: limit}},
+		}
+		similar := []similarCar{}
+		cur, err := c.Aggregate(r.Context(), pipeline)
+		if err == nil {
+			err = cur.All(r.Context(), &similar)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find similar cars", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(similar, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSimilarCarDecode(t *testing.T) {
+	// What the similarity pipeline yields: a stored car with its score added.
+	b, err := bson.Marshal(bson.M{
+		"manufacturer": "Ford",
+		"model":        "Focus",
+		"vin":          "WF0AXXGCDA1234567",
+		"mileage":      42000,
+		"price":        bson.M{"amount": 899500, "currency": "GBP"},
+		"score":        2.75,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var car similarCar
+	if err := bson.Unmarshal(b, &car); err != nil {
+		t.Fatal(err)
+	}
+	if car.Score != 2.75 {
+		t.Errorf("score = %v, want 2.75", car.Score)
+	}
+	if car.Vehicle.Manurfacturer != "Ford" || car.Vehicle.Model != "Focus" || car.Vehicle.VIN != "WF0AXXGCDA1234567" || car.Vehicle.Mileage != 42000 {
+		t.Errorf("car decoded as %+v", car.Vehicle)
+	}
+	if car.Vehicle.Price == nil || car.Vehicle.Price.Amount != 899500 {
+		t.Errorf("price decoded as %+v", car.Vehicle.Price)
+	}
+
+	out, err := json.Marshal(car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["vin"] != "WF0AXXGCDA1234567" || fields["score"] != 2.75 {
+		t.Errorf("similar car written as %s", out)
+	}
+}
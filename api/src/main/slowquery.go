@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"goji.io/middleware"
+)
+
+// maxSlowQueries is how many of the slowest operations an instance keeps to
+// list.
+const maxSlowQueries = 100
+
+var repositoryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "carsupermarket_repository_operation_duration_seconds",
+	Help:    "Car repository operation latency by operation and outcome.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"op", "outcome"})
+
+func init() {
+	prometheus.MustRegister(repositoryDuration)
+}
+
+// slowQuery is an operation of the car repository that took at least the
+// threshold. Filter is the filter it was given with every value replaced by
+// "?", so that only its shape is logged and listed, not what was searched
+// for.
+type slowQuery struct {
+	Op         string      `json:"op"`
+	Filter     interface{} `json:"filter,omitempty"`
+	Sort       []string    `json:"sort,omitempty"`
+	DurationMS float64     `json:"duration_ms"`
+	Route      string      `json:"route,omitempty"`
+	Tenant     string      `json:"tenant,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	At         time.Time   `json:"at"`
+}
+
+// timedVehicles times every operation of the repository it wraps, logging
+// those taking threshold or longer and keeping the slowest of them, as
+// /admin/slow-queries lists. A zero threshold logs none.
+type timedVehicles struct {
+	next      vehicleRepository
+	threshold time.Duration
+
+	mu      sync.Mutex
+	slowest []slowQuery
+}
+
+func (t *timedVehicles) get(ctx context.Context, vin string, projection bson.M) (car vehicle, err error) {
+	defer t.time(ctx, "get", bson.M{"vin": vin}, nil, time.Now(), &err)
+	return t.next.get(ctx, vin, projection)
+}
+
+func (t *timedVehicles) list(ctx context.Context, params ListParams) (cars []vehicle, total int64, cursor string, err error) {
+	defer t.time(ctx, "list", listShape(params), params.Sort, time.Now(), &err)
+	return t.next.list(ctx, params)
+}
+
+func (t *timedVehicles) each(ctx context.Context, params ListParams, fn func(vehicle) error) (err error) {
+	defer t.time(ctx, "each", listShape(params), params.Sort, time.Now(), &err)
+	return t.next.each(ctx, params, fn)
+}
+
+func (t *timedVehicles) facets(ctx context.Context, filter bson.M) (facets *carFacets, err error) {
+	defer t.time(ctx, "facets", filter, nil, time.Now(), &err)
+	return t.next.facets(ctx, filter)
+}
+
+func (t *timedVehicles) count(ctx context.Context, filter bson.M) (n int64, err error) {
+	defer t.time(ctx, "count", filter, nil, time.Now(), &err)
+	return t.next.count(ctx, filter)
+}
+
+func (t *timedVehicles) create(ctx context.Context, car vehicle) (err error) {
+	defer t.time(ctx, "create", bson.M{"vin": car.VIN}, nil, time.Now(), &err)
+	return t.next.create(ctx, car)
+}
+
+func (t *timedVehicles) replace(ctx context.Context, car *vehicle, rev int64) (was vehicle, err error) {
+	defer t.time(ctx, "replace", bson.M{"vin": car.VIN, "revision": rev}, nil, time.Now(), &err)
+	return t.next.replace(ctx, car, rev)
+}
+
+func (t *timedVehicles) update(ctx context.Context, vin string, rev int64, set, unset bson.M) (was vehicle, err error) {
+	defer t.time(ctx, "update", bson.M{"vin": vin, "revision": rev, "$set": set, "$unset": unset}, nil, time.Now(), &err)
+	return t.next.update(ctx, vin, rev, set, unset)
+}
+
+func (t *timedVehicles) delete(ctx context.Context, vin string, rev int64) (was vehicle, err error) {
+	defer t.time(ctx, "delete", bson.M{"vin": vin, "revision": rev}, nil, time.Now(), &err)
+	return t.next.delete(ctx, vin, rev)
+}
+
+// listShape is what a listing filters by: the filter of params, and its
+// search.
+func listShape(params ListParams) bson.M {
+	if params.Text == "" {
+		return params.Filter
+	}
+	shape := bson.M{"$text": params.Text}
+	for k, v := range params.Filter {
+		shape[k] = v
+	}
+	return shape
+}
+
+// time records an operation started at start, once it returns with the error
+// at errp, if it has one. The keys of order are kept of a slow one, as they
+// say nothing of what was asked for but much of why it was slow.
+func (t *timedVehicles) time(ctx context.Context, op string, filter bson.M, order bson.D, start time.Time, errp *error) {
+	d := time.Since(start)
+	outcome := "success"
+	var err error
+	if *errp != nil {
+		err = *errp
+		outcome = "failure"
+	}
+	repositoryDuration.WithLabelValues(op, outcome).Observe(d.Seconds())
+	if t.threshold == 0 || d < t.threshold {
+		return
+	}
+
+	q := slowQuery{
+		Op:         op,
+		Filter:     redactFilter(filter),
+		DurationMS: float64(d.Microseconds()) / 1000,
+		Tenant:     tenantFrom(ctx),
+		At:         start.UTC(),
+	}
+	for _, e := range order {
+		q.Sort = append(q.Sort, e.Key)
+	}
+	if p, ok := middleware.Pattern(ctx).(fmt.Stringer); ok {
+		q.Route = p.String()
+	}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	slog.WarnContext(ctx, "Slow database operation", "op", op, "duration", d, "filter", q.Filter, "route", q.Route)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := sort.Search(len(t.slowest), func(i int) bool { return t.slowest[i].DurationMS < q.DurationMS })
+	if i >= maxSlowQueries {
+		return
+	}
+	t.slowest = append(t.slowest, slowQuery{})
+	copy(t.slowest[i+1:], t.slowest[i:])
+	t.slowest[i] = q
+	if len(t.slowest) > maxSlowQueries {
+		t.slowest = t.slowest[:maxSlowQueries]
+	}
+}
+
+// redactFilter returns filter with its keys, which are field names and
+// operators, and every value replaced by "?".
+func redactFilter(filter interface{}) interface{} {
+	switch v := filter.(type) {
+	case nil:
+		return nil
+	case bson.M:
+		return redactMap(v)
+	case map[string]interface{}:
+		return redactMap(v)
+	case bson.D:
+		out := bson.M{}
+		for _, e := range v {
+			out[e.Key] = redactFilter(e.Value)
+		}
+		return out
+	case bson.A:
+		return redactSlice(v)
+	case []interface{}:
+		return redactSlice(v)
+	}
+	return "?"
+}
+
+func redactMap(m map[string]interface{}) bson.M {
+	out := bson.M{}
+	for k, v := range m {
+		out[k] = redactFilter(v)
+	}
+	return out
+}
+
+func redactSlice(a []interface{}) bson.A {
+	out := bson.A{}
+	for _, v := range a {
+		out = append(out, redactFilter(v))
+	}
+	return out
+}
+
+// slowQueries lists the slowest car repository operations of the instance
+// since it started, slowest first.
+func slowQueries(t *timedVehicles) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := maxSlowQueries
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := parseCount("limit", v, 1, maxSlowQueries)
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		t.mu.Lock()
+		listed := append([]slowQuery{}, t.slowest...)
+		t.mu.Unlock()
+		if len(listed) > limit {
+			listed = listed[:limit]
+		}
+
+		respBody, err := json.MarshalIndent(struct {
+			ThresholdMS float64     `json:"threshold_ms"`
+			Queries     []slowQuery `json:"queries"`
+		}{float64(t.threshold.Microseconds()) / 1000, listed}, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
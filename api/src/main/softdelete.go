@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deleting a car only marks it deleted, so a mistaken delete can be undone.
+// Deleted cars are hidden from every endpoint except listings asked to
+// ?include_deleted=true by an admin.
+
+// liveCar returns the filter selecting the tenant's car with the VIN unless
+// it has been deleted.
+func liveCar(ctx context.Context, vin string) bson.M {
+	return forTenant(ctx, bson.M{"vin": vin, "deletedat": bson.M{"$exists": false}})
+}
+
+// deletedForAdmins only lets admins list deleted cars.
+func deletedForAdmins(a *authenticator, h http.HandlerFunc) http.HandlerFunc {
+	admin := requireRole(a, roleAdmin, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("include_deleted") == "true" {
+			admin(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// softDelete marks the car with the VIN deleted, if it is at revision rev, and
+// returns it.
+func softDelete(ctx context.Context, c *mongo.Collection, vin string, rev int64) (vehicle, error) {
+	var car vehicle
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := bson.M{"$set": bson.M{"deletedat": time.Now().UTC()}, "$inc": incRevision}
+	err := c.FindOneAndUpdate(ctx, atRevision(ctx, vin, rev), update, opts).Decode(&car)
+	return car, err
+}
+
+func deleteCar(cars vehicleRepository, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		rev, ok := expectedRevision(w, r, cars, vin, 0)
+		if !ok {
+			return
+		}
+
+		var car vehicle
+		err := events.transact(r.Context(), func(ctx context.Context) error {
+			var err error
+			if car, err = cars.delete(ctx, vin, rev); err != nil {
+				return err
+			}
+			events.publish(ctx, inventoryEvent{Type: eventDeleted, VIN: vin, Car: &car})
+			return nil
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed delete car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				missingOrConflict(w, r, cars, vin, rev)
+				return
+			}
+		}
+
+		before := car
+		before.DeletedAt = nil
+		before.Revision--
+		audit.change(r.Context(), auditDeleted, vin, &before, &car)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// restoreCar undoes the deletion of a car.
+func restoreCar(c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := carVIN(r)
+
+		var before, car vehicle
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		filter := forTenant(r.Context(), bson.M{"vin": vin, "deletedat": bson.M{"$exists": true}})
+		update := bson.M{"$unset": bson.M{"deletedat": "", "mergedinto": ""}, "$inc": incRevision}
+		err := events.transact(r.Context(), func(ctx context.Context) error {
+			if err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before); err != nil {
+				return err
+			}
+			car = before
+			car.DeletedAt = nil
+			car.MergedInto = ""
+			car.Revision++
+			events.publish(ctx, inventoryEvent{Type: eventRestored, VIN: vin, Car: &car})
+			return nil
+		})
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed restore car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Deleted car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		audit.change(r.Context(), auditRestored, vin, &before, &car)
+
+		w.Header().Set("ETag", carETag(car))
+		respBody, err := json.MarshalIndent(car, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// maxBulkDelete is the most cars one bulk delete may remove; more matching
+// is refused, for the filter to be narrowed.
+const maxBulkDelete = 5000
+
+// bulkDeletion is the response of DELETE /cars.
+type bulkDeletion struct {
+	DryRun bool `json:"dry_run"`
+	// Count is how many cars were deleted, or would be in a dry run.
+	Count int64    `json:"count"`
+	VINs  []string `json:"vins,omitempty"`
+}
+
+// deleteCars deletes the live cars matching the listing filters of the query
+// string, such as ?manufacturer=, and ?older_than=, a model year the cars
+// are older than. At least one filter must be given. With ?dry_run=true it
+// only counts them. The deletions are audited as each car's, under the
+// request ID.
+func deleteCars(c *mongo.Collection, events *broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := ListParams{Filter: bson.M{}}
+		var dryRun bool
+		for name, values := range r.URL.Query() {
+			if len(values) != 1 {
+				errorWithJSON(w, fmt.Sprintf("Parameter %q may only be given once", name), http.StatusBadRequest)
+				return
+			}
+			var err error
+			switch value := values[0]; name {
+			case "dry_run":
+				if dryRun, err = strconv.ParseBool(value); err != nil {
+					err = fmt.Errorf("Parameter %q must be true or false", name)
+				}
+			case "older_than":
+				var year int
+				if year, err = strconv.Atoi(value); err != nil {
+					err = fmt.Errorf("Parameter %q must be a year", name)
+				}
+				params.bound("year", "$lt", year)
+			default:
+				err = params.addFilter(name, value)
+			}
+			if err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if len(params.Filter) == 0 {
+			errorWithJSON(w, "At least one filter is required", http.StatusBadRequest)
+			return
+		}
+		if err := checkFilter(params.Filter); err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter := forTenant(r.Context(), params.Filter)
+		filter["deletedat"] = bson.M{"$exists": false}
+
+		count, err := c.CountDocuments(r.Context(), filter)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count cars", "err", err)
+			return
+		}
+		if count > maxBulkDelete {
+			errorWithJSON(w, fmt.Sprintf("%d cars match; at most %d can be deleted at once", count, maxBulkDelete), http.StatusUnprocessableEntity)
+			return
+		}
+		res := bulkDeletion{DryRun: dryRun, Count: count}
+		if dryRun || count == 0 {
+			writeBulkDeletion(w, res)
+			return
+		}
+
+		var deleted []vehicle
+		err = events.transact(r.Context(), func(ctx context.Context) error {
+			var before []vehicle
+			cur, err := c.Find(ctx, filter)
+			if err == nil {
+				err = cur.All(ctx, &before)
+			}
+			if err != nil {
+				return err
+			}
+			vins := make([]string, len(before))
+			for i, car := range before {
+				vins[i] = car.VIN
+			}
+
+			// Only the cars found are deleted, so that each is audited.
+			now := time.Now().UTC()
+			update := bson.M{"$set": bson.M{"deletedat": now}, "$inc": incRevision}
+			if _, err := c.UpdateMany(ctx, forTenant(ctx, bson.M{"vin": bson.M{"$in": vins}, "deletedat": bson.M{"$exists": false}}), update); err != nil {
+				return err
+			}
+			deleted = before
+			for i := range deleted {
+				deleted[i].DeletedAt = &now
+				deleted[i].Revision++
+				events.publish(ctx, inventoryEvent{Type: eventDeleted, VIN: deleted[i].VIN, Car: &deleted[i]})
+			}
+			return nil
+		})
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete cars", "err", err)
+			return
+		}
+
+		entries := make([]auditEntry, len(deleted))
+		res.Count, res.VINs = int64(len(deleted)), make([]string, len(deleted))
+		for i := range deleted {
+			before := deleted[i]
+			before.DeletedAt = nil
+			before.Revision--
+			entries[i] = audit.entry(r.Context(), auditDeleted, deleted[i].VIN, &before, &deleted[i])
+			res.VINs[i] = deleted[i].VIN
+		}
+		audit.record(r.Context(), entries...)
+		slog.InfoContext(r.Context(), "Deleted cars in bulk", "count", res.Count, "filter", params.Filter)
+
+		writeBulkDeletion(w, res)
+	}
+}
+
+func writeBulkDeletion(w http.ResponseWriter, res bulkDeletion) {
+	respBody, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
+}
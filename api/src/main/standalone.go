@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"goji.io"
+	"goji.io/pat"
+
+	"config"
+)
+
+// serveMemory serves the API with STORAGE memory, keeping the cars in the
+// process and connecting to no database. Only the car endpoints of
+// memoryCarRoutes are served; every other operation of the OpenAPI document
+// answers 501, as what it reads and writes is kept in MongoDB. SEED_CARS
+// cars are generated at startup, and no credentials are needed.
+func serveMemory(cfg *config.Config) error {
+	slog.Warn("Serving the car endpoints from memory; other operations are not implemented", "addr", cfg.ListenAddr, "cars", cfg.SeedCars)
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      memoryHandler(cfg),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	return server.ListenAndServe()
+}
+
+// memoryHandler routes the requests to the API with STORAGE memory.
+func memoryHandler(cfg *config.Config) http.Handler {
+	repo := newMemoryVehicles()
+	events := newBroker()
+	audit := &auditLog{}
+	tenants := &tenancy{required: cfg.RequireTenant, fallback: cfg.DefaultTenant}
+	if cfg.SeedCars > 0 {
+		seedRepository(withTenant(context.Background(), cfg.DefaultTenant), repo, events, audit, cfg.SeedValue, cfg.SeedCars)
+	}
+
+	var corsP atomic.Pointer[corsPolicy]
+	corsP.Store(newCORSPolicy(cfg.CORSAllowedOrigins, cfg.CORSAllowedMethods, cfg.CORSAllowedHeaders,
+		cfg.CORSExposedHeaders, cfg.CORSMaxAge))
+
+	mux := goji.NewMux()
+	mux.Use(logRequests)
+	mux.Use(recoverPanics)
+	mux.Use(cors(&corsP))
+	mux.Use(negotiateContent)
+	mux.Use(scopeTenant(tenants))
+
+	mux.HandleFunc(pat.Get(route("/healthz")), healthz)
+	mux.HandleFunc(pat.Get(route("/readyz")), healthz)
+	mux.HandleFunc(pat.Get(route("/openapi.json")), openAPI())
+	mux.HandleFunc(pat.Get(route("/docs")), apiDocs)
+
+	memoryCarRoutes(mux, repo, events, audit)
+
+	eachOperation(openAPISpec(), func(p *pat.Pattern, op obj) {
+		mux.HandleFunc(p, notInMemory)
+	})
+	mux.HandleFunc(pat.New("/*"), unknownRoute)
+	return versioned(mux)
+}
+
+// notInMemory answers the operations that need MongoDB, which STORAGE
+// memory does without.
+func notInMemory(w http.ResponseWriter, r *http.Request) {
+	errorWithJSON(w, "Not available with STORAGE memory", http.StatusNotImplemented)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// oldestStockShown is how many of the cars in stock longest /stats lists.
+const oldestStockShown = 10
+
+// inventoryStats sums up a tenant's live cars for dashboards.
+type inventoryStats struct {
+	Total          int64        `json:"total"`
+	ByStatus       []statsCount `json:"by_status"`
+	ByManufacturer []statsCount `json:"by_manufacturer"`
+	ByModel        []statsCount `json:"by_model"`
+	Prices         []priceStats `json:"prices"`
+	// AverageDaysInStock is over the cars not yet sold or written off.
+	AverageDaysInStock float64   `json:"average_days_in_stock"`
+	OldestStock        []agedCar `json:"oldest_stock"`
+	At                 time.Time `json:"at"`
+}
+
+type statsCount struct {
+	Status       string `json:"status,omitempty" bson:"status,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty" bson:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty" bson:"model,omitempty"`
+	Count        int64  `json:"count"`
+}
+
+// priceStats are the asking prices in one currency, in its minor unit.
+type priceStats struct {
+	Currency string  `json:"currency"`
+	Count    int64   `json:"count"`
+	Average  float64 `json:"average"`
+	Median   float64 `json:"median"`
+	Min      int64   `json:"min"`
+	Max      int64   `json:"max"`
+}
+
+type agedCar struct {
+	VIN          string    `json:"vin"`
+	Manufacturer string    `json:"manufacturer"`
+	Model        string    `json:"model"`
+	AddedAt      time.Time `json:"added_at" bson:"addedat"`
+	DaysInStock  float64   `json:"days_in_stock" bson:"daysinstock"`
+}
+
+// addedAt is when a car was added, taken from its ObjectID, which the
+// driver generates as the car is inserted.
+var addedAt = bson.M{"$toDate": "$_id"}
+
+// stats computes the inventory statistics in a single aggregation, so that
+// dashboards need not download every car.
+func stats(c *mongo.Collection) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+		daysInStock := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, addedAt}}, float64(24 * time.Hour / time.Millisecond)}}
+		inStock := bson.M{"$match": bson.M{"status": bson.M{"$nin": bson.A{carSold, carWrittenOff}}}}
+		countBy := func(id bson.M) bson.A {
+			return bson.A{
+				bson.M{"$group": bson.M{"_id": id, "count": bson.M{"$sum": 1}}},
+				bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{"$_id", bson.M{"count": "$count"}}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}, {Key: "status", Value: 1}}},
+			}
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: forTenant(r.Context(), bson.M{"deletedat": bson.M{"$exists": false}})}},
+			{{Key: "$facet", Value: bson.M{
+				"total":          bson.A{bson.M{"$count": "n"}},
+				"bystatus":       countBy(bson.M{"status": "$status"}),
+				"bymanufacturer": countBy(bson.M{"manufacturer": "$manufacturer"}),
+				"bymodel":        countBy(bson.M{"manufacturer": "$manufacturer", "model": "$model"}),
+				"prices": bson.A{
+					bson.M{"$match": bson.M{"price.amount": bson.M{"$exists": true}}},
+					bson.M{"$group": bson.M{
+						"_id":     "$price.currency",
+						"count":   bson.M{"$sum": 1},
+						"average": bson.M{"$avg": "$price.amount"},
+						"median":  bson.M{"$median": bson.M{"input": "$price.amount", "method": "approximate"}},
+						"min":     bson.M{"$min": "$price.amount"},
+						"max":     bson.M{"$max": "$price.amount"},
+					}},
+					bson.M{"$set": bson.M{"currency": "$_id"}},
+					bson.M{"$sort": bson.M{"currency": 1}},
+				},
+				"daysinstock": bson.A{
+					inStock,
+					bson.M{"$group": bson.M{"_id": nil, "average": bson.M{"$avg": daysInStock}}},
+				},
+				"oldest": bson.A{
+					inStock,
+					bson.M{"$sort": bson.M{"_id": 1}},
+					bson.M{"$limit": oldestStockShown},
+					bson.M{"$project": bson.M{
+						"vin":          1,
+						"manufacturer": 1,
+						"model":        1,
+						"addedat":      addedAt,
+						"daysinstock":  daysInStock,
+					}},
+				},
+			}}},
+		}
+
+		var res []struct {
+			Total          []struct{ N int64 }         `bson:"total"`
+			ByStatus       []statsCount                `bson:"bystatus"`
+			ByManufacturer []statsCount                `bson:"bymanufacturer"`
+			ByModel        []statsCount                `bson:"bymodel"`
+			Prices         []priceStats                `bson:"prices"`
+			DaysInStock    []struct{ Average float64 } `bson:"daysinstock"`
+			Oldest         []agedCar                   `bson:"oldest"`
+		}
+		cur, err := c.Aggregate(r.Context(), pipeline)
+		if err == nil {
+			err = cur.All(r.Context(), &res)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed compute stats", "err", err)
+			return
+		}
+
+		f := res[0]
+		s := inventoryStats{
+			ByStatus:       f.ByStatus,
+			ByManufacturer: f.ByManufacturer,
+			ByModel:        f.ByModel,
+			Prices:         f.Prices,
+			OldestStock:    f.Oldest,
+			At:             now,
+		}
+		if len(f.Total) > 0 {
+			s.Total = f.Total[0].N
+		}
+		if len(f.DaysInStock) > 0 {
+			s.AverageDaysInStock = f.DaysInStock[0].Average
+		}
+
+		respBody, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+	"vin"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The lifecycle statuses of a car.
+const (
+	carInPrep     = "in_prep"
+	carInStock    = "in_stock"
+	carReserved   = "reserved"
+	carSold       = "sold"
+	carWrittenOff = "written_off"
+)
+
+// carTransitions are the statuses a car may move to from each status. Sold
+// and written off cars stay so.
+var carTransitions = map[string]map[string]bool{
+	carInPrep:     {carInStock: true, carWrittenOff: true},
+	carInStock:    {carInPrep: true, carReserved: true, carWrittenOff: true},
+	carReserved:   {carInStock: true, carSold: true},
+	carSold:       {},
+	carWrittenOff: {},
+}
+
+// maxStatusBatch is the most cars one batch may move.
+const maxStatusBatch = 500
+
+// What became of each car of a status batch.
+const (
+	statusMoved     = "moved"
+	statusUnchanged = "unchanged"
+	statusConflict  = "conflict"
+	statusNotFound  = "not_found"
+	statusFailed    = "failed"
+)
+
+// errCannotMove is returned by moveStatus for a car the state machine, or a
+// hold or order on it, keeps from moving.
+var errCannotMove = errors.New("car cannot move to the status")
+
+// managedStatuses are moved into and out of only by holds and orders, which
+// keep what the reservation or sale is for alongside.
+var managedStatuses = map[string]bool{carReserved: true, carSold: true}
+
+// statusesTo returns the statuses a car may move to status from.
+func statusesTo(status string) bson.A {
+	from := bson.A{}
+	for s, to := range carTransitions {
+		if to[status] {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+// backfillStatus gives a status to the cars stored before there were any:
+// sold if they have been sold, in stock otherwise.
+func backfillStatus(ctx context.Context, cars *mongo.Collection) error {
+	noStatus := bson.M{"status": bson.M{"$exists": false}}
+
+	sold := bson.M{"status": noStatus["status"], "soldat": bson.M{"$exists": true}}
+	if _, err := cars.UpdateMany(ctx, sold, bson.M{"$set": bson.M{"status": carSold}}); err != nil {
+		return err
+	}
+	_, err := cars.UpdateMany(ctx, noStatus, bson.M{"$set": bson.M{"status": carInStock}})
+	return err
+}
+
+// validStatus checks that status is one cars may be moved to directly,
+// answering w if it is not.
+func validStatus(w http.ResponseWriter, status string) bool {
+	if _, ok := carTransitions[status]; !ok {
+		fieldErrorWithJSON(w, "status", "invalid", "The status must be in_prep, in_stock, reserved, sold or written_off")
+		return false
+	}
+	if managedStatuses[status] {
+		errorWithJSON(w, "Cars are reserved through /reserve and sold through /orders", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// moveStatus moves the car with the VIN to status, publishing and auditing
+// the move, and returns it as it was and is. If it cannot move, it is
+// returned as it is with errCannotMove; mongo.ErrNoDocuments if there is no
+// such car.
+func moveStatus(ctx context.Context, o *orderWrites, vin, status string) (vehicle, vehicle, error) {
+	filter := liveCar(ctx, vin)
+	filter["status"] = bson.M{"$in": statusesTo(status)}
+	// A reserved car is released through its hold or order.
+	filter["hold"] = bson.M{"$exists": false}
+	filter["order"] = bson.M{"$exists": false}
+	update := bson.M{"$set": bson.M{"status": status}}
+	if status == carInStock {
+		// A car is listed the first time it goes in stock.
+		update["$min"] = bson.M{"listedat": time.Now().UTC()}
+	}
+	before, after, err := o.move(ctx, eventUpdated, filter, update)
+	if err == mongo.ErrNoDocuments {
+		var car vehicle
+		if err := o.cars.FindOne(ctx, liveCar(ctx, vin)).Decode(&car); err != nil {
+			return car, car, err
+		}
+		return car, car, errCannotMove
+	}
+	if err != nil {
+		return before, after, err
+	}
+	o.changed(ctx, auditUpdated, &before, &after)
+	return before, after, nil
+}
+
+// changeStatus moves a car to the status in the body, if the state machine
+// allows it.
+func changeStatus(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Status string `json:"status"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if !validStatus(w, req.Status) {
+			return
+		}
+
+		_, after, err := moveStatus(r.Context(), o, carVIN(r), req.Status)
+		switch err {
+		case nil:
+		case errCannotMove:
+			errorWithJSON(w, "A car cannot move from "+after.Status+" to "+req.Status, http.StatusConflict)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Car not found", http.StatusNotFound)
+			return
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed change car status", "err", err)
+			return
+		}
+
+		w.Header().Set("ETag", carETag(after))
+		respBody, err := json.MarshalIndent(after, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// statusResult says what became of one car of a status batch. From is the
+// status it was in, if it was found.
+type statusResult struct {
+	VIN     string `json:"vin"`
+	Result  string `json:"result"`
+	From    string `json:"from,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusReport is what became of a status batch, car by car in the order
+// asked for.
+type statusReport struct {
+	Status  string         `json:"status"`
+	Moved   int            `json:"moved"`
+	Failed  int            `json:"failed"`
+	Results []statusResult `json:"results"`
+}
+
+// changeStatuses moves the cars with the VINs in the body to its status,
+// each as POST /cars/:vin/status would, so that the intake tooling can move
+// a whole auction lot at once. A car that cannot move does not stop the
+// others; cars already in the status are left unchanged, so that a batch can
+// be retried.
+func changeStatuses(o *orderWrites) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			VINs   []string `json:"vins"`
+			Status string   `json:"status"`
+		}
+		if !decodeBody(w, r.Body, &req) {
+			return
+		}
+		if len(req.VINs) == 0 || len(req.VINs) > maxStatusBatch {
+			fieldErrorWithJSON(w, "vins", "invalid", fmt.Sprintf("Between 1 and %d VINs must be given", maxStatusBatch))
+			return
+		}
+		if !validStatus(w, req.Status) {
+			return
+		}
+
+		report := statusReport{Status: req.Status, Results: []statusResult{}}
+		seen := make(map[string]bool, len(req.VINs))
+		for _, v := range req.VINs {
+			vin := vin.Normalize(v)
+			if seen[vin] {
+				continue
+			}
+			seen[vin] = true
+
+			res := statusResult{VIN: vin}
+			car, _, err := moveStatus(r.Context(), o, vin, req.Status)
+			switch {
+			case err == nil:
+				res.Result, res.From = statusMoved, car.Status
+				report.Moved++
+			case err == errCannotMove && car.Status == req.Status:
+				res.Result, res.From = statusUnchanged, car.Status
+			case err == errCannotMove:
+				res.Result, res.From = statusConflict, car.Status
+				res.Message = "A car cannot move from " + car.Status + " to " + req.Status
+				if car.Hold != nil || car.Order != "" {
+					res.Message = "The car is released through its hold or order"
+				}
+			case err == mongo.ErrNoDocuments:
+				res.Result, res.Message = statusNotFound, "Car not found"
+			default:
+				res.Result, res.Message = statusFailed, "Database error"
+				slog.ErrorContext(r.Context(), "Failed change car status", "vin", vin, "err", err)
+			}
+			if res.Result != statusMoved && res.Result != statusUnchanged {
+				report.Failed++
+			}
+			report.Results = append(report.Results, res)
+		}
+
+		respBody, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
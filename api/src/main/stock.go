@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// stockRecountSchedule counts every model afresh, for the models whose cars
+// were changed before there were stock levels, or by hand in the database.
+const stockRecountSchedule = "@every 1h"
+
+// stockLevel counts the tenant's live cars of a model on their way to being
+// sold.
+type stockLevel struct {
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	InPrep       int64  `json:"in_prep" bson:"inprep"`
+	InStock      int64  `json:"in_stock" bson:"instock"`
+	Reserved     int64  `json:"reserved"`
+	// Low is set when in stock is below the threshold of an alert on the
+	// model.
+	Low       bool      `json:"low" bson:"-"`
+	CountedAt time.Time `json:"counted_at" bson:"countedat"`
+	Tenant    string    `json:"-" bson:"tenant"`
+}
+
+// stockAlert tells Notify when the cars of a model in stock fall below
+// Threshold.
+type stockAlert struct {
+	ID           string    `json:"id" bson:"alertid"`
+	Manufacturer string    `json:"manufacturer"`
+	Model        string    `json:"model"`
+	Threshold    int64     `json:"threshold"`
+	Notify       contact   `json:"notify"`
+	CreatedBy    string    `json:"created_by,omitempty" bson:"createdby,omitempty"`
+	CreatedAt    time.Time `json:"created_at" bson:"createdat"`
+	Tenant       string    `json:"-" bson:"tenant"`
+}
+
+func (a *stockAlert) validate() *fieldError {
+	c := &checks{}
+	c.require("manufacturer", a.Manufacturer, "The manufacturer is required")
+	c.require("model", a.Model, "The model is required")
+	c.check(a.Threshold > 0, "threshold", "The threshold must be at least 1")
+	if err := a.Notify.validate("notify"); err != nil {
+		return err
+	}
+	return c.err()
+}
+
+// stockLevels keeps the count of each model's cars by status. A model is
+// counted afresh from the cars whenever an event changes the status, make
+// or model of one of its cars, rather than its counts being added to, so
+// that they cannot drift; and a count is only stored over one taken before
+// it, so that of two counts racing the later wins. Crossing below the
+// threshold of an alert sends it.
+type stockLevels struct {
+	c      *mongo.Collection
+	alerts *mongo.Collection
+	cars   *mongo.Collection
+	notes  *notifier
+}
+
+func (s *stockLevels) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.alerts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "alertid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}}},
+	})
+	return err
+}
+
+// stockStatuses are the statuses counted, by the field they are counted in.
+var stockStatuses = map[string]string{carInPrep: "inprep", carInStock: "instock", carReserved: "reserved"}
+
+// countStock groups the live cars matching filter by tenant, manufacturer
+// and model, counting them by status.
+func (s *stockLevels) countStock(ctx context.Context, filter bson.M) ([]stockLevel, error) {
+	filter["deletedat"] = bson.M{"$exists": false}
+	filter["status"] = bson.M{"$in": bson.A{carInPrep, carInStock, carReserved}}
+	group := bson.M{"_id": bson.M{"tenant": "$tenant", "manufacturer": "$manufacturer", "model": "$model"}}
+	for status, field := range stockStatuses {
+		group[field] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$status", status}}, 1, 0}}}
+	}
+	cur, err := s.cars.Aggregate(ctx, bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$group": group},
+		bson.M{"$project": bson.M{
+			"tenant": "$_id.tenant", "manufacturer": "$_id.manufacturer", "model": "$_id.model",
+			"inprep": 1, "instock": 1, "reserved": 1,
+		}},
+	})
+	var levels []stockLevel
+	if err == nil {
+		err = cur.All(ctx, &levels)
+	}
+	return levels, err
+}
+
+// store sets level, counted at at, unless a later count is stored, and
+// returns the level it replaced: nil when there was none, or when the later
+// count was kept.
+func (s *stockLevels) store(ctx context.Context, level stockLevel, at time.Time) (*stockLevel, error) {
+	filter := bson.M{"tenant": level.Tenant, "manufacturer": level.Manufacturer, "model": level.Model, "countedat": bson.M{"$lt": at}}
+	update := bson.M{"$set": bson.M{"inprep": level.InPrep, "instock": level.InStock, "reserved": level.Reserved, "countedat": at}}
+	var was stockLevel
+	err := s.c.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetUpsert(true)).Decode(&was)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return nil, nil
+	case mongo.IsDuplicateKeyError(err):
+		// A later count is stored, so the upsert found nothing to update
+		// and could not insert another.
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return &was, nil
+}
+
+// recount counts a model of the tenant of ctx and alerts on it, given the
+// car whose change it is counted for.
+func (s *stockLevels) recount(ctx context.Context, manufacturer, model string, car vehicle) error {
+	at := time.Now().UTC()
+	levels, err := s.countStock(ctx, forTenant(ctx, bson.M{"manufacturer": manufacturer, "model": model}))
+	if err != nil {
+		return err
+	}
+	level := stockLevel{Manufacturer: manufacturer, Model: model, Tenant: tenantFrom(ctx)}
+	if len(levels) > 0 {
+		level = levels[0]
+	}
+	was, err := s.store(ctx, level, at)
+	if err != nil || was == nil {
+		return err
+	}
+	return s.alert(ctx, *was, level, car)
+}
+
+// observe is the outbox sink of stock levels: it counts the models a car
+// was and is of again when its status, make or model may have changed.
+func (s *stockLevels) observe(ctx context.Context, e outboxEvent) error {
+	if e.Car == nil {
+		return nil
+	}
+	if e.Type == eventUpdated && !(inventoryEvent{Changes: e.Changes}).changesAny(map[string]bool{"status": true, "manufacturer": true, "model": true}) {
+		return nil
+	}
+	models := map[[2]string]bool{{e.Car.Manurfacturer, e.Car.Model}: true}
+	before := [2]string{e.Car.Manurfacturer, e.Car.Model}
+	for _, c := range e.Changes {
+		old, _ := c.Old.(string)
+		switch c.Field {
+		case "manufacturer":
+			before[0] = old
+		case "model":
+			before[1] = old
+		}
+	}
+	models[before] = true
+	for m := range models {
+		if m[0] == "" || m[1] == "" {
+			continue
+		}
+		if err := s.recount(ctx, m[0], m[1], *e.Car); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alert sends the alerts on a model whose thresholds the cars in stock have
+// fallen below.
+func (s *stockLevels) alert(ctx context.Context, was, now stockLevel, car vehicle) error {
+	if now.InStock >= was.InStock {
+		return nil
+	}
+	filter := forTenant(ctx, bson.M{
+		"manufacturer": now.Manufacturer,
+		"model":        now.Model,
+		"threshold":    bson.M{"$gt": now.InStock, "$lte": was.InStock},
+	})
+	var alerts []stockAlert
+	cur, err := s.alerts.Find(ctx, filter)
+	if err == nil {
+		err = cur.All(ctx, &alerts)
+	}
+	if err != nil || len(alerts) == 0 {
+		return err
+	}
+
+	data, err := s.notes.data(ctx, car)
+	if err != nil {
+		return err
+	}
+	data.Title = now.Manufacturer + " " + now.Model
+	data.Stock = now.InStock
+	for _, a := range alerts {
+		d := data
+		d.Threshold = a.Threshold
+		// Each fall to a count is told of once, however often the event
+		// that caused it is relayed.
+		key := notifyLowStock + "-" + a.ID + "-" + strconv.FormatInt(was.InStock, 10) + "-" + strconv.FormatInt(now.InStock, 10) + "-" + car.VIN
+		if err := s.notes.send(ctx, key, notifyLowStock, a.Notify, "", d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recountAll counts every model of every tenant afresh, zeroing those with
+// no cars left that were not counted since.
+func (s *stockLevels) recountAll(ctx context.Context) error {
+	at := time.Now().UTC()
+	levels, err := s.countStock(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, level := range levels {
+		if _, err := s.store(ctx, level, at); err != nil {
+			return err
+		}
+	}
+	_, err = s.c.UpdateMany(ctx, bson.M{"countedat": bson.M{"$lt": at}},
+		bson.M{"$set": bson.M{"inprep": 0, "instock": 0, "reserved": 0, "countedat": at}})
+	return err
+}
+
+// allStockLevels lists the models' stock levels, optionally of one
+// manufacturer or only those low on stock.
+func allStockLevels(s *stockLevels) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := forTenant(r.Context(), bson.M{})
+		if m := query.Get("manufacturer"); m != "" {
+			filter["manufacturer"] = m
+		}
+		if m := query.Get("model"); m != "" {
+			filter["model"] = m
+		}
+		onlyLow := false
+		if v := query.Get("low"); v != "" {
+			var err error
+			if onlyLow, err = strconv.ParseBool(v); err != nil {
+				errorWithJSON(w, "Parameter \"low\" must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var levels []stockLevel
+		opts := options.Find().SetSort(bson.D{{Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}})
+		cur, err := s.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &levels)
+		}
+		var alerts []stockAlert
+		if err == nil {
+			cur, err = s.alerts.Find(r.Context(), forTenant(r.Context(), bson.M{}))
+		}
+		if err == nil {
+			err = cur.All(r.Context(), &alerts)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list stock levels", "err", err)
+			return
+		}
+
+		thresholds := map[[2]string]int64{}
+		for _, a := range alerts {
+			key := [2]string{a.Manufacturer, a.Model}
+			if a.Threshold > thresholds[key] {
+				thresholds[key] = a.Threshold
+			}
+		}
+		listed := []stockLevel{}
+		for _, l := range levels {
+			l.Low = l.InStock < thresholds[[2]string{l.Manufacturer, l.Model}]
+			if !onlyLow || l.Low {
+				listed = append(listed, l)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(listed, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func allStockAlerts(s *stockLevels) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alerts := []stockAlert{}
+		opts := options.Find().SetSort(bson.D{{Key: "manufacturer", Value: 1}, {Key: "model", Value: 1}, {Key: "threshold", Value: -1}})
+		cur, err := s.alerts.Find(r.Context(), forTenant(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &alerts)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list stock alerts", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(alerts, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func addStockAlert(s *stockLevels) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a stockAlert
+		if !decodeBody(w, r.Body, &a) {
+			return
+		}
+		if err := a.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		a.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		if p := principalFrom(r.Context()); p != nil {
+			a.CreatedBy = p.Subject
+		}
+		a.CreatedAt = time.Now().UTC()
+		a.Tenant = tenantFrom(r.Context())
+
+		if _, err := s.alerts.InsertOne(r.Context(), a); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert stock alert", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/stock-alerts/"+a.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func deleteStockAlert(s *stockLevels) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.alerts.DeleteOne(r.Context(), forTenant(r.Context(), bson.M{"alertid": pat.Param(r, "id")}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete stock alert", "err", err)
+			return
+		}
+
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "Stock alert not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// changeEvent is the part of a change stream event the feed reads.
+type changeEvent struct {
+	OperationType            string   `bson:"operationType"`
+	FullDocument             *vehicle `bson:"fullDocument"`
+	FullDocumentBeforeChange *vehicle `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// inventoryEvent turns a change of the cars collection into the event
+// clients see. Soft deletes and restores are updates in the database but
+// deletions and restorations to clients. ok is false for changes clients do
+// not see, such as edits to deleted cars.
+func (c changeEvent) inventoryEvent() (e inventoryEvent, ok bool) {
+	switch c.OperationType {
+	case "insert":
+		return inventoryEvent{Type: eventCreated, VIN: c.FullDocument.VIN, Car: c.FullDocument}, true
+	case "delete":
+		// The VIN is only known when pre-images are enabled.
+		if c.FullDocumentBeforeChange == nil {
+			return e, false
+		}
+		return inventoryEvent{Type: eventDeleted, VIN: c.FullDocumentBeforeChange.VIN, Car: c.FullDocumentBeforeChange}, true
+	}
+
+	car := c.FullDocument
+	if car == nil {
+		// Deleted before the lookup saw it.
+		return e, false
+	}
+
+	switch {
+	case car.DeletedAt != nil:
+		if _, deleted := c.UpdateDescription.UpdatedFields["deletedat"]; !deleted {
+			return e, false
+		}
+		return inventoryEvent{Type: eventDeleted, VIN: car.VIN, Car: car}, true
+	default:
+		for _, field := range c.UpdateDescription.RemovedFields {
+			if field == "deletedat" {
+				return inventoryEvent{Type: eventRestored, VIN: car.VIN, Car: car}, true
+			}
+		}
+		e = inventoryEvent{Type: eventUpdated, VIN: car.VIN, Car: car}
+		if c.FullDocumentBeforeChange != nil {
+			e.Changes = changes(c.FullDocumentBeforeChange, car)
+		}
+		return e, true
+	}
+}
+
+// enablePreImages makes the database keep cars as they were before each
+// change, so the feed can say which car was removed by a hard delete. Older
+// servers do not support it; removals are then left out of the feed.
+func enablePreImages(db *mongo.Database, collection string) {
+	cmd := bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}
+	if err := db.RunCommand(context.Background(), cmd).Err(); err != nil {
+		slog.Warn("Change stream pre-images are not available; hard deletes are left out of /cars/stream", "err", err)
+	}
+}
+
+// carStream pushes every change to the cars collection to a WebSocket
+// client, read from a MongoDB change stream so that changes made by other
+// instances and tools are seen too. Clients may narrow the feed with a
+// subscribe message as on /cars/ws. The feed ends when shutdown is done.
+func carStream(c *mongo.Collection, shutdown context.Context) func(w http.ResponseWriter, r *http.Request) {
+	slots := make(chan struct{}, maxWebSocketConns)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			errorWithJSON(w, "Too many live connections", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer context.AfterFunc(shutdown, cancel)()
+
+		pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+			"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+			"$or": bson.A{
+				bson.M{"fullDocument.tenant": tenantFrom(r.Context())},
+				bson.M{"fullDocumentBeforeChange.tenant": tenantFrom(r.Context())},
+			},
+		}}}}
+		opts := options.ChangeStream().
+			SetFullDocument(options.UpdateLookup).
+			SetFullDocumentBeforeChange(options.WhenAvailable)
+		cs, err := c.Watch(ctx, pipeline, opts)
+		if err != nil {
+			errorWithJSON(w, "Live updates are not available", http.StatusServiceUnavailable)
+			slog.ErrorContext(r.Context(), "Failed watch cars", "err", err)
+			return
+		}
+		defer cs.Close(context.Background())
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed websocket upgrade", "err", err)
+			return
+		}
+		defer conn.Close()
+
+		filters := make(chan carFilter)
+		done := make(chan struct{})
+		quit := make(chan struct{})
+		defer close(quit)
+		go readSubscriptions(conn, filters, done, quit)
+
+		changes := make(chan inventoryEvent)
+		go func() {
+			defer close(changes)
+			for cs.Next(ctx) {
+				var change changeEvent
+				if err := cs.Decode(&change); err != nil {
+					slog.ErrorContext(r.Context(), "Failed decode change event", "err", err)
+					continue
+				}
+				if e, ok := change.inventoryEvent(); ok {
+					select {
+					case changes <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			if err := cs.Err(); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(r.Context(), "Failed read change stream", "err", err)
+			}
+		}()
+
+		ping := time.NewTicker(wsPingPeriod)
+		defer ping.Stop()
+
+		var filter *carFilter
+		for {
+			select {
+			case <-done:
+				return
+			case f := <-filters:
+				filter = &f
+			case <-ping.C:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case e, ok := <-changes:
+				if !ok {
+					reason := "change stream ended"
+					if shutdown.Err() != nil {
+						reason = "server shutting down"
+					}
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+						time.Now().Add(wsWriteWait))
+					return
+				}
+
+				if filter != nil && !filter.matches(e.Car) {
+					continue
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteJSON(e); err != nil {
+					slog.ErrorContext(r.Context(), "Failed write websocket event", "err", err)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"problem"
+)
+
+// streamPageMin is the most cars of a page that is built in memory before it
+// is written; bigger pages are streamed.
+const streamPageMin = 100
+
+// errPageAnswered ends a streamed page whose error response has been written.
+var errPageAnswered = errors.New("page answered")
+
+// streamPage writes the page of cars described by params as the repository
+// yields them, a batch of dumpFlushEvery at a time, flushing after each, so
+// that a page of hundreds of cars is never held whole and its first cars are
+// sent while the rest are read. The page is that of listCars, with the cars
+// first and the fields known only once they are all read after them. A
+// streamed page has no ETag, as its body is not known until it is sent.
+func streamPage(w http.ResponseWriter, r *http.Request, repo vehicleRepository, rates *exchangeRates, params ListParams) {
+	total, err := repo.count(r.Context(), params.Filter)
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed count cars", "err", err)
+		return
+	}
+	page := carPage{Total: total, Limit: params.Limit}
+	if params.Facets {
+		filter := make(map[string]interface{}, len(params.Filter))
+		for k, v := range params.Filter {
+			filter[k] = v
+		}
+		if page.Facets, err = repo.facets(r.Context(), filter); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed count facets", "err", err)
+			return
+		}
+	}
+	if params.Currency != "" && params.Fields != nil {
+		params.Fields = append(params.Fields, "display_price")
+	}
+
+	flusher, _ := w.(http.Flusher)
+	// The status is sent with the first batch, so that a query or exchange
+	// rate that fails outright is still answered with an error.
+	sent := false
+	listed := 0
+	var last string
+	write := func(batch []vehicle) error {
+		if params.Currency != "" && !sent {
+			if !displayPricesOrFail(w, r, rates, batch, params.Currency) {
+				return errPageAnswered
+			}
+		} else if params.Currency != "" {
+			if err := rates.displayPrices(r.Context(), batch, params.Currency); err != nil {
+				return err
+			}
+		}
+		labelCars(r.Context(), batch)
+		if !sent {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("{\n  \"cars\": ["))
+			sent = true
+		}
+		for _, car := range batch {
+			var v interface{} = car
+			var err error
+			if params.Fields != nil {
+				if v, err = selectFields(car, params.Fields); err != nil {
+					return err
+				}
+			}
+			if params.Links {
+				if v, err = withLinks(v, car); err != nil {
+					return err
+				}
+			}
+			b, err := json.MarshalIndent(v, "    ", "  ")
+			if err != nil {
+				return err
+			}
+			if listed > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write([]byte("\n    "))
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			listed++
+			last = car.VIN
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	params.paged = true
+	batch := make([]vehicle, 0, dumpFlushEvery)
+	var next string
+	err = repo.each(r.Context(), params, func(car vehicle) error {
+		// In cursor mode the car after the page only tells there is another.
+		if listed+len(batch) == params.Limit {
+			next = encodeCursor(last)
+			if len(batch) > 0 {
+				next = encodeCursor(batch[len(batch)-1].VIN)
+			}
+			return nil
+		}
+		if batch = append(batch, car); len(batch) == dumpFlushEvery {
+			err := write(batch)
+			batch = batch[:0]
+			return err
+		}
+		return nil
+	})
+	if err == nil {
+		err = write(batch)
+	}
+	switch {
+	case err == errPageAnswered:
+		return
+	case err != nil && !sent:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed get all cars", "err", err)
+		return
+	case err != nil:
+		// The status has been sent, so a failure part way through can only
+		// be logged; the client sees a truncated page.
+		slog.ErrorContext(r.Context(), "Failed stream cars", "err", err)
+		return
+	}
+
+	if params.UseCursor {
+		page.NextCursor = next
+	} else {
+		page.Page = &params.Page
+		page.Offset = &params.Offset
+	}
+	if params.Links {
+		page.Links = &pageLinks{
+			Self: link{r.URL.RequestURI()},
+			Next: nextPage(r, params, listed, total, next),
+		}
+	}
+	// The rest of the page follows the cars, as the object they end.
+	rest, err := json.MarshalIndent(struct {
+		Total      int64      `json:"total"`
+		Limit      int        `json:"limit"`
+		Page       *int       `json:"page,omitempty"`
+		Offset     *int       `json:"offset,omitempty"`
+		NextCursor string     `json:"next_cursor,omitempty"`
+		Facets     *carFacets `json:"facets,omitempty"`
+		Links      *pageLinks `json:"_links,omitempty"`
+	}{page.Total, page.Limit, page.Page, page.Offset, page.NextCursor, page.Facets, page.Links}, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if listed > 0 {
+		w.Write([]byte("\n  "))
+	}
+	w.Write([]byte("],"))
+	w.Write(rest[1:])
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// suggestSchedule is how often the suggestions are worked out again.
+const suggestSchedule = "@every 5m"
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 25
+)
+
+// suggestion completes what has been typed in a search box with a
+// manufacturer, or a manufacturer and model, of the cars on sale.
+type suggestion struct {
+	Text         string `json:"text"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model,omitempty"`
+	// Count is how many cars on sale it would find.
+	Count int64 `json:"count"`
+}
+
+// suggester keeps the suggestions of each tenant, most cars first, ready for
+// GET /suggest. A tenant's are worked out on its first request, then again
+// on each refresh.
+type suggester struct {
+	cars *mongo.Collection
+
+	mu       sync.Mutex
+	byTenant map[string][]suggestion
+}
+
+func newSuggester(cars *mongo.Collection) *suggester {
+	return &suggester{cars: cars, byTenant: map[string][]suggestion{}}
+}
+
+// build works out the suggestions of the tenant of ctx from its cars on sale.
+func (s *suggester) build(ctx context.Context) ([]suggestion, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: forTenant(ctx, bson.M{
+			"deletedat": bson.M{"$exists": false},
+			"status":    bson.M{"$in": bson.A{carInStock, carReserved}},
+		})}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"manufacturer": "$manufacturer", "model": "$model"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	cur, err := s.cars.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ID struct {
+			Manufacturer string
+			Model        string
+		} `bson:"_id"`
+		Count int64
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	makes := map[string]int64{}
+	var suggestions []suggestion
+	for _, g := range groups {
+		if g.ID.Manufacturer == "" {
+			continue
+		}
+		makes[g.ID.Manufacturer] += g.Count
+		if g.ID.Model != "" {
+			suggestions = append(suggestions, suggestion{
+				Text:         g.ID.Manufacturer + " " + g.ID.Model,
+				Manufacturer: g.ID.Manufacturer,
+				Model:        g.ID.Model,
+				Count:        g.Count,
+			})
+		}
+	}
+	for m, n := range makes {
+		suggestions = append(suggestions, suggestion{Text: m, Manufacturer: m, Count: n})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Count != suggestions[j].Count {
+			return suggestions[i].Count > suggestions[j].Count
+		}
+		return suggestions[i].Text < suggestions[j].Text
+	})
+	return suggestions, nil
+}
+
+// get returns the suggestions of the tenant of ctx.
+func (s *suggester) get(ctx context.Context) ([]suggestion, error) {
+	tenant := tenantFrom(ctx)
+	s.mu.Lock()
+	suggestions, ok := s.byTenant[tenant]
+	s.mu.Unlock()
+	if ok {
+		return suggestions, nil
+	}
+
+	suggestions, err := s.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.byTenant[tenant] = suggestions
+	s.mu.Unlock()
+	return suggestions, nil
+}
+
+// refresh works out the suggestions of every tenant asked for them again.
+func (s *suggester) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	tenants := make([]string, 0, len(s.byTenant))
+	for t := range s.byTenant {
+		tenants = append(tenants, t)
+	}
+	s.mu.Unlock()
+
+	for _, t := range tenants {
+		suggestions, err := s.build(withTenant(ctx, t))
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.byTenant[t] = suggestions
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// suggest completes ?prefix= with the manufacturers and models of the cars
+// on sale, those with the most cars first. The prefix is matched, ignoring
+// case, against the start of the manufacturer, the model and both together.
+func suggest(s *suggester) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix := strings.ToLower(strings.TrimSpace(query.Get("prefix")))
+		if prefix == "" {
+			errorWithJSON(w, "Parameter \"prefix\" is required", http.StatusBadRequest)
+			return
+		}
+		limit := defaultSuggestLimit
+		if v := query.Get("limit"); v != "" {
+			var err error
+			if limit, err = parseCount("limit", v, 1, maxSuggestLimit); err != nil {
+				errorWithJSON(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		all, err := s.get(r.Context())
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed work out suggestions", "err", err)
+			return
+		}
+		matches := []suggestion{}
+		for _, sg := range all {
+			if len(matches) == limit {
+				break
+			}
+			if strings.HasPrefix(strings.ToLower(sg.Text), prefix) ||
+				sg.Model != "" && strings.HasPrefix(strings.ToLower(sg.Model), prefix) {
+				matches = append(matches, sg)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(struct {
+			Prefix      string       `json:"prefix"`
+			Suggestions []suggestion `json:"suggestions"`
+		}{query.Get("prefix"), matches}, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tenantHeader names the tenant of a request made without a tenant-bound
+// credential.
+const tenantHeader = "X-Tenant-ID"
+
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+type tenantKey struct{}
+
+// tenantFrom returns the tenant of the request, or "" outside one, which
+// matches no data.
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// forTenant narrows filter to the tenant of ctx and returns it.
+func forTenant(ctx context.Context, filter bson.M) bson.M {
+	filter["tenant"] = tenantFrom(ctx)
+	return filter
+}
+
+// tenancy works out which tenant a request acts for. A tenant bound to the
+// caller's credentials wins; otherwise it is taken from the X-Tenant-ID
+// header, which only admins and anonymous callers may send. Naming another
+// tenant than the credentials are bound to is forbidden, as are credentials
+// below admin bound to no tenant when authRequired is set. Without a tenant
+// the request is rejected when required is set, and acts for the fallback
+// tenant otherwise.
+type tenancy struct {
+	required bool
+	// authRequired is set when callers must authenticate to write.
+	authRequired bool
+	// fallback also owns the data stored before tenants were introduced.
+	fallback string
+}
+
+func (t *tenancy) resolve(p *principal, header string) (string, *problem.Details) {
+	if header != "" && !tenantID.MatchString(header) {
+		return "", problem.New(http.StatusBadRequest, "The "+tenantHeader+" header is not a valid tenant ID")
+	}
+
+	if p != nil && p.Tenant != "" {
+		if header != "" && header != p.Tenant {
+			return "", problem.New(http.StatusForbidden, "The credentials are not valid for this tenant")
+		}
+		return p.Tenant, nil
+	}
+	if p != nil && roleRank[p.Role] < roleRank[roleAdmin] {
+		if t.authRequired {
+			return "", problem.New(http.StatusForbidden, "The credentials are not bound to a tenant")
+		}
+		if header != "" {
+			return "", problem.New(http.StatusForbidden, "The "+roleAdmin+" role is required to choose the tenant with the "+tenantHeader+" header")
+		}
+	}
+	if header != "" {
+		return header, nil
+	}
+
+	if t.required {
+		return "", problem.WithCode(http.StatusBadRequest, problem.CodeTenantRequired,
+			"The tenant must be named in the "+tenantHeader+" header")
+	}
+	return t.fallback, nil
+}
+
+// scopeTenant puts the tenant of each API request into its context. Routes
+// outside the API, such as health checks and metrics, have no tenant.
+func scopeTenant(t *tenancy) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, apiRoute("/")) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			tenant, err := t.resolve(principalFrom(r.Context()), r.Header.Get(tenantHeader))
+			if err != nil {
+				problem.Write(w, err)
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+		})
+	}
+}
+
+// inTenant reports whether e is about a car of the tenant.
+func (e inventoryEvent) inTenant(tenant string) bool {
+	return e.Car != nil && e.Car.Tenant == tenant
+}
+
+// backfillTenant gives the data written before tenancy to the tenant. Each
+// collection is given with the key its documents carry the tenant under.
+func backfillTenant(tenant string, collections map[*mongo.Collection]string) {
+	for c, key := range collections {
+		_, err := c.UpdateMany(context.Background(), bson.M{key: bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{key: tenant}})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTenancyResolve(t *testing.T) {
+	editor := &principal{Subject: "ed", Role: roleEditor}
+	admin := &principal{Subject: "ad", Role: roleAdmin}
+	bound := &principal{Subject: "key", Role: roleEditor, Tenant: "acme"}
+	tests := []struct {
+		name    string
+		tenancy tenancy
+		p       *principal
+		header  string
+		want    string
+		status  int
+	}{
+		{"anonymous", tenancy{fallback: "main"}, nil, "", "main", 0},
+		{"anonymous names tenant", tenancy{fallback: "main"}, nil, "acme", "acme", 0},
+		{"anonymous invalid tenant", tenancy{fallback: "main"}, nil, "Acme!", "", http.StatusBadRequest},
+		{"anonymous without tenant required", tenancy{required: true}, nil, "", "", http.StatusBadRequest},
+		{"bound", tenancy{fallback: "main"}, bound, "", "acme", 0},
+		{"bound names own tenant", tenancy{fallback: "main"}, bound, "acme", "acme", 0},
+		{"bound names another tenant", tenancy{fallback: "main"}, bound, "other", "", http.StatusForbidden},
+		{"admin names tenant", tenancy{authRequired: true, fallback: "main"}, admin, "acme", "acme", 0},
+		{"admin without header", tenancy{authRequired: true, fallback: "main"}, admin, "", "main", 0},
+		{"editor names tenant", tenancy{fallback: "main"}, editor, "acme", "", http.StatusForbidden},
+		{"editor without header", tenancy{fallback: "main"}, editor, "", "main", 0},
+		{"editor unbound with auth required", tenancy{authRequired: true, fallback: "main"}, editor, "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		got, err := tt.tenancy.resolve(tt.p, tt.header)
+		if tt.status != 0 {
+			if err == nil || err.Status != tt.status {
+				t.Errorf("%s: resolve = %q, %v, want status %d", tt.name, got, err, tt.status)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: resolve = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The states of a test drive. Only booked and started drives hold their slot.
+const (
+	driveBooked    = "booked"
+	driveStarted   = "started"
+	driveCancelled = "cancelled"
+	driveNoShow    = "no_show"
+)
+
+const (
+	minTestDrive = 15 * time.Minute
+	maxTestDrive = 3 * time.Hour
+
+	noShowSchedule = "@every 1m"
+)
+
+// testDrive is a booking of a car for a test drive between Start and End.
+type testDrive struct {
+	ID         string     `json:"id" bson:"testdriveid"`
+	VIN        string     `json:"vin"`
+	Branch     string     `json:"branch,omitempty" bson:",omitempty"`
+	CustomerID string     `json:"customer_id,omitempty" bson:"customerid,omitempty"`
+	Start      time.Time  `json:"start"`
+	End        time.Time  `json:"end"`
+	Status     string     `json:"status"`
+	BookedBy   string     `json:"booked_by,omitempty" bson:"bookedby,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" bson:"createdat"`
+	ReleasedAt *time.Time `json:"released_at,omitempty" bson:"releasedat,omitempty"`
+	// RemindedAt is when the customer was sent a reminder of the drive.
+	RemindedAt *time.Time `json:"reminded_at,omitempty" bson:"remindedat,omitempty"`
+	Tenant     string     `json:"-" bson:"tenant"`
+}
+
+type testDriveStore struct {
+	c *mongo.Collection
+}
+
+func (s *testDriveStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "testdriveid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "vin", Value: 1}, {Key: "start", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "branch", Value: 1}, {Key: "start", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "start", Value: 1}}},
+	})
+	return err
+}
+
+// overlapping returns the filter for the drives holding a slot that overlaps
+// d and were booked before it, so that of two bookings made at once the later
+// one gives way.
+func overlapping(d testDrive, filter bson.M) bson.M {
+	filter["tenant"] = d.Tenant
+	filter["status"] = bson.M{"$in": bson.A{driveBooked, driveStarted}}
+	filter["start"] = bson.M{"$lt": d.End}
+	filter["end"] = bson.M{"$gt": d.Start}
+	filter["$or"] = bson.A{
+		bson.M{"createdat": bson.M{"$lt": d.CreatedAt}},
+		bson.M{"createdat": d.CreatedAt, "testdriveid": bson.M{"$lt": d.ID}},
+	}
+	return filter
+}
+
+// conflict reports why d cannot be booked: the car is already booked for
+// part of the slot, or its branch already runs as many drives at a time as
+// it has slots for. It is empty when d can be booked.
+func (s *testDriveStore) conflict(ctx context.Context, d testDrive, branchSlots int) (string, error) {
+	n, err := s.c.CountDocuments(ctx, overlapping(d, bson.M{"vin": d.VIN}), options.Count().SetLimit(1))
+	if err != nil || n > 0 {
+		return "The car is already booked for part of this slot", err
+	}
+
+	if d.Branch == "" || branchSlots == 0 {
+		return "", nil
+	}
+	n, err = s.c.CountDocuments(ctx, overlapping(d, bson.M{"branch": d.Branch}))
+	if err != nil || n >= int64(branchSlots) {
+		return "The branch has no test drive slot free at this time", err
+	}
+	return "", nil
+}
+
+// bookTestDrive books a test drive of a car in stock. The slot is checked for
+// conflicts again once the booking is stored, so that concurrent bookings of
+// the same slot cannot both succeed.
+func bookTestDrive(s *testDriveStore, cars *mongo.Collection, dealerships *dealershipStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d testDrive
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&d)
+		if err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		length := d.End.Sub(d.Start)
+		switch {
+		case d.Start.Before(time.Now()):
+			fieldErrorWithJSON(w, "start", "invalid", "The test drive must start in the future")
+			return
+		case length < minTestDrive || length > maxTestDrive:
+			fieldErrorWithJSON(w, "end", "invalid", "A test drive must last between 15 minutes and 3 hours")
+			return
+		}
+
+		var car vehicle
+		err = cars.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+		if car.SoldAt != nil || car.Status == carSold || car.Status == carWrittenOff {
+			errorWithJSON(w, "The car has been sold or written off", http.StatusConflict)
+			return
+		}
+
+		var branchSlots int
+		if car.Branch != "" {
+			branch, err := dealerships.find(r.Context(), car.Branch)
+			if err != nil && err != mongo.ErrNoDocuments {
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find dealership", "err", err)
+				return
+			}
+			branchSlots = branch.TestDriveSlots
+		}
+
+		d.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		d.VIN = car.VIN
+		d.Branch = car.Branch
+		d.Start = d.Start.UTC()
+		d.End = d.End.UTC()
+		d.Status = driveBooked
+		d.ReleasedAt = nil
+		d.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+		d.Tenant = tenantFrom(r.Context())
+		if p := principalFrom(r.Context()); p != nil {
+			d.BookedBy = p.Subject
+		}
+
+		reason, err := s.conflict(r.Context(), d, branchSlots)
+		if err == nil && reason == "" {
+			_, err = s.c.InsertOne(r.Context(), d)
+			if err == nil {
+				reason, err = s.conflict(r.Context(), d, branchSlots)
+			}
+			if err == nil && reason != "" {
+				_, err = s.c.DeleteOne(r.Context(), bson.M{"tenant": d.Tenant, "testdriveid": d.ID})
+			}
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed book test drive", "err", err)
+			return
+		}
+		if reason != "" {
+			errorWithJSON(w, reason, http.StatusConflict)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/cars/"+d.VIN+"/testdrives/"+d.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+// carTestDrives lists the test drives of a car, soonest first. Past and
+// released drives are included with ?all=true.
+func carTestDrives(s *testDriveStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := forTenant(r.Context(), bson.M{"vin": carVIN(r)})
+		if r.URL.Query().Get("all") != "true" {
+			filter["status"] = bson.M{"$in": bson.A{driveBooked, driveStarted}}
+			filter["end"] = bson.M{"$gt": time.Now()}
+		}
+
+		drives := []testDrive{}
+		cur, err := s.c.Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "start", Value: 1}}))
+		if err == nil {
+			err = cur.All(r.Context(), &drives)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list test drives", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(drives, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// moveTestDrive changes the status of a booked test drive and returns it.
+func moveTestDrive(w http.ResponseWriter, r *http.Request, s *testDriveStore, status string) {
+	filter := forTenant(r.Context(), bson.M{
+		"vin":         carVIN(r),
+		"testdriveid": pat.Param(r, "id"),
+		"status":      driveBooked,
+	})
+	set := bson.M{"status": status}
+	if status == driveCancelled {
+		set["releasedat"] = time.Now().UTC()
+	}
+
+	var d testDrive
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.c.FindOneAndUpdate(r.Context(), filter, bson.M{"$set": set}, opts).Decode(&d)
+	if err != nil {
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed update test drive", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "Booked test drive not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	respBody, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, http.StatusOK)
+}
+
+// cancelTestDrive cancels a booked test drive, freeing its slot.
+func cancelTestDrive(s *testDriveStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moveTestDrive(w, r, s, driveCancelled)
+	}
+}
+
+// startTestDrive checks the customer in for a booked test drive, so that it
+// is not released as a no-show.
+func startTestDrive(s *testDriveStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moveTestDrive(w, r, s, driveStarted)
+	}
+}
+
+// noShowReleaser releases the slots of test drives the customer has not been
+// checked in for within grace of the start, so the car can be booked again
+// for the rest of the slot.
+type noShowReleaser struct {
+	drives *testDriveStore
+	grace  time.Duration
+}
+
+func (n *noShowReleaser) release(ctx context.Context) error {
+	now := time.Now().UTC()
+	res, err := n.drives.c.UpdateMany(context.WithoutCancel(ctx),
+		bson.M{"status": driveBooked, "start": bson.M{"$lt": now.Add(-n.grace)}},
+		bson.M{"$set": bson.M{"status": driveNoShow, "releasedat": now}})
+	if err != nil {
+		return fmt.Errorf("release no-show test drives: %w", err)
+	}
+	if res.ModifiedCount > 0 {
+		slog.InfoContext(ctx, "Released no-show test drives", "count", res.ModifiedCount)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"problem"
+)
+
+// untimedRoutes get no deadline: event streams and WebSockets last as long
+// as the client wants, and bulk transfers and reindexing as long as the data
+// takes. So do backups, every route under untimedTrees.
+var (
+	untimedRoutes = []string{"/cars/events", "/cars/stream", "/cars/ws", "/cars/export", "/cars/import", "/admin/reindex"}
+	untimedTrees  = []string{"/admin/backups"}
+)
+
+func underUntimedTree(path string) bool {
+	for _, p := range untimedTrees {
+		if path == apiRoute(p) || strings.HasPrefix(path, apiRoute(p)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// deadlineRequests gives each request's context a deadline timeout away, which
+// the database calls made with it keep to. A request the deadline cuts short
+// is answered with 504 instead of the error its handler makes of it. Zero
+// timeout sets no deadline.
+func deadlineRequests(timeout time.Duration) func(http.Handler) http.Handler {
+	untimed := map[string]bool{}
+	for _, p := range untimedRoutes {
+		untimed[apiRoute(p)] = true
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if timeout == 0 || untimed[r.URL.Path] || underUntimedTree(r.URL.Path) || r.URL.Query().Get("format") == "ndjson" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			h.ServeHTTP(&deadlineWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+		})
+	}
+}
+
+// deadlineWriter replaces a server error written after ctx's deadline with a
+// 504, dropping the error's body.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	wrote    bool
+	timedOut bool
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	if dw.wrote {
+		return
+	}
+	dw.wrote = true
+	if code >= 500 && dw.ctx.Err() == context.DeadlineExceeded {
+		dw.timedOut = true
+		errorWithCode(dw.ResponseWriter, problem.CodeTimeout, "The request took too long", http.StatusGatewayTimeout)
+		return
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	if !dw.wrote {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if dw.timedOut {
+		return len(b), nil
+	}
+	return dw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far; a response flushed is under way,
+// and no longer replaced.
+func (dw *deadlineWriter) Flush() {
+	dw.wrote = true
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok && !dw.timedOut {
+		f.Flush()
+	}
+}
+
+func (dw *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := dw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	dw.wrote = true
+	return h.Hijack()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineRequestsStreamEvents(t *testing.T) {
+	events := newBroker()
+	defer events.close()
+	srv := httptest.NewServer(deadlineRequests(50 * time.Millisecond)(http.HandlerFunc(carEvents(events))))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + apiRoute("/cars/events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func(prefix string) {
+		t.Helper()
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return
+			}
+		}
+		t.Fatalf("stream ended before %q: %v", prefix, lines.Err())
+	}
+
+	// The stream outlives the deadline of other requests.
+	time.Sleep(100 * time.Millisecond)
+	events.publish(context.Background(), inventoryEvent{Type: eventCreated, VIN: "V1", Car: &vehicle{VIN: "V1"}})
+	next("event: " + eventCreated)
+}
+
+func TestDeadlineWriterFlushes(t *testing.T) {
+	flushed := make(chan struct{})
+	h := deadlineRequests(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("first\n"))
+		flusher.Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + apiRoute("/cars"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != "first" {
+		t.Fatalf("first line = %q, %v; want it flushed before the handler ends", lines.Text(), lines.Err())
+	}
+	close(flushed)
+	if !lines.Scan() || lines.Text() != "second" {
+		t.Fatalf("second line = %q, %v", lines.Text(), lines.Err())
+	}
+}
+
+func TestDeadlineWriterHijacks(t *testing.T) {
+	h := deadlineRequests(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		buf.Flush()
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + apiRoute("/cars/ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want 101", resp.StatusCode)
+	}
+}
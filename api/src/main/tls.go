@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"config"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS returns the TLS configuration the server listens with, or nil to
+// serve plain HTTP. Certificates come either from files or from Let's
+// Encrypt via autocert.
+func serverTLS(cfg *config.Config) (*tls.Config, error) {
+	var tc *tls.Config
+
+	switch {
+	case cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case len(cfg.TLSAutocertHosts) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertHosts...),
+			Cache:      autocert.DirCache(cfg.TLSAutocertCacheDir),
+		}
+		tc = m.TLSConfig()
+	default:
+		return nil, nil
+	}
+	tc.MinVersion = tls.VersionTLS12
+
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("client CA file holds no certificates")
+		}
+		// Certificates are verified when offered; requireClientCert decides
+		// which requests must offer one.
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tc, nil
+}
+
+// requireClientCert rejects writes made without a verified client
+// certificate. Reads are always allowed so browsers keep working.
+func requireClientCert(required bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if required && !isRead(r) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				errorWithJSON(w, "Client certificate required", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
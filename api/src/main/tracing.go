@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "carsupermarket-api"
+
+var tracer = otel.Tracer("carsupermarket")
+
+// setupTracing installs the W3C trace context propagator and, when endpoint
+// is set, a tracer provider exporting spans to that OTLP/HTTP collector. The
+// returned function flushes outstanding spans.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// traceRequests starts a server span for each request, continuing any trace
+// the caller propagated in the traceparent header.
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routePattern(r)
+
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := newStatusRecorder(w)
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// mongoSpans turns driver command events into client spans that are children
+// of the span in the operation's context.
+type mongoSpans struct {
+	spans sync.Map
+}
+
+func (m *mongoSpans) started(ctx context.Context, e *event.CommandStartedEvent) {
+	_, span := tracer.Start(ctx, "mongodb."+e.CommandName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", e.DatabaseName),
+			attribute.String("db.operation", e.CommandName),
+		),
+	)
+	m.spans.Store(e.RequestID, span)
+}
+
+func (m *mongoSpans) finished(e *event.CommandFinishedEvent, err string) {
+	v, ok := m.spans.LoadAndDelete(e.RequestID)
+	if !ok {
+		return
+	}
+
+	span := v.(trace.Span)
+	if err != "" {
+		span.SetStatus(codes.Error, err)
+	}
+	span.End()
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The states of a trade-in. A customer submits it, staff appraise it, and the
+// customer accepts or declines the appraisal. Only accepted trade-ins can be
+// put towards an order.
+const (
+	tradeInSubmitted = "submitted"
+	tradeInAppraised = "appraised"
+	tradeInAccepted  = "accepted"
+	tradeInDeclined  = "declined"
+)
+
+const (
+	maxTradeInPhotos = 10
+	appraisalValid   = 7 * 24 * time.Hour
+)
+
+// tradeIn is a car a customer offers in part-exchange.
+type tradeIn struct {
+	ID          string     `json:"id" bson:"tradeinid"`
+	Customer    buyer      `json:"customer"`
+	Car         tradeInCar `json:"car"`
+	Photos      []carImage `json:"photos,omitempty" bson:",omitempty"`
+	Status      string     `json:"status"`
+	Appraisal   *appraisal `json:"appraisal,omitempty" bson:",omitempty"`
+	Order       string     `json:"order,omitempty" bson:",omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at" bson:"submittedat"`
+	UpdatedAt   time.Time  `json:"updated_at" bson:"updatedat"`
+	Tenant      string     `json:"-" bson:"tenant"`
+}
+
+// tradeInCar is the customer's description of the car they are trading in.
+type tradeInCar struct {
+	VIN          string `json:"vin,omitempty" bson:",omitempty"`
+	RegNo        string `json:"regno,omitempty" bson:",omitempty"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	Year         int    `json:"year,omitempty" bson:",omitempty"`
+	Mileage      int    `json:"mileage,omitempty" bson:",omitempty"`
+	Condition    string `json:"condition,omitempty" bson:",omitempty"`
+	Notes        string `json:"notes,omitempty" bson:",omitempty"`
+}
+
+// appraisal is what the dealership offers for a trade-in, until ValidUntil.
+type appraisal struct {
+	Value      price     `json:"value"`
+	Notes      string    `json:"notes,omitempty" bson:",omitempty"`
+	ValidUntil time.Time `json:"valid_until" bson:"validuntil"`
+	By         string    `json:"by,omitempty" bson:",omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// tradeInAllowance is the accepted trade-in an order is part paid with.
+type tradeInAllowance struct {
+	ID    string `json:"id" bson:"tradeinid"`
+	Value price  `json:"value"`
+}
+
+func (t *tradeIn) validate() *fieldError {
+	c := &checks{}
+	c.require("customer", t.Customer.Name, "The customer's name is required")
+	c.require("customer", t.Customer.Email+t.Customer.Phone, "An email address or phone number is required")
+	c.check(t.Customer.Email == "" || strings.Contains(t.Customer.Email, "@"), "customer", "The email address is not valid")
+	c.require("car", t.Car.Manufacturer, "The car's manufacturer is required")
+	c.require("car", t.Car.Model, "The car's model is required")
+	c.maxLength("car", t.Car.Manufacturer, maxNameLength)
+	c.maxLength("car", t.Car.Model, maxNameLength)
+	c.check(t.Car.Mileage >= 0, "car", "The mileage must not be negative")
+	c.check(t.Car.Year == 0 || t.Car.Year >= 1900 && t.Car.Year <= time.Now().Year()+1, "car", "The year is not valid")
+	return c.err()
+}
+
+type tradeInStore struct {
+	c *mongo.Collection
+}
+
+func (s *tradeInStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "tradeinid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "status", Value: 1}, {Key: "submittedat", Value: -1}}},
+	})
+	return err
+}
+
+func writeTradeIn(w http.ResponseWriter, t tradeIn, status int) {
+	respBody, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	responseWithJSON(w, respBody, status)
+}
+
+// submitTradeIn takes a customer's offer of their car in part-exchange.
+func submitTradeIn(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t tradeIn
+		if !decodeBody(w, r.Body, &t) {
+			return
+		}
+
+		if err := t.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		t.ID, err = randomHex(8)
+		if err != nil {
+			panic(err)
+		}
+		t.Car.VIN = strings.ToUpper(t.Car.VIN)
+		t.Photos = nil
+		t.Status = tradeInSubmitted
+		t.Appraisal = nil
+		t.Order = ""
+		t.SubmittedAt = time.Now().UTC()
+		t.UpdatedAt = t.SubmittedAt
+		t.Tenant = tenantFrom(r.Context())
+
+		_, err = s.c.InsertOne(r.Context(), t)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert trade-in", "err", err)
+			return
+		}
+
+		w.Header().Set("Location", apiRoute("/trade-ins/"+t.ID))
+		writeTradeIn(w, t, http.StatusCreated)
+	}
+}
+
+// uploadTradeInPhoto adds a photo to a trade-in that has not been appraised
+// yet.
+func uploadTradeInPhoto(s *tradeInStore, photos photoStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := pat.Param(r, "id")
+
+		filter := forTenant(r.Context(), bson.M{
+			"tradeinid": id,
+			"status":    tradeInSubmitted,
+			"photos." + strconv.Itoa(maxTradeInPhotos-1): bson.M{"$exists": false},
+		})
+		n, err := s.c.CountDocuments(r.Context(), filter)
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find trade-in", "err", err)
+			return
+		}
+		if n == 0 {
+			errorWithJSON(w, "No trade-in awaiting appraisal with room for more photos", http.StatusNotFound)
+			return
+		}
+
+		image, ok := storePhoto(w, r, photos, "tradein:"+id, bson.M{"tradein": id})
+		if !ok {
+			return
+		}
+
+		var t tradeIn
+		update := bson.M{"$push": bson.M{"photos": image}, "$set": bson.M{"updatedat": time.Now().UTC()}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = s.c.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&t)
+		if err != nil {
+			// The photo belongs to no trade-in, so it is not kept.
+			if oid, err := primitive.ObjectIDFromHex(image.ID); err == nil {
+				photos.delete(context.WithoutCancel(r.Context()), oid)
+			}
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed add trade-in photo", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "No trade-in awaiting appraisal with room for more photos", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(image, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/trade-ins/"+id+"/photos/"+image.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+// tradeInPhoto serves a photo of a trade-in to staff.
+func tradeInPhoto(photos photoStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oid, err := primitive.ObjectIDFromHex(pat.Param(r, "photo"))
+		if err != nil {
+			errorWithJSON(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+
+		sendPhoto(w, r, photos, bson.M{"_id": oid, "metadata.tradein": pat.Param(r, "id")}, false)
+	}
+}
+
+// allTradeIns lists the trade-ins, newest first, with ?status= to pick out
+// those in one state.
+func allTradeIns(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := forTenant(r.Context(), bson.M{})
+		if v := r.URL.Query().Get("status"); v != "" {
+			filter["status"] = v
+		}
+
+		tradeIns := []tradeIn{}
+		opts := options.Find().SetSort(bson.D{{Key: "submittedat", Value: -1}, {Key: "tradeinid", Value: 1}})
+		cur, err := s.c.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &tradeIns)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list trade-ins", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(tradeIns, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func tradeInByID(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t tradeIn
+		err := s.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"tradeinid": pat.Param(r, "id")})).Decode(&t)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find trade-in", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Trade-in not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		writeTradeIn(w, t, http.StatusOK)
+	}
+}
+
+// moveTradeIn applies set to the trade-in with the ID in the route if it
+// matches filter, and returns it. A trade-in that exists but does not match
+// gets a 409 with conflict as its message.
+func moveTradeIn(w http.ResponseWriter, r *http.Request, s *tradeInStore, filter, set bson.M, conflict string) {
+	id := pat.Param(r, "id")
+	filter["tradeinid"] = id
+	set["updatedat"] = time.Now().UTC()
+
+	var t tradeIn
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.c.FindOneAndUpdate(r.Context(), forTenant(r.Context(), filter), bson.M{"$set": set}, opts).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		var n int64
+		n, err = s.c.CountDocuments(r.Context(), forTenant(r.Context(), bson.M{"tradeinid": id}))
+		if err == nil && n == 0 {
+			errorWithJSON(w, "Trade-in not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			errorWithJSON(w, conflict, http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed update trade-in", "err", err)
+		return
+	}
+
+	writeTradeIn(w, t, http.StatusOK)
+}
+
+// appraiseTradeIn records what the dealership offers for a trade-in. A
+// trade-in may be appraised again until the customer has answered.
+func appraiseTradeIn(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a appraisal
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&a); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		a.At = time.Now().UTC()
+		if a.ValidUntil.IsZero() {
+			a.ValidUntil = a.At.Add(appraisalValid)
+		}
+		switch {
+		case a.Value.Amount < 0 || !currencyCode.MatchString(a.Value.Currency):
+			fieldErrorWithJSON(w, "value", "invalid", "The value must not be negative and in an ISO 4217 currency")
+			return
+		case !a.ValidUntil.After(a.At):
+			fieldErrorWithJSON(w, "valid_until", "invalid", "The appraisal must be valid until a time in the future")
+			return
+		}
+		a.ValidUntil = a.ValidUntil.UTC()
+		a.By = ""
+		if p := principalFrom(r.Context()); p != nil {
+			a.By = p.Subject
+		}
+
+		filter := bson.M{"status": bson.M{"$in": bson.A{tradeInSubmitted, tradeInAppraised}}}
+		set := bson.M{"status": tradeInAppraised, "appraisal": a}
+		moveTradeIn(w, r, s, filter, set, "The customer has already answered the appraisal")
+	}
+}
+
+// acceptTradeIn records that the customer accepts the appraisal, while it is
+// still valid.
+func acceptTradeIn(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{"status": tradeInAppraised, "appraisal.validuntil": bson.M{"$gt": time.Now()}}
+		moveTradeIn(w, r, s, filter, bson.M{"status": tradeInAccepted}, "The trade-in has no valid appraisal to accept")
+	}
+}
+
+// declineTradeIn records that the customer turns the trade-in down.
+func declineTradeIn(s *tradeInStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := bson.M{"status": bson.M{"$in": bson.A{tradeInSubmitted, tradeInAppraised}}}
+		moveTradeIn(w, r, s, filter, bson.M{"status": tradeInDeclined}, "The trade-in has already been accepted or declined")
+	}
+}
+
+// linkTradeIn puts an accepted trade-in towards an open order. The trade-in
+// is claimed first, so it cannot go towards two orders, and let go again if
+// the order cannot take it.
+func linkTradeIn(s *tradeInStore, orders *orderStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Order string `json:"order"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if req.Order == "" {
+			fieldErrorWithJSON(w, "order", "required", "The order is required")
+			return
+		}
+
+		var t tradeIn
+		filter := forTenant(r.Context(), bson.M{
+			"tradeinid": pat.Param(r, "id"),
+			"status":    tradeInAccepted,
+			"order":     bson.M{"$exists": false},
+		})
+		update := bson.M{"$set": bson.M{"order": req.Order, "updatedat": time.Now().UTC()}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := s.c.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&t)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed claim trade-in", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "No accepted trade-in that is not yet on an order", http.StatusConflict)
+				return
+			}
+		}
+
+		allowance := tradeInAllowance{ID: t.ID, Value: t.Appraisal.Value}
+		orderFilter := forTenant(r.Context(), bson.M{
+			"orderid":        req.Order,
+			"status":         orderOpen,
+			"tradein":        bson.M{"$exists": false},
+			"price.currency": allowance.Value.Currency,
+		})
+		res, err := orders.c.UpdateOne(r.Context(), orderFilter, bson.M{"$set": bson.M{"tradein": allowance}})
+		if err != nil || res.MatchedCount == 0 {
+			_, rerr := s.c.UpdateOne(r.Context(), forTenant(r.Context(), bson.M{"tradeinid": t.ID}),
+				bson.M{"$unset": bson.M{"order": ""}})
+			if rerr != nil {
+				slog.ErrorContext(r.Context(), "Failed release trade-in", "tradein", t.ID, "err", rerr)
+			}
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed link trade-in", "err", err)
+			return
+		}
+		if res.MatchedCount == 0 {
+			fieldErrorWithJSON(w, "order", "invalid", "There is no open order in the trade-in's currency without a trade-in")
+			return
+		}
+
+		writeTradeIn(w, t, http.StatusOK)
+	}
+}
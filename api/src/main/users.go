@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+	"golang.org/x/crypto/scrypt"
+)
+
+// minPasswordLength is the shortest password a user may be given.
+const minPasswordLength = 12
+
+// The cost of the scrypt password hashes. Hashes keep the parameters they
+// were made with, so these can be raised without invalidating passwords.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+var validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]{2,63}$`)
+
+// user is a person who signs in with a password at POST /login. Usernames
+// are unique across tenants, and each user is bound to the tenant they were
+// made in.
+type user struct {
+	Username     string    `json:"username"`
+	Role         string    `json:"role"`
+	PasswordHash string    `json:"-" bson:"passwordhash"`
+	Tenant       string    `json:"tenant"`
+	CreatedAt    time.Time `json:"created_at" bson:"createdat"`
+	CreatedBy    string    `json:"created_by,omitempty" bson:"createdby,omitempty"`
+	// PasswordChangedAt is when the password was last changed, if it has
+	// been since the user was made.
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty" bson:"passwordchangedat,omitempty"`
+	DisabledAt        *time.Time `json:"disabled_at,omitempty" bson:"disabledat,omitempty"`
+}
+
+// subject is the user as the subject of their tokens, and of the audit trail.
+func (u user) subject() string {
+	return "user:" + u.Username
+}
+
+type userStore struct {
+	c *mongo.Collection
+}
+
+func (s *userStore) ensureIndex(ctx context.Context) error {
+	_, err := s.c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "username", Value: 1}}},
+	})
+	return err
+}
+
+// hashPassword returns a salted scrypt hash of password, holding the salt and
+// parameters it was made with.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", scryptN, scryptR, scryptP, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password is the one hash was made from.
+func checkPassword(hash, password string) bool {
+	var n, r, p int
+	var salt, key string
+	_, err := fmt.Sscanf(strings.ReplaceAll(hash, "$", " "), "scrypt %d %d %d %s %s", &n, &r, &p, &salt, &key)
+	if err != nil {
+		return false
+	}
+
+	enc := base64.RawStdEncoding
+	saltBytes, err := enc.DecodeString(salt)
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(key)
+	if err != nil {
+		return false
+	}
+	got, err := scrypt.Key([]byte(password), saltBytes, n, r, p, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// unknownUserHash is checked against when a login names no user, so that how
+// long a login takes does not tell whether the user exists.
+var unknownUserHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("unknown user")
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// passwordError returns what is wrong with password, or nil.
+func passwordError(password string) *fieldError {
+	if len(password) < minPasswordLength {
+		return &fieldError{Field: "password", Reason: "invalid", Message: fmt.Sprintf("Passwords must be at least %d characters", minPasswordLength)}
+	}
+	return nil
+}
+
+// authenticate returns the enabled user with the username and password.
+func (s *userStore) authenticate(ctx context.Context, username, password string) (*user, error) {
+	var u user
+	err := s.c.FindOne(ctx, bson.M{"username": strings.ToLower(username)}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		checkPassword(unknownUserHash(), password)
+		return nil, errInvalidLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !checkPassword(u.PasswordHash, password) || u.DisabledAt != nil {
+		return nil, errInvalidLogin
+	}
+	return &u, nil
+}
+
+// enabled returns the user with the username, unless they are disabled.
+func (s *userStore) enabled(ctx context.Context, username string) (*user, error) {
+	var u user
+	err := s.c.FindOne(ctx, bson.M{"username": username, "disabledat": bson.M{"$exists": false}}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return nil, errInvalidLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// bootstrap makes an admin user of the tenant with the username and
+// password, unless there is a user of that name already.
+func (s *userStore) bootstrap(ctx context.Context, tenant, username, password string) error {
+	if !validUsername.MatchString(username) {
+		return fmt.Errorf("bootstrap admin %q is not a valid username", username)
+	}
+	if err := passwordError(password); err != nil {
+		return errors.New(err.Message)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.InsertOne(ctx, user{Username: username, Role: roleAdmin, PasswordHash: hash, Tenant: tenant, CreatedAt: time.Now().UTC(), CreatedBy: "system:bootstrap"})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func createUser(s *userStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+
+		req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+		if !validUsername.MatchString(req.Username) {
+			fieldErrorWithJSON(w, "username", "invalid", "Usernames must be 3 to 64 letters, digits or . _ @ -")
+			return
+		}
+		if err := passwordError(req.Password); err != nil {
+			fieldErrorWithJSON(w, err.Field, err.Reason, err.Message)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleViewer
+		}
+		if _, ok := roleRank[req.Role]; !ok {
+			fieldErrorWithJSON(w, "role", "invalid", "Role must be viewer, editor or admin")
+			return
+		}
+
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			panic(err)
+		}
+		u := user{
+			Username:     req.Username,
+			Role:         req.Role,
+			PasswordHash: hash,
+			Tenant:       tenantFrom(r.Context()),
+			CreatedAt:    time.Now().UTC(),
+		}
+		if p := principalFrom(r.Context()); p != nil {
+			u.CreatedBy = p.Subject
+		}
+
+		_, err = s.c.InsertOne(r.Context(), u)
+		if mongo.IsDuplicateKeyError(err) {
+			errorWithJSON(w, "A user with this username already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert user", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(u, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func allUsers(s *userStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users := []user{}
+		cur, err := s.c.Find(r.Context(), forTenant(r.Context(), bson.M{}), options.Find().SetSort(bson.D{{Key: "username", Value: 1}}))
+		if err == nil {
+			err = cur.All(r.Context(), &users)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list users", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(users, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// disableUser stops a user signing in, and ends their sessions once their
+// access tokens expire.
+func disableUser(s *userStore, sessions *sessionIssuer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := pat.Param(r, "username")
+
+		var u user
+		err := s.c.FindOneAndUpdate(r.Context(),
+			forTenant(r.Context(), bson.M{"username": username}),
+			bson.M{"$set": bson.M{"disabledat": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&u)
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed disable user", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "User not found", http.StatusNotFound)
+			return
+		case nil:
+		}
+
+		if err := sessions.revokeAll(r.Context(), username); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed revoke refresh tokens", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(u, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// changePassword serves PUT /users/:username/password. Users change their
+// own password by giving the current one too; admins may set any user's
+// without it. Either way the user's sessions are ended.
+func changePassword(a *authenticator, s *userStore, sessions *sessionIssuer) http.HandlerFunc {
+	byAdmin := requireRole(a, roleAdmin, setPassword(s, sessions, false))
+	bySelf := setPassword(s, sessions, true)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFrom(r.Context()); p != nil && p.Subject == (user{Username: pat.Param(r, "username")}).subject() {
+			bySelf(w, r)
+			return
+		}
+		byAdmin(w, r)
+	}
+}
+
+func setPassword(s *userStore, sessions *sessionIssuer, needCurrent bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := pat.Param(r, "username")
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			Password        string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			incorrectBody(w, err)
+			return
+		}
+		if err := passwordError(req.Password); err != nil {
+			fieldErrorWithJSON(w, err.Field, err.Reason, err.Message)
+			return
+		}
+
+		var u user
+		err := s.c.FindOne(r.Context(), forTenant(r.Context(), bson.M{"username": username})).Decode(&u)
+		switch err {
+		default:
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed find user", "err", err)
+			return
+		case mongo.ErrNoDocuments:
+			errorWithJSON(w, "User not found", http.StatusNotFound)
+			return
+		case nil:
+		}
+		if needCurrent && !checkPassword(u.PasswordHash, req.CurrentPassword) {
+			fieldErrorWithJSON(w, "current_password", "invalid", "The current password is wrong")
+			return
+		}
+
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			panic(err)
+		}
+		_, err = s.c.UpdateOne(r.Context(), bson.M{"username": username},
+			bson.M{"$set": bson.M{"passwordhash": hash, "passwordchangedat": time.Now().UTC()}})
+		if err == nil {
+			err = sessions.revokeAll(r.Context(), username)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed change password", "err", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
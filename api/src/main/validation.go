@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"problem"
+)
+
+// The longest the free text fields of request bodies may be, in characters.
+const (
+	maxNameLength  = 100
+	maxRegNoLength = 16
+)
+
+// fieldError is a request field that failed validation. When more than one
+// did, it is the first and Errors holds them all.
+type fieldError struct {
+	Message string
+	Field   string
+	Reason  string
+	Errors  []fieldError
+}
+
+// all returns every field that failed, as problem details list them.
+func (e *fieldError) all() []problem.FieldError {
+	errs := e.Errors
+	if len(errs) == 0 {
+		errs = []fieldError{*e}
+	}
+	fields := make([]problem.FieldError, len(errs))
+	for i, f := range errs {
+		fields[i] = problem.FieldError{Field: f.Field, Reason: f.Reason, Detail: f.Message}
+	}
+	return fields
+}
+
+// String gives every field that failed and why, for the APIs that report
+// errors as text.
+func (e *fieldError) String() string {
+	var parts []string
+	for _, f := range e.all() {
+		parts = append(parts, f.Field+": "+f.Detail)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// checks collects the fields of a request body that fail validation, so
+// that all of them are reported at once rather than one per attempt.
+type checks struct {
+	errs []fieldError
+}
+
+func (c *checks) fail(field, reason, message string) {
+	c.errs = append(c.errs, fieldError{Message: message, Field: field, Reason: reason})
+}
+
+// check fails field as invalid unless ok.
+func (c *checks) check(ok bool, field, message string) {
+	if !ok {
+		c.fail(field, "invalid", message)
+	}
+}
+
+// require fails field unless value has more than whitespace.
+func (c *checks) require(field, value, message string) {
+	if strings.TrimSpace(value) == "" {
+		c.fail(field, "required", message)
+	}
+}
+
+// maxLength fails field if value is longer than max characters.
+func (c *checks) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		c.fail(field, "too_long", fmt.Sprintf("The %s must be at most %d characters", strings.ReplaceAll(field, "_", " "), max))
+	}
+}
+
+// oneOf fails field if value is set but not one of those allowed.
+func (c *checks) oneOf(field, value string, allowed map[string]bool, message string) {
+	if value != "" && !allowed[value] {
+		c.fail(field, "invalid", message)
+	}
+}
+
+// err returns the fields that failed, or nil.
+func (c *checks) err() *fieldError {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	if len(c.errs) > 1 {
+		err.Errors = c.errs
+	}
+	return &err
+}
+
+// fieldErrorsWithJSON writes the 422 response for the fields of err.
+func fieldErrorsWithJSON(w http.ResponseWriter, err *fieldError) {
+	detail := err.Message
+	if len(err.Errors) > 1 {
+		detail = fmt.Sprintf("%d fields are not valid", len(err.Errors))
+	}
+	problem.Write(w, problem.InvalidFields(detail, err.all()))
+}
+
+// validateOnly reads ?validate_only=, which has a write checked as it would
+// be made, duplicates included, and its result answered without making it.
+// It writes the error response and returns false for ok when the parameter
+// is not a boolean.
+func validateOnly(w http.ResponseWriter, r *http.Request) (on, ok bool) {
+	v := r.URL.Query().Get("validate_only")
+	if v == "" {
+		return false, true
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		errorWithJSON(w, "Parameter \"validate_only\" must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return on, true
+}
+
+// decodeBody decodes the JSON request body into v. It writes the error
+// response and returns false when it cannot: 422 naming the field when a
+// value is of the wrong type, 413 when the body is over its limit, else 400.
+func decodeBody(w http.ResponseWriter, body io.Reader, v interface{}) bool {
+	return decodeJSON(w, json.NewDecoder(body), v)
+}
+
+// decodeStrict is decodeBody for the bodies that set up behaviour, such as
+// webhooks, in which a misspelt field would otherwise be silently ignored:
+// a field v does not have is refused with 422.
+func decodeStrict(w http.ResponseWriter, body io.Reader, v interface{}) bool {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	return decodeJSON(w, decoder, v)
+}
+
+func decodeJSON(w http.ResponseWriter, decoder *json.Decoder, v interface{}) bool {
+	err := decoder.Decode(v)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		fieldErrorWithJSON(w, typeErr.Field, "type", fmt.Sprintf("The %s must not be a JSON %s", typeErr.Field, typeErr.Value))
+		return false
+	}
+	// The decoder has no error type for an unknown field.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		fieldErrorWithJSON(w, field, "unknown", fmt.Sprintf("There is no %s field", field))
+		return false
+	}
+	incorrectBody(w, err)
+	return false
+}
+
+// incorrectBody writes the response to a request body that could not be
+// read or decoded because of err: 413 when it is over its limit, else 400.
+func incorrectBody(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errorWithJSON(w, fmt.Sprintf("The body must be at most %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	errorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+}
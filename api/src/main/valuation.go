@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// valuation is an estimate of what a car is worth, with the range it is
+// likely to fall in.
+type valuation struct {
+	VIN      string    `json:"vin"`
+	Estimate price     `json:"estimate"`
+	Low      price     `json:"low"`
+	High     price     `json:"high"`
+	Provider string    `json:"provider"`
+	ValuedAt time.Time `json:"valued_at"`
+	// Revision is the revision of the car that was valued.
+	Revision int64 `json:"revision"`
+}
+
+// errNotValuable is returned by a valuationProvider when the car lacks what
+// it needs to value it.
+var errNotValuable = errors.New("The car cannot be valued without a price and year")
+
+// valuationProvider estimates what cars are worth.
+type valuationProvider interface {
+	name() string
+	value(ctx context.Context, car vehicle) (valuation, error)
+}
+
+// depreciationModel values a car from its list price, taking off a share for
+// each year of its age and for the miles it has done over the average, or
+// adding some back for fewer. A car is never valued below a tenth of its list
+// price.
+type depreciationModel struct {
+	// annualRate is the share of its value a car loses each year.
+	annualRate float64
+	// milesPerYear is the average mileage, and perMile the share of the list
+	// price each mile above it takes off.
+	milesPerYear int
+	perMile      float64
+}
+
+var defaultDepreciation = depreciationModel{annualRate: 0.15, milesPerYear: 10000, perMile: 0.000005}
+
+func (d depreciationModel) name() string { return "depreciation" }
+
+func (d depreciationModel) value(ctx context.Context, car vehicle) (valuation, error) {
+	if car.Price == nil || car.Price.Amount <= 0 || car.Year == 0 {
+		return valuation{}, errNotValuable
+	}
+
+	list := float64(car.Price.Amount)
+	age := time.Now().Year() - car.Year
+	if age < 0 {
+		age = 0
+	}
+	v := list * math.Pow(1-d.annualRate, float64(age))
+
+	excess := car.Mileage - d.milesPerYear*age
+	v -= math.Max(float64(excess)*d.perMile, -0.1) * list
+	v = math.Max(v, list/10)
+
+	estimate := int64(math.Round(v))
+	return valuation{
+		VIN:      car.VIN,
+		Estimate: price{Amount: estimate, Currency: car.Price.Currency},
+		Low:      price{Amount: estimate * 9 / 10, Currency: car.Price.Currency},
+		High:     price{Amount: estimate * 11 / 10, Currency: car.Price.Currency},
+		Provider: d.name(),
+	}, nil
+}
+
+// valuer answers valuations from a provider, cached per car revision for ttl
+// so that providers charged per lookup are not asked again for a car that
+// has not changed.
+type valuer struct {
+	provider valuationProvider
+	cache    cacheStore
+	ttl      time.Duration
+}
+
+func (v *valuer) cacheKey(car vehicle) string {
+	return "valuation:" + car.Tenant + ":" + car.VIN + ":" + strconv.FormatInt(car.Revision, 10)
+}
+
+// valueCar returns the valuation of a car, where flagValuation is on.
+func valueCar(c *mongo.Collection, v *valuer, flags *featureFlags) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !flags.enabled(r.Context(), flagValuation) {
+			errorWithJSON(w, "Valuations are not enabled", http.StatusNotFound)
+			return
+		}
+
+		var car vehicle
+		err := c.FindOne(r.Context(), liveCar(r.Context(), carVIN(r))).Decode(&car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+				slog.ErrorContext(r.Context(), "Failed find car", "err", err)
+				return
+			case mongo.ErrNoDocuments:
+				errorWithJSON(w, "Car not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		key := v.cacheKey(car)
+		if body, ok := v.cache.get(key); ok {
+			w.Header().Set("X-Cache", "HIT")
+			responseWithJSON(w, body, http.StatusOK)
+			return
+		}
+
+		val, err := v.provider.value(r.Context(), car)
+		if err != nil {
+			switch err {
+			default:
+				errorWithJSON(w, "Valuation unavailable", http.StatusBadGateway)
+				slog.ErrorContext(r.Context(), "Failed value car", "provider", v.provider.name(), "err", err)
+				return
+			case errNotValuable:
+				errorWithJSON(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		val.ValuedAt = time.Now().UTC()
+		val.Revision = car.Revision
+
+		respBody, err := json.MarshalIndent(val, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		if v.ttl > 0 {
+			v.cache.set(key, respBody, v.ttl)
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
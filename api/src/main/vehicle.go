@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"regno"
+)
+
+// The values allowed for the enumerated vehicle fields.
+var (
+	fuelTypes     = map[string]bool{"petrol": true, "diesel": true, "hybrid": true, "electric": true, "lpg": true}
+	transmissions = map[string]bool{"manual": true, "automatic": true}
+	conditions    = map[string]bool{"new": true, "used": true, "certified": true}
+)
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// firstModelYear is the year of the first production car.
+const firstModelYear = 1886
+
+// maxMileage is the highest mileage a car may be listed with.
+const maxMileage = 2_000_000
+
+// The formats registrations must be in, set from the configuration at
+// start: those of the tenants configured apart, and of the others.
+var (
+	regNoFormats       regno.Set
+	tenantRegNoFormats map[string]regno.Set
+)
+
+// regNoFormatsFor returns the formats registrations of the tenant of ctx
+// must be in.
+func regNoFormatsFor(ctx context.Context) regno.Set {
+	if formats, ok := tenantRegNoFormats[tenantFrom(ctx)]; ok {
+		return formats
+	}
+	return regNoFormats
+}
+
+// validate checks the optional fields of v that are set. Zero values are
+// treated as not set, so it also validates merge patches.
+func (v *vehicle) validate(ctx context.Context) *fieldError {
+	c := &checks{}
+	v.check(ctx, c)
+	return c.err()
+}
+
+// validateReplacement checks v as the whole of a car, replacing the one
+// stored, which must have a manufacturer and model.
+func (v *vehicle) validateReplacement(ctx context.Context) *fieldError {
+	c := &checks{}
+	c.require("manufacturer", v.Manurfacturer, "The manufacturer is required")
+	c.require("model", v.Model, "The model is required")
+	v.check(ctx, c)
+	return c.err()
+}
+
+// check checks v as written by the tenant of ctx, whose registration formats
+// it must be in.
+func (v *vehicle) check(ctx context.Context, c *checks) {
+	v.RegNo = normalRegNo(v.RegNo)
+
+	c.maxLength("manufacturer", v.Manurfacturer, maxNameLength)
+	c.maxLength("model", v.Model, maxNameLength)
+	c.maxLength("regno", v.RegNo, maxRegNoLength)
+	if v.RegNo != "" {
+		if err := regNoFormatsFor(ctx).Validate(v.RegNo); err != nil {
+			e := err.(*regno.Error)
+			c.fail("regno", e.Reason, e.Msg)
+		}
+	}
+	c.maxLength("dealer", v.Dealer, maxNameLength)
+	c.maxLength("colour", v.Colour, maxNameLength)
+	if v.Price != nil {
+		c.check(v.Price.Amount >= 0, "price", "The price must not be negative")
+		c.check(currencyCode.MatchString(v.Price.Currency), "price", "The currency must be an ISO 4217 code such as GBP")
+	}
+	c.check(v.Mileage >= 0 && v.Mileage <= maxMileage, "mileage", fmt.Sprintf("The mileage must be between 0 and %d", maxMileage))
+	c.check(v.Year == 0 || v.Year >= firstModelYear && v.Year <= time.Now().Year()+1, "year",
+		fmt.Sprintf("The year must be between %d and next year", firstModelYear))
+	c.oneOf("fuel_type", v.FuelType, fuelTypes, "Unknown fuel type")
+	c.oneOf("transmission", v.Transmission, transmissions, "The transmission must be manual or automatic")
+	c.oneOf("condition", v.Condition, conditions, "The condition must be new, used or certified")
+}
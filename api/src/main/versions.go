@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// apiVersion is the version new clients get. Older versions stay mounted
+// under their own prefix until they are retired.
+const apiVersion = "v1"
+
+// apiVersions are the versions being served.
+var apiVersions = map[string]bool{"v1": true}
+
+// resources are the collections served under a version prefix. They were
+// originally served from the root, which is kept as a deprecated alias.
+var resources = []string{"/cars", "/api-keys", "/roles"}
+
+// apiRoute returns the route of p in the current API version.
+func apiRoute(p string) string {
+	return route("/" + apiVersion + p)
+}
+
+// negotiateVersion returns the version asked for in an Accept header such as
+// "application/vnd.carsupermarket.v1+json". It returns the current version
+// when none is asked for.
+func negotiateVersion(accept string) string {
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		if v, ok := params["version"]; ok && mediaType == "application/vnd.carsupermarket+json" {
+			return "v" + strings.TrimPrefix(v, "v")
+		}
+		if v := strings.TrimPrefix(mediaType, "application/vnd.carsupermarket."); v != mediaType {
+			return strings.TrimSuffix(v, "+json")
+		}
+	}
+	return apiVersion
+}
+
+// versioned rewrites requests for the unversioned routes to the version
+// negotiated from the Accept header, marking the response as deprecated and
+// logging the use so remaining callers can be found.
+func versioned(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, basePath)
+		if path == r.URL.Path && basePath != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		for v := range apiVersions {
+			if strings.HasPrefix(path, "/"+v+"/") {
+				w.Header().Set("API-Version", v)
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		for _, res := range resources {
+			if path != res && !strings.HasPrefix(path, res+"/") {
+				continue
+			}
+
+			v := negotiateVersion(r.Header.Get("Accept"))
+			if !apiVersions[v] {
+				errorWithJSON(w, "Unsupported API version", http.StatusNotAcceptable)
+				return
+			}
+
+			successor := route("/" + v + path)
+			slog.WarnContext(r.Context(), "Deprecated unversioned route", "method", r.Method, "path", r.URL.Path,
+				"user_agent", r.UserAgent())
+
+			w.Header().Set("API-Version", v)
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+
+			r = r.Clone(r.Context())
+			r.URL.Path = successor
+			r.URL.RawPath = ""
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
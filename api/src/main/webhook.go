@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"goji.io/pat"
+)
+
+// The events webhooks are sent for, named after the inventory events.
+var webhookEvents = map[string]string{
+	eventCreated: "car.created",
+	eventUpdated: "car.updated",
+	eventDeleted: "car.deleted",
+	eventSold:    "car.sold",
+}
+
+// Headers of a webhook delivery. The signature is of the timestamp and body,
+// so that receivers can reject replays of old deliveries.
+const (
+	webhookSignatureHeader = "X-CarSupermarket-Signature"
+	webhookEventHeader     = "X-CarSupermarket-Event"
+	webhookDeliveryHeader  = "X-CarSupermarket-Delivery"
+)
+
+const (
+	// webhookRetrySchedule is when failed deliveries are retried, unless
+	// configured otherwise.
+	webhookRetrySchedule = "@every 30s"
+	// webhookFirstRetry is the wait before the first retry, doubled for each
+	// one after up to webhookMaxBackoff.
+	webhookFirstRetry = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+	// webhookConcurrency is how many deliveries are made at once.
+	webhookConcurrency = 8
+	// maxWebhookDeliveries is the most deliveries listed at once.
+	maxWebhookDeliveries = 100
+)
+
+// The statuses of a delivery.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhook is a partner's subscription to inventory events. Events is empty
+// for every event but the field events, which are only sent when named.
+type webhook struct {
+	ID        string    `json:"id" bson:"webhookid"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty" bson:"secret"`
+	CreatedAt time.Time `json:"created_at" bson:"createdat"`
+	Tenant    string    `json:"-" bson:"tenant"`
+}
+
+func (h *webhook) validate() *fieldError {
+	c := &checks{}
+	u, err := url.Parse(h.URL)
+	c.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "The URL must be an http(s) URL")
+	known := map[string]bool{savedSearchEvent: true}
+	for _, name := range webhookEvents {
+		known[name] = true
+	}
+	for _, e := range h.Events {
+		c.check(known[e] || validFieldEvent(e), "events", fmt.Sprintf("Unknown event %q", e))
+	}
+	return c.err()
+}
+
+func (h *webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return !isFieldEvent(event)
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// delivery is one event sent, or to be sent, to a webhook. Body is kept as
+// sent, so that retries send the same bytes.
+type delivery struct {
+	ID          string     `json:"id" bson:"deliveryid"`
+	Webhook     string     `json:"webhook" bson:"webhook"`
+	Event       string     `json:"event"`
+	Body        string     `json:"body"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastStatus  int        `json:"last_status,omitempty" bson:"laststatus,omitempty"`
+	LastError   string     `json:"last_error,omitempty" bson:"lasterror,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty" bson:"nextattempt,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" bson:"createdat"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty" bson:"deliveredat,omitempty"`
+	Tenant      string     `json:"-" bson:"tenant"`
+}
+
+// webhooks holds the subscriptions and sends them the inventory events. Each
+// delivery is recorded before it is made and retried with backoff until it
+// succeeds or maxAttempts have failed. Deliveries are kept for retention
+// afterwards, for partners to debug their endpoints with.
+//
+// Events are taken from the broker, so only the writes made through this
+// instance are sent from it; an event dropped on a slow subscription is not
+// sent at all.
+type webhooks struct {
+	hooks       *mongo.Collection
+	deliveries  *mongo.Collection
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	retention   time.Duration
+	slots       chan struct{}
+}
+
+func newWebhooks(hooks, deliveries *mongo.Collection, timeout time.Duration, maxAttempts int, retention time.Duration) *webhooks {
+	return &webhooks{
+		hooks:       hooks,
+		deliveries:  deliveries,
+		client:      &http.Client{Timeout: timeout},
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		slots:       make(chan struct{}, webhookConcurrency),
+	}
+}
+
+func (s *webhooks) ensureIndex(ctx context.Context) error {
+	_, err := s.hooks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "webhookid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "deliveryid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "webhook", Value: 1}, {Key: "createdat", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattempt", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "createdat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(s.retention.Seconds())),
+		},
+	})
+	return err
+}
+
+// deliver is the outbox sink of webhooks: it records a delivery of e to each
+// webhook that wants it and makes them, then one of each field it changed to
+// the webhooks that want a field event of the change. The deliveries of an
+// event are named after it, so that relaying it again records none twice.
+func (s *webhooks) deliver(ctx context.Context, e outboxEvent) error {
+	if e.Car == nil {
+		return nil
+	}
+	if name, ok := webhookEvents[e.Type]; ok {
+		if err := s.record(ctx, e.ID.Hex(), []string{name}, e.CreatedAt, e.Car); err != nil {
+			return err
+		}
+	}
+	for _, c := range e.Changes {
+		names := c.events()
+		if len(names) == 0 {
+			continue
+		}
+		data := fieldEvent{VIN: e.VIN, Field: c.Field, Old: c.Old, New: c.New, Car: e.Car}
+		if err := s.record(ctx, e.ID.Hex()+"-"+c.Field, names, e.CreatedAt, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record records and makes the deliveries of an event, with data as its
+// payload, to the webhooks of the tenant of ctx that want it by one of its
+// names. A delivery is named the first of them the webhook wants, so each
+// webhook is sent the event once.
+func (s *webhooks) record(ctx context.Context, eventID string, names []string, at time.Time, data interface{}) error {
+	var hooks []webhook
+	cur, err := s.hooks.Find(ctx, forTenant(ctx, bson.M{}))
+	if err == nil {
+		err = cur.All(ctx, &hooks)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, h := range hooks {
+		event := ""
+		for _, name := range names {
+			if h.wants(name) {
+				event = name
+				break
+			}
+		}
+		if event == "" {
+			continue
+		}
+		id := eventID + "-" + h.ID
+		body, err := json.Marshal(struct {
+			ID        string      `json:"id"`
+			Type      string      `json:"type"`
+			CreatedAt time.Time   `json:"created_at"`
+			Data      interface{} `json:"data"`
+		}{id, event, at, data})
+		if err != nil {
+			panic(err)
+		}
+		d := delivery{ID: id, Webhook: h.ID, Event: event, Body: string(body), Status: deliveryPending,
+			NextAttempt: &now, CreatedAt: now, Tenant: h.Tenant}
+		if _, err := s.deliveries.InsertOne(ctx, d); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return err
+		}
+		go s.attempt(ctx, id)
+	}
+	return nil
+}
+
+// retry makes the deliveries due a retry.
+func (s *webhooks) retry(ctx context.Context) error {
+	var due []delivery
+	filter := bson.M{"status": deliveryPending, "nextattempt": bson.M{"$lte": time.Now()}}
+	cur, err := s.deliveries.Find(ctx, filter, options.Find().SetProjection(bson.M{"deliveryid": 1, "tenant": 1}))
+	if err == nil {
+		err = cur.All(ctx, &due)
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.attempt(withTenant(ctx, d.Tenant), d.ID)
+	}
+	return nil
+}
+
+// attempt makes a delivery if it is due. It is claimed first, by moving its
+// next attempt past the time the attempt can take, so that it is not made
+// twice at once, by the retry job or another instance.
+func (s *webhooks) attempt(ctx context.Context, id string) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	ctx = context.WithoutCancel(ctx)
+
+	now := time.Now().UTC()
+	lease := now.Add(2 * s.timeout)
+	var d delivery
+	err := s.deliveries.FindOneAndUpdate(ctx,
+		forTenant(ctx, bson.M{"deliveryid": id, "status": deliveryPending, "nextattempt": bson.M{"$lte": now}}),
+		bson.M{"$set": bson.M{"nextattempt": lease}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed claim webhook delivery", "delivery", id, "err", err)
+		return
+	}
+
+	var h webhook
+	err = s.hooks.FindOne(ctx, forTenant(ctx, bson.M{"webhookid": d.Webhook})).Decode(&h)
+	if err == mongo.ErrNoDocuments {
+		s.finish(ctx, &d, bson.M{"status": deliveryFailed, "lasterror": "webhook deleted"})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed find webhook", "webhook", d.Webhook, "err", err)
+		return
+	}
+
+	status, err := s.send(ctx, &h, &d)
+	set := bson.M{"laststatus": status}
+	switch {
+	case err == nil:
+		at := time.Now().UTC()
+		set["status"], set["deliveredat"] = deliveryDelivered, at
+		s.finish(ctx, &d, set)
+		return
+	case d.Attempts >= s.maxAttempts:
+		set["status"], set["lasterror"] = deliveryFailed, err.Error()
+		slog.WarnContext(ctx, "Gave up webhook delivery", "webhook", h.ID, "delivery", d.ID, "attempts", d.Attempts, "err", err)
+	default:
+		set["lasterror"], set["nextattempt"] = err.Error(), time.Now().Add(webhookBackoff(d.Attempts)).UTC()
+	}
+	s.finish(ctx, &d, set)
+}
+
+// webhookBackoff is how long to wait before retrying a delivery that has
+// failed attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookFirstRetry
+	for i := 1; i < attempts && wait < webhookMaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, webhookMaxBackoff)
+}
+
+func (s *webhooks) finish(ctx context.Context, d *delivery, set bson.M) {
+	update := bson.M{"$set": set}
+	if set["status"] != nil {
+		update["$unset"] = bson.M{"nextattempt": ""}
+	}
+	if _, err := s.deliveries.UpdateOne(ctx, forTenant(ctx, bson.M{"deliveryid": d.ID}), update); err != nil {
+		slog.ErrorContext(ctx, "Failed record webhook delivery", "delivery", d.ID, "err", err)
+	}
+}
+
+// send POSTs the delivery, returning the response status, or 0 if none was
+// had. Any status but 2xx fails it.
+func (s *webhooks) send(ctx context.Context, h *webhook, d *delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader([]byte(d.Body)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "CarSupermarket-Webhooks/1")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, time.Now(), []byte(d.Body)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header of body sent at t: the Unix time
+// and the hex HMAC-SHA256, keyed with the secret, of the time, a dot and the
+// body.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookNotFound writes the response for a failed lookup of a webhook.
+func webhookNotFound(w http.ResponseWriter, r *http.Request, err error, op string) {
+	switch err {
+	default:
+		errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed "+op, "err", err)
+	case mongo.ErrNoDocuments:
+		errorWithJSON(w, "Webhook not found", http.StatusNotFound)
+	}
+}
+
+// addWebhook registers a webhook. The secret deliveries are signed with is
+// generated unless one is given, and only shown in this response.
+func addWebhook(s *webhooks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var h webhook
+		if !decodeStrict(w, r.Body, &h) {
+			return
+		}
+		if err := h.validate(); err != nil {
+			fieldErrorsWithJSON(w, err)
+			return
+		}
+
+		var err error
+		if h.ID, err = randomHex(8); err != nil {
+			panic(err)
+		}
+		if h.Secret == "" {
+			if h.Secret, err = randomHex(32); err != nil {
+				panic(err)
+			}
+		}
+		if h.Events == nil {
+			h.Events = []string{}
+		}
+		h.CreatedAt = time.Now().UTC()
+		h.Tenant = tenantFrom(r.Context())
+
+		if _, err := s.hooks.InsertOne(r.Context(), h); err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed insert webhook", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(h, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", apiRoute("/webhooks/"+h.ID))
+		responseWithJSON(w, respBody, http.StatusCreated)
+	}
+}
+
+func allWebhooks(s *webhooks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hooks := []webhook{}
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}}).SetProjection(bson.M{"secret": 0})
+		cur, err := s.hooks.Find(r.Context(), forTenant(r.Context(), bson.M{}), opts)
+		if err == nil {
+			err = cur.All(r.Context(), &hooks)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list webhooks", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(hooks, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+func webhookByID(s *webhooks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var h webhook
+		opts := options.FindOne().SetProjection(bson.M{"secret": 0})
+		err := s.hooks.FindOne(r.Context(), forTenant(r.Context(), bson.M{"webhookid": pat.Param(r, "id")}), opts).Decode(&h)
+		if err != nil {
+			webhookNotFound(w, r, err, "find webhook")
+			return
+		}
+
+		respBody, err := json.MarshalIndent(h, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// deleteWebhook removes a webhook; its pending deliveries are failed when
+// next attempted.
+func deleteWebhook(s *webhooks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.hooks.DeleteOne(r.Context(), forTenant(r.Context(), bson.M{"webhookid": pat.Param(r, "id")}))
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed delete webhook", "err", err)
+			return
+		}
+		if res.DeletedCount == 0 {
+			errorWithJSON(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webhookDeliveries lists the deliveries to a webhook, newest first,
+// optionally only those with a status.
+func webhookDeliveries(s *webhooks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := pat.Param(r, "id")
+		if err := s.hooks.FindOne(r.Context(), forTenant(r.Context(), bson.M{"webhookid": id})).Err(); err != nil {
+			webhookNotFound(w, r, err, "find webhook")
+			return
+		}
+
+		filter := forTenant(r.Context(), bson.M{"webhook": id})
+		switch status := r.URL.Query().Get("status"); status {
+		case "":
+		case deliveryPending, deliveryDelivered, deliveryFailed:
+			filter["status"] = status
+		default:
+			errorWithJSON(w, "Parameter \"status\" must be pending, delivered or failed", http.StatusBadRequest)
+			return
+		}
+		limit := int64(maxWebhookDeliveries)
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 || n > maxWebhookDeliveries {
+				errorWithJSON(w, fmt.Sprintf("Parameter \"limit\" must be between 1 and %d", maxWebhookDeliveries), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		deliveries := []delivery{}
+		opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}}).SetLimit(limit)
+		cur, err := s.deliveries.Find(r.Context(), filter, opts)
+		if err == nil {
+			err = cur.All(r.Context(), &deliveries)
+		}
+		if err != nil {
+			errorWithCode(w, problem.CodeDatabase, "Database error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed list webhook deliveries", "err", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(deliveries, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+
+		responseWithJSON(w, respBody, http.StatusOK)
+	}
+}
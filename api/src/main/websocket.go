@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxWebSocketConns caps the number of concurrently connected live
+	// search clients.
+	maxWebSocketConns = 256
+
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// carFilter is the subscription a live search client sends. Empty fields
+// match any value. Registrations match however they are cased or spaced.
+type carFilter struct {
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	RegNo        string `json:"regno"`
+	Dealer       string `json:"dealer"`
+}
+
+func (f carFilter) matches(car *vehicle) bool {
+	if car == nil {
+		return false
+	}
+
+	return (f.Manufacturer == "" || f.Manufacturer == car.Manurfacturer) &&
+		(f.Model == "" || f.Model == car.Model) &&
+		(f.RegNo == "" || normalRegNo(f.RegNo) == normalRegNo(car.RegNo)) &&
+		(f.Dealer == "" || f.Dealer == car.Dealer)
+}
+
+type wsMessage struct {
+	Type   string    `json:"type"`
+	Filter carFilter `json:"filter"`
+}
+
+func carWebSocket(events *broker) func(w http.ResponseWriter, r *http.Request) {
+	slots := make(chan struct{}, maxWebSocketConns)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			errorWithJSON(w, "Too many live connections", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed websocket upgrade", "err", err)
+			return
+		}
+		defer conn.Close()
+
+		tenant := tenantFrom(r.Context())
+		ch := events.subscribe()
+		defer events.unsubscribe(ch)
+
+		filters := make(chan carFilter)
+		done := make(chan struct{})
+		quit := make(chan struct{})
+		defer close(quit)
+		go readSubscriptions(conn, filters, done, quit)
+
+		ping := time.NewTicker(wsPingPeriod)
+		defer ping.Stop()
+
+		var filter *carFilter
+		for {
+			select {
+			case <-done:
+				return
+			case f := <-filters:
+				filter = &f
+			case <-ping.C:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+						time.Now().Add(wsWriteWait))
+					return
+				}
+
+				if !e.inTenant(tenant) || filter == nil || (e.Type != eventCreated && e.Type != eventUpdated) || !filter.matches(e.Car) {
+					continue
+				}
+
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteJSON(e); err != nil {
+					slog.ErrorContext(r.Context(), "Failed write websocket event", "err", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// readSubscriptions reads client messages until the connection fails, passing
+// each new filter to the writer. It closes done on exit and gives up once the
+// writer has closed quit.
+func readSubscriptions(conn *websocket.Conn, filters chan<- carFilter, done, quit chan struct{}) {
+	defer close(done)
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Error("Failed read websocket message", "err", err)
+			}
+			return
+		}
+
+		if msg.Type != "subscribe" {
+			continue
+		}
+
+		select {
+		case filters <- msg.Filter:
+		case <-quit:
+			return
+		}
+	}
+}
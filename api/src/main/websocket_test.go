@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCarFilterMatches(t *testing.T) {
+	car := &vehicle{Manurfacturer: "Ford", Model: "Focus", RegNo: "AB12CDE", Dealer: "north"}
+	tests := []struct {
+		filter carFilter
+		want   bool
+	}{
+		{carFilter{}, true},
+		{carFilter{RegNo: "AB12CDE"}, true},
+		{carFilter{RegNo: "ab12 cde"}, true},
+		{carFilter{RegNo: " Ab12\tCdE "}, true},
+		{carFilter{RegNo: "AB12CDF"}, false},
+		{carFilter{Manufacturer: "Ford", RegNo: "ab12cde"}, true},
+		{carFilter{Manufacturer: "Kia", RegNo: "ab12cde"}, false},
+		{carFilter{Dealer: "south"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(car); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if (carFilter{}).matches(nil) {
+		t.Error("a filter matches no car")
+	}
+	if !(carFilter{RegNo: "ab12cde"}).matches(&vehicle{RegNo: "ab12 cde"}) {
+		t.Error("a registration stored before normalising does not match")
+	}
+}
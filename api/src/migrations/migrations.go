@@ -0,0 +1,163 @@
+// Package migrations applies ordered, versioned changes to the database,
+// such as backfills, renames and index changes that cannot simply be
+// repeated at every startup. Applied versions are recorded in a collection,
+// so each step runs once.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// lockTTL is how long a lock taken by an instance that has gone away is
+// honoured before another instance may take it over.
+const lockTTL = 10 * time.Minute
+
+// lockID is the _id of the document held while migrations are applied, so
+// that instances starting together do not apply them twice.
+const lockID = "lock"
+
+// Migration is one step. Versions are applied in ascending order; a step
+// must leave the database as it found it if it fails, or be safe to run
+// again.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+}
+
+// Record is an applied migration.
+type Record struct {
+	Version   int       `json:"version" bson:"_id"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at" bson:"appliedat"`
+}
+
+// Applied returns the migrations recorded in c, in order.
+func Applied(ctx context.Context, c *mongo.Collection) ([]Record, error) {
+	records := []Record{}
+	cur, err := c.Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err == nil {
+		err = cur.All(ctx, &records)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Version < records[j].Version })
+	return records, err
+}
+
+// Pending returns the steps not yet recorded in c, in order.
+func Pending(ctx context.Context, c *mongo.Collection, steps []Migration) ([]Migration, error) {
+	if err := check(steps); err != nil {
+		return nil, err
+	}
+	records, err := Applied(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool, len(records))
+	for _, rec := range records {
+		applied[rec.Version] = true
+	}
+
+	var pending []Migration
+	for _, step := range sorted(steps) {
+		if !applied[step.Version] {
+			pending = append(pending, step)
+		}
+	}
+	return pending, nil
+}
+
+// Apply applies the steps not yet recorded in c, in order, and records each
+// as it succeeds. It stops at the first that fails. Only one caller applies
+// migrations at a time; the others wait for it.
+func Apply(ctx context.Context, c *mongo.Collection, steps []Migration) ([]Record, error) {
+	if err := check(steps); err != nil {
+		return nil, err
+	}
+	if err := lock(ctx, c); err != nil {
+		return nil, err
+	}
+	defer unlock(c)
+
+	pending, err := Pending(ctx, c, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Record
+	for _, step := range pending {
+		if err := step.Up(ctx); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", step.Version, step.Name, err)
+		}
+		rec := Record{Version: step.Version, Name: step.Name, AppliedAt: time.Now().UTC()}
+		if _, err := c.InsertOne(ctx, rec); err != nil {
+			return done, fmt.Errorf("migration %d (%s) applied but not recorded: %w", step.Version, step.Name, err)
+		}
+		slog.Info("Applied migration", "version", step.Version, "name", step.Name)
+		done = append(done, rec)
+	}
+	return done, nil
+}
+
+// check rejects steps with versions that are not positive or not unique.
+func check(steps []Migration) error {
+	seen := make(map[int]bool, len(steps))
+	for _, step := range steps {
+		if step.Version < 1 {
+			return fmt.Errorf("migration %q has version %d; versions start at 1", step.Name, step.Version)
+		}
+		if seen[step.Version] {
+			return fmt.Errorf("migration version %d is used twice", step.Version)
+		}
+		seen[step.Version] = true
+	}
+	return nil
+}
+
+func sorted(steps []Migration) []Migration {
+	s := append([]Migration(nil), steps...)
+	sort.Slice(s, func(i, j int) bool { return s[i].Version < s[j].Version })
+	return s
+}
+
+// lock takes the migration lock, waiting while another instance holds it.
+func lock(ctx context.Context, c *mongo.Collection) error {
+	for {
+		now := time.Now().UTC()
+		_, err := c.InsertOne(ctx, bson.M{"_id": lockID, "until": now.Add(lockTTL)})
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+
+		// A lock left behind by an instance that died is taken over.
+		res, err := c.DeleteOne(ctx, bson.M{"_id": lockID, "until": bson.M{"$lt": now}})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount > 0 {
+			continue
+		}
+
+		slog.Info("Waiting for another instance to apply migrations")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the migration lock: %w", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func unlock(c *mongo.Collection) {
+	if _, err := c.DeleteOne(context.Background(), bson.M{"_id": lockID}); err != nil {
+		slog.Error("Failed release migration lock", "err", err)
+	}
+}
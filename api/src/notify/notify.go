@@ -0,0 +1,113 @@
+// Package notify sends the messages people are told things by: email over
+// SMTP and text messages through Twilio, written from templates.
+//
+//	t, err := notify.ParseTemplate("Your reservation", "Hello {{.Name}}, ...", "Hi {{.Name}}, ...")
+//	msg, err := t.Render(notify.Email, data)
+//	msg.To = "buyer@example.com"
+//	id, err := sender.Send(ctx, msg)
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The channels a message is sent on.
+const (
+	Email = "email"
+	SMS   = "sms"
+)
+
+// Message is a message to send to one recipient: an email address or a
+// phone number in E.164 form, e.g. +447700900123. Subject is only sent by
+// email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends messages on a channel.
+type Sender interface {
+	// Send sends msg, returning the ID the provider knows it by.
+	Send(ctx context.Context, msg Message) (string, error)
+}
+
+// Template writes a message from data, with a subject and body for email
+// and a body for text messages.
+type Template struct {
+	subject, email, sms *template.Template
+}
+
+// ParseTemplate parses a template of text/template sources. The SMS body
+// may be empty when there is none, to send the message by email only.
+func ParseTemplate(subject, email, sms string) (*Template, error) {
+	t := &Template{}
+	for _, part := range []struct {
+		name string
+		text string
+		into **template.Template
+	}{{"subject", subject, &t.subject}, {"email", email, &t.email}, {"sms", sms, &t.sms}} {
+		if part.text == "" {
+			continue
+		}
+		parsed, err := template.New(part.name).Option("missingkey=zero").Parse(part.text)
+		if err != nil {
+			return nil, fmt.Errorf("notify: %s: %v", part.name, err)
+		}
+		*part.into = parsed
+	}
+	if t.email == nil && t.sms == nil {
+		return nil, fmt.Errorf("notify: a template needs an email or SMS body")
+	}
+	return t, nil
+}
+
+// Has reports whether the template writes messages for channel.
+func (t *Template) Has(channel string) bool {
+	switch channel {
+	case Email:
+		return t.email != nil
+	case SMS:
+		return t.sms != nil
+	}
+	return false
+}
+
+// Render writes the message for channel from data. Its To is left empty.
+func (t *Template) Render(channel string, data interface{}) (Message, error) {
+	var msg Message
+	body := t.email
+	if channel == SMS {
+		body = t.sms
+	}
+	if body == nil {
+		return msg, fmt.Errorf("notify: no %s template", channel)
+	}
+	var b bytes.Buffer
+	if err := body.Execute(&b, data); err != nil {
+		return msg, err
+	}
+	msg.Body = strings.TrimSpace(b.String())
+	if channel == Email && t.subject != nil {
+		b.Reset()
+		if err := t.subject.Execute(&b, data); err != nil {
+			return msg, err
+		}
+		msg.Subject = strings.Join(strings.Fields(b.String()), " ")
+	}
+	return msg, nil
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
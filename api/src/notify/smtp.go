@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends email through a mail server, with STARTTLS when the server
+// offers it.
+type SMTP struct {
+	// Addr is the host and port of the server, e.g. smtp.example.com:587.
+	Addr string
+	// Username and Password authenticate with PLAIN, when Username is set.
+	Username string
+	Password string
+	// From is the address mail is sent from, optionally with a name, e.g.
+	// "Car Supermarket <sales@example.com>".
+	From string
+}
+
+// Send sends msg, returning the Message-ID it was sent with. The deadline
+// of ctx, if any, bounds the whole exchange.
+func (s *SMTP) Send(ctx context.Context, msg Message) (string, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return "", fmt.Errorf("smtp: %v", err)
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return "", fmt.Errorf("smtp: from: %v", err)
+	}
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return "", fmt.Errorf("smtp: %q is not an email address", msg.To)
+	}
+	id := "<" + randomID() + "@" + host + ">"
+
+	var b bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&b, "%s: %s\r\n", name, value) }
+	header("From", s.From)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", id)
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return "", err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return "", err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	// The message is accepted; only the goodbye is left to fail.
+	c.Quit()
+	return id, nil
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TwilioURL is the root of Twilio's REST API.
+const TwilioURL = "https://api.twilio.com"
+
+// Twilio sends text messages through Twilio's Messages API.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	// From is the number messages are sent from, or the SID of a messaging
+	// service, starting MG, that picks one.
+	From string
+	// URL is the root of the API; empty is TwilioURL.
+	URL string
+	// HTTP makes the requests; nil uses http.DefaultClient.
+	HTTP *http.Client
+}
+
+// Send sends msg, returning the SID of the message Twilio queued.
+func (t *Twilio) Send(ctx context.Context, msg Message) (string, error) {
+	form := url.Values{"To": {msg.To}, "Body": {msg.Body}}
+	if strings.HasPrefix(t.From, "MG") {
+		form.Set("MessagingServiceSid", t.From)
+	} else {
+		form.Set("From", t.From)
+	}
+	root := t.URL
+	if root == "" {
+		root = TwilioURL
+	}
+	u := strings.TrimSuffix(root, "/") + "/2010-04-01/Accounts/" + url.PathEscape(t.AccountSID) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+
+	h := t.HTTP
+	if h == nil {
+		h = http.DefaultClient
+	}
+	resp, err := h.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		SID     string `json:"sid"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	if resp.StatusCode/100 != 2 {
+		if body.Message != "" {
+			return "", fmt.Errorf("twilio: %s (%d)", body.Message, body.Code)
+		}
+		return "", fmt.Errorf("twilio: %s", resp.Status)
+	}
+	return body.SID, nil
+}
@@ -0,0 +1,144 @@
+// Package problem writes error responses as RFC 7807 problem details, served
+// as application/problem+json.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType is the media type of problem details.
+const ContentType = "application/problem+json"
+
+// typePrefix is prepended to a code to give the problem type URI.
+const typePrefix = "urn:carsupermarket:problem:"
+
+// Codes identify the kind of problem. Clients should switch on these rather
+// than on the detail, which is for people and may change.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthenticated  = "unauthenticated"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotAcceptable    = "not_acceptable"
+	CodeConflict         = "conflict"
+	CodeTooLarge         = "too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeValidation       = "validation_failed"
+	CodeRateLimited      = "rate_limited"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+	CodeTimeout          = "timeout"
+	CodeNotImplemented   = "not_implemented"
+
+	CodeDatabase             = "database_error"
+	CodeDuplicateVIN         = "duplicate_vin"
+	CodeDuplicateRegNo       = "duplicate_regno"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeInProgress           = "request_in_progress"
+	CodeRevisionConflict     = "revision_conflict"
+	CodeTenantRequired       = "tenant_required"
+	CodeMaintenance          = "maintenance"
+	CodeBackupCorrupt        = "backup_corrupt"
+)
+
+// statusCodes are the codes used for a status when no other is given.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthenticated,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusNotAcceptable:         CodeNotAcceptable,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMedia,
+	http.StatusUnprocessableEntity:   CodeValidation,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusNotImplemented:        CodeNotImplemented,
+	http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// FieldError is a request field that failed validation, with Reason saying
+// why, e.g. "required", "too_long" or "invalid".
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+// Details is a problem details object. Field and Reason are set when a
+// request field failed validation; Errors lists every field that did.
+type Details struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Field  string       `json:"field,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+	// RequestID identifies the request in the server's logs.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// New returns the problem for status, with the code for the status.
+func New(status int, detail string) *Details {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+		if status < http.StatusInternalServerError {
+			code = CodeBadRequest
+		}
+	}
+	return WithCode(status, code, detail)
+}
+
+// WithCode returns the problem for status with a more specific code.
+func WithCode(status int, code, detail string) *Details {
+	return &Details{
+		Type:   typePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Invalid returns the problem for a request field that failed validation,
+// with reason saying why.
+func Invalid(field, reason, detail string) *Details {
+	p := New(http.StatusUnprocessableEntity, detail)
+	p.Field = field
+	p.Reason = reason
+	return p
+}
+
+// InvalidFields returns the problem for the request fields in errs, which
+// must not be empty. Field and Reason are those of the first, for clients
+// that look at only one.
+func InvalidFields(detail string, errs []FieldError) *Details {
+	p := Invalid(errs[0].Field, errs[0].Reason, detail)
+	p.Errors = errs
+	return p
+}
+
+// Write writes p as the response, with the ID of the request from the
+// X-Request-ID response header when it is set.
+func Write(w http.ResponseWriter, p *Details) {
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get("X-Request-ID")
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
@@ -0,0 +1,682 @@
+// The car inventory over gRPC. It serves the same data as the REST API under
+// /v1 and follows the same validation and role rules.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: cars.proto
+
+package carpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// An asking price in the minor unit of its currency, e.g. pence.
+type Price struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Amount int64                  `protobuf:"varint,1,opt,name=amount,proto3" json:"amount,omitempty"`
+	// ISO 4217 code such as GBP.
+	Currency      string `protobuf:"bytes,2,opt,name=currency,proto3" json:"currency,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Price) Reset() {
+	*x = Price{}
+	mi := &file_cars_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Price) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Price) ProtoMessage() {}
+
+func (x *Price) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Price.ProtoReflect.Descriptor instead.
+func (*Price) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Price) GetAmount() int64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *Price) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+type Vehicle struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Manufacturer string                 `protobuf:"bytes,1,opt,name=manufacturer,proto3" json:"manufacturer,omitempty"`
+	Model        string                 `protobuf:"bytes,2,opt,name=model,proto3" json:"model,omitempty"`
+	Vin          string                 `protobuf:"bytes,3,opt,name=vin,proto3" json:"vin,omitempty"`
+	Regno        string                 `protobuf:"bytes,4,opt,name=regno,proto3" json:"regno,omitempty"`
+	Dealer       string                 `protobuf:"bytes,5,opt,name=dealer,proto3" json:"dealer,omitempty"`
+	SoldAt       *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=sold_at,json=soldAt,proto3" json:"sold_at,omitempty"`
+	Price        *Price                 `protobuf:"bytes,7,opt,name=price,proto3" json:"price,omitempty"`
+	Mileage      int32                  `protobuf:"varint,8,opt,name=mileage,proto3" json:"mileage,omitempty"`
+	Year         int32                  `protobuf:"varint,9,opt,name=year,proto3" json:"year,omitempty"`
+	FuelType     string                 `protobuf:"bytes,10,opt,name=fuel_type,json=fuelType,proto3" json:"fuel_type,omitempty"`
+	Transmission string                 `protobuf:"bytes,11,opt,name=transmission,proto3" json:"transmission,omitempty"`
+	Colour       string                 `protobuf:"bytes,12,opt,name=colour,proto3" json:"colour,omitempty"`
+	Condition    string                 `protobuf:"bytes,13,opt,name=condition,proto3" json:"condition,omitempty"`
+	// ID of the dealership the car is at.
+	Branch string `protobuf:"bytes,14,opt,name=branch,proto3" json:"branch,omitempty"`
+	// Reserved or sold, as set by the car's order; empty when available.
+	// Ignored on writes.
+	Status        string `protobuf:"bytes,15,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Vehicle) Reset() {
+	*x = Vehicle{}
+	mi := &file_cars_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Vehicle) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Vehicle) ProtoMessage() {}
+
+func (x *Vehicle) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Vehicle.ProtoReflect.Descriptor instead.
+func (*Vehicle) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Vehicle) GetManufacturer() string {
+	if x != nil {
+		return x.Manufacturer
+	}
+	return ""
+}
+
+func (x *Vehicle) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *Vehicle) GetVin() string {
+	if x != nil {
+		return x.Vin
+	}
+	return ""
+}
+
+func (x *Vehicle) GetRegno() string {
+	if x != nil {
+		return x.Regno
+	}
+	return ""
+}
+
+func (x *Vehicle) GetDealer() string {
+	if x != nil {
+		return x.Dealer
+	}
+	return ""
+}
+
+func (x *Vehicle) GetSoldAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.SoldAt
+	}
+	return nil
+}
+
+func (x *Vehicle) GetPrice() *Price {
+	if x != nil {
+		return x.Price
+	}
+	return nil
+}
+
+func (x *Vehicle) GetMileage() int32 {
+	if x != nil {
+		return x.Mileage
+	}
+	return 0
+}
+
+func (x *Vehicle) GetYear() int32 {
+	if x != nil {
+		return x.Year
+	}
+	return 0
+}
+
+func (x *Vehicle) GetFuelType() string {
+	if x != nil {
+		return x.FuelType
+	}
+	return ""
+}
+
+func (x *Vehicle) GetTransmission() string {
+	if x != nil {
+		return x.Transmission
+	}
+	return ""
+}
+
+func (x *Vehicle) GetColour() string {
+	if x != nil {
+		return x.Colour
+	}
+	return ""
+}
+
+func (x *Vehicle) GetCondition() string {
+	if x != nil {
+		return x.Condition
+	}
+	return ""
+}
+
+func (x *Vehicle) GetBranch() string {
+	if x != nil {
+		return x.Branch
+	}
+	return ""
+}
+
+func (x *Vehicle) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+type ListCarsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Exact matches on the fields GET /cars filters on, including the _min and
+	// _max range filters, e.g. {"manufacturer": "Ford", "year_min": "2018"}.
+	Filter map[string]string `protobuf:"bytes,1,rep,name=filter,proto3" json:"filter,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Comma separated fields; prefix with - for descending. Cannot be used
+	// with page_token.
+	Sort string `protobuf:"bytes,2,opt,name=sort,proto3" json:"sort,omitempty"`
+	// At most 500; 50 when not set.
+	PageSize int32 `protobuf:"varint,3,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	// next_page_token of the previous response.
+	PageToken     string `protobuf:"bytes,4,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListCarsRequest) Reset() {
+	*x = ListCarsRequest{}
+	mi := &file_cars_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCarsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCarsRequest) ProtoMessage() {}
+
+func (x *ListCarsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCarsRequest.ProtoReflect.Descriptor instead.
+func (*ListCarsRequest) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListCarsRequest) GetFilter() map[string]string {
+	if x != nil {
+		return x.Filter
+	}
+	return nil
+}
+
+func (x *ListCarsRequest) GetSort() string {
+	if x != nil {
+		return x.Sort
+	}
+	return ""
+}
+
+func (x *ListCarsRequest) GetPageSize() int32 {
+	if x != nil {
+		return x.PageSize
+	}
+	return 0
+}
+
+func (x *ListCarsRequest) GetPageToken() string {
+	if x != nil {
+		return x.PageToken
+	}
+	return ""
+}
+
+type ListCarsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Cars  []*Vehicle             `protobuf:"bytes,1,rep,name=cars,proto3" json:"cars,omitempty"`
+	Total int64                  `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	// Empty on the last page.
+	NextPageToken string `protobuf:"bytes,3,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListCarsResponse) Reset() {
+	*x = ListCarsResponse{}
+	mi := &file_cars_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCarsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCarsResponse) ProtoMessage() {}
+
+func (x *ListCarsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCarsResponse.ProtoReflect.Descriptor instead.
+func (*ListCarsResponse) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListCarsResponse) GetCars() []*Vehicle {
+	if x != nil {
+		return x.Cars
+	}
+	return nil
+}
+
+func (x *ListCarsResponse) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *ListCarsResponse) GetNextPageToken() string {
+	if x != nil {
+		return x.NextPageToken
+	}
+	return ""
+}
+
+type GetCarRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Vin           string                 `protobuf:"bytes,1,opt,name=vin,proto3" json:"vin,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCarRequest) Reset() {
+	*x = GetCarRequest{}
+	mi := &file_cars_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCarRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCarRequest) ProtoMessage() {}
+
+func (x *GetCarRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCarRequest.ProtoReflect.Descriptor instead.
+func (*GetCarRequest) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetCarRequest) GetVin() string {
+	if x != nil {
+		return x.Vin
+	}
+	return ""
+}
+
+type CreateCarRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Car           *Vehicle               `protobuf:"bytes,1,opt,name=car,proto3" json:"car,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateCarRequest) Reset() {
+	*x = CreateCarRequest{}
+	mi := &file_cars_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateCarRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateCarRequest) ProtoMessage() {}
+
+func (x *CreateCarRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateCarRequest.ProtoReflect.Descriptor instead.
+func (*CreateCarRequest) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CreateCarRequest) GetCar() *Vehicle {
+	if x != nil {
+		return x.Car
+	}
+	return nil
+}
+
+// Replaces every field of the car with the VIN of car.
+type UpdateCarRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Car           *Vehicle               `protobuf:"bytes,1,opt,name=car,proto3" json:"car,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateCarRequest) Reset() {
+	*x = UpdateCarRequest{}
+	mi := &file_cars_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateCarRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateCarRequest) ProtoMessage() {}
+
+func (x *UpdateCarRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateCarRequest.ProtoReflect.Descriptor instead.
+func (*UpdateCarRequest) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *UpdateCarRequest) GetCar() *Vehicle {
+	if x != nil {
+		return x.Car
+	}
+	return nil
+}
+
+type DeleteCarRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Vin           string                 `protobuf:"bytes,1,opt,name=vin,proto3" json:"vin,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteCarRequest) Reset() {
+	*x = DeleteCarRequest{}
+	mi := &file_cars_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteCarRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteCarRequest) ProtoMessage() {}
+
+func (x *DeleteCarRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_cars_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteCarRequest.ProtoReflect.Descriptor instead.
+func (*DeleteCarRequest) Descriptor() ([]byte, []int) {
+	return file_cars_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DeleteCarRequest) GetVin() string {
+	if x != nil {
+		return x.Vin
+	}
+	return ""
+}
+
+var File_cars_proto protoreflect.FileDescriptor
+
+const file_cars_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"cars.proto\x12\x11carsupermarket.v1\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1fgoogle/protobuf/timestamp.proto\";\n" +
+	"\x05Price\x12\x16\n" +
+	"\x06amount\x18\x01 \x01(\x03R\x06amount\x12\x1a\n" +
+	"\bcurrency\x18\x02 \x01(\tR\bcurrency\"\xbd\x03\n" +
+	"\aVehicle\x12\"\n" +
+	"\fmanufacturer\x18\x01 \x01(\tR\fmanufacturer\x12\x14\n" +
+	"\x05model\x18\x02 \x01(\tR\x05model\x12\x10\n" +
+	"\x03vin\x18\x03 \x01(\tR\x03vin\x12\x14\n" +
+	"\x05regno\x18\x04 \x01(\tR\x05regno\x12\x16\n" +
+	"\x06dealer\x18\x05 \x01(\tR\x06dealer\x123\n" +
+	"\asold_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\x06soldAt\x12.\n" +
+	"\x05price\x18\a \x01(\v2\x18.carsupermarket.v1.PriceR\x05price\x12\x18\n" +
+	"\amileage\x18\b \x01(\x05R\amileage\x12\x12\n" +
+	"\x04year\x18\t \x01(\x05R\x04year\x12\x1b\n" +
+	"\tfuel_type\x18\n" +
+	" \x01(\tR\bfuelType\x12\"\n" +
+	"\ftransmission\x18\v \x01(\tR\ftransmission\x12\x16\n" +
+	"\x06colour\x18\f \x01(\tR\x06colour\x12\x1c\n" +
+	"\tcondition\x18\r \x01(\tR\tcondition\x12\x16\n" +
+	"\x06branch\x18\x0e \x01(\tR\x06branch\x12\x16\n" +
+	"\x06status\x18\x0f \x01(\tR\x06status\"\xe4\x01\n" +
+	"\x0fListCarsRequest\x12F\n" +
+	"\x06filter\x18\x01 \x03(\v2..carsupermarket.v1.ListCarsRequest.FilterEntryR\x06filter\x12\x12\n" +
+	"\x04sort\x18\x02 \x01(\tR\x04sort\x12\x1b\n" +
+	"\tpage_size\x18\x03 \x01(\x05R\bpageSize\x12\x1d\n" +
+	"\n" +
+	"page_token\x18\x04 \x01(\tR\tpageToken\x1a9\n" +
+	"\vFilterEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x80\x01\n" +
+	"\x10ListCarsResponse\x12.\n" +
+	"\x04cars\x18\x01 \x03(\v2\x1a.carsupermarket.v1.VehicleR\x04cars\x12\x14\n" +
+	"\x05total\x18\x02 \x01(\x03R\x05total\x12&\n" +
+	"\x0fnext_page_token\x18\x03 \x01(\tR\rnextPageToken\"!\n" +
+	"\rGetCarRequest\x12\x10\n" +
+	"\x03vin\x18\x01 \x01(\tR\x03vin\"@\n" +
+	"\x10CreateCarRequest\x12,\n" +
+	"\x03car\x18\x01 \x01(\v2\x1a.carsupermarket.v1.VehicleR\x03car\"@\n" +
+	"\x10UpdateCarRequest\x12,\n" +
+	"\x03car\x18\x01 \x01(\v2\x1a.carsupermarket.v1.VehicleR\x03car\"$\n" +
+	"\x10DeleteCarRequest\x12\x10\n" +
+	"\x03vin\x18\x01 \x01(\tR\x03vin2\x8f\x03\n" +
+	"\n" +
+	"CarService\x12S\n" +
+	"\bListCars\x12\".carsupermarket.v1.ListCarsRequest\x1a#.carsupermarket.v1.ListCarsResponse\x12F\n" +
+	"\x06GetCar\x12 .carsupermarket.v1.GetCarRequest\x1a\x1a.carsupermarket.v1.Vehicle\x12L\n" +
+	"\tCreateCar\x12#.carsupermarket.v1.CreateCarRequest\x1a\x1a.carsupermarket.v1.Vehicle\x12L\n" +
+	"\tUpdateCar\x12#.carsupermarket.v1.UpdateCarRequest\x1a\x1a.carsupermarket.v1.Vehicle\x12H\n" +
+	"\tDeleteCar\x12#.carsupermarket.v1.DeleteCarRequest\x1a\x16.google.protobuf.EmptyB&\n" +
+	"\x15com.carsupermarket.v1P\x01Z\vproto/carpbb\x06proto3"
+
+var (
+	file_cars_proto_rawDescOnce sync.Once
+	file_cars_proto_rawDescData []byte
+)
+
+func file_cars_proto_rawDescGZIP() []byte {
+	file_cars_proto_rawDescOnce.Do(func() {
+		file_cars_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_cars_proto_rawDesc), len(file_cars_proto_rawDesc)))
+	})
+	return file_cars_proto_rawDescData
+}
+
+var file_cars_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_cars_proto_goTypes = []any{
+	(*Price)(nil),                 // 0: carsupermarket.v1.Price
+	(*Vehicle)(nil),               // 1: carsupermarket.v1.Vehicle
+	(*ListCarsRequest)(nil),       // 2: carsupermarket.v1.ListCarsRequest
+	(*ListCarsResponse)(nil),      // 3: carsupermarket.v1.ListCarsResponse
+	(*GetCarRequest)(nil),         // 4: carsupermarket.v1.GetCarRequest
+	(*CreateCarRequest)(nil),      // 5: carsupermarket.v1.CreateCarRequest
+	(*UpdateCarRequest)(nil),      // 6: carsupermarket.v1.UpdateCarRequest
+	(*DeleteCarRequest)(nil),      // 7: carsupermarket.v1.DeleteCarRequest
+	nil,                           // 8: carsupermarket.v1.ListCarsRequest.FilterEntry
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 10: google.protobuf.Empty
+}
+var file_cars_proto_depIdxs = []int32{
+	9,  // 0: carsupermarket.v1.Vehicle.sold_at:type_name -> google.protobuf.Timestamp
+	0,  // 1: carsupermarket.v1.Vehicle.price:type_name -> carsupermarket.v1.Price
+	8,  // 2: carsupermarket.v1.ListCarsRequest.filter:type_name -> carsupermarket.v1.ListCarsRequest.FilterEntry
+	1,  // 3: carsupermarket.v1.ListCarsResponse.cars:type_name -> carsupermarket.v1.Vehicle
+	1,  // 4: carsupermarket.v1.CreateCarRequest.car:type_name -> carsupermarket.v1.Vehicle
+	1,  // 5: carsupermarket.v1.UpdateCarRequest.car:type_name -> carsupermarket.v1.Vehicle
+	2,  // 6: carsupermarket.v1.CarService.ListCars:input_type -> carsupermarket.v1.ListCarsRequest
+	4,  // 7: carsupermarket.v1.CarService.GetCar:input_type -> carsupermarket.v1.GetCarRequest
+	5,  // 8: carsupermarket.v1.CarService.CreateCar:input_type -> carsupermarket.v1.CreateCarRequest
+	6,  // 9: carsupermarket.v1.CarService.UpdateCar:input_type -> carsupermarket.v1.UpdateCarRequest
+	7,  // 10: carsupermarket.v1.CarService.DeleteCar:input_type -> carsupermarket.v1.DeleteCarRequest
+	3,  // 11: carsupermarket.v1.CarService.ListCars:output_type -> carsupermarket.v1.ListCarsResponse
+	1,  // 12: carsupermarket.v1.CarService.GetCar:output_type -> carsupermarket.v1.Vehicle
+	1,  // 13: carsupermarket.v1.CarService.CreateCar:output_type -> carsupermarket.v1.Vehicle
+	1,  // 14: carsupermarket.v1.CarService.UpdateCar:output_type -> carsupermarket.v1.Vehicle
+	10, // 15: carsupermarket.v1.CarService.DeleteCar:output_type -> google.protobuf.Empty
+	11, // [11:16] is the sub-list for method output_type
+	6,  // [6:11] is the sub-list for method input_type
+	6,  // [6:6] is the sub-list for extension type_name
+	6,  // [6:6] is the sub-list for extension extendee
+	0,  // [0:6] is the sub-list for field type_name
+}
+
+func init() { file_cars_proto_init() }
+func file_cars_proto_init() {
+	if File_cars_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_cars_proto_rawDesc), len(file_cars_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_cars_proto_goTypes,
+		DependencyIndexes: file_cars_proto_depIdxs,
+		MessageInfos:      file_cars_proto_msgTypes,
+	}.Build()
+	File_cars_proto = out.File
+	file_cars_proto_goTypes = nil
+	file_cars_proto_depIdxs = nil
+}
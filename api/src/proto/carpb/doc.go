@@ -0,0 +1,4 @@
+// Package carpb holds the gRPC service generated from cars.proto.
+package carpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cars.proto
@@ -0,0 +1,500 @@
+// Package qr encodes text as QR codes, as ISO/IEC 18004 specifies, for short
+// texts such as URLs: in byte mode and up to version 10, a grid of 57
+// modules, which holds 119 to 271 bytes by the error correction level.
+//
+//	code, err := qr.Encode([]byte("https://cars.example.com/cars/WVWZZZ1JZXW000001"), qr.M)
+//	img := code.Image(8)
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Level is an error correction level: how much of a code can be damaged and
+// still be read, at the cost of how much it holds.
+type Level int
+
+// The levels, which restore about 7%, 15%, 25% and 30% of a code.
+const (
+	L Level = iota
+	M
+	Q
+	H
+)
+
+// ParseLevel returns the level named L, M, Q or H, in either case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return L, nil
+	case "M":
+		return M, nil
+	case "Q":
+		return Q, nil
+	case "H":
+		return H, nil
+	}
+	return 0, fmt.Errorf("qr: unknown error correction level %q", s)
+}
+
+func (l Level) String() string {
+	return [...]string{"L", "M", "Q", "H"}[l]
+}
+
+// formatBits is the level as the format information writes it.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+// ErrTooLong is returned for text too long for a code of the level.
+var ErrTooLong = errors.New("qr: text too long to encode")
+
+// maxVersion is the largest version encoded.
+const maxVersion = 10
+
+// blocks says how a version's codewords are split at a level: into blocks
+// of ec error correction codewords, count1 with data1 data codewords and
+// count2 with one more.
+type blocks struct {
+	ec, count1, data1, count2 int
+}
+
+var blockTable = [maxVersion + 1][4]blocks{
+	1:  {{7, 1, 19, 0}, {10, 1, 16, 0}, {13, 1, 13, 0}, {17, 1, 9, 0}},
+	2:  {{10, 1, 34, 0}, {16, 1, 28, 0}, {22, 1, 22, 0}, {28, 1, 16, 0}},
+	3:  {{15, 1, 55, 0}, {26, 1, 44, 0}, {18, 2, 17, 0}, {22, 2, 13, 0}},
+	4:  {{20, 1, 80, 0}, {18, 2, 32, 0}, {26, 2, 24, 0}, {16, 4, 9, 0}},
+	5:  {{26, 1, 108, 0}, {24, 2, 43, 0}, {18, 2, 15, 2}, {22, 2, 11, 2}},
+	6:  {{18, 2, 68, 0}, {16, 4, 27, 0}, {24, 4, 19, 0}, {28, 4, 15, 0}},
+	7:  {{20, 2, 78, 0}, {18, 4, 31, 0}, {18, 2, 14, 4}, {26, 4, 13, 1}},
+	8:  {{24, 2, 97, 0}, {22, 2, 38, 2}, {22, 4, 18, 2}, {26, 4, 14, 2}},
+	9:  {{30, 2, 116, 0}, {22, 3, 36, 2}, {20, 4, 16, 4}, {24, 4, 12, 4}},
+	10: {{18, 2, 68, 2}, {26, 4, 43, 1}, {24, 6, 19, 2}, {28, 6, 15, 2}},
+}
+
+// alignment are the rows and columns of each version's alignment patterns.
+var alignment = [maxVersion + 1][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+func (b blocks) data() int {
+	return b.count1*b.data1 + b.count2*(b.data1+1)
+}
+
+// Code is an encoded QR code: a square of dark and light modules.
+type Code struct {
+	Version int
+	Level   Level
+	// Size is how many modules wide and tall the code is, without the quiet
+	// zone around it.
+	Size    int
+	modules []bool
+}
+
+// Dark reports whether the module in column x of row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y*c.Size+x]
+}
+
+// QuietZone is how many light modules wide the margin readers need around
+// a code is.
+const QuietZone = 4
+
+// Image draws the code, with its quiet zone, at scale pixels a module.
+func (c *Code) Image(scale int) *image.Paletted {
+	side := (c.Size + 2*QuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				row := img.Pix[((y+QuietZone)*scale+py)*img.Stride:]
+				for px := 0; px < scale; px++ {
+					row[(x+QuietZone)*scale+px] = 1
+				}
+			}
+		}
+	}
+	return img
+}
+
+// Capacity returns how many bytes the largest code of the level holds.
+func Capacity(level Level) int {
+	return blockTable[maxVersion][level].data() - 3
+}
+
+// Encode returns the smallest code of the level that holds text.
+func Encode(text []byte, level Level) (*Code, error) {
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if len(text) <= blockTable[v][level].data()-headerBytes(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	c := newCode(version, level)
+	c.drawData(codewords(text, version, level))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return &c.Code, nil
+}
+
+// headerBytes is how many bytes the mode and length of the text take up,
+// with the terminator, rounded up.
+func headerBytes(version int) int {
+	if version < 10 {
+		return 2
+	}
+	return 3
+}
+
+// codewords returns text in byte mode, padded to the data capacity of the
+// version, with the error correction added and the blocks interleaved.
+func codewords(text []byte, version int, level Level) []byte {
+	b := blockTable[version][level]
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	if version < 10 {
+		bits.append(len(text), 8)
+	} else {
+		bits.append(len(text), 16)
+	}
+	for _, c := range text {
+		bits.append(int(c), 8)
+	}
+	capacity := b.data() * 8
+	bits.append(0, min(4, capacity-bits.n))
+	bits.append(0, (8-bits.n%8)%8)
+	for pad := 0xec; bits.n < capacity; pad ^= 0xec ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	var data, ec [][]byte
+	gen := generator(b.ec)
+	rest := bits.bytes
+	for i := 0; i < b.count1+b.count2; i++ {
+		n := b.data1
+		if i >= b.count1 {
+			n++
+		}
+		data = append(data, rest[:n])
+		ec = append(ec, remainder(rest[:n], gen))
+		rest = rest[n:]
+	}
+
+	var out []byte
+	for i := 0; i <= b.data1; i++ {
+		for _, block := range data {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, block := range ec {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+type bitBuffer struct {
+	bytes []byte
+	n     int
+}
+
+// append adds the low count bits of v, most significant first.
+func (b *bitBuffer) append(v, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if v>>i&1 == 1 {
+			b.bytes[len(b.bytes)-1] |= 0x80 >> (b.n % 8)
+		}
+		b.n++
+	}
+}
+
+// Reed-Solomon arithmetic in GF(256), modulo x^8 + x^4 + x^3 + x^2 + 1.
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// generator returns the generator polynomial of n error correction
+// codewords, highest power first, without its leading 1.
+func generator(n int) []byte {
+	g := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfExp[i])
+		}
+		g = next
+	}
+	return g[1:]
+}
+
+// remainder returns the error correction codewords of data.
+func remainder(data, gen []byte) []byte {
+	r := make([]byte, len(gen))
+	for _, d := range data {
+		factor := d ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i, g := range gen {
+			r[i] ^= gfMul(g, factor)
+		}
+	}
+	return r
+}
+
+// builder lays out a code, keeping which modules its function patterns
+// take, which data and masks are not written to.
+type builder struct {
+	Code
+	function []bool
+}
+
+func newCode(version int, level Level) *builder {
+	size := 17 + 4*version
+	c := &builder{Code: Code{Version: version, Level: level, Size: size, modules: make([]bool, size*size)}, function: make([]bool, size*size)}
+
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	c.finder(3, 3)
+	c.finder(size-4, 3)
+	c.finder(3, size-4)
+	pos := alignment[version]
+	for i, x := range pos {
+		for j, y := range pos {
+			last := len(pos) - 1
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// The format is drawn once the mask is chosen; its modules are
+	// reserved until then.
+	c.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			c.set(a, b, bits>>i&1 == 1)
+			c.set(b, a, bits>>i&1 == 1)
+		}
+	}
+	return c
+}
+
+// finder draws a finder pattern centred on x, y, with its light separator.
+func (c *builder) finder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			if x+dx < 0 || x+dx >= c.Size || y+dy < 0 || y+dy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(x+dx, y+dy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *builder) set(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+// drawFormat writes the level and mask, twice.
+func (c *builder) drawFormat(mask int) {
+	data := c.Level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	c.set(8, c.Size-8, true)
+}
+
+// drawData writes the codewords in the zigzag of two module wide columns,
+// from the bottom right corner, around the function patterns.
+func (c *builder) drawData(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.function[y*c.Size+x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = data[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules the mask selects; applying it again
+// undoes it.
+func (c *builder) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y*c.Size+x] {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read, by the four rules of the
+// specification a mask is chosen by: the lower the better.
+func (c *builder) penalty() int {
+	n := c.Size
+	p := 0
+	line := func(at func(i int) bool) {
+		run := 1
+		for i := 1; i <= n; i++ {
+			if i < n && at(i) == at(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				p += run - 2
+			}
+			run = 1
+		}
+		// A finder-like 1:1:3:1:1, with four light modules on one side.
+		on := func(i int) bool { return i >= 0 && i < n && at(i) }
+		for i := 0; i < n; i++ {
+			if on(i) && !on(i+1) && on(i+2) && on(i+3) && on(i+4) && !on(i+5) && on(i+6) {
+				before := !on(i-1) && !on(i-2) && !on(i-3) && !on(i-4)
+				after := !on(i+7) && !on(i+8) && !on(i+9) && !on(i+10)
+				if before || after {
+					p += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		line(func(x int) bool { return c.Dark(x, y) })
+	}
+	for x := 0; x < n; x++ {
+		line(func(y int) bool { return c.Dark(x, y) })
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.Dark(x, y) {
+				dark++
+			}
+			if x+1 < n && y+1 < n && c.Dark(x, y) == c.Dark(x+1, y) && c.Dark(x, y) == c.Dark(x, y+1) && c.Dark(x, y) == c.Dark(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+	p += abs(dark*20-n*n*10) / (n * n) * 10
+	return p
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
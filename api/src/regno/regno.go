@@ -0,0 +1,173 @@
+// Package regno validates vehicle registration marks by the formats of the
+// countries that issue them. Formats are looked up by name, or by the name of
+// a group of them such as gb, and more can be registered:
+//
+//	formats, err := regno.Parse("gb,ni")
+//	err = formats.Validate(regno.Normalize("ab12 cde"))
+package regno
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReasonFormat is why a registration is rejected when it has none of the
+// formats allowed.
+const ReasonFormat = "format"
+
+// Error describes why a registration is invalid.
+type Error struct {
+	Reason string
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Validator checks registrations issued in one format.
+type Validator interface {
+	// Name names the format, e.g. gb-current.
+	Name() string
+	// Valid reports whether a normalized registration has the format.
+	Valid(regno string) bool
+}
+
+// Pattern returns the validator of the registrations matching expr whole.
+func Pattern(name, expr string) Validator {
+	return pattern{name, regexp.MustCompile("^(?:" + expr + ")$")}
+}
+
+type pattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (p pattern) Name() string            { return p.name }
+func (p pattern) Valid(regno string) bool { return p.re.MatchString(regno) }
+
+// irishCounties are the index marks of the counties and cities of Ireland,
+// those retired in 2014 included, as cars registered under them still run.
+const irishCounties = "C|CE|CN|CW|D|DL|G|KE|KK|KY|L|LD|LH|LK|LM|LS|MH|MN|MO|OY|RN|SO|T|TN|TS|W|WD|WH|WW|WX"
+
+var (
+	mu         sync.RWMutex
+	validators = map[string]Validator{}
+	groups     = map[string][]string{}
+)
+
+func init() {
+	// Great Britain: since 2001 two letters of the area, two digits of the
+	// age and three random letters, e.g. AB12CDE; from 1983 a letter of
+	// the year first, e.g. A123BCD; from 1963 last, e.g. ABC123D; and
+	// before then none, e.g. ABC1234 or 1234AB.
+	Register(Pattern("gb-current", `[A-Z]{2}[0-9]{2}[A-Z]{3}`))
+	Register(Pattern("gb-prefix", `[A-Z][0-9]{1,3}[A-Z]{3}`))
+	Register(Pattern("gb-suffix", `[A-Z]{3}[0-9]{1,3}[A-Z]`))
+	Register(Pattern("gb-dateless", `[A-Z]{1,3}[0-9]{1,4}|[0-9]{1,4}[A-Z]{1,3}`))
+	// Northern Ireland: a county code holding I or Z, optionally after a
+	// serial letter, then up to four digits, e.g. AIZ1234.
+	Register(Pattern("ni", `[A-Z]?(?:I[A-Z]|[A-Z][IZ])[0-9]{1,4}`))
+	// Ireland: since 1987 the year, and since 2013 its half, the county
+	// and a serial number, e.g. 191D12345 or 08KY123.
+	Register(Pattern("ie", `[0-9]{2,3}(?:`+irishCounties+`)[0-9]{1,6}`))
+
+	Group("gb", "gb-current", "gb-prefix", "gb-suffix", "gb-dateless")
+	Group("uk", "gb", "ni")
+}
+
+// Register adds a format, replacing any of the same name.
+func Register(v Validator) {
+	mu.Lock()
+	defer mu.Unlock()
+	validators[v.Name()] = v
+}
+
+// Group names formats, or other groups, to be allowed together.
+func Group(name string, members ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	groups[name] = members
+}
+
+// Names lists the formats and groups there are.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(validators)+len(groups))
+	for name := range validators {
+		names = append(names, name)
+	}
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Normalize returns regno as registrations are stored: in capitals, without
+// whitespace. It is not checked.
+func Normalize(regno string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(regno), ""))
+}
+
+// Set is the formats a registration may have. The empty set allows any.
+type Set []Validator
+
+// Parse returns the set of the comma separated formats and groups named.
+func Parse(names string) (Set, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	var s Set
+	seen := map[string]bool{}
+	var add func(name string, depth int) error
+	add = func(name string, depth int) error {
+		if v, ok := validators[name]; ok {
+			if !seen[name] {
+				seen[name] = true
+				s = append(s, v)
+			}
+			return nil
+		}
+		members, ok := groups[name]
+		if !ok || depth > 8 {
+			return fmt.Errorf("unknown registration format %q", name)
+		}
+		for _, m := range members {
+			if err := add(m, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := add(name, 0); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate reports whether a normalized registration has one of the formats
+// of s. The returned error, if any, is an *Error.
+func (s Set) Validate(regno string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	for _, v := range s {
+		if v.Valid(regno) {
+			return nil
+		}
+	}
+	names := make([]string, len(s))
+	for i, v := range s {
+		names[i] = v.Name()
+	}
+	return &Error{ReasonFormat, "The registration must be in one of the formats " + strings.Join(names, ", ")}
+}
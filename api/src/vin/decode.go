@@ -0,0 +1,106 @@
+package vin
+
+// Decoded holds what can be read from a VIN without the manufacturer's own
+// (proprietary) tables. The vehicle model lives in the descriptor section and
+// cannot be decoded generically.
+type Decoded struct {
+	WMI          string `json:"wmi"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Country      string `json:"country,omitempty"`
+	Region       string `json:"region"`
+	Descriptor   string `json:"descriptor"`
+	ModelYear    int    `json:"model_year,omitempty"`
+	PlantCode    string `json:"plant_code"`
+	SerialNumber string `json:"serial_number"`
+}
+
+// manufacturers maps world manufacturer identifiers to the marque they were
+// assigned to.
+var manufacturers = map[string]string{
+	"1FA": "Ford", "1FT": "Ford", "1G1": "Chevrolet", "1HG": "Honda",
+	"1M8": "Motor Coach Industries", "2T1": "Toyota", "3VW": "Volkswagen",
+	"5YJ": "Tesla", "JHM": "Honda", "JMZ": "Mazda", "JN1": "Nissan",
+	"JTD": "Toyota", "KMH": "Hyundai", "KNA": "Kia", "SAJ": "Jaguar",
+	"SAL": "Land Rover", "SB1": "Toyota", "SCC": "Lotus", "SFA": "Ford",
+	"SJN": "Nissan", "TMB": "Skoda", "VF1": "Renault", "VF3": "Peugeot",
+	"VF7": "Citroen", "VSS": "SEAT", "WAU": "Audi", "WBA": "BMW",
+	"WDB": "Mercedes-Benz", "WDD": "Mercedes-Benz", "WF0": "Ford",
+	"WME": "Smart", "WMW": "MINI", "WP0": "Porsche", "WVW": "Volkswagen",
+	"WV1": "Volkswagen", "WV2": "Volkswagen", "YS3": "Saab", "YV1": "Volvo",
+	"ZAR": "Alfa Romeo", "ZFA": "Fiat", "ZFF": "Ferrari",
+}
+
+// countries maps the first one or two characters of a WMI to a country for
+// the common producing countries.
+var countries = map[string]string{
+	"1": "United States", "4": "United States", "5": "United States",
+	"2": "Canada", "3": "Mexico", "J": "Japan", "KL": "South Korea",
+	"KM": "South Korea", "KN": "South Korea", "L": "China",
+	"SA": "United Kingdom", "SB": "United Kingdom", "SC": "United Kingdom",
+	"SD": "United Kingdom", "SE": "United Kingdom", "SF": "United Kingdom",
+	"SJ": "United Kingdom", "TM": "Czech Republic", "VF": "France",
+	"VS": "Spain", "W": "Germany", "YS": "Sweden", "YV": "Sweden",
+	"Z": "Italy",
+}
+
+// Decode validates v and splits it into its ISO 3779 sections.
+func Decode(v string) (Decoded, error) {
+	if err := Validate(v); err != nil {
+		return Decoded{}, err
+	}
+
+	d := Decoded{
+		WMI:          v[:3],
+		Manufacturer: manufacturers[v[:3]],
+		Region:       region(v[0]),
+		Descriptor:   v[3:9],
+		ModelYear:    modelYear(v),
+		PlantCode:    v[10:11],
+		SerialNumber: v[11:],
+	}
+
+	if country, ok := countries[v[:2]]; ok {
+		d.Country = country
+	} else {
+		d.Country = countries[v[:1]]
+	}
+
+	return d, nil
+}
+
+func region(c byte) string {
+	switch {
+	case c >= 'A' && c <= 'H':
+		return "Africa"
+	case c >= 'J' && c <= 'R':
+		return "Asia"
+	case c >= 'S' && c <= 'Z':
+		return "Europe"
+	case c >= '1' && c <= '5':
+		return "North America"
+	case c == '6' || c == '7':
+		return "Oceania"
+	default:
+		return "South America"
+	}
+}
+
+const yearCodes = "ABCDEFGHJKLMNPRSTVWXY123456789"
+
+// modelYear reads the tenth character, which repeats every 30 years. As in
+// North American practice a letter in the seventh position selects the later
+// cycle (2010 onwards).
+func modelYear(v string) int {
+	for i := 0; i < len(yearCodes); i++ {
+		if yearCodes[i] != v[9] {
+			continue
+		}
+
+		year := 1980 + i
+		if c := v[6]; c >= 'A' && c <= 'Z' {
+			year += 30
+		}
+		return year
+	}
+	return 0
+}
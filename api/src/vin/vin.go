@@ -0,0 +1,90 @@
+// Package vin validates vehicle identification numbers as laid out in
+// ISO 3779.
+package vin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Length is the number of characters in a VIN.
+const Length = 17
+
+// Reasons a VIN can be rejected.
+const (
+	ReasonLength     = "length"
+	ReasonCharacter  = "character"
+	ReasonCheckDigit = "check_digit"
+)
+
+// Error describes why a VIN is invalid.
+type Error struct {
+	Reason string
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// transliteration holds the value of each letter used when computing the check
+// digit. I, O and Q are not allowed in a VIN and so are absent.
+var transliteration = map[byte]int{
+	'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5, 'F': 6, 'G': 7, 'H': 8,
+	'J': 1, 'K': 2, 'L': 3, 'M': 4, 'N': 5, 'P': 7, 'R': 9,
+	'S': 2, 'T': 3, 'U': 4, 'V': 5, 'W': 6, 'X': 7, 'Y': 8, 'Z': 9,
+}
+
+var weights = [Length]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// Normalize returns v as VINs are stored: in capitals, without whitespace.
+// It is not checked.
+func Normalize(v string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(v), ""))
+}
+
+// Validate reports whether v is a well formed VIN with a correct check digit
+// in the ninth position. The returned error, if any, is an *Error.
+func Validate(v string) error {
+	check, err := CheckDigit(v)
+	if err != nil {
+		return err
+	}
+	if v[8] != check {
+		return &Error{ReasonCheckDigit, fmt.Sprintf("Check digit %q does not match the expected %q", v[8], check)}
+	}
+
+	return nil
+}
+
+// CheckDigit returns the check digit v should have in its ninth position.
+// The character there does not count towards it but must be allowed, so a
+// VIN being made can hold a placeholder such as 0. The returned error, if
+// any, is an *Error.
+func CheckDigit(v string) (byte, error) {
+	if len(v) != Length {
+		return 0, &Error{ReasonLength, fmt.Sprintf("A VIN must be %d characters long", Length)}
+	}
+
+	sum := 0
+	for i := 0; i < Length; i++ {
+		value, ok := charValue(v[i])
+		if !ok {
+			return 0, &Error{ReasonCharacter, fmt.Sprintf("Character %q at position %d is not allowed in a VIN", v[i], i+1)}
+		}
+		sum += value * weights[i]
+	}
+
+	if sum%11 == 10 {
+		return 'X', nil
+	}
+	return byte('0' + sum%11), nil
+}
+
+func charValue(c byte) (int, bool) {
+	if c >= '0' && c <= '9' {
+		return int(c - '0'), true
+	}
+	value, ok := transliteration[c]
+	return value, ok
+}